@@ -0,0 +1,126 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parsePrefixes parses a list of networks in CIDR notation, a bare address
+// standing for itself
+func parsePrefixes(list stringList) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range list {
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q, expected CIDR notation such as 10.0.0.0/8", value)
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// allowlist restricts the clients of the HTTP endpoints to networks. The
+// zero value allows them all.
+type allowlist struct {
+	// all restricts all the endpoints, admin the state-changing ones
+	all   []netip.Prefix
+	admin []netip.Prefix
+	// trustProxy takes the client address from the X-Forwarded-For header
+	trustProxy bool
+}
+
+// newAllowlist returns the allowlist of the web settings. The networks of
+// the state-changing endpoints, if any, restrict them further.
+func newAllowlist(web WebConfig) (allowlist, error) {
+	all, err := parsePrefixes(web.AllowedCIDRs)
+	if err != nil {
+		return allowlist{}, err
+	}
+	admin, err := parsePrefixes(web.AdminAllowedCIDRs)
+	if err != nil {
+		return allowlist{}, err
+	}
+	return allowlist{all: all, admin: admin, trustProxy: web.TrustProxy}, nil
+}
+
+// clientAddr returns the address of the client of a request: that of the
+// connection, or, trusting the proxy, the last address of X-Forwarded-For,
+// appended by the proxy. The clients of a Unix domain socket have no
+// address, the zero Addr being returned.
+func (a allowlist) clientAddr(r *http.Request) (netip.Addr, error) {
+	var remote string
+	if forwarded := r.Header.Values("X-Forwarded-For"); a.trustProxy && len(forwarded) > 0 {
+		hops := strings.Split(forwarded[len(forwarded)-1], ",")
+		remote = strings.Trim(strings.TrimSpace(hops[len(hops)-1]), "[]")
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remote = host
+	} else {
+		return netip.Addr{}, nil
+	}
+	// Zones are not part of the networks
+	remote, _, _ = strings.Cut(remote, "%")
+	addr, err := netip.ParseAddr(remote)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid client address %q", remote)
+	}
+	return addr.Unmap(), nil
+}
+
+// allows tells whether the client of a request is in one of the networks,
+// an empty list allowing any client. The clients of a Unix domain socket
+// are local, and allowed.
+func (a allowlist) allows(prefixes []netip.Prefix, r *http.Request) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	addr, err := a.clientAddr(r)
+	if err != nil {
+		return false
+	}
+	if !addr.IsValid() {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowClients answers 403 to the requests of the clients outside the
+// allowed networks of the active configuration
+func allowClients(manager *configManager, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowlist := manager.current().allowlist
+		if !allowlist.allows(allowlist.all, r) {
+			http.Error(w, "Client address not allowed.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		cidrs      stringList
+		trustProxy bool
+		remote     string
+		forwarded  []string
+		allowed    bool
+	}{
+		{name: "no restriction", remote: "203.0.113.7:4242", allowed: true},
+		{name: "v4 allowed", cidrs: stringList{"10.0.0.0/8", "192.168.0.0/16"}, remote: "192.168.1.20:4242", allowed: true},
+		{name: "v4 denied", cidrs: stringList{"10.0.0.0/8", "192.168.0.0/16"}, remote: "172.16.0.1:4242"},
+		{name: "v4 address", cidrs: stringList{"192.0.2.1"}, remote: "192.0.2.1:4242", allowed: true},
+		{name: "v4 other address", cidrs: stringList{"192.0.2.1"}, remote: "192.0.2.2:4242"},
+		{name: "v4 mapped", cidrs: stringList{"10.0.0.0/8"}, remote: "[::ffff:10.1.2.3]:4242", allowed: true},
+		{name: "v4 mapped network", cidrs: stringList{"::ffff:10.0.0.0/104"}, remote: "10.1.2.3:4242", allowed: true},
+		{name: "v6 allowed", cidrs: stringList{"2001:db8::/32"}, remote: "[2001:db8::1]:4242", allowed: true},
+		{name: "v6 denied", cidrs: stringList{"2001:db8::/32"}, remote: "[2001:db9::1]:4242"},
+		{name: "v6 zone", cidrs: stringList{"fe80::/10"}, remote: "[fe80::1%eth0]:4242", allowed: true},
+		{name: "v6 loopback", cidrs: stringList{"127.0.0.0/8", "::1/128"}, remote: "[::1]:4242", allowed: true},
+		{name: "v4 client of a v6 network", cidrs: stringList{"::/0"}, remote: "192.0.2.1:4242"},
+		{name: "unix socket", cidrs: stringList{"10.0.0.0/8"}, remote: "@", allowed: true},
+		{name: "untrusted forwarded", cidrs: stringList{"10.0.0.0/8"}, remote: "192.0.2.1:4242", forwarded: []string{"10.0.0.1"}},
+		{name: "untrusted forwarded from allowed proxy", cidrs: stringList{"10.0.0.0/8"}, remote: "10.0.0.2:4242", forwarded: []string{"192.0.2.1"}, allowed: true},
+		{name: "trusted forwarded", cidrs: stringList{"10.0.0.0/8"}, trustProxy: true, remote: "192.0.2.1:4242", forwarded: []string{"10.0.0.1"}, allowed: true},
+		{name: "trusted forwarded denied", cidrs: stringList{"10.0.0.0/8"}, trustProxy: true, remote: "10.0.0.2:4242", forwarded: []string{"192.0.2.1"}},
+		{name: "trusted forwarded last hop", cidrs: stringList{"10.0.0.0/8"}, trustProxy: true, remote: "192.0.2.1:4242", forwarded: []string{"192.0.2.9, 10.0.0.1"}, allowed: true},
+		{name: "trusted forwarded spoofed first hop", cidrs: stringList{"10.0.0.0/8"}, trustProxy: true, remote: "192.0.2.1:4242", forwarded: []string{"10.0.0.1, 192.0.2.9"}},
+		{name: "trusted forwarded last header", cidrs: stringList{"10.0.0.0/8"}, trustProxy: true, remote: "192.0.2.1:4242", forwarded: []string{"192.0.2.9", "10.0.0.1"}, allowed: true},
+		{name: "trusted forwarded v6", cidrs: stringList{"2001:db8::/32"}, trustProxy: true, remote: "10.0.0.2:4242", forwarded: []string{"2001:db8::5"}, allowed: true},
+		{name: "trusted forwarded bracketed v6", cidrs: stringList{"2001:db8::/32"}, trustProxy: true, remote: "10.0.0.2:4242", forwarded: []string{"[2001:db8::5]"}, allowed: true},
+		{name: "trusted forwarded invalid", cidrs: stringList{"10.0.0.0/8"}, trustProxy: true, remote: "10.0.0.2:4242", forwarded: []string{"unknown"}},
+		{name: "trusted without header", cidrs: stringList{"10.0.0.0/8"}, trustProxy: true, remote: "10.0.0.2:4242", allowed: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			allowlist, err := newAllowlist(WebConfig{AllowedCIDRs: test.cidrs, TrustProxy: test.trustProxy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			r.RemoteAddr = test.remote
+			for _, forwarded := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", forwarded)
+			}
+			if allowed := allowlist.allows(allowlist.all, r); allowed != test.allowed {
+				t.Errorf("Expected allowed %v, got %v", test.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestAllowClients(t *testing.T) {
+	args := []string{"--probe.only", "--web.allowed-cidrs", "10.0.0.0/8,2001:db8::/32", "--web.admin-allowed-cidrs", "10.1.0.0/16"}
+	config, err := parseTestConfig(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := newConfigManager(args, config, newExporter(context.Background(), nil, defaultConfig().Metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newRouter(config, manager, newRegistry(config, manager))
+	for _, test := range []struct {
+		method, path, remote string
+		code                 int
+	}{
+		{"GET", "/metrics", "10.2.0.1:4242", http.StatusOK},
+		{"GET", "/-/healthy", "[2001:db8::1]:4242", http.StatusOK},
+		{"GET", "/metrics", "192.0.2.1:4242", http.StatusForbidden},
+		{"GET", "/-/healthy", "[2001:db9::1]:4242", http.StatusForbidden},
+		{"POST", "/-/reload", "10.1.0.1:4242", http.StatusOK},
+		{"POST", "/-/reload", "10.2.0.1:4242", http.StatusForbidden},
+		{"POST", "/-/soak/pause", "[2001:db8::1]:4242", http.StatusForbidden},
+		{"POST", "/-/reload", "192.0.2.1:4242", http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.RemoteAddr = test.remote
+		h.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s from %s: expected status %d, got %d", test.method, test.path, test.remote, test.code, w.Code)
+		}
+	}
+
+	for _, cidrs := range []string{"10.0.0.0/33", "10.0.0.0/8,example.com", "2001:db8::/129"} {
+		if _, err := parseTestConfig("--web.allowed-cidrs", cidrs); err == nil {
+			t.Errorf("%s: expected an error", cidrs)
+		}
+		if _, err := parseTestConfig("--web.admin-allowed-cidrs", cidrs); err == nil {
+			t.Errorf("%s: expected an admin networks error", cidrs)
+		}
+	}
+}
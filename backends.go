@@ -0,0 +1,58 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// newBackendExporter returns the Exporter of the tests of a backend
+// compared with others. Like those of the links, it shares the outputs of
+// exporter, and its results are not saved to the state file. Its metrics
+// and results are labeled with the backend.
+func newBackendExporter(exporter *Exporter, backend string, config *Config) *Exporter {
+	e := newExporter(exporter.ctx, nil, config.Metrics)
+	e.backend = backend
+	e.labels = map[string]string{"backend": backend}
+	e.outputs = exporter.outputs
+	e.newClient = exporter.newClient
+	if backend == backendMock {
+		e.mock = newMockBackend(config.Mock)
+		e.newClient = e.mock.newClient
+	}
+	e.limiter = exporter.limiter
+	e.tracer = exporter.tracer
+	e.sinkMetrics = nil
+	return e
+}
+
+// newBackendExporters returns the Exporters of the compared backends, if
+// any, the first one testing the others after each of its tests
+func newBackendExporters(exporter *Exporter, config *Config) []*Exporter {
+	var backends []*Exporter
+	for _, backend := range config.Backends {
+		backends = append(backends, newBackendExporter(exporter, backend, config))
+	}
+	if len(backends) > 0 {
+		backends[0].followers = backends[1:]
+	}
+	return backends
+}
+
+// backendSettings returns the Speedtest settings of the tests of a
+// compared backend: those of the speedtest.net servers ignore the Mini
+// server
+func backendSettings(config SpeedtestConfig, backend string) SpeedtestConfig {
+	if backend == backendSpeedtest {
+		config.MiniURL = ""
+	}
+	return config
+}
@@ -0,0 +1,157 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+func TestBackends(t *testing.T) {
+	args := []string{"--backends", "speedtest,mini,mock", "--speedtest.mini-url", "http://mini.lan/speedtest/", "--speedtest.interval", "1h"}
+	config, err := parseTestConfig(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := newExporter(context.Background(), nil, config.Metrics)
+	// The tests of speedtest.net fail, those of the Mini server succeed
+	clients := []*fakeClient{
+		{server: speedtest.Server{ID: "1234"}, err: &speedtest.PhaseError{Phase: speedtest.PhaseDownload, Err: fmt.Errorf("connection reset by peer")}},
+		{server: speedtest.Server{ID: "mini"}, measurements: map[string]speedtest.Measurement{speedtest.PhaseDownload: {Value: 42}}},
+	}
+	var miniURLs []string
+	exporter.newClient = func(ctx context.Context, config *SpeedtestConfig, opts speedtest.Options) (speedtestClient, error) {
+		miniURLs = append(miniURLs, config.MiniURL)
+		return clients[len(miniURLs)-1], nil
+	}
+	manager, err := newConfigManager(args, config, exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.initClient()
+	if len(miniURLs) != 2 || miniURLs[0] != "" || miniURLs[1] != "http://mini.lan/speedtest/" {
+		t.Fatalf("Expected a client of the speedtest.net servers and one of the Mini server, got %q", miniURLs)
+	}
+	if initialized, _ := exporter.Status(); initialized {
+		t.Error("Expected the backends to run the tests instead of the exporter")
+	}
+	if err := manager.ready(); err != nil {
+		t.Errorf("Expected the exporter to be ready, got %s", err)
+	}
+
+	// A cycle tests every backend in turn
+	manager.backends[0].testCycle(triggerSchedule)
+	for i, client := range clients {
+		if len(client.runs) != 1 {
+			t.Errorf("Expected a test of backend %s, got %d", config.Backends[i], len(client.runs))
+		}
+	}
+
+	// The failure of speedtest doesn't suppress the results of the others
+	w := httptest.NewRecorder()
+	scrapeHandler(config, exporter, prometheus.NewRegistry(), manager.children()...).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := w.Body.String()
+	for _, line := range []string{
+		`speedtest_download{backend="mini",ip="unknown"} 42`,
+		`speedtest_download{backend="mock",ip="192.0.2.1"}`,
+		`speedtest_errors_total{backend="speedtest",phase="download",type="other"} 1`,
+		`speedtest_tests_total{backend="mini",trigger="schedule"} 1`,
+		`speedtest_tests_total{backend="speedtest",trigger="schedule"} 1`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %s, got:\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, `speedtest_download{backend="speedtest"`) {
+		t.Errorf("Expected no download of the failed backend, got:\n%s", metrics)
+	}
+
+	handler := &resultHandler{exporter: exporter, links: manager.children()}
+	for query, expected := range map[string]string{"": "speedtest", "?backend=mini": "mini", "?backend=mock": "mock"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/result"+query, nil))
+		var result Result
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil || result.Backend != expected || result.Labels["backend"] != expected {
+			t.Errorf("Expected the result of %s for %q, got %+v (%v)", expected, query, result, err)
+		}
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/result?backend=cloudflare", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown backend, got %d", w.Code)
+	}
+}
+
+func TestConfigBackends(t *testing.T) {
+	for _, args := range [][]string{
+		{"--backends", "speedtest,cloudflare"},
+		{"--backends", "speedtest,speedtest"},
+		{"--backends", "speedtest,mini"},
+		{"--backends", "speedtest,mock", "--backend", "mock"},
+		{"--backends", "speedtest,mock", "--probe.only"},
+		{"--backends", "speedtest,mock", "--speedtest.mode", "soak"},
+		{"--backends", "speedtest,mock", "--mock.download", "0"},
+	} {
+		if _, err := parseTestConfig(args...); err == nil {
+			t.Errorf("Expected an error with %q", args)
+		}
+	}
+	if _, err := parseTestConfig("--backends", "speedtest,mini", "--speedtest.mini-url", "http://mini.lan/speedtest/"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBackendsSchedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := defaultConfig()
+	config.Backends = stringList{backendSpeedtest, backendMini}
+	exporter := newExporter(ctx, nil, config.Metrics)
+	backends := newBackendExporters(exporter, config)
+	// The client of speedtest couldn't be created, that of mini is tested
+	// all the same
+	mini := &fakeClient{measurements: map[string]speedtest.Measurement{speedtest.PhaseDownload: {Value: 42}}}
+	backends[1].SetClient(mini)
+	for _, backend := range backends {
+		backend.SetInterval(time.Hour)
+	}
+	go backends[0].run()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if last, next := backends[1].Last(); last != nil {
+			if last.Backend != backendMini || last.Error != "" {
+				t.Errorf("Expected a successful test of mini, got %+v", last)
+			}
+			if _, next = backends[0].Last(); next.IsZero() {
+				t.Error("Expected the next cycle to be scheduled")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected mini to be tested without a client of speedtest")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// benchmarkAssumedRate is the bandwidth (bits per second) the data estimate
+// of benchmark-servers assumes without rate limit
+const benchmarkAssumedRate = 1000 * 1000 * 1000
+
+// benchmarkOptions are the settings of benchmark-servers
+type benchmarkOptions struct {
+	// ServerIDs are the servers benchmarked, or else the Top closest ones
+	// matching the server filter of the configuration
+	ServerIDs []string
+	Top       int
+	// Duration is the duration of the download of each server
+	Duration time.Duration
+	// Yes skips the confirmation of the data used
+	Yes bool
+	// Format is table or json
+	Format string
+}
+
+// benchmarkResult is the outcome of the benchmark of a server
+type benchmarkResult struct {
+	Rank          int     `json:"rank"`
+	ID            string  `json:"id"`
+	Sponsor       string  `json:"sponsor"`
+	Name          string  `json:"name"`
+	Country       string  `json:"country"`
+	Distance      float64 `json:"distance_km"`
+	Latency       float64 `json:"latency_ms"`
+	Jitter        float64 `json:"jitter_ms"`
+	Download      float64 `json:"download_mbps"`
+	DownloadBytes int64   `json:"download_bytes"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// runBenchmarkServers runs the benchmark-servers subcommand with its
+// arguments, the flags of the exporter followed by the server IDs, and
+// returns the exit code
+func runBenchmarkServers(args []string) int {
+	fs := flag.NewFlagSet("benchmark-servers", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s benchmark-servers [flags] [server ID...]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Tests the latency and a brief download of the given servers, or of the closest ones, in turn, and ranks them.")
+		fs.PrintDefaults()
+	}
+	opts := benchmarkOptions{}
+	fs.IntVar(&opts.Top, "top", 5, "Number of the closest servers matching -speedtest.server-ids and -speedtest.server-country-codes benchmarked when no server ID is given")
+	fs.DurationVar(&opts.Duration, "duration", 3*time.Second, "Duration of the download of each server")
+	fs.BoolVar(&opts.Yes, "yes", false, "Don't ask for confirmation of the data about to be used")
+	fs.StringVar(&opts.Format, "format", "table", "Output format: table or json")
+	config, err := parseConfig(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	opts.ServerIDs = fs.Args()
+
+	logLevel := promslog.NewLevel()
+	logLevel.Set(config.Log.Level)
+	logFormat := promslog.NewFormat()
+	logFormat.Set(config.Log.Format)
+	slog.SetDefault(promslog.New(&promslog.Config{Level: logLevel, Format: logFormat}))
+
+	if err := benchmarkServers(context.Background(), os.Stdout, os.Stderr, os.Stdin, config, opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// benchmarkServers tests the latency and a download of opts.Duration of
+// each server of opts in turn, with the settings of config, and writes
+// their ranking to w, by download bandwidth then latency, the failed
+// servers last. Unless opts.Yes, the data about to be used is confirmed on
+// prompt and in first.
+func benchmarkServers(ctx context.Context, w io.Writer, prompt io.Writer, in io.Reader, config *Config, opts benchmarkOptions) error {
+	if opts.Format != "table" && opts.Format != "json" {
+		return fmt.Errorf("Unknown output format %q, must be table or json", opts.Format)
+	}
+	if opts.Duration <= 0 || opts.Top < 1 {
+		return fmt.Errorf("The duration and the number of servers must be positive")
+	}
+	if config.Backend == backendMock || config.Speedtest.MiniURL != "" {
+		return fmt.Errorf("Only the speedtest.net servers can be benchmarked, not the mock backend nor a Speedtest Mini server")
+	}
+	auth, err := loadAuth(config.Speedtest.Auth)
+	if err != nil {
+		return err
+	}
+	transport, err := newSpeedtestTransport(&config.Speedtest)
+	if err != nil {
+		return err
+	}
+	active := &activeConfig{Config: config, auth: auth, transport: transport}
+	filter := config.Speedtest.serverFilter()
+	if len(opts.ServerIDs) > 0 {
+		filter = speedtest.ServerFilter{IDs: opts.ServerIDs}
+	}
+	setupCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+	client, err := speedtest.NewFilteredClient(setupCtx, config.Speedtest.ConfigURL, config.Speedtest.ServerURL, filter, active.clientOptions())
+	cancel()
+	if err != nil {
+		return fmt.Errorf("Can't retrieve the Speedtest servers: %s", err)
+	}
+	servers := client.ClosestServers
+	if len(opts.ServerIDs) > 0 {
+		for _, id := range opts.ServerIDs {
+			if !hasServer(servers, id) {
+				slog.Warn("Unknown Speedtest server, skipped", "server_id", id)
+			}
+		}
+	} else if len(servers) > opts.Top {
+		servers = servers[:opts.Top]
+	}
+
+	config.Speedtest.configure(client, 0)
+	client.DownloadDuration = opts.Duration
+	client.Share, client.Hops, client.Duplex = false, false, false
+	if !opts.Yes && !confirmBenchmark(prompt, in, len(servers), opts.Duration, int64(config.Speedtest.RateLimit)) {
+		return fmt.Errorf("Benchmark aborted")
+	}
+
+	results := make([]benchmarkResult, len(servers))
+	for i, server := range servers {
+		slog.Info("Benchmarking server", "server_id", server.ID, "sponsor", server.Sponsor, "name", server.Name, "server", fmt.Sprintf("%d/%d", i+1, len(servers)))
+		results[i] = benchmarkResult{ID: server.ID, Sponsor: server.Sponsor, Name: server.Name, Country: server.Country, Distance: server.Distance}
+		client.Server = server
+		testCtx, cancel := context.WithTimeout(ctx, config.Probe.Timeout)
+		res, err := client.Run(testCtx, speedtest.PhaseDownload, speedtest.PhasePing)
+		cancel()
+		if err != nil {
+			slog.Warn("Server benchmark failed", "server_id", server.ID, "err", err)
+			results[i].Error = err.Error()
+		}
+		if res != nil {
+			results[i].Latency, results[i].Jitter = res.Ping, res.Jitter
+			results[i].Download, results[i].DownloadBytes = res.Download, res.BytesDown
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if (a.Error == "") != (b.Error == "") {
+			return a.Error == ""
+		}
+		if a.Download != b.Download {
+			return a.Download > b.Download
+		}
+		return a.Latency < b.Latency
+	})
+	for i := range results {
+		results[i].Rank = i + 1
+	}
+
+	if opts.Format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			Servers []benchmarkResult `json:"servers"`
+		}{results})
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tID\tSPONSOR\tNAME\tDISTANCE\tLATENCY\tJITTER\tDOWNLOAD\tERROR")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%.0f km\t%.2f ms\t%.2f ms\t%.2f Mbps\t%s\n",
+			r.Rank, r.ID, r.Sponsor, r.Name, r.Distance, r.Latency, r.Jitter, r.Download, r.Error)
+	}
+	return tw.Flush()
+}
+
+// hasServer tells whether the server of the given ID is one of servers
+func hasServer(servers []speedtest.Server, id string) bool {
+	for _, server := range servers {
+		if server.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmBenchmark warns about the data the downloads of the benchmark of
+// n servers may use, at the rate limit if any, and asks for confirmation
+func confirmBenchmark(prompt io.Writer, in io.Reader, n int, duration time.Duration, rateLimit int64) bool {
+	rate, basis := rateLimit, "the rate limit"
+	if rate <= 0 {
+		rate, basis = benchmarkAssumedRate, "assuming a 1 Gbps link"
+	}
+	bytes := float64(rate) / 8 * duration.Seconds() * float64(n)
+	fmt.Fprintf(prompt, "Benchmarking %d servers downloads for %s from each, up to %.0f MB at %.0f Mbps, %s. Continue? [y/N] ",
+		n, duration, bytes/1e6, float64(rate)/1e6, basis)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchmarkServers(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	config := defaultConfig()
+	config.Speedtest.ConfigURL = fake.URL + "/config.php"
+	config.Speedtest.ServerURL = fake.URL + "/servers.php"
+	opts := benchmarkOptions{Top: 5, Duration: 100 * time.Millisecond, Yes: true, Format: "table"}
+
+	var out strings.Builder
+	if err := benchmarkServers(context.Background(), &out, io.Discard, strings.NewReader(""), config, opts); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "RANK") || !strings.Contains(out.String(), "Near") || !strings.Contains(out.String(), "Far") {
+		t.Errorf("Expected the ranking of both servers, got:\n%s", out.String())
+	}
+	if !fake.requested("/near/random") || !fake.requested("/far/latency.txt") {
+		t.Error("Expected both servers to be tested")
+	}
+	if fake.requested("/near/upload.php") {
+		t.Error("Expected no upload")
+	}
+
+	// The given servers only, as JSON
+	out.Reset()
+	opts.ServerIDs, opts.Format = []string{"99"}, "json"
+	if err := benchmarkServers(context.Background(), &out, io.Discard, strings.NewReader(""), config, opts); err != nil {
+		t.Fatal(err)
+	}
+	var ranking struct {
+		Servers []benchmarkResult `json:"servers"`
+	}
+	if err := json.Unmarshal([]byte(out.String()), &ranking); err != nil {
+		t.Fatalf("Can't parse %s: %s", out.String(), err)
+	}
+	if len(ranking.Servers) != 1 || ranking.Servers[0].ID != "99" || ranking.Servers[0].Rank != 1 || ranking.Servers[0].Download <= 0 || ranking.Servers[0].Error != "" {
+		t.Errorf("Unexpected ranking %+v", ranking.Servers)
+	}
+}
+
+func TestBenchmarkServersConfirmation(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	config := defaultConfig()
+	config.Speedtest.ConfigURL = fake.URL + "/config.php"
+	config.Speedtest.ServerURL = fake.URL + "/servers.php"
+	config.Speedtest.RateLimit = 100 * 1000 * 1000
+	opts := benchmarkOptions{Top: 1, Duration: 2 * time.Second, Format: "table"}
+
+	var prompt strings.Builder
+	err := benchmarkServers(context.Background(), io.Discard, &prompt, strings.NewReader("n\n"), config, opts)
+	if err == nil {
+		t.Error("Expected the benchmark to be aborted")
+	}
+	if !strings.Contains(prompt.String(), "up to 25 MB at 100 Mbps, the rate limit") {
+		t.Errorf("Expected the data estimate, got %q", prompt.String())
+	}
+	if fake.requested("/near/random") {
+		t.Error("Expected no download once aborted")
+	}
+	opts.Duration = 100 * time.Millisecond
+	if err := benchmarkServers(context.Background(), io.Discard, io.Discard, strings.NewReader("y\n"), config, opts); err != nil {
+		t.Errorf("Expected the benchmark to run once confirmed, got %v", err)
+	}
+}
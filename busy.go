@@ -0,0 +1,160 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// skipLinkBusy is the reason of the tests skipped as the link was busy
+const skipLinkBusy = "link_busy"
+
+var errCountersReset = errors.New("Interface counters went back during the sample")
+
+// busyCheck samples the traffic of an interface before the bandwidth
+// tests: while a backup or another transfer saturates the link, a test
+// would only measure what is left of it, and slow the transfer down. The
+// tests finding the link busy are deferred a few times, then skipped.
+type busyCheck struct {
+	skipped *prometheus.CounterVec
+	// read returns the counters of an interface, failing on the platforms
+	// without them
+	read func(iface string) (speedtest.InterfaceBytes, error)
+
+	mu     sync.Mutex
+	config BusyConfig
+	// deferrals is the number of times the pending scheduled test was
+	// deferred
+	deferrals int
+	// warned tells whether the counters failing to be read was logged
+	warned bool
+}
+
+func newBusyCheck(namespace string) *busyCheck {
+	return &busyCheck{
+		skipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "skipped_tests_total",
+			Help:      "Number of tests not run, by reason: link_busy when the traffic of the checked interface exceeded the threshold.",
+		}, []string{"reason"}),
+		read: speedtest.ReadInterfaceBytes,
+	}
+}
+
+// setConfig sets the interface checked and the threshold, an empty
+// interface disabling the check
+func (b *busyCheck) setConfig(config BusyConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if config != b.config {
+		b.deferrals, b.warned = 0, false
+	}
+	b.config = config
+}
+
+func (b *busyCheck) settings() BusyConfig {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.config
+}
+
+// sample returns the traffic (bps) of the interface over the sample
+// duration, in the busier direction. It fails when the counters can't be
+// read, went back as when the interface was reset, or ctx is done.
+func (b *busyCheck) sample(ctx context.Context, config BusyConfig) (float64, error) {
+	before, err := b.read(config.Interface)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	timer := time.NewTimer(config.SampleDuration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	after, err := b.read(config.Interface)
+	if err != nil {
+		return 0, err
+	}
+	if after.Rx < before.Rx || after.Tx < before.Tx {
+		return 0, errCountersReset
+	}
+	busier := max(after.Rx-before.Rx, after.Tx-before.Tx)
+	return float64(busier) * 8 / time.Since(start).Seconds(), nil
+}
+
+// linkBusy samples the link before a test, unless the check is disabled,
+// and returns whether the test is held back. A scheduled test, deferrable,
+// is deferred by the returned delay while it is deferred fewer times than
+// the retries, and is otherwise skipped. The counters failing to be read,
+// the test is run.
+func (e *Exporter) linkBusy(ctx context.Context, deferrable bool) (bool, time.Duration) {
+	b := e.busy
+	config := b.settings()
+	if config.Interface == "" {
+		return false, 0
+	}
+	// The sample waits for the running tests, not to count their traffic
+	if err := e.limiter.acquire(ctx); err != nil {
+		return false, 0
+	}
+	rate, err := b.sample(ctx, config)
+	e.limiter.release()
+
+	logger := e.logger()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		if ctx.Err() == nil && !b.warned {
+			logger.Warn("Can't sample the traffic of the interface, the tests run whatever the traffic", "interface", config.Interface, "err", err)
+			b.warned = true
+		}
+		return false, 0
+	}
+	attrs := []any{"interface", config.Interface, "traffic_mbps", math.Round(rate/1e4) / 100, "threshold_mbps", float64(config.Threshold) / 1e6}
+	if rate <= float64(config.Threshold) {
+		logger.Debug("Link idle enough for the test", attrs...)
+		b.deferrals = 0
+		return false, 0
+	}
+	if deferrable && config.RetryDelay > 0 && b.deferrals < config.Retries {
+		b.deferrals++
+		logger.Info("Link busy, deferring the test", append(attrs, "delay", config.RetryDelay, "deferral", b.deferrals)...)
+		return true, config.RetryDelay
+	}
+	logger.Warn("Link busy, skipping the test", attrs...)
+	b.deferrals = 0
+	b.skipped.WithLabelValues(skipLinkBusy).Inc()
+	return true, 0
+}
+
+// Describe implements the prometheus.Collector interface
+func (b *busyCheck) Describe(ch chan<- *prometheus.Desc) {
+	b.skipped.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface
+func (b *busyCheck) Collect(ch chan<- prometheus.Metric) {
+	b.skipped.Collect(ch)
+}
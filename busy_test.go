@@ -0,0 +1,140 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// fakeCounters are interface counters transmitting tx bytes between two
+// reads
+type fakeCounters struct {
+	mu    sync.Mutex
+	tx    int64
+	total int64
+	err   error
+}
+
+func (c *fakeCounters) read(iface string) (speedtest.InterfaceBytes, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return speedtest.InterfaceBytes{}, c.err
+	}
+	c.total += c.tx
+	return speedtest.InterfaceBytes{Rx: 1000, Tx: c.total}, nil
+}
+
+func (c *fakeCounters) set(tx int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tx, c.err = tx, err
+}
+
+func newBusyExporter(ctx context.Context, config BusyConfig) (*Exporter, *fakeCounters) {
+	exporter := newExporter(ctx, nil, defaultConfig().Metrics)
+	counters := &fakeCounters{}
+	exporter.busy.read = counters.read
+	config.Threshold = 50 * 1000 * 1000
+	config.SampleDuration = 20 * time.Millisecond
+	exporter.busy.setConfig(config)
+	return exporter, counters
+}
+
+func TestLinkBusy(t *testing.T) {
+	exporter, counters := newBusyExporter(context.Background(), BusyConfig{Interface: "eth0", RetryDelay: time.Minute, Retries: 2})
+	skipped := exporter.busy.skipped.WithLabelValues(skipLinkBusy)
+
+	// 10 MB in 20ms is far above 50Mbps
+	counters.set(10*1000*1000, nil)
+	for i := 0; i < 2; i++ {
+		if busy, delay := exporter.linkBusy(context.Background(), true); !busy || delay != time.Minute {
+			t.Errorf("Expected deferral %d of a minute, got %v %s", i+1, busy, delay)
+		}
+	}
+	if busy, delay := exporter.linkBusy(context.Background(), true); !busy || delay != 0 {
+		t.Errorf("Expected the test to be skipped after the retries, got %v %s", busy, delay)
+	}
+	if value := testutil.ToFloat64(skipped); value != 1 {
+		t.Errorf("Expected 1 skipped test, got %v", value)
+	}
+	// The tests on scrape are not deferred
+	if busy, delay := exporter.linkBusy(context.Background(), false); !busy || delay != 0 {
+		t.Errorf("Expected the test on scrape to be skipped, got %v %s", busy, delay)
+	}
+	if value := testutil.ToFloat64(skipped); value != 2 {
+		t.Errorf("Expected 2 skipped tests, got %v", value)
+	}
+
+	// 10 kB in 20ms is 4Mbps
+	counters.set(10*1000, nil)
+	if busy, _ := exporter.linkBusy(context.Background(), true); busy {
+		t.Error("Expected the link not to be busy")
+	}
+
+	// The counters failing to be read, as on the platforms without them,
+	// the tests run
+	counters.set(0, errors.New("Interface counters are only supported on Linux"))
+	if busy, _ := exporter.linkBusy(context.Background(), true); busy {
+		t.Error("Expected the test to run without counters")
+	}
+
+	exporter.busy.setConfig(BusyConfig{})
+	counters.set(10*1000*1000, nil)
+	if busy, _ := exporter.linkBusy(context.Background(), true); busy {
+		t.Error("Expected no check without interface")
+	}
+}
+
+func TestBusySchedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exporter, counters := newBusyExporter(ctx, BusyConfig{Interface: "eth0"})
+	counters.set(10*1000*1000, nil)
+	client := &fakeClient{measurements: map[string]speedtest.Measurement{speedtest.PhaseDownload: {Value: 93.5}}}
+	exporter.SetClient(client)
+
+	// A test on scrape serves no result
+	gather(t, exporter)
+	if len(client.requested()) != 0 {
+		t.Errorf("Expected no test on scrape while the link is busy, got %v", client.requested())
+	}
+
+	// A scheduled test is skipped until the next interval
+	exporter.SetInterval(time.Hour)
+	go exporter.run()
+	skipped := exporter.busy.skipped.WithLabelValues(skipLinkBusy)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, next := exporter.Last(); testutil.ToFloat64(skipped) == 2 && time.Until(next) > 59*time.Minute {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The scheduled test wasn't skipped until the next interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(client.requested()) != 0 {
+		t.Errorf("Expected no scheduled test while the link is busy, got %v", client.requested())
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// checkTimeout bounds the network checks of checkConfig
+const checkTimeout = time.Minute
+
+// checkConfig checks what the validated configuration refers to: the
+// credential and probe modules files and, unless offline, the Speedtest
+// configuration and server list, from which the test server is selected.
+// No bandwidth test is run. The outcome is written to w.
+func checkConfig(w io.Writer, config *Config, offline bool) error {
+	auth, err := loadAuth(config.Speedtest.Auth)
+	if err != nil {
+		return err
+	}
+	if config.Probe.ModulesFile != "" {
+		file, err := loadModules(config.Probe.ModulesFile)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Probe modules file %s: %d modules\n", config.Probe.ModulesFile, len(file.Modules))
+	}
+	if offline || config.Probe.Only {
+		fmt.Fprintln(w, "Configuration is valid")
+		return nil
+	}
+	if config.Backend == backendMock {
+		fmt.Fprintf(w, "Tests would return the results of the mock backend: %v Mbps download, %v Mbps upload, %v ms latency\n", config.Mock.Download, config.Mock.Upload, config.Mock.Ping)
+		fmt.Fprintln(w, "Configuration is valid")
+		return nil
+	}
+	if config.Speedtest.MiniURL != "" {
+		fmt.Fprintf(w, "Tests would run against the Speedtest Mini server %s\n", config.Speedtest.MiniURL)
+		if config.Speedtest.HostOverride != "" {
+			fmt.Fprintf(w, "Requested as %s\n", config.Speedtest.HostOverride)
+		}
+		fmt.Fprintln(w, "Configuration is valid")
+		return nil
+	}
+
+	transport, err := newSpeedtestTransport(&config.Speedtest)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	active := &activeConfig{Config: config, auth: auth, transport: transport}
+	client, err := speedtest.NewFilteredClient(ctx, config.Speedtest.ConfigURL, config.Speedtest.ServerURL, config.Speedtest.serverFilter(), active.clientOptions())
+	if err != nil {
+		return fmt.Errorf("Can't select a test server: %s", err)
+	}
+	server := client.Server
+	fmt.Fprintf(w, "Tests would run against server %s: %s (%s, %s), %.0f km away, latency %.2f ms\n",
+		server.ID, server.Sponsor, server.Name, server.Country, server.Distance, server.Latency)
+	fmt.Fprintln(w, "Configuration is valid")
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	config := defaultConfig()
+	config.Speedtest.ConfigURL = fake.URL + "/config.php"
+	config.Speedtest.ServerURL = fake.URL + "/servers.php"
+	config.Speedtest.Server.IDs = []string{"99"}
+
+	var out strings.Builder
+	if err := checkConfig(&out, config, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "server 99") {
+		t.Errorf("Expected the selected server, got %q", out.String())
+	}
+
+	config.Speedtest.Server.IDs = []string{"404"}
+	if err := checkConfig(&out, config, false); err == nil {
+		t.Error("Expected an error with an unknown server ID")
+	}
+
+	fake.reset()
+	out.Reset()
+	if err := checkConfig(&out, config, true); err != nil {
+		t.Fatal(err)
+	}
+	if fake.requested("/") {
+		t.Error("Offline checks must not reach the network")
+	}
+
+	config.Probe.ModulesFile = "/nonexistent/probe.yml"
+	if err := checkConfig(&out, config, true); err == nil {
+		t.Error("Expected an error with a missing modules file")
+	}
+}
+
+func TestCheckConfigProxy(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	var mu sync.Mutex
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.URL.Path)
+		mu.Unlock()
+		req, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := (&http.Transport{}).RoundTrip(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer proxy.Close()
+
+	config, err := parseTestConfig(
+		"--speedtest.config-url", fake.URL+"/config.php",
+		"--speedtest.server-url", fake.URL+"/servers.php",
+		"--speedtest.proxy-url", proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := checkConfig(&out, config, false); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range []string{"/config.php", "/servers.php"} {
+		found := false
+		for _, p := range proxied {
+			found = found || p == path
+		}
+		if !found {
+			t.Errorf("Expected %s to be requested through the proxy, got %v", path, proxied)
+		}
+	}
+
+	if _, err := parseTestConfig("--speedtest.proxy-url", "ftp://proxy.lan"); err == nil {
+		t.Error("Expected an error with an unsupported proxy URL")
+	}
+}
+
+func TestCheckConfigTLS(t *testing.T) {
+	fake := &fakeSpeedtest{}
+	fake.Server = httptest.NewTLSServer(http.HandlerFunc(fake.serveHTTP))
+	defer fake.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fake.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		args  []string
+		valid bool
+	}{
+		{nil, false},
+		{[]string{"--speedtest.tls-ca-file", caFile}, true},
+		{[]string{"--speedtest.tls-insecure-skip-verify"}, true},
+	} {
+		args := append([]string{"--speedtest.config-url", fake.URL + "/config.php", "--speedtest.server-url", fake.URL + "/servers.php"}, tc.args...)
+		config, err := parseTestConfig(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out strings.Builder
+		if err := checkConfig(&out, config, false); (err == nil) != tc.valid {
+			t.Errorf("%v: unexpected outcome %v", tc.args, err)
+		}
+	}
+
+	config, err := parseTestConfig("--speedtest.tls-ca-file", filepath.Join(dir, "speedtest.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfigFile(t, dir, "not a certificate")
+	if _, err := newSpeedtestTransport(&config.Speedtest); err == nil {
+		t.Error("Expected an error with a CA file without certificates")
+	}
+}
@@ -0,0 +1,2179 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/exporter-toolkit/web"
+	"golang.org/x/net/http/httpguts"
+	"gopkg.in/yaml.v3"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+	"github.com/nlamirault/speedtest_exporter/version"
+)
+
+// Config is the exporter configuration. It is read from the configuration
+// file, if any, then from the command line flags which take precedence.
+type Config struct {
+	ConfigFile  string `yaml:"-"`
+	ShowVersion bool   `yaml:"-"`
+	// ConfigURL is fetched instead of the configuration file, every
+	// ConfigRefresh when set
+	ConfigURL     string        `yaml:"-"`
+	ConfigRefresh time.Duration `yaml:"-"`
+	// CheckConfig only validates the configuration, offline skipping the
+	// network checks
+	CheckConfig        bool `yaml:"-"`
+	CheckConfigOffline bool `yaml:"-"`
+	// Once runs a single test, prints its result and exits, with a
+	// non-zero status when it fails or misses one of the Assert thresholds
+	Once   bool         `yaml:"-"`
+	Assert AssertConfig `yaml:"-"`
+	// OnceOutput is the format of the result of -once, json or junit
+	OnceOutput string `yaml:"-"`
+	// ServiceInstall and ServiceUninstall manage the Windows service
+	ServiceInstall   bool `yaml:"-"`
+	ServiceUninstall bool `yaml:"-"`
+	// Profile is a named preset of settings, applied over the
+	// configuration file and overridden by the environment and the flags
+	Profile string `yaml:"profile"`
+	// Backend is speedtest, or mock for the results of Mock, which don't
+	// touch the network
+	Backend string     `yaml:"backend"`
+	Mock    MockConfig `yaml:"mock"`
+	// Backends, when set, replace Backend: each test cycle tests them in
+	// turn, their metrics being labeled with the backend
+	Backends stringList `yaml:"backends"`
+
+	Web         WebConfig         `yaml:"web"`
+	Speedtest   SpeedtestConfig   `yaml:"speedtest"`
+	Schedule    ScheduleConfig    `yaml:"schedule"`
+	Probe       ProbeConfig       `yaml:"probe"`
+	Output      OutputConfig      `yaml:"output"`
+	Metrics     MetricsConfig     `yaml:"metrics"`
+	Line        LineConfig        `yaml:"line"`
+	Links       []LinkConfig      `yaml:"links"`
+	DNS         DNSConfig         `yaml:"dns"`
+	GeoIP       GeoIPConfig       `yaml:"geoip"`
+	State       StateConfig       `yaml:"state"`
+	Results     ResultsConfig     `yaml:"results"`
+	History     HistoryConfig     `yaml:"history"`
+	Influx      InfluxConfig      `yaml:"influx"`
+	MQTT        MQTTConfig        `yaml:"mqtt"`
+	OTLP        OTLPConfig        `yaml:"otlp"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	RemoteWrite RemoteWriteConfig `yaml:"remote_write"`
+	Webhook     WebhookConfig     `yaml:"webhook"`
+	StatsD      StatsDConfig      `yaml:"statsd"`
+	Log         LogConfig         `yaml:"log"`
+
+	// hash identifies the content of the configuration file
+	hash string
+}
+
+// WebConfig defines the HTTP server settings
+type WebConfig struct {
+	ListenAddress          string     `yaml:"listen_address"`
+	SocketMode             string     `yaml:"socket_mode"`
+	TelemetryPath          string     `yaml:"telemetry_path"`
+	ConfigFile             string     `yaml:"config_file"`
+	ReadyRequiresFirstTest bool       `yaml:"ready_requires_first_test"`
+	DisableExporterMetrics bool       `yaml:"disable_exporter_metrics"`
+	EnablePprof            bool       `yaml:"enable_pprof"`
+	PprofListenAddress     string     `yaml:"pprof_listen_address"`
+	EnableDebugServers     bool       `yaml:"enable_debug_servers"`
+	LogRequests            bool       `yaml:"log_requests"`
+	DisableConfigEndpoint  bool       `yaml:"disable_config_endpoint"`
+	APITokenFile           string     `yaml:"api_token_file"`
+	AllowedCIDRs           stringList `yaml:"allowed_cidrs"`
+	AdminAllowedCIDRs      stringList `yaml:"admin_allowed_cidrs"`
+	TrustProxy             bool       `yaml:"trust_proxy"`
+	RoutePrefix            string     `yaml:"route_prefix"`
+	ExternalURL            string     `yaml:"external_url"`
+}
+
+// routePrefix returns the path prefix of the endpoints, which defaults to
+// the path of the external URL, without trailing slash except for "/"
+func (c *WebConfig) routePrefix() string {
+	prefix := c.RoutePrefix
+	if prefix == "" {
+		if u, err := url.Parse(c.ExternalURL); err == nil {
+			prefix = u.Path
+		}
+	}
+	return "/" + strings.Trim(prefix, "/")
+}
+
+// externalPath returns the path the exporter is reachable under, from the
+// external URL or else the route prefix, with a trailing slash
+func (c *WebConfig) externalPath() string {
+	path := c.routePrefix()
+	if c.ExternalURL != "" {
+		if u, err := url.Parse(c.ExternalURL); err == nil {
+			path = "/" + strings.Trim(u.Path, "/")
+		}
+	}
+	return strings.TrimSuffix(path, "/") + "/"
+}
+
+// SpeedtestConfig defines the test settings
+type SpeedtestConfig struct {
+	// ConfigURL and ServerURL may list comma separated mirrors, tried in
+	// order, each attempt bounded by FetchTimeout. InitTimeout bounds the
+	// creation of a client: their retrieval, mirrors included, and the
+	// server selection.
+	ConfigURL    string        `yaml:"config_url"`
+	ServerURL    string        `yaml:"server_url"`
+	FetchTimeout time.Duration `yaml:"fetch_timeout"`
+	InitTimeout  time.Duration `yaml:"init_timeout"`
+	MiniURL      string        `yaml:"mini_url"`
+	// ClientLat and ClientLon, set together, replace the coordinates of
+	// the client from the configuration, in the distances to the servers
+	// and the client coordinate metrics
+	ClientLat coordinate `yaml:"client_lat,omitempty"`
+	ClientLon coordinate `yaml:"client_lon,omitempty"`
+	// HostOverride, if set, replaces the host of MiniURL in the Host header
+	// of the requests and the TLS handshakes, for a server fronted by a
+	// load balancer or CDN reached by address
+	HostOverride  string    `yaml:"host_override"`
+	ProxyURL      string    `yaml:"proxy_url"`
+	UserAgent     string    `yaml:"user_agent"`
+	Headers       headerMap `yaml:"headers"`
+	SourceAddress string    `yaml:"source_address"`
+	Interface     string    `yaml:"interface"`
+	// Netns is the named network namespace the test connections are
+	// opened in, e.g. the one of a WAN on a policy routing router
+	Netns       string    `yaml:"netns"`
+	DNSServer   string    `yaml:"dns_server"`
+	TLS         TLSConfig `yaml:"tls"`
+	HTTPVersion string    `yaml:"http_version"`
+	// DialTimeout bounds the establishment of the connections, and
+	// ReadTimeout aborts the requests transferring no data for that long
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+	Server      ServerConfig  `yaml:"server"`
+	Auth        AuthConfig    `yaml:"auth"`
+	IP          IPConfig      `yaml:"ip"`
+	Expect      ExpectConfig  `yaml:"expect"`
+	// Streams is the number of parallel connections of the download and
+	// upload phases, overridden per direction by DownloadStreams and
+	// UploadStreams when set
+	Streams         int `yaml:"streams"`
+	DownloadStreams int `yaml:"download_streams"`
+	UploadStreams   int `yaml:"upload_streams"`
+	// DownloadDuration and UploadDuration bound the transfer phases, each
+	// size being requested once when not set
+	DownloadDuration time.Duration `yaml:"download_duration"`
+	UploadDuration   time.Duration `yaml:"upload_duration"`
+	DownloadSizes    intList       `yaml:"download_sizes"`
+	// DownloadAdaptive picks the download sizes from a probe transfer
+	DownloadAdaptive bool `yaml:"download_adaptive"`
+	// UploadMaxBytes caps the volume of the upload phase, and
+	// UploadChunkSize sets the size of its payloads
+	UploadMaxBytes  byteSize `yaml:"upload_max_bytes"`
+	UploadChunkSize byteSize `yaml:"upload_chunk_size"`
+	// UploadFormat is the encoding of the upload payloads: auto, form or
+	// raw
+	UploadFormat string `yaml:"upload_format"`
+	// UploadPayload is the content of the upload payloads: random or zero
+	UploadPayload string `yaml:"upload_payload"`
+	// PingSamples is the number of latency samples of a server, aggregated
+	// by PingAggregation: min, mean or median
+	PingSamples     int    `yaml:"ping_samples"`
+	PingAggregation string `yaml:"ping_aggregation"`
+	// Retries is the number of retries of the requests failing with
+	// transient errors
+	Retries int `yaml:"retries"`
+	// FreshConnections closes the idle connections before each phase
+	FreshConnections bool `yaml:"fresh_connections"`
+	// CacheCheckHeaders and CacheCheckContent look for the downloads
+	// served by a transparent cache, from the response headers and from
+	// the same content being served twice
+	CacheCheckHeaders bool `yaml:"cache_check_headers"`
+	CacheCheckContent bool `yaml:"cache_check_content"`
+	// Hops counts the hops to the test server before the phases
+	Hops bool `yaml:"hops"`
+	// VerifyInterface is the network interface whose counters are
+	// exported along with the bytes of the transfer phases (Linux only)
+	VerifyInterface string `yaml:"verify_interface"`
+	// CPUThreshold is the CPU utilization, from 0 to 1, above which the
+	// transfer phases are CPU limited, zero disabling the sampling
+	CPUThreshold float64 `yaml:"cpu_threshold"`
+	// BufferSize is the size of the buffers the downloads are read through
+	BufferSize byteSize `yaml:"buffer_size"`
+	// Duplex runs the download and upload phases at once
+	Duplex bool `yaml:"duplex"`
+	// Share submits the successful results to the speedtest.net API at
+	// ShareURL, so they show in its result history
+	Share    bool   `yaml:"share"`
+	ShareURL string `yaml:"share_url"`
+	// RateLimit caps the bandwidth of the transfer phases
+	RateLimit bitRate `yaml:"rate_limit"`
+	// Aggregation is how the bandwidth is computed from the throughput
+	// samples of the transfer phases, simple, stable-window or ookla
+	Aggregation string `yaml:"aggregation"`
+	// Mode is test for discrete tests, or soak for the continuous
+	// transfers of Soak instead
+	Mode string     `yaml:"mode"`
+	Soak SoakConfig `yaml:"soak"`
+	// Busy defers or skips the tests while the link is busy
+	Busy BusyConfig `yaml:",inline"`
+
+	// explicit tells which of parameterSettings were set, and so are not
+	// taken from the test parameters of the Speedtest configuration
+	explicit map[string]bool
+}
+
+// Modes of the Speedtest exporter
+const (
+	modeTest = "test"
+	modeSoak = "soak"
+)
+
+// SoakConfig defines the soak test, transferring continuously at a low rate
+type SoakConfig struct {
+	// DownloadRate and UploadRate are the target rates of the transfers, a
+	// direction being left out when zero
+	DownloadRate bitRate `yaml:"download_rate"`
+	UploadRate   bitRate `yaml:"upload_rate"`
+	// URL, if set, is downloaded from and uploaded to instead of the test
+	// server
+	URL string `yaml:"url"`
+	// Interval is the period the soak metrics are updated at
+	Interval time.Duration `yaml:"interval"`
+}
+
+// BusyConfig defers or skips the bandwidth tests while the traffic of an
+// interface, such as a backup saturating the uplink, exceeds a threshold
+type BusyConfig struct {
+	// Interface is the interface whose counters are sampled for
+	// SampleDuration before the tests, the check being disabled when empty
+	Interface      string        `yaml:"skip_if_busy_interface"`
+	Threshold      bitRate       `yaml:"busy_threshold"`
+	SampleDuration time.Duration `yaml:"busy_sample_duration"`
+	// RetryDelay, when set, defers a scheduled test finding the link busy
+	// by that long, up to Retries times, before skipping it
+	RetryDelay time.Duration `yaml:"busy_retry_delay"`
+	Retries    int           `yaml:"busy_retries"`
+}
+
+// TLSConfig defines how the certificates of the servers are verified
+type TLSConfig struct {
+	// CAFile is a PEM bundle trusted in addition to the system CAs
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// ServerConfig restricts the servers the test server is selected from
+type ServerConfig struct {
+	IDs          stringList `yaml:"ids"`
+	CountryCodes stringList `yaml:"country_codes"`
+}
+
+// AuthConfig defines the credentials sent to the test server
+type AuthConfig struct {
+	Username        string `yaml:"username"`
+	PasswordFile    string `yaml:"password_file"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+}
+
+// IPConfig defines how the external IP address is looked up when missing
+// from the Speedtest configuration
+type IPConfig struct {
+	// URLs of the services answering the IP address, tried in order
+	URLs stringList `yaml:"urls"`
+	// Family is the address family of the answers: any, ipv4 or ipv6
+	Family string `yaml:"family"`
+	// DualStack looks up the IPv4 and IPv6 addresses too
+	DualStack bool `yaml:"dual_stack"`
+	// RDNS resolves the reverse DNS name of the address
+	RDNS bool `yaml:"rdns"`
+	// Netns looks the address up from within speedtest.netns, or the
+	// namespace of the link, rather than the namespace of the exporter
+	Netns bool `yaml:"netns"`
+	// CacheTTL is the time the address is cached for. It is looked up on
+	// each test when zero.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// Timeout bounds the lookup of each service
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ExpectConfig defines the thresholds the successful tests are expected to
+// meet, zero disabling a threshold
+type ExpectConfig struct {
+	Download bitRate       `yaml:"download"`
+	Upload   bitRate       `yaml:"upload"`
+	Ping     time.Duration `yaml:"ping"`
+	// Misses is the number of consecutive tests missing a threshold
+	// before it is reported
+	Misses int `yaml:"misses"`
+}
+
+// LinkConfig is a network link the tests run over, such as an uplink of a
+// dual-WAN router. Its metrics carry its name as link label.
+type LinkConfig struct {
+	Name string `yaml:"name"`
+	// SourceAddress, Interface and Netns bind the connections of the link
+	// tests, replacing those of the speedtest section
+	SourceAddress string `yaml:"source_address"`
+	Interface     string `yaml:"interface"`
+	Netns         string `yaml:"netns"`
+	// Interval, when set, replaces schedule.interval, or the bandwidth
+	// interval of a split schedule, for the link
+	Interval time.Duration `yaml:"interval"`
+	// DailyCap, when set, skips the tests of the link once they transferred
+	// that much over the last 24 hours
+	DailyCap byteSize `yaml:"daily_cap"`
+	// Labels are attached to the metrics and results of the link tests,
+	// in addition to metrics.labels
+	Labels labelMap `yaml:"labels"`
+}
+
+// speedtest returns the Speedtest settings of the link tests
+func (l LinkConfig) speedtest(config SpeedtestConfig) SpeedtestConfig {
+	config.SourceAddress = l.SourceAddress
+	config.Interface = l.Interface
+	config.Netns = l.Netns
+	return config
+}
+
+// ScheduleConfig defines when the exporter runs tests
+type ScheduleConfig struct {
+	// Interval between tests. When zero, a test is run on each scrape.
+	Interval time.Duration `yaml:"interval"`
+	// PingInterval and BandwidthInterval, when set, split the schedule of
+	// the exporter and its links: the latency phase is tested alone every
+	// PingInterval, against the server of the full tests, which run every
+	// BandwidthInterval instead of Interval
+	PingInterval      time.Duration `yaml:"ping_interval"`
+	BandwidthInterval time.Duration `yaml:"bandwidth_interval"`
+	// RetestAnomalies runs a confirmation test after an anomalous test
+	RetestAnomalies bool `yaml:"retest_anomalies"`
+	// MaxConcurrentTests is the number of tests run at once by the
+	// exporter, its links, the probes and the targets, the others waiting
+	// at most MaxQueueWait for their turn
+	MaxConcurrentTests int           `yaml:"max_concurrent_tests"`
+	MaxQueueWait       time.Duration `yaml:"max_queue_wait"`
+	// ReinitAfterFailures is the number of consecutive failed tests after
+	// which the Speedtest client is created again, zero disabling it. The
+	// re-initializations are spaced by ReinitBackoff, doubled each time
+	// until a test succeeds.
+	ReinitAfterFailures int           `yaml:"reinit_after_failures"`
+	ReinitBackoff       time.Duration `yaml:"reinit_backoff"`
+	// RateLimitMaxBackoff bounds the backoff of the tests after 403 and
+	// 429 responses, zero disabling it
+	RateLimitMaxBackoff time.Duration `yaml:"rate_limit_max_backoff"`
+}
+
+// testInterval returns the interval between the full tests of the
+// exporter, the bandwidth interval of a split schedule
+func (c ScheduleConfig) testInterval() time.Duration {
+	if c.BandwidthInterval > 0 {
+		return c.BandwidthInterval
+	}
+	return c.Interval
+}
+
+// OutputConfig defines how the results are exported
+type OutputConfig struct {
+	// Timestamps attaches the test completion time to the result samples
+	Timestamps bool `yaml:"timestamps"`
+}
+
+// MetricsConfig defines the naming of the exported metrics
+type MetricsConfig struct {
+	// Namespace prefixes the metric names of the results
+	Namespace string `yaml:"namespace"`
+	// Labels are attached to every speedtest_* metric
+	Labels labelMap `yaml:"labels"`
+	// NoIPLabel removes the ip label of the results, and disables the
+	// external IP address lookup
+	NoIPLabel bool `yaml:"no_ip_label"`
+	// ServerLabels labels the results with the ID and name of the test
+	// server
+	ServerLabels bool `yaml:"server_labels"`
+	// Window is the number of recent tests the window aggregates are
+	// computed over, zero disabling them
+	Window int `yaml:"window"`
+	// AnomalyThreshold is the deviation from the median of the window, in
+	// percent, beyond which a result is anomalous, zero disabling the
+	// detection
+	AnomalyThreshold float64 `yaml:"anomaly_threshold"`
+}
+
+// LineConfig defines the subscribed rates of the line under test, exported
+// along with the ratio of the measured bandwidth to them
+type LineConfig struct {
+	Download bitRate `yaml:"download"`
+	Upload   bitRate `yaml:"upload"`
+}
+
+// DNSConfig defines the names whose lookups are timed alongside the tests
+type DNSConfig struct {
+	Names stringList `yaml:"names"`
+	// Server (IP address with an optional port), if set, answers the lookups instead of
+	// the system resolver
+	Server  string        `yaml:"server"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// GeoIPConfig defines how the external IP address is located
+type GeoIPConfig struct {
+	// Database is a local MMDB file, e.g. GeoLite2-City.mmdb
+	Database string `yaml:"database"`
+	// ASNDatabase is a local MMDB file the AS is found in, e.g.
+	// GeoLite2-ASN.mmdb
+	ASNDatabase string `yaml:"asn_database"`
+	// ASNDNS finds the AS with DNS queries when not in the database
+	ASNDNS bool `yaml:"asn_dns"`
+}
+
+// ProbeConfig defines the /probe endpoint settings
+type ProbeConfig struct {
+	Only        bool              `yaml:"only"`
+	Timeout     time.Duration     `yaml:"timeout"`
+	ModulesFile string            `yaml:"modules_file"`
+	TargetsFile string            `yaml:"targets_file"`
+	Modules     map[string]Module `yaml:"modules"`
+}
+
+// MockConfig defines the results of the mock backend
+type MockConfig struct {
+	// Download and Upload are the bandwidths (Mbps), Ping the latency (ms)
+	// and Jitter the variation between its samples (ms)
+	Download float64 `yaml:"download"`
+	Upload   float64 `yaml:"upload"`
+	Ping     float64 `yaml:"ping"`
+	Jitter   float64 `yaml:"jitter"`
+	// Noise is the standard deviation of the values relative to them, from
+	// a generator seeded with Seed
+	Noise float64 `yaml:"noise"`
+	Seed  int64   `yaml:"seed"`
+	// FailureRate is the probability of each phase failing
+	FailureRate float64 `yaml:"failure_rate"`
+}
+
+// LogConfig defines the logging settings
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+	// DedupWindow is the period of the summaries of the repeated errors of
+	// the tests, which are otherwise not logged, 0 logging them all
+	DedupWindow time.Duration `yaml:"dedup_window"`
+}
+
+// StateConfig defines where the exporter state is persisted
+type StateConfig struct {
+	File string `yaml:"file"`
+}
+
+// ResultsConfig defines the log the results are appended to
+type ResultsConfig struct {
+	File string `yaml:"file"`
+	// MaxSize is the size the file is rotated at, zero meaning never. The
+	// MaxFiles last rotated files are kept.
+	MaxSize  byteSize `yaml:"max_size"`
+	MaxFiles int      `yaml:"max_files"`
+}
+
+// HistoryConfig defines the database the results are stored in
+type HistoryConfig struct {
+	DB string `yaml:"db"`
+	// Retention is the age the results are deleted at, zero meaning never
+	Retention longDuration `yaml:"retention"`
+}
+
+// InfluxConfig defines where the results are written as InfluxDB line
+// protocol
+type InfluxConfig struct {
+	// URL is the address of the InfluxDB server. Points are written to the
+	// bucket of the org with a 2.x server, or to the 1.x database.
+	URL      string `yaml:"url"`
+	Org      string `yaml:"org"`
+	Bucket   string `yaml:"bucket"`
+	Database string `yaml:"database"`
+	// TokenFile holds the 2.x API token, Username and PasswordFile are the
+	// 1.x credentials
+	TokenFile    string `yaml:"token_file"`
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file"`
+	// File is appended the points, such as for the tail plugin of Telegraf
+	File        string `yaml:"file"`
+	Measurement string `yaml:"measurement"`
+	// Retries is the number of retries of the failed writes
+	Retries int `yaml:"retries"`
+}
+
+// MQTTConfig defines the MQTT broker the results are published to
+type MQTTConfig struct {
+	// Broker is the URL of the broker, such as tcp://broker:1883 or
+	// ssl://broker:8883
+	Broker       string    `yaml:"broker"`
+	Topic        string    `yaml:"topic"`
+	ClientID     string    `yaml:"client_id"`
+	Username     string    `yaml:"username"`
+	PasswordFile string    `yaml:"password_file"`
+	TLS          TLSConfig `yaml:"tls"`
+	QoS          int       `yaml:"qos"`
+	// MetricTopics publishes the measured values to the subtopics of
+	// Topic too, such as Topic/download
+	MetricTopics bool `yaml:"metric_topics"`
+	// Discovery publishes the Home Assistant MQTT discovery messages of
+	// the sensors under DiscoveryPrefix
+	Discovery       bool   `yaml:"discovery"`
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+}
+
+// The protocols of the OTLP exporter
+const (
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http/protobuf"
+)
+
+// OTLPConfig defines the OpenTelemetry collector the results are pushed to
+type OTLPConfig struct {
+	// Endpoint is the host and port of the collector, such as
+	// otel-collector:4317
+	Endpoint string `yaml:"endpoint"`
+	// Protocol is either grpc or http/protobuf
+	Protocol string `yaml:"protocol"`
+	// Insecure disables TLS
+	Insecure bool      `yaml:"insecure"`
+	TLS      TLSConfig `yaml:"tls"`
+	Headers  headerMap `yaml:"headers"`
+}
+
+// TracingConfig defines the OpenTelemetry collector the traces of the tests
+// are exported to, tracing being disabled without OTLPEndpoint
+type TracingConfig struct {
+	// OTLPEndpoint is the host and port of the collector, such as
+	// otel-collector:4317, reached with OTLPProtocol, grpc or
+	// http/protobuf
+	OTLPEndpoint string    `yaml:"otlp_endpoint"`
+	OTLPProtocol string    `yaml:"otlp_protocol"`
+	OTLPInsecure bool      `yaml:"otlp_insecure"`
+	OTLPTLS      TLSConfig `yaml:"otlp_tls"`
+	OTLPHeaders  headerMap `yaml:"otlp_headers"`
+	// SampleRatio is the share of the tests traced, from 0 to 1
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// RemoteWriteConfig defines the Prometheus remote write endpoint the
+// metrics of each test are pushed to
+type RemoteWriteConfig struct {
+	URL string `yaml:"url"`
+	// Username and PasswordFile are the basic auth credentials,
+	// BearerTokenFile holds a bearer token instead
+	Username        string    `yaml:"username"`
+	PasswordFile    string    `yaml:"password_file"`
+	BearerTokenFile string    `yaml:"bearer_token_file"`
+	TLS             TLSConfig `yaml:"tls"`
+	Headers         headerMap `yaml:"headers"`
+	// Retries is the number of retries of the failed pushes
+	Retries int `yaml:"retries"`
+}
+
+// WebhookConfig defines the webhook the JSON result of each test is posted
+// to
+type WebhookConfig struct {
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	// SecretFile holds the shared secret the requests are signed with
+	SecretFile string `yaml:"secret_file"`
+}
+
+// StatsDConfig defines where the results are sent as StatsD gauges or
+// Graphite plaintext
+type StatsDConfig struct {
+	// Address is the host and port of the StatsD server, over UDP
+	Address string `yaml:"address"`
+	// GraphiteAddress is the host and port of the Graphite plaintext
+	// listener, over TCP
+	GraphiteAddress string `yaml:"graphite_address"`
+	// Template is the path of the metrics, whose {metric} placeholder is
+	// replaced with the metric name, and the others such as {site} with
+	// the constant labels
+	Template string `yaml:"template"`
+	// TagFormat is how the metrics are tagged: none, datadog or graphite
+	TagFormat string `yaml:"tag_format"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Backend:    backendSpeedtest,
+		OnceOutput: onceOutputJSON,
+		Mock: MockConfig{
+			Download: 500,
+			Upload:   50,
+			Ping:     10,
+			Jitter:   1,
+			Seed:     1,
+		},
+		Web: WebConfig{
+			ListenAddress: ":9112",
+			SocketMode:    "0660",
+			TelemetryPath: "/metrics",
+		},
+		Speedtest: SpeedtestConfig{
+			ConfigURL:   speedtest.DefaultConfigURL,
+			ShareURL:    speedtest.DefaultShareURL,
+			ServerURL:   speedtest.DefaultServersURL,
+			UserAgent:   "speedtest_exporter/" + version.Version,
+			Streams:     1,
+			Aggregation: speedtest.AggregationSimple,
+			HTTPVersion: speedtest.HTTPVersionAuto,
+			DialTimeout: 5 * time.Second,
+			ReadTimeout: 15 * time.Second,
+			Retries:     2,
+
+			FetchTimeout: 30 * time.Second,
+			InitTimeout:  2 * time.Minute,
+
+			UploadFormat:      speedtest.UploadFormatAuto,
+			UploadPayload:     speedtest.UploadPayloadRandom,
+			CacheCheckHeaders: true,
+			PingSamples:       5,
+			PingAggregation:   speedtest.PingAggregationMin,
+			CPUThreshold:      0.9,
+			Busy: BusyConfig{
+				SampleDuration: 2 * time.Second,
+				Retries:        3,
+			},
+			IP: IPConfig{
+				CacheTTL: defaultIPCacheTTL,
+				Timeout:  defaultIPTimeout,
+				Family:   ipFamilyAny,
+			},
+			Expect: ExpectConfig{
+				Misses: 1,
+			},
+			Mode: modeTest,
+			Soak: SoakConfig{
+				DownloadRate: 5 * 1000 * 1000,
+				UploadRate:   5 * 1000 * 1000,
+				Interval:     5 * time.Second,
+			},
+		},
+		Schedule: ScheduleConfig{
+			MaxConcurrentTests:  1,
+			MaxQueueWait:        maxTestDuration,
+			ReinitAfterFailures: 3,
+			ReinitBackoff:       5 * time.Minute,
+			RateLimitMaxBackoff: 6 * time.Hour,
+		},
+		DNS: DNSConfig{
+			Timeout: 2 * time.Second,
+		},
+		Probe: ProbeConfig{
+			Timeout: 2 * time.Minute,
+		},
+		Metrics: MetricsConfig{
+			Namespace: defaultNamespace,
+		},
+		Results: ResultsConfig{
+			MaxSize:  100 * 1000 * 1000,
+			MaxFiles: 10,
+		},
+		Influx: InfluxConfig{
+			Measurement: "speedtest",
+			Retries:     3,
+		},
+		MQTT: MQTTConfig{
+			Topic:           "speedtest",
+			ClientID:        "speedtest_exporter",
+			QoS:             1,
+			DiscoveryPrefix: "homeassistant",
+		},
+		OTLP: OTLPConfig{
+			Protocol: otlpProtocolGRPC,
+		},
+		Tracing: TracingConfig{
+			OTLPProtocol: otlpProtocolGRPC,
+			SampleRatio:  1,
+		},
+		RemoteWrite: RemoteWriteConfig{
+			Retries: 3,
+		},
+		Webhook: WebhookConfig{
+			Timeout: 10 * time.Second,
+		},
+		StatsD: StatsDConfig{
+			Template:  "speedtest.{metric}",
+			TagFormat: statsdTagsNone,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "logfmt",
+
+			DedupWindow: 30 * time.Minute,
+		},
+	}
+}
+
+// registerFlags binds the command line flags to the configuration fields.
+// The current field values are used as the flags default values.
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config.file", c.ConfigFile, "Configuration file. Command line flags take precedence over its values")
+	fs.StringVar(&c.Profile, "profile", c.Profile, "Preset of settings applied over the configuration file, the other flags taking precedence: low-memory, for constrained devices")
+	fs.StringVar(&c.Backend, "backend", c.Backend, "Backend of the tests: speedtest, or mock for the deterministic results of -mock.*, without touching the network. Changes require a restart")
+	fs.Var(&c.Backends, "backends", "Comma separated backends tested in turn by each test cycle, e.g. speedtest,mini, their metrics being labeled with the backend: speedtest for the speedtest.net servers, mini for the Mini server of -speedtest.mini-url, or mock. Changes require a restart")
+	fs.Float64Var(&c.Mock.Download, "mock.download", c.Mock.Download, "Download bandwidth (Mbps) of the mock backend. Changes require a restart")
+	fs.Float64Var(&c.Mock.Upload, "mock.upload", c.Mock.Upload, "Upload bandwidth (Mbps) of the mock backend. Changes require a restart")
+	fs.Float64Var(&c.Mock.Ping, "mock.ping", c.Mock.Ping, "Latency (ms) of the mock backend. Changes require a restart")
+	fs.Float64Var(&c.Mock.Jitter, "mock.jitter", c.Mock.Jitter, "Variation between the latency samples (ms) of the mock backend. Changes require a restart")
+	fs.Float64Var(&c.Mock.Noise, "mock.noise", c.Mock.Noise, "Standard deviation of the values of the mock backend relative to them, e.g. 0.05. Changes require a restart")
+	fs.Int64Var(&c.Mock.Seed, "mock.seed", c.Mock.Seed, "Seed of the noise and failures of the mock backend, the same seed repeating the same results. Changes require a restart")
+	fs.Float64Var(&c.Mock.FailureRate, "mock.failure-rate", c.Mock.FailureRate, "Probability of each phase of the mock backend failing, as an overloaded server. Changes require a restart")
+	fs.StringVar(&c.ConfigURL, "config.url", c.ConfigURL, "URL of the configuration file, fetched instead of -config.file")
+	fs.DurationVar(&c.ConfigRefresh, "config.refresh", c.ConfigRefresh, "Interval the configuration is fetched again from -config.url at. When zero, it is only fetched on reload")
+	fs.BoolVar(&c.ShowVersion, "version", c.ShowVersion, "Print version information.")
+	fs.BoolVar(&c.CheckConfig, "check-config", c.CheckConfig, "Check the configuration, print the test server that would be selected and exit.")
+	fs.BoolVar(&c.ServiceInstall, "service.install", c.ServiceInstall, "Install the exporter as a Windows service run with the other command line arguments, and exit.")
+	fs.BoolVar(&c.ServiceUninstall, "service.uninstall", c.ServiceUninstall, "Uninstall the Windows service, and exit.")
+	fs.BoolVar(&c.CheckConfigOffline, "check-config.offline", c.CheckConfigOffline, "Skip the network checks of -check-config.")
+	fs.BoolVar(&c.Once, "once", c.Once, "Run a single test, print its result as JSON and exit with status 0, 1 if it fails, or 2 if it misses an -assert threshold.")
+	fs.Var(&c.Assert.MinDownload, "assert.min-download", "Download bandwidth the test of -once must reach, e.g. 100Mbps")
+	fs.Var(&c.Assert.MinUpload, "assert.min-upload", "Upload bandwidth the test of -once must reach, e.g. 20Mbps")
+	fs.DurationVar(&c.Assert.MaxPing, "assert.max-ping", c.Assert.MaxPing, "Latency the test of -once must stay under, e.g. 40ms")
+	fs.StringVar(&c.OnceOutput, "once.output", c.OnceOutput, "Format of the result of -once: json, or junit for a JUnit XML report of the test and its -assert thresholds")
+	fs.StringVar(&c.Web.ListenAddress, "web.listen-address", c.Web.ListenAddress, "Address to listen on for web interface and telemetry, or unix:///path/to/socket for a Unix domain socket.")
+	fs.StringVar(&c.Web.SocketMode, "web.socket-mode", c.Web.SocketMode, "Permissions of the Unix domain socket when listening on a unix:// address")
+	fs.StringVar(&c.Web.TelemetryPath, "web.telemetry-path", c.Web.TelemetryPath, "Path under which to expose metrics.")
+	fs.StringVar(&c.Web.ConfigFile, "web.config.file", c.Web.ConfigFile, "Path to the exporter-toolkit web configuration file, enabling TLS and authentication. Changes require a restart")
+	fs.BoolVar(&c.Web.DisableExporterMetrics, "web.disable-exporter-metrics", c.Web.DisableExporterMetrics, "Exclude the Go runtime, process and scrape handler metrics of the exporter from the telemetry path. Changes require a restart")
+	fs.BoolVar(&c.Web.EnablePprof, "web.enable-pprof", c.Web.EnablePprof, "Serve the pprof profiling endpoints under /debug/pprof/. Changes require a restart")
+	fs.StringVar(&c.Web.PprofListenAddress, "web.pprof-listen-address", c.Web.PprofListenAddress, "Serve the pprof endpoints on this address (e.g. localhost:6060) instead of the main listener. Changes require a restart")
+	fs.BoolVar(&c.Web.EnableDebugServers, "web.enable-debug-servers", c.Web.EnableDebugServers, "Serve the servers the test server was selected from under /debug/servers. Changes require a restart")
+	fs.BoolVar(&c.Web.ReadyRequiresFirstTest, "web.ready-requires-first-test", c.Web.ReadyRequiresFirstTest, "Only report ready once a test completed successfully")
+	fs.BoolVar(&c.Web.DisableConfigEndpoint, "web.disable-config-endpoint", c.Web.DisableConfigEndpoint, "Disable the /-/config endpoint, which returns the active configuration. Changes require a restart")
+	fs.StringVar(&c.Web.APITokenFile, "web.api-token-file", c.Web.APITokenFile, "File containing the bearer token required by the state-changing endpoints, such as /-/reload")
+	fs.Var(&c.Web.AllowedCIDRs, "web.allowed-cidrs", "Comma separated networks, e.g. 10.0.0.0/8,192.168.0.0/16, the clients of all the HTTP endpoints must be in. Other clients are answered 403. Defaults to any client")
+	fs.Var(&c.Web.AdminAllowedCIDRs, "web.admin-allowed-cidrs", "Comma separated networks the clients of the state-changing endpoints, such as /-/reload, must also be in. Defaults to the networks of -web.allowed-cidrs")
+	fs.BoolVar(&c.Web.TrustProxy, "web.trust-proxy", c.Web.TrustProxy, "Check the last address of the X-Forwarded-For header, as appended by a reverse proxy, against -web.allowed-cidrs instead of the address of the connection. Only enable behind a proxy setting the header")
+	fs.BoolVar(&c.Web.LogRequests, "web.log-requests", c.Web.LogRequests, "Log the HTTP requests, except health checks: at debug level, or info level for non-2xx responses. Changes require a restart")
+	fs.StringVar(&c.Web.ExternalURL, "web.external-url", c.Web.ExternalURL, "URL the exporter is reachable at, e.g. behind a reverse proxy. Used to generate the links of the landing page; its path is the default route prefix. Changes require a restart")
+	fs.StringVar(&c.Web.RoutePrefix, "web.route-prefix", c.Web.RoutePrefix, "Path prefix of all the HTTP endpoints. Defaults to the path of -web.external-url. Changes require a restart")
+	fs.StringVar(&c.Speedtest.ConfigURL, "speedtest.config-url", c.Speedtest.ConfigURL, "Speedtest configuration URL, or comma separated URLs of its mirrors tried in order")
+	fs.StringVar(&c.Speedtest.ServerURL, "speedtest.server-url", c.Speedtest.ServerURL, "Speedtest server list URL, or comma separated URLs of its mirrors tried in order")
+	fs.DurationVar(&c.Speedtest.FetchTimeout, "speedtest.fetch-timeout", c.Speedtest.FetchTimeout, "Timeout of each attempt at retrieving the Speedtest configuration or server list, from each URL of -speedtest.config-url and -speedtest.server-url")
+	fs.DurationVar(&c.Speedtest.InitTimeout, "speedtest.init-timeout", c.Speedtest.InitTimeout, "Timeout of the creation of the Speedtest client: the retrieval of the configuration and server list, from all their URLs, and the server selection")
+	fs.Var(&c.Speedtest.ClientLat, "speedtest.client-lat", "Latitude (degrees) of the client replacing the one of the Speedtest configuration, located by the GeoIP of the egress address, in the selection of the nearest servers. Requires -speedtest.client-lon")
+	fs.Var(&c.Speedtest.ClientLon, "speedtest.client-lon", "Longitude (degrees) of the client replacing the one of the Speedtest configuration, located by the GeoIP of the egress address, in the selection of the nearest servers. Requires -speedtest.client-lat")
+	fs.StringVar(&c.Speedtest.MiniURL, "speedtest.mini-url", c.Speedtest.MiniURL, "Base URL of a self-hosted Speedtest Mini server (e.g. http://mini.lan/speedtest/). When set, the Speedtest configuration and server list are not used")
+	fs.StringVar(&c.Speedtest.HostOverride, "speedtest.host-override", c.Speedtest.HostOverride, "Host name sent in the Host header and TLS SNI of the requests to -speedtest.mini-url, and verified in its certificate, instead of the host of the URL, e.g. to test a given node behind a load balancer by address")
+	fs.StringVar(&c.Speedtest.ProxyURL, "speedtest.proxy-url", c.Speedtest.ProxyURL, "URL of the proxy of the Speedtest requests: http://, https://, socks5:// or socks5h:// to resolve host names through the proxy. Defaults to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables")
+	fs.StringVar(&c.Speedtest.UserAgent, "speedtest.user-agent", c.Speedtest.UserAgent, "User-Agent of the Speedtest requests")
+	fs.Var(&c.Speedtest.Headers, "speedtest.header", "Header sent with every Speedtest request, as \"Name: value\". Repeatable")
+	fs.StringVar(&c.Speedtest.SourceAddress, "speedtest.source-address", c.Speedtest.SourceAddress, "Local address of the Speedtest connections, to test a given link of a multi-homed host")
+	fs.StringVar(&c.Speedtest.Interface, "speedtest.interface", c.Speedtest.Interface, "Network interface the Speedtest connections are bound to (Linux only)")
+	fs.StringVar(&c.Speedtest.Netns, "speedtest.netns", c.Speedtest.Netns, "Named network namespace the Speedtest connections are opened in, as created by ip netns add, e.g. wan2. The HTTP listener stays in the namespace of the exporter (Linux only)")
+	fs.StringVar(&c.Speedtest.TLS.CAFile, "speedtest.tls-ca-file", c.Speedtest.TLS.CAFile, "PEM file of the CA certificates trusted, in addition to the system ones, for the Speedtest servers")
+	fs.BoolVar(&c.Speedtest.TLS.InsecureSkipVerify, "speedtest.tls-insecure-skip-verify", c.Speedtest.TLS.InsecureSkipVerify, "Disable the verification of the Speedtest server certificates. Last resort, for self-signed certificates")
+	fs.IntVar(&c.Speedtest.Streams, "speedtest.streams", c.Speedtest.Streams, "Number of parallel connections of the download and upload phases")
+	fs.IntVar(&c.Speedtest.DownloadStreams, "speedtest.download-streams", c.Speedtest.DownloadStreams, "Number of parallel connections of the download phase. Defaults to -speedtest.streams")
+	fs.IntVar(&c.Speedtest.UploadStreams, "speedtest.upload-streams", c.Speedtest.UploadStreams, "Number of parallel connections of the upload phase. Defaults to -speedtest.streams")
+	fs.DurationVar(&c.Speedtest.DownloadDuration, "speedtest.download-duration", c.Speedtest.DownloadDuration, "Duration of the download phase, e.g. 10s. When not set, each image size is downloaded once")
+	fs.DurationVar(&c.Speedtest.UploadDuration, "speedtest.upload-duration", c.Speedtest.UploadDuration, "Duration of the upload phase, e.g. 10s. When not set, each payload size is uploaded once")
+	fs.Var(&c.Speedtest.DownloadSizes, "speedtest.download-sizes", "Comma separated list of the random image sizes downloaded, among "+supportedSizes+". Defaults to all of them")
+	fs.Var(&c.Speedtest.UploadMaxBytes, "speedtest.upload-max-bytes", "Maximum volume of the upload phase, e.g. 50MB. The phase is repeated until this volume or -speedtest.upload-duration is reached")
+	fs.Var(&c.Speedtest.UploadChunkSize, "speedtest.upload-chunk-size", "Size of the upload payloads, e.g. 256KB. Defaults to payloads from 256KiB to 2MiB")
+	fs.StringVar(&c.Speedtest.UploadFormat, "speedtest.upload-format", c.Speedtest.UploadFormat, "Encoding of the upload payloads: auto (form-encoded, falling back to raw when a server rejects it), form, as expected by upload.php, or raw")
+	fs.StringVar(&c.Speedtest.UploadPayload, "speedtest.upload-payload", c.Speedtest.UploadPayload, "Content of the upload payloads: random, incompressible, or zero, to measure the path through a transparent compression on purpose")
+	fs.DurationVar(&c.Speedtest.DialTimeout, "speedtest.dial-timeout", c.Speedtest.DialTimeout, "Timeout of the establishment of the connections to the Speedtest servers, counted as connect_timeout errors")
+	fs.DurationVar(&c.Speedtest.ReadTimeout, "speedtest.read-timeout", c.Speedtest.ReadTimeout, "Time after which a test request transferring no data is aborted, counted as a stalled_transfer error. 0 disables it")
+	fs.StringVar(&c.Speedtest.HTTPVersion, "speedtest.http-version", c.Speedtest.HTTPVersion, "HTTP version of the Speedtest requests: auto (HTTP/2 when negotiated over TLS), h1, h2 or h3 (test requests over QUIC, in the builds with the http3 tag)")
+	fs.BoolVar(&c.Speedtest.DownloadAdaptive, "speedtest.download-adaptive", c.Speedtest.DownloadAdaptive, "Pick the size and number of the downloaded images from a probe transfer, so the download phase lasts about the download duration, or 10s")
+	fs.IntVar(&c.Speedtest.PingSamples, "speedtest.ping-samples", c.Speedtest.PingSamples, "Number of latency samples of the servers, during the server selection and the ping phase")
+	fs.StringVar(&c.Speedtest.PingAggregation, "speedtest.ping-aggregation", c.Speedtest.PingAggregation, "Aggregation of the latency samples: min, mean or median")
+	fs.IntVar(&c.Speedtest.Retries, "speedtest.retries", c.Speedtest.Retries, "Number of retries of the test requests failing with transient errors, such as connection resets or 503 responses")
+	fs.BoolVar(&c.Speedtest.FreshConnections, "speedtest.fresh-connections", c.Speedtest.FreshConnections, "Dial fresh connections for each test phase instead of reusing those of the previous phases")
+	fs.BoolVar(&c.Speedtest.CacheCheckHeaders, "speedtest.cache-check-headers", c.Speedtest.CacheCheckHeaders, "Suspect a transparent cache when the download responses have an Age or a cache hit header, exported by speedtest_cached_result_suspected. Disable with =false for servers legitimately sending them")
+	fs.BoolVar(&c.Speedtest.CacheCheckContent, "speedtest.cache-check-content", c.Speedtest.CacheCheckContent, "Suspect a transparent cache when two downloads of an image size start with the same bytes, for the servers generating random images")
+	fs.BoolVar(&c.Speedtest.Duplex, "speedtest.duplex", c.Speedtest.Duplex, "Run the download and upload phases at once, loading both directions of the link, instead of one after the other. The results are exported as duplex_download and duplex_upload")
+	fs.BoolVar(&c.Speedtest.Share, "speedtest.share", c.Speedtest.Share, "Submit the successful results to speedtest.net, as the classic clients do, the URL of their result image being exported by speedtest_result_info")
+	fs.StringVar(&c.Speedtest.ShareURL, "speedtest.share-url", c.Speedtest.ShareURL, "speedtest.net API the results of -speedtest.share are submitted to")
+	fs.StringVar(&c.Speedtest.VerifyInterface, "speedtest.verify-interface", c.Speedtest.VerifyInterface, "Network interface whose byte counters are exported during the transfer phases, to check the bytes of the tests against the traffic of the host, e.g. eth0 (Linux only, left out elsewhere or when the interface is missing)")
+	fs.Var(&c.Speedtest.BufferSize, "speedtest.buffer-size", "Size of the buffers the downloads are read through, e.g. 4KiB. Defaults to 32KiB")
+	fs.StringVar(&c.Speedtest.Busy.Interface, "speedtest.skip-if-busy-interface", c.Speedtest.Busy.Interface, "Network interface whose traffic is sampled before the bandwidth tests, e.g. eth0, the tests being deferred or skipped while it exceeds -speedtest.busy-threshold (Linux only, the tests running whatever the traffic elsewhere)")
+	fs.Var(&c.Speedtest.Busy.Threshold, "speedtest.busy-threshold", "Traffic of -speedtest.skip-if-busy-interface, in the busier direction, above which the link is busy, e.g. 50Mbps")
+	fs.DurationVar(&c.Speedtest.Busy.SampleDuration, "speedtest.busy-sample-duration", c.Speedtest.Busy.SampleDuration, "Time the traffic of -speedtest.skip-if-busy-interface is sampled over before the bandwidth tests")
+	fs.DurationVar(&c.Speedtest.Busy.RetryDelay, "speedtest.busy-retry-delay", c.Speedtest.Busy.RetryDelay, "Delay a scheduled test finding the link busy is deferred by, up to -speedtest.busy-retries times, before being skipped. 0 skips it right away")
+	fs.IntVar(&c.Speedtest.Busy.Retries, "speedtest.busy-retries", c.Speedtest.Busy.Retries, "Number of times a scheduled test finding the link busy is deferred before being skipped")
+	fs.Float64Var(&c.Speedtest.CPUThreshold, "speedtest.cpu-threshold", c.Speedtest.CPUThreshold, "CPU utilization of the host, from 0 to 1, above which a transfer phase is flagged by speedtest_cpu_limited when reached for most of its duration (Linux only). 0 disables the CPU sampling")
+	fs.BoolVar(&c.Speedtest.Hops, "speedtest.hops", c.Speedtest.Hops, "Count the hops to the test server before the test phases, with TCP connections of increasing TTL. Omitted when the TTL can't be set")
+	fs.Var(&c.Speedtest.RateLimit, "speedtest.rate-limit", "Bandwidth cap of the transfer phases, e.g. 200Mbps, so the tests don't saturate a shared link")
+	fs.StringVar(&c.Speedtest.Mode, "speedtest.mode", c.Speedtest.Mode, "Run discrete tests, or keep low-rate transfers running continuously, catching the short outages and congestion the tests miss. One of: [test, soak]")
+	fs.Var(&c.Speedtest.Soak.DownloadRate, "speedtest.soak-download-rate", "Target download rate of the soak mode, e.g. 5Mbps, 0 leaving the download out")
+	fs.Var(&c.Speedtest.Soak.UploadRate, "speedtest.soak-upload-rate", "Target upload rate of the soak mode, e.g. 5Mbps, 0 leaving the upload out")
+	fs.StringVar(&c.Speedtest.Soak.URL, "speedtest.soak-url", c.Speedtest.Soak.URL, "URL downloaded from and uploaded to by the soak mode instead of the test server")
+	fs.DurationVar(&c.Speedtest.Soak.Interval, "speedtest.soak-interval", c.Speedtest.Soak.Interval, "Period the soak metrics are updated at")
+	fs.StringVar(&c.Speedtest.Aggregation, "speedtest.aggregation", c.Speedtest.Aggregation, "How the bandwidth is computed from the transfer samples: simple (bytes over the whole phase), stable-window (leaving out the TCP ramp-up) or ookla (as the speedtest.net clients, from the fastest slices and streams)")
+	fs.StringVar(&c.Speedtest.DNSServer, "speedtest.dns-server", c.Speedtest.DNSServer, "DNS server resolving the host names of the Speedtest and IP check requests instead of the system resolver, as address[:port], e.g. 9.9.9.9:53")
+	fs.Var(&c.Speedtest.Server.IDs, "speedtest.server-ids", "Comma separated list of server IDs the test server is selected from")
+	fs.Var(&c.Speedtest.Server.CountryCodes, "speedtest.server-country-codes", "Comma separated list of country codes the test server is selected from")
+	fs.StringVar(&c.Speedtest.Auth.Username, "speedtest.auth-username", c.Speedtest.Auth.Username, "Username for basic authentication against the test server")
+	fs.StringVar(&c.Speedtest.Auth.PasswordFile, "speedtest.auth-password-file", c.Speedtest.Auth.PasswordFile, "File containing the password for basic authentication against the test server")
+	fs.StringVar(&c.Speedtest.Auth.BearerTokenFile, "speedtest.bearer-token-file", c.Speedtest.Auth.BearerTokenFile, "File containing the bearer token sent to the test server")
+	fs.Var(&c.Speedtest.IP.URLs, "speedtest.ip-url", "Comma separated list of services answering the external IP address as plain text (e.g. https://checkip.amazonaws.com), tried in order when the Speedtest configuration has no valid client address")
+	fs.StringVar(&c.Speedtest.IP.Family, "speedtest.ip-family", c.Speedtest.IP.Family, "Address family the services of -speedtest.ip-url are queried over, and must answer. One of: [any, ipv4, ipv6]")
+	fs.DurationVar(&c.Speedtest.IP.CacheTTL, "speedtest.ip-cache-ttl", c.Speedtest.IP.CacheTTL, "Time the address answered by -speedtest.ip-url is cached for, a stale address being refreshed in the background. When zero, it is looked up on each test")
+	fs.BoolVar(&c.Speedtest.IP.DualStack, "speedtest.ip-dual-stack", c.Speedtest.IP.DualStack, "Also look up the IPv4 and IPv6 addresses with the services of -speedtest.ip-url, exported by speedtest_external_address_info")
+	fs.BoolVar(&c.Speedtest.IP.Netns, "speedtest.ip-netns", c.Speedtest.IP.Netns, "Query the services of -speedtest.ip-url from within -speedtest.netns, or the network namespace of the link, too")
+	fs.BoolVar(&c.Speedtest.IP.RDNS, "speedtest.ip-rdns", c.Speedtest.IP.RDNS, "Resolve the reverse DNS name of the external IP address, exported by speedtest_external_ip_rdns_info")
+	fs.DurationVar(&c.Speedtest.IP.Timeout, "speedtest.ip-timeout", c.Speedtest.IP.Timeout, "Timeout of the lookup of each service of -speedtest.ip-url")
+	fs.Var(&c.Speedtest.Expect.Download, "speedtest.expect-download", "Download bandwidth the tests are expected to reach, e.g. 500Mbps, a warning being logged when missed")
+	fs.Var(&c.Speedtest.Expect.Upload, "speedtest.expect-upload", "Upload bandwidth the tests are expected to reach, e.g. 50Mbps, a warning being logged when missed")
+	fs.DurationVar(&c.Speedtest.Expect.Ping, "speedtest.expect-ping", c.Speedtest.Expect.Ping, "Latency the tests are expected to stay under, e.g. 30ms, a warning being logged when missed")
+	fs.IntVar(&c.Speedtest.Expect.Misses, "speedtest.expect-misses", c.Speedtest.Expect.Misses, "Number of consecutive tests missing an expectation before it is reported, against flapping")
+	fs.DurationVar(&c.Schedule.Interval, "speedtest.interval", c.Schedule.Interval, "Run a test at this interval, scrapes returning the last result. When zero, a test is run on each scrape")
+	fs.DurationVar(&c.Schedule.PingInterval, "speedtest.ping-interval", c.Schedule.PingInterval, "Test the latency alone at this interval, against the server of the full tests run at -speedtest.bandwidth-interval, e.g. 1m")
+	fs.DurationVar(&c.Schedule.BandwidthInterval, "speedtest.bandwidth-interval", c.Schedule.BandwidthInterval, "Run the full tests at this interval, instead of -speedtest.interval, when the latency is tested at -speedtest.ping-interval, e.g. 2h")
+	fs.BoolVar(&c.Schedule.RetestAnomalies, "speedtest.retest-anomalies", c.Schedule.RetestAnomalies, "Run one confirmation test right after a scheduled test flagged by -metrics.anomaly-threshold")
+	fs.IntVar(&c.Schedule.MaxConcurrentTests, "speedtest.max-concurrent-tests", c.Schedule.MaxConcurrentTests, "Number of tests run at once by the exporter, its links, the probes and the targets, the others being queued. Raise it for links that don't share any bandwidth")
+	fs.DurationVar(&c.Schedule.MaxQueueWait, "speedtest.max-queue-wait", c.Schedule.MaxQueueWait, "Maximum time a test waits for its turn, after which it fails in the queue phase")
+	fs.IntVar(&c.Schedule.ReinitAfterFailures, "speedtest.reinit-after-failures", c.Schedule.ReinitAfterFailures, "Create the Speedtest client again, with a fresh configuration, server list and test server, after this many consecutive failed tests. Zero disables it")
+	fs.DurationVar(&c.Schedule.ReinitBackoff, "speedtest.reinit-backoff", c.Schedule.ReinitBackoff, "Minimum time between two re-initializations of the Speedtest client, doubled each time until a test succeeds, up to an hour")
+	fs.DurationVar(&c.Schedule.RateLimitMaxBackoff, "speedtest.rate-limit-max-backoff", c.Schedule.RateLimitMaxBackoff, "Longest time the tests are suspended for after 403 or 429 responses, the backoff doubling from twice the interval with each rate-limited test until one succeeds. 0 disables the backoff")
+	fs.BoolVar(&c.Output.Timestamps, "output.timestamps", c.Output.Timestamps, "Expose the result samples with the time the test completed, instead of the scrape time")
+	fs.StringVar(&c.Metrics.Namespace, "metrics.namespace", c.Metrics.Namespace, "Prefix of the exported metric names, e.g. speedtest_ookla. Changes require a restart")
+	fs.Var(&c.Metrics.Labels, "metrics.label", "Constant label attached to every exported metric, as name=value. Repeatable. Changes require a restart")
+	fs.BoolVar(&c.Metrics.NoIPLabel, "metrics.no-ip-label", c.Metrics.NoIPLabel, "Don't label the results with the external IP address, which is then not looked up. Changes require a restart")
+	fs.IntVar(&c.Metrics.Window, "metrics.window", c.Metrics.Window, "Number of recent tests the average, minimum and maximum of the results are exported over, e.g. speedtest_download_window_avg. Changes require a restart")
+	fs.Float64Var(&c.Metrics.AnomalyThreshold, "metrics.anomaly-threshold", c.Metrics.AnomalyThreshold, "Deviation from the median of -metrics.window, in percent, beyond which a result is flagged by speedtest_result_anomalous. Changes require a restart")
+	fs.BoolVar(&c.Metrics.ServerLabels, "metrics.server-labels", c.Metrics.ServerLabels, "Label the results with the server_id and server_name of the test server. Changes require a restart")
+	fs.Var(&c.Line.Download, "line.download", "Subscribed download rate of the line, e.g. 1000Mbps, exported with the ratio of the measured bandwidth to it")
+	fs.Var(&c.Line.Upload, "line.upload", "Subscribed upload rate of the line, e.g. 50Mbps, exported with the ratio of the measured bandwidth to it")
+	fs.Var(&c.DNS.Names, "dns.names", "Comma separated names looked up alongside each test, e.g. example.com,netflix.com, their lookups being exported by speedtest_dns_lookup_seconds")
+	fs.StringVar(&c.DNS.Server, "dns.server", c.DNS.Server, "DNS server (IP address with an optional port) the names of -dns.names are looked up with, instead of the system resolver")
+	fs.DurationVar(&c.DNS.Timeout, "dns.timeout", c.DNS.Timeout, "Timeout of each lookup of -dns.names")
+	fs.StringVar(&c.GeoIP.Database, "geoip.database", c.GeoIP.Database, "Local MMDB database the external IP address is located with, e.g. /usr/share/GeoIP/GeoLite2-City.mmdb, exported by speedtest_external_ip_geo_info")
+	fs.StringVar(&c.GeoIP.ASNDatabase, "geoip.asn-database", c.GeoIP.ASNDatabase, "Local MMDB database the origin AS of the external IP address is found in, e.g. /usr/share/GeoIP/GeoLite2-ASN.mmdb, exported by speedtest_external_ip_asn_info")
+	fs.BoolVar(&c.GeoIP.ASNDNS, "geoip.asn-dns", c.GeoIP.ASNDNS, "Find the origin AS of the external IP address with DNS queries to Team Cymru when not in -geoip.asn-database")
+	fs.BoolVar(&c.Probe.Only, "probe.only", c.Probe.Only, "Only run tests on /probe requests. The metrics path then exposes the exporter's own metrics only")
+	fs.DurationVar(&c.Probe.Timeout, "probe.timeout", c.Probe.Timeout, "Probe timeout used when the scrape timeout is not sent by Prometheus")
+	fs.StringVar(&c.Probe.ModulesFile, "probe.modules-file", c.Probe.ModulesFile, "Probe modules configuration file")
+	fs.StringVar(&c.Probe.TargetsFile, "probe.targets-file", c.Probe.TargetsFile, "File listing the targets tested at the schedule interval, watched for changes")
+	fs.StringVar(&c.Log.Level, "log.level", c.Log.Level, "Only log messages with the given severity or above. One of: ["+strings.Join(promslog.LevelFlagOptions, ", ")+"]")
+	fs.StringVar(&c.Log.Format, "log.format", c.Log.Format, "Output format of log messages. One of: ["+strings.Join(promslog.FormatFlagOptions, ", ")+"]. Changes require a restart")
+	fs.DurationVar(&c.Log.DedupWindow, "log.dedup-window", c.Log.DedupWindow, "Period of the summaries of the errors of the tests repeating the previous one, which are otherwise not logged. 0 logs them all")
+	fs.StringVar(&c.State.File, "state.file", c.State.File, "File the exporter state, such as the last result, is saved to on shutdown. Changes require a restart")
+	fs.StringVar(&c.Results.File, "results.file", c.Results.File, "File each test result is appended to, as a line of JSON. Changes require a restart")
+	fs.Var(&c.Results.MaxSize, "results.max-size", "Size the results file is rotated at, e.g. 100MB, 0 meaning never. Changes require a restart")
+	fs.IntVar(&c.Results.MaxFiles, "results.max-files", c.Results.MaxFiles, "Number of rotated results files kept. Changes require a restart")
+	fs.StringVar(&c.History.DB, "history.db", c.History.DB, "SQLite database the test results are stored in, served on /history. Changes require a restart")
+	fs.Var(&c.History.Retention, "history.retention", "Age the results of -history.db are deleted at, e.g. 90d, 0 meaning never. Changes require a restart")
+	fs.StringVar(&c.Influx.URL, "influx.url", c.Influx.URL, "URL of the InfluxDB server each test result is written to. Changes require a restart")
+	fs.StringVar(&c.Influx.Org, "influx.org", c.Influx.Org, "Organization of -influx.bucket. Changes require a restart")
+	fs.StringVar(&c.Influx.Bucket, "influx.bucket", c.Influx.Bucket, "Bucket the results are written to, with InfluxDB 2.x. Changes require a restart")
+	fs.StringVar(&c.Influx.Database, "influx.database", c.Influx.Database, "Database the results are written to, with InfluxDB 1.x. Changes require a restart")
+	fs.StringVar(&c.Influx.TokenFile, "influx.token-file", c.Influx.TokenFile, "File containing the InfluxDB 2.x API token. Changes require a restart")
+	fs.StringVar(&c.Influx.Username, "influx.username", c.Influx.Username, "Username of InfluxDB 1.x. Changes require a restart")
+	fs.StringVar(&c.Influx.PasswordFile, "influx.password-file", c.Influx.PasswordFile, "File containing the password of -influx.username. Changes require a restart")
+	fs.StringVar(&c.Influx.File, "influx.file", c.Influx.File, "File each test result is appended to as InfluxDB line protocol, such as for the tail plugin of Telegraf. Changes require a restart")
+	fs.StringVar(&c.Influx.Measurement, "influx.measurement", c.Influx.Measurement, "Measurement of the InfluxDB points. Changes require a restart")
+	fs.IntVar(&c.Influx.Retries, "influx.retries", c.Influx.Retries, "Number of retries of the failed InfluxDB writes. Changes require a restart")
+	fs.StringVar(&c.MQTT.Broker, "mqtt.broker", c.MQTT.Broker, "URL of the MQTT broker each test result is published to, e.g. tcp://broker:1883. Changes require a restart")
+	fs.StringVar(&c.MQTT.Topic, "mqtt.topic", c.MQTT.Topic, "Topic the results are published to as retained JSON messages. Changes require a restart")
+	fs.StringVar(&c.MQTT.ClientID, "mqtt.client-id", c.MQTT.ClientID, "Client ID of the exporter on the MQTT broker. Changes require a restart")
+	fs.StringVar(&c.MQTT.Username, "mqtt.username", c.MQTT.Username, "Username on the MQTT broker. Changes require a restart")
+	fs.StringVar(&c.MQTT.PasswordFile, "mqtt.password-file", c.MQTT.PasswordFile, "File containing the password of -mqtt.username. Changes require a restart")
+	fs.StringVar(&c.MQTT.TLS.CAFile, "mqtt.tls-ca-file", c.MQTT.TLS.CAFile, "PEM file of the CA certificates trusted, in addition to the system ones, for the MQTT broker. Changes require a restart")
+	fs.BoolVar(&c.MQTT.TLS.InsecureSkipVerify, "mqtt.tls-insecure-skip-verify", c.MQTT.TLS.InsecureSkipVerify, "Disable the verification of the MQTT broker certificate. Changes require a restart")
+	fs.IntVar(&c.MQTT.QoS, "mqtt.qos", c.MQTT.QoS, "QoS of the MQTT messages, 0, 1 or 2. Changes require a restart")
+	fs.BoolVar(&c.MQTT.MetricTopics, "mqtt.metric-topics", c.MQTT.MetricTopics, "Also publish the measured values to subtopics of -mqtt.topic, such as its download subtopic. Changes require a restart")
+	fs.BoolVar(&c.MQTT.Discovery, "mqtt.discovery", c.MQTT.Discovery, "Publish the Home Assistant MQTT discovery messages of the sensors. Changes require a restart")
+	fs.StringVar(&c.MQTT.DiscoveryPrefix, "mqtt.discovery-prefix", c.MQTT.DiscoveryPrefix, "Home Assistant MQTT discovery prefix. Changes require a restart")
+	fs.StringVar(&c.OTLP.Endpoint, "otlp.endpoint", c.OTLP.Endpoint, "Host and port of the OpenTelemetry collector the metrics of each test are pushed to, e.g. otel-collector:4317. Changes require a restart")
+	fs.StringVar(&c.OTLP.Protocol, "otlp.protocol", c.OTLP.Protocol, "Protocol of -otlp.endpoint, "+otlpProtocolGRPC+" or "+otlpProtocolHTTP+". Changes require a restart")
+	fs.BoolVar(&c.OTLP.Insecure, "otlp.insecure", c.OTLP.Insecure, "Connect to -otlp.endpoint without TLS. Changes require a restart")
+	fs.StringVar(&c.OTLP.TLS.CAFile, "otlp.tls-ca-file", c.OTLP.TLS.CAFile, "PEM file of the CA certificates trusted, in addition to the system ones, for -otlp.endpoint. Changes require a restart")
+	fs.BoolVar(&c.OTLP.TLS.InsecureSkipVerify, "otlp.tls-insecure-skip-verify", c.OTLP.TLS.InsecureSkipVerify, "Disable the verification of the -otlp.endpoint certificate. Changes require a restart")
+	fs.StringVar(&c.StatsD.Address, "statsd.address", c.StatsD.Address, "Host and port of the StatsD server each test result is sent to as gauges, over UDP. Changes require a restart")
+	fs.StringVar(&c.StatsD.GraphiteAddress, "statsd.graphite-address", c.StatsD.GraphiteAddress, "Host and port of the Graphite plaintext listener each test result is sent to, over TCP. Changes require a restart")
+	fs.StringVar(&c.StatsD.Template, "statsd.template", c.StatsD.Template, "Path of the StatsD and Graphite metrics, e.g. speedtest.{site}.{metric}, {site} being the value of the site constant label. Changes require a restart")
+	fs.StringVar(&c.StatsD.TagFormat, "statsd.tag-format", c.StatsD.TagFormat, "Format of the tags of the StatsD and Graphite metrics: none, datadog or graphite. Changes require a restart")
+	fs.Var(&c.OTLP.Headers, "otlp.header", "Header sent with the OTLP exports, such as for authentication, as \"Name: value\". Repeatable. Changes require a restart")
+	fs.StringVar(&c.Tracing.OTLPEndpoint, "tracing.otlp-endpoint", c.Tracing.OTLPEndpoint, "Host and port of the OpenTelemetry collector the traces of the tests are exported to, e.g. otel-collector:4317. Tracing is disabled when not set. Changes require a restart")
+	fs.StringVar(&c.Tracing.OTLPProtocol, "tracing.otlp-protocol", c.Tracing.OTLPProtocol, "Protocol of -tracing.otlp-endpoint, "+otlpProtocolGRPC+" or "+otlpProtocolHTTP+". Changes require a restart")
+	fs.BoolVar(&c.Tracing.OTLPInsecure, "tracing.otlp-insecure", c.Tracing.OTLPInsecure, "Connect to -tracing.otlp-endpoint without TLS. Changes require a restart")
+	fs.StringVar(&c.Tracing.OTLPTLS.CAFile, "tracing.otlp-tls-ca-file", c.Tracing.OTLPTLS.CAFile, "PEM file of the CA certificates trusted, in addition to the system ones, for -tracing.otlp-endpoint. Changes require a restart")
+	fs.BoolVar(&c.Tracing.OTLPTLS.InsecureSkipVerify, "tracing.otlp-tls-insecure-skip-verify", c.Tracing.OTLPTLS.InsecureSkipVerify, "Disable the verification of the -tracing.otlp-endpoint certificate. Changes require a restart")
+	fs.Var(&c.Tracing.OTLPHeaders, "tracing.otlp-header", "Header sent with the trace exports, such as for authentication, as \"Name: value\". Repeatable. Changes require a restart")
+	fs.Float64Var(&c.Tracing.SampleRatio, "tracing.sample-ratio", c.Tracing.SampleRatio, "Share of the tests traced, from 0 to 1. Changes require a restart")
+	fs.StringVar(&c.RemoteWrite.URL, "remote-write.url", c.RemoteWrite.URL, "Prometheus remote write URL the metrics of each test are pushed to, e.g. https://mimir.example.com/api/v1/push. Changes require a restart")
+	fs.StringVar(&c.RemoteWrite.Username, "remote-write.username", c.RemoteWrite.Username, "Basic auth username of -remote-write.url. Changes require a restart")
+	fs.StringVar(&c.RemoteWrite.PasswordFile, "remote-write.password-file", c.RemoteWrite.PasswordFile, "File containing the password of -remote-write.username. Changes require a restart")
+	fs.StringVar(&c.RemoteWrite.BearerTokenFile, "remote-write.bearer-token-file", c.RemoteWrite.BearerTokenFile, "File containing the bearer token of -remote-write.url. Changes require a restart")
+	fs.StringVar(&c.RemoteWrite.TLS.CAFile, "remote-write.tls-ca-file", c.RemoteWrite.TLS.CAFile, "PEM file of the CA certificates trusted, in addition to the system ones, for -remote-write.url. Changes require a restart")
+	fs.BoolVar(&c.RemoteWrite.TLS.InsecureSkipVerify, "remote-write.tls-insecure-skip-verify", c.RemoteWrite.TLS.InsecureSkipVerify, "Disable the verification of the -remote-write.url certificate. Changes require a restart")
+	fs.Var(&c.RemoteWrite.Headers, "remote-write.header", "Header sent with the remote write requests, such as X-Scope-OrgID, as \"Name: value\". Repeatable. Changes require a restart")
+	fs.StringVar(&c.Webhook.URL, "webhook.url", c.Webhook.URL, "URL the JSON result of each test is posted to. Changes require a restart")
+	fs.DurationVar(&c.Webhook.Timeout, "webhook.timeout", c.Webhook.Timeout, "Timeout of the webhook requests. Changes require a restart")
+	fs.StringVar(&c.Webhook.SecretFile, "webhook.secret-file", c.Webhook.SecretFile, "File containing the secret the webhook requests are signed with, in the "+webhookSignatureHeader+" header. Changes require a restart")
+	fs.IntVar(&c.RemoteWrite.Retries, "remote-write.retries", c.RemoteWrite.Retries, "Number of retries of the remote write requests failed with a 5xx or 429 status. Changes require a restart")
+}
+
+// envPrefix prefixes the environment variables matching the flags, e.g.
+// SPEEDTEST_EXPORTER_WEB_LISTEN_ADDRESS for -web.listen-address
+const envPrefix = "SPEEDTEST_EXPORTER_"
+
+// parseConfig builds the configuration from the command line arguments, the
+// environment and the configuration file or URL they point to. Flags take
+// precedence over the environment, which takes precedence over the profile,
+// which takes precedence over the file.
+func parseConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	// A first pass finds the configuration file and the profile. The
+	// environment and the flags are then applied again on top of their
+	// content, so they override it.
+	config := defaultConfig()
+	config.registerFlags(fs)
+	documentEnv(fs)
+	if err := setFromEnv(fs); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if config.ConfigFile != "" && config.ConfigURL != "" {
+		return nil, fmt.Errorf("-config.file and -config.url are mutually exclusive")
+	}
+	source := config.ConfigFile
+	var buf []byte
+	var err error
+	switch {
+	case config.ConfigURL != "":
+		source = config.ConfigURL
+		buf, err = fetchConfig(config.ConfigURL)
+	case config.ConfigFile != "":
+		buf, err = ioutil.ReadFile(config.ConfigFile)
+	case config.Profile == "":
+		config.markExplicit(nil, fs)
+		return config, config.validate(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profile := config.Profile
+	config = defaultConfig()
+	var root *yaml.Node
+	if source != "" {
+		if root, err = decodeConfig(source, buf, config); err != nil {
+			return nil, err
+		}
+		config.hash = fmt.Sprintf("%x", sha256.Sum256(buf))[:16]
+	}
+	if profile != "" {
+		config.Profile = profile
+	}
+	config.applyProfile()
+	overrides := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	overrides.SetOutput(ioutil.Discard)
+	config.registerFlags(overrides)
+	if err := setFromEnv(overrides); err != nil {
+		return nil, err
+	}
+	if err := overrides.Parse(args); err != nil {
+		return nil, err
+	}
+	config.markExplicit(root, overrides)
+	if source == "" {
+		return config, config.validate(nil)
+	}
+	if err := config.validate(root); err != nil {
+		return nil, fmt.Errorf("Invalid configuration file %s: %s", source, err)
+	}
+	return config, nil
+}
+
+// parameterSettings are the settings of the speedtest section defaulting to
+// the test parameters of the Speedtest configuration, by YAML name
+var parameterSettings = []string{"streams", "download_streams", "upload_streams", "download_duration", "upload_duration", "upload_chunk_size"}
+
+// markExplicit records which of parameterSettings are set by the
+// configuration file root, if not nil, the flags of fs or their environment
+// variables, or the profile
+func (c *Config) markExplicit(root *yaml.Node, fs *flag.FlagSet) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	c.Speedtest.explicit = map[string]bool{}
+	for _, name := range parameterSettings {
+		c.Speedtest.explicit[name] = c.Profile == profileLowMemory || set["speedtest."+strings.ReplaceAll(name, "_", "-")] ||
+			findNode(root, []string{"speedtest", name}) != nil
+	}
+}
+
+// profileLowMemory is the profile of the devices short of memory
+const profileLowMemory = "low-memory"
+
+// The settings of profileLowMemory
+const (
+	lowMemoryBufferSize = byteSize(4 << 10)
+	lowMemoryStreams    = 2
+	lowMemoryDuration   = 8 * time.Second
+	lowMemoryChunkSize  = byteSize(256 << 10)
+)
+
+// applyProfile tunes the settings of the configuration profile together.
+// The low-memory profile reads the downloads through small buffers, caps
+// the streams, the duration of the transfer phases and the size of the
+// upload payloads, and computes the bandwidth with the simple aggregation,
+// which retains no throughput samples.
+func (c *Config) applyProfile() {
+	if c.Profile != profileLowMemory {
+		return
+	}
+	s := &c.Speedtest
+	s.BufferSize = lowMemoryBufferSize
+	s.Streams = min(s.Streams, lowMemoryStreams)
+	s.DownloadStreams = min(s.DownloadStreams, lowMemoryStreams)
+	s.UploadStreams = min(s.UploadStreams, lowMemoryStreams)
+	if s.DownloadDuration == 0 || s.DownloadDuration > lowMemoryDuration {
+		s.DownloadDuration = lowMemoryDuration
+	}
+	if s.UploadDuration == 0 || s.UploadDuration > lowMemoryDuration {
+		s.UploadDuration = lowMemoryDuration
+	}
+	if s.UploadChunkSize == 0 || s.UploadChunkSize > lowMemoryChunkSize {
+		s.UploadChunkSize = lowMemoryChunkSize
+	}
+	s.Aggregation = speedtest.AggregationSimple
+}
+
+// envName returns the environment variable matching a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flagName))
+}
+
+// setFromEnv sets the flags from their environment variables, if set
+func setFromEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("Invalid value %q for %s (-%s): %s", value, name, f.Name, expectedValue(f, e))
+		}
+	})
+	return err
+}
+
+// expectedValue describes the values a flag accepts, for the parsing error
+// err
+func expectedValue(f *flag.Flag, err error) string {
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return "expected a boolean (true, false, 1 or 0)"
+	}
+	if getter, ok := f.Value.(flag.Getter); ok {
+		switch getter.Get().(type) {
+		case time.Duration:
+			return "expected a duration such as 90s, 15m or 1h30m"
+		case int, int64, uint, uint64:
+			return "expected an integer"
+		}
+	}
+	return err.Error()
+}
+
+// documentEnv appends the environment variable of each flag to its usage
+func documentEnv(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Usage += " [$" + envName(f.Name) + "]"
+	})
+}
+
+// decodeConfig strictly decodes the configuration file read from source on
+// top of config. It returns the document root node, used to locate
+// validation errors.
+func decodeConfig(source string, buf []byte, config *Config) (*yaml.Node, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("Can't parse %s: %s", source, err)
+	}
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(buf, root); err != nil {
+		return nil, fmt.Errorf("Can't parse %s: %s", source, err)
+	}
+	return root, nil
+}
+
+// configError is a validation error of a configuration field, identified
+// by its YAML path (e.g. "speedtest.config_url")
+type configError struct {
+	path string
+	msg  string
+}
+
+// validate checks the configuration. When root is not nil, errors are
+// prefixed by the line of the offending field in the configuration file.
+func (c *Config) validate(root *yaml.Node) error {
+	var errs []configError
+	check := func(path string, err error) {
+		if err != nil {
+			errs = append(errs, configError{path: path, msg: err.Error()})
+		}
+	}
+	if c.Profile != "" && c.Profile != profileLowMemory {
+		check("profile", fmt.Errorf("must be %s, got %q", profileLowMemory, c.Profile))
+	}
+	switch c.Backend {
+	case backendSpeedtest, backendMock:
+	default:
+		check("backend", fmt.Errorf("must be %s or %s, got %q", backendSpeedtest, backendMock, c.Backend))
+	}
+	check("backends", c.validateBackends())
+	if c.Backend == backendMock || slices.Contains(c.Backends, backendMock) {
+		if c.Mock.Download <= 0 {
+			check("mock.download", fmt.Errorf("must be positive"))
+		}
+		if c.Mock.Upload <= 0 {
+			check("mock.upload", fmt.Errorf("must be positive"))
+		}
+		if c.Mock.Ping <= 0 {
+			check("mock.ping", fmt.Errorf("must be positive"))
+		}
+		if c.Mock.Jitter < 0 {
+			check("mock.jitter", fmt.Errorf("must not be negative"))
+		}
+		if c.Mock.Noise < 0 || c.Mock.Noise >= 1 {
+			check("mock.noise", fmt.Errorf("must be between 0 and 1, got %v", c.Mock.Noise))
+		}
+		if c.Mock.FailureRate < 0 || c.Mock.FailureRate > 1 {
+			check("mock.failure_rate", fmt.Errorf("must be between 0 and 1, got %v", c.Mock.FailureRate))
+		}
+	}
+	if c.Assert.MaxPing < 0 {
+		check("assert.max_ping", fmt.Errorf("must not be negative"))
+	}
+	if c.Assert != (AssertConfig{}) && !c.Once {
+		check("assert", fmt.Errorf("the thresholds only apply to -once"))
+	}
+	switch {
+	case c.OnceOutput != onceOutputJSON && c.OnceOutput != onceOutputJUnit:
+		check("once.output", fmt.Errorf("must be %s or %s, got %q", onceOutputJSON, onceOutputJUnit, c.OnceOutput))
+	case c.OnceOutput != onceOutputJSON && !c.Once:
+		check("once.output", fmt.Errorf("only applies to -once"))
+	}
+	check("web.listen_address", validateNotEmpty(c.Web.ListenAddress))
+	if strings.HasPrefix(c.Web.ListenAddress, unixPrefix) {
+		_, err := parseSocketMode(c.Web.SocketMode)
+		check("web.socket_mode", err)
+	}
+	check("web.telemetry_path", validatePath(c.Web.TelemetryPath))
+	if c.Web.ConfigFile != "" {
+		check("web.config_file", web.Validate(c.Web.ConfigFile))
+	}
+	if c.Web.RoutePrefix != "" {
+		check("web.route_prefix", validatePath(c.Web.RoutePrefix))
+	}
+	if c.Web.ExternalURL != "" {
+		check("web.external_url", validateURL(c.Web.ExternalURL))
+	}
+	_, err := parsePrefixes(c.Web.AllowedCIDRs)
+	check("web.allowed_cidrs", err)
+	_, err = parsePrefixes(c.Web.AdminAllowedCIDRs)
+	check("web.admin_allowed_cidrs", err)
+	check("speedtest.config_url", validateURLs(c.Speedtest.ConfigURL))
+	check("speedtest.server_url", validateURLs(c.Speedtest.ServerURL))
+	if c.Speedtest.FetchTimeout <= 0 {
+		check("speedtest.fetch_timeout", fmt.Errorf("must be positive"))
+	}
+	if c.Speedtest.InitTimeout <= 0 {
+		check("speedtest.init_timeout", fmt.Errorf("must be positive"))
+	}
+	if lat := c.Speedtest.ClientLat; lat.set && !(lat.degrees >= -90 && lat.degrees <= 90) {
+		check("speedtest.client_lat", fmt.Errorf("must be between -90 and 90, got %v", lat))
+	}
+	if lon := c.Speedtest.ClientLon; lon.set && !(lon.degrees >= -180 && lon.degrees <= 180) {
+		check("speedtest.client_lon", fmt.Errorf("must be between -180 and 180, got %v", lon))
+	}
+	if c.Speedtest.ClientLat.set && !c.Speedtest.ClientLon.set {
+		check("speedtest.client_lon", fmt.Errorf("must be set along with speedtest.client_lat"))
+	} else if c.Speedtest.ClientLon.set && !c.Speedtest.ClientLat.set {
+		check("speedtest.client_lat", fmt.Errorf("must be set along with speedtest.client_lon"))
+	}
+	if c.Speedtest.MiniURL != "" {
+		check("speedtest.mini_url", validateURL(c.Speedtest.MiniURL))
+	}
+	if c.Speedtest.HostOverride != "" {
+		if c.Speedtest.MiniURL == "" {
+			check("speedtest.host_override", fmt.Errorf("requires speedtest.mini_url"))
+		} else if u, err := url.Parse("//" + c.Speedtest.HostOverride); err != nil || u.Host != c.Speedtest.HostOverride || u.Hostname() == "" {
+			check("speedtest.host_override", fmt.Errorf("must be a host name, optionally with a port"))
+		}
+	}
+	if c.Speedtest.Share {
+		check("speedtest.share_url", validateURL(c.Speedtest.ShareURL))
+	}
+	check("speedtest.headers", validateHeaders(c.Speedtest.Headers))
+	if c.Speedtest.BufferSize < 0 {
+		check("speedtest.buffer_size", fmt.Errorf("must not be negative"))
+	}
+	if c.Speedtest.CPUThreshold < 0 || c.Speedtest.CPUThreshold > 1 {
+		check("speedtest.cpu_threshold", fmt.Errorf("must be between 0 and 1"))
+	}
+	if c.Speedtest.Busy.Interface != "" && c.Speedtest.Busy.Threshold <= 0 {
+		check("speedtest.busy_threshold", fmt.Errorf("must be positive with speedtest.skip_if_busy_interface"))
+	}
+	if c.Speedtest.Busy.SampleDuration <= 0 {
+		check("speedtest.busy_sample_duration", fmt.Errorf("must be positive"))
+	}
+	if c.Speedtest.Busy.RetryDelay < 0 {
+		check("speedtest.busy_retry_delay", fmt.Errorf("must not be negative"))
+	}
+	if c.Speedtest.Busy.Retries < 0 {
+		check("speedtest.busy_retries", fmt.Errorf("must not be negative"))
+	}
+	if c.Speedtest.Streams < 1 {
+		check("speedtest.streams", fmt.Errorf("must be positive"))
+	}
+	if c.Speedtest.DownloadStreams < 0 {
+		check("speedtest.download_streams", fmt.Errorf("must not be negative"))
+	}
+	if c.Speedtest.UploadStreams < 0 {
+		check("speedtest.upload_streams", fmt.Errorf("must not be negative"))
+	}
+	if c.Speedtest.DialTimeout <= 0 {
+		check("speedtest.dial_timeout", fmt.Errorf("must be positive"))
+	}
+	if c.Speedtest.ReadTimeout < 0 {
+		check("speedtest.read_timeout", fmt.Errorf("must not be negative"))
+	}
+	if c.Speedtest.PingSamples < 1 {
+		check("speedtest.ping_samples", fmt.Errorf("must be positive"))
+	}
+	switch c.Speedtest.PingAggregation {
+	case speedtest.PingAggregationMin, speedtest.PingAggregationMean, speedtest.PingAggregationMedian:
+	default:
+		check("speedtest.ping_aggregation", fmt.Errorf("must be one of %s, %s or %s, got %q", speedtest.PingAggregationMin, speedtest.PingAggregationMean, speedtest.PingAggregationMedian, c.Speedtest.PingAggregation))
+	}
+	if c.Speedtest.Retries < 0 {
+		check("speedtest.retries", fmt.Errorf("must not be negative"))
+	}
+	if c.Speedtest.DownloadDuration < 0 {
+		check("speedtest.download_duration", fmt.Errorf("must not be negative"))
+	}
+	if c.Speedtest.UploadDuration < 0 {
+		check("speedtest.upload_duration", fmt.Errorf("must not be negative"))
+	}
+	check("speedtest.download_sizes", validateDownloadSizes(c.Speedtest.DownloadSizes))
+	if c.Speedtest.UploadChunkSize > maxUploadChunkSize {
+		check("speedtest.upload_chunk_size", fmt.Errorf("must not exceed %s", maxUploadChunkSize))
+	}
+	switch c.Speedtest.UploadFormat {
+	case speedtest.UploadFormatAuto, speedtest.UploadFormatForm, speedtest.UploadFormatRaw:
+	default:
+		check("speedtest.upload_format", fmt.Errorf("must be one of %s, %s or %s, got %q", speedtest.UploadFormatAuto, speedtest.UploadFormatForm, speedtest.UploadFormatRaw, c.Speedtest.UploadFormat))
+	}
+	switch c.Speedtest.UploadPayload {
+	case speedtest.UploadPayloadRandom, speedtest.UploadPayloadZero:
+	default:
+		check("speedtest.upload_payload", fmt.Errorf("must be %s or %s, got %q", speedtest.UploadPayloadRandom, speedtest.UploadPayloadZero, c.Speedtest.UploadPayload))
+	}
+	switch c.Speedtest.HTTPVersion {
+	case speedtest.HTTPVersionAuto, speedtest.HTTPVersionH1, speedtest.HTTPVersionH2, speedtest.HTTPVersionH3:
+	default:
+		check("speedtest.http_version", fmt.Errorf("must be one of %s, %s, %s or %s, got %q", speedtest.HTTPVersionAuto, speedtest.HTTPVersionH1, speedtest.HTTPVersionH2, speedtest.HTTPVersionH3, c.Speedtest.HTTPVersion))
+	}
+	switch c.Speedtest.Aggregation {
+	case speedtest.AggregationSimple, speedtest.AggregationStableWindow, speedtest.AggregationOokla:
+	default:
+		check("speedtest.aggregation", fmt.Errorf("must be one of %s, %s or %s, got %q", speedtest.AggregationSimple, speedtest.AggregationStableWindow, speedtest.AggregationOokla, c.Speedtest.Aggregation))
+	}
+	switch c.Speedtest.Mode {
+	case modeTest:
+	case modeSoak:
+		if c.Speedtest.Soak.DownloadRate == 0 && c.Speedtest.Soak.UploadRate == 0 {
+			check("speedtest.soak", fmt.Errorf("download_rate or upload_rate must be set"))
+		}
+		if c.Speedtest.Soak.Interval <= 0 {
+			check("speedtest.soak.interval", fmt.Errorf("must be positive"))
+		}
+		if c.Speedtest.Soak.URL != "" {
+			check("speedtest.soak.url", validateURL(c.Speedtest.Soak.URL))
+		}
+		if c.Probe.Only {
+			check("speedtest.mode", fmt.Errorf("soak can't run with probe.only"))
+		}
+	default:
+		check("speedtest.mode", fmt.Errorf("must be one of %s or %s, got %q", modeTest, modeSoak, c.Speedtest.Mode))
+	}
+	if c.Speedtest.DNSServer != "" {
+		check("speedtest.dns_server", validateDNSServer(c.Speedtest.DNSServer))
+	}
+	if strings.Contains(c.Speedtest.Netns, "/") {
+		check("speedtest.netns", fmt.Errorf("invalid network namespace name %q", c.Speedtest.Netns))
+	}
+	if c.Speedtest.SourceAddress != "" && net.ParseIP(c.Speedtest.SourceAddress) == nil {
+		check("speedtest.source_address", fmt.Errorf("invalid IP address %q", c.Speedtest.SourceAddress))
+	}
+	if c.Speedtest.ProxyURL != "" {
+		check("speedtest.proxy_url", validateProxyURL(c.Speedtest.ProxyURL))
+		if c.Speedtest.Hops {
+			check("speedtest.hops", fmt.Errorf("can't be counted through a proxy"))
+		}
+	}
+	for _, u := range c.Speedtest.IP.URLs {
+		check("speedtest.ip.urls", validateURL(u))
+	}
+	if c.Speedtest.IP.Timeout <= 0 {
+		check("speedtest.ip.timeout", fmt.Errorf("must be positive"))
+	}
+	switch c.Speedtest.IP.Family {
+	case ipFamilyAny, ipFamilyIPv4, ipFamilyIPv6:
+	default:
+		check("speedtest.ip.family", fmt.Errorf("must be one of any, ipv4 or ipv6, got %q", c.Speedtest.IP.Family))
+	}
+	if c.Speedtest.IP.CacheTTL < 0 {
+		check("speedtest.ip.cache_ttl", fmt.Errorf("must not be negative"))
+	}
+	if c.Speedtest.Expect.Ping < 0 {
+		check("speedtest.expect.ping", fmt.Errorf("must not be negative"))
+	}
+	if c.Speedtest.Expect.Misses < 1 {
+		check("speedtest.expect.misses", fmt.Errorf("must be at least 1"))
+	}
+	if c.Speedtest.Auth.PasswordFile != "" && c.Speedtest.Auth.Username == "" {
+		check("speedtest.auth.password_file", fmt.Errorf("a password file requires a username"))
+	}
+	if c.Schedule.Interval < 0 {
+		check("schedule.interval", fmt.Errorf("must not be negative"))
+	}
+	switch {
+	case c.Schedule.PingInterval < 0:
+		check("schedule.ping_interval", fmt.Errorf("must not be negative"))
+	case c.Schedule.BandwidthInterval < 0:
+		check("schedule.bandwidth_interval", fmt.Errorf("must not be negative"))
+	case c.Schedule.PingInterval > 0 && c.Schedule.BandwidthInterval == 0:
+		check("schedule.ping_interval", fmt.Errorf("requires schedule.bandwidth_interval"))
+	case c.Schedule.BandwidthInterval > 0 && c.Schedule.PingInterval == 0:
+		check("schedule.bandwidth_interval", fmt.Errorf("requires schedule.ping_interval"))
+	case c.Schedule.PingInterval >= c.Schedule.BandwidthInterval && c.Schedule.PingInterval > 0:
+		check("schedule.ping_interval", fmt.Errorf("must be shorter than schedule.bandwidth_interval"))
+	}
+	if c.Schedule.MaxConcurrentTests < 1 {
+		check("schedule.max_concurrent_tests", fmt.Errorf("must be positive"))
+	}
+	if c.Schedule.MaxQueueWait <= 0 {
+		check("schedule.max_queue_wait", fmt.Errorf("must be positive"))
+	}
+	if c.Schedule.ReinitAfterFailures < 0 {
+		check("schedule.reinit_after_failures", fmt.Errorf("must not be negative"))
+	}
+	if c.Schedule.ReinitBackoff <= 0 {
+		check("schedule.reinit_backoff", fmt.Errorf("must be positive"))
+	}
+	if c.Schedule.RateLimitMaxBackoff < 0 {
+		check("schedule.rate_limit_max_backoff", fmt.Errorf("must not be negative"))
+	}
+	if c.Probe.Timeout <= 0 {
+		check("probe.timeout", fmt.Errorf("must be positive"))
+	}
+	if c.Results.MaxFiles < 0 {
+		check("results.max_files", fmt.Errorf("must not be negative"))
+	}
+	if c.Influx.URL != "" {
+		check("influx.url", validateURL(c.Influx.URL))
+		if c.Influx.Bucket == "" && c.Influx.Database == "" {
+			check("influx.url", fmt.Errorf("requires influx.bucket or influx.database"))
+		}
+	}
+	if c.Influx.Bucket != "" && c.Influx.Org == "" {
+		check("influx.bucket", fmt.Errorf("requires influx.org"))
+	}
+	if c.Influx.PasswordFile != "" && c.Influx.Username == "" {
+		check("influx.password_file", fmt.Errorf("a password file requires a username"))
+	}
+	check("influx.measurement", validateNotEmpty(c.Influx.Measurement))
+	if c.Influx.Retries < 0 {
+		check("influx.retries", fmt.Errorf("must not be negative"))
+	}
+	if c.MQTT.Broker != "" {
+		check("mqtt.broker", validateBrokerURL(c.MQTT.Broker))
+	}
+	check("mqtt.topic", validateTopic(c.MQTT.Topic))
+	check("mqtt.client_id", validateNotEmpty(c.MQTT.ClientID))
+	if c.MQTT.PasswordFile != "" && c.MQTT.Username == "" {
+		check("mqtt.password_file", fmt.Errorf("a password file requires a username"))
+	}
+	if c.MQTT.QoS < 0 || c.MQTT.QoS > 2 {
+		check("mqtt.qos", fmt.Errorf("must be 0, 1 or 2"))
+	}
+	if c.MQTT.Discovery {
+		check("mqtt.discovery_prefix", validateTopic(c.MQTT.DiscoveryPrefix))
+	}
+	if c.OTLP.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(c.OTLP.Endpoint); err != nil {
+			check("otlp.endpoint", fmt.Errorf("expected a host and port such as otel-collector:4317, got %q", c.OTLP.Endpoint))
+		}
+	}
+	switch c.OTLP.Protocol {
+	case otlpProtocolGRPC, otlpProtocolHTTP:
+	default:
+		check("otlp.protocol", fmt.Errorf("must be one of %s or %s, got %q", otlpProtocolGRPC, otlpProtocolHTTP, c.OTLP.Protocol))
+	}
+	check("otlp.headers", validateHeaders(c.OTLP.Headers))
+	if c.Tracing.OTLPEndpoint != "" {
+		if _, _, err := net.SplitHostPort(c.Tracing.OTLPEndpoint); err != nil {
+			check("tracing.otlp_endpoint", fmt.Errorf("expected a host and port such as otel-collector:4317, got %q", c.Tracing.OTLPEndpoint))
+		}
+	}
+	switch c.Tracing.OTLPProtocol {
+	case otlpProtocolGRPC, otlpProtocolHTTP:
+	default:
+		check("tracing.otlp_protocol", fmt.Errorf("must be one of %s or %s, got %q", otlpProtocolGRPC, otlpProtocolHTTP, c.Tracing.OTLPProtocol))
+	}
+	check("tracing.otlp_headers", validateHeaders(c.Tracing.OTLPHeaders))
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		check("tracing.sample_ratio", fmt.Errorf("must be between 0 and 1"))
+	}
+	if c.RemoteWrite.URL != "" {
+		check("remote_write.url", validateURL(c.RemoteWrite.URL))
+	}
+	if c.RemoteWrite.PasswordFile != "" && c.RemoteWrite.Username == "" {
+		check("remote_write.password_file", fmt.Errorf("a password file requires a username"))
+	}
+	if c.RemoteWrite.BearerTokenFile != "" && c.RemoteWrite.Username != "" {
+		check("remote_write.bearer_token_file", fmt.Errorf("can't be used with a basic auth username"))
+	}
+	check("remote_write.headers", validateHeaders(c.RemoteWrite.Headers))
+	if c.RemoteWrite.Retries < 0 {
+		check("remote_write.retries", fmt.Errorf("must not be negative"))
+	}
+	if c.Webhook.URL != "" {
+		check("webhook.url", validateURL(c.Webhook.URL))
+	}
+	if c.Webhook.Timeout <= 0 {
+		check("webhook.timeout", fmt.Errorf("must be positive"))
+	}
+	for path, address := range map[string]string{"statsd.address": c.StatsD.Address, "statsd.graphite_address": c.StatsD.GraphiteAddress} {
+		if _, _, err := net.SplitHostPort(address); address != "" && err != nil {
+			check(path, fmt.Errorf("expected a host and port such as localhost:8125, got %q", address))
+		}
+	}
+	check("statsd.template", validateTemplate(c.StatsD.Template, c.Metrics.Labels))
+	switch c.StatsD.TagFormat {
+	case statsdTagsNone, statsdTagsDatadog, statsdTagsGraphite:
+	default:
+		check("statsd.tag_format", fmt.Errorf("must be one of %s, %s or %s, got %q", statsdTagsNone, statsdTagsDatadog, statsdTagsGraphite, c.StatsD.TagFormat))
+	}
+	if c.Probe.TargetsFile != "" && c.Schedule.Interval <= 0 {
+		check("probe.targets_file", fmt.Errorf("requires schedule.interval"))
+	}
+	check("log.level", promslog.NewLevel().Set(c.Log.Level))
+	check("log.format", promslog.NewFormat().Set(c.Log.Format))
+	if c.Log.DedupWindow < 0 {
+		check("log.dedup_window", fmt.Errorf("must not be negative"))
+	}
+	if !metricNameRE.MatchString(c.Metrics.Namespace) {
+		check("metrics.namespace", fmt.Errorf("invalid metric name prefix %q", c.Metrics.Namespace))
+	}
+	check("metrics.labels", validateLabels(c.Metrics.Labels))
+	if c.Metrics.Window < 0 {
+		check("metrics.window", fmt.Errorf("must not be negative"))
+	}
+	if c.Metrics.AnomalyThreshold < 0 {
+		check("metrics.anomaly_threshold", fmt.Errorf("must not be negative"))
+	} else if c.Metrics.AnomalyThreshold > 0 && c.Metrics.Window <= 0 {
+		check("metrics.anomaly_threshold", fmt.Errorf("requires metrics.window"))
+	}
+	if c.Schedule.RetestAnomalies && c.Metrics.AnomalyThreshold <= 0 {
+		check("schedule.retest_anomalies", fmt.Errorf("requires metrics.anomaly_threshold"))
+	}
+	for name, module := range c.Probe.Modules {
+		check("probe.modules."+name, module.validate())
+	}
+	check("links", c.validateLinks())
+	if c.DNS.Server != "" {
+		check("dns.server", validateDNSServer(c.DNS.Server))
+	}
+	if c.DNS.Timeout <= 0 {
+		check("dns.timeout", fmt.Errorf("must be positive"))
+	}
+	for _, name := range c.DNS.Names {
+		if name == "" {
+			check("dns.names", fmt.Errorf("must not contain empty names"))
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		line := ""
+		if n := findNode(root, strings.Split(e.path, ".")); n != nil {
+			line = fmt.Sprintf("line %d: ", n.Line)
+		}
+		msgs = append(msgs, fmt.Sprintf("%s%s: %s", line, e.path, e.msg))
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+// validateBackends checks the compared backends, whose names go into the
+// backend label
+func (c *Config) validateBackends() error {
+	if len(c.Backends) == 0 {
+		return nil
+	}
+	switch {
+	case c.Backend != backendSpeedtest:
+		return fmt.Errorf("can't be combined with backend %s", c.Backend)
+	case c.Probe.Only:
+		return fmt.Errorf("can't be tested with probe.only")
+	case len(c.Links) > 0:
+		return fmt.Errorf("can't be combined with links")
+	case c.Speedtest.Mode == modeSoak:
+		return fmt.Errorf("can't be tested in %s mode", modeSoak)
+	}
+	seen := map[string]bool{}
+	for _, backend := range c.Backends {
+		switch {
+		case backend != backendSpeedtest && backend != backendMini && backend != backendMock:
+			return fmt.Errorf("unknown backend %q, expected %s, %s or %s", backend, backendSpeedtest, backendMini, backendMock)
+		case seen[backend]:
+			return fmt.Errorf("duplicate backend %q", backend)
+		case backend == backendMini && c.Speedtest.MiniURL == "":
+			return fmt.Errorf("backend %s requires speedtest.mini_url", backendMini)
+		}
+		seen[backend] = true
+	}
+	return nil
+}
+
+// validateLinks checks the links, whose names go into the link label
+func (c *Config) validateLinks() error {
+	if len(c.Links) == 0 {
+		return nil
+	}
+	if c.Probe.Only {
+		return fmt.Errorf("can't be tested with probe.only")
+	}
+	if _, ok := c.Metrics.Labels["link"]; ok {
+		return fmt.Errorf("the link label is already set by metrics.labels")
+	}
+	seen := map[string]bool{}
+	for _, link := range c.Links {
+		switch {
+		case link.Name == "":
+			return fmt.Errorf("missing name")
+		case seen[link.Name]:
+			return fmt.Errorf("duplicate link %q", link.Name)
+		case link.SourceAddress == "" && link.Interface == "" && link.Netns == "":
+			return fmt.Errorf("link %q: missing source_address, interface or netns", link.Name)
+		case strings.Contains(link.Netns, "/"):
+			return fmt.Errorf("link %q: invalid network namespace name %q", link.Name, link.Netns)
+		case link.SourceAddress != "" && net.ParseIP(link.SourceAddress) == nil:
+			return fmt.Errorf("link %q: invalid IP address %q", link.Name, link.SourceAddress)
+		case link.Interval < 0:
+			return fmt.Errorf("link %q: interval must not be negative", link.Name)
+		case link.DailyCap < 0:
+			return fmt.Errorf("link %q: daily_cap must not be negative", link.Name)
+		}
+		if err := validateLabels(link.Labels); err != nil {
+			return fmt.Errorf("link %q: %s", link.Name, err)
+		}
+		if err := validateLabelCollisions(link.Labels, c.Metrics.Labels); err != nil {
+			return fmt.Errorf("link %q: %s", link.Name, err)
+		}
+		if _, ok := link.Labels["link"]; ok {
+			return fmt.Errorf("link %q: label %q is already set by the exporter", link.Name, "link")
+		}
+		seen[link.Name] = true
+	}
+	return nil
+}
+
+// findNode returns the key node of the field at the given path in a YAML
+// document, or nil if absent.
+func findNode(node *yaml.Node, path []string) *yaml.Node {
+	if node == nil {
+		return nil
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		return findNode(node.Content[0], path)
+	}
+	if len(path) == 0 {
+		return node
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == path[0] {
+			if len(path) == 1 {
+				return node.Content[i]
+			}
+			return findNode(node.Content[i+1], path[1:])
+		}
+	}
+	return nil
+}
+
+func validateNotEmpty(value string) error {
+	if value == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+func validatePath(value string) error {
+	if !strings.HasPrefix(value, "/") {
+		return fmt.Errorf("must start with a slash")
+	}
+	return nil
+}
+
+// validateBrokerURL checks the URL of an MQTT broker
+func validateBrokerURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+	default:
+		return fmt.Errorf("unsupported scheme %q, expected tcp, ssl, ws or wss", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host in %q", value)
+	}
+	return nil
+}
+
+// validateTopic checks an MQTT topic published to, which can't hold
+// wildcards
+func validateTopic(value string) error {
+	if value == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	if strings.ContainsAny(value, "+#\x00") {
+		return fmt.Errorf("must not contain wildcards, got %q", value)
+	}
+	return nil
+}
+
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host in URL %q", value)
+	}
+	return nil
+}
+
+// validateURLs validates a comma separated list of URLs
+func validateURLs(value string) error {
+	var urls stringList
+	urls.Set(value)
+	if len(urls) == 0 {
+		return fmt.Errorf("missing URL")
+	}
+	for _, u := range urls {
+		if err := validateURL(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dnsServerAddress returns the host:port address of a DNS server, port 53
+// being the default
+func dnsServerAddress(server string) string {
+	if server == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "53")
+}
+
+// validateDNSServer checks a DNS server is an IP address with an optional
+// port
+func validateDNSServer(server string) error {
+	host, port, err := net.SplitHostPort(dnsServerAddress(server))
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid IP address %q", host)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// validateProxyURL checks an HTTP or SOCKS5 proxy URL
+func validateProxyURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host in URL %q", value)
+	}
+	return nil
+}
+
+var (
+	// labelNameRE matches the valid Prometheus label names
+	labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	// metricNameRE matches the valid Prometheus metric names
+	metricNameRE = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+)
+
+// reservedLabels are the labels set by the exporter itself
+var reservedLabels = []string{"ip", "server_id", "server_name", "phase", "type", "module", "backend", "version", "revision", "branch", "goversion"}
+
+func validateLabels(labels labelMap) error {
+	for name := range labels {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		for _, reserved := range reservedLabels {
+			if name == reserved {
+				return fmt.Errorf("label %q is already set by the exporter", name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateLabelCollisions checks the labels of a target don't collide with
+// the constant labels of metrics.labels, which can't be overridden
+func validateLabelCollisions(labels, constant labelMap) error {
+	for name := range labels {
+		if _, ok := constant[name]; ok {
+			return fmt.Errorf("label %q is already set by metrics.labels", name)
+		}
+	}
+	return nil
+}
+
+// validateHeaders checks the extra request headers, without quoting their
+// values: they may carry credentials
+func validateHeaders(headers headerMap) error {
+	for name, value := range headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid value for header %q", name)
+		}
+		if http.CanonicalHeaderKey(name) == "Host" || http.CanonicalHeaderKey(name) == "User-Agent" {
+			return fmt.Errorf("header %q can't be set this way", name)
+		}
+	}
+	return nil
+}
+
+// supportedSizes lists the sizes of the images of the Speedtest servers
+var supportedSizes = (*intList)(&speedtest.DownloadSizes).String()
+
+// validateDownloadSizes checks the sizes are those of the images of the
+// Speedtest servers
+func validateDownloadSizes(sizes intList) error {
+	for _, size := range sizes {
+		found := false
+		for _, valid := range speedtest.DownloadSizes {
+			found = found || size == valid
+		}
+		if !found {
+			return fmt.Errorf("unsupported size %d, must be one of %s", size, supportedSizes)
+		}
+	}
+	return nil
+}
+
+// configure sets the transfer settings of client. streams, if set,
+// overrides the number of parallel connections for both directions. The
+// test parameters of the Speedtest configuration, if any, are the defaults
+// of the settings not set explicitly, as the official clients obey them.
+func (c *SpeedtestConfig) configure(client *speedtest.Client, streams int) {
+	client.DownloadDuration = c.DownloadDuration
+	client.UploadDuration = c.UploadDuration
+	client.DownloadSizes = c.DownloadSizes
+	client.AdaptiveDownload = c.DownloadAdaptive
+	client.UploadMaxBytes = int64(c.UploadMaxBytes)
+	client.UploadChunkSize = int(c.UploadChunkSize)
+	client.UploadFormat = c.UploadFormat
+	client.UploadPayload = c.UploadPayload
+	client.Aggregation = c.Aggregation
+	client.RateLimit = int64(c.RateLimit)
+	client.FreshConnections = c.FreshConnections
+	client.CheckCacheHeaders = c.CacheCheckHeaders
+	client.CheckCacheContent = c.CacheCheckContent
+	client.Retries = c.Retries
+	client.ReadTimeout = c.ReadTimeout
+	client.Hops = c.Hops
+	client.VerifyInterface = c.VerifyInterface
+	client.CPUThreshold = c.CPUThreshold
+	client.BufferSize = int(c.BufferSize)
+	client.Duplex = c.Duplex
+	client.Share = c.Share
+	client.ShareURL = c.ShareURL
+	if c.Hops {
+		client.HopsTransport = c.dialConfig()
+	}
+	if p := client.Parameters; p != nil {
+		if p.DownloadDuration > 0 && !c.explicit["download_duration"] {
+			client.DownloadDuration = p.DownloadDuration
+		}
+		if p.UploadDuration > 0 && !c.explicit["upload_duration"] {
+			client.UploadDuration = p.UploadDuration
+		}
+		if !c.explicit["upload_chunk_size"] {
+			client.UploadSizes = p.UploadSizes()
+		}
+	}
+	if streams > 0 {
+		client.Streams = streams
+		return
+	}
+	client.Streams = c.Streams
+	client.DownloadStreams = c.DownloadStreams
+	client.UploadStreams = c.UploadStreams
+	if p := client.Parameters; p != nil && !c.explicit["streams"] {
+		if p.DownloadThreads > 0 && !c.explicit["download_streams"] {
+			client.DownloadStreams = p.DownloadThreads
+		}
+		if p.UploadThreads > 0 && !c.explicit["upload_streams"] {
+			client.UploadStreams = p.UploadThreads
+		}
+	}
+}
+
+// dialConfig returns the source address, interface, network namespace,
+// dial timeout and resolver of the connections to the Speedtest servers
+func (c *SpeedtestConfig) dialConfig() speedtest.TransportConfig {
+	config := speedtest.TransportConfig{Interface: c.Interface, Netns: c.Netns, DialTimeout: c.DialTimeout}
+	if c.SourceAddress != "" {
+		config.SourceAddress = net.ParseIP(c.SourceAddress)
+	}
+	if c.DNSServer != "" {
+		config.Resolver = speedtest.NewResolver(dnsServerAddress(c.DNSServer), config)
+	}
+	return config
+}
+
+func (c *SpeedtestConfig) serverFilter() speedtest.ServerFilter {
+	return speedtest.ServerFilter{
+		IDs:          c.Server.IDs,
+		CountryCodes: c.Server.CountryCodes,
+	}
+}
+
+// stringList is a comma separated list flag, or a list in YAML
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// headerMap is a repeatable "Name: value" flag, or a mapping in YAML. The
+// names are canonicalized.
+type headerMap map[string]string
+
+func (m *headerMap) String() string {
+	if m == nil {
+		return ""
+	}
+	names := make([]string, 0, len(*m))
+	for name := range *m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (m *headerMap) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return fmt.Errorf("expected \"Name: value\", got %q", value)
+	}
+	if *m == nil {
+		*m = headerMap{}
+	}
+	(*m)[http.CanonicalHeaderKey(strings.TrimSpace(value[:i]))] = strings.TrimSpace(value[i+1:])
+	return nil
+}
+
+// intList is a comma separated list flag of integers, or a list in YAML
+type intList []int
+
+func (l *intList) String() string {
+	if l == nil {
+		return ""
+	}
+	values := make([]string, len(*l))
+	for i, v := range *l {
+		values[i] = strconv.Itoa(v)
+	}
+	return strings.Join(values, ",")
+}
+
+func (l *intList) Set(value string) error {
+	*l = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+// maxUploadChunkSize bounds the upload payloads, held in memory
+const maxUploadChunkSize = byteSize(64 * 1000 * 1000)
+
+// byteUnits are the units of byteSize, decimal and binary
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// byteSize is a number of bytes, with an optional unit such as 50MB or
+// 256KiB, as a flag or in YAML
+type byteSize int64
+
+func (b byteSize) String() string {
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+func (b *byteSize) Set(value string) error {
+	number, unit := strings.TrimSpace(value), int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(number), strings.ToUpper(u.suffix)) {
+			number, unit = strings.TrimSpace(number[:len(number)-len(u.suffix)]), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * float64(unit))
+	return nil
+}
+
+func (b *byteSize) UnmarshalYAML(node *yaml.Node) error {
+	return b.Set(node.Value)
+}
+
+func (b byteSize) MarshalYAML() (interface{}, error) {
+	return b.String(), nil
+}
+
+// coordinate is a latitude or longitude in degrees, as a flag or in YAML,
+// which tells whether it was set, 0 being a valid coordinate
+type coordinate struct {
+	degrees float64
+	set     bool
+}
+
+func (c coordinate) String() string {
+	if !c.set {
+		return ""
+	}
+	return strconv.FormatFloat(c.degrees, 'g', -1, 64)
+}
+
+func (c *coordinate) Set(value string) error {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return fmt.Errorf("invalid coordinate %q", value)
+	}
+	*c = coordinate{degrees: f, set: true}
+	return nil
+}
+
+// IsZero tells the YAML encoder to omit the coordinates which aren't set
+func (c coordinate) IsZero() bool {
+	return !c.set
+}
+
+func (c *coordinate) UnmarshalYAML(node *yaml.Node) error {
+	return c.Set(node.Value)
+}
+
+func (c coordinate) MarshalYAML() (interface{}, error) {
+	return c.degrees, nil
+}
+
+// longDuration is a duration which may also be given in days, such as 90d,
+// as a flag or in YAML
+type longDuration time.Duration
+
+func (d longDuration) String() string {
+	if day := longDuration(24 * time.Hour); d > 0 && d%day == 0 {
+		return strconv.FormatInt(int64(d/day), 10) + "d"
+	}
+	return time.Duration(d).String()
+}
+
+func (d *longDuration) Set(value string) error {
+	value = strings.TrimSpace(value)
+	var n time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		f, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		n = time.Duration(f * float64(24*time.Hour))
+	} else {
+		var err error
+		if n, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+	}
+	if n < 0 {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+	*d = longDuration(n)
+	return nil
+}
+
+func (d *longDuration) UnmarshalYAML(node *yaml.Node) error {
+	return d.Set(node.Value)
+}
+
+func (d longDuration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// bitRateUnits are the units of bitRate, decimal
+var bitRateUnits = []struct {
+	suffix string
+	rate   int64
+}{
+	{"Kbps", 1000}, {"Mbps", 1000 * 1000}, {"Gbps", 1000 * 1000 * 1000},
+	{"bps", 1},
+}
+
+// bitRate is a number of bits per second, with an optional unit such as
+// 200Mbps, as a flag or in YAML
+type bitRate int64
+
+func (r bitRate) String() string {
+	return strconv.FormatInt(int64(r), 10) + "bps"
+}
+
+func (r *bitRate) Set(value string) error {
+	number, unit := strings.TrimSpace(value), int64(1)
+	for _, u := range bitRateUnits {
+		if strings.HasSuffix(strings.ToLower(number), strings.ToLower(u.suffix)) {
+			number, unit = strings.TrimSpace(number[:len(number)-len(u.suffix)]), u.rate
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid rate %q", value)
+	}
+	*r = bitRate(n * float64(unit))
+	return nil
+}
+
+func (r *bitRate) UnmarshalYAML(node *yaml.Node) error {
+	return r.Set(node.Value)
+}
+
+func (r bitRate) MarshalYAML() (interface{}, error) {
+	return r.String(), nil
+}
+
+// labelMap is a repeatable name=value flag, or a mapping in YAML
+type labelMap map[string]string
+
+func (m *labelMap) String() string {
+	if m == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*m))
+	for name, value := range *m {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m *labelMap) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 0 {
+		return fmt.Errorf("expected name=value, got %q", value)
+	}
+	if *m == nil {
+		*m = labelMap{}
+	}
+	(*m)[value[:i]] = value[i+1:]
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretValue replaces the values that may carry credentials
+const secretValue = "<secret>"
+
+// configHandler returns the active configuration as YAML, as merged from
+// the configuration file, the environment and the flags
+type configHandler struct {
+	manager *configManager
+}
+
+func (h *configHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	active := h.manager.current()
+	config := active.redacted()
+	// The modules of the modules file are merged with the inline ones
+	config.Probe.Modules = active.modules
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		slog.Error("Error marshalling the configuration", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
+	w.Write(out)
+}
+
+// redacted returns a copy of the configuration without the passwords of its
+// URLs. The credentials themselves are only referenced by file.
+func (c *Config) redacted() *Config {
+	redacted := *c
+	for _, urls := range []*string{&redacted.Speedtest.ConfigURL, &redacted.Speedtest.ServerURL} {
+		list := strings.Split(*urls, ",")
+		for i, u := range list {
+			list[i] = redactURL(strings.TrimSpace(u))
+		}
+		*urls = strings.Join(list, ",")
+	}
+	for _, u := range []*string{
+		&redacted.Speedtest.MiniURL,
+		&redacted.Speedtest.ProxyURL,
+		&redacted.Web.ExternalURL,
+		&redacted.Influx.URL,
+		&redacted.MQTT.Broker,
+		&redacted.RemoteWrite.URL,
+		&redacted.Webhook.URL,
+	} {
+		*u = redactURL(*u)
+	}
+	for _, headers := range []*headerMap{&redacted.Speedtest.Headers, &redacted.OTLP.Headers, &redacted.Tracing.OTLPHeaders, &redacted.RemoteWrite.Headers} {
+		if *headers == nil {
+			continue
+		}
+		masked := headerMap{}
+		for name := range *headers {
+			masked[name] = secretValue
+		}
+		*headers = masked
+	}
+	redacted.Speedtest.IP.URLs = make(stringList, len(c.Speedtest.IP.URLs))
+	for i, u := range c.Speedtest.IP.URLs {
+		redacted.Speedtest.IP.URLs[i] = redactURL(u)
+	}
+	return &redacted
+}
+
+// redactURL masks the password of a URL
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	return u.Redacted()
+}
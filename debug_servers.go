@@ -0,0 +1,116 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serversProbeTimeout bounds the latency measurements of /debug/servers
+const serversProbeTimeout = 10 * time.Second
+
+var serversTemplate = template.Must(template.New("servers").Parse(`<html>
+<head><title>Speedtest Exporter servers</title></head>
+<body>
+<h1>Speedtest servers</h1>
+<table>
+<tr><th>ID</th><th>Sponsor</th><th>Name</th><th>Country</th><th>Distance (km)</th><th>Latency (ms)</th><th>Status</th></tr>
+{{range .}}<tr>
+<td>{{.ID}}</td><td>{{.Sponsor}}</td><td>{{.Name}}</td><td>{{.Country}}</td>
+<td align="right">{{printf "%.0f" .Distance}}</td>
+<td align="right">{{if .Probed}}{{printf "%.2f" .Latency}}{{else}}-{{end}}</td>
+<td>{{if .Selected}}<b>selected</b>{{else if .Error}}unavailable: {{.Error}}{{else if not .Probed}}not probed{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// debugServer is a server the test server was selected from
+type debugServer struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Sponsor  string  `json:"sponsor"`
+	Country  string  `json:"country"`
+	CC       string  `json:"cc"`
+	URL      string  `json:"url"`
+	Distance float64 `json:"distance_km"`
+	// Probed tells whether the latency was measured, and Error why the
+	// server is unavailable, if it is
+	Probed   bool    `json:"probed"`
+	Latency  float64 `json:"latency_ms,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Selected bool    `json:"selected"`
+}
+
+// serversHandler serves the servers the test server was selected from, as
+// JSON or as an HTML table for browsers. With probe=true, their latency is
+// measured again.
+type serversHandler struct {
+	exporter *Exporter
+}
+
+func (h *serversHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.exporter.mu.RLock()
+	client := h.exporter.Client
+	h.exporter.mu.RUnlock()
+	if client == nil {
+		http.Error(w, "Speedtest client not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx := r.Context()
+	probe := r.URL.Query().Get("probe") == "true"
+	if probe {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, serversProbeTimeout)
+		defer cancel()
+	}
+	servers := []debugServer{}
+	for _, status := range client.Servers(ctx, probe) {
+		server := debugServer{
+			ID:       status.ID,
+			Name:     status.Name,
+			Sponsor:  status.Sponsor,
+			Country:  status.Country,
+			CC:       status.CC,
+			URL:      redactURL(status.URL),
+			Distance: status.Distance,
+			Probed:   status.Probed,
+			Latency:  status.Latency,
+			Selected: status.Selected,
+		}
+		if status.Err != nil {
+			server.Error = status.Err.Error()
+		}
+		servers = append(servers, server)
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := serversTemplate.Execute(w, servers); err != nil {
+			slog.Error("Error rendering the servers page", "err", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(servers)
+}
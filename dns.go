@@ -0,0 +1,154 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// dnsConcurrency bounds the lookups run at once
+const dnsConcurrency = 4
+
+// dnsBenchmark times the lookups of the configured names, run alongside
+// the tests so a slow resolver is told apart from a slow line. The
+// lookups don't delay the tests: they run in the background, each one
+// bounded by the timeout.
+type dnsBenchmark struct {
+	duration *prometheus.GaugeVec
+	failures *prometheus.CounterVec
+
+	mu       sync.Mutex
+	config   DNSConfig
+	resolver *net.Resolver
+	dial     ipDial
+	// running is set while the lookups of a test are in progress, the
+	// following tests skipping theirs meanwhile
+	running bool
+}
+
+func newDNSBenchmark(namespace string) *dnsBenchmark {
+	return &dnsBenchmark{
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "dns_lookup_seconds",
+			Help:      "Duration of the last successful lookup of the name.",
+		}, []string{"name"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dns_lookup_failures_total",
+			Help:      "Number of failed or timed out lookups of the name.",
+		}, []string{"name"}),
+		resolver: net.DefaultResolver,
+	}
+}
+
+// setConfig sets the names looked up and the resolver, whose queries are
+// sent from the source address, interface and network namespace of dial. The system resolver
+// is used when no server is configured.
+func (b *dnsBenchmark) setConfig(config DNSConfig, dial ipDial) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, name := range b.config.Names {
+		if !slices.Contains(config.Names, name) {
+			b.duration.DeleteLabelValues(name)
+			b.failures.DeleteLabelValues(name)
+		}
+	}
+	if dial != b.dial || config.Server != b.config.Server {
+		b.resolver = net.DefaultResolver
+		if config.Server != "" {
+			bind := speedtest.TransportConfig{Interface: dial.iface, Netns: dial.netns}
+			if dial.sourceAddress != "" {
+				bind.SourceAddress = net.ParseIP(dial.sourceAddress)
+			}
+			b.resolver = speedtest.NewResolver(dnsServerAddress(config.Server), bind)
+		}
+	}
+	b.config = config
+	b.dial = dial
+}
+
+// start looks up the names in the background, unless the lookups of a
+// previous test are still running. The lookups are aborted when ctx is
+// done.
+func (b *dnsBenchmark) start(ctx context.Context, logger *slog.Logger) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.config.Names) == 0 {
+		return
+	}
+	if b.running {
+		logger.Debug("Skipping the DNS lookups, the previous ones are still running")
+		return
+	}
+	b.running = true
+	go b.run(ctx, logger, b.config, b.resolver)
+}
+
+func (b *dnsBenchmark) run(ctx context.Context, logger *slog.Logger, config DNSConfig, resolver *net.Resolver) {
+	sem := make(chan struct{}, dnsConcurrency)
+	var wg sync.WaitGroup
+	for _, name := range config.Names {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			b.lookup(ctx, logger, resolver, name, config.Timeout)
+		}()
+	}
+	wg.Wait()
+	b.mu.Lock()
+	b.running = false
+	b.mu.Unlock()
+}
+
+// lookup times the lookup of name, failed when not answered within
+// timeout
+func (b *dnsBenchmark) lookup(ctx context.Context, logger *slog.Logger, resolver *net.Resolver, name string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	_, err := resolver.LookupHost(ctx, name)
+	elapsed := time.Since(start)
+	if err != nil {
+		logger.Warn("DNS lookup failed", "name", name, "duration", elapsed, "err", err)
+		b.failures.WithLabelValues(name).Inc()
+		return
+	}
+	logger.Debug("DNS lookup", "name", name, "duration", elapsed)
+	b.duration.WithLabelValues(name).Set(elapsed.Seconds())
+}
+
+// Describe implements prometheus.Collector
+func (b *dnsBenchmark) Describe(ch chan<- *prometheus.Desc) {
+	b.duration.Describe(ch)
+	b.failures.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (b *dnsBenchmark) Collect(ch chan<- prometheus.Metric) {
+	b.duration.Collect(ch)
+	b.failures.Collect(ch)
+}
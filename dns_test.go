@@ -0,0 +1,85 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitDNSLookups waits for the lookups started by the benchmark to finish
+func waitDNSLookups(t *testing.T, b *dnsBenchmark) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		running := b.running
+		b.mu.Unlock()
+		if !running {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The DNS lookups didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDNSBenchmark(t *testing.T) {
+	b := newDNSBenchmark("speedtest")
+	b.setConfig(DNSConfig{Names: stringList{"localhost"}, Timeout: 2 * time.Second}, ipDial{})
+	b.start(context.Background(), slog.Default())
+	waitDNSLookups(t, b)
+	if n := testutil.CollectAndCount(b, "speedtest_dns_lookup_seconds"); n != 1 {
+		t.Errorf("Expected the lookup duration of localhost, got %d metrics", n)
+	}
+
+	// A server never answering times the lookups out, without delaying
+	// the caller
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	names := stringList{"a.test", "b.test", "c.test", "d.test", "e.test"}
+	b.setConfig(DNSConfig{Names: names, Server: conn.LocalAddr().String(), Timeout: 100 * time.Millisecond}, ipDial{})
+	start := time.Now()
+	b.start(context.Background(), slog.Default())
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Starting the lookups took %s", elapsed)
+	}
+	// The lookups still running are not started again
+	b.start(context.Background(), slog.Default())
+	waitDNSLookups(t, b)
+
+	expected := `
+# HELP speedtest_dns_lookup_failures_total Number of failed or timed out lookups of the name.
+# TYPE speedtest_dns_lookup_failures_total counter
+speedtest_dns_lookup_failures_total{name="a.test"} 1
+speedtest_dns_lookup_failures_total{name="b.test"} 1
+speedtest_dns_lookup_failures_total{name="c.test"} 1
+speedtest_dns_lookup_failures_total{name="d.test"} 1
+speedtest_dns_lookup_failures_total{name="e.test"} 1
+`
+	if err := testutil.CollectAndCompare(b, strings.NewReader(expected), "speedtest_dns_lookup_failures_total", "speedtest_dns_lookup_seconds"); err != nil {
+		t.Error(err)
+	}
+}
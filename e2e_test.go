@@ -0,0 +1,345 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlamirault/speedtest_exporter/internal/speedtestfake"
+)
+
+// e2eEnv is set in the environment of the test binary started by
+// startExporter, which then runs the exporter rather than the tests
+const e2eEnv = "SPEEDTEST_EXPORTER_E2E"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(e2eEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// e2eExporter is the exporter run by the test binary in a child process,
+// listening on a Unix domain socket
+type e2eExporter struct {
+	cmd    *exec.Cmd
+	client *http.Client
+	output bytes.Buffer
+	dir    func()
+}
+
+// startExporter runs the exporter with the given flags, and returns once
+// it is ready, its client initialized
+func startExporter(t *testing.T, args ...string) *e2eExporter {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("Runs the exporter")
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("The exporter is stopped with a signal")
+	}
+	dir, cleanup := tempDir(t)
+	socket := filepath.Join(dir, "exporter.sock")
+	e := &e2eExporter{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		dir: cleanup,
+	}
+	e.cmd = exec.Command(os.Args[0], append([]string{"--web.listen-address=" + unixPrefix + socket}, args...)...)
+	e.cmd.Env = append(os.Environ(), e2eEnv+"=1")
+	e.cmd.Stdout = &e.output
+	e.cmd.Stderr = &e.output
+	if err := e.cmd.Start(); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if status, _ := e.get("/-/ready", nil); status == http.StatusOK {
+			return e
+		}
+		if time.Now().After(deadline) {
+			e.stop(t)
+			t.Fatal("The exporter didn't get ready")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// get returns the status and body of a request, the status being 0 when
+// the request fails
+func (e *e2eExporter) get(path string, header http.Header) (int, string) {
+	req, err := http.NewRequest("GET", "http://exporter"+path, nil)
+	if err != nil {
+		return 0, err.Error()
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// stop shuts the exporter down, and logs its output if the test failed
+func (e *e2eExporter) stop(t *testing.T) {
+	t.Helper()
+	defer e.dir()
+	e.cmd.Process.Signal(os.Interrupt)
+	done := make(chan error, 1)
+	go func() { done <- e.cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("The exporter exited with %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		e.cmd.Process.Kill()
+		<-done
+		t.Error("The exporter didn't shut down")
+	}
+	if t.Failed() {
+		t.Logf("Exporter output:\n%s", e.output.String())
+	}
+}
+
+// series returns the series of a metrics page without their values, the
+// build information and the random run_id labels left out
+func series(body string) string {
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") || strings.Contains(line, "_build_info{") {
+			continue
+		}
+		line = line[:strings.LastIndexByte(line, ' ')]
+		lines = append(lines, runIDPattern.ReplaceAllString(line, `run_id=""`))
+	}
+	return strings.Join(lines, "\n")
+}
+
+var runIDPattern = regexp.MustCompile(`run_id="[^"]*"`)
+
+// metricValue returns the value of a series of a metrics page
+func metricValue(body string, series string) (float64, bool) {
+	for _, line := range strings.Split(body, "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			return v, err == nil
+		}
+	}
+	return 0, false
+}
+
+// fakeFlags are the flags of the exporter testing briefly against fake
+func fakeFlags(fake *speedtestfake.Server) []string {
+	return []string{
+		"--speedtest.config-url=" + fake.ConfigURL(),
+		"--speedtest.server-url=" + fake.ServersURL(),
+		"--speedtest.download-sizes=350",
+		"--speedtest.download-duration=1s",
+		"--speedtest.upload-duration=1s",
+		"--web.disable-exporter-metrics",
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("The CPU utilization metrics are those of Linux")
+	}
+	fake := speedtestfake.New(speedtestfake.Options{DownloadRate: 4e6, UploadRate: 2e6})
+	defer fake.Close()
+	exporter := startExporter(t, fakeFlags(fake)...)
+	defer exporter.stop(t)
+
+	status, body := exporter.get("/metrics", nil)
+	if status != http.StatusOK {
+		t.Fatalf("Expected the metrics, got %d %s", status, body)
+	}
+	expected := `speedtest_backoff_until_timestamp_seconds
+speedtest_cached_result_suspected{ip="203.0.113.7"}
+speedtest_client_latitude{ip="203.0.113.7"}
+speedtest_client_longitude{ip="203.0.113.7"}
+speedtest_config_last_reload_success_timestamp_seconds
+speedtest_config_last_reload_successful
+speedtest_connection_info{http_version="1.1",ip="203.0.113.7",remote_addr_family="ipv4",tls_version="none"}
+speedtest_cpu_limited{ip="203.0.113.7",phase="download"}
+speedtest_cpu_limited{ip="203.0.113.7",phase="upload"}
+speedtest_cpu_utilization_ratio{ip="203.0.113.7",phase="download"}
+speedtest_cpu_utilization_ratio{ip="203.0.113.7",phase="upload"}
+speedtest_download{ip="203.0.113.7"}
+speedtest_exporter_cpu_utilization_ratio{ip="203.0.113.7",phase="download"}
+speedtest_exporter_cpu_utilization_ratio{ip="203.0.113.7",phase="upload"}
+speedtest_external_ip_changes_total
+speedtest_http_requests_total{code="2xx",phase="download"}
+speedtest_http_requests_total{code="2xx",phase="ping"}
+speedtest_http_requests_total{code="2xx",phase="upload"}
+speedtest_phase_success{ip="203.0.113.7",phase="download"}
+speedtest_phase_success{ip="203.0.113.7",phase="ping"}
+speedtest_phase_success{ip="203.0.113.7",phase="upload"}
+speedtest_ping{ip="203.0.113.7"}
+speedtest_ping_stddev{ip="203.0.113.7"}
+speedtest_queue_timeouts_total
+speedtest_queued_tests
+speedtest_result_info{ip="203.0.113.7",run_id="",share_url=""}
+speedtest_server_latitude{ip="203.0.113.7"}
+speedtest_server_longitude{ip="203.0.113.7"}
+speedtest_share_failures_total
+speedtest_test_parameters_info{download_duration="1",download_streams="1",ip="203.0.113.7",upload_duration="1",upload_max_payload="2097152",upload_payload="random",upload_payloads="5",upload_streams="1"}
+speedtest_tests_total{trigger="scrape"}
+speedtest_transfer_streams{ip="203.0.113.7",phase="download"}
+speedtest_transfer_streams{ip="203.0.113.7",phase="upload"}
+speedtest_transferred_bytes_total{phase="download"}
+speedtest_transferred_bytes_total{phase="upload"}
+speedtest_upload{ip="203.0.113.7"}`
+	if got := series(body); got != expected {
+		t.Errorf("Unexpected series:\n%s", got)
+	}
+
+	for _, line := range []string{
+		`speedtest_server_latitude{ip="203.0.113.7"} 52.5`,
+		`speedtest_phase_success{ip="203.0.113.7",phase="upload"} 1`,
+		`speedtest_tests_total{trigger="scrape"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %s, got:\n%s", line, body)
+		}
+	}
+	// The bandwidths are those of the fake link, with a wide tolerance for
+	// the slow test machines
+	for series, expected := range map[string]float64{
+		`speedtest_download{ip="203.0.113.7"}`: 32,
+		`speedtest_upload{ip="203.0.113.7"}`:   16,
+	} {
+		if v, ok := metricValue(body, series); !ok || v < expected*0.5 || v > expected*1.5 {
+			t.Errorf("Expected %s to be about %g, got %g", series, expected, v)
+		}
+	}
+}
+
+func TestEndToEndTimeouts(t *testing.T) {
+	fake := speedtestfake.New(speedtestfake.Options{})
+	defer fake.Close()
+	exporter := startExporter(t, append(fakeFlags(fake), "--speedtest.read-timeout=300ms")...)
+	defer exporter.stop(t)
+
+	// The scrape timeout of Prometheus bounds a probe whose upload hangs
+	fake.Inject(speedtestfake.Upload, speedtestfake.Fault{Hang: true})
+	start := time.Now()
+	_, body := exporter.get("/probe", http.Header{"X-Prometheus-Scrape-Timeout-Seconds": {"2"}})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the probe to give up after 1.5s, got %s", elapsed)
+	}
+	for _, line := range []string{
+		"probe_success 0",
+		`speedtest_phase_success{ip="203.0.113.7",phase="download"} 1`,
+		`speedtest_phase_success{ip="203.0.113.7",phase="upload"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %s, got:\n%s", line, body)
+		}
+	}
+
+	// A download sending nothing is abandoned after the read timeout
+	fake.Clear()
+	fake.Inject(speedtestfake.Download, speedtestfake.Fault{Hang: true})
+	_, body = exporter.get("/metrics", nil)
+	for _, line := range []string{
+		`speedtest_errors_total{phase="download",type="stalled_transfer"} 1`,
+		`speedtest_phase_success{ip="203.0.113.7",phase="download"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %s, got:\n%s", line, body)
+		}
+	}
+}
+
+func TestEndToEndFailover(t *testing.T) {
+	fake := speedtestfake.New(speedtestfake.Options{})
+	defer fake.Close()
+	broken := speedtestfake.New(speedtestfake.Options{})
+	defer broken.Close()
+	broken.Inject(speedtestfake.Config, speedtestfake.Fault{Status: http.StatusInternalServerError})
+	broken.Inject(speedtestfake.Servers, speedtestfake.Fault{Status: http.StatusInternalServerError})
+
+	// The broken mirrors come first
+	exporter := startExporter(t, append(fakeFlags(fake),
+		"--speedtest.config-url="+broken.ConfigURL()+","+fake.ConfigURL(),
+		"--speedtest.server-url="+broken.ServersURL()+","+fake.ServersURL(),
+		"--speedtest.reinit-after-failures=1",
+		"--speedtest.retries=1",
+	)...)
+	defer exporter.stop(t)
+
+	// A transient error is retried
+	fake.Inject(speedtestfake.Download, speedtestfake.Fault{Status: http.StatusServiceUnavailable, Times: 1})
+	_, body := exporter.get("/metrics", nil)
+	for _, line := range []string{
+		`speedtest_phase_success{ip="203.0.113.7",phase="download"} 1`,
+		`speedtest_server_latitude{ip="203.0.113.7"} 52.5`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %s, got:\n%s", line, body)
+		}
+	}
+	if !strings.Contains(body, `speedtest_request_retries_total{`) {
+		t.Errorf("Expected the download to be retried, got:\n%s", body)
+	}
+	if broken.Requests(speedtestfake.Config) == 0 || broken.Requests(speedtestfake.Servers) == 0 {
+		t.Error("Expected the broken mirrors to be tried first")
+	}
+
+	// The client moves to the other server once the nearest one is down
+	fake.Inject(speedtestfake.Download, speedtestfake.Fault{Status: http.StatusNotFound, Server: "1234"})
+	fake.Inject(speedtestfake.Latency, speedtestfake.Fault{Status: http.StatusNotFound, Server: "1234"})
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		_, body = exporter.get("/metrics", nil)
+		if strings.Contains(body, `speedtest_server_latitude{ip="203.0.113.7"} 40`+"\n") &&
+			strings.Contains(body, `speedtest_phase_success{ip="203.0.113.7",phase="upload"} 1`+"\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the tests to move to server 99, got:\n%s", body)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !strings.Contains(body, `speedtest_client_reinitializations_total{result="success"} 1`) {
+		t.Errorf("Expected the client to be re-initialized, got:\n%s", body)
+	}
+}
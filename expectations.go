@@ -0,0 +1,164 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// expectation is a threshold of a measured value, in the unit of its
+// result
+type expectation struct {
+	metric string
+	unit   string
+	// threshold is the minimum of the value, or its maximum when max
+	threshold float64
+	max       bool
+	value     func(*Result) *PhaseResult
+}
+
+// missed tells whether value misses the expectation
+func (e expectation) missed(value float64) bool {
+	if e.max {
+		return value > e.threshold
+	}
+	return value < e.threshold
+}
+
+// expected describes the expectation, such as ≥500 Mbps
+func (e expectation) expected() string {
+	comparison := "≥"
+	if e.max {
+		comparison = "≤"
+	}
+	return comparison + strconv.FormatFloat(e.threshold, 'f', -1, 64) + " " + e.unit
+}
+
+// newExpectations returns the expectations of the minimum download and
+// upload bandwidths and of the maximum latency, zero disabling one
+func newExpectations(download, upload bitRate, ping time.Duration) []expectation {
+	var expectations []expectation
+	if download > 0 {
+		expectations = append(expectations, expectation{"download", "Mbps", float64(download) / 1e6, false, func(r *Result) *PhaseResult { return r.Download }})
+	}
+	if upload > 0 {
+		expectations = append(expectations, expectation{"upload", "Mbps", float64(upload) / 1e6, false, func(r *Result) *PhaseResult { return r.Upload }})
+	}
+	if ping > 0 {
+		expectations = append(expectations, expectation{"ping", "ms", float64(ping.Microseconds()) / 1000, true, func(r *Result) *PhaseResult { return r.Ping }})
+	}
+	return expectations
+}
+
+// expectationChecker reports the successful tests missing the expected
+// results. A threshold is reported missed, by a warning and
+// below_expectation, once missed by enough consecutive tests.
+type expectationChecker struct {
+	below *prometheus.GaugeVec
+
+	mu           sync.Mutex
+	expectations []expectation
+	required     int
+	// misses are the consecutive misses of each metric
+	misses map[string]int
+}
+
+func newExpectationChecker(namespace string) *expectationChecker {
+	return &expectationChecker{
+		below: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "below_expectation",
+			Help:      "Whether the last tests missed the expected value of the metric, 1 when missed by the number of consecutive tests configured.",
+		}, []string{"metric"}),
+		required: 1,
+		misses:   map[string]int{},
+	}
+}
+
+// setConfig sets the expectations, resetting the misses of the metrics
+// whose threshold changed
+func (c *expectationChecker) setConfig(config ExpectConfig) {
+	expectations := newExpectations(config.Download, config.Upload, config.Ping)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := map[string]float64{}
+	for _, e := range c.expectations {
+		previous[e.metric] = e.threshold
+	}
+	kept := map[string]bool{}
+	for _, e := range expectations {
+		threshold, ok := previous[e.metric]
+		if !ok || threshold != e.threshold || config.Misses != c.required {
+			c.misses[e.metric] = 0
+			c.below.WithLabelValues(e.metric).Set(0)
+		}
+		kept[e.metric] = true
+	}
+	for metric := range previous {
+		if !kept[metric] {
+			delete(c.misses, metric)
+			c.below.DeleteLabelValues(metric)
+		}
+	}
+	c.expectations = expectations
+	c.required = config.Misses
+}
+
+// check compares the values of the successful test result to the
+// expectations
+func (c *expectationChecker) check(result *Result) {
+	var serverID string
+	if result.Server != nil {
+		serverID = result.Server.ID
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.expectations {
+		phase := e.value(result)
+		if phase == nil {
+			continue
+		}
+		if !e.missed(phase.Value) {
+			if c.misses[e.metric] >= c.required {
+				slog.Info("Speedtest result meets the expectation again", "metric", e.metric,
+					"value", strconv.FormatFloat(phase.Value, 'f', 2, 64)+" "+e.unit, "expected", e.expected())
+			}
+			c.misses[e.metric] = 0
+			c.below.WithLabelValues(e.metric).Set(0)
+			continue
+		}
+		c.misses[e.metric]++
+		if c.misses[e.metric] >= c.required {
+			slog.Warn("Speedtest result below expectation", "metric", e.metric,
+				"value", strconv.FormatFloat(phase.Value, 'f', 2, 64)+" "+e.unit, "expected", e.expected(),
+				"consecutive_misses", c.misses[e.metric], "server_id", serverID)
+			c.below.WithLabelValues(e.metric).Set(1)
+		}
+	}
+}
+
+func (c *expectationChecker) Describe(ch chan<- *prometheus.Desc) {
+	c.below.Describe(ch)
+}
+
+func (c *expectationChecker) Collect(ch chan<- prometheus.Metric) {
+	c.below.Collect(ch)
+}
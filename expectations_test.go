@@ -0,0 +1,69 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExpectationChecker(t *testing.T) {
+	c := newExpectationChecker("speedtest")
+	c.setConfig(ExpectConfig{Download: 500 * 1000 * 1000, Ping: 30 * time.Millisecond, Misses: 2})
+	below := func(metric string) float64 {
+		return testutil.ToFloat64(c.below.WithLabelValues(metric))
+	}
+	slow := &Result{Download: &PhaseResult{Value: 212}, Ping: &PhaseResult{Value: 12}}
+	fast := &Result{Download: &PhaseResult{Value: 540}, Ping: &PhaseResult{Value: 45}}
+
+	c.check(slow)
+	if below("download") != 0 {
+		t.Error("Expected a single miss to be tolerated")
+	}
+	c.check(slow)
+	if below("download") != 1 || below("ping") != 0 {
+		t.Errorf("Expected the download below expectation, got download %v and ping %v", below("download"), below("ping"))
+	}
+	c.check(fast)
+	if below("download") != 0 || below("ping") != 0 {
+		t.Errorf("Expected the download to meet the expectation again, got %v", below("download"))
+	}
+	// A partial result leaves the other metrics alone
+	c.check(&Result{Ping: &PhaseResult{Value: 50}})
+	if below("ping") != 1 {
+		t.Errorf("Expected the ping below expectation after 2 misses, got %v", below("ping"))
+	}
+
+	c.setConfig(ExpectConfig{Ping: 60 * time.Millisecond, Misses: 2})
+	if below("ping") != 0 {
+		t.Error("Expected the misses to be reset with the threshold")
+	}
+	if n := testutil.CollectAndCount(c); n != 1 {
+		t.Errorf("Expected only the ping expectation, got %d metrics", n)
+	}
+}
+
+func TestExpectationExpected(t *testing.T) {
+	c := newExpectationChecker("speedtest")
+	c.setConfig(ExpectConfig{Download: 500 * 1000 * 1000, Ping: 30 * time.Millisecond, Misses: 1})
+	if expected := c.expectations[0].expected(); expected != "≥500 Mbps" {
+		t.Errorf("Unexpected download expectation %s", expected)
+	}
+	if expected := c.expectations[1].expected(); expected != "≤30 ms" {
+		t.Errorf("Unexpected ping expectation %s", expected)
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// geoRecord holds the fields of a GeoIP2 or GeoLite2 City database record
+// the exporter uses. The AS organization is only found in the ISP and
+// enterprise databases.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoIP locates the external IP address with a local MMDB database. The
+// location is looked up again when the address changes.
+type geoIP struct {
+	desc *prometheus.Desc
+
+	mu       sync.Mutex
+	filename string
+	db       *maxminddb.Reader
+	// ip is the address record was looked up for, record being nil when
+	// the database has none
+	ip     string
+	record *geoRecord
+}
+
+func newGeoIP(namespace string) *geoIP {
+	return &geoIP{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "external_ip", "geo_info"),
+			"Location of the external IP address, from the GeoIP database.",
+			[]string{"country", "city", "asn_org"}, nil,
+		),
+	}
+}
+
+// setDatabase opens the database file, unless already open. The lookups are
+// disabled when filename is empty, or with a warning when the database
+// can't be opened.
+func (g *geoIP) setDatabase(filename string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if filename == g.filename {
+		return
+	}
+	if g.db != nil {
+		g.db.Close()
+	}
+	g.filename, g.ip, g.record = filename, "", nil
+	g.db = openMMDB(filename, "GeoIP")
+}
+
+// openMMDB opens an MMDB database, returning nil when filename is empty or
+// the database can't be opened, the lookups of what being then disabled
+func openMMDB(filename string, what string) *maxminddb.Reader {
+	if filename == "" {
+		return nil
+	}
+	db, err := maxminddb.Open(filename)
+	if err != nil {
+		slog.Warn("Can't open the "+what+" database, "+what+" lookups are disabled", "file", filename, "err", err)
+		return nil
+	}
+	return db
+}
+
+// collect delivers the location of ip, if known
+func (g *geoIP) collect(ch chan<- prometheus.Metric, ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.db == nil || ip == "" {
+		return
+	}
+	if ip != g.ip {
+		g.ip, g.record = ip, nil
+		var record geoRecord
+		if _, ok, err := g.db.LookupNetwork(net.ParseIP(ip), &record); err != nil {
+			slog.Warn("GeoIP lookup failed", "ip", ip, "err", err)
+		} else if ok {
+			g.record = &record
+		}
+	}
+	if g.record == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, 1,
+		g.record.Country.ISOCode, g.record.City.Names["en"], g.record.AutonomousSystemOrganization)
+}
+
+const (
+	// dnsLookupTimeout bounds the DNS lookups of the AS and of the reverse
+	// DNS name
+	dnsLookupTimeout = 2 * time.Second
+
+	// lookupRetryInterval is the time after which a failed AS or reverse DNS
+	// lookup is retried for the same address
+	lookupRetryInterval = 5 * time.Minute
+)
+
+// asnRecord holds the fields of a GeoLite2 ASN database record
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// asnLookup finds the origin AS of the external IP address, with a local
+// MMDB database or else, if enabled, with the DNS service of Team Cymru. The
+// AS is looked up again when the address changes.
+type asnLookup struct {
+	desc *prometheus.Desc
+	// lookupTXT resolves the TXT records of the DNS service
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	mu       sync.Mutex
+	filename string
+	db       *maxminddb.Reader
+	dns      bool
+	// ip is the address record was looked up for, record being nil when
+	// the AS is unknown, and failed the time of the last failed lookup
+	ip     string
+	record *asnRecord
+	failed time.Time
+}
+
+func newASNLookup(namespace string) *asnLookup {
+	return &asnLookup{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "external_ip", "asn_info"),
+			"Origin AS of the external IP address.",
+			[]string{"asn", "org"}, nil,
+		),
+		lookupTXT: net.DefaultResolver.LookupTXT,
+	}
+}
+
+// setConfig opens the database file, unless already open, and enables the
+// DNS lookups when the database has no record
+func (a *asnLookup) setConfig(filename string, dns bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if filename == a.filename && dns == a.dns {
+		return
+	}
+	if filename != a.filename {
+		if a.db != nil {
+			a.db.Close()
+		}
+		a.filename = filename
+		a.db = openMMDB(filename, "ASN")
+	}
+	a.dns = dns
+	a.ip, a.record, a.failed = "", nil, time.Time{}
+}
+
+// collect delivers the AS of ip, if known
+func (a *asnLookup) collect(ch chan<- prometheus.Metric, ip string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.db == nil && !a.dns || ip == "" {
+		return
+	}
+	if ip != a.ip || a.record == nil && !a.failed.IsZero() && time.Since(a.failed) >= lookupRetryInterval {
+		a.ip, a.record, a.failed = ip, nil, time.Time{}
+		record, err := a.lookup(net.ParseIP(ip))
+		if err != nil {
+			slog.Warn("AS lookup failed", "ip", ip, "err", err)
+			a.failed = time.Now()
+		}
+		a.record = record
+	}
+	if a.record == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(a.desc, prometheus.GaugeValue, 1,
+		strconv.FormatUint(uint64(a.record.Number), 10), a.record.Organization)
+}
+
+// lookup returns the AS of ip, nil if unknown
+func (a *asnLookup) lookup(ip net.IP) (*asnRecord, error) {
+	if a.db != nil {
+		// IPv4 databases can't look up IPv6 addresses, which are then
+		// looked up with DNS
+		var record asnRecord
+		_, ok, err := a.db.LookupNetwork(ip, &record)
+		if err != nil && !a.dns {
+			return nil, err
+		}
+		if err == nil && ok && record.Number != 0 {
+			return &record, nil
+		}
+	}
+	if !a.dns {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	return cymruLookup(ctx, a.lookupTXT, ip)
+}
+
+// cymruLookup finds the origin AS of ip with the DNS service of Team Cymru,
+// which answers e.g. "13335 | 1.1.1.0/24 | AU | apnic | 2011-08-11" for
+// 1.1.1.1.origin.asn.cymru.com, then "13335 | US | arin | 2010-07-14 |
+// CLOUDFLARENET, US" for AS13335.asn.cymru.com.
+func cymruLookup(ctx context.Context, lookupTXT func(context.Context, string) ([]string, error), ip net.IP) (*asnRecord, error) {
+	var name string
+	if v4 := ip.To4(); v4 != nil {
+		name = fmt.Sprintf("%d.%d.%d.%d.origin.asn.cymru.com", v4[3], v4[2], v4[1], v4[0])
+	} else if v6 := ip.To16(); v6 != nil {
+		nibbles := make([]string, 0, 32)
+		for i := len(v6) - 1; i >= 0; i-- {
+			nibbles = append(nibbles, fmt.Sprintf("%x", v6[i]&0xf), fmt.Sprintf("%x", v6[i]>>4))
+		}
+		name = strings.Join(nibbles, ".") + ".origin6.asn.cymru.com"
+	} else {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+
+	origin, err := cymruFields(ctx, lookupTXT, name)
+	if err != nil || origin == nil {
+		return nil, err
+	}
+	// Addresses announced by several AS list them all, the first one is
+	// used
+	asn, err := strconv.ParseUint(strings.Fields(origin[0])[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AS number in %q", origin[0])
+	}
+	record := &asnRecord{Number: uint(asn)}
+	description, err := cymruFields(ctx, lookupTXT, fmt.Sprintf("AS%d.asn.cymru.com", asn))
+	if err != nil {
+		return nil, err
+	}
+	if len(description) >= 5 {
+		record.Organization = description[4]
+	}
+	return record, nil
+}
+
+// cymruFields returns the fields of the first TXT record of name, nil if
+// there is none
+func cymruFields(ctx context.Context, lookupTXT func(context.Context, string) ([]string, error), name string) ([]string, error) {
+	records, err := lookupTXT(ctx, name)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	fields := strings.Split(records[0], "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if fields[0] == "" {
+		return nil, fmt.Errorf("invalid answer %q for %s", records[0], name)
+	}
+	return fields, nil
+}
+
+// rdnsLookup resolves the reverse DNS name of the external IP address, which
+// often names the access node the connection landed on. The name is cached
+// per address.
+type rdnsLookup struct {
+	desc *prometheus.Desc
+	// lookupAddr resolves the PTR records of an address
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+
+	mu      sync.Mutex
+	enabled bool
+	// ip is the address hostname was resolved for, hostname being empty
+	// when it has no PTR record, and failed the time of the last failed
+	// lookup
+	ip       string
+	hostname string
+	failed   time.Time
+}
+
+func newRDNSLookup(namespace string) *rdnsLookup {
+	return &rdnsLookup{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "external_ip", "rdns_info"),
+			"Reverse DNS name of the external IP address.",
+			[]string{"hostname"}, nil,
+		),
+		lookupAddr: net.DefaultResolver.LookupAddr,
+	}
+}
+
+func (r *rdnsLookup) setEnabled(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if enabled != r.enabled {
+		r.ip, r.hostname, r.failed = "", "", time.Time{}
+	}
+	r.enabled = enabled
+}
+
+// collect delivers the reverse DNS name of ip, if any
+func (r *rdnsLookup) collect(ch chan<- prometheus.Metric, ip string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.enabled || ip == "" {
+		return
+	}
+	if ip != r.ip || !r.failed.IsZero() && time.Since(r.failed) >= lookupRetryInterval {
+		r.ip, r.hostname, r.failed = ip, "", time.Time{}
+		ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+		names, err := r.lookupAddr(ctx, ip)
+		cancel()
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			err = nil
+		}
+		if err != nil {
+			slog.Warn("Reverse DNS lookup failed", "ip", ip, "err", err)
+			r.failed = time.Now()
+		} else if len(names) > 0 {
+			r.hostname = strings.ToLower(strings.TrimRight(names[0], "."))
+		}
+	}
+	if r.hostname == "" {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(r.desc, prometheus.GaugeValue, 1, r.hostname)
+}
@@ -0,0 +1,297 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mmdbNode is a node of the search tree of a test MMDB database
+type mmdbNode struct {
+	children [2]*mmdbNode
+	// data is the offset of the record of a leaf in the data section
+	data int
+	leaf bool
+}
+
+// writeMMDB writes an IPv4 MMDB database mapping single addresses to
+// records, which are maps of strings and nested maps.
+func writeMMDB(t *testing.T, filename string, records map[string]map[string]interface{}) {
+	var data bytes.Buffer
+	root := &mmdbNode{}
+	ips := make([]string, 0, len(records))
+	for ip := range records {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		offset := data.Len()
+		encodeMMDB(&data, records[ip])
+		node := root
+		addr := net.ParseIP(ip).To4()
+		for i := 0; i < 32; i++ {
+			bit := addr[i/8] >> (7 - uint(i%8)) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbNode{}
+			}
+			node = node.children[bit]
+		}
+		node.leaf, node.data = true, offset
+	}
+
+	// Number the inner nodes breadth first, the root being 0
+	var nodes []*mmdbNode
+	index := map[*mmdbNode]int{}
+	for queue := []*mmdbNode{root}; len(queue) > 0; queue = queue[1:] {
+		node := queue[0]
+		index[node] = len(nodes)
+		nodes = append(nodes, node)
+		for _, child := range node.children {
+			if child != nil && !child.leaf {
+				queue = append(queue, child)
+			}
+		}
+	}
+	var out bytes.Buffer
+	record := func(child *mmdbNode) uint32 {
+		switch {
+		case child == nil:
+			return uint32(len(nodes))
+		case child.leaf:
+			return uint32(len(nodes) + 16 + child.data)
+		}
+		return uint32(index[child])
+	}
+	for _, node := range nodes {
+		for _, child := range node.children {
+			v := record(child)
+			out.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	encodeMMDB(&out, map[string]interface{}{
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               "Test",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint32(0),
+	})
+	if err := ioutil.WriteFile(filename, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// encodeMMDB encodes a value of the MMDB data section
+func encodeMMDB(buf *bytes.Buffer, value interface{}) {
+	control := func(kind byte, size int) {
+		if size < 29 {
+			buf.WriteByte(kind<<5 | byte(size))
+		} else {
+			buf.Write([]byte{kind<<5 | 29, byte(size - 29)})
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint16:
+		control(5, 2)
+		binary.Write(buf, binary.BigEndian, v)
+	case uint32:
+		control(6, 4)
+		binary.Write(buf, binary.BigEndian, v)
+	case map[string]interface{}:
+		control(7, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encodeMMDB(buf, key)
+			encodeMMDB(buf, v[key])
+		}
+	default:
+		panic("unsupported MMDB value")
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	filename := filepath.Join(dir, "GeoLite2-City.mmdb")
+	writeMMDB(t, filename, map[string]map[string]interface{}{
+		"203.0.113.7": {
+			"country": map[string]interface{}{"iso_code": "DE"},
+			"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Berlin"}},
+		},
+		"203.0.113.8": {
+			"country":                        map[string]interface{}{"iso_code": "FR"},
+			"autonomous_system_organization": "Example Telecom",
+		},
+	})
+
+	checker := newIPChecker(defaultNamespace, nil)
+	checker.geo.setDatabase(filename)
+	for _, tc := range []struct {
+		ip, sample string
+	}{
+		{"203.0.113.7", `speedtest_external_ip_geo_info{asn_org="",city="Berlin",country="DE"} 1`},
+		// The location is looked up again when the address changes
+		{"203.0.113.8", `speedtest_external_ip_geo_info{asn_org="Example Telecom",city="",country="FR"} 1`},
+		// An address missing from the database has no location
+		{"198.51.100.1", ""},
+	} {
+		checker.observe(tc.ip)
+		metrics := gather(t, checker)
+		if tc.sample == "" {
+			if strings.Contains(metrics, "speedtest_external_ip_geo_info{") {
+				t.Errorf("%s: expected no location, got:\n%s", tc.ip, metrics)
+			}
+		} else if !strings.Contains(metrics, tc.sample) {
+			t.Errorf("%s: expected %s, got:\n%s", tc.ip, tc.sample, metrics)
+		}
+	}
+
+	// An invalid database disables the lookups
+	invalid := filepath.Join(dir, "invalid.mmdb")
+	if err := ioutil.WriteFile(invalid, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checker.geo.setDatabase(invalid)
+	checker.observe("203.0.113.7")
+	if metrics := gather(t, checker); strings.Contains(metrics, "speedtest_external_ip_geo_info{") {
+		t.Errorf("Expected no location with an invalid database, got:\n%s", metrics)
+	}
+}
+
+func TestASNLookup(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	filename := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	writeMMDB(t, filename, map[string]map[string]interface{}{
+		"203.0.113.7": {
+			"autonomous_system_number":       uint32(64496),
+			"autonomous_system_organization": "Example Transit",
+		},
+	})
+	var queries []string
+	lookupTXT := func(ctx context.Context, name string) ([]string, error) {
+		queries = append(queries, name)
+		switch name {
+		case "8.113.0.203.origin.asn.cymru.com":
+			return []string{"64497 64498 | 203.0.113.0/24 | DE | ripencc | 2020-01-01"}, nil
+		case "AS64497.asn.cymru.com":
+			return []string{"64497 | DE | ripencc | 2020-01-01 | EXAMPLE-UPSTREAM, DE"}, nil
+		case "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.origin6.asn.cymru.com":
+			return []string{"64499 | 2001:db8::/32 | DE | ripencc | 2020-01-01"}, nil
+		case "AS64499.asn.cymru.com":
+			return []string{"64499 | DE | ripencc | 2020-01-01 | EXAMPLE-V6, DE"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	checker := newIPChecker(defaultNamespace, nil)
+	checker.asn.lookupTXT = lookupTXT
+	checker.asn.setConfig(filename, false)
+	checker.observe("203.0.113.7")
+	if metrics := gather(t, checker); !strings.Contains(metrics, `speedtest_external_ip_asn_info{asn="64496",org="Example Transit"} 1`) {
+		t.Errorf("Expected the AS of the database, got:\n%s", metrics)
+	}
+	checker.observe("203.0.113.8")
+	if metrics := gather(t, checker); strings.Contains(metrics, "speedtest_external_ip_asn_info{") {
+		t.Errorf("Expected no AS without DNS lookups, got:\n%s", metrics)
+	}
+
+	checker.asn.setConfig(filename, true)
+	for _, tc := range []struct {
+		ip, sample string
+	}{
+		{"203.0.113.7", `speedtest_external_ip_asn_info{asn="64496",org="Example Transit"} 1`},
+		{"203.0.113.8", `speedtest_external_ip_asn_info{asn="64497",org="EXAMPLE-UPSTREAM, DE"} 1`},
+		{"2001:db8::1", `speedtest_external_ip_asn_info{asn="64499",org="EXAMPLE-V6, DE"} 1`},
+		{"198.51.100.1", ""},
+	} {
+		queries = nil
+		checker.observe(tc.ip)
+		metrics := gather(t, checker)
+		if tc.sample == "" {
+			if strings.Contains(metrics, "speedtest_external_ip_asn_info{") {
+				t.Errorf("%s: expected no AS, got:\n%s", tc.ip, metrics)
+			}
+		} else if !strings.Contains(metrics, tc.sample) {
+			t.Errorf("%s: expected %s, got:\n%s", tc.ip, tc.sample, metrics)
+		}
+		// The AS is cached until the address changes
+		n := len(queries)
+		gather(t, checker)
+		if len(queries) != n {
+			t.Errorf("%s: expected the AS to be cached, got the queries %v", tc.ip, queries)
+		}
+	}
+}
+
+func TestRDNSLookup(t *testing.T) {
+	var queries []string
+	checker := newIPChecker(defaultNamespace, nil)
+	checker.rdns.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		queries = append(queries, addr)
+		switch addr {
+		case "203.0.113.7":
+			return []string{"X.Dyn.BER03.Example-ISP.net."}, nil
+		case "203.0.113.8":
+			return nil, &net.DNSError{Err: "timeout", Name: addr, IsTimeout: true}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	checker.setConfig(IPConfig{Timeout: time.Second, RDNS: true}, false)
+
+	for _, tc := range []struct {
+		ip, sample string
+	}{
+		{"203.0.113.7", `speedtest_external_ip_rdns_info{hostname="x.dyn.ber03.example-isp.net"} 1`},
+		{"203.0.113.8", ""},
+		{"198.51.100.1", ""},
+	} {
+		queries = nil
+		checker.observe(tc.ip)
+		metrics := gather(t, checker)
+		if tc.sample == "" {
+			if strings.Contains(metrics, "speedtest_external_ip_rdns_info{") {
+				t.Errorf("%s: expected no name, got:\n%s", tc.ip, metrics)
+			}
+		} else if !strings.Contains(metrics, tc.sample) {
+			t.Errorf("%s: expected %s, got:\n%s", tc.ip, tc.sample, metrics)
+		}
+		// The name is cached per address
+		gather(t, checker)
+		if len(queries) != 1 {
+			t.Errorf("%s: expected a single lookup, got %v", tc.ip, queries)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// healthyHandler answers as long as the HTTP server is serving requests
+func healthyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Healthy.")
+	})
+}
+
+// readyHandler reports whether the exporter can produce test results. It
+// never runs a test itself.
+type readyHandler struct {
+	manager *configManager
+}
+
+func (h *readyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.manager.ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "Ready.")
+}
+
+// ready returns why the exporter can't produce test results yet, or nil
+// once it can
+func (m *configManager) ready() error {
+	config := m.current()
+	if config.Probe.Only {
+		return nil
+	}
+	for _, e := range m.testers() {
+		initialized, tested := e.Status()
+		if !initialized {
+			return errors.New("Speedtest client not initialized.")
+		}
+		if config.Web.ReadyRequiresFirstTest && !tested {
+			return errors.New("Waiting for the first test.")
+		}
+	}
+	return nil
+}
+
+// healthy returns whether no test is stuck
+func (m *configManager) healthy() bool {
+	for _, e := range m.testers() {
+		if !e.Healthy() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveReady(manager *configManager) int {
+	w := httptest.NewRecorder()
+	(&readyHandler{manager: manager}).ServeHTTP(w, httptest.NewRequest("GET", "/-/ready", nil))
+	return w.Code
+}
+
+func writeReadyConfigFile(t *testing.T, dir string, fake *fakeSpeedtest, requireTest bool) string {
+	return writeConfigFile(t, dir, fmt.Sprintf(`
+web:
+  ready_requires_first_test: %t
+speedtest:
+  config_url: %s/config.php
+  server_url: %s/servers.php
+`, requireTest, fake.URL, fake.URL))
+}
+
+func TestHealthy(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/-/healthy", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+}
+
+func TestReady(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	configFile := func(requireTest bool) string {
+		return writeReadyConfigFile(t, dir, fake, requireTest)
+	}
+	args := []string{"--config.file", configFile(true)}
+	config, err := parseTestConfig(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	manager, err := newConfigManager(args, config, exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := serveReady(manager); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 before the client is initialized, got %d", code)
+	}
+	manager.initClient()
+	if code := serveReady(manager); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 before the first test, got %d", code)
+	}
+	if fake.requested("/near/random") {
+		t.Error("The readiness check must not run a test")
+	}
+
+	gather(t, exporter)
+	if code := serveReady(manager); code != http.StatusOK {
+		t.Errorf("Expected status 200 after the first test, got %d", code)
+	}
+}
+
+func TestReadyReload(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	configFile := func(requireTest bool) string {
+		return writeReadyConfigFile(t, dir, fake, requireTest)
+	}
+	args := []string{"--config.file", configFile(false)}
+	config, err := parseTestConfig(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := newConfigManager(args, config, newExporter(context.Background(), nil, defaultConfig().Metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.initClient()
+	if code := serveReady(manager); code != http.StatusOK {
+		t.Errorf("Expected status 200 once initialized, got %d", code)
+	}
+
+	configFile(true)
+	if err := manager.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code := serveReady(manager); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the reloaded readiness criteria to apply, got %d", code)
+	}
+}
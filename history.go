@@ -0,0 +1,270 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	// Registers the pure Go "sqlite" driver, so the exporter still builds
+	// without cgo
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// historyLimit is the number of results /history returns by default,
+	// and maxHistoryLimit the most it returns
+	historyLimit    = 500
+	maxHistoryLimit = 10000
+)
+
+// historyMigrations create and update the schema of the history database.
+// The database user_version is the number of migrations applied, so append
+// the changes of the schema here instead of editing the applied
+// migrations. The timestamps are in Unix milliseconds, and result holds
+// the whole result as JSON, as served on /result.
+var historyMigrations = []string{
+	`CREATE TABLE results (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		started_at INTEGER NOT NULL,
+		finished_at INTEGER NOT NULL,
+		ip TEXT NOT NULL,
+		isp TEXT NOT NULL,
+		server_id TEXT,
+		server_name TEXT,
+		server_sponsor TEXT,
+		server_country TEXT,
+		server_cc TEXT,
+		server_url TEXT,
+		server_distance_km REAL,
+		download REAL,
+		upload REAL,
+		ping REAL,
+		success INTEGER NOT NULL,
+		error TEXT,
+		result TEXT NOT NULL
+	);
+	CREATE INDEX results_started_at ON results (started_at);`,
+}
+
+// historyStore stores the results in a SQLite database, deleting those
+// older than retention. A nil historyStore discards the results.
+type historyStore struct {
+	db        *sql.DB
+	retention time.Duration
+}
+
+// openHistory opens the history database, creating it if needed, and
+// migrates its schema
+func openHistory(config HistoryConfig) (*historyStore, error) {
+	db, err := sql.Open("sqlite", config.DB)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes the writes, which SQLite requires
+	// anyway, and keeps the pragmas applied
+	db.SetMaxOpenConns(1)
+	h := &historyStore{db: db, retention: time.Duration(config.Retention)}
+	if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Can't open %s: %s", config.DB, err)
+	}
+	if err := h.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Can't migrate %s: %s", config.DB, err)
+	}
+	return h, nil
+}
+
+// migrate applies the migrations the database lacks, each in its own
+// transaction
+func (h *historyStore) migrate() error {
+	var version int
+	if err := h.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(historyMigrations) {
+		return fmt.Errorf("schema version %d is newer than this exporter, which knows %d", version, len(historyMigrations))
+	}
+	for i := version; i < len(historyMigrations); i++ {
+		tx, err := h.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(historyMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		slog.Debug("Migrated the history database", "version", i+1)
+	}
+	return nil
+}
+
+// add stores result, then deletes the expired results. Errors are logged,
+// the test itself being unaffected.
+func (h *historyStore) add(result *Result) {
+	if h == nil {
+		return
+	}
+	if err := h.insert(result); err != nil {
+		slog.Error("Can't store the result in the history database", "err", err)
+	}
+	if h.retention <= 0 {
+		return
+	}
+	res, err := h.db.Exec("DELETE FROM results WHERE started_at < ?", time.Now().Add(-h.retention).UnixMilli())
+	if err != nil {
+		slog.Error("Can't delete the expired results from the history database", "err", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		slog.Debug("Deleted the expired results from the history database", "count", n)
+	}
+}
+
+func (h *historyStore) insert(result *Result) error {
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	var server ResultServer
+	var serverID, serverDistance any
+	if result.Server != nil {
+		server = *result.Server
+		serverID, serverDistance = server.ID, server.Distance
+	}
+	value := func(phase *PhaseResult) any {
+		if phase == nil {
+			return nil
+		}
+		return phase.Value
+	}
+	var errorValue any
+	if result.Error != "" {
+		errorValue = result.Error
+	}
+	_, err = h.db.Exec(`INSERT INTO results (
+		started_at, finished_at, ip, isp,
+		server_id, server_name, server_sponsor, server_country, server_cc, server_url, server_distance_km,
+		download, upload, ping, success, error, result
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		result.StartedAt.UnixMilli(), result.FinishedAt.UnixMilli(), result.IP, result.ISP,
+		serverID, nullString(server.Name), nullString(server.Sponsor), nullString(server.Country), nullString(server.CC), nullString(server.URL), serverDistance,
+		value(result.Download), value(result.Upload), value(result.Ping), result.Error == "", errorValue, string(encoded))
+	return err
+}
+
+// nullString stores empty strings as NULL
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// query returns the last limit results started at or after since, oldest
+// first
+func (h *historyStore) query(since time.Time, limit int) ([]*Result, error) {
+	rows, err := h.db.Query(`SELECT result FROM (
+		SELECT id, started_at, result FROM results WHERE started_at >= ? ORDER BY started_at DESC, id DESC LIMIT ?
+	) ORDER BY started_at, id`, since.UnixMilli(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []*Result{}
+	for rows.Next() {
+		var encoded string
+		if err := rows.Scan(&encoded); err != nil {
+			return nil, err
+		}
+		result := &Result{}
+		if err := json.Unmarshal([]byte(encoded), result); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// close closes the database
+func (h *historyStore) close() error {
+	if h == nil {
+		return nil
+	}
+	return h.db.Close()
+}
+
+// historyHandler serves the stored results as JSON. The since parameter,
+// a date or an RFC 3339 timestamp, excludes the older results, and limit
+// bounds their number, the last ones being returned.
+type historyHandler struct {
+	history *historyStore
+}
+
+func (h *historyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var since time.Time
+	if value := params.Get("since"); value != "" {
+		var err error
+		if since, err = parseSince(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := historyLimit
+	if value := params.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit %q, expected an integer between 1 and %d", value, maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	results, err := h.history.query(since, limit)
+	if err != nil {
+		slog.Error("Can't query the history database", "err", err)
+		http.Error(w, "Can't query the history database", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// parseSince parses a date such as 2024-01-01, in UTC, or an RFC 3339
+// timestamp
+func parseSince(value string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid since %q, expected a date such as 2024-01-01 or an RFC 3339 timestamp", value)
+	}
+	return t, nil
+}
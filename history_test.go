@@ -0,0 +1,165 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestHistory(t *testing.T, config HistoryConfig) *historyStore {
+	t.Helper()
+	if config.DB == "" {
+		config.DB = filepath.Join(t.TempDir(), "history.db")
+	}
+	history, err := openHistory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { history.close() })
+	return history
+}
+
+func TestHistory(t *testing.T) {
+	history := openTestHistory(t, HistoryConfig{})
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		started := start.Add(time.Duration(i) * time.Hour)
+		history.add(&Result{
+			StartedAt:  started,
+			FinishedAt: started.Add(30 * time.Second),
+			IP:         "192.0.2.1",
+			Server:     &ResultServer{ID: "1", Name: "Berlin", Sponsor: "Example", CC: "DE"},
+			Download:   &PhaseResult{Value: float64(100 + i), Unit: "Mbit/s"},
+		})
+	}
+	history.add(&Result{StartedAt: start.Add(5 * time.Hour), FinishedAt: start.Add(5 * time.Hour), Error: "timeout"})
+
+	results, err := history.query(time.Time{}, historyLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 6 {
+		t.Fatalf("Expected 6 results, got %d", len(results))
+	}
+	if first := results[0]; first.Server == nil || first.Server.Name != "Berlin" || first.Download.Value != 100 || !first.StartedAt.Equal(start) {
+		t.Errorf("Unexpected first result %+v", first)
+	}
+	if last := results[5]; last.Error != "timeout" || last.Download != nil {
+		t.Errorf("Unexpected last result %+v", last)
+	}
+
+	// The last results since the date are returned, oldest first
+	results, err = history.query(start.Add(2*time.Hour), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Download == nil || results[0].Download.Value != 104 || results[1].Error != "timeout" {
+		t.Errorf("Unexpected results %+v", results)
+	}
+
+	var success, failures int
+	history.db.QueryRow("SELECT count(*) FROM results WHERE success AND server_name = 'Berlin'").Scan(&success)
+	history.db.QueryRow("SELECT count(*) FROM results WHERE NOT success AND error IS NOT NULL AND server_id IS NULL").Scan(&failures)
+	if success != 5 || failures != 1 {
+		t.Errorf("Expected 5 successful tests and 1 failure in the columns, got %d and %d", success, failures)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	history := openTestHistory(t, HistoryConfig{Retention: longDuration(90 * 24 * time.Hour)})
+	now := time.Now()
+	history.add(&Result{StartedAt: now.Add(-100 * 24 * time.Hour)})
+	history.add(&Result{StartedAt: now.Add(-80 * 24 * time.Hour)})
+	history.add(&Result{StartedAt: now})
+
+	results, err := history.query(time.Time{}, historyLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("Expected the result older than 90 days to be deleted, got %d results", len(results))
+	}
+}
+
+func TestHistoryMigrations(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "history.db")
+	history := openTestHistory(t, HistoryConfig{DB: filename})
+	history.add(&Result{IP: "192.0.2.1"})
+	history.close()
+
+	// Reopening keeps the results, the migrations being applied once
+	history = openTestHistory(t, HistoryConfig{DB: filename})
+	var version int
+	history.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if version != len(historyMigrations) {
+		t.Errorf("Expected the schema version %d, got %d", len(historyMigrations), version)
+	}
+	if results, err := history.query(time.Time{}, historyLimit); err != nil || len(results) != 1 {
+		t.Errorf("Expected the stored result after reopening, got %v (%v)", results, err)
+	}
+
+	// A database migrated by a newer exporter is refused
+	history.db.Exec("PRAGMA user_version = 1000")
+	history.close()
+	if _, err := openHistory(HistoryConfig{DB: filename}); err == nil {
+		t.Error("Expected an error opening a newer database")
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	history := openTestHistory(t, HistoryConfig{})
+	for _, day := range []int{1, 2, 3} {
+		history.add(&Result{StartedAt: time.Date(2024, 1, day, 0, 0, 0, 0, time.UTC), IP: "192.0.2.1"})
+	}
+	handler := &historyHandler{history: history}
+
+	for _, tc := range []struct {
+		query   string
+		status  int
+		results int
+	}{
+		{"", http.StatusOK, 3},
+		{"since=2024-01-02", http.StatusOK, 2},
+		{"since=2024-01-02T12:00:00Z", http.StatusOK, 1},
+		{"since=2024-01-04", http.StatusOK, 0},
+		{"limit=1", http.StatusOK, 1},
+		{"since=yesterday", http.StatusBadRequest, 0},
+		{"limit=0", http.StatusBadRequest, 0},
+		{"limit=many", http.StatusBadRequest, 0},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/history?"+tc.query, nil))
+			if rr.Code != tc.status {
+				t.Fatalf("Expected status %d, got %d: %s", tc.status, rr.Code, rr.Body)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			var results []*Result
+			if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != tc.results {
+				t.Errorf("Expected %d results, got %d", tc.results, len(results))
+			}
+		})
+	}
+}
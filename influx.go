@@ -0,0 +1,242 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// influxEncoder encodes the results as InfluxDB line protocol, as points
+// of measurement tagged like the Prometheus metrics
+type influxEncoder struct {
+	measurement string
+	// labels are the constant labels of the metrics, and ip tells whether
+	// the points are tagged with the external IP address
+	labels labelMap
+	ip     bool
+}
+
+func newInfluxEncoder(config *Config) *influxEncoder {
+	return &influxEncoder{
+		measurement: config.Influx.Measurement,
+		labels:      config.Metrics.Labels,
+		ip:          !config.Metrics.NoIPLabel,
+	}
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	influxStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`)
+)
+
+// line returns the point of result, ending with a newline. The bandwidths
+// are in bits per second and the latencies in milliseconds.
+func (e *influxEncoder) line(result *Result) []byte {
+	tags := map[string]string{}
+	for name, value := range e.labels {
+		tags[name] = value
+	}
+	if result.Server != nil && result.Server.ID != "" {
+		tags["server_id"] = result.Server.ID
+	}
+	if result.Backend != "" {
+		tags["backend"] = result.Backend
+	}
+	if result.Link != "" {
+		tags["link"] = result.Link
+	}
+	for name, value := range result.Labels {
+		tags[name] = value
+	}
+	if e.ip && result.IP != "" {
+		tags["ip"] = result.IP
+	}
+	names := make([]string, 0, len(tags))
+	for name, value := range tags {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString(influxMeasurementEscaper.Replace(e.measurement))
+	for _, name := range names {
+		fmt.Fprintf(&buf, ",%s=%s", influxTagEscaper.Replace(name), influxTagEscaper.Replace(tags[name]))
+	}
+
+	var fields []string
+	float := func(name string, value float64) {
+		fields = append(fields, name+"="+strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	if result.Download != nil {
+		float("download_bps", result.Download.Value*1e6)
+		fields = append(fields, fmt.Sprintf("download_bytes=%di", result.Download.Bytes))
+	}
+	if result.Upload != nil {
+		float("upload_bps", result.Upload.Value*1e6)
+		fields = append(fields, fmt.Sprintf("upload_bytes=%di", result.Upload.Bytes))
+	}
+	if result.Ping != nil {
+		float("ping_ms", result.Ping.Value)
+		if len(result.Ping.Samples) > 1 {
+			float("jitter_ms", result.Ping.Jitter)
+		}
+	}
+	fields = append(fields, "success="+strconv.FormatBool(result.Error == ""))
+	if result.Error != "" {
+		fields = append(fields, `error="`+influxStringEscaper.Replace(result.Error)+`"`)
+	}
+	fmt.Fprintf(&buf, " %s %d\n", strings.Join(fields, ","), result.FinishedAt.UnixNano())
+	return buf.Bytes()
+}
+
+// influxWriter posts the results to the write endpoint of InfluxDB, the
+// 2.x one when a bucket is configured and the 1.x one otherwise
+type influxWriter struct {
+	encoder *influxEncoder
+	client  *http.Client
+	url     string
+	// token is the 2.x API token, username and password the 1.x
+	// credentials
+	token    string
+	username string
+	password string
+}
+
+func newInfluxWriter(config *Config) (*influxWriter, error) {
+	w := &influxWriter{
+		encoder:  newInfluxEncoder(config),
+		client:   &http.Client{},
+		username: config.Influx.Username,
+	}
+	params := url.Values{"precision": {"ns"}}
+	endpoint := "/write"
+	if config.Influx.Bucket != "" {
+		endpoint = "/api/v2/write"
+		params.Set("org", config.Influx.Org)
+		params.Set("bucket", config.Influx.Bucket)
+	} else {
+		params.Set("db", config.Influx.Database)
+	}
+	w.url = strings.TrimSuffix(config.Influx.URL, "/") + endpoint + "?" + params.Encode()
+	var err error
+	if config.Influx.TokenFile != "" {
+		if w.token, err = readSecretFile(config.Influx.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.Influx.PasswordFile != "" {
+		if w.password, err = readSecretFile(config.Influx.PasswordFile); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *influxWriter) write(ctx context.Context, result *Result) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(w.encoder.line(result)))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	} else if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("InfluxDB answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	// The other client errors, such as a missing bucket or a rejected
+	// token, fail again
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+		return permanentError{err}
+	}
+	return err
+}
+
+// influxFile appends the results to a file, such as for the tail plugin of
+// Telegraf
+type influxFile struct {
+	encoder *influxEncoder
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openInfluxFile(config *Config) (*influxFile, error) {
+	file, err := os.OpenFile(config.Influx.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &influxFile{encoder: newInfluxEncoder(config), file: file}, nil
+}
+
+func (f *influxFile) write(ctx context.Context, result *Result) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.file.Write(f.encoder.line(result))
+	return err
+}
+
+// Close flushes the file to disk and closes it
+func (f *influxFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.file.Sync()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// openInfluxSinks returns the InfluxDB sinks of the configuration, by name
+func openInfluxSinks(config *Config) (map[string]resultSink, error) {
+	sinks := map[string]resultSink{}
+	if config.Influx.URL != "" {
+		writer, err := newInfluxWriter(config)
+		if err != nil {
+			return nil, fmt.Errorf("Can't set up the InfluxDB output: %s", err)
+		}
+		sinks["influx"] = writer
+	}
+	if config.Influx.File != "" {
+		file, err := openInfluxFile(config)
+		if err != nil {
+			return nil, fmt.Errorf("Can't open the InfluxDB output file: %s", err)
+		}
+		sinks["influx_file"] = file
+	}
+	return sinks, nil
+}
@@ -0,0 +1,149 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var influxTestResult = &Result{
+	FinishedAt: time.Unix(1700000000, 0),
+	IP:         "192.0.2.1",
+	Backend:    "speedtest",
+	Server:     &ResultServer{ID: "1234", Name: "Berlin"},
+	Download:   &PhaseResult{Value: 93.5, Unit: "Mbps", Bytes: 120000000},
+	Upload:     &PhaseResult{Value: 40, Unit: "Mbps", Bytes: 50000000},
+	Ping:       &PhaseResult{Value: 12.5, Unit: "ms", Samples: []float64{12.5, 13, 14}, Jitter: 0.75},
+}
+
+func TestInfluxLine(t *testing.T) {
+	config := defaultConfig()
+	config.Metrics.Labels = labelMap{"site": "home office"}
+	encoder := newInfluxEncoder(config)
+
+	expected := `speedtest,backend=speedtest,ip=192.0.2.1,server_id=1234,site=home\ office download_bps=93500000,download_bytes=120000000i,upload_bps=40000000,upload_bytes=50000000i,ping_ms=12.5,jitter_ms=0.75,success=true 1700000000000000000` + "\n"
+	if line := string(encoder.line(influxTestResult)); line != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, line)
+	}
+
+	// The results of a link are tagged with it and its labels
+	link := *influxTestResult
+	link.Link, link.Labels = "lte", map[string]string{"circuit": "DIA-4821"}
+	expected = `speedtest,backend=speedtest,circuit=DIA-4821,ip=192.0.2.1,link=lte,server_id=1234,site=home\ office download_bps=93500000,download_bytes=120000000i,upload_bps=40000000,upload_bytes=50000000i,ping_ms=12.5,jitter_ms=0.75,success=true 1700000000000000000` + "\n"
+	if line := string(encoder.line(&link)); line != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, line)
+	}
+
+	config.Metrics.NoIPLabel = true
+	config.Metrics.Labels = nil
+	config.Influx.Measurement = "speed test"
+	failed := &Result{FinishedAt: time.Unix(1700000000, 0), IP: "192.0.2.1", Backend: "mini", Error: `download failed: "EOF"`}
+	expected = `speed\ test,backend=mini success=false,error="download failed: \"EOF\"" 1700000000000000000` + "\n"
+	if line := string(newInfluxEncoder(config).line(failed)); line != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, line)
+	}
+}
+
+func TestInfluxWriter(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	os.WriteFile(tokenFile, []byte("secret\n"), 0600)
+
+	var path, auth, body string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth = r.URL.String(), r.Header.Get("Authorization")
+		buf, _ := io.ReadAll(r.Body)
+		body = string(buf)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	config := defaultConfig()
+	config.Influx.URL = server.URL + "/"
+	config.Influx.Org = "home"
+	config.Influx.Bucket = "speedtest"
+	config.Influx.TokenFile = tokenFile
+	writer, err := newInfluxWriter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.write(context.Background(), influxTestResult); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/api/v2/write?bucket=speedtest&org=home&precision=ns" || auth != "Token secret" {
+		t.Errorf("Unexpected 2.x write to %s with %q", path, auth)
+	}
+	if body != string(writer.encoder.line(influxTestResult)) {
+		t.Errorf("Unexpected body %q", body)
+	}
+
+	config.Influx.Bucket, config.Influx.TokenFile = "", ""
+	config.Influx.Database = "speedtest"
+	config.Influx.Username = "exporter"
+	if writer, err = newInfluxWriter(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.write(context.Background(), influxTestResult); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/write?db=speedtest&precision=ns" || auth != "Basic ZXhwb3J0ZXI6" {
+		t.Errorf("Unexpected 1.x write to %s with %q", path, auth)
+	}
+
+	// Rejected writes aren't retried, unlike the server errors
+	for code, permanent := range map[int]bool{http.StatusBadRequest: true, http.StatusTooManyRequests: false, http.StatusServiceUnavailable: false} {
+		status = code
+		err := writer.write(context.Background(), influxTestResult)
+		if _, ok := err.(permanentError); err == nil || ok != permanent {
+			t.Errorf("Expected a permanent error (%t) with status %d, got %v", permanent, code, err)
+		}
+	}
+}
+
+func TestInfluxFile(t *testing.T) {
+	config := defaultConfig()
+	config.Influx.File = filepath.Join(t.TempDir(), "speedtest.influx")
+	sinks, err := openInfluxSinks(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := sinks["influx_file"]
+	if len(sinks) != 1 || file == nil {
+		t.Fatalf("Expected the file sink only, got %v", sinks)
+	}
+	for i := 0; i < 2; i++ {
+		if err := file.write(context.Background(), influxTestResult); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.(io.Closer).Close()
+
+	content, err := os.ReadFile(config.Influx.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := string(newInfluxEncoder(config).line(influxTestResult))
+	if string(content) != line+line {
+		t.Errorf("Unexpected file content %q", content)
+	}
+}
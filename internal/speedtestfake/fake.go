@@ -0,0 +1,423 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package speedtestfake is a fake Speedtest.net, serving the configuration
+// and server list documents and the test files of the servers it lists, all
+// from one httptest server. The bandwidth and latency of the fake link are
+// configurable, and faults are injected per endpoint, so the tests of the
+// client and of the exporter run end to end without the network.
+package speedtestfake
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint is a kind of request served by the fake
+type Endpoint string
+
+// The endpoints of the fake
+const (
+	// Config is the configuration document, describing the client
+	Config Endpoint = "config"
+	// Servers is the server list
+	Servers Endpoint = "servers"
+	// Latency is the latency.txt file of the test servers
+	Latency Endpoint = "latency"
+	// Download is the random images of the test servers
+	Download Endpoint = "download"
+	// Upload is the upload.php sink of the test servers
+	Upload Endpoint = "upload"
+)
+
+const (
+	configPath  = "/speedtest-config.php"
+	serversPath = "/speedtest-servers-static.php"
+	// chunkBytes is the size of the writes and reads of the transfers,
+	// the granularity of the throttling
+	chunkBytes = 16 << 10
+)
+
+// TestServer is a test server of the server list, served by the fake under
+// /<ID>/
+type TestServer struct {
+	ID      string
+	Name    string
+	Country string
+	CC      string
+	Sponsor string
+	Lat     float64
+	Lon     float64
+	// Latency is added to the latency of the fake for the requests of the
+	// server, so the server selection is not left to chance
+	Latency time.Duration
+}
+
+// Options are the settings of the fake. The zero values are replaced by
+// the defaults.
+type Options struct {
+	// ClientIP, ISP, Lat and Lon describe the client in the configuration
+	ClientIP string
+	ISP      string
+	Lat      float64
+	Lon      float64
+	// Servers are the test servers of the server list, by default 1234
+	// (Near, in Berlin next to the client) and 99 (Far, in New York, 30ms
+	// further)
+	Servers []TestServer
+	// Latency delays every response
+	Latency time.Duration
+	// DownloadRate and UploadRate (bytes/s) throttle the transfers to and
+	// from the test servers, shared by the concurrent requests. 0 leaves
+	// them unthrottled.
+	DownloadRate int64
+	UploadRate   int64
+}
+
+// DefaultServers are the test servers listed by default
+var DefaultServers = []TestServer{
+	{ID: "1234", Name: "Near", Country: "Germany", CC: "DE", Sponsor: "Fake", Lat: 52.5, Lon: 13.4},
+	{ID: "99", Name: "Far", Country: "United States", CC: "US", Sponsor: "Fake", Lat: 40, Lon: -70, Latency: 30 * time.Millisecond},
+}
+
+// Fault is an error injected in the responses of an endpoint
+type Fault struct {
+	// Status is the status code of the failed requests
+	Status int
+	// Hang holds the failed requests until the client gives up, without
+	// sending the response headers
+	Hang bool
+	// Times is the number of requests failing, all of them when 0
+	Times int
+	// Server restricts the fault to the requests of a test server, by ID
+	Server string
+}
+
+// Server is a running fake, to be closed after use
+type Server struct {
+	*httptest.Server
+
+	opts     Options
+	image    []byte
+	done     chan struct{}
+	doneOnce sync.Once
+
+	mu       sync.Mutex
+	latency  time.Duration
+	download *link
+	upload   *link
+	faults   map[Endpoint]*Fault
+	requests map[Endpoint]int
+}
+
+// New starts a fake with the given options
+func New(opts Options) *Server {
+	if opts.ClientIP == "" {
+		opts.ClientIP = "203.0.113.7"
+	}
+	if opts.ISP == "" {
+		opts.ISP = "Example ISP"
+	}
+	if opts.Lat == 0 && opts.Lon == 0 {
+		opts.Lat, opts.Lon = 52.5, 13.4
+	}
+	if len(opts.Servers) == 0 {
+		opts.Servers = DefaultServers
+	}
+	s := &Server{
+		opts:     opts,
+		image:    make([]byte, chunkBytes),
+		done:     make(chan struct{}),
+		latency:  opts.Latency,
+		download: &link{rate: opts.DownloadRate},
+		upload:   &link{rate: opts.UploadRate},
+		faults:   map[Endpoint]*Fault{},
+		requests: map[Endpoint]int{},
+	}
+	// The images are not compressible, as the real ones
+	rand.New(rand.NewSource(1)).Read(s.image)
+	// Started once assigned, a request can't see the server unset
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	s.Server.Start()
+	return s
+}
+
+// Close releases the hung requests, then shuts the fake down
+func (s *Server) Close() {
+	s.doneOnce.Do(func() { close(s.done) })
+	s.Server.Close()
+}
+
+// ConfigURL is the URL of the configuration document
+func (s *Server) ConfigURL() string {
+	return s.URL + configPath
+}
+
+// ServersURL is the URL of the server list
+func (s *Server) ServersURL() string {
+	return s.URL + serversPath
+}
+
+// ServerURL is the upload.php URL of a test server, as listed
+func (s *Server) ServerURL(id string) string {
+	return s.URL + "/" + id + "/upload.php"
+}
+
+// Inject makes the next requests of an endpoint fail, replacing its
+// previous fault
+func (s *Server) Inject(endpoint Endpoint, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = &fault
+}
+
+// Clear removes the injected faults
+func (s *Server) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = map[Endpoint]*Fault{}
+}
+
+// SetLatency changes the delay of the responses
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// SetRates changes the throttling (bytes/s) of the transfers, 0 leaving
+// them unthrottled
+func (s *Server) SetRates(download int64, upload int64) {
+	s.download.setRate(download)
+	s.upload.setRate(upload)
+}
+
+// Requests returns the number of requests of an endpoint received so far,
+// the failed ones included
+func (s *Server) Requests(endpoint Endpoint) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// route returns the endpoint of a request and the test server it is sent
+// to, if any
+func (s *Server) route(r *http.Request) (Endpoint, string) {
+	switch r.URL.Path {
+	case configPath:
+		return Config, ""
+	case serversPath:
+		return Servers, ""
+	}
+	id, file, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !ok || s.testServer(id) == nil {
+		return "", ""
+	}
+	switch {
+	case file == "latency.txt":
+		return Latency, id
+	case file == "upload.php" && r.Method == http.MethodPost:
+		return Upload, id
+	case imageSize(file) > 0:
+		return Download, id
+	}
+	return "", ""
+}
+
+func (s *Server) testServer(id string) *TestServer {
+	for i := range s.opts.Servers {
+		if s.opts.Servers[i].ID == id {
+			return &s.opts.Servers[i]
+		}
+	}
+	return nil
+}
+
+// imageSize returns the size of a random{N}x{N}.jpg image, 0 for the other
+// files
+func imageSize(file string) int {
+	dims, ok := strings.CutPrefix(file, "random")
+	if !ok {
+		return 0
+	}
+	dims, ok = strings.CutSuffix(dims, ".jpg")
+	if !ok {
+		return 0
+	}
+	width, height, ok := strings.Cut(dims, "x")
+	size, err := strconv.Atoi(width)
+	if !ok || err != nil || width != height || size <= 0 {
+		return 0
+	}
+	return size
+}
+
+// fault counts a request of an endpoint and returns the fault it fails
+// with, if any
+func (s *Server) fault(endpoint Endpoint, server string) (*Fault, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[endpoint]++
+	fault := s.faults[endpoint]
+	if fault == nil || (fault.Server != "" && fault.Server != server) {
+		return nil, s.latency
+	}
+	if fault.Times > 0 {
+		fault.Times--
+		if fault.Times == 0 {
+			delete(s.faults, endpoint)
+		}
+	}
+	return fault, s.latency
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	endpoint, server := s.route(r)
+	if endpoint == "" {
+		http.NotFound(w, r)
+		return
+	}
+	fault, latency := s.fault(endpoint, server)
+	if ts := s.testServer(server); ts != nil {
+		latency += ts.Latency
+	}
+	if !s.sleep(r.Context(), latency) {
+		return
+	}
+	if fault != nil {
+		if fault.Hang {
+			s.sleep(r.Context(), -1)
+			return
+		}
+		http.Error(w, http.StatusText(fault.Status), fault.Status)
+		return
+	}
+
+	switch endpoint {
+	case Config:
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+			`<settings><client ip="%s" lat="%g" lon="%g" isp="%s"/></settings>`,
+			s.opts.ClientIP, s.opts.Lat, s.opts.Lon, s.opts.ISP)
+	case Servers:
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<settings><servers>`)
+		for _, ts := range s.opts.Servers {
+			fmt.Fprintf(w, `<server url="%s" lat="%g" lon="%g" name="%s" country="%s" cc="%s" sponsor="%s" id="%s"/>`,
+				s.ServerURL(ts.ID), ts.Lat, ts.Lon, ts.Name, ts.Country, ts.CC, ts.Sponsor, ts.ID)
+		}
+		fmt.Fprint(w, `</servers></settings>`)
+	case Latency:
+		fmt.Fprint(w, "test=test\n")
+	case Download:
+		s.serveImage(w, r, imageSize(strings.TrimPrefix(r.URL.Path, "/"+server+"/")))
+	case Upload:
+		s.serveUpload(w, r)
+	}
+}
+
+// serveImage writes the 2*size*size bytes of an image, throttled
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request, size int) {
+	remaining := 2 * int64(size) * int64(size)
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.FormatInt(remaining, 10))
+	for remaining > 0 {
+		chunk := s.image[:min(remaining, int64(len(s.image)))]
+		if !s.sleep(r.Context(), s.download.reserve(len(chunk))) {
+			return
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return
+		}
+		remaining -= int64(len(chunk))
+	}
+}
+
+// serveUpload reads the upload payload, throttled, and answers its size
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, chunkBytes)
+	var total int64
+	for {
+		n, err := r.Body.Read(buf)
+		total += int64(n)
+		if !s.sleep(r.Context(), s.upload.reserve(n)) {
+			return
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+	}
+	fmt.Fprintf(w, "size=%d", total)
+}
+
+// sleep waits for d, forever when negative, and returns false when the
+// request is canceled or the fake closed first
+func (s *Server) sleep(ctx context.Context, d time.Duration) bool {
+	if d == 0 {
+		return true
+	}
+	var expired <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-expired:
+		return true
+	case <-ctx.Done():
+	case <-s.done:
+	}
+	return false
+}
+
+// link throttles the transfers of one direction to a rate shared by the
+// concurrent requests
+type link struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+func (l *link) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.next = time.Time{}
+}
+
+// reserve books the transfer of n bytes and returns the time to wait for
+// before they are transferred
+func (l *link) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 || n <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	return l.next.Sub(now)
+}
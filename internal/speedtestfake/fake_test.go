@@ -0,0 +1,127 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtestfake
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestDocuments(t *testing.T) {
+	fake := New(Options{})
+	defer fake.Close()
+
+	_, config := get(t, fake.ConfigURL())
+	if !strings.Contains(config, `<client ip="203.0.113.7" lat="52.5" lon="13.4" isp="Example ISP"/>`) {
+		t.Errorf("Unexpected configuration %s", config)
+	}
+	_, servers := get(t, fake.ServersURL())
+	for _, id := range []string{"1234", "99"} {
+		if !strings.Contains(servers, `url="`+fake.ServerURL(id)+`"`) {
+			t.Errorf("Expected server %s in the server list, got %s", id, servers)
+		}
+	}
+	if status, body := get(t, fake.URL+"/1234/latency.txt"); status != http.StatusOK || body != "test=test\n" {
+		t.Errorf("Unexpected latency file %d %q", status, body)
+	}
+	if status, body := get(t, fake.URL+"/1234/random350x350.jpg"); status != http.StatusOK || len(body) != 2*350*350 {
+		t.Errorf("Expected an image of %d bytes, got %d %d bytes", 2*350*350, status, len(body))
+	}
+	resp, err := http.Post(fake.ServerURL("99"), "application/octet-stream", strings.NewReader(strings.Repeat("x", 100000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "size=100000" {
+		t.Errorf("Unexpected upload response %q", body)
+	}
+	for _, path := range []string{"/1234/random350x500.jpg", "/5/latency.txt", "/other"} {
+		if status, _ := get(t, fake.URL+path); status != http.StatusNotFound {
+			t.Errorf("Expected %s not to be found, got %d", path, status)
+		}
+	}
+	if n := fake.Requests(Download); n != 1 {
+		t.Errorf("Expected 1 download request, got %d", n)
+	}
+}
+
+func TestThrottling(t *testing.T) {
+	fake := New(Options{DownloadRate: 1 << 20, Latency: 50 * time.Millisecond})
+	defer fake.Close()
+
+	start := time.Now()
+	get(t, fake.URL+"/1234/random500x500.jpg")
+	// 500000 bytes at 1MiB/s
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected the download to last about 500ms, got %s", elapsed)
+	}
+
+	fake.SetRates(0, 0)
+	fake.SetLatency(0)
+	start = time.Now()
+	get(t, fake.URL+"/1234/random500x500.jpg")
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Expected an unthrottled download, got %s", elapsed)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	fake := New(Options{})
+	defer fake.Close()
+
+	fake.Inject(Download, Fault{Status: http.StatusServiceUnavailable, Times: 2, Server: "1234"})
+	if status, _ := get(t, fake.URL+"/99/random350x350.jpg"); status != http.StatusOK {
+		t.Errorf("Expected the fault to spare the other servers, got %d", status)
+	}
+	for i := 0; i < 2; i++ {
+		if status, _ := get(t, fake.URL+"/1234/random350x350.jpg"); status != http.StatusServiceUnavailable {
+			t.Errorf("Expected request %d to fail, got %d", i, status)
+		}
+	}
+	if status, _ := get(t, fake.URL+"/1234/random350x350.jpg"); status != http.StatusOK {
+		t.Errorf("Expected the fault to be over, got %d", status)
+	}
+
+	fake.Inject(Config, Fault{Hang: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", fake.ConfigURL(), nil)
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Error("Expected the request to hang until its timeout")
+	}
+	fake.Clear()
+	if status, _ := get(t, fake.ConfigURL()); status != http.StatusOK {
+		t.Errorf("Expected the faults to be cleared, got %d", status)
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+const (
+	// defaultIPCacheTTL is the time the external IP address is cached for
+	defaultIPCacheTTL = 10 * time.Minute
+
+	// defaultIPTimeout bounds each attempt to look up the external IP
+	// address
+	defaultIPTimeout = 3 * time.Second
+
+	// unknownIP is the ip label value when the lookup failed
+	unknownIP = "unknown"
+
+	// maxIPResponseSize bounds the response read from the IP check service
+	maxIPResponseSize = 1024
+)
+
+// IP address families of the ip family setting
+const (
+	ipFamilyAny  = "any"
+	ipFamilyIPv4 = "ipv4"
+	ipFamilyIPv6 = "ipv6"
+)
+
+var (
+	// errInvalidIP is returned when the IP check service answers something
+	// else than an IP address
+	errInvalidIP = errors.New("invalid IP address")
+
+	// errIPFamily is returned when the IP check service answers an address
+	// of another family than configured
+	errIPFamily = errors.New("unexpected IP address family")
+)
+
+// ipChecker determines the external IP address of the exporter, the value
+// of the ip label. It is the client address of the Speedtest configuration,
+// the one the test runs from, or else the address answered by the first of
+// the configured IP check services which answers one. That address is cached
+// for the TTL of the configuration, then refreshed in the background. With
+// dual stack enabled, the IPv4 and IPv6 addresses are looked up too. It
+// counts the answers and failures of the services, and the changes of the
+// address, the last one observed being saved to the state.
+// It implements prometheus.Collector.
+type ipChecker struct {
+	mu     sync.Mutex
+	config IPConfig
+	// disabled skips any lookup, the ip label being disabled
+	disabled bool
+	// dial is how the services are reached
+	dial ipDial
+	// generation changes with the services, so the answers of the previous
+	// ones aren't cached
+	generation int
+	// primary looks up the ip label value, ipv4 and ipv6 the addresses of
+	// each family with dual stack enabled
+	primary *ipLookup
+	ipv4    *ipLookup
+	ipv6    *ipLookup
+	// lastIP is the last address observed, empty if none
+	lastIP string
+	state  *stateStore
+	geo    *geoIP
+	asn    *asnLookup
+	rdns   *rdnsLookup
+
+	answers     *prometheus.CounterVec
+	errors      *prometheus.CounterVec
+	changes     prometheus.Counter
+	addressInfo *prometheus.Desc
+}
+
+// ipDial defines how the IP check services are reached
+type ipDial struct {
+	// dnsServer (host:port), if set, resolves the host names of the
+	// services
+	dnsServer string
+	// sourceAddress and iface, if set, bind the connections to the
+	// services, so the address of a link is looked up over that link
+	sourceAddress string
+	iface         string
+	// netns, if set, is the network namespace the connections are opened
+	// in
+	netns string
+}
+
+// ipLookup caches the address answered by the IP check services over an
+// address family
+type ipLookup struct {
+	family string
+	http   *http.Client
+	// keep retains the previous address when the services don't answer,
+	// instead of dropping it
+	keep bool
+	// ip is the last address looked up, at fetched
+	ip         string
+	fetched    time.Time
+	refreshing bool
+}
+
+func newIPLookup(family string, keep bool, dial ipDial) *ipLookup {
+	return &ipLookup{
+		family: family,
+		http:   ipHTTPClient(family, dial),
+		keep:   keep,
+	}
+}
+
+func newIPChecker(namespace string, state *stateStore) *ipChecker {
+	return &ipChecker{
+		lastIP:  state.lastIP(),
+		state:   state,
+		geo:     newGeoIP(namespace),
+		asn:     newASNLookup(namespace),
+		rdns:    newRDNSLookup(namespace),
+		config:  IPConfig{CacheTTL: defaultIPCacheTTL, Timeout: defaultIPTimeout, Family: ipFamilyAny},
+		primary: newIPLookup(ipFamilyAny, true, ipDial{}),
+		ipv4:    newIPLookup(ipFamilyIPv4, false, ipDial{}),
+		ipv6:    newIPLookup(ipFamilyIPv6, false, ipDial{}),
+		answers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ip_lookup_answers_total",
+			Help:      "Number of external IP address lookups answered, by IP check service.",
+		}, []string{"service"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ip_lookup_errors_total",
+			Help:      "Number of failed external IP address lookups, by IP check service and error type.",
+		}, []string{"service", "type"}),
+		changes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "external_ip_changes_total",
+			Help:      "Number of changes of the external IP address.",
+		}),
+		addressInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "external", "address_info"),
+			"External IP address of each address family answered by the IP check services.",
+			[]string{"ip", "family"}, nil,
+		),
+	}
+}
+
+// setConfig defines how the next lookups are done, disabled skipping them.
+// The cached addresses are dropped when the services change.
+func (c *ipChecker) setConfig(config IPConfig, disabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !reflect.DeepEqual(config.URLs, c.config.URLs) || config.Family != c.config.Family {
+		c.resetLocked(config.Family)
+	}
+	c.config = config
+	c.disabled = disabled
+	c.rdns.setEnabled(config.RDNS)
+}
+
+// setDial defines how the services are reached, the system resolver and
+// routes being used by default
+func (c *ipChecker) setDial(dial ipDial) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dial != c.dial {
+		c.dial = dial
+		c.resetLocked(c.config.Family)
+	}
+}
+
+// resetLocked forgets the addresses looked up so far. c.mu must be held.
+func (c *ipChecker) resetLocked(family string) {
+	c.generation++
+	c.primary = newIPLookup(family, true, c.dial)
+	c.ipv4 = newIPLookup(ipFamilyIPv4, false, c.dial)
+	c.ipv6 = newIPLookup(ipFamilyIPv6, false, c.dial)
+}
+
+// enabled returns whether the external IP address is determined at all
+func (c *ipChecker) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.disabled
+}
+
+// externalIP returns the external IP address of the Speedtest client info,
+// if valid, or else the address answered by the IP check services. It
+// returns "unknown" when neither is available, or an empty string when
+// disabled.
+func (c *ipChecker) externalIP(ctx context.Context, info *speedtest.ClientInfo) string {
+	if !c.enabled() {
+		return ""
+	}
+	if info != nil {
+		if ip := net.ParseIP(info.IP); ip != nil {
+			c.observe(ip.String())
+			return ip.String()
+		}
+		slog.Debug("Invalid IP address in the Speedtest configuration", "ip", info.IP)
+	}
+	ip := c.serviceIP(ctx)
+	c.observe(ip)
+	return ip
+}
+
+// observe records ip as the current address, counting a change from the
+// previous one. A failed lookup is not a change.
+func (c *ipChecker) observe(ip string) {
+	if ip == "" || ip == unknownIP {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastIP == ip {
+		return
+	}
+	if c.lastIP != "" {
+		slog.Info("External IP address changed", "previous", c.lastIP, "ip", ip)
+		c.changes.Inc()
+	}
+	c.lastIP = ip
+	c.state.setLastIP(ip)
+}
+
+// serviceIP returns the address answered by the IP check services. When
+// they don't answer before ctx is done or their timeout, it falls back to the
+// previous address, or "unknown" if none. Once an address is cached, it is
+// returned right away, a stale one being refreshed in the background.
+func (c *ipChecker) serviceIP(ctx context.Context) string {
+	c.mu.Lock()
+	config, l := c.config, c.primary
+	ip, fetched := l.ip, l.fetched
+	switch {
+	case len(config.URLs) == 0:
+		c.mu.Unlock()
+		return unknownIP
+	case ip == "" || config.CacheTTL == 0:
+		c.mu.Unlock()
+	case time.Since(fetched) < config.CacheTTL:
+		c.mu.Unlock()
+		return ip
+	default:
+		c.refreshLocked(l)
+		c.mu.Unlock()
+		return ip
+	}
+
+	if fresh, ok := c.lookup(ctx, l); ok {
+		return fresh
+	}
+	if ip != "" {
+		return ip
+	}
+	return unknownIP
+}
+
+// refreshLocked looks up the address of l again in the background, unless
+// already being done. c.mu must be held.
+func (c *ipChecker) refreshLocked(l *ipLookup) {
+	if l.refreshing {
+		return
+	}
+	l.refreshing = true
+	go func() {
+		c.lookup(context.Background(), l)
+		c.mu.Lock()
+		l.refreshing = false
+		c.mu.Unlock()
+	}()
+}
+
+// lookup gets the external IP address of l from the first service answering
+// a valid one, and caches it unless the services changed in the meantime
+func (c *ipChecker) lookup(ctx context.Context, l *ipLookup) (string, bool) {
+	c.mu.Lock()
+	config, generation := c.config, c.generation
+	c.mu.Unlock()
+
+	for _, serviceURL := range config.URLs {
+		service := ipServiceName(serviceURL)
+		attempt, cancel := context.WithTimeout(ctx, config.Timeout)
+		ip, err := checkIP(attempt, l.http, serviceURL, l.family)
+		cancel()
+		if err != nil {
+			errorType := ipErrorType(err)
+			slog.Error("Error getting IP address", "service", service, "family", l.family, "type", errorType, "err", err)
+			c.errors.WithLabelValues(service, errorType).Inc()
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		c.answers.WithLabelValues(service).Inc()
+		c.mu.Lock()
+		if c.generation == generation {
+			l.ip, l.fetched = ip, time.Now()
+		}
+		c.mu.Unlock()
+		return ip, true
+	}
+	c.mu.Lock()
+	if c.generation == generation && !l.keep {
+		l.ip, l.fetched = "", time.Now()
+	}
+	c.mu.Unlock()
+	return "", false
+}
+
+func (c *ipChecker) Describe(ch chan<- *prometheus.Desc) {
+	c.answers.Describe(ch)
+	c.errors.Describe(ch)
+	c.changes.Describe(ch)
+	ch <- c.addressInfo
+	ch <- c.geo.desc
+	ch <- c.asn.desc
+	ch <- c.rdns.desc
+}
+
+// Collect delivers the lookup counters, the location, AS and reverse DNS
+// name of the address and, with dual stack enabled, the cached address of
+// each family which has one. Stale addresses are refreshed in the
+// background, so scrapes never wait for the services.
+func (c *ipChecker) Collect(ch chan<- prometheus.Metric) {
+	c.answers.Collect(ch)
+	c.errors.Collect(ch)
+	c.changes.Collect(ch)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.disabled {
+		c.geo.collect(ch, c.lastIP)
+		c.asn.collect(ch, c.lastIP)
+		c.rdns.collect(ch, c.lastIP)
+	}
+	if c.disabled || !c.config.DualStack || len(c.config.URLs) == 0 {
+		return
+	}
+	for _, l := range []*ipLookup{c.ipv4, c.ipv6} {
+		if l.fetched.IsZero() || time.Since(l.fetched) >= c.config.CacheTTL {
+			c.refreshLocked(l)
+		}
+		if l.ip != "" {
+			ch <- prometheus.MustNewConstMetric(c.addressInfo, prometheus.GaugeValue, 1, l.ip, l.family)
+		}
+	}
+}
+
+// ipHTTPClient returns the HTTP client of the IP check services, which
+// connects over the given address family only, as defined by dial
+func ipHTTPClient(family string, dial ipDial) *http.Client {
+	network := map[string]string{ipFamilyIPv4: "tcp4", ipFamilyIPv6: "tcp6"}[family]
+	if network == "" && dial == (ipDial{}) {
+		return http.DefaultClient
+	}
+	dialer := speedtest.TransportConfig{Interface: dial.iface, Netns: dial.netns}
+	if dial.sourceAddress != "" {
+		dialer.SourceAddress = net.ParseIP(dial.sourceAddress)
+	}
+	if dial.dnsServer != "" {
+		dialer.Resolver = speedtest.NewResolver(dial.dnsServer, dialer)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, defaultNetwork, address string) (net.Conn, error) {
+		if network == "" {
+			return dialer.DialContext(ctx, defaultNetwork, address)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// ipServiceName identifies an IP check service in the metrics and logs,
+// without the credentials its URL may contain
+func ipServiceName(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return redactURL(rawURL)
+}
+
+// checkIP gets the current external IP address from the service at
+// serviceURL, which answers it as plain text. The address must be of the
+// given family.
+func checkIP(ctx context.Context, client *http.Client, serviceURL string, family string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", serviceURL, nil)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", &speedtest.HTTPError{URL: redactURL(serviceURL), StatusCode: rsp.StatusCode, Status: rsp.Status}
+	}
+
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(nil, rsp.Body, maxIPResponseSize))
+	if err != nil {
+		return "", err
+	}
+	answer := strings.TrimSpace(string(buf))
+	ip := net.ParseIP(answer)
+	if ip == nil {
+		if len(answer) > 64 {
+			answer = answer[:64] + "..."
+		}
+		return "", fmt.Errorf("%w %q", errInvalidIP, answer)
+	}
+	if v4 := ip.To4() != nil; family == ipFamilyIPv4 && !v4 || family == ipFamilyIPv6 && v4 {
+		return "", fmt.Errorf("%w: %s is not an %s address", errIPFamily, ip, family)
+	}
+	return ip.String(), nil
+}
+
+// ipErrorType classifies a lookup error, for use as a metric label value
+func ipErrorType(err error) string {
+	switch {
+	case errors.Is(err, errInvalidIP):
+		return "invalid_response"
+	case errors.Is(err, errIPFamily):
+		return "wrong_family"
+	}
+	return speedtest.ErrorType(err)
+}
@@ -0,0 +1,350 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+func TestExternalIP(t *testing.T) {
+	answer, status := "", http.StatusOK
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+		fmt.Fprint(w, answer)
+	}))
+	defer ts.Close()
+
+	var checker *ipChecker
+	for _, tc := range []struct {
+		answer    string
+		status    int
+		ip        string
+		errorType string
+	}{
+		{" 203.0.113.7\n", http.StatusOK, "203.0.113.7", ""},
+		{"2001:DB8::1\n", http.StatusOK, "2001:db8::1", ""},
+		{"<html><body>Access denied</body></html>", http.StatusOK, unknownIP, "invalid_response"},
+		{"", http.StatusOK, unknownIP, "invalid_response"},
+		{"203.0.113.7", http.StatusTooManyRequests, unknownIP, "rate_limited"},
+	} {
+		answer, status = tc.answer, tc.status
+		checker = newIPChecker(defaultNamespace, nil)
+		checker.setConfig(IPConfig{Timeout: time.Second, URLs: stringList{ts.URL}}, false)
+		if ip := checker.externalIP(context.Background(), nil); ip != tc.ip {
+			t.Errorf("%q: expected %q, got %q", tc.answer, tc.ip, ip)
+		}
+		if tc.errorType == "" {
+			continue
+		}
+		if n := testutil.ToFloat64(checker.errors.WithLabelValues(ipServiceName(ts.URL), tc.errorType)); n != 1 {
+			t.Errorf("%q: expected an error of type %s, got %v", tc.answer, tc.errorType, n)
+		}
+	}
+
+	// The client address of the Speedtest configuration comes first
+	requests = 0
+	info := &speedtest.ClientInfo{IP: "198.51.100.1", ISP: "Example ISP"}
+	if ip := checker.externalIP(context.Background(), info); ip != "198.51.100.1" || requests != 0 {
+		t.Errorf("Expected the client address, got %q after %d requests", ip, requests)
+	}
+	answer, status = "203.0.113.7", http.StatusOK
+	info.IP = "<unknown>"
+	if ip := checker.externalIP(context.Background(), info); ip != "203.0.113.7" {
+		t.Errorf("Expected the service address for an invalid client address, got %q", ip)
+	}
+
+	requests = 0
+	checker.setConfig(IPConfig{}, false)
+	if ip := checker.externalIP(context.Background(), nil); ip != unknownIP || requests != 0 {
+		t.Errorf("Expected %q without service, got %q after %d requests", unknownIP, ip, requests)
+	}
+	checker.setConfig(IPConfig{Timeout: time.Second, URLs: stringList{ts.URL}}, true)
+	if ip := checker.externalIP(context.Background(), info); ip != "" || requests != 0 {
+		t.Errorf("Expected no lookup when disabled, got %q after %d requests", ip, requests)
+	}
+}
+
+func TestExternalIPCache(t *testing.T) {
+	var mu sync.Mutex
+	answer, requests := "203.0.113.7", 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		fmt.Fprintln(w, answer)
+	}))
+	defer ts.Close()
+	set := func(a string) {
+		mu.Lock()
+		defer mu.Unlock()
+		answer, requests = a, 0
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	checker := newIPChecker(defaultNamespace, nil)
+	checker.setConfig(IPConfig{Timeout: time.Second, URLs: stringList{ts.URL}, CacheTTL: time.Hour}, false)
+	for i := 0; i < 3; i++ {
+		if ip := checker.externalIP(context.Background(), nil); ip != "203.0.113.7" {
+			t.Errorf("Expected 203.0.113.7, got %q", ip)
+		}
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected a single lookup, got %d", n)
+	}
+
+	// A stale address is returned while refreshed in the background
+	stale := func() {
+		checker.mu.Lock()
+		checker.primary.fetched = time.Now().Add(-2 * time.Hour)
+		checker.mu.Unlock()
+	}
+	waitRefresh := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			checker.mu.Lock()
+			refreshing := checker.primary.refreshing
+			checker.mu.Unlock()
+			if !refreshing {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("Timeout waiting for the refresh")
+	}
+	set("203.0.113.8")
+	stale()
+	if ip := checker.externalIP(context.Background(), nil); ip != "203.0.113.7" {
+		t.Errorf("Expected the stale address, got %q", ip)
+	}
+	waitRefresh()
+	if ip := checker.externalIP(context.Background(), nil); ip != "203.0.113.8" {
+		t.Errorf("Expected the refreshed address, got %q", ip)
+	}
+
+	// A failed refresh keeps the previous address
+	set("<html>")
+	stale()
+	checker.externalIP(context.Background(), nil)
+	waitRefresh()
+	if n := count(); n != 1 {
+		t.Errorf("Expected a refresh, got %d lookups", n)
+	}
+	if ip := checker.externalIP(context.Background(), nil); ip != "203.0.113.8" {
+		t.Errorf("Expected the previous address after a failed refresh, got %q", ip)
+	}
+	if n := testutil.ToFloat64(checker.errors.WithLabelValues(ipServiceName(ts.URL), "invalid_response")); n != 1 {
+		t.Errorf("Expected the failed refresh to be counted, got %v", n)
+	}
+}
+
+func TestExternalIPFallback(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Rate limited", http.StatusTooManyRequests)
+	}))
+	defer down.Close()
+	ipv6 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "2001:db8::1")
+	}))
+	defer ipv6.Close()
+	ipv4 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "203.0.113.7")
+	}))
+	defer ipv4.Close()
+
+	checker := newIPChecker(defaultNamespace, nil)
+	checker.setConfig(IPConfig{Timeout: time.Second, URLs: stringList{down.URL, ipv6.URL, ipv4.URL}, Family: ipFamilyIPv4}, false)
+	if ip := checker.externalIP(context.Background(), nil); ip != "203.0.113.7" {
+		t.Errorf("Expected the address of the last service, got %q", ip)
+	}
+	for _, tc := range []struct {
+		url, errorType string
+	}{
+		{down.URL, "rate_limited"},
+		{ipv6.URL, "wrong_family"},
+	} {
+		if n := testutil.ToFloat64(checker.errors.WithLabelValues(ipServiceName(tc.url), tc.errorType)); n != 1 {
+			t.Errorf("%s: expected an error of type %s, got %v", tc.url, tc.errorType, n)
+		}
+	}
+	if n := testutil.ToFloat64(checker.answers.WithLabelValues(ipServiceName(ipv4.URL))); n != 1 {
+		t.Errorf("Expected an answer of the last service, got %v", n)
+	}
+
+	checker.setConfig(IPConfig{Timeout: time.Second, URLs: stringList{down.URL, ipv6.URL, ipv4.URL}, Family: ipFamilyAny}, false)
+	if ip := checker.externalIP(context.Background(), nil); ip != "2001:db8::1" {
+		t.Errorf("Expected the address of the first answering service, got %q", ip)
+	}
+}
+
+func TestExternalIPTimeout(t *testing.T) {
+	var mu sync.Mutex
+	hang := false
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		h := hang
+		mu.Unlock()
+		if h {
+			select {
+			case <-done:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		fmt.Fprintln(w, "203.0.113.7")
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	checker := newIPChecker(defaultNamespace, nil)
+	checker.setConfig(IPConfig{URLs: stringList{ts.URL}, Timeout: 100 * time.Millisecond}, false)
+	if ip := checker.externalIP(context.Background(), nil); ip != "203.0.113.7" {
+		t.Fatalf("Expected 203.0.113.7, got %q", ip)
+	}
+
+	mu.Lock()
+	hang = true
+	mu.Unlock()
+	start := time.Now()
+	if ip := checker.externalIP(context.Background(), nil); ip != "203.0.113.7" {
+		t.Errorf("Expected the previous address on timeout, got %q", ip)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the lookup to time out after 100ms, took %s", elapsed)
+	}
+	if n := testutil.ToFloat64(checker.errors.WithLabelValues(ipServiceName(ts.URL), "timeout")); n != 1 {
+		t.Errorf("Expected a timeout error, got %v", n)
+	}
+
+	// Without previous address
+	checker = newIPChecker(defaultNamespace, nil)
+	checker.setConfig(IPConfig{URLs: stringList{ts.URL}, Timeout: time.Minute}, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if ip := checker.externalIP(ctx, nil); ip != unknownIP {
+		t.Errorf("Expected %q on timeout, got %q", unknownIP, ip)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the lookup to be canceled with the context after 100ms, took %s", elapsed)
+	}
+}
+
+func TestExternalAddressInfo(t *testing.T) {
+	// The server only listens on IPv4, so the IPv6 lookup fails
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "203.0.113.7")
+	}))
+	defer ts.Close()
+
+	checker := newIPChecker(defaultNamespace, nil)
+	checker.setConfig(IPConfig{URLs: stringList{ts.URL}, Timeout: time.Second, CacheTTL: time.Hour, DualStack: true}, false)
+	collect := func() string {
+		return gather(t, checker)
+	}
+	// The first scrape doesn't wait for the lookups
+	if metrics := collect(); strings.Contains(metrics, "speedtest_external_address_info") {
+		t.Errorf("Expected no address before the lookups, got:\n%s", metrics)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		checker.mu.Lock()
+		refreshing := checker.ipv4.refreshing || checker.ipv6.refreshing
+		checker.mu.Unlock()
+		if !refreshing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the lookups")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	metrics := collect()
+	if !strings.Contains(metrics, `speedtest_external_address_info{family="ipv4",ip="203.0.113.7"} 1`) {
+		t.Errorf("Expected the IPv4 address, got:\n%s", metrics)
+	}
+	if strings.Contains(metrics, `family="ipv6"`) {
+		t.Errorf("Expected no IPv6 address, got:\n%s", metrics)
+	}
+
+	checker.setConfig(IPConfig{URLs: stringList{ts.URL}, Timeout: time.Second, CacheTTL: time.Hour}, false)
+	if metrics := collect(); strings.Contains(metrics, "speedtest_external_address_info") {
+		t.Errorf("Expected no address without dual stack, got:\n%s", metrics)
+	}
+}
+
+func TestExternalIPChanges(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	filename := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(filename, []byte(`{"last_ip": "203.0.113.7"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker := newIPChecker(defaultNamespace, state)
+	checker.setConfig(IPConfig{Timeout: time.Second}, false)
+	for _, tc := range []struct {
+		ip      string
+		changes float64
+	}{
+		// The address saved before the restart is not a change
+		{"203.0.113.7", 0},
+		{"203.0.113.8", 1},
+		{"203.0.113.8", 1},
+		// Nor is a failed lookup
+		{"<unknown>", 1},
+		{"203.0.113.8", 1},
+		{"203.0.113.7", 2},
+	} {
+		checker.externalIP(context.Background(), &speedtest.ClientInfo{IP: tc.ip})
+		if n := testutil.ToFloat64(checker.changes); n != tc.changes {
+			t.Errorf("%s: expected %v changes, got %v", tc.ip, tc.changes, n)
+		}
+	}
+
+	if err := state.flush(); err != nil {
+		t.Fatal(err)
+	}
+	state, err = loadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := state.lastIP(); ip != "203.0.113.7" {
+		t.Errorf("Expected the last address to be saved, got %q", ip)
+	}
+}
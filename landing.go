@@ -0,0 +1,83 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var landingTemplate = template.Must(template.New("landing").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		return t.Format(time.RFC1123)
+	},
+}).Parse(`<html>
+<head><title>Speedtest Exporter</title></head>
+<body>
+<h1>Speedtest Exporter</h1>
+<h2>Last result</h2>
+{{with .Last}}
+<table>
+<tr><th align="left">Download</th><td>{{with .Download}}{{printf "%.2f" .Value}} {{.Unit}}{{else}}-{{end}}</td></tr>
+<tr><th align="left">Upload</th><td>{{with .Upload}}{{printf "%.2f" .Value}} {{.Unit}}{{else}}-{{end}}</td></tr>
+<tr><th align="left">Ping</th><td>{{with .Ping}}{{printf "%.2f" .Value}} {{.Unit}}{{else}}-{{end}}</td></tr>
+<tr><th align="left">Server</th><td>{{with .Server}}{{.Sponsor}} ({{.Name}}, {{.Country}}), id {{.ID}}{{else}}-{{end}}</td></tr>
+<tr><th align="left">Tested at</th><td>{{time .FinishedAt}}</td></tr>
+{{with .Error}}<tr><th align="left">Error</th><td>{{.}}</td></tr>{{end}}
+</table>
+{{else}}
+<p>No test completed yet.</p>
+{{end}}
+<p>Next test: {{if .Next.IsZero}}on the next scrape of the metrics{{else}}{{time .Next}}{{end}}</p>
+<h2>Links</h2>
+<ul>
+<li><a href="{{.Prefix}}{{.MetricsPath}}">Metrics</a></li>
+<li><a href="{{.Prefix}}/result">Last result (JSON)</a></li>
+<li><a href="{{.Prefix}}/probe">Probe</a></li>
+<li><a href="{{.Prefix}}/-/healthy">Health</a></li>
+</ul>
+</body>
+</html>
+`))
+
+// landingHandler serves the landing page, which shows the last result and
+// the schedule of the tests
+type landingHandler struct {
+	// prefix is the path the exporter is reachable under, links being
+	// relative to it
+	prefix      string
+	metricsPath string
+	exporter    *Exporter
+}
+
+func (h *landingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	last, next := h.exporter.Last()
+	data := struct {
+		Prefix      string
+		MetricsPath string
+		Last        *Result
+		Next        time.Time
+	}{h.prefix, h.metricsPath, last, next}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingTemplate.Execute(w, data); err != nil {
+		slog.Error("Error rendering the landing page", "err", err)
+	}
+}
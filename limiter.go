@@ -0,0 +1,144 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// phaseQueue is the phase of the tests failing to get their turn
+const phaseQueue = "queue"
+
+var errQueueTimeout = errors.New("Timed out waiting for the running tests to finish")
+
+// testLimiter bounds the tests run at once by the exporter, its links, the
+// probes and the targets, the others waiting for their turn in order of
+// arrival. The wait is capped, so a stuck test fails the queued ones
+// instead of blocking them forever.
+type testLimiter struct {
+	queued   *prometheus.Desc
+	timeouts prometheus.Counter
+
+	mu      sync.Mutex
+	max     int
+	wait    time.Duration
+	running int
+	// queue holds the channels of the waiting tests, closed when they get
+	// their turn
+	queue []chan struct{}
+}
+
+func newTestLimiter(namespace string) *testLimiter {
+	return &testLimiter{
+		queued: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "queued_tests"),
+			"Number of tests waiting for the running ones to finish.",
+			nil, nil,
+		),
+		timeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "queue_timeouts_total",
+			Help:      "Number of tests not run as they waited too long for the running ones to finish.",
+		}),
+		max:  1,
+		wait: maxTestDuration,
+	}
+}
+
+// setConfig sets the number of tests run at once and the maximum wait of
+// the others. The queued tests are started right away when max grows.
+func (l *testLimiter) setConfig(max int, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = max
+	l.wait = wait
+	l.dispatch()
+}
+
+// acquire waits for the turn of a test, until the maximum wait elapses or
+// ctx is done. The test must call release once finished.
+func (l *testLimiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.running < l.max && len(l.queue) == 0 {
+		l.running++
+		l.mu.Unlock()
+		return nil
+	}
+	turn := make(chan struct{})
+	l.queue = append(l.queue, turn)
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	l.mu.Unlock()
+
+	var err error
+	select {
+	case <-turn:
+		return nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-turn:
+		// The turn came along with the timeout
+		return nil
+	default:
+	}
+	l.queue = slices.DeleteFunc(l.queue, func(c chan struct{}) bool { return c == turn })
+	if err == errQueueTimeout {
+		l.timeouts.Inc()
+	}
+	return err
+}
+
+// release ends a test, starting the next queued one
+func (l *testLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	l.dispatch()
+}
+
+// dispatch starts the queued tests while below the limit. l.mu must be
+// held.
+func (l *testLimiter) dispatch() {
+	for l.running < l.max && len(l.queue) > 0 {
+		close(l.queue[0])
+		l.queue = l.queue[1:]
+		l.running++
+	}
+}
+
+func (l *testLimiter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.queued
+	l.timeouts.Describe(ch)
+}
+
+func (l *testLimiter) Collect(ch chan<- prometheus.Metric) {
+	l.mu.Lock()
+	queued := len(l.queue)
+	l.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(l.queued, prometheus.GaugeValue, float64(queued))
+	l.timeouts.Collect(ch)
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+func TestTestLimiter(t *testing.T) {
+	limiter := newTestLimiter("speedtest")
+	ctx := context.Background()
+	queued := func() int {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		return len(limiter.queue)
+	}
+	if err := limiter.acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queued tests get their turn in order
+	var order []int
+	done := make(chan int)
+	for i := range 2 {
+		go func() {
+			if err := limiter.acquire(ctx); err != nil {
+				t.Error(err)
+			}
+			done <- i
+		}()
+		// Waits for the test to be queued
+		for queued() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	limiter.release()
+	order = append(order, <-done)
+	limiter.release()
+	order = append(order, <-done)
+	if order[0] != 0 || order[1] != 1 {
+		t.Errorf("Unexpected order %v", order)
+	}
+
+	// The wait is capped
+	limiter.setConfig(1, 10*time.Millisecond)
+	if err := limiter.acquire(ctx); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("Expected a queue timeout, got %v", err)
+	}
+	if value := testutil.ToFloat64(limiter.timeouts); value != 1 {
+		t.Errorf("Unexpected timeouts %f", value)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	limiter.setConfig(1, time.Minute)
+	if err := limiter.acquire(canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancellation, got %v", err)
+	}
+
+	// Raising the limit starts the queued tests
+	go func() {
+		if err := limiter.acquire(ctx); err != nil {
+			t.Error(err)
+		}
+		done <- 2
+	}()
+	for queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	limiter.setConfig(2, time.Minute)
+	<-done
+	if n := queued(); n != 0 {
+		t.Errorf("Unexpected queued tests %d", n)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	link := newLinkExporter(exporter, LinkConfig{Name: "wan2"}, defaultConfig().Metrics)
+	exporter.limiter.setConfig(1, 10*time.Millisecond)
+	// A stuck test of a link holds the only slot
+	if err := link.limiter.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeClient{server: speedtest.Server{ID: "1234"}}
+	result := exporter.test(context.Background(), client, triggerScrape)
+	if !strings.Contains(result.Error, errQueueTimeout.Error()) {
+		t.Errorf("Unexpected error %q", result.Error)
+	}
+	if value := testutil.ToFloat64(exporter.errors.WithLabelValues(phaseQueue, "other")); value != 1 {
+		t.Errorf("Unexpected queue errors %f", value)
+	}
+	link.limiter.release()
+	if result := exporter.test(context.Background(), client, triggerScrape); result.Error != "" {
+		t.Errorf("Unexpected error %q", result.Error)
+	}
+}
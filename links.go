@@ -0,0 +1,128 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dataCapPeriod is the period the daily data caps apply to
+const dataCapPeriod = 24 * time.Hour
+
+// dataUsage is the volume transferred by a test
+type dataUsage struct {
+	at    time.Time
+	bytes int64
+}
+
+// newLinkExporter returns the Exporter of the tests over a link. It
+// shares the outputs of exporter, while its results are not saved to the
+// state file.
+func newLinkExporter(exporter *Exporter, link LinkConfig, metrics MetricsConfig) *Exporter {
+	e := newExporter(exporter.ctx, nil, metrics)
+	e.link = link.Name
+	e.labels = link.Labels
+	e.outputs = exporter.outputs
+	e.newClient = exporter.newClient
+	e.mock = exporter.mock
+	e.limiter = exporter.limiter
+	e.tracer = exporter.tracer
+	e.sinkMetrics = nil
+	return e
+}
+
+// child tells whether e runs the tests of a link or of a compared backend,
+// sharing the limiter and the sinks of the exporter
+func (e *Exporter) child() bool {
+	return e.link != "" || e.backend != ""
+}
+
+// logger returns the logger of the tests, tagged with the link or the
+// compared backend if any
+func (e *Exporter) logger() *slog.Logger {
+	switch {
+	case e.link != "":
+		return slog.With("link", e.link)
+	case e.backend != "":
+		return slog.With("backend", e.backend)
+	}
+	return slog.Default()
+}
+
+// SetDailyCap caps the volume the tests may transfer over 24 hours, zero
+// meaning no cap
+func (e *Exporter) SetDailyCap(bytes int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dataCap = bytes
+}
+
+func (e *Exporter) dataCapValue() int64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.dataCap
+}
+
+// addDataUsage records the volume of a test, or of a soak report, if
+// capped. The volumes of the same minute add up, so the continuous soak
+// reports don't pile up.
+func (e *Exporter) addDataUsage(bytes int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.dataCap <= 0 {
+		return
+	}
+	now := time.Now()
+	if n := len(e.dataUsage); n > 0 && now.Sub(e.dataUsage[n-1].at) < time.Minute {
+		e.dataUsage[n-1].bytes += bytes
+		return
+	}
+	e.dataUsage = append(e.dataUsage, dataUsage{at: now, bytes: bytes})
+}
+
+// usedLocked returns the volume transferred over the last 24 hours,
+// forgetting the older tests. e.mu must be held.
+func (e *Exporter) usedLocked() int64 {
+	cutoff := time.Now().Add(-dataCapPeriod)
+	for len(e.dataUsage) > 0 && e.dataUsage[0].at.Before(cutoff) {
+		e.dataUsage = e.dataUsage[1:]
+	}
+	var used int64
+	for _, u := range e.dataUsage {
+		used += u.bytes
+	}
+	return used
+}
+
+// capped returns whether the tests reached the daily cap
+func (e *Exporter) capped() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dataCap > 0 && e.usedLocked() >= e.dataCap
+}
+
+// collectDataUsage delivers the daily cap and its usage, if capped
+func (e *Exporter) collectDataUsage(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	capped, used := e.dataCap, e.usedLocked()
+	e.mu.Unlock()
+	if capped > 0 {
+		ch <- prometheus.MustNewConstMetric(e.dataCapDesc, prometheus.GaugeValue, float64(capped))
+		ch <- prometheus.MustNewConstMetric(e.dataUsed, prometheus.GaugeValue, float64(used))
+	}
+}
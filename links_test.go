@@ -0,0 +1,150 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+func TestLinks(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	filename := writeConfigFile(t, dir, `
+links:
+  - name: wan1
+    source_address: 127.0.0.1
+  - name: lte
+    source_address: 127.0.0.1
+    daily_cap: 1KiB
+    labels: {circuit: DIA-4821, carrier: lumen}
+`)
+	config, err := parseTestConfig("--config.file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := newExporter(context.Background(), nil, config.Metrics)
+	// The tests over wan1 fail, those over lte transfer 2KiB
+	clients := []*fakeClient{
+		{server: speedtest.Server{ID: "1234"}, err: &speedtest.PhaseError{Phase: speedtest.PhaseDownload, Err: fmt.Errorf("connection reset by peer")}},
+		{server: speedtest.Server{ID: "99"}, measurements: map[string]speedtest.Measurement{speedtest.PhaseDownload: {Value: 42, Bytes: 2048}}},
+	}
+	var sources []string
+	exporter.newClient = func(ctx context.Context, config *SpeedtestConfig, opts speedtest.Options) (speedtestClient, error) {
+		sources = append(sources, config.SourceAddress)
+		client := clients[len(sources)-1]
+		return client, nil
+	}
+	manager, err := newConfigManager([]string{"--config.file", filename}, config, exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.initClient()
+	if len(sources) != 2 || sources[0] != "127.0.0.1" {
+		t.Fatalf("Expected a client by link, bound to its address, got %v", sources)
+	}
+	if initialized, _ := exporter.Status(); initialized {
+		t.Error("Expected the links to run the tests instead of the default route")
+	}
+	if err := manager.ready(); err != nil {
+		t.Errorf("Expected the exporter to be ready, got %s", err)
+	}
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		scrapeHandler(config, exporter, prometheus.NewRegistry(), manager.links...).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	// The failure of wan1 doesn't suppress the results of lte
+	metrics := scrape()
+	for _, line := range []string{
+		`speedtest_download{carrier="lumen",circuit="DIA-4821",ip="unknown",link="lte"} 42`,
+		`speedtest_errors_total{carrier="",circuit="",link="wan1",phase="download",type="other"} 1`,
+		`speedtest_daily_cap_used_bytes{carrier="lumen",circuit="DIA-4821",link="lte"} 2048`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %s, got:\n%s", line, metrics)
+		}
+	}
+	// The cap of lte is reached, its last result being served instead
+	metrics = scrape()
+	for _, line := range []string{
+		`speedtest_tests_total{carrier="lumen",circuit="DIA-4821",link="lte",trigger="scrape"} 1`,
+		`speedtest_tests_total{carrier="",circuit="",link="wan1",trigger="scrape"} 2`,
+		`speedtest_download{carrier="lumen",circuit="DIA-4821",ip="unknown",link="lte"} 42`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %s, got:\n%s", line, metrics)
+		}
+	}
+
+	handler := &resultHandler{exporter: exporter, links: manager.links}
+	for query, expected := range map[string]string{"": "wan1", "?link=lte": "lte"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/result"+query, nil))
+		var result Result
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil || result.Link != expected {
+			t.Errorf("Expected the result of %s for %q, got %+v (%v)", expected, query, result, err)
+		}
+		if expected == "lte" && result.Labels["circuit"] != "DIA-4821" {
+			t.Errorf("Expected the labels of lte in its result, got %v", result.Labels)
+		}
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/result?link=dsl", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown link, got %d", w.Code)
+	}
+}
+
+func TestConfigLinks(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, content := range []string{
+		"links:\n  - source_address: 192.0.2.10",
+		"links:\n  - name: wan1\n",
+		"links:\n  - name: wan1\n    source_address: wan1",
+		"links:\n  - name: wan1\n    interface: eth0\n  - name: wan1\n    interface: eth1",
+		"links:\n  - name: wan1\n    interface: eth0\nprobe:\n  only: true",
+		"links:\n  - name: wan1\n    interface: eth0\nmetrics:\n  labels:\n    link: dsl",
+		"links:\n  - name: wan1\n    interface: eth0\n    labels: {link: dsl}",
+		"links:\n  - name: wan1\n    interface: eth0\n    labels: {server_id: '1'}",
+		"links:\n  - name: wan1\n    interface: eth0\n    labels: {1circuit: a}",
+		"links:\n  - name: wan1\n    interface: eth0\n    labels: {site: a}\nmetrics:\n  labels:\n    site: b",
+		"links:\n  - name: wan1\n    netns: ../wan1",
+	} {
+		if _, err := parseTestConfig("--config.file", writeConfigFile(t, dir, content)); err == nil {
+			t.Errorf("Expected an error with %q", content)
+		}
+	}
+
+	// A network namespace is enough to tell a link apart
+	config, err := parseTestConfig("--config.file", writeConfigFile(t, dir, "links:\n  - name: wan2\n    netns: wan2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings := config.Links[0].speedtest(config.Speedtest); settings.Netns != "wan2" || settings.dialConfig().Netns != "wan2" {
+		t.Errorf("Expected the link connections in network namespace wan2, got %q", settings.Netns)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logRequests logs the requests handled by next: at debug level when
+// successful, at info level otherwise. Health checks aren't logged, nor
+// request bodies and headers.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/-/healthy") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		level := slog.LevelDebug
+		if recorder.status < 200 || recorder.status > 299 {
+			level = slog.LevelInfo
+		}
+		slog.Log(r.Context(), level, "HTTP request", "method", r.Method, "path", r.URL.Path,
+			"status", recorder.status, "duration", time.Since(start), "remote_addr", r.RemoteAddr)
+	})
+}
+
+// statusRecorder records the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// logDedup suppresses the repeats of the messages logged over and over,
+// such as the errors of the tests while the network is down. A message is
+// logged the first time, then its repeats are summarized every window, and
+// once more when it changes or is reset.
+type logDedup struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	window  time.Duration
+	repeats map[string]*logRepeats
+}
+
+// logRepeats are the repeats of a message since it was last logged
+type logRepeats struct {
+	// key identifies what the message reports, args are the attributes of
+	// its last repeat
+	key   string
+	level slog.Level
+	args  []any
+	since time.Time
+	count int
+}
+
+func newLogDedup() *logDedup {
+	return &logDedup{now: time.Now, repeats: map[string]*logRepeats{}}
+}
+
+// setWindow sets the period of the summaries, 0 disabling the
+// deduplication
+func (d *logDedup) setWindow(window time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.window = window
+}
+
+// log logs msg at level with args, unless it repeats the previous msg of
+// the same key, such as the phase and type of an error
+func (d *logDedup) log(logger *slog.Logger, level slog.Level, msg string, key string, args ...any) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	r := d.repeats[msg]
+	if r != nil && r.key == key && d.window > 0 {
+		r.count++
+		r.level, r.args = level, args
+		if now.Sub(r.since) >= d.window {
+			d.summarize(logger, msg, r, now)
+		}
+		return
+	}
+	if r != nil {
+		d.summarize(logger, msg, r, now)
+	}
+	logger.Log(context.Background(), level, msg, args...)
+	d.repeats[msg] = &logRepeats{key: key, level: level, args: args, since: now}
+}
+
+// reset ends the repeats of msg, as what it reports is over
+func (d *logDedup) reset(logger *slog.Logger, msg string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r := d.repeats[msg]; r != nil {
+		d.summarize(logger, msg, r, d.now())
+		delete(d.repeats, msg)
+	}
+}
+
+// summarize logs the number of repeats of msg since r.since, if any, with
+// the attributes of the last one, and counts them again from now
+func (d *logDedup) summarize(logger *slog.Logger, msg string, r *logRepeats, now time.Time) {
+	if r.count > 0 {
+		period := now.Sub(r.since).Round(time.Second)
+		logger.Log(context.Background(), r.level, fmt.Sprintf("%s: last error repeated %d times in the past %s", msg, r.count, period),
+			append([]any{"repeats", r.count, "period", period}, r.args...)...)
+	}
+	r.count, r.since = 0, now
+}
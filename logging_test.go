@@ -0,0 +1,156 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+func TestLogRequests(t *testing.T) {
+	var buf strings.Builder
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	config := defaultConfig()
+	config.Web.LogRequests = true
+	h := newTestRouter(t, config)
+	for _, path := range []string{"/metrics", "/nope", "/-/healthy"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	log := buf.String()
+	for _, s := range []string{"level=DEBUG msg=\"HTTP request\" method=GET path=/metrics status=200", "level=INFO msg=\"HTTP request\" method=GET path=/nope status=404", "remote_addr=192.0.2.1"} {
+		if !strings.Contains(log, s) {
+			t.Errorf("Expected %q in the log, got:\n%s", s, log)
+		}
+	}
+	for _, s := range []string{"/-/healthy", "secret"} {
+		if strings.Contains(log, s) {
+			t.Errorf("Unexpected %q in the log:\n%s", s, log)
+		}
+	}
+}
+
+func TestLogRequestsDisabled(t *testing.T) {
+	var buf strings.Builder
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	h := newTestRouter(t, defaultConfig())
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nope", nil))
+	if strings.Contains(buf.String(), "HTTP request") {
+		t.Errorf("Expected no request log by default, got:\n%s", buf.String())
+	}
+	if w := get(logRequests(http.NotFoundHandler()), "/x"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the status of the wrapped handler, got %d", w.Code)
+	}
+}
+
+func TestLogDedup(t *testing.T) {
+	var buf strings.Builder
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := newLogDedup()
+	d.now = func() time.Time { return now }
+	d.setWindow(30 * time.Minute)
+	lines := func() []string {
+		defer buf.Reset()
+		return strings.Split(strings.TrimSpace(buf.String()), "\n")
+	}
+	fail := func(key string, n int) {
+		for i := 0; i < n; i++ {
+			d.log(logger, slog.LevelError, "Speedtest failed", key, "type", key)
+			now = now.Add(time.Minute)
+		}
+	}
+
+	// The first error is logged, its repeats summarized after the window
+	fail("dial", 32)
+	expected := []string{
+		`level=ERROR msg="Speedtest failed" type=dial`,
+		`level=ERROR msg="Speedtest failed: last error repeated 30 times in the past 30m0s" repeats=30 period=30m0s type=dial`,
+	}
+	if got := lines(); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected the first error and a summary, got:\n%s", strings.Join(got, "\n"))
+	}
+
+	// A different error ends the repeats of the previous one
+	fail("dns", 2)
+	expected = []string{
+		`level=ERROR msg="Speedtest failed: last error repeated 1 times in the past 2m0s" repeats=1 period=2m0s type=dial`,
+		`level=ERROR msg="Speedtest failed" type=dns`,
+	}
+	if got := lines(); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected the summary of the previous error and the new one, got:\n%s", strings.Join(got, "\n"))
+	}
+
+	// A success too, the next error being logged again
+	d.reset(logger, "Speedtest failed")
+	d.reset(logger, "Speedtest failed")
+	fail("dns", 1)
+	expected = []string{
+		`level=ERROR msg="Speedtest failed: last error repeated 1 times in the past 2m0s" repeats=1 period=2m0s type=dns`,
+		`level=ERROR msg="Speedtest failed" type=dns`,
+	}
+	if got := lines(); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected the summary on reset and the error logged again, got:\n%s", strings.Join(got, "\n"))
+	}
+
+	// Without window, every error is logged
+	d.setWindow(0)
+	fail("dns", 2)
+	if got := lines(); len(got) != 2 || got[0] != `level=ERROR msg="Speedtest failed" type=dns` {
+		t.Errorf("Expected every error logged, got:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestLogDedupTests(t *testing.T) {
+	var buf strings.Builder
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetLogDedup(time.Hour)
+	client := &fakeClient{server: speedtest.Server{ID: "1234"}, err: &speedtest.PhaseError{Phase: speedtest.PhaseDownload, Err: errors.New("connection refused")}}
+	for i := 0; i < 3; i++ {
+		exporter.test(context.Background(), client, triggerSchedule)
+	}
+	if n := strings.Count(buf.String(), `msg="Speedtest failed"`); n != 1 {
+		t.Errorf("Expected the failure logged once, got:\n%s", buf.String())
+	}
+	client.err = nil
+	exporter.test(context.Background(), client, triggerSchedule)
+	if !strings.Contains(buf.String(), "last error repeated 2 times") {
+		t.Errorf("Expected a summary once the tests succeed, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// Backends of the tests
+const (
+	backendSpeedtest = "speedtest"
+	backendMini      = "mini"
+	backendMock      = "mock"
+)
+
+// mockPhaseDuration is the duration of the mock transfer phases without
+// configured duration
+const mockPhaseDuration = 10 * time.Second
+
+// The server and client of the mock backend, in documentation ranges
+var (
+	mockServer = speedtest.Server{
+		URL:      "http://speedtest.example.com/speedtest/upload.php",
+		Lat:      52.52,
+		Lon:      13.40,
+		Name:     "Mock",
+		Country:  "Mock",
+		CC:       "ZZ",
+		Sponsor:  "speedtest_exporter",
+		ID:       "mock",
+		Distance: 3,
+	}
+	mockClientInfo = speedtest.ClientInfo{IP: "192.0.2.1", Lat: 52.50, Lon: 13.43, ISP: "Mock ISP"}
+)
+
+// mockBackend creates the clients of the mock backend, which share the
+// generator of its noise and failures, so that the results follow each
+// other rather than repeat when a client is created again
+type mockBackend struct {
+	config MockConfig
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newMockBackend(config MockConfig) *mockBackend {
+	return &mockBackend{config: config, rand: rand.New(rand.NewPCG(uint64(config.Seed), 0))}
+}
+
+// newClient is the clientFactory of the mock backend
+func (b *mockBackend) newClient(ctx context.Context, config *SpeedtestConfig, opts speedtest.Options) (speedtestClient, error) {
+	return b.client(config, opts, 0), nil
+}
+
+// client returns a mock client with the settings of config, streams
+// overriding its streams when set
+func (b *mockBackend) client(config *SpeedtestConfig, opts speedtest.Options, streams int) *mockClient {
+	c := &mockClient{backend: b, settings: *config, onRequest: opts.OnRequest, pingSamples: opts.PingSamples, pingAggregation: opts.PingAggregation}
+	if streams > 0 {
+		c.settings.Streams, c.settings.DownloadStreams, c.settings.UploadStreams = streams, 0, 0
+	}
+	return c
+}
+
+// noisy returns value with the noise of the backend, never negative
+func (b *mockBackend) noisy(value float64) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return math.Max(0, value*(1+b.config.Noise*b.rand.NormFloat64()))
+}
+
+// fails tells whether a phase fails
+func (b *mockBackend) fails() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rand.Float64() < b.config.FailureRate
+}
+
+// mockClient is the speedtestClient of the mock backend
+type mockClient struct {
+	backend         *mockBackend
+	settings        SpeedtestConfig
+	onRequest       func(phase string, status int)
+	pingSamples     int
+	pingAggregation string
+}
+
+func (c *mockClient) TestServer() speedtest.Server {
+	return mockServer
+}
+
+func (c *mockClient) ClientInfo() *speedtest.ClientInfo {
+	info := mockClientInfo
+	return &info
+}
+
+func (c *mockClient) FetchClientInfo(ctx context.Context) (*speedtest.ClientInfo, error) {
+	return c.ClientInfo(), nil
+}
+
+func (c *mockClient) Servers(ctx context.Context, probe bool) []speedtest.ServerStatus {
+	server := mockServer
+	server.Latency = c.backend.config.Ping
+	return []speedtest.ServerStatus{{Server: server, Probed: true, Selected: true}}
+}
+
+// Run returns the results of the mock backend for the given phases, or all
+// of them if none is given, in the order of the real tests. A failed phase
+// ends the test with the error of an overloaded server.
+func (c *mockClient) Run(ctx context.Context, phases ...string) (*speedtest.Result, error) {
+	result := &speedtest.Result{
+		Server:     mockServer,
+		StartedAt:  time.Now(),
+		Phases:     map[string]speedtest.Measurement{},
+		Succeeded:  map[string]bool{},
+		Parameters: c.parameters(),
+	}
+	var err error
+	for _, phase := range []string{speedtest.PhaseDownload, speedtest.PhaseUpload, speedtest.PhasePing} {
+		if len(phases) > 0 && !slices.Contains(phases, phase) {
+			continue
+		}
+		if err = ctx.Err(); err == nil && c.backend.fails() {
+			err = &speedtest.HTTPError{URL: mockServer.URL, StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+		}
+		if err != nil {
+			c.request(phase, http.StatusServiceUnavailable)
+			result.Succeeded[phase] = false
+			err = &speedtest.PhaseError{Phase: phase, Err: err}
+			break
+		}
+		c.request(phase, http.StatusOK)
+		result.Phases[phase] = c.measure(phase)
+		result.Succeeded[phase] = true
+	}
+	result.FinishedAt = time.Now()
+	result.Ping = result.Phases[speedtest.PhasePing].Value
+	result.Jitter = result.Phases[speedtest.PhasePing].Jitter
+	result.Download = result.Phases[speedtest.PhaseDownload].Value
+	result.BytesDown = result.Phases[speedtest.PhaseDownload].Bytes
+	result.Upload = result.Phases[speedtest.PhaseUpload].Value
+	result.BytesUp = result.Phases[speedtest.PhaseUpload].Bytes
+	return result, err
+}
+
+// request counts a request of phase, as the real clients do
+func (c *mockClient) request(phase string, status int) {
+	if c.onRequest != nil {
+		c.onRequest(phase, status)
+	}
+}
+
+// measure returns the measurement of a successful phase
+func (c *mockClient) measure(phase string) speedtest.Measurement {
+	config := c.backend.config
+	if phase == speedtest.PhasePing {
+		samples := make([]float64, max(c.pingSamples, 1))
+		ping, jitter := c.backend.noisy(config.Ping), c.backend.noisy(config.Jitter)
+		for i := range samples {
+			// The samples alternate between the latency and the latency
+			// plus the jitter, their mean variation
+			samples[i] = ping + float64(i%2)*jitter
+		}
+		return speedtest.Measurement{
+			Value:    speedtest.AggregateLatency(samples, c.pingAggregation),
+			Duration: time.Duration(float64(len(samples)) * ping * float64(time.Millisecond)),
+			Samples:  samples,
+			StdDev:   speedtest.StdDev(samples),
+			Jitter:   speedtest.Jitter(samples),
+		}
+	}
+
+	value, duration, streams := config.Download, c.settings.DownloadDuration, c.phaseStreams(phase)
+	if phase == speedtest.PhaseUpload {
+		value, duration = config.Upload, c.settings.UploadDuration
+	}
+	if duration <= 0 {
+		duration = mockPhaseDuration
+	}
+	m := speedtest.Measurement{
+		Value:        c.backend.noisy(value),
+		Duration:     duration,
+		Streams:      streams,
+		CacheChecked: phase == speedtest.PhaseDownload && c.settings.CacheCheckHeaders,
+		Connection:   &speedtest.ConnectionInfo{HTTPVersion: "1.1", TLSVersion: "none", Family: "ipv4"},
+	}
+	if c.settings.RateLimit > 0 {
+		m.RateLimit = float64(c.settings.RateLimit) / 1e6
+		if m.Value >= m.RateLimit {
+			m.Value, m.RateLimited = m.RateLimit, true
+		}
+	}
+	m.Bytes = int64(m.Value * 1e6 / 8 * duration.Seconds())
+	m.PerStream = make([]speedtest.StreamMeasurement, streams)
+	for i := range m.PerStream {
+		m.PerStream[i] = speedtest.StreamMeasurement{Value: m.Value / float64(streams), Bytes: m.Bytes / int64(streams)}
+	}
+	m.PerStream[0].Bytes += m.Bytes % int64(streams)
+	return m
+}
+
+// phaseStreams returns the streams of a transfer phase
+func (c *mockClient) phaseStreams(phase string) int {
+	streams := c.settings.Streams
+	if phase == speedtest.PhaseDownload && c.settings.DownloadStreams > 0 {
+		streams = c.settings.DownloadStreams
+	}
+	if phase == speedtest.PhaseUpload && c.settings.UploadStreams > 0 {
+		streams = c.settings.UploadStreams
+	}
+	return max(streams, 1)
+}
+
+// parameters returns the transfer settings of the tests
+func (c *mockClient) parameters() speedtest.TransferParameters {
+	return speedtest.TransferParameters{
+		DownloadStreams:  c.phaseStreams(speedtest.PhaseDownload),
+		UploadStreams:    c.phaseStreams(speedtest.PhaseUpload),
+		DownloadDuration: c.settings.DownloadDuration,
+		UploadDuration:   c.settings.UploadDuration,
+		UploadPayload:    c.settings.UploadPayload,
+	}
+}
+
+// Soak reports the soak rates of opts, with the noise of the backend,
+// every interval until ctx is done
+func (c *mockClient) Soak(ctx context.Context, opts speedtest.SoakOptions, report func(speedtest.SoakReport)) error {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		r := speedtest.SoakReport{
+			Elapsed:    interval,
+			Download:   c.backend.noisy(float64(opts.DownloadRate) / 1e6),
+			Upload:     c.backend.noisy(float64(opts.UploadRate) / 1e6),
+			Ping:       c.backend.noisy(c.backend.config.Ping),
+			Stalls:     map[string]int{},
+			Reconnects: map[string]int{},
+		}
+		r.DownloadBytes = int64(r.Download * 1e6 / 8 * interval.Seconds())
+		r.UploadBytes = int64(r.Upload * 1e6 / 8 * interval.Seconds())
+		report(r)
+	}
+}
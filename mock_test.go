@@ -0,0 +1,126 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+func TestMockBackend(t *testing.T) {
+	config := defaultConfig()
+	config.Speedtest.Streams = 3
+	mock := newMockBackend(config.Mock)
+	exporter := newExporter(context.Background(), nil, config.Metrics)
+	exporter.mock = mock
+	exporter.newClient = mock.newClient
+	client, err := exporter.createClient(&config.Speedtest, speedtest.Options{PingSamples: 5, PingAggregation: speedtest.PingAggregationMin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.SetClient(client)
+
+	result := exporter.test(context.Background(), client, triggerScrape)
+	if result.Error != "" || result.Backend != backendMock || result.ISP != "Mock ISP" || result.Server.ID != "mock" {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	if result.Download.Value != 500 || result.Upload.Value != 50 || result.Ping.Value != 10 || result.Ping.Jitter != 1 {
+		t.Errorf("Expected the configured values, got %v, %v, %v and %v", result.Download.Value, result.Upload.Value, result.Ping.Value, result.Ping.Jitter)
+	}
+	if result.Download.Streams != 3 || len(result.Download.PerStream) != 3 || result.Download.Bytes != 500*1000*1000/8*10 {
+		t.Errorf("Expected 3 streams transferring 10s at 500Mbps, got %+v", result.Download)
+	}
+	metrics := gather(t, exporter)
+	for _, sample := range [][]string{
+		{"speedtest_download", "} 500"},
+		{"speedtest_ping", "} 10"},
+		{"speedtest_http_requests_total", `code="2xx",phase="upload"}`},
+	} {
+		if !hasSample(metrics, sample[0], sample[1]) {
+			t.Errorf("Expected %s...%s, got:\n%s", sample[0], sample[1], metrics)
+		}
+	}
+}
+
+func TestMockNoise(t *testing.T) {
+	values := func(seed int64) []float64 {
+		mock := newMockBackend(MockConfig{Download: 500, Upload: 50, Ping: 10, Noise: 0.1, Seed: seed})
+		// The clients of a backend share its generator
+		var values []float64
+		for i := 0; i < 3; i++ {
+			result, err := mock.client(&SpeedtestConfig{}, speedtest.Options{}, 0).Run(context.Background(), speedtest.PhaseDownload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, result.Download)
+		}
+		return values
+	}
+	first, again, other := values(42), values(42), values(43)
+	for i := range first {
+		if first[i] != again[i] {
+			t.Errorf("Expected the same values with the same seed, got %v and %v", first, again)
+		}
+	}
+	if first[0] == first[1] || first[0] == other[0] {
+		t.Errorf("Expected noisy values varying with the seed, got %v and %v", first, other)
+	}
+}
+
+func TestMockFailures(t *testing.T) {
+	mock := newMockBackend(MockConfig{Download: 500, Upload: 50, Ping: 10, FailureRate: 1})
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.mock = mock
+	result := exporter.test(context.Background(), mock.client(&SpeedtestConfig{}, speedtest.Options{}, 0), triggerScrape)
+	if result.Download != nil || result.PhaseSuccess[speedtest.PhaseDownload] || result.Error == "" {
+		t.Errorf("Expected the download to fail, got %+v", result)
+	}
+	if value := testutil.ToFloat64(exporter.errors.WithLabelValues(speedtest.PhaseDownload, "overloaded")); value != 1 {
+		t.Errorf("Expected an overloaded error, got %v", value)
+	}
+
+	_, err := mock.client(&SpeedtestConfig{}, speedtest.Options{}, 0).Run(context.Background(), speedtest.PhasePing)
+	var pe *speedtest.PhaseError
+	var httpErr *speedtest.HTTPError
+	if !errors.As(err, &pe) || pe.Phase != speedtest.PhasePing || !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the ping phase to fail, got %v", err)
+	}
+}
+
+func TestConfigMock(t *testing.T) {
+	config, err := parseTestConfig("--backend", "mock", "--mock.download", "900", "--mock.failure-rate", "0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Backend != backendMock || config.Mock.Download != 900 || config.Mock.Upload != 50 || config.Mock.FailureRate != 0.1 {
+		t.Errorf("Unexpected mock settings %s %+v", config.Backend, config.Mock)
+	}
+	for _, args := range [][]string{
+		{"--backend", "iperf"},
+		{"--backend", "mock", "--mock.ping", "0"},
+		{"--backend", "mock", "--mock.noise", "1"},
+		{"--backend", "mock", "--mock.failure-rate", "1.5"},
+	} {
+		if _, err := parseTestConfig(args...); err == nil {
+			t.Errorf("Expected an error with %v", args)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// Module defines how a probe is run
+type Module struct {
+	// Backend is either "speedtest" or "mini"
+	Backend string `yaml:"backend"`
+	// Phases lists the tests to run. All of them are run when empty.
+	Phases []string `yaml:"phases"`
+	// Timeout bounds the probe, in addition to the scrape timeout
+	Timeout time.Duration `yaml:"timeout"`
+	// Streams is the number of parallel connections of the download and
+	// upload tests, those of the Speedtest settings when not set
+	Streams int `yaml:"streams"`
+	// ServerIDs and CountryCodes restrict the servers the fastest one is
+	// selected from
+	ServerIDs    []string `yaml:"server_ids"`
+	CountryCodes []string `yaml:"country_codes"`
+}
+
+// ModulesConfig is the content of the probe modules file
+type ModulesConfig struct {
+	Modules map[string]Module `yaml:"modules"`
+}
+
+// loadModules reads and validates the probe modules file
+func loadModules(filename string) (*ModulesConfig, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &ModulesConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("Can't parse %s: %s", filename, err)
+	}
+	if config.Modules == nil {
+		config.Modules = map[string]Module{}
+	}
+	for name, module := range config.Modules {
+		if err := module.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid module %q: %s", name, err)
+		}
+	}
+	return config, nil
+}
+
+func (module Module) validate() error {
+	switch module.Backend {
+	case "", "speedtest", "mini":
+	default:
+		return fmt.Errorf("unknown backend %q", module.Backend)
+	}
+	for _, phase := range module.Phases {
+		switch phase {
+		case speedtest.PhaseDownload, speedtest.PhaseUpload, speedtest.PhasePing:
+		default:
+			return fmt.Errorf("unknown phase %q", phase)
+		}
+	}
+	if module.Timeout < 0 {
+		return fmt.Errorf("negative timeout %s", module.Timeout)
+	}
+	if module.Streams < 0 {
+		return fmt.Errorf("negative streams %d", module.Streams)
+	}
+	return nil
+}
+
+func (module Module) serverFilter() speedtest.ServerFilter {
+	return speedtest.ServerFilter{
+		IDs:          module.ServerIDs,
+		CountryCodes: module.CountryCodes,
+	}
+}
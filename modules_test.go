@@ -0,0 +1,63 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeModulesFile(t *testing.T, dir string, content string) string {
+	filename := filepath.Join(dir, "probe.yml")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadModules(t *testing.T) {
+	modules, err := loadModules("probe.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pingOnly, ok := modules.Modules["ping_only"]
+	if !ok || len(pingOnly.Phases) != 1 || pingOnly.Phases[0] != "ping" {
+		t.Errorf("Unexpected ping_only module %+v", pingOnly)
+	}
+	full, ok := modules.Modules["full_hourly"]
+	if !ok || full.Streams != 4 || len(full.CountryCodes) != 1 {
+		t.Errorf("Unexpected full_hourly module %+v", full)
+	}
+}
+
+func TestLoadModulesErrors(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for content, expected := range map[string]string{
+		"modules:\n  m:\n    backend: ftp\n":        `unknown backend "ftp"`,
+		"modules:\n  m:\n    phases: [jitter]\n":    `unknown phase "jitter"`,
+		"modules:\n  m:\n    timeout: -1s\n":        "negative timeout",
+		"modules:\n  m:\n    streams: -2\n":         "negative streams",
+		"modules:\n  m:\n    unknown_field: 1\n":    "field unknown_field not found",
+		"modules:\n  m:\n    timeout: notaduration": "Can't parse",
+	} {
+		_, err := loadModules(writeModulesFile(t, dir, content))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected error containing %q, got %v", content, expected, err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/nlamirault/speedtest_exporter/version"
+)
+
+// mqttDisconnectTimeout bounds the publication of the offline status and
+// the disconnection on shutdown
+const mqttDisconnectTimeout = time.Second
+
+// mqttNodeRE matches the characters Home Assistant doesn't accept in the
+// node ID of the discovery topics
+var mqttNodeRE = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// mqttMessage is a retained message
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// mqttPublisher publishes the results to an MQTT broker, as retained JSON
+// messages on topic. The broker is reconnected to automatically, the
+// status subtopic telling whether the exporter is online.
+type mqttPublisher struct {
+	client mqtt.Client
+	topic  string
+	qos    byte
+	// metricTopics publishes the measured values to the subtopics of
+	// topic too
+	metricTopics bool
+	// discovery are the Home Assistant discovery messages, published on
+	// each connection
+	discovery []mqttMessage
+}
+
+func newMQTTPublisher(config *Config) (*mqttPublisher, error) {
+	c := config.MQTT
+	p := &mqttPublisher{
+		topic:        c.Topic,
+		qos:          byte(c.QoS),
+		metricTopics: c.MetricTopics,
+	}
+	if c.Discovery {
+		p.discovery = mqttDiscovery(c)
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(c.ClientID).
+		SetUsername(c.Username).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(p.statusTopic(), "offline", p.qos, true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("Lost the connection to the MQTT broker, reconnecting", "broker", redactURL(c.Broker), "err", err)
+		})
+	if c.PasswordFile != "" {
+		password, err := readSecretFile(c.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetPassword(password)
+	}
+	tlsConfig, err := newTLSConfig(&c.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	p.client = mqtt.NewClient(opts)
+	// The connection is retried in the background until the broker is
+	// available
+	p.client.Connect()
+	return p, nil
+}
+
+func (p *mqttPublisher) statusTopic() string {
+	return p.topic + "/status"
+}
+
+// onConnect publishes the online status and the discovery messages
+func (p *mqttPublisher) onConnect(client mqtt.Client) {
+	slog.Debug("Connected to the MQTT broker")
+	client.Publish(p.statusTopic(), p.qos, true, "online")
+	for _, m := range p.discovery {
+		client.Publish(m.topic, p.qos, true, m.payload)
+	}
+}
+
+// messages returns the messages of result: the result as JSON, served on
+// /result, and with metric topics the measured values of the successful
+// phases
+func (p *mqttPublisher) messages(result *Result) ([]mqttMessage, error) {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	messages := []mqttMessage{{p.topic, payload}}
+	if !p.metricTopics {
+		return messages, nil
+	}
+	value := func(name string, v float64) {
+		messages = append(messages, mqttMessage{p.topic + "/" + name, []byte(strconv.FormatFloat(v, 'f', -1, 64))})
+	}
+	if result.Download != nil {
+		value("download", result.Download.Value)
+	}
+	if result.Upload != nil {
+		value("upload", result.Upload.Value)
+	}
+	if result.Ping != nil {
+		value("ping", result.Ping.Value)
+		value("jitter", result.Ping.Jitter)
+	}
+	messages = append(messages, mqttMessage{p.topic + "/success", []byte(strconv.FormatBool(result.Error == ""))})
+	return messages, nil
+}
+
+func (p *mqttPublisher) write(ctx context.Context, result *Result) error {
+	messages, err := p.messages(result)
+	if err != nil {
+		return permanentError{err}
+	}
+	if !p.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to the MQTT broker")
+	}
+	tokens := make([]mqtt.Token, 0, len(messages))
+	for _, m := range messages {
+		tokens = append(tokens, p.client.Publish(m.topic, p.qos, true, m.payload))
+	}
+	for _, token := range tokens {
+		select {
+		case <-token.Done():
+			if err := token.Error(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close publishes the offline status, which the broker only does itself
+// when the connection is lost, and disconnects
+func (p *mqttPublisher) Close() error {
+	if p.client.IsConnectionOpen() {
+		p.client.Publish(p.statusTopic(), p.qos, true, "offline").WaitTimeout(mqttDisconnectTimeout)
+	}
+	p.client.Disconnect(uint(mqttDisconnectTimeout / time.Millisecond))
+	return nil
+}
+
+// mqttDiscovery returns the Home Assistant MQTT discovery messages of the
+// sensors of the results published on the topic of config
+func mqttDiscovery(config MQTTConfig) []mqttMessage {
+	node := mqttNodeRE.ReplaceAllString(config.ClientID, "_")
+	device := map[string]any{
+		"identifiers": []string{node},
+		"name":        "Speedtest exporter",
+		"model":       "speedtest_exporter",
+		"sw_version":  version.Version,
+	}
+	var messages []mqttMessage
+	for _, sensor := range []struct {
+		key, name, phase, field, unit, deviceClass string
+	}{
+		{"download", "Download", "download", "value", "Mbit/s", "data_rate"},
+		{"upload", "Upload", "upload", "value", "Mbit/s", "data_rate"},
+		{"ping", "Ping", "ping", "value", "ms", "duration"},
+		{"jitter", "Jitter", "ping", "jitter", "ms", "duration"},
+	} {
+		// The phases of failed tests are absent, their sensors becoming
+		// unknown
+		payload, _ := json.Marshal(map[string]any{
+			"name":                sensor.name,
+			"unique_id":           node + "_" + sensor.key,
+			"state_topic":         config.Topic,
+			"availability_topic":  config.Topic + "/status",
+			"value_template":      fmt.Sprintf("{{ value_json.%s.%s if value_json.%s is defined else none }}", sensor.phase, sensor.field, sensor.phase),
+			"unit_of_measurement": sensor.unit,
+			"device_class":        sensor.deviceClass,
+			"state_class":         "measurement",
+			"device":              device,
+		})
+		messages = append(messages, mqttMessage{
+			topic:   fmt.Sprintf("%s/sensor/%s/%s/config", config.DiscoveryPrefix, node, sensor.key),
+			payload: payload,
+		})
+	}
+	return messages
+}
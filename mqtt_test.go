@@ -0,0 +1,236 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker is an MQTT broker recording the last retained message of
+// each topic
+type fakeBroker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	retained map[string]string
+	username string
+	password string
+	received chan string
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{listener: listener, retained: map[string]string{}, received: make(chan string, 100)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// serve answers the packets of a client, accepting any connection
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			b.connect(body)
+			conn.Write([]byte{0x20, 2, 0, 0})
+		case 3: // PUBLISH
+			n := int(binary.BigEndian.Uint16(body))
+			topic, rest := string(body[2:2+n]), body[2+n:]
+			if qos := (header >> 1) & 3; qos > 0 {
+				conn.Write([]byte{0x40, 2, rest[0], rest[1]})
+				rest = rest[2:]
+			}
+			b.mu.Lock()
+			b.retained[topic] = string(rest)
+			b.mu.Unlock()
+			b.received <- topic
+		case 12: // PINGREQ
+			conn.Write([]byte{0xd0, 0})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// connect records the credentials of a CONNECT packet
+func (b *fakeBroker) connect(body []byte) {
+	field := func() string {
+		n := int(binary.BigEndian.Uint16(body))
+		value := string(body[2 : 2+n])
+		body = body[2+n:]
+		return value
+	}
+	field() // Protocol name
+	flags := body[1]
+	body = body[4:]
+	field() // Client ID
+	if flags&0x04 != 0 {
+		field() // Will topic
+		field() // Will message
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if flags&0x80 != 0 {
+		b.username = field()
+	}
+	if flags&0x40 != 0 {
+		b.password = field()
+	}
+}
+
+// wait waits until topic is published to, returning its message
+func (b *fakeBroker) wait(t *testing.T, topic string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		b.mu.Lock()
+		message, ok := b.retained[topic]
+		b.mu.Unlock()
+		if ok {
+			return message
+		}
+		select {
+		case <-b.received:
+		case <-timeout:
+			t.Fatalf("Timed out waiting for a message on %s", topic)
+		}
+	}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	broker := newFakeBroker(t)
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(passwordFile, []byte("secret\n"), 0600)
+	config := defaultConfig()
+	config.MQTT.Broker = broker.url()
+	config.MQTT.Topic = "network/speedtest"
+	config.MQTT.Username = "exporter"
+	config.MQTT.PasswordFile = passwordFile
+	config.MQTT.MetricTopics = true
+	config.MQTT.Discovery = true
+	publisher, err := newMQTTPublisher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := broker.wait(t, "network/speedtest/status"); status != "online" {
+		t.Errorf("Expected the online status, got %q", status)
+	}
+	var discovery map[string]any
+	if err := json.Unmarshal([]byte(broker.wait(t, "homeassistant/sensor/speedtest_exporter/download/config")), &discovery); err != nil {
+		t.Fatal(err)
+	}
+	if discovery["state_topic"] != "network/speedtest" || discovery["unit_of_measurement"] != "Mbit/s" || discovery["unique_id"] != "speedtest_exporter_download" {
+		t.Errorf("Unexpected discovery message %v", discovery)
+	}
+	broker.mu.Lock()
+	if broker.username != "exporter" || broker.password != "secret" {
+		t.Errorf("Unexpected credentials %q and %q", broker.username, broker.password)
+	}
+	broker.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result := &Result{IP: "192.0.2.1", Download: &PhaseResult{Value: 93.5, Unit: "Mbps"}}
+	if err := publisher.write(ctx, result); err != nil {
+		t.Fatal(err)
+	}
+	var published Result
+	if err := json.Unmarshal([]byte(broker.wait(t, "network/speedtest")), &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.IP != "192.0.2.1" || published.Download == nil || published.Download.Value != 93.5 {
+		t.Errorf("Unexpected published result %+v", published)
+	}
+	if download := broker.wait(t, "network/speedtest/download"); download != "93.5" {
+		t.Errorf("Expected the download on its topic, got %q", download)
+	}
+	if success := broker.wait(t, "network/speedtest/success"); success != "true" {
+		t.Errorf("Expected the success on its topic, got %q", success)
+	}
+	broker.mu.Lock()
+	_, ok := broker.retained["network/speedtest/upload"]
+	broker.mu.Unlock()
+	if ok {
+		t.Error("Expected no upload message without upload phase")
+	}
+
+	publisher.Close()
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if status := broker.retained["network/speedtest/status"]; status != "offline" {
+		t.Errorf("Expected the offline status on shutdown, got %q", status)
+	}
+}
+
+func TestMQTTPublisherDisconnected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	config := defaultConfig()
+	config.MQTT.Broker = "tcp://" + listener.Addr().String()
+	publisher, err := newMQTTPublisher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	// Publishing fails without waiting while the broker is unavailable
+	if err := publisher.write(context.Background(), &Result{}); err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Errorf("Expected a connection error, got %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// The exit codes of -once besides 0, for a failed test and for a test
+// missing an assertion
+const (
+	exitTestFailed      = 1
+	exitAssertionFailed = 2
+)
+
+// The output formats of -once
+const (
+	onceOutputJSON  = "json"
+	onceOutputJUnit = "junit"
+)
+
+// AssertConfig defines the thresholds the test of -once must meet, zero
+// disabling a threshold
+type AssertConfig struct {
+	MinDownload bitRate
+	MinUpload   bitRate
+	MaxPing     time.Duration
+}
+
+// onceResult is the output of -once: the result of the test and, with
+// thresholds, the outcome of their assertions
+type onceResult struct {
+	*Result
+	Assertions *assertionsResult `json:"assertions,omitempty"`
+}
+
+// assertionsResult is the outcome of the assertions of -once, passed when
+// all of them are
+type assertionsResult struct {
+	Passed bool        `json:"passed"`
+	Checks []assertion `json:"checks"`
+}
+
+// assertion is the outcome of a threshold, in the unit of its value
+type assertion struct {
+	Name      string  `json:"name"`
+	Passed    bool    `json:"passed"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Unit      string  `json:"unit"`
+	// Message tells how a failed assertion missed its threshold
+	Message string `json:"message,omitempty"`
+	// measured tells whether Value was measured
+	measured bool
+}
+
+// assertResult checks the values of result against the expectations, nil
+// when there is none. A value which wasn't measured misses its threshold.
+func assertResult(result *Result, expectations []expectation) *assertionsResult {
+	if len(expectations) == 0 {
+		return nil
+	}
+	outcome := &assertionsResult{Passed: true, Checks: []assertion{}}
+	for _, e := range expectations {
+		a := assertion{Name: e.metric, Passed: true, Threshold: e.threshold, Unit: e.unit}
+		switch phase := e.value(result); {
+		case phase == nil:
+			a.Passed, a.Message = false, fmt.Sprintf("%s not measured, expected %s", e.metric, e.expected())
+		case e.missed(phase.Value):
+			a.Value, a.measured = phase.Value, true
+			a.Passed, a.Message = false, fmt.Sprintf("%s of %s %s, expected %s", e.metric, strconv.FormatFloat(phase.Value, 'f', 2, 64), e.unit, e.expected())
+		default:
+			a.Value, a.measured = phase.Value, true
+		}
+		outcome.Passed = outcome.Passed && a.Passed
+		outcome.Checks = append(outcome.Checks, a)
+	}
+	return outcome
+}
+
+// writeOnceResult writes the output of -once to w in format, indented JSON
+// or a JUnit report
+func writeOnceResult(w io.Writer, output onceResult, format string) error {
+	if format == onceOutputJUnit {
+		return writeJUnit(w, output)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
+
+// junitSuites is the root element of a JUnit report
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr,omitempty"`
+	Failure   *junitProblem `xml:"failure"`
+	Error     *junitProblem `xml:"error"`
+}
+
+// junitProblem is the failure or the error of a test case
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the output of -once to w as a JUnit report: a test
+// case for the test itself, erroring when it failed, followed by one for
+// each assertion, failing when missed
+func writeJUnit(w io.Writer, output onceResult) error {
+	result := output.Result
+	seconds := strconv.FormatFloat(result.FinishedAt.Sub(result.StartedAt).Seconds(), 'f', 3, 64)
+	suite := junitSuite{Name: "speedtest", Time: seconds, Timestamp: result.StartedAt.UTC().Format(time.RFC3339)}
+	test := junitCase{Name: "test", ClassName: "speedtest", Time: seconds}
+	if result.Error != "" {
+		test.Error = &junitProblem{Message: result.Error, Type: "test"}
+		suite.Errors++
+	}
+	suite.Cases = append(suite.Cases, test)
+	if output.Assertions != nil {
+		for _, a := range output.Assertions.Checks {
+			c := junitCase{Name: a.Name, ClassName: "speedtest.assertions"}
+			if !a.Passed {
+				value := "not measured"
+				if a.measured {
+					value = strconv.FormatFloat(a.Value, 'f', 2, 64) + " " + a.Unit
+				}
+				text := fmt.Sprintf("value: %s, threshold: %s %s", value, strconv.FormatFloat(a.Threshold, 'f', -1, 64), a.Unit)
+				c.Failure = &junitProblem{Message: a.Message, Type: "assertion", Text: text}
+				suite.Failures++
+			}
+			suite.Cases = append(suite.Cases, c)
+		}
+	}
+	suite.Tests = len(suite.Cases)
+	report := junitSuites{Name: "speedtest_exporter", Tests: suite.Tests, Failures: suite.Failures, Errors: suite.Errors, Time: seconds, Suites: []junitSuite{suite}}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// runOnce runs a single test of the default route with the settings of
+// config, aborted when ctx is done, writes its result to w and the
+// errors and missed assertions to errw, and returns the exit code: 0, or
+// exitTestFailed when the test failed, or else exitAssertionFailed when it
+// missed an assertion. Nothing is exported nor written to the outputs.
+func runOnce(ctx context.Context, w io.Writer, errw io.Writer, config *Config) int {
+	exporter := newExporter(ctx, nil, config.Metrics)
+	if config.Backend == backendMock {
+		exporter.mock = newMockBackend(config.Mock)
+		exporter.newClient = exporter.mock.newClient
+	}
+	manager, err := newConfigManager(nil, config, exporter)
+	if err != nil {
+		fmt.Fprintln(errw, err)
+		return exitTestFailed
+	}
+	active := manager.current()
+	client, err := exporter.createClient(&active.Speedtest, active.clientOptions())
+	if err != nil {
+		fmt.Fprintln(errw, err)
+		return exitTestFailed
+	}
+	result := exporter.test(ctx, client, triggerOnce)
+	output := onceResult{Result: result}
+	output.Assertions = assertResult(result, newExpectations(config.Assert.MinDownload, config.Assert.MinUpload, config.Assert.MaxPing))
+
+	if err := writeOnceResult(w, output, config.OnceOutput); err != nil {
+		fmt.Fprintln(errw, err)
+		return exitTestFailed
+	}
+	if result.Error != "" {
+		fmt.Fprintf(errw, "Test failed: %s\n", result.Error)
+		return exitTestFailed
+	}
+	if output.Assertions != nil && !output.Assertions.Passed {
+		for _, a := range output.Assertions.Checks {
+			if !a.Passed {
+				fmt.Fprintf(errw, "Assertion failed: %s\n", a.Message)
+			}
+		}
+		return exitAssertionFailed
+	}
+	return 0
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunOnce(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		code int
+		// assertions is the outcome of the assertions, passed or failed,
+		// if any
+		assertions string
+		stderr     string
+	}{
+		{nil, 0, "", ""},
+		{[]string{"--assert.min-download", "100Mbps", "--assert.max-ping", "40ms"}, 0, "passed", ""},
+		{[]string{"--assert.min-download", "100Mbps", "--assert.min-upload", "100Mbps"}, exitAssertionFailed, "failed", "Assertion failed: upload of 50.00 Mbps, expected ≥100 Mbps\n"},
+		{[]string{"--assert.max-ping", "5ms"}, exitAssertionFailed, "failed", "Assertion failed: ping of 10.00 ms, expected ≤5 ms\n"},
+		// A failed test fails whatever the assertions
+		{[]string{"--mock.failure-rate", "1", "--assert.min-download", "100Mbps"}, exitTestFailed, "failed", "Test failed: "},
+	} {
+		config, err := parseTestConfig(append([]string{"--once", "--backend", "mock"}, tc.args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stdout, stderr strings.Builder
+		if code := runOnce(context.Background(), &stdout, &stderr, config); code != tc.code {
+			t.Errorf("%v: expected exit code %d, got %d: %s", tc.args, tc.code, code, stderr.String())
+		}
+		if !strings.HasPrefix(stderr.String(), tc.stderr) || (tc.stderr == "" && stderr.Len() > 0) {
+			t.Errorf("%v: expected the errors %q, got %q", tc.args, tc.stderr, stderr.String())
+		}
+		var output struct {
+			Trigger    string `json:"trigger"`
+			Backend    string `json:"backend"`
+			Assertions *struct {
+				Passed bool `json:"passed"`
+			} `json:"assertions"`
+		}
+		if err := json.Unmarshal([]byte(stdout.String()), &output); err != nil {
+			t.Fatalf("%v: invalid output %q: %s", tc.args, stdout.String(), err)
+		}
+		if output.Trigger != triggerOnce || output.Backend != backendMock {
+			t.Errorf("%v: expected the result of the mock backend, got %s", tc.args, stdout.String())
+		}
+		assertions := ""
+		switch {
+		case output.Assertions != nil && output.Assertions.Passed:
+			assertions = "passed"
+		case output.Assertions != nil:
+			assertions = "failed"
+		}
+		if assertions != tc.assertions {
+			t.Errorf("%v: expected the assertions %q, got %s", tc.args, tc.assertions, stdout.String())
+		}
+	}
+
+	// The report has the same outcome
+	config, err := parseTestConfig("--once", "--backend", "mock", "--once.output", "junit", "--assert.max-ping", "5ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr strings.Builder
+	if code := runOnce(context.Background(), &stdout, &stderr, config); code != exitAssertionFailed || !strings.Contains(stdout.String(), `<failure message="ping of 10.00 ms, expected ≤5 ms" type="assertion">`) {
+		t.Errorf("Expected the JUnit report of the missed assertion, got %d: %s", code, stdout.String())
+	}
+
+	for _, args := range [][]string{
+		{"--assert.min-download", "100Mbps"},
+		{"--once", "--assert.max-ping", "-1ms"},
+		{"--once", "--once.output", "xml"},
+		{"--once.output", "junit"},
+	} {
+		if _, err := parseTestConfig(args...); err == nil {
+			t.Errorf("Expected an error with %v", args)
+		}
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	start := time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC)
+	expectations := newExpectations(100e6, 20e6, 40*time.Millisecond)
+	for golden, result := range map[string]*Result{
+		"once-junit.xml": {
+			StartedAt: start, FinishedAt: start.Add(30500 * time.Millisecond),
+			Download: &PhaseResult{Value: 85.2}, Upload: &PhaseResult{Value: 25}, Ping: &PhaseResult{Value: 12.3},
+		},
+		// The phases of a failed test which weren't measured miss their
+		// thresholds
+		"once-junit-error.xml": {
+			StartedAt: start, FinishedAt: start.Add(2 * time.Second),
+			Ping: &PhaseResult{Value: 12.3}, Error: "download: connection reset by peer",
+		},
+	} {
+		var buf strings.Builder
+		if err := writeOnceResult(&buf, onceResult{Result: result, Assertions: assertResult(result, expectations)}, onceOutputJUnit); err != nil {
+			t.Fatal(err)
+		}
+		expected, err := os.ReadFile(filepath.Join("testdata", golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != string(expected) {
+			t.Errorf("Expected the report of testdata/%s:\n%s\ngot:\n%s", golden, expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nootlp
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+	"github.com/nlamirault/speedtest_exporter/version"
+)
+
+// otlpExporter is the part of the OTLP exporters the sink depends on
+type otlpExporter interface {
+	Export(ctx context.Context, rm *metricdata.ResourceMetrics) error
+	Shutdown(ctx context.Context) error
+}
+
+// otlpSink pushes the results to an OpenTelemetry collector as soon as the
+// tests complete. The instruments mirror the Prometheus metrics, the
+// constant labels being the resource attributes.
+type otlpSink struct {
+	exporter otlpExporter
+	reader   *sdkmetric.ManualReader
+	provider *sdkmetric.MeterProvider
+	// ip tells whether the data points carry the external IP address
+	ip bool
+
+	ping, download, upload, phaseSuccess metric.Float64Gauge
+	transferred                          metric.Int64Counter
+
+	// recorded is the result of metrics, kept to be exported again on
+	// retries
+	recorded *Result
+	metrics  metricdata.ResourceMetrics
+}
+
+func newOTLPSink(config *Config) (resultSink, error) {
+	exporter, err := newOTLPExporter(config.OTLP)
+	if err != nil {
+		return nil, err
+	}
+	return newOTLPSinkWith(config, exporter)
+}
+
+// newOTLPExporter returns the gRPC or HTTP exporter of config. Its own
+// retries are disabled, the sink queue retrying the failed exports.
+func newOTLPExporter(config OTLPConfig) (otlpExporter, error) {
+	tlsConfig, err := newTLSConfig(&config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if config.Protocol == otlpProtocolHTTP {
+		opts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(config.Endpoint),
+			otlpmetrichttp.WithHeaders(config.Headers),
+			otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig{Enabled: false}),
+		}
+		if config.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		} else if tlsConfig != nil {
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(tlsConfig))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+	opts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(config.Endpoint),
+		otlpmetricgrpc.WithHeaders(config.Headers),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetryConfig{Enabled: false}),
+	}
+	if config.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	} else if tlsConfig != nil {
+		opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// otlpResource returns the resource of the OTLP metrics and traces: the
+// exporter and the constant labels
+func otlpResource(config *Config) *resource.Resource {
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", "speedtest_exporter"),
+		attribute.String("service.version", version.Version),
+	}
+	names := make([]string, 0, len(config.Metrics.Labels))
+	for name := range config.Metrics.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attrs = append(attrs, attribute.String(name, config.Metrics.Labels[name]))
+	}
+	return resource.NewSchemaless(attrs...)
+}
+
+func newOTLPSinkWith(config *Config, exporter otlpExporter) (*otlpSink, error) {
+	s := &otlpSink{
+		exporter: exporter,
+		// The gauges only report the values of the last test, a failed
+		// phase leaving no stale value
+		reader: sdkmetric.NewManualReader(sdkmetric.WithTemporalitySelector(func(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+			if kind == sdkmetric.InstrumentKindGauge {
+				return metricdata.DeltaTemporality
+			}
+			return metricdata.CumulativeTemporality
+		})),
+		ip: !config.Metrics.NoIPLabel,
+	}
+	s.provider = sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(otlpResource(config)),
+		sdkmetric.WithReader(s.reader),
+	)
+	meter := s.provider.Meter("github.com/nlamirault/speedtest_exporter")
+	name := func(metric string) string {
+		if config.Metrics.Namespace == "" {
+			return metric
+		}
+		return config.Metrics.Namespace + "_" + metric
+	}
+	var err error
+	if s.ping, err = meter.Float64Gauge(name("ping"), metric.WithUnit("ms"), metric.WithDescription("Latency (ms).")); err != nil {
+		return nil, err
+	}
+	if s.download, err = meter.Float64Gauge(name("download"), metric.WithUnit("Mbit/s"), metric.WithDescription("Download bandwidth (Mbps).")); err != nil {
+		return nil, err
+	}
+	if s.upload, err = meter.Float64Gauge(name("upload"), metric.WithUnit("Mbit/s"), metric.WithDescription("Upload bandwidth (Mbps).")); err != nil {
+		return nil, err
+	}
+	if s.phaseSuccess, err = meter.Float64Gauge(name("phase_success"), metric.WithDescription("Whether each phase of the test succeeded, by phase.")); err != nil {
+		return nil, err
+	}
+	if s.transferred, err = meter.Int64Counter(name("transferred_bytes_total"), metric.WithUnit("By"), metric.WithDescription("Bytes transferred by the successful download and upload phases, by phase.")); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// record records the measurements of result
+func (s *otlpSink) record(ctx context.Context, result *Result) {
+	var attrs []attribute.KeyValue
+	if result.Server != nil {
+		attrs = append(attrs, attribute.String("server_id", result.Server.ID))
+	}
+	if s.ip {
+		attrs = append(attrs, attribute.String("ip", result.IP))
+	}
+	if result.Link != "" {
+		attrs = append(attrs, attribute.String("link", result.Link))
+	}
+	names := make([]string, 0, len(result.Labels))
+	for name := range result.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attrs = append(attrs, attribute.String(name, result.Labels[name]))
+	}
+	opt := metric.WithAttributes(attrs...)
+	if result.Ping != nil {
+		s.ping.Record(ctx, result.Ping.Value, opt)
+	}
+	for phase, r := range map[string]*PhaseResult{speedtest.PhaseDownload: result.Download, speedtest.PhaseUpload: result.Upload} {
+		if r == nil {
+			continue
+		}
+		if phase == speedtest.PhaseDownload {
+			s.download.Record(ctx, r.Value, opt)
+		} else {
+			s.upload.Record(ctx, r.Value, opt)
+		}
+		s.transferred.Add(ctx, r.Bytes, metric.WithAttributes(attribute.String("phase", phase)))
+	}
+	for phase, succeeded := range result.PhaseSuccess {
+		success := 0.0
+		if succeeded {
+			success = 1
+		}
+		s.phaseSuccess.Record(ctx, success, metric.WithAttributes(append(attrs[:len(attrs):len(attrs)], attribute.String("phase", phase))...))
+	}
+}
+
+// write exports the metrics of result. On retries, the metrics collected
+// on the first attempt are exported again.
+func (s *otlpSink) write(ctx context.Context, result *Result) error {
+	if s.recorded != result {
+		s.record(ctx, result)
+		if err := s.reader.Collect(ctx, &s.metrics); err != nil {
+			return permanentError{fmt.Errorf("Can't collect the OTLP metrics: %s", err)}
+		}
+		s.recorded = result
+	}
+	return s.exporter.Export(ctx, &s.metrics)
+}
+
+// Close shuts the exporter down
+func (s *otlpSink) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+	s.provider.Shutdown(ctx)
+	return s.exporter.Shutdown(ctx)
+}
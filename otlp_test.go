@@ -0,0 +1,167 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nootlp
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// fakeOTLPExporter records the exported metrics, failing the first
+// failures exports
+type fakeOTLPExporter struct {
+	failures int
+	exported []metricdata.ResourceMetrics
+}
+
+func (e *fakeOTLPExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	if e.failures > 0 {
+		e.failures--
+		return fmt.Errorf("unavailable")
+	}
+	e.exported = append(e.exported, *rm)
+	return nil
+}
+
+func (e *fakeOTLPExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// otlpValues returns the gauge and counter values of rm by metric name and
+// phase attribute
+func otlpValues(rm metricdata.ResourceMetrics) map[string]float64 {
+	values := map[string]float64{}
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Gauge[float64]:
+				for _, p := range data.DataPoints {
+					phase, _ := p.Attributes.Value("phase")
+					values[strings.TrimSuffix(m.Name+"/"+phase.AsString(), "/")] = p.Value
+				}
+			case metricdata.Sum[int64]:
+				for _, p := range data.DataPoints {
+					phase, _ := p.Attributes.Value("phase")
+					values[m.Name+"/"+phase.AsString()] = float64(p.Value)
+				}
+			}
+		}
+	}
+	return values
+}
+
+func TestOTLPSink(t *testing.T) {
+	config := defaultConfig()
+	config.Metrics.Labels = labelMap{"site": "office"}
+	exporter := &fakeOTLPExporter{failures: 1}
+	sink, err := newOTLPSinkWith(config, exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	result := &Result{
+		IP:           "192.0.2.1",
+		Server:       &ResultServer{ID: "1234"},
+		Ping:         &PhaseResult{Value: 12.5},
+		Download:     &PhaseResult{Value: 93.5, Bytes: 1000},
+		Upload:       &PhaseResult{Value: 40, Bytes: 500},
+		PhaseSuccess: map[string]bool{"ping": true, "download": true, "upload": true},
+	}
+	// A failed export is retried with the same metrics
+	if err := sink.write(ctx, result); err == nil {
+		t.Fatal("Expected the first export to fail")
+	}
+	if err := sink.write(ctx, result); err != nil {
+		t.Fatal(err)
+	}
+	if len(exporter.exported) != 1 {
+		t.Fatalf("Expected 1 export, got %d", len(exporter.exported))
+	}
+	rm := exporter.exported[0]
+	if site, ok := rm.Resource.Set().Value("site"); !ok || site.AsString() != "office" {
+		t.Errorf("Expected the site resource attribute, got %v", rm.Resource)
+	}
+	expected := map[string]float64{
+		"speedtest_ping":                             12.5,
+		"speedtest_download":                         93.5,
+		"speedtest_upload":                           40,
+		"speedtest_phase_success/ping":               1,
+		"speedtest_phase_success/download":           1,
+		"speedtest_phase_success/upload":             1,
+		"speedtest_transferred_bytes_total/download": 1000,
+		"speedtest_transferred_bytes_total/upload":   500,
+	}
+	if values := otlpValues(rm); fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, values)
+	}
+	for _, p := range rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Gauge[float64]).DataPoints {
+		if p.Attributes != attribute.NewSet(attribute.String("server_id", "1234"), attribute.String("ip", "192.0.2.1")) {
+			t.Errorf("Unexpected attributes %v", p.Attributes)
+		}
+	}
+
+	// The gauges of the failed phases aren't exported again, the counters
+	// being cumulative
+	failed := &Result{IP: "192.0.2.1", Ping: &PhaseResult{Value: 15}, PhaseSuccess: map[string]bool{"ping": true, "download": false}, Error: "download failed"}
+	if err := sink.write(ctx, failed); err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]float64{
+		"speedtest_ping":                             15,
+		"speedtest_phase_success/ping":               1,
+		"speedtest_phase_success/download":           0,
+		"speedtest_transferred_bytes_total/download": 1000,
+		"speedtest_transferred_bytes_total/upload":   500,
+	}
+	if values := otlpValues(exporter.exported[1]); fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, values)
+	}
+}
+
+func TestOTLPHTTPExport(t *testing.T) {
+	var path, contentType, auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType, auth = r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer server.Close()
+
+	config := defaultConfig()
+	config.OTLP.Endpoint = strings.TrimPrefix(server.URL, "http://")
+	config.OTLP.Protocol = otlpProtocolHTTP
+	config.OTLP.Insecure = true
+	config.OTLP.Headers = headerMap{"Authorization": "Bearer secret"}
+	sink, err := newOTLPSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.(*otlpSink).Close()
+	if err := sink.write(context.Background(), &Result{Download: &PhaseResult{Value: 93.5}}); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v1/metrics" || contentType != "application/x-protobuf" || auth != "Bearer secret" {
+		t.Errorf("Unexpected export to %s, as %s with %q", path, contentType, auth)
+	}
+}
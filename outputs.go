@@ -0,0 +1,134 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// outputs are the destinations of the results of the exporter tests,
+// besides the metrics. A nil outputs discards the results.
+type outputs struct {
+	results *resultsLog
+	history *historyStore
+	sinks   []*sinkQueue
+}
+
+// openOutputs opens the outputs of the configuration for the results of
+// exporter, whose metrics count the deliveries of the sinks
+func openOutputs(config *Config, exporter *Exporter) (*outputs, error) {
+	o := &outputs{}
+	metrics := exporter.sinkMetrics
+	var err error
+	if config.Results.File != "" {
+		if o.results, err = openResultsLog(config.Results); err != nil {
+			return nil, fmt.Errorf("Can't open the results file: %s", err)
+		}
+	}
+	if config.History.DB != "" {
+		if o.history, err = openHistory(config.History); err != nil {
+			o.close(context.Background())
+			return nil, fmt.Errorf("Can't open the history database: %s", err)
+		}
+	}
+	sinks, err := openInfluxSinks(config)
+	if err != nil {
+		o.close(context.Background())
+		return nil, err
+	}
+	for name, sink := range sinks {
+		o.sinks = append(o.sinks, newSinkQueue(name, sink, config.Influx.Retries, metrics))
+	}
+	for name, sink := range newStatsDSinks(config) {
+		o.sinks = append(o.sinks, newSinkQueue(name, sink, sinkRetries, metrics))
+	}
+	if config.MQTT.Broker != "" {
+		publisher, err := newMQTTPublisher(config)
+		if err != nil {
+			o.close(context.Background())
+			return nil, fmt.Errorf("Can't set up the MQTT output: %s", err)
+		}
+		o.sinks = append(o.sinks, newSinkQueue("mqtt", publisher, sinkRetries, metrics))
+	}
+	if config.OTLP.Endpoint != "" {
+		sink, err := newOTLPSink(config)
+		if err != nil {
+			o.close(context.Background())
+			return nil, fmt.Errorf("Can't set up the OTLP output: %s", err)
+		}
+		o.sinks = append(o.sinks, newSinkQueue("otlp", sink, sinkRetries, metrics))
+	}
+	if config.RemoteWrite.URL != "" {
+		writer, err := newRemoteWriter(config, exporter)
+		if err != nil {
+			o.close(context.Background())
+			return nil, fmt.Errorf("Can't set up the remote write output: %s", err)
+		}
+		o.sinks = append(o.sinks, newSinkQueue("remote_write", writer, config.RemoteWrite.Retries, metrics))
+	}
+	if config.Webhook.URL != "" {
+		sink, err := newWebhookSink(config)
+		if err != nil {
+			o.close(context.Background())
+			return nil, fmt.Errorf("Can't set up the webhook output: %s", err)
+		}
+		// The webhook is retried once
+		q := newSinkQueue("webhook", sink, 1, metrics)
+		q.timeout = config.Webhook.Timeout
+		o.sinks = append(o.sinks, q)
+	}
+	return o, nil
+}
+
+// historyStore returns the history database, if any
+func (o *outputs) historyStore() *historyStore {
+	if o == nil {
+		return nil
+	}
+	return o.history
+}
+
+// add hands result to the outputs, without waiting for the sinks
+func (o *outputs) add(result *Result) {
+	if o == nil {
+		return
+	}
+	o.results.append(result)
+	o.history.add(result)
+	for _, sink := range o.sinks {
+		sink.push(result)
+	}
+}
+
+// close flushes and closes the outputs, the sinks being given until ctx
+// is done to deliver the queued results. Errors are logged.
+func (o *outputs) close(ctx context.Context) {
+	if o == nil {
+		return
+	}
+	if err := o.results.close(); err != nil {
+		slog.Error("Error closing the results file", "err", err)
+	}
+	if err := o.history.close(); err != nil {
+		slog.Error("Error closing the history database", "err", err)
+	}
+	for _, sink := range o.sinks {
+		if err := sink.close(ctx); err != nil {
+			slog.Error("Error closing the sink", "sink", sink.name, "err", err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+const (
+	// timeoutOffset is subtracted from the Prometheus scrape timeout so the
+	// probe answers before Prometheus gives up.
+	timeoutOffset = 500 * time.Millisecond
+
+	// maxDebugLogSize caps the log returned by debug probes
+	maxDebugLogSize = 64 * 1024
+)
+
+// probeHandler runs a Speedtest against the target given in the request
+// parameters and exposes the results of this single probe, in the same way
+// as the blackbox_exporter.
+type probeHandler struct {
+	manager *configManager
+}
+
+// probeResult exposes the results of a single probe.
+// It implements prometheus.Collector.
+type probeResult struct {
+	*Result
+	descs    *resultDescs
+	serverID string
+}
+
+func (r *probeResult) Describe(ch chan<- *prometheus.Desc) {
+	r.descs.describe(ch)
+}
+
+func (r *probeResult) Collect(ch chan<- prometheus.Metric) {
+	if r.Result != nil {
+		collectResult(ch, r.descs, r.Result, false)
+	}
+}
+
+func (h *probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	active := h.manager.current()
+	params := r.URL.Query()
+	moduleName := params.Get("module")
+	module := Module{}
+	if moduleName != "" {
+		var ok bool
+		module, ok = active.modules[moduleName]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+			return
+		}
+	}
+
+	backend := params.Get("backend")
+	if backend == "" {
+		backend = module.Backend
+	}
+	if backend == "" {
+		backend = "speedtest"
+	}
+	switch backend {
+	case "speedtest":
+	case "mini":
+		if active.Speedtest.MiniURL == "" {
+			http.Error(w, "Speedtest Mini URL is not configured", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Unknown backend %q", backend), http.StatusBadRequest)
+		return
+	}
+
+	filter := module.serverFilter()
+	if id := params.Get("server_id"); id != "" {
+		filter.IDs = []string{id}
+	}
+	if backend == "mini" && (len(filter.IDs) > 0 || len(filter.CountryCodes) > 0) {
+		http.Error(w, "Server selection is not supported by the mini backend", http.StatusBadRequest)
+		return
+	}
+
+	timeout, err := probeTimeout(r, active.Probe.Timeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if module.Timeout > 0 && module.Timeout < timeout {
+		timeout = module.Timeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	// A debug probe logs to its own buffer, returned with the metrics
+	debug := params.Get("debug") == "true"
+	var debugLog *limitedBuffer
+	var debugLogger *slog.Logger
+	if debug {
+		debugLog = &limitedBuffer{max: maxDebugLogSize}
+		debugLogger = slog.New(slog.NewTextHandler(debugLog, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		debugLogger.Info("Beginning probe", "module", moduleName, "backend", backend, "filter", filter.String(), "timeout", timeout)
+		ctx = speedtest.WithLogger(ctx, debugLogger)
+	}
+
+	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Displays whether or not the probe was a success",
+	})
+	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Returns how long the probe took to complete in seconds",
+	})
+	registry := prometheus.NewRegistry()
+	labeled := prometheus.WrapRegistererWith(prometheus.Labels(active.Metrics.Labels), registry)
+	labeled.MustRegister(probeSuccess, probeDuration)
+	if moduleName != "" {
+		moduleInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_module_info",
+			Help: "The module used by the probe",
+		}, []string{"module", "backend"})
+		moduleInfo.WithLabelValues(moduleName, backend).Set(1)
+		labeled.MustRegister(moduleInfo)
+	}
+
+	start := time.Now()
+	result, err := probe(ctx, h.manager.exporter, active, backend, filter, module)
+	probeDuration.Set(time.Since(start).Seconds())
+	if err != nil {
+		phase := "setup"
+		if pe, ok := err.(*speedtest.PhaseError); ok {
+			phase = pe.Phase
+			err = pe.Err
+		}
+		attrs := []any{"module", moduleName, "backend", backend, "phase", phase,
+			"server_id", result.serverID, "duration", time.Since(start), "type", speedtest.ErrorType(err), "err", err}
+		slog.Error("Probe failed", attrs...)
+		if debug {
+			debugLogger.Error("Probe failed", attrs...)
+		}
+	} else {
+		probeSuccess.Set(1)
+		if debug {
+			debugLogger.Info("Probe succeeded", "server_id", result.serverID, "duration", time.Since(start))
+		}
+	}
+	labeled.MustRegister(result)
+
+	if debug {
+		serveDebugProbe(w, debugLog, registry)
+		return
+	}
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// serveDebugProbe answers a debug probe with its log, followed by the
+// metrics it would have returned
+func serveDebugProbe(w http.ResponseWriter, debugLog *limitedBuffer, registry *prometheus.Registry) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Logs for the probe:\n%s\n", debugLog.String())
+	fmt.Fprintf(w, "Metrics that would have been returned:\n")
+	families, err := registry.Gather()
+	if err != nil {
+		fmt.Fprintf(w, "Error gathering the metrics: %s\n", err)
+	}
+	for _, family := range families {
+		expfmt.MetricFamilyToText(w, family)
+	}
+}
+
+// limitedBuffer keeps the first max bytes written to it, discarding the
+// rest
+type limitedBuffer struct {
+	max int
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:room])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.truncated {
+		return b.buf.String() + "... log truncated\n"
+	}
+	return b.buf.String()
+}
+
+// probe runs a test with the Speedtest client of backend, waiting for its
+// turn of the limiter of exporter. The mock backend of exporter, if any,
+// replaces backend.
+func probe(ctx context.Context, exporter *Exporter, active *activeConfig, backend string, filter speedtest.ServerFilter, module Module) (*probeResult, error) {
+	result := &probeResult{
+		descs: newResultDescs(active.Metrics),
+	}
+	if err := exporter.limiter.acquire(ctx); err != nil {
+		return result, &speedtest.PhaseError{Phase: phaseQueue, Err: err}
+	}
+	defer exporter.limiter.release()
+	start := time.Now()
+
+	var client speedtestClient
+	if exporter.mock != nil {
+		client, backend = exporter.mock.client(&active.Speedtest, active.clientOptions(), module.Streams), backendMock
+	} else {
+		var live *speedtest.Client
+		var err error
+		if backend == "mini" {
+			live, err = speedtest.NewMiniClient(active.Speedtest.MiniURL, active.clientOptions())
+		} else {
+			live, err = speedtest.NewFilteredClient(ctx, active.Speedtest.ConfigURL, active.Speedtest.ServerURL, filter, active.clientOptions())
+		}
+		if err != nil {
+			return result, err
+		}
+		active.Speedtest.configure(live, module.Streams)
+		client = liveClient{live}
+	}
+
+	server, info := client.TestServer(), client.ClientInfo()
+	result.serverID = server.ID
+	ip := exporter.ip.externalIP(ctx, info)
+	res, err := client.Run(ctx, module.Phases...)
+	if res != nil && res.ShareErr != nil {
+		slog.Warn("Can't share the Speedtest result", "server_id", server.ID, "err", res.ShareErr)
+	}
+	result.Result = newResult(start, ip, res)
+	result.Backend = backend
+	// The probes still run while the tests back off, telling when the
+	// Speedtest servers stop rate-limiting the client
+	if err == nil && backend != "mini" {
+		exporter.liftBackoff()
+	}
+	if info != nil {
+		result.ISP = info.ISP
+		result.ClientLocation = newLocation(info.Lat, info.Lon)
+	}
+	return result, err
+}
+
+// probeTimeout returns the probe timeout, derived from the scrape timeout
+// sent by Prometheus when available.
+func probeTimeout(r *http.Request, fallback time.Duration) (time.Duration, error) {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return fallback, nil
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse timeout from Prometheus header: %s", err)
+	}
+	timeout := time.Duration(seconds*float64(time.Second)) - timeoutOffset
+	if timeout <= 0 {
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	return timeout, nil
+}
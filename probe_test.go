@@ -0,0 +1,142 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newProbeHandler returns a probe handler serving the given probe only
+// configuration.
+func newProbeHandler(t *testing.T, config *Config) *probeHandler {
+	config.Probe.Only = true
+	manager, err := newConfigManager(nil, config, newExporter(context.Background(), nil, defaultConfig().Metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &probeHandler{manager: manager}
+}
+
+func serveProbe(h http.Handler, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/probe?"+query, nil))
+	return w
+}
+
+func TestProbeMiniServerSelection(t *testing.T) {
+	config := defaultConfig()
+	config.Speedtest.MiniURL = "http://127.0.0.1:1/mini/"
+	config.Probe.Modules = map[string]Module{
+		"mini_de": {Backend: "mini", CountryCodes: []string{"DE"}},
+	}
+	h := newProbeHandler(t, config)
+
+	for _, query := range []string{"backend=mini&server_id=1234", "module=mini_de"} {
+		w := serveProbe(h, query)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "not supported by the mini backend") {
+			t.Errorf("%s: unexpected response %q", query, w.Body.String())
+		}
+	}
+}
+
+func TestProbeUnknownModule(t *testing.T) {
+	h := newProbeHandler(t, defaultConfig())
+	w := serveProbe(h, "module=nope")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
+
+func TestProbeModule(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+
+	config := defaultConfig()
+	config.Speedtest.ConfigURL = fake.URL + "/config.php"
+	config.Speedtest.ServerURL = fake.URL + "/servers.php"
+	config.Probe.Modules = map[string]Module{
+		"ping_far": {Phases: []string{"ping"}, ServerIDs: []string{"99"}},
+	}
+	h := newProbeHandler(t, config)
+
+	w := serveProbe(h, "module=ping_far")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	for _, expected := range []string{
+		"probe_success 1",
+		`probe_module_info{backend="speedtest",module="ping_far"} 1`,
+		"speedtest_ping{",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in the probe response:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, "speedtest_download{") {
+		t.Errorf("Unexpected download result for a ping only module:\n%s", body)
+	}
+	if fake.requested("/near/random") || !fake.requested("/far/latency.txt") {
+		t.Error("Expected the probe to ping server 99 only")
+	}
+}
+
+func TestProbeDebug(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+
+	config := defaultConfig()
+	config.Speedtest.ConfigURL = fake.URL + "/config.php"
+	config.Speedtest.ServerURL = fake.URL + "/servers.php"
+	h := newProbeHandler(t, config)
+
+	// Concurrent probes must not share their logs
+	far, near := make(chan string), make(chan string)
+	go func() { far <- serveProbe(h, "debug=true&server_id=99").Body.String() }()
+	go func() { near <- serveProbe(h, "debug=true&server_id=1234").Body.String() }()
+	for id, body := range map[string]string{"99": <-far, "1234": <-near} {
+		for _, s := range []string{"Logs for the probe:", "Server latency", "server_id=" + id, "Speedtest download", "bytes=", "Probe succeeded", "Metrics that would have been returned:", "probe_success 1"} {
+			if !strings.Contains(body, s) {
+				t.Errorf("Expected %q in the debug output of server %s, got:\n%s", s, id, body)
+			}
+		}
+		other := "server_id=1234"
+		if id == "1234" {
+			other = "server_id=99"
+		}
+		if strings.Contains(body, other) {
+			t.Errorf("Unexpected %q in the debug output of server %s:\n%s", other, id, body)
+		}
+	}
+
+	if body := serveProbe(h, "server_id=99").Body.String(); strings.Contains(body, "Logs for the probe") {
+		t.Errorf("Expected no debug output without debug=true, got:\n%s", body)
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &limitedBuffer{max: 4}
+	b.Write([]byte("abc"))
+	b.Write([]byte("def"))
+	if s := b.String(); s != "abcd... log truncated\n" {
+		t.Errorf("Unexpected buffer content %q", s)
+	}
+}
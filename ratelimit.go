@@ -0,0 +1,116 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// minRateLimitBackoff is the base of the backoff of the tests run on
+// scrape, or scheduled more often
+const minRateLimitBackoff = time.Minute
+
+// rateLimitBackoff suspends the tests while speedtest.net rate-limits or
+// bans the client, which more tests would only prolong: after a test
+// answered 403 or 429, no test runs for twice the interval, a delay
+// doubling with each rate-limited test up to a maximum, until a test
+// succeeds.
+type rateLimitBackoff struct {
+	until *prometheus.Desc
+
+	mu sync.Mutex
+	// max bounds the delay, zero disabling the backoff
+	max time.Duration
+	// delay is the current delay, zero when not rate-limited, and next
+	// the time the tests resume
+	delay time.Duration
+	next  time.Time
+}
+
+func newRateLimitBackoff(namespace string) *rateLimitBackoff {
+	return &rateLimitBackoff{
+		until: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "backoff_until_timestamp_seconds"),
+			"Time the tests resume after the Speedtest servers rate-limited the client, 0 when not backing off.",
+			nil, nil,
+		),
+	}
+}
+
+// setMax sets the longest delay, zero disabling the backoff
+func (b *rateLimitBackoff) setMax(max time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.max = max
+	if max == 0 {
+		b.delay, b.next = 0, time.Time{}
+	}
+}
+
+// record records the outcome of a test run every interval, returning the
+// delay before the next one when err is a rate-limiting response. Other
+// errors leave the backoff unchanged, and a success ends it.
+func (b *rateLimitBackoff) record(err error, interval time.Duration) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.delay, b.next = 0, time.Time{}
+		return 0
+	}
+	if b.max == 0 || !speedtest.IsRateLimited(err) {
+		return 0
+	}
+	if b.delay == 0 {
+		b.delay = max(interval, minRateLimitBackoff)
+	}
+	b.delay = min(2*b.delay, b.max)
+	b.next = time.Now().Add(b.delay)
+	return b.delay
+}
+
+// backingOff returns the time the tests resume, zero when they are not
+// suspended
+func (b *rateLimitBackoff) backingOff() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.next) {
+		return b.next
+	}
+	return time.Time{}
+}
+
+func (b *rateLimitBackoff) Describe(ch chan<- *prometheus.Desc) {
+	ch <- b.until
+}
+
+// Collect delivers the time the tests resume, unless the backoff is
+// disabled
+func (b *rateLimitBackoff) Collect(ch chan<- prometheus.Metric) {
+	b.mu.Lock()
+	enabled, next := b.max > 0, b.next
+	b.mu.Unlock()
+	if !enabled {
+		return
+	}
+	var until float64
+	if time.Now().Before(next) {
+		until = float64(next.UnixNano()) / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(b.until, prometheus.GaugeValue, until)
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+func TestRateLimitBackoff(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.rateLimit.setMax(6 * time.Hour)
+	exporter.reinit.setConfig(1, time.Minute)
+	rebuilds := 0
+	exporter.rebuild = func() (speedtestClient, error) {
+		rebuilds++
+		return nil, errors.New("no server")
+	}
+	exporter.SetInterval(time.Hour)
+	banned := &fakeClient{err: &speedtest.PhaseError{Phase: speedtest.PhaseDownload, Err: &speedtest.HTTPError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"}}}
+	exporter.SetClient(banned)
+
+	// The backoff doubles from twice the interval, up to the maximum
+	for _, expected := range []time.Duration{2 * time.Hour, 4 * time.Hour, 6 * time.Hour, 6 * time.Hour} {
+		exporter.test(context.Background(), banned, triggerSchedule)
+		until := exporter.rateLimit.backingOff()
+		if delay := time.Until(until); delay <= expected-time.Minute || delay > expected {
+			t.Errorf("Expected a backoff of %s, got %s", expected, delay)
+		}
+		if value := testutil.ToFloat64(exporter.rateLimit); value != float64(until.UnixNano())/1e9 {
+			t.Errorf("Expected speedtest_backoff_until_timestamp_seconds %v, got %v", float64(until.UnixNano())/1e9, value)
+		}
+	}
+	if rebuilds != 0 {
+		t.Errorf("Expected no re-initialization while rate-limited, got %d", rebuilds)
+	}
+	if value := testutil.ToFloat64(exporter.errors.WithLabelValues(speedtest.PhaseDownload, "rate_limited")); value != 4 {
+		t.Errorf("Expected 4 rate_limited errors, got %v", value)
+	}
+
+	// Other errors leave the backoff unchanged
+	until := exporter.rateLimit.backingOff()
+	failing := &fakeClient{err: &speedtest.PhaseError{Phase: speedtest.PhaseDownload, Err: errors.New("connection reset")}}
+	exporter.test(context.Background(), failing, triggerSchedule)
+	if next := exporter.rateLimit.backingOff(); !next.Equal(until) {
+		t.Errorf("Expected the backoff to be unchanged by other errors, got %s instead of %s", next, until)
+	}
+
+	// The tests on scrape are suspended too
+	exporter.SetInterval(0)
+	ok := &fakeClient{measurements: map[string]speedtest.Measurement{speedtest.PhaseDownload: {Value: 93.5}}}
+	exporter.SetClient(ok)
+	gather(t, exporter)
+	if len(ok.runs) != 0 {
+		t.Errorf("Expected no test on scrape while rate-limited, got %d", len(ok.runs))
+	}
+
+	// A successful probe ends the backoff
+	exporter.liftBackoff()
+	if until := exporter.rateLimit.backingOff(); !until.IsZero() {
+		t.Errorf("Expected the backoff to be lifted, until %s", until)
+	}
+	if value := testutil.ToFloat64(exporter.rateLimit); value != 0 {
+		t.Errorf("Expected speedtest_backoff_until_timestamp_seconds 0, got %v", value)
+	}
+	gather(t, exporter)
+	if len(ok.runs) != 1 {
+		t.Errorf("Expected a test on scrape once the backoff lifted, got %d", len(ok.runs))
+	}
+
+	// A success ends the backoff, which restarts from twice the interval
+	exporter.SetInterval(time.Hour)
+	exporter.test(context.Background(), banned, triggerSchedule)
+	exporter.test(context.Background(), ok, triggerSchedule)
+	if until := exporter.rateLimit.backingOff(); !until.IsZero() {
+		t.Errorf("Expected a success to end the backoff, until %s", until)
+	}
+	if exporter.rateLimit.record(banned.err, time.Hour) != 2*time.Hour {
+		t.Errorf("Expected the backoff to restart from twice the interval")
+	}
+
+	// The backoff can be disabled
+	exporter.rateLimit.setMax(0)
+	exporter.test(context.Background(), banned, triggerSchedule)
+	if until := exporter.rateLimit.backingOff(); !until.IsZero() {
+		t.Errorf("Expected no backoff when disabled, until %s", until)
+	}
+}
+
+func TestRateLimitBackoffScrapes(t *testing.T) {
+	backoff := newRateLimitBackoff("speedtest")
+	backoff.setMax(time.Hour)
+	forbidden := &speedtest.HTTPError{StatusCode: http.StatusForbidden}
+	// The base of the tests on scrape is a minute
+	if delay := backoff.record(forbidden, 0); delay != 2*time.Minute {
+		t.Errorf("Expected a backoff of 2m, got %s", delay)
+	}
+	if delay := backoff.record(&speedtest.HTTPError{StatusCode: http.StatusServiceUnavailable}, 0); delay != 0 {
+		t.Errorf("Expected no backoff on 503, got %s", delay)
+	}
+	if delay := backoff.record(forbidden, 0); delay != 4*time.Minute {
+		t.Errorf("Expected a backoff of 4m, got %s", delay)
+	}
+}
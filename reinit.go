@@ -0,0 +1,148 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxReinitBackoff bounds the time between the re-initializations of a
+// client failing on, unless the configured backoff is longer
+const maxReinitBackoff = time.Hour
+
+// clientReinit decides when the Speedtest client is re-initialized: after
+// enough consecutive failed tests, stale state such as a dead test server
+// or a rotated configuration being the likely cause. The re-initializations
+// are spaced by a backoff doubling until a test succeeds.
+type clientReinit struct {
+	total *prometheus.CounterVec
+
+	mu sync.Mutex
+	// after is the number of consecutive failures triggering a
+	// re-initialization, zero disabling them, and backoff the initial time
+	// between re-initializations
+	after   int
+	backoff time.Duration
+	// client is the client whose consecutive failures are counted
+	client   speedtestClient
+	failures int
+	// delay is the current backoff, next the earliest time of the next
+	// re-initialization, and running whether one is running
+	delay   time.Duration
+	next    time.Time
+	running bool
+}
+
+func newClientReinit(namespace string) *clientReinit {
+	return &clientReinit{
+		total: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_reinitializations_total",
+			Help:      "Number of re-initializations of the Speedtest client after consecutive failed tests, by result: success or failure.",
+		}, []string{"result"}),
+	}
+}
+
+// setConfig sets the number of consecutive failures triggering a
+// re-initialization and the initial backoff, resetting the backoff when
+// it changed
+func (r *clientReinit) setConfig(after int, backoff time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if backoff != r.backoff {
+		r.delay, r.next = 0, time.Time{}
+	}
+	r.after, r.backoff = after, backoff
+}
+
+// record records the outcome of a test of client, and returns the number
+// of its consecutive failures when it is due for a re-initialization, in
+// which case done must be called once it is over. Zero is returned
+// otherwise.
+func (r *clientReinit) record(client speedtestClient, failed bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client != r.client {
+		r.client, r.failures = client, 0
+	}
+	if !failed {
+		r.failures, r.delay, r.next = 0, 0, time.Time{}
+		return 0
+	}
+	r.failures++
+	if r.after == 0 || r.failures < r.after || r.running || time.Now().Before(r.next) {
+		return 0
+	}
+	if r.delay == 0 {
+		r.delay = r.backoff
+	}
+	r.next = time.Now().Add(r.delay)
+	r.delay = min(2*r.delay, max(maxReinitBackoff, r.backoff))
+	r.running = true
+	return r.failures
+}
+
+// done records the end of a re-initialization, returning the time until
+// the next one may run
+func (r *clientReinit) done(ok bool) time.Duration {
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	r.total.WithLabelValues(result).Inc()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running = false
+	return time.Until(r.next)
+}
+
+func (r *clientReinit) Describe(ch chan<- *prometheus.Desc) {
+	r.total.Describe(ch)
+}
+
+func (r *clientReinit) Collect(ch chan<- prometheus.Metric) {
+	r.total.Collect(ch)
+}
+
+// reinitialize replaces client, failing on its consecutive failures, by a
+// new one of the active configuration, with a fresh configuration, server
+// list and test server. It runs within the failed test, which holds its
+// turn of the test limiter meanwhile. The client is kept if it can't be
+// created, or if a reload replaced it meanwhile.
+func (e *Exporter) reinitialize(client speedtestClient, failures int) {
+	logger := e.logger()
+	logger.Warn("Re-initializing the Speedtest client after consecutive failed tests", "failures", failures)
+	fresh, err := e.rebuild()
+	if err != nil {
+		logger.Error("Can't re-initialize the Speedtest client", "err", err, "retry_in", e.reinit.done(false).Round(time.Second))
+		return
+	}
+	e.mu.Lock()
+	replaced := e.Client != client
+	if !replaced {
+		e.Client = fresh
+	}
+	e.mu.Unlock()
+	e.reinit.done(true)
+	if replaced {
+		logger.Info("Speedtest client replaced by a reload meanwhile, discarding the re-initialized one")
+		return
+	}
+	server := fresh.TestServer()
+	logger.Info("Speedtest client re-initialized", "server_id", server.ID, "name", server.Name)
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+func TestReinitialize(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.reinit.setConfig(3, 10*time.Minute)
+	failing := &fakeClient{err: &speedtest.PhaseError{Phase: speedtest.PhaseDownload, Err: errors.New("connection reset")}}
+	fresh := &fakeClient{measurements: map[string]speedtest.Measurement{speedtest.PhaseDownload: {Value: 93.5}}}
+	var rebuildErr error
+	rebuilds := 0
+	exporter.rebuild = func() (speedtestClient, error) {
+		rebuilds++
+		return fresh, rebuildErr
+	}
+	exporter.SetClient(failing)
+	run := func(n int) {
+		for range n {
+			exporter.mu.RLock()
+			client := exporter.Client
+			exporter.mu.RUnlock()
+			exporter.test(context.Background(), client, triggerSchedule)
+		}
+	}
+
+	// The canceled tests don't count
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	exporter.test(ctx, failing, triggerScrape)
+	run(2)
+	if rebuilds != 0 {
+		t.Fatalf("Expected no re-initialization before 3 failures, got %d", rebuilds)
+	}
+
+	// A failed re-initialization keeps the client, and is retried after
+	// the backoff only
+	rebuildErr = errors.New("no server")
+	run(3)
+	if rebuilds != 1 || exporter.Client != failing {
+		t.Fatalf("Expected a failed re-initialization, got %d and %v", rebuilds, exporter.Client)
+	}
+	exporter.reinit.next = time.Time{}
+	rebuildErr = nil
+	run(1)
+	if rebuilds != 2 || exporter.Client != fresh {
+		t.Fatalf("Expected the client to be re-initialized, got %d and %v", rebuilds, exporter.Client)
+	}
+	if delay := exporter.reinit.delay; delay != 40*time.Minute {
+		t.Errorf("Expected the backoff to double twice, got %s", delay)
+	}
+	if n := testutil.ToFloat64(exporter.reinit.total.WithLabelValues("success")); n != 1 {
+		t.Errorf("Expected 1 successful re-initialization, got %g", n)
+	}
+	if n := testutil.ToFloat64(exporter.reinit.total.WithLabelValues("failure")); n != 1 {
+		t.Errorf("Expected 1 failed re-initialization, got %g", n)
+	}
+
+	// A success resets the failures and the backoff
+	run(1)
+	if exporter.reinit.failures != 0 || exporter.reinit.delay != 0 || !exporter.reinit.next.IsZero() {
+		t.Errorf("Expected the backoff to be reset, got %+v", exporter.reinit)
+	}
+}
+
+func TestReinitializeReplaced(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.reinit.setConfig(1, time.Minute)
+	failing := &fakeClient{err: &speedtest.PhaseError{Phase: speedtest.PhasePing, Err: errors.New("timeout")}}
+	reloaded := &fakeClient{}
+	exporter.rebuild = func() (speedtestClient, error) {
+		// A reload replaces the client meanwhile
+		exporter.SetClient(reloaded)
+		return &fakeClient{}, nil
+	}
+	exporter.SetClient(failing)
+	exporter.test(context.Background(), failing, triggerSchedule)
+	if exporter.Client != reloaded {
+		t.Errorf("Expected the client of the reload to be kept, got %v", exporter.Client)
+	}
+
+	// Disabled, the client is kept whatever the failures
+	exporter.reinit.setConfig(0, time.Minute)
+	for range 3 {
+		exporter.test(context.Background(), reloaded, triggerSchedule)
+	}
+	reloaded.err = failing.err
+	for range 3 {
+		exporter.test(context.Background(), reloaded, triggerSchedule)
+	}
+	if exporter.Client != reloaded {
+		t.Errorf("Expected no re-initialization when disabled, got %v", exporter.Client)
+	}
+}
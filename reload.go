@@ -0,0 +1,539 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// activeConfig is the configuration in use. It is replaced as a whole on
+// reload, never modified.
+type activeConfig struct {
+	*Config
+	auth    *speedtest.Auth
+	modules map[string]Module
+	// transport is shared by the Speedtest clients, linkTransports by those
+	// of each link
+	transport      *http.Transport
+	linkTransports []*http.Transport
+	// apiToken, if set, is required by the state-changing endpoints
+	apiToken  string
+	allowlist allowlist
+}
+
+// clientOptions returns the options of the Speedtest clients
+func (a *activeConfig) clientOptions() speedtest.Options {
+	header := http.Header{}
+	for name, value := range a.Speedtest.Headers {
+		header.Set(name, value)
+	}
+	opts := speedtest.Options{
+		Auth:      a.auth,
+		Transport: a.transport,
+		UserAgent: a.Speedtest.UserAgent,
+		Header:    header,
+		Host:      a.Speedtest.HostOverride,
+
+		FetchTimeout: a.Speedtest.FetchTimeout,
+
+		PingSamples:     a.Speedtest.PingSamples,
+		PingAggregation: a.Speedtest.PingAggregation,
+	}
+	if a.Speedtest.ClientLat.set && a.Speedtest.ClientLon.set {
+		opts.ClientLocation = &speedtest.Coordinates{Lat: a.Speedtest.ClientLat.degrees, Lon: a.Speedtest.ClientLon.degrees}
+	}
+	return opts
+}
+
+// linkOptions returns the options of the Speedtest clients of the i-th
+// link
+func (a *activeConfig) linkOptions(i int) speedtest.Options {
+	opts := a.clientOptions()
+	opts.Transport = a.linkTransports[i]
+	return opts
+}
+
+// configManager holds the active configuration and reloads it from the
+// command line arguments and the configuration file.
+type configManager struct {
+	args     []string
+	exporter *Exporter
+	// links are the Exporters of the links, if any, which run the tests
+	// instead of exporter
+	links []*Exporter
+	// backends are the Exporters of the compared backends, if any, which
+	// run the tests in turn instead of exporter
+	backends []*Exporter
+	// targets, if set, runs the tests of the targets, managed by the
+	// targets API
+	targets *targetRunner
+
+	// reloadMu serializes reloads, mu guards the active configuration
+	reloadMu sync.Mutex
+	mu       sync.RWMutex
+	active   *activeConfig
+
+	// logLevel, if set, is updated on reload
+	logLevel *promslog.Level
+
+	lastReloadSuccessful  prometheus.Gauge
+	lastReloadSuccessTime prometheus.Gauge
+	configInfo            *prometheus.Desc
+}
+
+// newConfigManager activates the initial configuration, creating the
+// Exporters of its links or backends. The Speedtest clients are then
+// created by initClient.
+func newConfigManager(args []string, config *Config, exporter *Exporter) (*configManager, error) {
+	var links []*Exporter
+	for _, link := range config.Links {
+		links = append(links, newLinkExporter(exporter, link, config.Metrics))
+	}
+	m := &configManager{
+		links:    links,
+		backends: newBackendExporters(exporter, config),
+		args:     args,
+		exporter: exporter,
+		lastReloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: config.Metrics.Namespace,
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful.",
+		}),
+		lastReloadSuccessTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: config.Metrics.Namespace,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload.",
+		}),
+		configInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Metrics.Namespace, "config", "info"),
+			"The hash of the content of the active configuration file.",
+			[]string{"hash"}, nil,
+		),
+	}
+	exporter.rebuild = func() (speedtestClient, error) {
+		m.reloadMu.Lock()
+		defer m.reloadMu.Unlock()
+		active := m.current()
+		active.transport.CloseIdleConnections()
+		return exporter.createClient(&active.Speedtest, active.clientOptions())
+	}
+	for i, link := range links {
+		link.rebuild = func() (speedtestClient, error) {
+			m.reloadMu.Lock()
+			defer m.reloadMu.Unlock()
+			active := m.current()
+			active.linkTransports[i].CloseIdleConnections()
+			settings := active.Links[i].speedtest(active.Speedtest)
+			return link.createClient(&settings, active.linkOptions(i))
+		}
+	}
+	for _, backend := range m.backends {
+		backend.rebuild = func() (speedtestClient, error) {
+			m.reloadMu.Lock()
+			defer m.reloadMu.Unlock()
+			active := m.current()
+			active.transport.CloseIdleConnections()
+			settings := backendSettings(active.Speedtest, backend.backend)
+			return backend.createClient(&settings, active.clientOptions())
+		}
+	}
+	if err := m.apply(config); err != nil {
+		return nil, err
+	}
+	m.lastReloadSuccessful.Set(1)
+	m.lastReloadSuccessTime.Set(float64(time.Now().Unix()))
+	return m, nil
+}
+
+// current returns the active configuration
+func (m *configManager) current() *activeConfig {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.active
+}
+
+// reload parses the command line arguments and the configuration file
+// again. The new configuration is activated only if it is valid, the
+// previous one being kept otherwise.
+func (m *configManager) reload() error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	slog.Info("Reloading configuration")
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	config, err := parseConfig(fs, m.args)
+	if err == nil {
+		err = m.apply(config)
+	}
+	if err != nil {
+		m.lastReloadSuccessful.Set(0)
+		return err
+	}
+	m.lastReloadSuccessful.Set(1)
+	m.lastReloadSuccessTime.Set(float64(time.Now().Unix()))
+	slog.Info("Configuration reloaded")
+	return nil
+}
+
+// apply loads everything the configuration refers to, then swaps it with
+// the active one. The exporter Speedtest client is only rebuilt when the
+// Speedtest settings or credentials changed, or when it is missing. The
+// initial client is created by initClient instead.
+func (m *configManager) apply(config *Config) error {
+	auth, err := loadAuth(config.Speedtest.Auth)
+	if err != nil {
+		return err
+	}
+
+	modules := map[string]Module{}
+	if config.Probe.ModulesFile != "" {
+		file, err := loadModules(config.Probe.ModulesFile)
+		if err != nil {
+			return err
+		}
+		modules = file.Modules
+	}
+	for name, module := range config.Probe.Modules {
+		modules[name] = module
+	}
+
+	var apiToken string
+	if config.Web.APITokenFile != "" {
+		if apiToken, err = readSecretFile(config.Web.APITokenFile); err != nil {
+			return err
+		}
+		if apiToken == "" {
+			return fmt.Errorf("API token file %s is empty", config.Web.APITokenFile)
+		}
+	}
+
+	allowed, err := newAllowlist(config.Web)
+	if err != nil {
+		return err
+	}
+
+	previous := m.current()
+	// Only the readiness, API token and allowed networks settings of the
+	// web section apply without restart
+	listener := func(web WebConfig) WebConfig {
+		web.ReadyRequiresFirstTest = false
+		web.APITokenFile = ""
+		web.AllowedCIDRs, web.AdminAllowedCIDRs, web.TrustProxy = nil, nil, false
+		return web
+	}
+	if previous != nil && !reflect.DeepEqual(listener(previous.Web), listener(config.Web)) {
+		slog.Warn("Web settings changes other than readiness, API token and allowed networks require a restart, they are ignored")
+		reloaded := config.Web
+		config.Web = previous.Web
+		config.Web.ReadyRequiresFirstTest = reloaded.ReadyRequiresFirstTest
+		config.Web.APITokenFile = reloaded.APITokenFile
+		config.Web.AllowedCIDRs, config.Web.AdminAllowedCIDRs, config.Web.TrustProxy = reloaded.AllowedCIDRs, reloaded.AdminAllowedCIDRs, reloaded.TrustProxy
+	}
+
+	if previous != nil && !reflect.DeepEqual(previous.Metrics, config.Metrics) {
+		slog.Warn("Metrics settings changes require a restart, they are ignored")
+		config.Metrics = previous.Metrics
+	}
+
+	if previous != nil && !reflect.DeepEqual(previous.Links, config.Links) {
+		slog.Warn("Links changes require a restart, they are ignored")
+		config.Links = previous.Links
+	}
+
+	if previous != nil && (previous.Backend != config.Backend || previous.Mock != config.Mock || !reflect.DeepEqual(previous.Backends, config.Backends)) {
+		slog.Warn("Backend changes require a restart, they are ignored")
+		config.Backend, config.Mock, config.Backends = previous.Backend, previous.Mock, previous.Backends
+	}
+
+	if previous != nil && previous.Log.Format != config.Log.Format {
+		slog.Warn("Log format changes require a restart, they are ignored")
+		config.Log.Format = previous.Log.Format
+	}
+
+	// The transport is kept, with its connections, unless its settings
+	// changed
+	transportSettings := func(settings SpeedtestConfig) []interface{} {
+		return []interface{}{settings.ProxyURL, settings.SourceAddress, settings.Interface, settings.Netns, settings.DNSServer, settings.TLS, settings.HTTPVersion, settings.DialTimeout, settings.HostOverride}
+	}
+	var transport *http.Transport
+	if previous != nil && reflect.DeepEqual(transportSettings(previous.Speedtest), transportSettings(config.Speedtest)) {
+		transport = previous.transport
+	} else if transport, err = newSpeedtestTransport(&config.Speedtest); err != nil {
+		return err
+	}
+	var linkTransports []*http.Transport
+	for i, link := range config.Links {
+		settings := link.speedtest(config.Speedtest)
+		if previous != nil && reflect.DeepEqual(transportSettings(previous.Links[i].speedtest(previous.Speedtest)), transportSettings(settings)) {
+			linkTransports = append(linkTransports, previous.linkTransports[i])
+			continue
+		}
+		linkTransport, err := newSpeedtestTransport(&settings)
+		if err != nil {
+			return fmt.Errorf("Link %s: %s", link.Name, err)
+		}
+		linkTransports = append(linkTransports, linkTransport)
+	}
+	active := &activeConfig{
+		Config:         config,
+		auth:           auth,
+		modules:        modules,
+		transport:      transport,
+		linkTransports: linkTransports,
+		apiToken:       apiToken,
+		allowlist:      allowed,
+	}
+
+	// The IP lookup, the expectations and the busy check don't depend on
+	// the Speedtest client
+	clientSettings := func(settings SpeedtestConfig) SpeedtestConfig {
+		settings.IP = IPConfig{}
+		settings.Expect = ExpectConfig{}
+		settings.Mode, settings.Soak = "", SoakConfig{}
+		settings.Busy = BusyConfig{}
+		return settings
+	}
+	changed := previous != nil && (previous.Probe.Only != config.Probe.Only ||
+		!reflect.DeepEqual(clientSettings(previous.Speedtest), clientSettings(config.Speedtest)) ||
+		!reflect.DeepEqual(previous.auth, auth))
+	initialized, _ := m.exporter.Status()
+	rebuild := previous != nil && (!initialized || changed)
+	var client speedtestClient
+	if rebuild && !config.Probe.Only && len(config.Links) == 0 && len(config.Backends) == 0 {
+		if client, err = m.exporter.createClient(&config.Speedtest, active.clientOptions()); err != nil {
+			return err
+		}
+	}
+	linkClients := make([]speedtestClient, len(m.links))
+	linkRebuilds := make([]bool, len(m.links))
+	for i, link := range m.links {
+		initialized, _ := link.Status()
+		if linkRebuilds[i] = previous != nil && (!initialized || changed); !linkRebuilds[i] {
+			continue
+		}
+		settings := config.Links[i].speedtest(config.Speedtest)
+		if linkClients[i], err = link.createClient(&settings, active.linkOptions(i)); err != nil {
+			return fmt.Errorf("Link %s: %s", config.Links[i].Name, err)
+		}
+	}
+	backendClients := make([]speedtestClient, len(m.backends))
+	backendRebuilds := make([]bool, len(m.backends))
+	for i, backend := range m.backends {
+		initialized, _ := backend.Status()
+		if backendRebuilds[i] = previous != nil && (!initialized || changed); !backendRebuilds[i] {
+			continue
+		}
+		settings := backendSettings(config.Speedtest, backend.backend)
+		if backendClients[i], err = backend.createClient(&settings, active.clientOptions()); err != nil {
+			return fmt.Errorf("Backend %s: %s", backend.backend, err)
+		}
+	}
+
+	m.mu.Lock()
+	m.active = active
+	if rebuild {
+		m.exporter.SetClient(client)
+	}
+	m.exporter.SetInterval(config.Schedule.testInterval())
+	m.exporter.SetPingInterval(config.Schedule.PingInterval)
+	m.exporter.SetMode(config.Speedtest.Mode, config.Speedtest.Soak)
+	m.exporter.SetRetest(config.Schedule.RetestAnomalies)
+	m.exporter.SetLogDedup(config.Log.DedupWindow)
+	m.exporter.SetOutput(config.Output)
+	// The subscribed rates are those of every link or backend otherwise
+	if len(m.children()) == 0 {
+		m.exporter.SetLine(config.Line)
+	}
+	m.exporter.expectations.setConfig(config.Speedtest.Expect)
+	m.exporter.dns.setConfig(config.DNS, ipDial{})
+	m.exporter.limiter.setConfig(config.Schedule.MaxConcurrentTests, config.Schedule.MaxQueueWait)
+	m.exporter.reinit.setConfig(config.Schedule.ReinitAfterFailures, config.Schedule.ReinitBackoff)
+	m.exporter.rateLimit.setMax(config.Schedule.RateLimitMaxBackoff)
+	m.exporter.busy.setConfig(config.Speedtest.Busy)
+	ipDialer := ipDial{dnsServer: dnsServerAddress(config.Speedtest.DNSServer)}
+	if config.Speedtest.IP.Netns {
+		ipDialer.netns = config.Speedtest.Netns
+	}
+	m.exporter.ip.setDial(ipDialer)
+	m.exporter.ip.setConfig(config.Speedtest.IP, config.Metrics.NoIPLabel)
+	m.exporter.ip.geo.setDatabase(config.GeoIP.Database)
+	m.exporter.ip.asn.setConfig(config.GeoIP.ASNDatabase, config.GeoIP.ASNDNS)
+	for i, link := range m.links {
+		settings := config.Links[i]
+		if linkRebuilds[i] {
+			link.SetClient(linkClients[i])
+		}
+		interval := config.Schedule.testInterval()
+		if settings.Interval > 0 {
+			interval = settings.Interval
+		}
+		link.SetInterval(interval)
+		link.SetPingInterval(config.Schedule.PingInterval)
+		link.SetMode(config.Speedtest.Mode, config.Speedtest.Soak)
+		link.SetRetest(config.Schedule.RetestAnomalies)
+		link.SetLogDedup(config.Log.DedupWindow)
+		link.reinit.setConfig(config.Schedule.ReinitAfterFailures, config.Schedule.ReinitBackoff)
+		link.rateLimit.setMax(config.Schedule.RateLimitMaxBackoff)
+		link.busy.setConfig(config.Speedtest.Busy)
+		link.SetDailyCap(int64(settings.DailyCap))
+		link.SetOutput(config.Output)
+		link.SetLine(config.Line)
+		link.expectations.setConfig(config.Speedtest.Expect)
+		link.dns.setConfig(config.DNS, ipDial{sourceAddress: settings.SourceAddress, iface: settings.Interface, netns: settings.Netns})
+		linkDialer := ipDial{dnsServer: dnsServerAddress(config.Speedtest.DNSServer), sourceAddress: settings.SourceAddress, iface: settings.Interface}
+		if config.Speedtest.IP.Netns {
+			linkDialer.netns = settings.Netns
+		}
+		link.ip.setDial(linkDialer)
+		link.ip.setConfig(config.Speedtest.IP, config.Metrics.NoIPLabel)
+		link.ip.geo.setDatabase(config.GeoIP.Database)
+		link.ip.asn.setConfig(config.GeoIP.ASNDatabase, config.GeoIP.ASNDNS)
+	}
+	for i, backend := range m.backends {
+		if backendRebuilds[i] {
+			backend.SetClient(backendClients[i])
+		}
+		backend.SetInterval(config.Schedule.testInterval())
+		backend.SetPingInterval(config.Schedule.PingInterval)
+		backend.SetRetest(config.Schedule.RetestAnomalies)
+		backend.SetLogDedup(config.Log.DedupWindow)
+		backend.reinit.setConfig(config.Schedule.ReinitAfterFailures, config.Schedule.ReinitBackoff)
+		backend.rateLimit.setMax(config.Schedule.RateLimitMaxBackoff)
+		backend.busy.setConfig(config.Speedtest.Busy)
+		backend.SetOutput(config.Output)
+		backend.SetLine(config.Line)
+		backend.expectations.setConfig(config.Speedtest.Expect)
+		backend.dns.setConfig(config.DNS, ipDial{})
+		backend.ip.setDial(ipDialer)
+		backend.ip.setConfig(config.Speedtest.IP, config.Metrics.NoIPLabel)
+		backend.ip.geo.setDatabase(config.GeoIP.Database)
+		backend.ip.asn.setConfig(config.GeoIP.ASNDatabase, config.GeoIP.ASNDNS)
+	}
+	m.mu.Unlock()
+	if m.logLevel != nil {
+		m.logLevel.Set(config.Log.Level)
+	}
+	return nil
+}
+
+// initClient creates the Speedtest clients of the configuration activated
+// at startup, that of the exporter or those of the links or backends,
+// unless a reload did already. On failure, the exporter stays not ready until a reload
+// succeeds.
+func (m *configManager) initClient() {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	active := m.current()
+	for i, link := range m.links {
+		if initialized, _ := link.Status(); initialized {
+			continue
+		}
+		settings := active.Links[i].speedtest(active.Speedtest)
+		client, err := link.createClient(&settings, active.linkOptions(i))
+		if err != nil {
+			link.logger().Error("Can't create the Speedtest client", "err", err)
+			continue
+		}
+		link.SetClient(client)
+	}
+	for _, backend := range m.backends {
+		if initialized, _ := backend.Status(); initialized {
+			continue
+		}
+		settings := backendSettings(active.Speedtest, backend.backend)
+		client, err := backend.createClient(&settings, active.clientOptions())
+		if err != nil {
+			backend.logger().Error("Can't create the Speedtest client", "err", err)
+			continue
+		}
+		backend.SetClient(client)
+	}
+	if initialized, _ := m.exporter.Status(); initialized || active.Probe.Only || len(m.children()) > 0 {
+		return
+	}
+	client, err := m.exporter.createClient(&active.Speedtest, active.clientOptions())
+	if err != nil {
+		slog.Error("Can't create the Speedtest client", "err", err)
+		return
+	}
+	m.exporter.SetClient(client)
+}
+
+// testers returns the Exporters running the tests: those of the links or
+// backends if any, the exporter otherwise
+func (m *configManager) testers() []*Exporter {
+	if children := m.children(); len(children) > 0 {
+		return children
+	}
+	return []*Exporter{m.exporter}
+}
+
+// children returns the Exporters of the links or of the compared
+// backends, which run the tests instead of the exporter, if any
+func (m *configManager) children() []*Exporter {
+	if len(m.backends) > 0 {
+		return m.backends
+	}
+	return m.links
+}
+
+// reloadHandler reloads the configuration on POST requests, for
+// deployments where sending SIGHUP is not practical.
+type reloadHandler struct {
+	manager *configManager
+}
+
+func (h *reloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "This endpoint requires a POST request.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.manager.reload(); err != nil {
+		slog.Error("Error reloading configuration", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *configManager) Describe(ch chan<- *prometheus.Desc) {
+	m.lastReloadSuccessful.Describe(ch)
+	m.lastReloadSuccessTime.Describe(ch)
+	ch <- m.configInfo
+}
+
+// Collect implements prometheus.Collector.
+func (m *configManager) Collect(ch chan<- prometheus.Metric) {
+	m.lastReloadSuccessful.Collect(ch)
+	m.lastReloadSuccessTime.Collect(ch)
+	if hash := m.current().hash; hash != "" {
+		ch <- prometheus.MustNewConstMetric(m.configInfo, prometheus.GaugeValue, 1, hash)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSpeedtest is a Speedtest server listing two test servers: 1234 under
+// /near/ and 99 under /far/. It records the paths of the requests it gets.
+type fakeSpeedtest struct {
+	*httptest.Server
+
+	// When not nil, uploads block until canceled by the client, and
+	// uploadStarted is closed when the first one starts.
+	uploadStarted chan struct{}
+	startOnce     sync.Once
+
+	mu    sync.Mutex
+	paths []string
+}
+
+func newFakeSpeedtest() *fakeSpeedtest {
+	fake := &fakeSpeedtest{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	return fake
+}
+
+func (fake *fakeSpeedtest) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	fake.paths = append(fake.paths, r.URL.Path)
+	fake.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/config.php":
+		fmt.Fprint(w, `<settings><client ip="203.0.113.7" lat="52.5" lon="13.4" isp="Example ISP"/></settings>`)
+	case r.URL.Path == "/servers.php":
+		fmt.Fprintf(w, `<settings><servers>`+
+			`<server url="%[1]s/near/upload.php" lat="52.5" lon="13.4" name="Near" country="Germany" cc="DE" sponsor="Fake" id="1234"/>`+
+			`<server url="%[1]s/far/upload.php" lat="40" lon="-70" name="Far" country="United States" cc="US" sponsor="Fake" id="99"/>`+
+			`</servers></settings>`, fake.URL)
+	case strings.HasSuffix(r.URL.Path, "/latency.txt"):
+		fmt.Fprint(w, "test=test\n")
+	case strings.HasSuffix(r.URL.Path, ".jpg"):
+		w.Write(make([]byte, 1024))
+	case strings.HasSuffix(r.URL.Path, "/upload.php"):
+		// The body is drained first, so the server notices when the
+		// client hangs up and cancels the request context.
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		if fake.uploadStarted != nil {
+			fake.startOnce.Do(func() { close(fake.uploadStarted) })
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprintf(w, "size=%d", n)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// requested returns whether a request was received for a path with the
+// given prefix since the last reset.
+func (fake *fakeSpeedtest) requested(prefix string) bool {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, path := range fake.paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// reset forgets the requests received so far
+func (fake *fakeSpeedtest) reset() {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.paths = nil
+}
+
+func postReload(manager *configManager, method string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	(&reloadHandler{manager: manager}).ServeHTTP(w, httptest.NewRequest(method, "/-/reload", nil))
+	return w
+}
+
+func TestReloadEndpoint(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	configFile := func(serverID string, timeout string) string {
+		return writeConfigFile(t, dir, fmt.Sprintf(`
+speedtest:
+  config_url: %s/config.php
+  server_url: %s/servers.php
+  server:
+    ids: ["%s"]
+probe:
+  timeout: %s
+`, fake.URL, fake.URL, serverID, timeout))
+	}
+	args := []string{"--config.file", configFile("1234", "1m")}
+
+	config, err := parseTestConfig(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	manager, err := newConfigManager(args, config, exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.initClient()
+	if _, err := exporter.Client.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.requested("/near/random") {
+		t.Fatal("Expected the test to run against server 1234")
+	}
+	fake.reset()
+
+	if w := postReload(manager, "GET"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for GET, got %d", w.Code)
+	}
+
+	configFile("99", "1m")
+	if w := postReload(manager, "POST"); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := exporter.Client.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.requested("/far/random") {
+		t.Fatal("Expected the test to run against server 99 after reload")
+	}
+	// The re-initializations create the client of the active configuration
+	if client, err := exporter.rebuild(); err != nil || client.TestServer().ID != "99" {
+		t.Errorf("Expected a client of server 99 to be rebuilt, got %v", err)
+	}
+
+	configFile("1234", "-1m")
+	w := postReload(manager, "POST")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "probe.timeout: must be positive") {
+		t.Errorf("Expected the validation error in the response, got %q", w.Body.String())
+	}
+	if got := manager.current().Speedtest.Server.IDs; len(got) != 1 || got[0] != "99" {
+		t.Errorf("Expected the previous configuration to be kept, got server IDs %v", got)
+	}
+}
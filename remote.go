@@ -0,0 +1,79 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// remoteConfigTimeout bounds the retrieval of the configuration from its URL
+const remoteConfigTimeout = 30 * time.Second
+
+// remoteConfigCache holds the last configuration fetched from a URL, so it
+// is only downloaded again when it changed
+var remoteConfigCache = struct {
+	sync.Mutex
+	url          string
+	etag         string
+	lastModified string
+	body         []byte
+}{}
+
+// fetchConfig returns the configuration file served at url. The request is
+// conditional when the file was fetched before, the cached copy being
+// returned when unchanged.
+func fetchConfig(url string) ([]byte, error) {
+	cache := &remoteConfigCache
+	cache.Lock()
+	defer cache.Unlock()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cache.url == url {
+		if cache.etag != "" {
+			req.Header.Set("If-None-Match", cache.etag)
+		}
+		if cache.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cache.lastModified)
+		}
+	}
+	client := &http.Client{Timeout: remoteConfigTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Can't fetch the configuration: %s", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cache.url == url:
+		return cache.body, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("Can't fetch the configuration from %s: %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Can't fetch the configuration: %s", err)
+	}
+	cache.url = url
+	cache.etag = resp.Header.Get("ETag")
+	cache.lastModified = resp.Header.Get("Last-Modified")
+	cache.body = body
+	return body, nil
+}
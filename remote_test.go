@@ -0,0 +1,99 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemoteConfig(t *testing.T) {
+	var mu sync.Mutex
+	content, etag, downloads := "schedule:\n  interval: 1h\n", `"v1"`, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+	update := func(c, e string) {
+		mu.Lock()
+		defer mu.Unlock()
+		content, etag = c, e
+	}
+
+	args := []string{"--config.url", server.URL + "/speedtest.yml", "--probe.only"}
+	config, err := parseTestConfig(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Schedule.Interval != time.Hour {
+		t.Errorf("Expected the interval of the remote configuration, got %s", config.Schedule.Interval)
+	}
+	manager, err := newConfigManager(args, config, newExporter(context.Background(), nil, defaultConfig().Metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := config.hash
+	if metrics := gather(t, manager); !strings.Contains(metrics, `speedtest_config_info{hash="`+hash+`"} 1`) {
+		t.Errorf("Expected the configuration hash, got:\n%s", metrics)
+	}
+
+	// An unchanged configuration isn't downloaded again
+	if err := manager.reload(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if downloads != 1 {
+		t.Errorf("Expected a single download, got %d", downloads)
+	}
+	mu.Unlock()
+
+	// An invalid configuration keeps the last good one
+	update("schedule:\n  interval: -1h\n", `"v2"`)
+	if err := manager.reload(); err == nil || !strings.Contains(err.Error(), server.URL) {
+		t.Errorf("Expected a validation error naming the URL, got %v", err)
+	}
+	if active := manager.current(); active.Schedule.Interval != time.Hour || active.hash != hash {
+		t.Errorf("Expected the last good configuration to be kept, got %s", active.Schedule.Interval)
+	}
+
+	update("schedule:\n  interval: 2h\n", `"v3"`)
+	if err := manager.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if active := manager.current(); active.Schedule.Interval != 2*time.Hour || active.hash == hash {
+		t.Errorf("Expected the new configuration, got %s", active.Schedule.Interval)
+	}
+
+	server.Close()
+	if err := manager.reload(); err == nil {
+		t.Error("Expected an error when the configuration can't be fetched")
+	}
+	if _, err := parseTestConfig("--config.url", server.URL, "--config.file", "speedtest.yml"); err == nil {
+		t.Error("Expected -config.file and -config.url to be mutually exclusive")
+	}
+}
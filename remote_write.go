@@ -0,0 +1,272 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/nlamirault/speedtest_exporter/version"
+)
+
+// remoteWriteJob is the job label of the pushed samples, which a scrape
+// would have attached
+const remoteWriteJob = "speedtest_exporter"
+
+// pushCollector collects the metrics of the exporter for result, as a
+// scrape right after its test would
+type pushCollector struct {
+	*Exporter
+	result *Result
+}
+
+func (c pushCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	line := c.line
+	c.mu.RUnlock()
+	collectResult(ch, c.descs, c.result, false)
+	collectLine(ch, c.descs, line, c.result, false)
+	c.collectCounters(ch)
+}
+
+// remoteWriter pushes the metrics of each result with the Prometheus
+// remote write protocol, timestamped with the end of the test
+type remoteWriter struct {
+	exporter *Exporter
+	config   *Config
+	client   *http.Client
+	url      string
+	// instance is the instance label of the samples
+	instance string
+	// username and password are the basic auth credentials, token the
+	// bearer token
+	username string
+	password string
+	token    string
+	headers  headerMap
+}
+
+func newRemoteWriter(config *Config, exporter *Exporter) (*remoteWriter, error) {
+	tlsConfig, err := newTLSConfig(&config.RemoteWrite.TLS)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	w := &remoteWriter{
+		exporter: exporter,
+		config:   config,
+		client:   &http.Client{Transport: transport},
+		url:      config.RemoteWrite.URL,
+		username: config.RemoteWrite.Username,
+		headers:  config.RemoteWrite.Headers,
+	}
+	if w.instance, err = os.Hostname(); err != nil {
+		return nil, fmt.Errorf("Can't get the hostname: %s", err)
+	}
+	if config.RemoteWrite.PasswordFile != "" {
+		if w.password, err = readSecretFile(config.RemoteWrite.PasswordFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.RemoteWrite.BearerTokenFile != "" {
+		if w.token, err = readSecretFile(config.RemoteWrite.BearerTokenFile); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *remoteWriter) write(ctx context.Context, result *Result) error {
+	families, err := newRegistry(w.config, pushCollector{w.exporter, result}).Gather()
+	if err != nil {
+		return permanentError{fmt.Errorf("Can't gather the metrics: %s", err)}
+	}
+	target := map[string]string{"job": remoteWriteJob, "instance": w.instance, "link": result.Link}
+	for name, value := range result.Labels {
+		target[name] = value
+	}
+	series := remoteSeriesOf(families, target, result.FinishedAt)
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(snappy.Encode(nil, encodeWriteRequest(series))))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "speedtest_exporter/"+version.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for name, value := range w.headers {
+		req.Header.Set(name, value)
+	}
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	} else if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("The remote write endpoint answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return retryAfterError{err, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	case resp.StatusCode/100 == 5:
+		return err
+	}
+	// The samples are rejected, such as out of order ones, and would be
+	// again
+	return permanentError{err}
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, in seconds
+// or as a date, 0 when missing or invalid
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// remoteLabel and remoteSeries are the labels and time series of the
+// remote write protocol
+type remoteLabel struct {
+	name, value string
+}
+
+type remoteSeries struct {
+	labels    []remoteLabel
+	value     float64
+	timestamp int64
+}
+
+// remoteSeriesOf returns the time series of the samples of families, with
+// the target labels added unless already present. The histograms and
+// summaries are split in their series, as on the text exposition format.
+func remoteSeriesOf(families []*dto.MetricFamily, target map[string]string, timestamp time.Time) []remoteSeries {
+	var series []remoteSeries
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for name, value := range target {
+				labels[name] = value
+			}
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			add := func(suffix string, value float64, extra ...string) {
+				s := remoteSeries{value: value, timestamp: timestamp.UnixMilli()}
+				s.labels = append(s.labels, remoteLabel{"__name__", family.GetName() + suffix})
+				for name, value := range labels {
+					if value != "" {
+						s.labels = append(s.labels, remoteLabel{name, value})
+					}
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					s.labels = append(s.labels, remoteLabel{extra[i], extra[i+1]})
+				}
+				sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+				series = append(series, s)
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					add("", q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add("_sum", summary.GetSampleSum())
+				add("_count", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, b := range histogram.GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add("_bucket", float64(histogram.GetSampleCount()), "le", "+Inf")
+				add("_sum", histogram.GetSampleSum())
+				add("_count", float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// formatFloat formats the values of the quantile and le labels
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes series as the protobuf WriteRequest of the
+// remote write protocol:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []remoteSeries) []byte {
+	var request []byte
+	for _, s := range series {
+		var ts []byte
+		for _, label := range s.labels {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label.name)
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, ts)
+	}
+	return request
+}
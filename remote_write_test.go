@@ -0,0 +1,183 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeWriteRequest decodes the samples of a remote write request, by
+// the labels of their series
+func decodeWriteRequest(t *testing.T, body []byte) map[string]remoteSeries {
+	t.Helper()
+	fields := func(b []byte, each func(num protowire.Number, typ protowire.Type, b []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+			n = each(num, typ, b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	series := map[string]remoteSeries{}
+	fields(body, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		ts, n := protowire.ConsumeBytes(b)
+		var s remoteSeries
+		key := ""
+		fields(ts, func(num protowire.Number, typ protowire.Type, b []byte) int {
+			msg, n := protowire.ConsumeBytes(b)
+			var label remoteLabel
+			fields(msg, func(field protowire.Number, typ protowire.Type, b []byte) int {
+				switch {
+				case num == 1 && field == 1:
+					v, n := protowire.ConsumeString(b)
+					label.name = v
+					return n
+				case num == 1 && field == 2:
+					v, n := protowire.ConsumeString(b)
+					label.value = v
+					return n
+				case num == 2 && field == 1:
+					v, n := protowire.ConsumeFixed64(b)
+					s.value = math.Float64frombits(v)
+					return n
+				case num == 2 && field == 2:
+					v, n := protowire.ConsumeVarint(b)
+					s.timestamp = int64(v)
+					return n
+				}
+				return protowire.ConsumeFieldValue(field, typ, b)
+			})
+			if num == 1 {
+				s.labels = append(s.labels, label)
+				key += label.name + "=" + label.value + ","
+			}
+			return n
+		})
+		series[key] = s
+		return n
+	})
+	return series
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	series := []remoteSeries{
+		{labels: []remoteLabel{{"__name__", "speedtest_download"}, {"job", "speedtest_exporter"}}, value: 93.5, timestamp: 1700000000000},
+		{labels: []remoteLabel{{"__name__", "speedtest_up"}}, value: 1, timestamp: 1700000000000},
+	}
+	decoded := decodeWriteRequest(t, encodeWriteRequest(series))
+	if s := decoded["__name__=speedtest_download,job=speedtest_exporter,"]; s.value != 93.5 || s.timestamp != 1700000000000 {
+		t.Errorf("Unexpected series %+v in %+v", s, decoded)
+	}
+	if len(decoded) != 2 {
+		t.Errorf("Expected 2 series, got %+v", decoded)
+	}
+}
+
+func TestRemoteWriter(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	os.WriteFile(passwordFile, []byte("secret\n"), 0600)
+
+	var headers http.Header
+	var series map[string]remoteSeries
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+		}
+		series = decodeWriteRequest(t, body)
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	config := defaultConfig()
+	config.Web.DisableExporterMetrics = true
+	config.Metrics.Labels = labelMap{"site": "home"}
+	config.RemoteWrite.URL = server.URL
+	config.RemoteWrite.Username = "speedtest"
+	config.RemoteWrite.PasswordFile = passwordFile
+	config.RemoteWrite.Headers = headerMap{"X-Scope-OrgID": "home"}
+	exporter := newExporter(context.Background(), nil, config.Metrics)
+	writer, err := newRemoteWriter(config, exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.instance = "host"
+	if err := writer.write(context.Background(), influxTestResult); err != nil {
+		t.Fatal(err)
+	}
+	if headers.Get("Content-Encoding") != "snappy" || headers.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" || headers.Get("X-Scope-OrgID") != "home" {
+		t.Errorf("Unexpected headers %v", headers)
+	}
+	if username, password, _ := (&http.Request{Header: headers}).BasicAuth(); username != "speedtest" || password != "secret" {
+		t.Errorf("Unexpected credentials %s:%s", username, password)
+	}
+	download, ok := series["__name__=speedtest_download,instance=host,ip=192.0.2.1,job=speedtest_exporter,site=home,"]
+	if !ok || download.value != 93.5 || download.timestamp != influxTestResult.FinishedAt.UnixMilli() {
+		t.Errorf("Unexpected download series %+v in %+v", download, series)
+	}
+
+	status = http.StatusTooManyRequests
+	var retryAfter retryAfterError
+	if err := writer.write(context.Background(), influxTestResult); !errors.As(err, &retryAfter) || retryAfter.after != 30*time.Second {
+		t.Errorf("Expected a retry after 30s, got %v", err)
+	}
+	status = http.StatusServiceUnavailable
+	var permanent permanentError
+	if err := writer.write(context.Background(), influxTestResult); err == nil || errors.As(err, &permanent) {
+		t.Errorf("Expected a temporary error, got %v", err)
+	}
+	status = http.StatusBadRequest
+	if err := writer.write(context.Background(), influxTestResult); !errors.As(err, &permanent) {
+		t.Errorf("Expected a permanent error, got %v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for header, expected := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Mon, 01 Jan 2024 12:00:30 GMT": 30 * time.Second,
+		"Mon, 01 Jan 2024 11:00:00 GMT": 0,
+		"":                              0,
+		"soon":                          0,
+	} {
+		if delay := parseRetryAfter(header, now); delay != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, header, delay)
+		}
+	}
+}
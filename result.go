@@ -0,0 +1,518 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// Result is the result of a test. It is the source of the exported metrics,
+// and is served as JSON on /result and saved to the state file. A Result is
+// complete once published as the last result of an Exporter, and never
+// modified afterwards, so the metrics of a scrape all come from the same
+// test, but for the latency of a split schedule.
+type Result struct {
+	// RunID identifies the test among the others
+	RunID      string    `json:"run_id,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// LatencyRunID and LatencyFinishedAt identify the latency test of a
+	// split schedule the latency comes from, when more recent than the
+	// test
+	LatencyRunID      string    `json:"latency_run_id,omitempty"`
+	LatencyFinishedAt time.Time `json:"latency_finished_at,omitzero"`
+	IP                string    `json:"ip"`
+	// Link is the name of the link the test ran over, empty for the
+	// default route
+	Link string `json:"link,omitempty"`
+	// Labels are the labels of the link, if any
+	Labels map[string]string `json:"labels,omitempty"`
+	// ISP is the provider of the client, from the Speedtest configuration
+	ISP string `json:"isp,omitempty"`
+	// ClientLocation is the position of the client, from the Speedtest
+	// configuration, if known
+	ClientLocation *Location `json:"client_location,omitempty"`
+	// Backend is the kind of test server, speedtest or mini
+	Backend string `json:"backend,omitempty"`
+	// Trigger is what ran the test: scrape, schedule, startup, retest,
+	// ping or once
+	Trigger string        `json:"trigger,omitempty"`
+	Server  *ResultServer `json:"server,omitempty"`
+	// Hops is the number of hops to the server, when counted
+	Hops int `json:"hops,omitempty"`
+	// Duplex tells whether the download and upload ran at once
+	Duplex bool `json:"duplex,omitempty"`
+	// ShareURL is the URL of the result image on speedtest.net, when
+	// shared
+	ShareURL string `json:"share_url,omitempty"`
+	// Parameters are the settings of the transfer phases in force, when
+	// reported by the client
+	Parameters *TestParameters `json:"parameters,omitempty"`
+	// Connection describes the test connections, from the first one of
+	// the download phase, or else of the upload phase
+	Connection *ConnectionResult `json:"connection,omitempty"`
+	// Anomalous tells whether a value deviates from the recent tests by
+	// more than the anomaly threshold
+	Anomalous bool `json:"anomalous,omitempty"`
+	// Phases of failed or skipped tests are absent
+	Download *PhaseResult `json:"download,omitempty"`
+	Upload   *PhaseResult `json:"upload,omitempty"`
+	Ping     *PhaseResult `json:"ping,omitempty"`
+	// PhaseSuccess tells whether each phase run succeeded, by phase
+	PhaseSuccess map[string]bool `json:"phase_success,omitempty"`
+	Error        string          `json:"error,omitempty"`
+}
+
+// TestParameters are the settings of the transfer phases of a test, set
+// in the configuration or recommended by the Speedtest configuration
+type TestParameters struct {
+	DownloadStreams         int     `json:"download_streams"`
+	UploadStreams           int     `json:"upload_streams"`
+	DownloadDurationSeconds float64 `json:"download_duration_seconds"`
+	UploadDurationSeconds   float64 `json:"upload_duration_seconds"`
+	// UploadPayloads is the number of upload payloads requested in turn,
+	// and UploadMaxPayloadBytes the size of the largest
+	UploadPayloads        int `json:"upload_payloads"`
+	UploadMaxPayloadBytes int `json:"upload_max_payload_bytes"`
+	// UploadPayload is the content of the upload payloads, random or zero
+	UploadPayload string `json:"upload_payload,omitempty"`
+}
+
+// ConnectionResult describes a test connection
+type ConnectionResult struct {
+	HTTPVersion string `json:"http_version"`
+	TLSVersion  string `json:"tls_version"`
+	Family      string `json:"remote_addr_family"`
+}
+
+// ResultServer describes the server a test ran against
+type ResultServer struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Sponsor  string  `json:"sponsor"`
+	Country  string  `json:"country"`
+	CC       string  `json:"cc"`
+	URL      string  `json:"url"`
+	Distance float64 `json:"distance_km"`
+	// Location is the position of the server, if known
+	Location *Location `json:"location,omitempty"`
+}
+
+// Location is a position in decimal degrees
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// newLocation returns the location at lat and lon, nil when unknown. The
+// Speedtest configuration and server list leave the coordinates they don't
+// know empty, parsed as 0.
+func newLocation(lat, lon float64) *Location {
+	if lat == 0 && lon == 0 {
+		return nil
+	}
+	return &Location{Lat: lat, Lon: lon}
+}
+
+// PhaseResult is the result of a test phase
+type PhaseResult struct {
+	Value           float64 `json:"value"`
+	Unit            string  `json:"unit"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Bytes           int64   `json:"bytes"`
+	// Streams is the number of connections that transferred data, for the
+	// download and upload phases
+	Streams int `json:"streams,omitempty"`
+	// PerStream are the outcomes of each stream of the download and upload
+	// phases
+	PerStream []StreamResult `json:"per_stream,omitempty"`
+	// RateLimit is the rate limit of the download and upload phases, if
+	// any, and RateLimited tells whether it constrained their bandwidth
+	RateLimit   float64 `json:"rate_limit,omitempty"`
+	RateLimited bool    `json:"rate_limited,omitempty"`
+	// Samples are the round trip times of the ping phase, StdDev their
+	// standard deviation and Jitter their mean variation
+	Samples []float64 `json:"samples,omitempty"`
+	StdDev  float64   `json:"stddev,omitempty"`
+	Jitter  float64   `json:"jitter,omitempty"`
+	// Interface is the traffic of the verified interface during the
+	// download and upload phases, if verified
+	Interface *InterfaceTraffic `json:"interface,omitempty"`
+	// CPU is the CPU usage during the download and upload phases, if
+	// sampled
+	CPU *CPUResult `json:"cpu,omitempty"`
+	// Cache tells whether the download phase seemed served by a
+	// transparent cache, if checked
+	Cache *CacheResult `json:"cache,omitempty"`
+}
+
+// StreamResult is the outcome of a stream of a transfer phase, whose
+// bandwidth is zero when it failed
+type StreamResult struct {
+	Value  float64 `json:"value"`
+	Bytes  int64   `json:"bytes"`
+	Errors int     `json:"errors"`
+	Failed bool    `json:"failed,omitempty"`
+}
+
+// CPUResult is the CPU usage of the host during a phase
+type CPUResult struct {
+	Utilization         float64 `json:"utilization"`
+	ExporterUtilization float64 `json:"exporter_utilization"`
+	Limited             bool    `json:"limited"`
+}
+
+// CacheResult tells whether a transparent cache is suspected, and why
+type CacheResult struct {
+	Suspected bool   `json:"suspected"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// InterfaceTraffic is the traffic of a network interface during a phase
+type InterfaceTraffic struct {
+	RxBytes int64 `json:"rx_bytes"`
+	TxBytes int64 `json:"tx_bytes"`
+}
+
+// newResult builds the result of a test started at start, from the result
+// of the Speedtest client, nil when the test couldn't run
+func newResult(start time.Time, ip string, res *speedtest.Result) *Result {
+	result := &Result{
+		StartedAt:  start,
+		FinishedAt: time.Now(),
+		IP:         ip,
+	}
+	if res == nil {
+		return result
+	}
+	result.FinishedAt = res.FinishedAt
+	result.PhaseSuccess = res.Succeeded
+	result.Hops = res.Hops
+	result.Duplex = res.Duplex
+	result.ShareURL = res.ShareURL
+	if params := res.Parameters; params.DownloadStreams > 0 || params.UploadStreams > 0 {
+		result.Parameters = &TestParameters{
+			DownloadStreams:         params.DownloadStreams,
+			UploadStreams:           params.UploadStreams,
+			DownloadDurationSeconds: params.DownloadDuration.Seconds(),
+			UploadDurationSeconds:   params.UploadDuration.Seconds(),
+			UploadPayloads:          len(params.UploadSizes),
+			UploadPayload:           params.UploadPayload,
+		}
+		for _, size := range params.UploadSizes {
+			result.Parameters.UploadMaxPayloadBytes = max(result.Parameters.UploadMaxPayloadBytes, size)
+		}
+	}
+	if server := res.Server; server.ID != "" || server.URL != "" {
+		result.Server = &ResultServer{
+			ID:       server.ID,
+			Name:     server.Name,
+			Sponsor:  server.Sponsor,
+			Country:  server.Country,
+			CC:       server.CC,
+			URL:      server.URL,
+			Distance: server.Distance,
+			Location: newLocation(server.Lat, server.Lon),
+		}
+	}
+	phase := func(name, unit string) *PhaseResult {
+		m, ok := res.Phases[name]
+		if !ok {
+			return nil
+		}
+		var traffic *InterfaceTraffic
+		if m.Interface != nil {
+			traffic = &InterfaceTraffic{RxBytes: m.Interface.Rx, TxBytes: m.Interface.Tx}
+		}
+		var cpu *CPUResult
+		if m.CPU != nil {
+			cpu = &CPUResult{Utilization: m.CPU.System, ExporterUtilization: m.CPU.Process, Limited: m.CPU.Limited}
+		}
+		var streams []StreamResult
+		for _, stream := range m.PerStream {
+			streams = append(streams, StreamResult{Value: stream.Value, Bytes: stream.Bytes, Errors: stream.Errors, Failed: stream.Failed})
+		}
+		var cache *CacheResult
+		if m.CacheChecked {
+			cache = &CacheResult{Suspected: m.CacheSuspected, Reason: m.CacheReason}
+		}
+		return &PhaseResult{
+			Value:           m.Value,
+			Unit:            unit,
+			DurationSeconds: m.Duration.Seconds(),
+			Bytes:           m.Bytes,
+			Streams:         m.Streams,
+			PerStream:       streams,
+			RateLimit:       m.RateLimit,
+			RateLimited:     m.RateLimited,
+			Samples:         m.Samples,
+			StdDev:          m.StdDev,
+			Jitter:          m.Jitter,
+			Interface:       traffic,
+			CPU:             cpu,
+			Cache:           cache,
+		}
+	}
+	result.Download = phase(speedtest.PhaseDownload, "Mbps")
+	result.Upload = phase(speedtest.PhaseUpload, "Mbps")
+	result.Ping = phase(speedtest.PhasePing, "ms")
+	for _, name := range []string{speedtest.PhaseDownload, speedtest.PhaseUpload} {
+		if conn := res.Phases[name].Connection; conn != nil {
+			result.Connection = &ConnectionResult{HTTPVersion: conn.HTTPVersion, TLSVersion: conn.TLSVersion, Family: conn.Family}
+			break
+		}
+	}
+	return result
+}
+
+// mergeLatency returns a copy of the result of a full test whose latency is
+// that of the latency test, when more recent
+func mergeLatency(result, latency *Result) *Result {
+	if !latency.FinishedAt.After(result.FinishedAt) {
+		return result
+	}
+	merged := *result
+	merged.LatencyRunID = latency.RunID
+	merged.LatencyFinishedAt = latency.FinishedAt
+	merged.Ping = latency.Ping
+	merged.PhaseSuccess = maps.Clone(result.PhaseSuccess)
+	if merged.PhaseSuccess == nil {
+		merged.PhaseSuccess = map[string]bool{}
+	}
+	merged.PhaseSuccess[speedtest.PhasePing] = latency.PhaseSuccess[speedtest.PhasePing]
+	return &merged
+}
+
+// collectResult delivers the result as Prometheus metrics. Metrics of
+// failed tests are not delivered. With timestamps, the samples carry the
+// test completion time, that of the latency test for the latency of a
+// split schedule.
+func collectResult(ch chan<- prometheus.Metric, descs *resultDescs, result *Result, timestamps bool) {
+	latencyFinishedAt := result.FinishedAt
+	if !result.LatencyFinishedAt.IsZero() {
+		latencyFinishedAt = result.LatencyFinishedAt
+	}
+	collectAt := func(desc *prometheus.Desc, phase *PhaseResult, at time.Time) {
+		if phase == nil {
+			return
+		}
+		m := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, phase.Value, descs.labelValues(result)...)
+		if timestamps {
+			m = prometheus.NewMetricWithTimestamp(at, m)
+		}
+		ch <- m
+	}
+	collect := func(desc *prometheus.Desc, phase *PhaseResult) {
+		collectAt(desc, phase, result.FinishedAt)
+	}
+	collectAt(descs.ping, result.Ping, latencyFinishedAt)
+	if result.Duplex {
+		collect(descs.duplexDownload, result.Download)
+		collect(descs.duplexUpload, result.Upload)
+	} else {
+		collect(descs.download, result.Download)
+		collect(descs.upload, result.Upload)
+	}
+	if result.Ping != nil && len(result.Ping.Samples) > 1 {
+		collectAt(descs.pingStdDev, &PhaseResult{Value: result.Ping.StdDev}, latencyFinishedAt)
+	}
+	if result.Hops > 0 {
+		collect(descs.hops, &PhaseResult{Value: float64(result.Hops)})
+	}
+	if result.RunID != "" || result.ShareURL != "" {
+		m := prometheus.MustNewConstMetric(descs.info, prometheus.GaugeValue, 1, append(descs.labelValues(result), result.RunID, result.ShareURL)...)
+		if timestamps {
+			m = prometheus.NewMetricWithTimestamp(result.FinishedAt, m)
+		}
+		ch <- m
+	}
+	if params := result.Parameters; params != nil {
+		m := prometheus.MustNewConstMetric(descs.testParameters, prometheus.GaugeValue, 1, append(descs.labelValues(result),
+			strconv.Itoa(params.DownloadStreams), strconv.Itoa(params.UploadStreams),
+			strconv.FormatFloat(params.DownloadDurationSeconds, 'g', -1, 64), strconv.FormatFloat(params.UploadDurationSeconds, 'g', -1, 64),
+			strconv.Itoa(params.UploadPayloads), strconv.Itoa(params.UploadMaxPayloadBytes), params.UploadPayload)...)
+		if timestamps {
+			m = prometheus.NewMetricWithTimestamp(result.FinishedAt, m)
+		}
+		ch <- m
+	}
+	if conn := result.Connection; conn != nil {
+		m := prometheus.MustNewConstMetric(descs.connectionInfo, prometheus.GaugeValue, 1, append(descs.labelValues(result),
+			conn.HTTPVersion, conn.TLSVersion, conn.Family)...)
+		if timestamps {
+			m = prometheus.NewMetricWithTimestamp(result.FinishedAt, m)
+		}
+		ch <- m
+	}
+	if location := result.ClientLocation; location != nil {
+		collect(descs.clientLatitude, &PhaseResult{Value: location.Lat})
+		collect(descs.clientLongitude, &PhaseResult{Value: location.Lon})
+	}
+	if result.Server != nil && result.Server.Location != nil {
+		collect(descs.serverLatitude, &PhaseResult{Value: result.Server.Location.Lat})
+		collect(descs.serverLongitude, &PhaseResult{Value: result.Server.Location.Lon})
+	}
+
+	collectPhase := func(desc *prometheus.Desc, value float64, phase string) {
+		m := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append(descs.labelValues(result), phase)...)
+		if timestamps && phase == speedtest.PhasePing {
+			m = prometheus.NewMetricWithTimestamp(latencyFinishedAt, m)
+		} else if timestamps {
+			m = prometheus.NewMetricWithTimestamp(result.FinishedAt, m)
+		}
+		ch <- m
+	}
+	for phase, succeeded := range result.PhaseSuccess {
+		success := 0.0
+		if succeeded {
+			success = 1
+		}
+		collectPhase(descs.phaseSuccess, success, phase)
+	}
+	for phase, r := range map[string]*PhaseResult{speedtest.PhaseDownload: result.Download, speedtest.PhaseUpload: result.Upload} {
+		if r == nil {
+			continue
+		}
+		if r.Streams > 0 {
+			collectPhase(descs.streams, float64(r.Streams), phase)
+		}
+		// The streams are only told apart when there are several
+		if len(r.PerStream) > 1 {
+			for i, stream := range r.PerStream {
+				for desc, value := range map[*prometheus.Desc]float64{descs.streamThroughput: stream.Value * 1e6, descs.streamErrors: float64(stream.Errors)} {
+					m := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append(descs.labelValues(result), phase, strconv.Itoa(i))...)
+					if timestamps {
+						m = prometheus.NewMetricWithTimestamp(result.FinishedAt, m)
+					}
+					ch <- m
+				}
+			}
+		}
+		if r.RateLimit > 0 {
+			rateLimited := 0.0
+			if r.RateLimited {
+				rateLimited = 1
+			}
+			collectPhase(descs.rateLimited, rateLimited, phase)
+		}
+		if r.Interface != nil {
+			collectPhase(descs.transferBytes, float64(r.Bytes), phase)
+			collectPhase(descs.interfaceRx, float64(r.Interface.RxBytes), phase)
+			collectPhase(descs.interfaceTx, float64(r.Interface.TxBytes), phase)
+		}
+		if r.CPU != nil {
+			collectPhase(descs.cpuUtilization, r.CPU.Utilization, phase)
+			collectPhase(descs.processCPUUtilization, r.CPU.ExporterUtilization, phase)
+			limited := 0.0
+			if r.CPU.Limited {
+				limited = 1
+			}
+			collectPhase(descs.cpuLimited, limited, phase)
+		}
+	}
+	if r := result.Download; r != nil && r.Cache != nil {
+		suspected := 0.0
+		if r.Cache.Suspected {
+			suspected = 1
+		}
+		collect(descs.cacheSuspected, &PhaseResult{Value: suspected})
+	}
+}
+
+// collectLine delivers the subscribed rates of line, when set, and the
+// ratios of the bandwidths of result to them, when measured. result is nil
+// before the first test.
+func collectLine(ch chan<- prometheus.Metric, descs *resultDescs, line LineConfig, result *Result, timestamps bool) {
+	for _, l := range []struct {
+		provisioned, ratio *prometheus.Desc
+		rate               bitRate
+		phase              func(*Result) *PhaseResult
+	}{
+		{descs.provisionedDownload, descs.downloadRatio, line.Download, func(r *Result) *PhaseResult { return r.Download }},
+		{descs.provisionedUpload, descs.uploadRatio, line.Upload, func(r *Result) *PhaseResult { return r.Upload }},
+	} {
+		if l.rate <= 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(l.provisioned, prometheus.GaugeValue, float64(l.rate))
+		if result == nil || l.phase(result) == nil {
+			continue
+		}
+		m := prometheus.MustNewConstMetric(l.ratio, prometheus.GaugeValue, l.phase(result).Value*1e6/float64(l.rate), descs.labelValues(result)...)
+		if timestamps {
+			m = prometheus.NewMetricWithTimestamp(result.FinishedAt, m)
+		}
+		ch <- m
+	}
+}
+
+// resultHandler serves the last test result as JSON. With links, it is
+// the result of the link parameter, the first link by default, and with
+// compared backends that of the backend parameter, the first backend by
+// default.
+type resultHandler struct {
+	exporter *Exporter
+	// links are the Exporters of the links or of the compared backends
+	links []*Exporter
+}
+
+func (h *resultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	exporter := h.exporter
+	if len(h.links) > 0 {
+		exporter = h.links[0]
+	}
+	if name := r.URL.Query().Get("link"); name != "" {
+		exporter = nil
+		for _, link := range h.links {
+			if link.link == name {
+				exporter = link
+			}
+		}
+		if exporter == nil {
+			http.Error(w, fmt.Sprintf("Unknown link %q", name), http.StatusNotFound)
+			return
+		}
+	}
+	if name := r.URL.Query().Get("backend"); name != "" {
+		exporter = nil
+		for _, backend := range h.links {
+			if backend.backend == name {
+				exporter = backend
+			}
+		}
+		if exporter == nil {
+			http.Error(w, fmt.Sprintf("Unknown backend %q", name), http.StatusNotFound)
+			return
+		}
+	}
+	last, _ := exporter.Last()
+
+	w.Header().Set("Content-Type", "application/json")
+	if last == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No test completed yet"})
+		return
+	}
+	json.NewEncoder(w).Encode(last)
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+func TestResultHandler(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	client, err := speedtest.NewClient(fake.URL+"/config.php", fake.URL+"/servers.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetClient(liveClient{client})
+	handler := &resultHandler{exporter: exporter}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/result", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 before the first test, got %d", w.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == "" {
+		t.Errorf("Expected a JSON error, got %q", w.Body.String())
+	}
+
+	exporter.test(context.Background(), liveClient{client}, triggerScrape)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/result", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var result Result
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Server == nil || result.Server.ID != client.Server.ID {
+		t.Errorf("Expected server %s, got %+v", client.Server.ID, result.Server)
+	}
+	if result.Trigger != triggerScrape {
+		t.Errorf("Expected the scrape trigger, got %q", result.Trigger)
+	}
+	if result.IP != "203.0.113.7" || result.ISP != "Example ISP" {
+		t.Errorf("Expected the client of the Speedtest configuration, got %q and %q", result.IP, result.ISP)
+	}
+	for name, phase := range map[string]*PhaseResult{"download": result.Download, "upload": result.Upload, "ping": result.Ping} {
+		if phase == nil {
+			t.Errorf("Expected the %s result", name)
+		}
+	}
+	if result.Download != nil && (result.Download.Bytes == 0 || result.Download.Streams != 1) {
+		t.Errorf("Expected the downloaded bytes over a single stream, got %+v", result.Download)
+	}
+	if metrics := gather(t, exporter); !strings.Contains(metrics, `speedtest_transfer_streams{ip="203.0.113.7",phase="upload"} 1`) {
+		t.Errorf("Expected the number of upload streams, got:\n%s", metrics)
+	}
+	if result.FinishedAt.Before(result.StartedAt) {
+		t.Errorf("Expected the test to finish after it started, got %s and %s", result.StartedAt, result.FinishedAt)
+	}
+}
+
+func TestResultTimestamps(t *testing.T) {
+	finished := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.Client = liveClient{&speedtest.Client{}}
+	exporter.interval = time.Hour
+	exporter.last = &Result{
+		FinishedAt: finished,
+		IP:         "192.0.2.1",
+		Download:   &PhaseResult{Value: 93.5, Unit: "Mbps"},
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+		handler.ServeHTTP(w, r)
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+			t.Errorf("Expected the OpenMetrics format, got %q", ct)
+		}
+		return w.Body.String()
+	}
+
+	if body := scrape(); !strings.Contains(body, "speedtest_download{ip=\"192.0.2.1\"} 93.5\n") {
+		t.Errorf("Expected the download sample without timestamp, got:\n%s", body)
+	}
+
+	exporter.SetOutput(OutputConfig{Timestamps: true})
+	// OpenMetrics timestamps are in seconds
+	expected := "speedtest_download{ip=\"192.0.2.1\"} 93.5 1.483272e+09\n"
+	if body := scrape(); !strings.Contains(body, expected) {
+		t.Errorf("Expected %q, got:\n%s", expected, body)
+	}
+
+	// The latency of a split schedule carries the time of its own test
+	exporter.lastPing = &Result{
+		FinishedAt: finished.Add(time.Minute),
+		IP:         "192.0.2.1",
+		Ping:       &PhaseResult{Value: 12.5, Unit: "ms"},
+	}
+	body := scrape()
+	for _, expected := range []string{
+		"speedtest_download{ip=\"192.0.2.1\"} 93.5 1.483272e+09\n",
+		"speedtest_ping{ip=\"192.0.2.1\"} 12.5 1.48327206e+09\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestMergeLatency(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	full := &Result{RunID: "full", FinishedAt: start, Ping: &PhaseResult{Value: 12.5}, Download: &PhaseResult{Value: 93.5},
+		PhaseSuccess: map[string]bool{speedtest.PhasePing: true, speedtest.PhaseDownload: true}}
+	failed := &Result{RunID: "ping", FinishedAt: start.Add(time.Minute), Error: "timeout"}
+	merged := mergeLatency(full, failed)
+	if merged.Ping != nil || merged.PhaseSuccess[speedtest.PhasePing] || !merged.PhaseSuccess[speedtest.PhaseDownload] || merged.Download == nil {
+		t.Errorf("Expected the failed latency test to replace the latency only, got %+v", merged)
+	}
+	if merged.LatencyRunID != "ping" || merged.Error != "" || !full.PhaseSuccess[speedtest.PhasePing] {
+		t.Errorf("Expected the full test to be left unchanged, got %+v and %+v", merged, full)
+	}
+	// A latency test older than the full test is superseded by it
+	if merged := mergeLatency(full, &Result{FinishedAt: start.Add(-time.Minute)}); merged != full {
+		t.Errorf("Expected the full test, got %+v", merged)
+	}
+
+}
+
+func TestResultRateLimited(t *testing.T) {
+	result := &probeResult{
+		Result: &Result{
+			IP:       "192.0.2.1",
+			Download: &PhaseResult{Value: 200, Unit: "Mbps", RateLimit: 200, RateLimited: true},
+			Upload:   &PhaseResult{Value: 20, Unit: "Mbps", RateLimit: 200},
+			Ping:     &PhaseResult{Value: 12, Unit: "ms"},
+		},
+		descs: newResultDescs(defaultConfig().Metrics),
+	}
+	metrics := gather(t, result)
+	for _, expected := range []string{
+		`speedtest_rate_limited{ip="192.0.2.1",phase="download"} 1`,
+		`speedtest_rate_limited{ip="192.0.2.1",phase="upload"} 0`,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, metrics)
+		}
+	}
+
+	result.Download.RateLimit, result.Upload.RateLimit = 0, 0
+	if metrics := gather(t, result); strings.Contains(metrics, "speedtest_rate_limited") {
+		t.Errorf("Expected no rate_limited metric without a rate limit, got:\n%s", metrics)
+	}
+}
+
+func TestResultPingStdDev(t *testing.T) {
+	result := &probeResult{
+		Result: &Result{
+			IP:   "192.0.2.1",
+			Ping: &PhaseResult{Value: 10, Unit: "ms", Samples: []float64{10, 12, 14}, StdDev: 1.5},
+		},
+		descs: newResultDescs(defaultConfig().Metrics),
+	}
+	if metrics := gather(t, result); !strings.Contains(metrics, `speedtest_ping_stddev{ip="192.0.2.1"} 1.5`) {
+		t.Errorf("Expected the standard deviation of the latency, got:\n%s", metrics)
+	}
+	result.Ping.Samples = result.Ping.Samples[:1]
+	if metrics := gather(t, result); strings.Contains(metrics, "speedtest_ping_stddev") {
+		t.Errorf("Expected no standard deviation of a single sample, got:\n%s", metrics)
+	}
+}
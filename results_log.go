@@ -0,0 +1,146 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// resultsLog appends the results to a file, one JSON object per line, and
+// rotates it once it reaches maxSize: the file is renamed with the .1
+// suffix, the previous rotated files shifting to .2 and so on, up to
+// maxFiles of them. A nil resultsLog discards the results, and so does a
+// closed one.
+type resultsLog struct {
+	filename string
+	maxSize  int64
+	maxFiles int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+// openResultsLog opens the results file, creating it if needed
+func openResultsLog(config ResultsConfig) (*resultsLog, error) {
+	l := &resultsLog{
+		filename: config.File,
+		maxSize:  int64(config.MaxSize),
+		maxFiles: config.MaxFiles,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *resultsLog) open() error {
+	file, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// append writes result as a line of the file. Each line is written at
+// once, so readers never see part of it. Errors are logged, the test
+// itself being unaffected.
+func (l *resultsLog) append(result *Result) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(result)
+	if err != nil {
+		slog.Error("Can't encode the result", "err", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			slog.Error("Can't rotate the results file", "file", l.filename, "err", err)
+		}
+	}
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			slog.Error("Can't open the results file", "file", l.filename, "err", err)
+			return
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		slog.Error("Can't write the result to the results file", "file", l.filename, "err", err)
+	}
+}
+
+// rotate renames the file and the rotated files, dropping the oldest one,
+// the next append creating a new file
+func (l *resultsLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		slog.Warn("Error closing the results file", "file", l.filename, "err", err)
+	}
+	l.file = nil
+	rotated := func(i int) string {
+		return fmt.Sprintf("%s.%d", l.filename, i)
+	}
+	if l.maxFiles == 0 {
+		return os.Remove(l.filename)
+	}
+	if err := os.Remove(rotated(l.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := l.maxFiles - 1; i > 0; i-- {
+		if err := os.Rename(rotated(i), rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(l.filename, rotated(1))
+}
+
+// close flushes the file to disk and closes it
+func (l *resultsLog) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
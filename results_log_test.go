@@ -0,0 +1,156 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readResultsFile(t *testing.T, filename string) []string {
+	t.Helper()
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func TestResultsLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "results.jsonl")
+	results, err := openResultsLog(ResultsConfig{File: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results.append(&Result{IP: "192.0.2.1", Download: &PhaseResult{Value: 100, Unit: "Mbit/s"}})
+	results.append(&Result{IP: "192.0.2.1", Error: "timeout"})
+	if err := results.close(); err != nil {
+		t.Fatal(err)
+	}
+	// A closed log discards the results
+	results.append(&Result{IP: "192.0.2.2"})
+
+	lines := readResultsFile(t, filename)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", lines)
+	}
+	var first, second Result
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatal(err)
+	}
+	if first.Download == nil || first.Download.Value != 100 || second.Error != "timeout" {
+		t.Errorf("Unexpected results %+v and %+v", first, second)
+	}
+
+	// Reopening appends to the existing file
+	results, err = openResultsLog(ResultsConfig{File: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results.append(&Result{IP: "192.0.2.3"})
+	results.close()
+	if lines := readResultsFile(t, filename); len(lines) != 3 {
+		t.Errorf("Expected 3 lines, got %q", lines)
+	}
+
+	// A nil log discards the results
+	var disabled *resultsLog
+	disabled.append(&Result{})
+	if err := disabled.close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResultsLogRotation(t *testing.T) {
+	line, _ := json.Marshal(&Result{IP: "192.0.2.1"})
+	size := len(line) + 1
+
+	for _, tc := range []struct {
+		name     string
+		maxFiles int
+		files    []string
+	}{
+		{"no_rotated_file", 0, []string{"results.jsonl"}},
+		{"one_rotated_file", 1, []string{"results.jsonl", "results.jsonl.1"}},
+		{"rotated_files", 2, []string{"results.jsonl", "results.jsonl.1", "results.jsonl.2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "results.jsonl")
+			results, err := openResultsLog(ResultsConfig{
+				File:     filename,
+				MaxSize:  byteSize(2 * size),
+				MaxFiles: tc.maxFiles,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 7; i++ {
+				results.append(&Result{IP: "192.0.2.1"})
+			}
+			results.close()
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			for _, entry := range entries {
+				files = append(files, entry.Name())
+			}
+			if strings.Join(files, ",") != strings.Join(tc.files, ",") {
+				t.Errorf("Expected the files %q, got %q", tc.files, files)
+			}
+			// The current file holds the last line, the rotated ones two
+			// lines each
+			if lines := readResultsFile(t, filename); len(lines) != 1 {
+				t.Errorf("Expected 1 line in the current file, got %q", lines)
+			}
+			for _, name := range tc.files[1:] {
+				if lines := readResultsFile(t, filepath.Join(dir, name)); len(lines) != 2 {
+					t.Errorf("Expected 2 lines in %s, got %q", name, lines)
+				}
+			}
+		})
+	}
+}
+
+func TestResultsLogErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := openResultsLog(ResultsConfig{File: filepath.Join(dir, "missing", "results.jsonl")}); err == nil {
+		t.Error("Expected an error opening a file in a missing directory")
+	}
+
+	// Once the directory is gone, appending only logs the errors
+	filename := filepath.Join(dir, "logs", "results.jsonl")
+	os.Mkdir(filepath.Dir(filename), 0755)
+	results, err := openResultsLog(ResultsConfig{File: filename, MaxSize: 1, MaxFiles: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results.append(&Result{IP: "192.0.2.1"})
+	if err := os.RemoveAll(filepath.Dir(filename)); err != nil {
+		t.Fatal(err)
+	}
+	results.append(&Result{IP: "192.0.2.2"})
+	results.append(&Result{IP: "192.0.2.3"})
+	results.close()
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newRouter returns the handler of the exporter HTTP server, exposing the
+// metrics of registry on the telemetry path. All the endpoints are served
+// under the route prefix, if any.
+func newRouter(config *Config, manager *configManager, registry *prometheus.Registry) http.Handler {
+	handler := allowClients(manager, newMux(config, manager, registry))
+	if config.Web.LogRequests {
+		return logRequests(handler)
+	}
+	return handler
+}
+
+func newMux(config *Config, manager *configManager, registry *prometheus.Registry) *http.ServeMux {
+	mux := http.NewServeMux()
+	metricsPath := config.Web.TelemetryPath
+	var metrics http.Handler = scrapeHandler(config, manager.exporter, registry, manager.children()...)
+	if !config.Web.DisableExporterMetrics {
+		metrics = promhttp.InstrumentMetricHandler(registry, metrics)
+	}
+	mux.Handle(metricsPath, metrics)
+	mux.Handle("/probe", &probeHandler{
+		manager: manager,
+	})
+	mux.Handle("/result", &resultHandler{
+		exporter: manager.exporter,
+		links:    manager.children(),
+	})
+	if history := manager.exporter.outputs.historyStore(); history != nil {
+		mux.Handle("/history", &historyHandler{
+			history: history,
+		})
+	}
+	if manager.targets != nil {
+		api := &targetsHandler{
+			manager: manager,
+			runner:  manager.targets,
+		}
+		mux.Handle("/api/v1/targets", api)
+		mux.Handle("/api/v1/targets/{name}", api)
+	}
+	mux.Handle("/-/reload", requireToken(manager, &reloadHandler{
+		manager: manager,
+	}))
+	mux.Handle("/-/soak/pause", requireToken(manager, &soakHandler{
+		exporter: manager.exporter,
+		links:    manager.links,
+		paused:   true,
+	}))
+	mux.Handle("/-/soak/resume", requireToken(manager, &soakHandler{
+		exporter: manager.exporter,
+		links:    manager.links,
+	}))
+	if !config.Web.DisableConfigEndpoint {
+		mux.Handle("/-/config", &configHandler{
+			manager: manager,
+		})
+	}
+	mux.Handle("/-/healthy", healthyHandler())
+	mux.Handle("/-/ready", &readyHandler{
+		manager: manager,
+	})
+	if config.Web.EnablePprof && config.Web.PprofListenAddress == "" {
+		registerPprof(mux)
+	}
+	if config.Web.EnableDebugServers {
+		mux.Handle("/debug/servers", &serversHandler{
+			exporter: manager.testers()[0],
+		})
+	}
+	mux.Handle("/", &landingHandler{
+		prefix:      strings.TrimSuffix(config.Web.externalPath(), "/"),
+		metricsPath: metricsPath,
+		exporter:    manager.testers()[0],
+	})
+
+	prefix := config.Web.routePrefix()
+	if prefix == "/" {
+		return mux
+	}
+	root := http.NewServeMux()
+	root.Handle(prefix+"/", http.StripPrefix(prefix, mux))
+	root.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, config.Web.externalPath(), http.StatusFound)
+	})
+	return root
+}
+
+// linkLabels returns the labels of the metrics of each link: its name and
+// the labels of all the links, those it doesn't define being empty, as the
+// metrics of a name must have the same labels. Those of the compared
+// backends are their backend label.
+func linkLabels(links []*Exporter) []prometheus.Labels {
+	names := map[string]bool{}
+	for _, link := range links {
+		for name := range link.labels {
+			names[name] = true
+		}
+	}
+	all := make([]prometheus.Labels, len(links))
+	for i, link := range links {
+		all[i] = prometheus.Labels{}
+		if link.link != "" {
+			all[i]["link"] = link.link
+		}
+		for name := range names {
+			all[i][name] = link.labels[name]
+		}
+	}
+	return all
+}
+
+// scrapeHandler serves the metrics of registry and those of the exporter,
+// collected with the context of the scrape request: a test run on scrape
+// is aborted when Prometheus gives up on the scrape. With links or
+// compared backends, their Exporters run the tests instead, their metrics
+// being labeled with the link or backend, and only the sink and queue
+// metrics of the exporter are served.
+func scrapeHandler(config *Config, exporter *Exporter, registry *prometheus.Registry, links ...*Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrape := prometheus.NewRegistry()
+		labeled := prometheus.WrapRegistererWith(prometheus.Labels(config.Metrics.Labels), scrape)
+		if len(links) == 0 {
+			labeled.MustRegister(scrapeCollector{Exporter: exporter, ctx: r.Context()})
+		} else {
+			labeled.MustRegister(exporter.sinkMetrics, exporter.limiter)
+		}
+		for i, labels := range linkLabels(links) {
+			prometheus.WrapRegistererWith(labels, labeled).MustRegister(scrapeCollector{Exporter: links[i], ctx: r.Context()})
+		}
+		promhttp.HandlerFor(prometheus.Gatherers{registry, scrape}, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		}).ServeHTTP(w, r)
+	})
+}
+
+// registerPprof registers the profiling handlers under /debug/pprof/
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
@@ -0,0 +1,43 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+)
+
+const (
+	// serviceName names the Windows service and its event log source
+	serviceName        = "speedtest_exporter"
+	serviceDisplayName = "Speedtest Exporter"
+	serviceDescription = "Prometheus exporter for Speedtest measures"
+)
+
+// serviceArgs returns the command line arguments the service is installed
+// with: those of the installation, without the service management flags.
+func serviceArgs(args []string) []string {
+	var result []string
+	for _, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+		if strings.HasPrefix(arg, "-") && (name == "service.install" || name == "service.uninstall") {
+			continue
+		}
+		result = append(result, arg)
+	}
+	return result
+}
@@ -0,0 +1,43 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+func isService() (bool, error) {
+	return false, nil
+}
+
+func runService(stop chan<- os.Signal) (done func()) {
+	return func() {}
+}
+
+func installService(args []string) error {
+	return fmt.Errorf("Services are only supported on Windows")
+}
+
+func uninstallService() error {
+	return fmt.Errorf("Services are only supported on Windows")
+}
+
+func newServiceHandler(level slog.Leveler) (slog.Handler, error) {
+	return nil, fmt.Errorf("Services are only supported on Windows")
+}
@@ -0,0 +1,180 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// isService returns whether the exporter is run by the Windows service
+// manager
+func isService() (bool, error) {
+	return svc.IsWindowsService()
+}
+
+// runService reports the exporter status to the Windows service manager,
+// until done is called. Stop and shutdown requests are sent to stop, for the
+// same graceful shutdown as SIGTERM.
+func runService(stop chan<- os.Signal) (done func()) {
+	finished := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		if err := svc.Run(serviceName, &serviceHandler{stop: stop, finished: finished}); err != nil {
+			slog.Error("Error running the Windows service", "err", err)
+		}
+	}()
+	return func() {
+		close(finished)
+		<-returned
+	}
+}
+
+// serviceHandler answers the Windows service control requests
+type serviceHandler struct {
+	stop     chan<- os.Signal
+	finished <-chan struct{}
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				h.stop <- syscall.SIGTERM
+				<-h.finished
+				return false, 0
+			}
+		case <-h.finished:
+			return false, 0
+		}
+	}
+}
+
+// installService registers the exporter as an automatically started
+// Windows service run with args, and its event log source
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("Service %s already exists", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("Can't install the event log source: %s", err)
+	}
+	return nil
+}
+
+// uninstallService removes the Windows service and its event log source
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("Service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+// newServiceHandler returns a log handler writing to the Windows event log
+func newServiceHandler(level slog.Leveler) (slog.Handler, error) {
+	log, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	h := &eventLogHandler{log: log, mu: &sync.Mutex{}, buf: &bytes.Buffer{}}
+	h.Handler = slog.NewTextHandler(h.buf, &slog.HandlerOptions{Level: level})
+	return h, nil
+}
+
+// eventLogHandler formats the log records as text, and writes them to the
+// event log with their severity
+type eventLogHandler struct {
+	slog.Handler
+	log *eventlog.Log
+
+	// mu guards buf, shared by the handlers derived with WithAttrs and
+	// WithGroup
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err := h.Handler.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := h.buf.String()
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.log.Error(1, msg)
+	case r.Level >= slog.LevelWarn:
+		return h.log.Warning(1, msg)
+	}
+	return h.log.Info(1, msg)
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &eventLogHandler{Handler: h.Handler.WithAttrs(attrs), log: h.log, mu: h.mu, buf: h.buf}
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	return &eventLogHandler{Handler: h.Handler.WithGroup(name), log: h.log, mu: h.mu, buf: h.buf}
+}
@@ -0,0 +1,227 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// sinkQueueSize is the number of results waiting for delivery to a
+	// sink, the next ones being dropped
+	sinkQueueSize = 100
+
+	// sinkTimeout bounds each delivery attempt, for the sinks without a
+	// setting
+	sinkTimeout = 10 * time.Second
+
+	// sinkRetryDelay is the delay before the first retry of a failed
+	// delivery, doubled on each retry
+	sinkRetryDelay = time.Second
+
+	// sinkRetries is the number of retries of the failed deliveries, for
+	// the sinks without a setting
+	sinkRetries = 2
+
+	// maxRetryAfter bounds the delays sinks may ask for before a retry
+	maxRetryAfter = time.Minute
+)
+
+// resultSink delivers the results to an external system
+type resultSink interface {
+	write(ctx context.Context, result *Result) error
+}
+
+// permanentError is a delivery error retrying doesn't fix, such as a
+// rejected request
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// retryAfterError is a delivery error to be retried after a delay, such
+// as the Retry-After of a rate limited request
+type retryAfterError struct {
+	error
+	after time.Duration
+}
+
+func (e retryAfterError) Unwrap() error {
+	return e.error
+}
+
+// sinkMetrics count the deliveries of the sinks, by sink
+type sinkMetrics struct {
+	deliveries *prometheus.CounterVec
+	failures   *prometheus.CounterVec
+}
+
+func newSinkMetrics(namespace string) *sinkMetrics {
+	return &sinkMetrics{
+		deliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sink_deliveries_total",
+			Help:      "Number of results the outputs delivered, by sink.",
+		}, []string{"sink"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sink_failures_total",
+			Help:      "Number of results the outputs failed to deliver, after retries or with a full queue, by sink.",
+		}, []string{"sink"}),
+	}
+}
+
+func (m *sinkMetrics) Describe(ch chan<- *prometheus.Desc) {
+	if m == nil {
+		return
+	}
+	m.deliveries.Describe(ch)
+	m.failures.Describe(ch)
+}
+
+func (m *sinkMetrics) Collect(ch chan<- prometheus.Metric) {
+	if m == nil {
+		return
+	}
+	m.deliveries.Collect(ch)
+	m.failures.Collect(ch)
+}
+
+// sinkQueue delivers the results to a sink in the background, so a slow or
+// unavailable sink never delays the tests. Failed deliveries are retried
+// up to retries times, the results being dropped afterwards.
+type sinkQueue struct {
+	name       string
+	sink       resultSink
+	retries    int
+	retryDelay time.Duration
+	// timeout bounds each delivery attempt
+	timeout time.Duration
+	// deliveries and failures count the results delivered and not
+	deliveries prometheus.Counter
+	failures   prometheus.Counter
+
+	mu     sync.Mutex
+	queue  chan *Result
+	closed bool
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newSinkQueue(name string, sink resultSink, retries int, metrics *sinkMetrics) *sinkQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &sinkQueue{
+		name:       name,
+		sink:       sink,
+		retries:    retries,
+		retryDelay: sinkRetryDelay,
+		timeout:    sinkTimeout,
+		deliveries: metrics.deliveries.WithLabelValues(name),
+		failures:   metrics.failures.WithLabelValues(name),
+		queue:      make(chan *Result, sinkQueueSize),
+		done:       make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	go q.run()
+	return q
+}
+
+// push queues result for delivery. It never blocks: the result is dropped
+// when the queue is full or closed.
+func (q *sinkQueue) push(result *Result) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	select {
+	case q.queue <- result:
+	default:
+		slog.Error("Dropping the result, the sink queue is full", "sink", q.name)
+		q.failures.Inc()
+	}
+}
+
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	for result := range q.queue {
+		q.deliver(result)
+	}
+}
+
+func (q *sinkQueue) deliver(result *Result) {
+	delay := q.retryDelay
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(q.ctx, q.timeout)
+		err := q.sink.write(ctx, result)
+		cancel()
+		if err == nil {
+			q.deliveries.Inc()
+			return
+		}
+		var permanent permanentError
+		if attempt > q.retries || errors.As(err, &permanent) || q.ctx.Err() != nil {
+			slog.Error("Can't deliver the result", "sink", q.name, "attempts", attempt, "err", err)
+			q.failures.Inc()
+			return
+		}
+		wait := delay
+		var retryAfter retryAfterError
+		if errors.As(err, &retryAfter) && retryAfter.after > wait {
+			wait = min(retryAfter.after, maxRetryAfter)
+		}
+		slog.Warn("Can't deliver the result, retrying", "sink", q.name, "delay", wait, "err", err)
+		select {
+		case <-time.After(wait):
+		case <-q.ctx.Done():
+		}
+		delay *= 2
+	}
+}
+
+// close stops accepting results and waits for the queued ones to be
+// delivered until ctx is done, the remaining deliveries being aborted. The
+// sink is then closed, if it is an io.Closer.
+func (q *sinkQueue) close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		q.cancel()
+		<-q.done
+	}
+	q.cancel()
+	if closer, ok := q.sink.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
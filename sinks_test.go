@@ -0,0 +1,142 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeSink fails the first failures writes, blocking each write until
+// release is closed when set
+type fakeSink struct {
+	mu       sync.Mutex
+	failures int
+	err      error
+	attempts int
+	written  []*Result
+	release  chan struct{}
+}
+
+func (s *fakeSink) write(ctx context.Context, result *Result) error {
+	if s.release != nil {
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.attempts <= s.failures {
+		return s.err
+	}
+	s.written = append(s.written, result)
+	return nil
+}
+
+func newTestSinkQueue(sink resultSink, retries int) (*sinkQueue, prometheus.Counter) {
+	metrics := newSinkMetrics("speedtest")
+	q := newSinkQueue("test", sink, retries, metrics)
+	q.retryDelay = time.Millisecond
+	return q, metrics.failures.WithLabelValues("test")
+}
+
+func TestSinkQueueRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		failures  int
+		err       error
+		attempts  int
+		delivered bool
+	}{
+		{"success", 0, nil, 1, true},
+		{"retried", 2, fmt.Errorf("unavailable"), 3, true},
+		{"exhausted", 5, fmt.Errorf("unavailable"), 3, false},
+		{"permanent", 5, permanentError{fmt.Errorf("rejected")}, 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sink := &fakeSink{failures: tc.failures, err: tc.err}
+			q, failures := newTestSinkQueue(sink, 2)
+			q.push(&Result{IP: "192.0.2.1"})
+			if err := q.close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if sink.attempts != tc.attempts {
+				t.Errorf("Expected %d attempts, got %d", tc.attempts, sink.attempts)
+			}
+			if delivered := len(sink.written) == 1; delivered != tc.delivered {
+				t.Errorf("Expected the result to be delivered: %t", tc.delivered)
+			}
+			if expected := map[bool]float64{true: 0, false: 1}[tc.delivered]; testutil.ToFloat64(failures) != expected {
+				t.Errorf("Expected %v failures, got %v", expected, testutil.ToFloat64(failures))
+			}
+		})
+	}
+}
+
+func TestSinkQueueRetryAfter(t *testing.T) {
+	sink := &fakeSink{failures: 1, err: retryAfterError{fmt.Errorf("rate limited"), 50 * time.Millisecond}}
+	q, _ := newTestSinkQueue(sink, 1)
+	start := time.Now()
+	q.push(&Result{})
+	if err := q.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.written) != 1 {
+		t.Fatal("Expected the result to be delivered")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the retry to wait for the Retry-After, took %s", elapsed)
+	}
+}
+
+func TestSinkQueueNeverBlocks(t *testing.T) {
+	sink := &fakeSink{release: make(chan struct{})}
+	q, failures := newTestSinkQueue(sink, 0)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < sinkQueueSize+10; i++ {
+			q.push(&Result{})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pushing the results blocked on the sink")
+	}
+	// The first result is being written, the queue holds the next ones
+	if dropped := testutil.ToFloat64(failures); dropped < 9 || dropped > 10 {
+		t.Errorf("Expected about 10 dropped results, got %v", dropped)
+	}
+
+	// The deliveries still pending on shutdown are aborted
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	q.close(ctx)
+	q.push(&Result{})
+	if len(sink.written) != 0 || testutil.ToFloat64(failures) != sinkQueueSize+10 {
+		t.Errorf("Expected all the results to fail, got %d written and %v failures", len(sink.written), testutil.ToFloat64(failures))
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// soakCapCheck is the period the daily cap is checked at, once it paused
+// the soak test
+const soakCapCheck = time.Minute
+
+// soakMetrics are the rolling metrics of the soak test, updated on each
+// report
+type soakMetrics struct {
+	download prometheus.Gauge
+	upload   prometheus.Gauge
+	ping     prometheus.Gauge
+	paused   prometheus.Gauge
+	// stalls, reconnects and transferred are by direction: download or
+	// upload
+	stalls      *prometheus.CounterVec
+	reconnects  *prometheus.CounterVec
+	transferred *prometheus.CounterVec
+}
+
+func newSoakMetrics(namespace string) *soakMetrics {
+	return &soakMetrics{
+		download: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "soak_download",
+			Help:      "Download rate achieved by the soak test over the last interval (Mbps).",
+		}),
+		upload: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "soak_upload",
+			Help:      "Upload rate achieved by the soak test over the last interval (Mbps).",
+		}),
+		ping: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "soak_ping",
+			Help:      "Latency to the test server last measured under the load of the soak test (ms).",
+		}),
+		paused: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "soak_paused",
+			Help:      "Whether the soak test is paused, through the API or by the daily data cap.",
+		}),
+		stalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "soak_stalls_total",
+			Help:      "Number of times the soak transfers stopped moving data for a while, by direction.",
+		}, []string{"direction"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "soak_reconnects_total",
+			Help:      "Number of soak transfers dropped or failed, and reconnected, by direction.",
+		}, []string{"direction"}),
+		transferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "soak_transferred_bytes_total",
+			Help:      "Bytes transferred by the soak test, by direction.",
+		}, []string{"direction"}),
+	}
+}
+
+func (m *soakMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.download.Describe(ch)
+	m.upload.Describe(ch)
+	m.ping.Describe(ch)
+	m.paused.Describe(ch)
+	m.stalls.Describe(ch)
+	m.reconnects.Describe(ch)
+	m.transferred.Describe(ch)
+}
+
+func (m *soakMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.download.Collect(ch)
+	m.upload.Collect(ch)
+	m.ping.Collect(ch)
+	m.paused.Collect(ch)
+	m.stalls.Collect(ch)
+	m.reconnects.Collect(ch)
+	m.transferred.Collect(ch)
+}
+
+// SetMode defines whether the exporter runs discrete tests, or the soak
+// test of soak
+func (e *Exporter) SetMode(mode string, soak SoakConfig) {
+	e.mu.Lock()
+	changed := e.mode != mode || (mode == modeSoak && e.soak != soak)
+	e.mode, e.soak = mode, soak
+	e.mu.Unlock()
+	if changed {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// soaking tells whether the exporter runs the soak test
+func (e *Exporter) soaking() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.mode == modeSoak
+}
+
+// SetSoakPaused pauses or resumes the soak test
+func (e *Exporter) SetSoakPaused(paused bool) {
+	e.mu.Lock()
+	changed := e.soakPaused != paused
+	e.soakPaused = paused
+	e.mu.Unlock()
+	if changed {
+		e.logger().Info("Soak test " + map[bool]string{true: "paused", false: "resumed"}[paused])
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runSoak runs the soak test with client until the exporter is woken up,
+// by a pause or a change of its settings, or its context is done. The soak
+// test stops while the daily cap is reached.
+func (e *Exporter) runSoak(client speedtestClient, config SoakConfig) {
+	logger := e.logger()
+	opts := speedtest.SoakOptions{
+		DownloadRate: int64(config.DownloadRate),
+		UploadRate:   int64(config.UploadRate),
+		URL:          config.URL,
+		Interval:     config.Interval,
+	}
+	for {
+		e.mu.RLock()
+		paused := e.soakPaused
+		e.mu.RUnlock()
+		if paused || e.capped() {
+			e.soakMetrics.paused.Set(1)
+			e.soakMetrics.download.Set(0)
+			e.soakMetrics.upload.Set(0)
+			var check <-chan time.Time
+			if !paused {
+				check = time.After(soakCapCheck)
+			}
+			select {
+			case <-check:
+				continue
+			case <-e.wake:
+			case <-e.ctx.Done():
+			}
+			return
+		}
+		e.soakMetrics.paused.Set(0)
+
+		ctx, cancel := context.WithCancel(e.ctx)
+		if e.link != "" {
+			ctx = speedtest.WithLogger(ctx, logger)
+		}
+		done := make(chan error, 1)
+		logger.Info("Soak test starting", "server_id", client.TestServer().ID, "download_rate", config.DownloadRate, "upload_rate", config.UploadRate)
+		go func() {
+			done <- client.Soak(ctx, opts, func(r speedtest.SoakReport) {
+				e.soakReport(r)
+				if e.capped() {
+					logger.Warn("Daily data cap reached, pausing the soak test", "cap", byteSize(e.dataCapValue()))
+					cancel()
+				}
+			})
+		}()
+		var err error
+		select {
+		case err = <-done:
+			cancel()
+		case <-e.wake:
+			cancel()
+			<-done
+			return
+		case <-e.ctx.Done():
+			cancel()
+			<-done
+			return
+		}
+		if err != nil {
+			// Retried once the settings or the client change
+			logger.Error("Can't run the soak test", "err", err)
+			select {
+			case <-e.wake:
+			case <-e.ctx.Done():
+			}
+			return
+		}
+	}
+}
+
+// soakReport records a report of the soak test
+func (e *Exporter) soakReport(r speedtest.SoakReport) {
+	m := e.soakMetrics
+	m.download.Set(r.Download)
+	m.upload.Set(r.Upload)
+	if r.PingErr == nil && r.Ping > 0 {
+		m.ping.Set(r.Ping)
+	}
+	for _, direction := range []string{speedtest.PhaseDownload, speedtest.PhaseUpload} {
+		m.stalls.WithLabelValues(direction).Add(float64(r.Stalls[direction]))
+		m.reconnects.WithLabelValues(direction).Add(float64(r.Reconnects[direction]))
+	}
+	m.transferred.WithLabelValues(speedtest.PhaseDownload).Add(float64(r.DownloadBytes))
+	m.transferred.WithLabelValues(speedtest.PhaseUpload).Add(float64(r.UploadBytes))
+	e.addDataUsage(r.DownloadBytes + r.UploadBytes)
+	if r.Err != nil {
+		e.logger().Warn("Soak transfer reconnected", "download_reconnects", r.Reconnects[speedtest.PhaseDownload],
+			"upload_reconnects", r.Reconnects[speedtest.PhaseUpload], "err", r.Err)
+	}
+}
+
+// soakHandler pauses or resumes the soak test of the exporter and its
+// links on POST requests, or of the link of the link parameter only
+type soakHandler struct {
+	exporter *Exporter
+	links    []*Exporter
+	paused   bool
+}
+
+func (h *soakHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "This endpoint requires a POST request.", http.StatusMethodNotAllowed)
+		return
+	}
+	exporters := []*Exporter{h.exporter}
+	if len(h.links) > 0 {
+		exporters = h.links
+	}
+	if name := r.URL.Query().Get("link"); name != "" {
+		exporters = nil
+		for _, link := range h.links {
+			if link.link == name {
+				exporters = []*Exporter{link}
+			}
+		}
+		if exporters == nil {
+			http.Error(w, fmt.Sprintf("Unknown link %q", name), http.StatusNotFound)
+			return
+		}
+	}
+	for _, exporter := range exporters {
+		if !exporter.soaking() {
+			http.Error(w, "The exporter doesn't run in soak mode.", http.StatusConflict)
+			return
+		}
+	}
+	for _, exporter := range exporters {
+		exporter.SetSoakPaused(h.paused)
+	}
+}
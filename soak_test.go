@@ -0,0 +1,143 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// waitForMetric waits for the metrics of exporter to have line
+func waitForMetric(t *testing.T, exporter *Exporter, line string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		metrics := gather(t, exporter)
+		if strings.Contains(metrics, line) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s, got:\n%s", line, metrics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSoakMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := defaultConfig()
+	config.Probe.Only = true
+	exporter := newExporter(ctx, nil, config.Metrics)
+	manager, err := newConfigManager(nil, config, exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeClient{
+		server: speedtest.Server{ID: "1234"},
+		soakReports: []speedtest.SoakReport{
+			{Elapsed: time.Second, DownloadBytes: 625000, UploadBytes: 125000, Download: 5, Upload: 1, Ping: 12.5,
+				Stalls: map[string]int{speedtest.PhaseDownload: 1}, Reconnects: map[string]int{}},
+			{Elapsed: time.Second, DownloadBytes: 500000, UploadBytes: 125000, Download: 4, Upload: 1, PingErr: context.DeadlineExceeded,
+				Stalls: map[string]int{}, Reconnects: map[string]int{speedtest.PhaseUpload: 1}},
+		},
+	}
+	exporter.SetMode(modeSoak, SoakConfig{DownloadRate: 5 * 1000 * 1000, UploadRate: 1000 * 1000, Interval: 10 * time.Millisecond})
+	exporter.SetClient(client)
+	exporter.SetInterval(time.Hour)
+	go exporter.run()
+
+	waitForMetric(t, exporter, `speedtest_soak_transferred_bytes_total{direction="download"} 1.125e+06`)
+	metrics := gather(t, exporter)
+	for _, line := range []string{
+		"speedtest_soak_download 4\n",
+		"speedtest_soak_upload 1\n",
+		// The failed measurement keeps the last latency
+		"speedtest_soak_ping 12.5\n",
+		"speedtest_soak_paused 0\n",
+		`speedtest_soak_stalls_total{direction="download"} 1`,
+		`speedtest_soak_reconnects_total{direction="upload"} 1`,
+		`speedtest_soak_transferred_bytes_total{direction="upload"} 250000`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %s, got:\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, "speedtest_tests_total{") {
+		t.Errorf("Expected no discrete test in soak mode, got:\n%s", metrics)
+	}
+
+	// Pausing stops the soak test, resuming starts it again
+	handler := newRouter(config, manager, newRegistry(config, manager))
+	post := func(path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", path, nil))
+		return rec.Code
+	}
+	if code := post("/-/soak/pause"); code != http.StatusOK {
+		t.Fatalf("Expected the soak test to pause, got status %d", code)
+	}
+	waitForMetric(t, exporter, "speedtest_soak_paused 1\n")
+	soaks := client.soaks.Load()
+	if code := post("/-/soak/resume"); code != http.StatusOK {
+		t.Fatalf("Expected the soak test to resume, got status %d", code)
+	}
+	waitForMetric(t, exporter, "speedtest_soak_paused 0\n")
+	if client.soaks.Load() != soaks+1 {
+		t.Errorf("Expected the soak test to start again, got %d starts after %d", client.soaks.Load(), soaks)
+	}
+	if code := post("/-/soak/pause?link=wan1"); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown link, got status %d", code)
+	}
+
+	// Without soak test, there is nothing to pause
+	exporter.SetMode(modeTest, SoakConfig{})
+	if code := post("/-/soak/pause"); code != http.StatusConflict {
+		t.Errorf("Expected a conflict in test mode, got status %d", code)
+	}
+	if metrics := gather(t, exporter); strings.Contains(metrics, "speedtest_soak_") {
+		t.Errorf("Expected no soak metrics in test mode, got:\n%s", metrics)
+	}
+}
+
+func TestSoakDataCap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exporter := newExporter(ctx, nil, defaultConfig().Metrics)
+	report := speedtest.SoakReport{Elapsed: time.Second, DownloadBytes: 400, UploadBytes: 200, Download: 0.0032, Upload: 0.0016}
+	client := &fakeClient{soakReports: []speedtest.SoakReport{report, report, report}}
+	exporter.SetDailyCap(1000)
+	exporter.SetMode(modeSoak, SoakConfig{DownloadRate: 1000, Interval: 10 * time.Millisecond})
+	exporter.SetClient(client)
+	go exporter.run()
+
+	// The soak test stops once past the cap, its reports counting
+	waitForMetric(t, exporter, "speedtest_soak_paused 1\n")
+	metrics := gather(t, exporter)
+	for _, line := range []string{
+		"speedtest_daily_cap_used_bytes 1200\n",
+		"speedtest_soak_download 0\n",
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %s, got:\n%s", line, metrics)
+		}
+	}
+}
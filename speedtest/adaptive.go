@@ -0,0 +1,167 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// adaptiveDuration is the duration targeted by the adaptive download
+	// phase when it isn't bounded
+	adaptiveDuration = 10 * time.Second
+	// probeDuration is the duration of a probe transfer long enough to
+	// estimate the bandwidth, and maxProbes the number of probe transfers
+	// run to reach it
+	probeDuration = 250 * time.Millisecond
+	maxProbes     = 3
+	// requestsPerStream is the number of requests each stream of an
+	// adaptive download phase runs, so the phase doesn't hinge on a single
+	// request
+	requestsPerStream = 4
+	// maxPlanRequests caps the requests of an adaptive download phase
+	maxPlanRequests = 1000
+)
+
+// imageBytes are the sizes (bytes) of the random images of the Speedtest
+// servers, by image size
+var imageBytes = map[int]int64{
+	350:  245388,
+	500:  505544,
+	750:  1118012,
+	1000: 1986284,
+	1500: 4468241,
+	2000: 7907740,
+	2500: 12407926,
+	3000: 17816816,
+	3500: 24262167,
+	4000: 31625365,
+}
+
+// ImageBytes returns the expected size (bytes) of the random image of the
+// given size. The images of unknown sizes are assumed to be as dense as the
+// others.
+func ImageBytes(size int) int64 {
+	if n, ok := imageBytes[size]; ok {
+		return n
+	}
+	return 2 * int64(size) * int64(size)
+}
+
+// DownloadPlan is the image size and number of requests of an adaptive
+// download phase
+type DownloadPlan struct {
+	// Estimate is the bandwidth (Mbps) estimated by the probe transfers
+	Estimate float64
+	Size     int
+	Requests int
+}
+
+// NextProbeSize returns the size of the next probe transfer after one of
+// the given size took elapsed for bytes, among sizes sorted in ascending
+// order: the smallest one expected to last probeDuration at the estimated
+// bandwidth. False is returned when the probe was long enough, or there is
+// no larger size.
+func NextProbeSize(size int, bytes int64, elapsed time.Duration, sizes []int) (int, bool) {
+	if elapsed >= probeDuration || bytes <= 0 {
+		return 0, false
+	}
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+	wanted := float64(bytes) * probeDuration.Seconds() / elapsed.Seconds()
+	next := 0
+	for _, s := range sizes {
+		if s <= size {
+			continue
+		}
+		next = s
+		if float64(ImageBytes(s)) >= wanted {
+			break
+		}
+	}
+	return next, next != 0
+}
+
+// PlanDownload returns the plan of a download phase over streams lasting
+// about target at the estimated bandwidth (Mbps): the largest size among
+// sizes each stream can download requestsPerStream times, and the number
+// of requests it takes. The smallest size is chosen when even it is too
+// large.
+func PlanDownload(estimate float64, target time.Duration, streams int, sizes []int) DownloadPlan {
+	plan := DownloadPlan{Estimate: estimate}
+	if len(sizes) == 0 {
+		return plan
+	}
+	if streams < 1 {
+		streams = 1
+	}
+	sorted := append([]int(nil), sizes...)
+	sort.Ints(sorted)
+	total := estimate * 1000 * 1000 / 8 * target.Seconds()
+	perRequest := total / float64(streams*requestsPerStream)
+	plan.Size = sorted[0]
+	for _, size := range sorted {
+		if float64(ImageBytes(size)) <= perRequest {
+			plan.Size = size
+		}
+	}
+	plan.Requests = int(math.Round(total / float64(ImageBytes(plan.Size))))
+	if plan.Requests < streams {
+		plan.Requests = streams
+	}
+	if plan.Requests > maxPlanRequests {
+		plan.Requests = maxPlanRequests
+	}
+	return plan
+}
+
+// planDownload runs probe transfers of increasing sizes until one lasts
+// long enough to estimate the bandwidth, and plans the download phase from
+// it. The probe transfers are not part of the measurement.
+func (client *Client) planDownload(ctx context.Context, sizes []int, request func(ctx context.Context, size int, m *meter) (int64, error)) (DownloadPlan, error) {
+	sorted := append([]int(nil), sizes...)
+	sort.Ints(sorted)
+	size := sorted[0]
+	var n int64
+	var elapsed time.Duration
+	for i := 0; i < maxProbes; i++ {
+		start := time.Now()
+		var err error
+		n, err = client.retry(ctx, PhaseDownload, nil, func() (int64, error) {
+			return request(ctx, size, nil)
+		})
+		elapsed = time.Since(start)
+		if err != nil {
+			return DownloadPlan{}, err
+		}
+		next, ok := NextProbeSize(size, n, elapsed, sorted)
+		if !ok {
+			break
+		}
+		size = next
+	}
+	target := client.DownloadDuration
+	if target <= 0 {
+		target = adaptiveDuration
+	}
+	plan := PlanDownload(mbps(n, elapsed), target, client.streams(PhaseDownload), sorted)
+	loggerFrom(ctx).Debug("Download plan", "probe_size", size, "probe_bytes", n, "probe_duration", elapsed,
+		"estimate_mbps", plan.Estimate, "target", target, "size", plan.Size, "requests", plan.Requests)
+	return plan, nil
+}
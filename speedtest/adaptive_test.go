@@ -0,0 +1,96 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanDownload(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		estimate float64
+		streams  int
+		sizes    []int
+		size     int
+		requests int
+	}{
+		{"100 Mbps", 100, 1, DownloadSizes, 3500, 5},
+		{"1 Mbps", 1, 1, DownloadSizes, 350, 5},
+		{"slower than the smallest size", 0.1, 1, DownloadSizes, 350, 1},
+		{"parallel streams", 1000, 4, DownloadSizes, 4000, 40},
+		{"capped requests", 100000, 1, DownloadSizes, 4000, maxPlanRequests},
+		{"restricted sizes", 100, 1, []int{750, 350}, 750, 112},
+		{"no sizes", 100, 1, nil, 0, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			plan := PlanDownload(tc.estimate, 10*time.Second, tc.streams, tc.sizes)
+			if plan.Size != tc.size || plan.Requests != tc.requests || plan.Estimate != tc.estimate {
+				t.Errorf("Expected %d requests of size %d, got %+v", tc.requests, tc.size, plan)
+			}
+		})
+	}
+}
+
+func TestNextProbeSize(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		size    int
+		bytes   int64
+		elapsed time.Duration
+		next    int
+	}{
+		{"long enough", 350, 245388, 300 * time.Millisecond, 0},
+		{"fast", 350, 245388, 10 * time.Millisecond, 2000},
+		{"slightly short", 350, 245388, 100 * time.Millisecond, 750},
+		{"largest size", 4000, 31625365, 10 * time.Millisecond, 0},
+		{"instant", 350, 245388, 0, 4000},
+		{"empty", 350, 0, 10 * time.Millisecond, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			next, ok := NextProbeSize(tc.size, tc.bytes, tc.elapsed, DownloadSizes)
+			if next != tc.next || ok != (tc.next != 0) {
+				t.Errorf("Expected %d, got %d (%t)", tc.next, next, ok)
+			}
+		})
+	}
+}
+
+func TestAdaptiveDownload(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.AdaptiveDownload = true
+	client.DownloadDuration = 200 * time.Millisecond
+	var buf strings.Builder
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	measurements, err := client.Measure(WithLogger(context.Background(), logger), PhaseDownload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := measurements[PhaseDownload]; m.Bytes == 0 || m.Value <= 0 {
+		t.Errorf("Expected the download bandwidth, got %+v", m)
+	}
+	if logs := buf.String(); !strings.Contains(logs, "Download plan") || !strings.Contains(logs, "estimate_mbps=") {
+		t.Errorf("Expected the download plan to be logged, got:\n%s", logs)
+	}
+}
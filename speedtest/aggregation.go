@@ -0,0 +1,249 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// AggregationSimple computes the bandwidth of a transfer phase from all
+	// the bytes transferred over its whole duration
+	AggregationSimple = "simple"
+	// AggregationStableWindow computes the bandwidth of a transfer phase
+	// from its stable portion, leaving out the TCP ramp-up
+	AggregationStableWindow = "stable-window"
+	// AggregationOokla computes the bandwidth of a transfer phase as the
+	// Ookla clients do, from its fastest slices and streams
+	AggregationOokla = "ookla"
+
+	// PingAggregationMin reports the lowest round trip time of the ping
+	// phase, close to what Ookla reports
+	PingAggregationMin = "min"
+	// PingAggregationMean reports the mean round trip time
+	PingAggregationMean = "mean"
+	// PingAggregationMedian reports the median round trip time, the least
+	// sensitive to outliers
+	PingAggregationMedian = "median"
+
+	// sampleInterval is the interval at which the throughput of the
+	// transfer phases is sampled
+	sampleInterval = 100 * time.Millisecond
+	// rampUpFraction is the fraction of a transfer phase left out by
+	// AggregationStableWindow
+	rampUpFraction = 0.2
+	// minStableSamples is the number of samples below which
+	// AggregationStableWindow falls back to AggregationSimple
+	minStableSamples = 5
+
+	// ooklaSlices is the number of slices of equal duration the transfer
+	// phases are cut into by AggregationOokla, of which the slowest
+	// ooklaSlowSlices and fastest ooklaFastSlices are left out
+	ooklaSlices     = 20
+	ooklaSlowSlices = 0.3
+	ooklaFastSlices = 0.1
+	// ooklaStarvedStream is the share of the median bytes of the streams
+	// below which AggregationOokla leaves a stream out
+	ooklaStarvedStream = 0.25
+)
+
+// Sample is the number of bytes transferred since the start of a transfer
+// phase, after Elapsed
+type Sample struct {
+	Elapsed time.Duration
+	Bytes   int64
+}
+
+// StableThroughput returns the bandwidth (Mbps) of a transfer phase over
+// its stable portion, given its samples in chronological order: the first
+// samples, up to rampUpFraction of the phase, are the TCP ramp-up and are
+// left out. The bandwidth over the whole phase is returned when there are
+// too few samples to tell.
+func StableThroughput(samples []Sample) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	last := samples[len(samples)-1]
+	if last.Elapsed <= 0 {
+		return 0
+	}
+	if len(samples) < minStableSamples {
+		return mbps(last.Bytes, last.Elapsed)
+	}
+	cutoff := time.Duration(float64(last.Elapsed) * rampUpFraction)
+	for _, sample := range samples {
+		if sample.Elapsed >= cutoff {
+			if window := last.Elapsed - sample.Elapsed; window > 0 {
+				return mbps(last.Bytes-sample.Bytes, window)
+			}
+			break
+		}
+	}
+	return mbps(last.Bytes, last.Elapsed)
+}
+
+// OoklaThroughput returns the bandwidth (Mbps) of a transfer phase computed
+// as the Ookla clients do, given the samples of each of its streams in
+// chronological order, all sampled at the same times:
+//
+//  1. the streams that transferred less than ooklaStarvedStream of the
+//     median bytes of the streams, starved or stalled, are left out
+//  2. the phase is cut into ooklaSlices slices of equal duration, the
+//     bytes of the remaining streams being interpolated between the
+//     samples at their boundaries
+//  3. the slowest ooklaSlowSlices of the slices, the TCP ramp-up and the
+//     congestion backoffs, and the fastest ooklaFastSlices, the bursts,
+//     are left out
+//  4. the bandwidth is the mean throughput of the remaining slices
+func OoklaThroughput(streams [][]Sample) float64 {
+	if len(streams) == 0 || len(streams[0]) == 0 {
+		return 0
+	}
+	elapsed := streams[0][len(streams[0])-1].Elapsed
+	if elapsed <= 0 {
+		return 0
+	}
+
+	totals := make([]float64, len(streams))
+	for i, samples := range streams {
+		totals[i] = float64(samples[len(samples)-1].Bytes)
+	}
+	sorted := append([]float64{}, totals...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + median) / 2
+	}
+	combined := make([]Sample, len(streams[0]))
+	for i, samples := range streams {
+		if totals[i] < median*ooklaStarvedStream {
+			continue
+		}
+		for j, sample := range samples {
+			combined[j].Elapsed = sample.Elapsed
+			combined[j].Bytes += sample.Bytes
+		}
+	}
+
+	// bytesAt interpolates the bytes of the remaining streams after t,
+	// from none at the start of the phase
+	bytesAt := func(t time.Duration) float64 {
+		previous := Sample{}
+		for _, sample := range combined {
+			if sample.Elapsed >= t {
+				span := sample.Elapsed - previous.Elapsed
+				if span <= 0 {
+					return float64(sample.Bytes)
+				}
+				return float64(previous.Bytes) + float64(sample.Bytes-previous.Bytes)*float64(t-previous.Elapsed)/float64(span)
+			}
+			previous = sample
+		}
+		return float64(previous.Bytes)
+	}
+	slice := elapsed / ooklaSlices
+	if slice <= 0 {
+		return mbps(combined[len(combined)-1].Bytes, elapsed)
+	}
+	rates := make([]float64, ooklaSlices)
+	for i := range rates {
+		start, end := slice*time.Duration(i), slice*time.Duration(i+1)
+		if i == ooklaSlices-1 {
+			end = elapsed
+		}
+		rates[i] = (bytesAt(end) - bytesAt(start)) * 8 / 1000 / 1000 / (end - start).Seconds()
+	}
+	sort.Float64s(rates)
+	kept := rates[int(ooklaSlices*ooklaSlowSlices) : ooklaSlices-int(ooklaSlices*ooklaFastSlices)]
+	sum := 0.0
+	for _, rate := range kept {
+		sum += rate
+	}
+	return sum / float64(len(kept))
+}
+
+// aggregation returns the aggregation of the client, defaulting to
+// AggregationSimple
+func (client *Client) aggregation() string {
+	if client.Aggregation == "" {
+		return AggregationSimple
+	}
+	return client.Aggregation
+}
+
+// AggregateLatency returns the latency of the round trip times of samples
+// aggregated with PingAggregationMin, PingAggregationMean or
+// PingAggregationMedian, 0 without samples
+func AggregateLatency(samples []float64, aggregation string) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	switch aggregation {
+	case PingAggregationMean:
+		sum := 0.0
+		for _, sample := range sorted {
+			sum += sample
+		}
+		return sum / float64(len(sorted))
+	case PingAggregationMedian:
+		middle := len(sorted) / 2
+		if len(sorted)%2 == 0 {
+			return (sorted[middle-1] + sorted[middle]) / 2
+		}
+		return sorted[middle]
+	default:
+		return sorted[0]
+	}
+}
+
+// StdDev returns the standard deviation of samples, 0 with less than two
+// samples
+func StdDev(samples []float64) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	mean := AggregateLatency(samples, PingAggregationMean)
+	sum := 0.0
+	for _, sample := range samples {
+		sum += (sample - mean) * (sample - mean)
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+// Jitter returns the mean difference between consecutive samples, 0 with
+// less than two samples
+func Jitter(samples []float64) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	sum := 0.0
+	for i := 1; i < len(samples); i++ {
+		sum += math.Abs(samples[i] - samples[i-1])
+	}
+	return sum / float64(len(samples)-1)
+}
+
+// pingAggregation returns the latency aggregation of the client,
+// defaulting to PingAggregationMin
+func (client *Client) pingAggregation() string {
+	if client.PingAggregation == "" {
+		return PingAggregationMin
+	}
+	return client.PingAggregation
+}
@@ -0,0 +1,157 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+// rampSamples returns the samples of a 10s transfer at 100 Mbps, starting
+// at 10 Mbps for its first rampUp
+func rampSamples(rampUp time.Duration) []Sample {
+	samples := []Sample{}
+	var bytes int64
+	for elapsed := sampleInterval; elapsed <= 10*time.Second; elapsed += sampleInterval {
+		rate := int64(100 * 1000 * 1000 / 8)
+		if elapsed <= rampUp {
+			rate /= 10
+		}
+		bytes += rate * int64(sampleInterval) / int64(time.Second)
+		samples = append(samples, Sample{Elapsed: elapsed, Bytes: bytes})
+	}
+	return samples
+}
+
+func TestStableThroughput(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		samples  []Sample
+		expected float64
+	}{
+		{"empty", nil, 0},
+		{"no elapsed time", []Sample{{0, 0}}, 0},
+		{"too few samples", []Sample{{time.Second, 1000 * 1000}, {2 * time.Second, 5 * 1000 * 1000}}, 20},
+		{"steady", rampSamples(0), 100},
+		{"ramp-up", rampSamples(time.Second), 100},
+		{"long ramp-up", rampSamples(4 * time.Second), 77.5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := StableThroughput(tc.samples); math.Abs(actual-tc.expected) > 0.01 {
+				t.Errorf("Expected %.2f Mbps, got %.2f", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestStableThroughputExceedsSimple(t *testing.T) {
+	samples := rampSamples(2 * time.Second)
+	last := samples[len(samples)-1]
+	simple := mbps(last.Bytes, last.Elapsed)
+	stable := StableThroughput(samples)
+	if stable <= simple {
+		t.Errorf("Expected the stable window (%.2f Mbps) to exceed the simple bandwidth (%.2f Mbps)", stable, simple)
+	}
+}
+
+// ooklaFixture is a test case of testdata/aggregation-ookla.json: the
+// cumulative bytes of each stream sampled every interval, and the expected
+// bandwidth of the Ookla and simple aggregations
+type ooklaFixture struct {
+	Name       string    `json:"name"`
+	IntervalMS int       `json:"interval_ms"`
+	Streams    [][]int64 `json:"streams"`
+	Expected   float64   `json:"expected_mbps"`
+	Simple     float64   `json:"simple_mbps"`
+}
+
+func TestOoklaThroughput(t *testing.T) {
+	var fixtures []ooklaFixture
+	if err := json.Unmarshal(readFixture(t, "aggregation-ookla.json"), &fixtures); err != nil {
+		t.Fatal(err)
+	}
+	for _, fixture := range fixtures {
+		t.Run(fixture.Name, func(t *testing.T) {
+			var streams [][]Sample
+			var total int64
+			var elapsed time.Duration
+			for _, bytes := range fixture.Streams {
+				samples := make([]Sample, len(bytes))
+				for i, n := range bytes {
+					samples[i] = Sample{Elapsed: time.Duration(i+1) * time.Duration(fixture.IntervalMS) * time.Millisecond, Bytes: n}
+				}
+				streams = append(streams, samples)
+				total += bytes[len(bytes)-1]
+				elapsed = samples[len(samples)-1].Elapsed
+			}
+			if actual := OoklaThroughput(streams); math.Abs(actual-fixture.Expected) > 1e-6 {
+				t.Errorf("Expected %.2f Mbps, got %.6f", fixture.Expected, actual)
+			}
+			// The fixtures tell the simple bandwidth the Ookla one departs
+			// from
+			simple := 0.0
+			if elapsed > 0 {
+				simple = mbps(total, elapsed)
+			}
+			if math.Abs(simple-fixture.Simple) > 1e-6 {
+				t.Errorf("Expected a simple bandwidth of %.2f Mbps, got %.6f", fixture.Simple, simple)
+			}
+		})
+	}
+}
+
+func TestAggregateLatency(t *testing.T) {
+	samples := []float64{12, 10, 30, 11, 13, 12}
+	for _, tc := range []struct {
+		aggregation string
+		samples     []float64
+		expected    float64
+	}{
+		{PingAggregationMin, samples, 10},
+		{"", samples, 10},
+		{PingAggregationMean, samples, 88.0 / 6},
+		{PingAggregationMedian, samples, 12},
+		{PingAggregationMedian, samples[:5], 12},
+		{PingAggregationMedian, []float64{10, 20}, 15},
+		{PingAggregationMean, nil, 0},
+	} {
+		if actual := AggregateLatency(tc.samples, tc.aggregation); math.Abs(actual-tc.expected) > 1e-9 {
+			t.Errorf("%q of %v: expected %.2f, got %.2f", tc.aggregation, tc.samples, tc.expected, actual)
+		}
+	}
+	if samples[0] != 12 {
+		t.Errorf("Expected the samples to be left unsorted, got %v", samples)
+	}
+}
+
+func TestStdDev(t *testing.T) {
+	if actual := StdDev([]float64{2, 4, 4, 4, 5, 5, 7, 9}); actual != 2 {
+		t.Errorf("Expected a standard deviation of 2, got %.2f", actual)
+	}
+	if actual := StdDev([]float64{10}); actual != 0 {
+		t.Errorf("Expected no deviation of a single sample, got %.2f", actual)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if actual := Jitter([]float64{10, 12, 9, 9, 13}); actual != 2.25 {
+		t.Errorf("Expected a jitter of 2.25, got %.2f", actual)
+	}
+	if actual := Jitter([]float64{10}); actual != 0 {
+		t.Errorf("Expected no jitter of a single sample, got %.2f", actual)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestBindToDevice(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{Transport: newTransport(t, TransportConfig{Interface: "lo"})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Measure(context.Background(), PhasePing)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("Binding to an interface is not permitted")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cacheSampleSize is the number of leading bytes of the download responses
+// compared by CheckCacheContent
+const cacheSampleSize = 64
+
+// cacheHeaders are the response headers of the caches telling a hit
+var cacheHeaders = []string{"X-Cache", "X-Cache-Status", "X-Proxy-Cache", "CF-Cache-Status"}
+
+// cachedHeader returns why the header of a download response suggests it
+// was served from a cache, empty if it doesn't: a positive Age, or a hit
+// in one of cacheHeaders
+func cachedHeader(header http.Header) string {
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		return fmt.Sprintf("Age: %d", age)
+	}
+	for _, name := range cacheHeaders {
+		if value := header.Get(name); strings.Contains(strings.ToLower(value), "hit") {
+			return name + ": " + value
+		}
+	}
+	return ""
+}
+
+// cacheDetector looks for the responses of a download phase served by a
+// transparent cache, with the checks enabled on the client. A nil
+// cacheDetector does nothing.
+type cacheDetector struct {
+	headers bool
+	content bool
+
+	mu sync.Mutex
+	// samples are the leading bytes of the first response of each URL,
+	// without its nonce
+	samples map[string][]byte
+	reason  string
+}
+
+// newCacheDetector returns the cacheDetector of the download phase, nil
+// when no check is enabled
+func (client *Client) newCacheDetector() *cacheDetector {
+	if !client.CheckCacheHeaders && !client.CheckCacheContent {
+		return nil
+	}
+	return &cacheDetector{headers: client.CheckCacheHeaders, content: client.CheckCacheContent, samples: map[string][]byte{}}
+}
+
+// sampleSize returns the number of leading bytes of the responses to
+// checkContent
+func (d *cacheDetector) sampleSize() int {
+	if d == nil || !d.content {
+		return 0
+	}
+	return cacheSampleSize
+}
+
+// checkHeaders checks the header of a response of url
+func (d *cacheDetector) checkHeaders(ctx context.Context, url string, header http.Header) {
+	if d == nil || !d.headers {
+		return
+	}
+	if reason := cachedHeader(header); reason != "" {
+		d.suspect(ctx, url, reason)
+	}
+}
+
+// checkContent checks the leading bytes of a response of url, the same as
+// the ones of a previous response of url being suspicious with payloads
+// generated at random for each request
+func (d *cacheDetector) checkContent(ctx context.Context, url string, sample []byte) {
+	if d == nil || !d.content || len(sample) == 0 {
+		return
+	}
+	d.mu.Lock()
+	previous, ok := d.samples[url]
+	if !ok {
+		d.samples[url] = sample
+	}
+	d.mu.Unlock()
+	if ok && bytes.Equal(previous, sample) {
+		d.suspect(ctx, url, "identical content")
+	}
+}
+
+// suspect records the first reason to suspect a cache, and logs it
+func (d *cacheDetector) suspect(ctx context.Context, url, reason string) {
+	d.mu.Lock()
+	first := d.reason == ""
+	if first {
+		d.reason = reason
+	}
+	d.mu.Unlock()
+	if first {
+		loggerFrom(ctx).Warn("Download suspected to be served from a cache", "url", url, "reason", reason)
+	}
+}
+
+// suspected returns why a cache is suspected, empty if it isn't
+func (d *cacheDetector) suspected() string {
+	if d == nil {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reason
+}
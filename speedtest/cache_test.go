@@ -0,0 +1,107 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCachedHeader(t *testing.T) {
+	for _, tc := range []struct {
+		header   http.Header
+		expected string
+	}{
+		{http.Header{}, ""},
+		{http.Header{"Age": {"0"}}, ""},
+		{http.Header{"Age": {"120"}}, "Age: 120"},
+		{http.Header{"Age": {"soon"}}, ""},
+		{http.Header{"X-Cache": {"HIT from proxy.isp.net"}}, "X-Cache: HIT from proxy.isp.net"},
+		{http.Header{"X-Cache": {"MISS from proxy.isp.net"}}, ""},
+		{http.Header{"Cf-Cache-Status": {"HIT"}}, "CF-Cache-Status: HIT"},
+		{http.Header{"Cf-Cache-Status": {"DYNAMIC"}}, ""},
+		{http.Header{"X-Cache-Status": {"hit"}}, "X-Cache-Status: hit"},
+	} {
+		if reason := cachedHeader(tc.header); reason != tc.expected {
+			t.Errorf("Expected %q for %v, got %q", tc.expected, tc.header, reason)
+		}
+	}
+}
+
+func TestCacheContent(t *testing.T) {
+	ctx := context.Background()
+	d := (&Client{CheckCacheContent: true}).newCacheDetector()
+	d.checkHeaders(ctx, "/random350x350.jpg", http.Header{"Age": {"120"}})
+	d.checkContent(ctx, "/random350x350.jpg", []byte("first"))
+	d.checkContent(ctx, "/random500x500.jpg", []byte("first"))
+	d.checkContent(ctx, "/random350x350.jpg", []byte("second"))
+	if reason := d.suspected(); reason != "" {
+		t.Fatalf("Expected no cache suspected, got %q", reason)
+	}
+	d.checkContent(ctx, "/random500x500.jpg", []byte("first"))
+	if reason := d.suspected(); reason != "identical content" {
+		t.Errorf("Expected the identical content to be suspected, got %q", reason)
+	}
+
+	if d := (&Client{}).newCacheDetector(); d != nil || d.sampleSize() != 0 || d.suspected() != "" {
+		t.Errorf("Expected no detector without checks, got %+v", d)
+	}
+}
+
+func TestDownloadCached(t *testing.T) {
+	var mu sync.Mutex
+	nonces := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		nonces[r.URL.Query().Get("x")] = true
+		mu.Unlock()
+		if r.Header.Get("Cache-Control") != "no-cache" || r.Header.Get("Pragma") != "no-cache" {
+			t.Errorf("Expected no-cache requests, got %v", r.Header)
+		}
+		w.Header().Set("Age", "3600")
+		w.Write(make([]byte, 1024))
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		headers, content bool
+		expected         string
+	}{
+		{false, false, ""},
+		{true, false, "Age: 3600"},
+		{false, true, "identical content"},
+	} {
+		client, err := NewMiniClient(server.URL+"/", Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.DownloadSizes = []int{350, 350}
+		client.CheckCacheHeaders = tc.headers
+		client.CheckCacheContent = tc.content
+		measurements, err := client.Measure(context.Background(), PhaseDownload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := measurements[PhaseDownload]; m.CacheChecked != (tc.headers || tc.content) || m.CacheSuspected != (tc.expected != "") || m.CacheReason != tc.expected {
+			t.Errorf("Expected the cache reason %q with checks %t and %t, got %t and %q", tc.expected, tc.headers, tc.content, m.CacheSuspected, m.CacheReason)
+		}
+	}
+	if len(nonces) != 6 || nonces[""] {
+		t.Errorf("Expected a different nonce on each download, got %v", nonces)
+	}
+}
@@ -15,92 +15,655 @@
 package speedtest
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
 	"time"
+)
 
-	"github.com/prometheus/common/log"
-	"github.com/zpeters/speedtest/print"
-	"github.com/zpeters/speedtest/sthttp"
-	"github.com/zpeters/speedtest/tests"
+// Test phases
+const (
+	PhaseDownload = "download"
+	PhaseUpload   = "upload"
+	PhasePing     = "ping"
 )
 
 const (
 	userAgent = "speedtest_exporter"
+
+	httpTimeout     = 5 * time.Minute
+	numClosest      = 3
+	numLatencyTests = 5
+	// maxRedirects caps the redirects of the configuration and server list
+	// requests
+	maxRedirects = 5
+	// maxErrorBody bounds the error pages drained from the test servers
+	maxErrorBody = 64 * 1024
 )
 
 // Client defines the Speedtest client
 type Client struct {
-	Server          sthttp.Server
-	SpeedtestClient *sthttp.Client
-	AllServers      []sthttp.Server
-	ClosestServers  []sthttp.Server
+	Server         Server
+	Config         *ClientInfo
+	AllServers     []Server
+	ClosestServers []Server
+	// Parameters are the test parameters recommended by the Speedtest
+	// configuration, nil without any or for Speedtest Mini servers. They
+	// are left to the caller to apply.
+	Parameters *ServerParameters
+	// Streams is the number of parallel connections used by the download
+	// and upload tests. A single connection is used when not set.
+	Streams int
+	// DownloadStreams and UploadStreams, when set, override Streams for
+	// one direction
+	DownloadStreams int
+	UploadStreams   int
+	// DownloadDuration and UploadDuration, when set, bound the transfer
+	// phases, the sizes being requested in turn until their end. Each size
+	// is requested once otherwise.
+	DownloadDuration time.Duration
+	UploadDuration   time.Duration
+	// DownloadSizes are the sizes of the random images requested by the
+	// download phase, among DownloadSizes, all of them when not set
+	DownloadSizes []int
+	// AdaptiveDownload, when set, picks the size and number of the images
+	// downloaded from a quick probe transfer, so the download phase lasts
+	// about DownloadDuration, or 10 seconds when not set
+	AdaptiveDownload bool
+	// UploadMaxBytes, when set, caps the volume of the upload phase.
+	// UploadChunkSize, when set, is the size of every upload payload,
+	// UploadSizes otherwise the sizes of the payloads requested in turn.
+	UploadMaxBytes  int64
+	UploadChunkSize int
+	UploadSizes     []int
+	// UploadFormat is the encoding of the upload payloads: UploadFormatAuto,
+	// the default, UploadFormatForm or UploadFormatRaw
+	UploadFormat string
+	// UploadPayload is the content of the upload payloads:
+	// UploadPayloadRandom, the default, or UploadPayloadZero
+	UploadPayload string
+	// CheckCacheHeaders and CheckCacheContent, when set, look for the
+	// download responses served by a transparent cache: from their Age and
+	// cache status headers, and from the leading bytes of the responses of
+	// an image size being the same, for the servers generating random
+	// images. A suspected cache is reported by Measurement.CacheSuspected.
+	CheckCacheHeaders bool
+	CheckCacheContent bool
+	// PingSamples is the number of latency samples of a server, 5 when not
+	// set, aggregated by PingAggregation, PingAggregationMin when not set.
+	// They apply to the server selection and to the ping phase.
+	PingSamples     int
+	PingAggregation string
+	// ReadTimeout, when set, aborts the requests transferring no data for
+	// that long. A stalled stream of a transfer phase is abandoned, the
+	// phase failing when all of them stalled.
+	ReadTimeout time.Duration
+	// Retries is the number of times the requests of the phases failing
+	// with transient errors, such as connection resets, are retried.
+	// OnRetry, if set, is called on each retry.
+	Retries int
+	OnRetry func(phase string, err error)
+	// OnRequest, if set, is called on each response to the requests of
+	// the phases with its status code, and on each request failing without
+	// response with 0. The requests interrupted by their context, such as
+	// those of the transfer phases when they end, are not reported.
+	OnRequest func(phase string, status int)
+	// OnEncodedResponse, if set, is called on each successful response of
+	// the phases with a content encoding, with its lowercase name or
+	// other. Those bodies are measured as received, not decoded, but the
+	// encoding may overstate the bandwidth the test was meant to measure.
+	OnEncodedResponse func(phase string, encoding string)
+	// OnParseWarning, if set, is called with each part of the Speedtest
+	// configuration or server list ignored or defaulted by the parse, by
+	// document: DocumentConfig or DocumentServers
+	OnParseWarning func(document string, warning string)
+	// Trace, when set, is called at the start of each step of the client:
+	// its setup (StepSetup and its children StepConfig, StepServers and
+	// StepSelection), the retrieval of FetchClientInfo and the phases. It
+	// returns the context the step runs with, e.g. carrying its span, and
+	// the function called with the outcome of the step at its end.
+	Trace func(ctx context.Context, step string) (context.Context, func(Step))
+	// VerifyInterface, when set, is the network interface whose kernel
+	// counters are read before and after the transfer phases, so their
+	// bytes can be checked against the traffic of the host. Only supported
+	// on Linux, the counters being left out elsewhere or when they can't
+	// be read.
+	VerifyInterface string
+	// CPUThreshold, when set, samples the CPU usage of the host during the
+	// transfer phases, which are CPU limited when the busy share of the
+	// CPUs reached it, from 0 to 1, for most of the phase. Only supported
+	// on Linux, the usage being left out elsewhere.
+	CPUThreshold float64
+	// BufferSize is the size of the buffers the response bodies of the
+	// download phase are read through, 32KiB when not set
+	BufferSize int
+	// FreshConnections, when set, closes the idle connections of the
+	// transport before each phase, so each one dials its own connections.
+	// They are reused across phases otherwise.
+	FreshConnections bool
+	// RateLimit, when set, caps the bandwidth (bits per second) of the
+	// transfer phases, leaving room for other traffic
+	RateLimit int64
+	// Aggregation is how the bandwidth of the transfer phases is computed
+	// from their throughput samples, AggregationSimple when not set
+	Aggregation string
+	// Duplex, when set, runs the download and upload phases at once rather
+	// than one after the other, when both are run. They then share the
+	// longest of DownloadDuration and UploadDuration.
+	Duplex bool
+	// Hops, when set, counts the hops to the server before the phases,
+	// with CountHops. Its connections are bound to the source address and
+	// interface of HopsTransport.
+	Hops          bool
+	HopsTransport TransportConfig
+	// Share, when set, submits the results of Run to the speedtest.net API
+	// at ShareURL, or DefaultShareURL, with ShareResult. Only the complete
+	// results of speedtest.net servers are submitted.
+	Share    bool
+	ShareURL string
+
+	http      *http.Client
+	auth      *Auth
+	userAgent string
+	header    http.Header
+	host      string
+	// configURL is the Speedtest configuration URL, or the comma separated
+	// URLs of its mirrors, empty for Speedtest Mini servers
+	configURL string
+	// fetchTimeout bounds each attempt at retrieving the configuration or
+	// server list
+	fetchTimeout time.Duration
+	// clientLocation overrides the coordinates of the configuration, when
+	// set
+	clientLocation *Coordinates
+	// probes are the latency probes of the server selection, by server
+	// URL
+	probes map[string]latencyProbe
+	// uploadFormat is the upload format detected in UploadFormatAuto
+	// mode, nil until an upload succeeds
+	uploadFormat atomic.Pointer[string]
+}
+
+// Auth defines the credentials sent to the test server. Either the basic
+// auth credentials or the bearer token are used, the token taking
+// precedence.
+type Auth struct {
+	Username    string
+	Password    string
+	BearerToken string
+}
+
+func (auth *Auth) apply(req *http.Request) {
+	if auth == nil {
+		return
+	}
+	if auth.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+auth.BearerToken)
+	} else if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+}
+
+// Options defines how a client reaches the Speedtest servers
+type Options struct {
+	// Auth, if not nil, is sent to the test servers
+	Auth *Auth
+	// Transport carries every request of the client. A transport using the
+	// proxy of the environment is shared by the clients created without
+	// one. Tests may substitute their own.
+	Transport http.RoundTripper
+	// UserAgent replaces the default User-Agent of the requests
+	UserAgent string
+	// Host, if set, replaces the host of the URLs in the Host header of
+	// every request, e.g. for a Speedtest Mini server reached by address,
+	// along with TransportConfig.ServerName
+	Host string
+	// Header is added to every request, including the configuration and
+	// server list retrieval
+	Header http.Header
+	// FetchTimeout bounds each attempt at retrieving the configuration or
+	// server list, from each of their URLs. The HTTP timeout applies when
+	// not set.
+	FetchTimeout time.Duration
+	// ClientLocation, if set, replaces the coordinates of the client from
+	// the configuration, located by the GeoIP of its address which is off
+	// behind a VPN or a carrier-grade NAT, before the servers are sorted
+	// by distance. 0,0 is a valid location.
+	ClientLocation *Coordinates
+	// PingSamples and PingAggregation set the Client fields of the same
+	// name, already applied to the server selection
+	PingSamples     int
+	PingAggregation string
+	// OnRetry, OnRequest, OnEncodedResponse, OnParseWarning and Trace set
+	// the Client fields of the same name, Trace already tracing the setup
+	OnRetry           func(phase string, err error)
+	OnRequest         func(phase string, status int)
+	OnEncodedResponse func(phase string, encoding string)
+	OnParseWarning    func(document string, warning string)
+	Trace             func(ctx context.Context, step string) (context.Context, func(Step))
+
+	// The following options only apply to Run.
+	//
+	// ConfigURL and ServersURL replace DefaultConfigURL and
+	// DefaultServersURL, with mirrors as in NewFilteredClient. MiniURL, when set, runs the test against the
+	// Speedtest Mini server of that URL instead, as NewMiniClient.
+	ConfigURL  string
+	ServersURL string
+	MiniURL    string
+	// Filter restricts the servers the test server is selected from
+	Filter ServerFilter
+	// Phases are the phases run, all of them when not set
+	Phases []string
+	// Configure, if set, is called with the client before the phases run,
+	// to change its settings
+	Configure func(client *Client)
+}
+
+// setHeaders sets the headers common to every request
+func (client *Client) setHeaders(req *http.Request) {
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Pragma", "no-cache")
+	if client.userAgent != "" {
+		req.Header.Set("User-Agent", client.userAgent)
+	} else {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	for name, values := range client.header {
+		req.Header[name] = values
+	}
+	if client.host != "" {
+		req.Host = client.host
+	}
+}
+
+func newHTTPClient(transport http.RoundTripper) *http.Client {
+	if transport == nil {
+		transport = defaultTransport
+	}
+	return &http.Client{
+		Timeout:       httpTimeout,
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// testRequestKey marks the context of the test requests, which must not be
+// redirected
+type testRequestKey struct{}
+
+// checkRedirect rejects the redirects of the test requests, and caps those
+// of the other requests at maxRedirects
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if via[0].Context().Value(testRequestKey{}) != nil || len(via) >= maxRedirects {
+		return &RedirectError{URL: via[len(via)-1].URL.String(), Location: req.URL.String()}
+	}
+	return nil
 }
 
 // NewClient defines a new client for Speedtest
 func NewClient(configURL string, serversURL string) (*Client, error) {
-	log.Debugf("New Speedtest client %s %s", configURL, serversURL)
-	stClient := sthttp.NewClient(
-		&sthttp.SpeedtestConfig{
-			ConfigURL:       configURL,
-			ServersURL:      serversURL,
-			AlgoType:        "max",
-			NumClosest:      3,
-			NumLatencyTests: 5,
-			Interface:       "",
-			Blacklist:       []string{},
-			UserAgent:       userAgent,
-		},
-		&sthttp.HTTPConfig{
-			HTTPTimeout: 5 * time.Minute,
-		},
-		true,
-		"|")
+	return newClient(context.Background(), configURL, serversURL, ServerFilter{}, Options{})
+}
+
+// NewFilteredClient defines a new client for Speedtest testing the fastest
+// of the servers matching the filter. configURL and serversURL may list
+// comma separated URLs, tried in order until one answers. ctx bounds the
+// configuration and server list retrieval, mirrors included, and the
+// server selection. The credentials of opts
+// are sent to the test servers, including during server selection, but
+// never to the Speedtest configuration and server list URLs.
+func NewFilteredClient(ctx context.Context, configURL string, serversURL string, filter ServerFilter, opts Options) (*Client, error) {
+	return newClient(ctx, configURL, serversURL, filter, opts)
+}
+
+func newClient(ctx context.Context, configURL string, serversURL string, filter ServerFilter, opts Options) (*Client, error) {
+	loggerFrom(ctx).Debug("New Speedtest client", "config_url", configURL, "servers_url", serversURL)
+	client := &Client{
+		http:      newHTTPClient(opts.Transport),
+		auth:      opts.Auth,
+		userAgent: opts.UserAgent,
+		header:    opts.Header,
+		host:      opts.Host,
+		configURL: configURL,
+
+		fetchTimeout:   opts.FetchTimeout,
+		clientLocation: opts.ClientLocation,
 
-	log.Debug("Retrieve configuration")
-	config, err := stClient.GetConfig()
+		PingSamples:       opts.PingSamples,
+		PingAggregation:   opts.PingAggregation,
+		OnRetry:           opts.OnRetry,
+		OnRequest:         opts.OnRequest,
+		OnEncodedResponse: opts.OnEncodedResponse,
+		OnParseWarning:    opts.OnParseWarning,
+		Trace:             opts.Trace,
+	}
+	ctx, end := client.trace(ctx, StepSetup)
+	err := client.setup(ctx, configURL, serversURL, filter)
 	if err != nil {
+		end(Step{Err: err})
 		return nil, err
 	}
-	stClient.Config = &config
+	end(Step{Server: &client.Server})
+	return client, nil
+}
 
-	print.EnvironmentReport(stClient)
+// setup retrieves the Speedtest configuration and server list, and selects
+// the test server among the servers matching filter
+func (client *Client) setup(ctx context.Context, configURL string, serversURL string, filter ServerFilter) error {
+	loggerFrom(ctx).Debug("Retrieve configuration")
+	config, parameters, err := client.getConfig(ctx, configURL)
+	if err != nil {
+		return err
+	}
+	client.Config, client.Parameters = config, parameters
+	if parameters != nil {
+		loggerFrom(ctx).Debug("Speedtest test parameters", "parameters", *parameters)
+	}
+	loggerFrom(ctx).Debug("Speedtest client", "ip", config.IP, "isp", config.ISP, "lat", config.Lat, "lon", config.Lon, "location", client.locationSource())
 
-	log.Debugf("Retrieve all servers")
-	var allServers []sthttp.Server
-	allServers, err = stClient.GetServers()
+	loggerFrom(ctx).Debug("Retrieve all servers")
+	client.AllServers, err = client.getServers(ctx, serversURL)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	servers := filter.apply(client.AllServers)
+	if len(servers) == 0 {
+		return fmt.Errorf("No Speedtest server matches %s", filter)
+	}
+	client.ClosestServers = closestServers(config, servers)
+	loggerFrom(ctx).Debug("Selecting the test server", "servers", len(servers))
+	selectionCtx, end := client.trace(ctx, StepSelection)
+	client.Server, err = client.fastestServer(selectionCtx, client.ClosestServers)
+	if err != nil {
+		end(Step{Err: err})
+		return err
+	}
+	end(Step{Server: &client.Server})
+	loggerFrom(ctx).Debug("Test server", "server_id", client.Server.ID, "sponsor", client.Server.Sponsor, "name", client.Server.Name, "url", client.Server.URL)
+	return nil
+}
+
+// NewMiniClient defines a new client for a self-hosted Speedtest Mini server.
+// baseURL is the directory holding the Mini test files (upload.php,
+// latency.txt and the random images). The public Speedtest configuration
+// and server list are not used. The credentials of opts, if any, are sent
+// with every request.
+func NewMiniClient(baseURL string, opts Options) (*Client, error) {
+	slog.Debug("New Speedtest Mini client", "url", baseURL)
+	if baseURL == "" {
+		return nil, fmt.Errorf("Speedtest Mini URL is empty")
+	}
+	if baseURL[len(baseURL)-1] != '/' {
+		baseURL += "/"
+	}
+	client := &Client{
+		Server: Server{
+			URL:  baseURL + "upload.php",
+			Name: "Speedtest Mini",
+			ID:   "mini",
+		},
+		http:      newHTTPClient(opts.Transport),
+		auth:      opts.Auth,
+		userAgent: opts.UserAgent,
+		header:    opts.Header,
+		host:      opts.Host,
+
+		PingSamples:       opts.PingSamples,
+		PingAggregation:   opts.PingAggregation,
+		OnRetry:           opts.OnRetry,
+		OnRequest:         opts.OnRequest,
+		OnEncodedResponse: opts.OnEncodedResponse,
+		OnParseWarning:    opts.OnParseWarning,
+		Trace:             opts.Trace,
 	}
+	slog.Debug("Test server", "url", client.Server.URL)
+	return client, nil
+}
+
+// StreamMeasurement is the outcome of a stream of a transfer phase
+type StreamMeasurement struct {
+	// Value is the bandwidth (Mbps) of the stream over the phase, zero when
+	// failed
+	Value float64
+	Bytes int64
+	// Errors is the number of failed requests of the stream, retried or
+	// not, and Failed tells whether the stream was abandoned on error
+	Errors int
+	Failed bool
+}
+
+// Measurement is the outcome of a test phase
+type Measurement struct {
+	// Value is the bandwidth (Mbps) of the download and upload phases, or
+	// the latency (ms) of the ping phase
+	Value    float64
+	Duration time.Duration
+	// Bytes is the amount of data transferred, excluding protocol overhead
+	Bytes int64
+	// Streams is the number of connections that transferred data during
+	// the download and upload phases
+	Streams int
+	// PerStream are the outcomes of each stream of the download and upload
+	// phases, in the order they were started
+	PerStream []StreamMeasurement
+	// Samples are the round trip times (ms) of the ping phase, StdDev their
+	// standard deviation and Jitter their mean variation
+	Samples []float64
+	StdDev  float64
+	Jitter  float64
+	// RateLimit is the rate limit (Mbps) of the download and upload phases,
+	// if any, and RateLimited tells whether it throttled them
+	RateLimit   float64
+	RateLimited bool
+	// CacheChecked tells whether the responses of the download phase were
+	// checked for a transparent cache, and CacheSuspected whether they
+	// seemed served by one, for CacheReason
+	CacheChecked   bool
+	CacheSuspected bool
+	CacheReason    string
+	// Connection describes the first connection established by the
+	// download and upload phases, nil if none
+	Connection *ConnectionInfo
+	// Interface is the traffic of VerifyInterface during the download and
+	// upload phases, nil when not verified, and CPU the CPU usage
+	// meanwhile, nil when not sampled. The duplex phases share them.
+	Interface *InterfaceBytes
+	CPU       *CPUUsage
+}
 
-	closestServers := stClient.GetClosestServers(allServers)
-	// log.Infof("Closest Servers: %s", closestServers)
-	testServer := stClient.GetFastestServer(closestServers)
-	log.Infof("Test server: %s", testServer)
+// Result is the outcome of a test
+type Result struct {
+	// Ping is the latency (ms) and Jitter the mean variation of its samples
+	Ping   float64
+	Jitter float64
+	// Download and Upload are the bandwidths (Mbps), and BytesDown and
+	// BytesUp the amounts of data they transferred
+	Download  float64
+	Upload    float64
+	BytesDown int64
+	BytesUp   int64
+	// Server is the server the test ran against
+	Server     Server
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Hops is the number of hops to the server, zero when not counted
+	Hops int
+	// Duplex tells whether the download and upload phases ran at once
+	Duplex bool
+	// ShareURL is the URL of the image of the result on speedtest.net,
+	// when shared, and ShareErr the reason it couldn't be. A failed
+	// submission doesn't fail the test.
+	ShareURL string
+	ShareErr error
+	// Phases holds the details of the phases that completed, by phase.
+	// The fields of the others are zero.
+	Phases map[string]Measurement
+	// Succeeded tells whether each phase run succeeded, by phase. The
+	// phases not run, including those following a failed one, are absent.
+	Succeeded map[string]bool
+	// Parameters are the settings of the transfer phases in force
+	Parameters TransferParameters
+}
+
+// Run runs the given phases, or all of them if none is given, against the
+// selected server. If a phase fails, the result of the previous ones is
+// returned with a *PhaseError.
+func (client *Client) Run(ctx context.Context, phases ...string) (*Result, error) {
+	result := &Result{Server: client.Server, StartedAt: time.Now(), Parameters: client.transferParameters()}
+	if client.Hops {
+		hops, err := client.CountHops(ctx)
+		if err != nil {
+			loggerFrom(ctx).Debug("Can't count the hops to the server", "err", err)
+		} else {
+			loggerFrom(ctx).Debug("Speedtest hops", "hops", hops)
+			result.Hops = hops
+		}
+	}
+	measurements, err := client.Measure(ctx, phases...)
+	result.FinishedAt = time.Now()
+	result.Duplex = client.runsDuplex(phases)
+	result.Phases = measurements
+	result.Ping = measurements[PhasePing].Value
+	result.Jitter = measurements[PhasePing].Jitter
+	result.Download = measurements[PhaseDownload].Value
+	result.BytesDown = measurements[PhaseDownload].Bytes
+	result.Upload = measurements[PhaseUpload].Value
+	result.BytesUp = measurements[PhaseUpload].Bytes
+	result.Succeeded = map[string]bool{}
+	for phase := range measurements {
+		result.Succeeded[phase] = true
+	}
+	if pe, ok := err.(*PhaseError); ok {
+		result.Succeeded[pe.Phase] = false
+	}
+	if client.Share && err == nil {
+		if reason := shareable(result); reason != nil {
+			loggerFrom(ctx).Debug("Not sharing the Speedtest result", "reason", reason)
+		} else if result.ShareURL, result.ShareErr = client.ShareResult(ctx, result); result.ShareErr == nil {
+			loggerFrom(ctx).Debug("Speedtest result shared", "url", result.ShareURL)
+		}
+	}
+	return result, err
+}
 
-	return &Client{
-		Server:          testServer,
-		SpeedtestClient: stClient,
-		AllServers:      allServers,
-		ClosestServers:  closestServers,
-	}, nil
+// NetworkMetrics runs the download, upload and latency tests against the
+// selected server. If a test fails, the metrics measured so far are returned
+// with a *PhaseError.
+//
+// Deprecated: use Run, whose Result is typed.
+func (client *Client) NetworkMetrics() (map[string]float64, error) {
+	return client.NetworkMetricsContext(context.Background())
 }
 
-func (client *Client) NetworkMetrics() map[string]float64 {
+// NetworkMetricsContext is like NetworkMetrics, the tests being aborted when
+// ctx is done. Only the given phases are run, or all of them if none is
+// given.
+//
+// Deprecated: use Run, whose Result is typed.
+func (client *Client) NetworkMetricsContext(ctx context.Context, phases ...string) (map[string]float64, error) {
+	measurements, err := client.Measure(ctx, phases...)
 	result := map[string]float64{}
-	tester := tests.NewTester(client.SpeedtestClient, tests.DefaultDLSizes, tests.DefaultULSizes, false, false)
-	downloadMbps := tester.Download(client.Server)
-	log.Infof("Speedtest Download: %v Mbps", downloadMbps)
-	uploadMbps := tester.Upload(client.Server)
-	log.Infof("Speedtest Upload: %v Mbps", uploadMbps)
+	for phase, m := range measurements {
+		result[phase] = m.Value
+	}
+	return result, err
+}
 
-	ping, err := client.SpeedtestClient.GetLatency(client.Server, client.SpeedtestClient.GetLatencyURL(client.Server))
-	if err != nil {
-		log.Fatal(err)
+// Measure runs the given phases, or all of them if none is given, and
+// returns their measurements by phase. If a phase fails, the measurements
+// of the previous ones are returned with a *PhaseError.
+func (client *Client) Measure(ctx context.Context, phases ...string) (map[string]Measurement, error) {
+	result := map[string]Measurement{}
+	run := func(phase string) bool {
+		return runsPhase(phases, phase)
+	}
+
+	if client.runsDuplex(phases) {
+		counted, sampled := client.countInterface(ctx), client.sampleCPU(ctx)
+		err := client.duplex(ctx, result)
+		traffic, usage := counted(), sampled()
+		if err != nil {
+			return result, err
+		}
+		for _, phase := range []string{PhaseDownload, PhaseUpload} {
+			m := result[phase]
+			m.Interface, m.CPU = traffic, usage
+			result[phase] = m
+		}
+	}
+
+	if run(PhaseDownload) && !client.runsDuplex(phases) {
+		client.startPhase(ctx, PhaseDownload)
+		counted, sampled := client.countInterface(ctx), client.sampleCPU(ctx)
+		m, err := client.traced(ctx, PhaseDownload, func(ctx context.Context) (Measurement, error) {
+			return client.download(ctx, client.Server)
+		})
+		traffic, usage := counted(), sampled()
+		if err != nil {
+			return result, &PhaseError{Phase: PhaseDownload, Err: err}
+		}
+		m.Interface, m.CPU = traffic, usage
+		loggerFrom(ctx).Debug("Speedtest download", "mbps", m.Value, "duration", m.Duration, "bytes", m.Bytes)
+		result[PhaseDownload] = m
+	}
+
+	if run(PhaseUpload) && !client.runsDuplex(phases) {
+		client.startPhase(ctx, PhaseUpload)
+		counted, sampled := client.countInterface(ctx), client.sampleCPU(ctx)
+		m, err := client.traced(ctx, PhaseUpload, func(ctx context.Context) (Measurement, error) {
+			return client.upload(ctx, client.Server)
+		})
+		traffic, usage := counted(), sampled()
+		if err != nil {
+			return result, &PhaseError{Phase: PhaseUpload, Err: err}
+		}
+		m.Interface, m.CPU = traffic, usage
+		loggerFrom(ctx).Debug("Speedtest upload", "mbps", m.Value, "duration", m.Duration, "bytes", m.Bytes)
+		result[PhaseUpload] = m
+	}
+
+	if run(PhasePing) {
+		client.startPhase(ctx, PhasePing)
+		m, err := client.traced(ctx, PhasePing, func(ctx context.Context) (Measurement, error) {
+			start := time.Now()
+			ping, samples, err := client.latency(ctx, client.Server)
+			if err != nil {
+				return Measurement{}, err
+			}
+			return Measurement{Value: ping, Duration: time.Since(start), Samples: samples, StdDev: StdDev(samples), Jitter: Jitter(samples)}, nil
+		})
+		if err != nil {
+			return result, &PhaseError{Phase: PhasePing, Err: err}
+		}
+		loggerFrom(ctx).Debug("Speedtest latency", "ms", m.Value, "aggregation", client.pingAggregation(), "samples", m.Samples)
+		result[PhasePing] = m
+	}
+
+	return result, nil
+}
+
+// runsPhase returns whether phase is one of phases, all of them running
+// when none is given
+func runsPhase(phases []string, phase string) bool {
+	if len(phases) == 0 {
+		return true
+	}
+	for _, p := range phases {
+		if p == phase {
+			return true
+		}
 	}
+	return false
+}
 
-	log.Infof("Speedtest Latency: %v ms", ping)
-	result["download"] = downloadMbps
-	result["upload"] = uploadMbps
-	result["ping"] = ping
-	log.Infof("Speedtest results: %s", result)
-	return result
+// startPhase closes the idle connections before a phase when they are not
+// to be reused
+func (client *Client) startPhase(ctx context.Context, phase string) {
+	if client.FreshConnections {
+		loggerFrom(ctx).Debug("Closing the idle connections", "phase", phase)
+		closeIdleConnections(client.http)
+	}
 }
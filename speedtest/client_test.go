@@ -0,0 +1,588 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlamirault/speedtest_exporter/internal/speedtestfake"
+)
+
+// miniServer serves the Speedtest Mini test files under /mini/ and records
+// the paths it is requested.
+type miniServer struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	paths []string
+}
+
+func newMiniServer() *miniServer {
+	mini := newUnstartedMiniServer()
+	mini.Start()
+	return mini
+}
+
+// newUnstartedMiniServer returns a miniServer to be configured, then
+// started
+func newUnstartedMiniServer() *miniServer {
+	mini := &miniServer{}
+	mini.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mini.mu.Lock()
+		mini.paths = append(mini.paths, r.URL.Path)
+		mini.mu.Unlock()
+		switch {
+		case r.URL.Path == "/mini/latency.txt":
+			fmt.Fprint(w, "test=test\n")
+		case strings.HasPrefix(r.URL.Path, "/mini/random") && strings.HasSuffix(r.URL.Path, ".jpg"):
+			w.Write(make([]byte, 1024))
+		case r.URL.Path == "/mini/upload.php" && r.Method == "POST":
+			n, _ := io.Copy(ioutil.Discard, r.Body)
+			fmt.Fprintf(w, "size=%d", n)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return mini
+}
+
+// requested returns the paths requested so far, requests interrupted by the
+// client possibly still being served
+func (mini *miniServer) requested() []string {
+	mini.mu.Lock()
+	defer mini.mu.Unlock()
+	return append([]string(nil), mini.paths...)
+}
+
+func TestMiniClient(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+
+	client, err := NewMiniClient(mini.URL+"/mini", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Server.URL != mini.URL+"/mini/upload.php" {
+		t.Errorf("Unexpected test server URL %s", client.Server.URL)
+	}
+	result, err := client.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Download <= 0 || result.Upload <= 0 || result.Ping <= 0 || result.BytesDown <= 0 || result.BytesUp <= 0 {
+		t.Errorf("Expected positive results, got %+v", result)
+	}
+	if result.Server != client.Server || result.FinishedAt.Before(result.StartedAt) || len(result.Phases) != 3 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	if result.Jitter != result.Phases[PhasePing].Jitter || len(result.Phases[PhasePing].Samples) != numLatencyTests {
+		t.Errorf("Expected the jitter of the ping samples, got %+v", result.Phases[PhasePing])
+	}
+	if p := result.Parameters; p.DownloadStreams != 1 || p.UploadStreams != 1 || len(p.UploadSizes) != len(uploadSizes) {
+		t.Errorf("Expected the default transfer parameters, got %+v", p)
+	}
+	for _, path := range mini.requested() {
+		if !strings.HasPrefix(path, "/mini/") {
+			t.Errorf("Unexpected request outside of the Mini directory: %s", path)
+		}
+	}
+}
+
+func TestMiniClientPhases(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := client.NetworkMetricsContext(context.Background(), PhasePing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := metrics["download"]; ok || metrics["ping"] <= 0 {
+		t.Errorf("Expected the ping result only, got %v", metrics)
+	}
+}
+
+func TestRunPartialResult(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/upload.php") {
+			http.Error(w, "uploads disabled", http.StatusForbidden)
+			return
+		}
+		mini.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client, err := NewMiniClient(server.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := client.Run(context.Background())
+	if pe, ok := err.(*PhaseError); !ok || pe.Phase != PhaseUpload {
+		t.Fatalf("Expected the upload to fail, got %v", err)
+	}
+	if result.Download <= 0 || result.Upload != 0 || result.Ping != 0 {
+		t.Errorf("Expected the download result only, got %+v", result)
+	}
+	if _, ok := result.Phases[PhaseUpload]; ok {
+		t.Errorf("Expected no upload measurement, got %+v", result.Phases)
+	}
+	if _, ran := result.Succeeded[PhasePing]; ran || !result.Succeeded[PhaseDownload] {
+		t.Errorf("Expected the download to succeed and the ping not to run, got %v", result.Succeeded)
+	}
+	if succeeded, ran := result.Succeeded[PhaseUpload]; !ran || succeeded {
+		t.Errorf("Expected the upload to fail, got %v", result.Succeeded)
+	}
+}
+
+func TestAuthOnlySentToTestServers(t *testing.T) {
+	var mu sync.Mutex
+	authorized := map[string]bool{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		mu.Lock()
+		if r.Header.Get("Authorization") != "" {
+			authorized[r.URL.Path] = true
+		}
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/config.php":
+			fmt.Fprint(w, `<settings><client ip="203.0.113.7" lat="52.5" lon="13.4" isp="Example ISP"/></settings>`)
+			return
+		case "/servers.php":
+			fmt.Fprintf(w, `<settings><servers><server url="%s/private/upload.php" lat="52.5" lon="13.4" name="Private" cc="DE" id="1"/></servers></settings>`, server.URL)
+			return
+		}
+		if !ok || user != "user" || password != "secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "test=test\n")
+	}))
+	defer server.Close()
+
+	auth := &Auth{Username: "user", Password: "secret"}
+	client, err := NewFilteredClient(context.Background(), server.URL+"/config.php", server.URL+"/servers.php", ServerFilter{}, Options{Auth: auth})
+	if err != nil {
+		t.Fatalf("Expected the private server to be selected: %s", err)
+	}
+	if client.Server.ID != "1" {
+		t.Errorf("Unexpected test server %s", client.Server.ID)
+	}
+	if authorized["/config.php"] || authorized["/servers.php"] {
+		t.Errorf("Credentials sent to the Speedtest configuration or server list: %v", authorized)
+	}
+	if !authorized["/private/latency.txt"] {
+		t.Errorf("Credentials not sent during server selection: %v", authorized)
+	}
+
+	if _, err := NewFilteredClient(context.Background(), server.URL+"/config.php", server.URL+"/servers.php", ServerFilter{}, Options{}); err == nil {
+		t.Error("Expected the private server to be unavailable without credentials")
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	var mu sync.Mutex
+	missing := map[string]bool{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if r.UserAgent() != "probe/1.0" || r.Header.Get("X-Org-Team") != "network" {
+			missing[r.URL.Path] = true
+		}
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/config.php":
+			fmt.Fprint(w, `<settings><client ip="203.0.113.7" lat="52.5" lon="13.4" isp="Example ISP"/></settings>`)
+		case "/servers.php":
+			fmt.Fprintf(w, `<settings><servers><server url="%s/test/upload.php" lat="52.5" lon="13.4" name="Test" cc="DE" id="1"/></servers></settings>`, server.URL)
+		case "/test/upload.php":
+			n, _ := io.Copy(ioutil.Discard, r.Body)
+			fmt.Fprintf(w, "size=%d", n)
+		case "/test/latency.txt":
+			fmt.Fprint(w, "test=test\n")
+		default:
+			w.Write(make([]byte, 1024))
+		}
+	}))
+	defer server.Close()
+
+	opts := Options{UserAgent: "probe/1.0", Header: http.Header{"X-Org-Team": {"network"}}}
+	client, err := NewFilteredClient(context.Background(), server.URL+"/config.php", server.URL+"/servers.php", ServerFilter{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Measure(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) > 0 {
+		t.Errorf("Headers missing from the requests for %v", missing)
+	}
+}
+
+func TestTransferStreams(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Streams = 3
+	client.UploadStreams = 2
+	measurements, err := client.Measure(context.Background(), PhaseDownload, PhaseUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloads := 0
+	for _, path := range mini.paths {
+		if strings.HasSuffix(path, ".jpg") {
+			downloads++
+		}
+	}
+	if downloads != len(DownloadSizes) {
+		t.Errorf("Expected %d downloads, got %v", len(DownloadSizes), mini.paths)
+	}
+	if n := measurements[PhaseDownload].Streams; n < 1 || n > 3 {
+		t.Errorf("Expected up to 3 download streams, got %d", n)
+	}
+	if n := measurements[PhaseUpload].Streams; n < 1 || n > 2 {
+		t.Errorf("Expected up to 2 upload streams, got %d", n)
+	}
+	for phase, streams := range map[string]int{PhaseDownload: 3, PhaseUpload: 2} {
+		m := measurements[phase]
+		if len(m.PerStream) != streams {
+			t.Errorf("Expected %d %s streams, got %+v", streams, phase, m.PerStream)
+			continue
+		}
+		var bytes int64
+		var value float64
+		for _, stream := range m.PerStream {
+			bytes += stream.Bytes
+			value += stream.Value
+		}
+		if bytes != m.Bytes || math.Abs(value-m.Value) > 1e-6*m.Value {
+			t.Errorf("Expected the %s streams to add up to %d bytes and %g Mbps, got %+v", phase, m.Bytes, m.Value, m.PerStream)
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	for _, tc := range []struct {
+		streams, downloadStreams, uploadStreams int
+		download, upload                        int
+	}{
+		{0, 0, 0, 1, 1},
+		{4, 0, 0, 4, 4},
+		{4, 0, 1, 4, 1},
+		{0, 8, 0, 8, 1},
+		{4, 8, 2, 8, 2},
+	} {
+		client := &Client{Streams: tc.streams, DownloadStreams: tc.downloadStreams, UploadStreams: tc.uploadStreams}
+		if download, upload := client.streams(PhaseDownload), client.streams(PhaseUpload); download != tc.download || upload != tc.upload {
+			t.Errorf("Expected %d download and %d upload streams with %d, %d and %d, got %d and %d", tc.download, tc.upload, tc.streams, tc.downloadStreams, tc.uploadStreams, download, upload)
+		}
+	}
+}
+
+func TestOoklaAggregation(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Streams = 3
+	client.Aggregation = AggregationOokla
+	client.DownloadDuration = 500 * time.Millisecond
+	measurements, err := client.Measure(context.Background(), PhaseDownload, PhaseUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{PhaseDownload, PhaseUpload} {
+		m := measurements[phase]
+		if m.Value <= 0 || m.Bytes <= 0 {
+			t.Errorf("Expected a %s bandwidth, got %+v", phase, m)
+		}
+		// The streams are metered apart, adding up to the phase
+		var bytes int64
+		for _, stream := range m.PerStream {
+			bytes += stream.Bytes
+		}
+		if bytes != m.Bytes {
+			t.Errorf("Expected the %s streams to add up to %d bytes, got %+v", phase, m.Bytes, m.PerStream)
+		}
+	}
+}
+
+func TestTransferDuration(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DownloadDuration = 200 * time.Millisecond
+	client.UploadDuration = 200 * time.Millisecond
+	client.DownloadSizes = []int{350}
+	measurements, err := client.Measure(context.Background(), PhaseDownload, PhaseUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{PhaseDownload, PhaseUpload} {
+		m := measurements[phase]
+		if m.Duration < 100*time.Millisecond || m.Duration > time.Second {
+			t.Errorf("Expected the %s phase to last about 200ms, got %s", phase, m.Duration)
+		}
+		if m.Bytes == 0 || m.Value <= 0 {
+			t.Errorf("Expected the %s bandwidth, got %+v", phase, m)
+		}
+	}
+	downloads := 0
+	for _, path := range mini.requested() {
+		if strings.HasSuffix(path, ".jpg") {
+			if path != "/mini/random350x350.jpg" {
+				t.Errorf("Unexpected download %s", path)
+			}
+			downloads++
+		}
+	}
+	if downloads <= 1 {
+		t.Errorf("Expected the download to be repeated until the end of the phase, got %d requests", downloads)
+	}
+}
+
+func TestUploadMaxBytes(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.UploadChunkSize = 30000
+	client.UploadMaxBytes = 100000
+	client.UploadDuration = time.Minute
+	measurements, err := client.Measure(context.Background(), PhaseUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := measurements[PhaseUpload]; m.Bytes != 100000 || m.Duration > 10*time.Second {
+		t.Errorf("Expected the upload to stop at 100000 bytes, got %+v", m)
+	}
+	if len(mini.paths) != 4 {
+		t.Errorf("Expected 4 uploads, got %v", mini.paths)
+	}
+}
+
+// rewriteTransport sends every request to target, recording the hosts
+// they were meant for
+type rewriteTransport struct {
+	target *url.URL
+
+	mu    sync.Mutex
+	hosts map[string]bool
+}
+
+func (rt *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.hosts[req.URL.Host] = true
+	rt.mu.Unlock()
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestPingSamples(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{PingSamples: 10, PingAggregation: PingAggregationMedian})
+	if err != nil {
+		t.Fatal(err)
+	}
+	measurements, err := client.Measure(context.Background(), PhasePing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := measurements[PhasePing]
+	if len(m.Samples) != 10 || m.Value != AggregateLatency(m.Samples, PingAggregationMedian) || m.StdDev != StdDev(m.Samples) {
+		t.Errorf("Expected the median of 10 samples, got %+v", m)
+	}
+	requests := 0
+	for _, path := range mini.requested() {
+		if path == "/mini/latency.txt" {
+			requests++
+		}
+	}
+	if requests != 10 {
+		t.Errorf("Expected 10 latency requests, got %d", requests)
+	}
+}
+
+func TestFreshConnections(t *testing.T) {
+	mini := newUnstartedMiniServer()
+	var mu sync.Mutex
+	dialed := 0
+	mini.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			dialed++
+			mu.Unlock()
+		}
+	}
+	mini.Start()
+	defer mini.Close()
+
+	for fresh, expected := range map[bool]int{false: 1, true: 3} {
+		mu.Lock()
+		dialed = 0
+		mu.Unlock()
+		client, err := NewMiniClient(mini.URL+"/mini/", Options{Transport: newTransport(t, TransportConfig{})})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.FreshConnections = fresh
+		client.DownloadSizes = []int{350}
+		if _, err := client.Measure(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		if dialed != expected {
+			t.Errorf("Expected %d connections with fresh connections %t, got %d", expected, fresh, dialed)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestTransport(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	target, _ := url.Parse(mini.URL)
+	transport := &rewriteTransport{target: target, hosts: map[string]bool{}}
+
+	client, err := NewMiniClient("http://mini.invalid/mini/", Options{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Measure(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.hosts) != 1 || !transport.hosts["mini.invalid"] {
+		t.Errorf("Unexpected hosts %v", transport.hosts)
+	}
+	for _, prefix := range []string{"/mini/latency.txt", "/mini/random", "/mini/upload.php"} {
+		found := false
+		for _, path := range mini.paths {
+			found = found || strings.HasPrefix(path, prefix)
+		}
+		if !found {
+			t.Errorf("Expected a request for %s through the transport, got %v", prefix, mini.paths)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	var configured *Client
+	result, err := Run(context.Background(), Options{
+		MiniURL: mini.URL + "/mini/",
+		Phases:  []string{PhasePing, PhaseDownload},
+		Configure: func(client *Client) {
+			client.DownloadSizes = []int{350}
+			configured = client
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configured == nil || result.Server.ID != "mini" || result.Ping <= 0 || result.Download <= 0 || result.Upload != 0 {
+		t.Errorf("Expected the ping and download results of the Mini server, got %+v", result)
+	}
+
+	scripted := newScriptedServer()
+	defer scripted.Close()
+	result, err = Run(context.Background(), Options{
+		ConfigURL:  scripted.URL + "/config.php",
+		ServersURL: scripted.URL + "/servers.php",
+		Filter:     ServerFilter{CountryCodes: []string{"FR"}},
+		Phases:     []string{PhasePing},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Server.ID != "4" || result.Ping <= 0 {
+		t.Errorf("Expected the ping result of server 4, got %+v", result)
+	}
+
+	result, err = Run(context.Background(), Options{
+		ConfigURL:  scripted.URL + "/config.php",
+		ServersURL: scripted.URL + "/servers.php",
+		Filter:     ServerFilter{IDs: []string{"3"}},
+	})
+	if err == nil || result != nil {
+		t.Errorf("Expected no server to be selected, got %+v", result)
+	}
+}
+
+func TestFakeBandwidth(t *testing.T) {
+	fake := speedtestfake.New(speedtestfake.Options{
+		Latency:      20 * time.Millisecond,
+		DownloadRate: 4e6,
+		UploadRate:   2e6,
+	})
+	defer fake.Close()
+
+	client, err := NewFilteredClient(context.Background(), fake.ConfigURL(), fake.ServersURL(), ServerFilter{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Server.ID != "1234" {
+		t.Errorf("Expected the nearest server to be selected, got %s", client.Server.ID)
+	}
+	client.DownloadSizes = []int{350}
+	client.DownloadDuration = time.Second
+	client.UploadDuration = time.Second
+	measurements, err := client.Measure(context.Background(), PhasePing, PhaseDownload, PhaseUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The link is shared by the streams, the bandwidth measured is its
+	// rate, with a wide tolerance for the slow test machines
+	for phase, expected := range map[string]float64{PhasePing: 20, PhaseDownload: 32, PhaseUpload: 16} {
+		if m := measurements[phase]; m.Value < expected*0.6 || m.Value > expected*1.4 {
+			t.Errorf("Expected the %s to be about %g, got %+v", phase, expected, m)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+)
+
+// ConnectionInfo describes a connection of the transfer phases, with
+// values from small sets
+type ConnectionInfo struct {
+	// HTTPVersion is 1.1, 2 or 3
+	HTTPVersion string
+	// TLSVersion is 1.0 to 1.3, or none over cleartext connections
+	TLSVersion string
+	// Family is the address family of the server, ipv4 or ipv6, or
+	// unknown
+	Family string
+}
+
+// newConnectionInfo describes the connection of resp, from remote
+func newConnectionInfo(resp *http.Response, remote net.Addr) ConnectionInfo {
+	return ConnectionInfo{HTTPVersion: httpVersion(resp), TLSVersion: tlsVersion(resp.TLS), Family: addressFamily(remote)}
+}
+
+// httpVersion returns the HTTP version of resp, e.g. 1.1 or 2
+func httpVersion(resp *http.Response) string {
+	if resp.ProtoMajor == 1 {
+		return "1." + strconv.Itoa(resp.ProtoMinor)
+	}
+	return strconv.Itoa(resp.ProtoMajor)
+}
+
+// tlsVersion returns the TLS version of a connection, none without state
+func tlsVersion(state *tls.ConnectionState) string {
+	if state == nil {
+		return "none"
+	}
+	switch state.Version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return "unknown"
+}
+
+// addressFamily returns the family of addr, ipv4 for the IPv4-mapped IPv6
+// addresses, and unknown when not traced
+func addressFamily(addr net.Addr) string {
+	if addr == nil {
+		return "unknown"
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "unknown"
+	}
+	ip, err := netip.ParseAddr(host)
+	switch {
+	case err != nil:
+		return "unknown"
+	case ip.Unmap().Is4():
+		return "ipv4"
+	}
+	return "ipv6"
+}
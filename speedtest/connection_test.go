@@ -0,0 +1,115 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnectionHelpers(t *testing.T) {
+	for _, tc := range []struct {
+		addr     net.Addr
+		expected string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, "ipv4"},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 443}, "ipv4"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, "ipv6"},
+		{&net.UnixAddr{Name: "/run/speedtest.sock", Net: "unix"}, "unknown"},
+		{nil, "unknown"},
+	} {
+		if family := addressFamily(tc.addr); family != tc.expected {
+			t.Errorf("Expected %s for %v, got %s", tc.expected, tc.addr, family)
+		}
+	}
+	for _, tc := range []struct {
+		state    *tls.ConnectionState
+		expected string
+	}{
+		{nil, "none"},
+		{&tls.ConnectionState{Version: tls.VersionTLS12}, "1.2"},
+		{&tls.ConnectionState{Version: tls.VersionTLS13}, "1.3"},
+		{&tls.ConnectionState{Version: 0x0200}, "unknown"},
+	} {
+		if version := tlsVersion(tc.state); version != tc.expected {
+			t.Errorf("Expected %s for %+v, got %s", tc.expected, tc.state, version)
+		}
+	}
+	for _, tc := range []struct {
+		major, minor int
+		expected     string
+	}{
+		{1, 1, "1.1"},
+		{2, 0, "2"},
+		{3, 0, "3"},
+	} {
+		if version := httpVersion(&http.Response{ProtoMajor: tc.major, ProtoMinor: tc.minor}); version != tc.expected {
+			t.Errorf("Expected %s for HTTP/%d.%d, got %s", tc.expected, tc.major, tc.minor, version)
+		}
+	}
+}
+
+func TestConnectionInfo(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	h2 := httptest.NewUnstartedServer(mini.Config.Handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	for _, tc := range []struct {
+		server   *httptest.Server
+		expected ConnectionInfo
+	}{
+		{mini.Server, ConnectionInfo{HTTPVersion: "1.1", TLSVersion: "none", Family: "ipv4"}},
+		{h2, ConnectionInfo{HTTPVersion: "2", TLSVersion: "1.3", Family: "ipv4"}},
+	} {
+		pool := x509.NewCertPool()
+		if cert := tc.server.Certificate(); cert != nil {
+			pool.AddCert(cert)
+		}
+		transport := newTransport(t, TransportConfig{TLSConfig: &tls.Config{RootCAs: pool}})
+		client, err := NewMiniClient(tc.server.URL+"/mini/", Options{Transport: transport})
+		if err != nil {
+			t.Fatal(err)
+		}
+		measurements, err := client.Measure(context.Background(), PhaseDownload, PhaseUpload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, phase := range []string{PhaseDownload, PhaseUpload} {
+			if conn := measurements[phase].Connection; conn == nil || *conn != tc.expected {
+				t.Errorf("Expected the %s connection to be %+v against %s, got %+v", phase, tc.expected, tc.server.URL, conn)
+			}
+		}
+	}
+
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping, err := client.Measure(context.Background(), PhasePing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn := ping[PhasePing].Connection; conn != nil {
+		t.Errorf("Expected no connection described by the ping phase, got %+v", conn)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cpuSampleInterval is the interval the CPU usage is sampled at during the
+// transfer phases
+const cpuSampleInterval = 250 * time.Millisecond
+
+// CPUUsage is the CPU usage of the host during a phase
+type CPUUsage struct {
+	// System is the busy share of all the CPUs, and Process the share used
+	// by the process, from 0 to 1
+	System  float64
+	Process float64
+	// Limited tells whether the system utilization reached CPUThreshold
+	// for most of the phase, the throughput being likely bounded by the
+	// CPU rather than by the network
+	Limited bool
+}
+
+// cpuTimes are the CPU times of the host, in clock ticks: busy and total
+// across all CPUs, and process for the process
+type cpuTimes struct {
+	busy    uint64
+	total   uint64
+	process uint64
+}
+
+// parseProcStat returns the busy and total times of the cpu line of r, in
+// the format of /proc/stat: user, nice, system, idle, iowait, irq, softirq
+// and steal, the guest times being already counted as user times
+func parseProcStat(r io.Reader) (busy uint64, total uint64, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "cpu" {
+			continue
+		}
+		if len(fields) < 5 {
+			return 0, 0, fmt.Errorf("Unexpected cpu line %q", scanner.Text())
+		}
+		var idle uint64
+		for i, field := range fields[1:min(len(fields), 9)] {
+			ticks, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("Invalid cpu time %q: %s", field, err)
+			}
+			total += ticks
+			// idle and iowait
+			if i == 3 || i == 4 {
+				idle += ticks
+			}
+		}
+		return total - idle, total, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, fmt.Errorf("No cpu line")
+}
+
+// parseProcessStat returns the user and system times of the process in
+// stat, in the format of /proc/self/stat, whose second field is the
+// parenthesized command name, which may contain spaces
+func parseProcessStat(stat string) (uint64, error) {
+	i := strings.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("Unexpected process stat %q", stat)
+	}
+	// The fields following the name start with the state, the third one,
+	// utime and stime being the 14th and 15th
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("Unexpected process stat %q", stat)
+	}
+	var ticks uint64
+	for _, field := range fields[11:13] {
+		t, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid process time %q: %s", field, err)
+		}
+		ticks += t
+	}
+	return ticks, nil
+}
+
+// utilization returns the busy share of the CPUs and the share used by the
+// process between from and to, false when no time elapsed or the counters
+// went back
+func utilization(from, to cpuTimes) (system float64, process float64, ok bool) {
+	if to.total <= from.total || to.busy < from.busy || to.process < from.process {
+		return 0, 0, false
+	}
+	total := float64(to.total - from.total)
+	return min(float64(to.busy-from.busy)/total, 1), min(float64(to.process-from.process)/total, 1), true
+}
+
+// sampleCPU samples the CPU usage from now on, when CPUThreshold is set,
+// and returns the function ending the sampling with the usage meanwhile.
+// It returns nil when not sampled, or when the CPU times can't be read, as
+// on other systems than Linux.
+func (client *Client) sampleCPU(ctx context.Context) func() *CPUUsage {
+	if client.CPUThreshold <= 0 {
+		return func() *CPUUsage { return nil }
+	}
+	start, err := readCPUTimes()
+	if err != nil {
+		loggerFrom(ctx).Debug("Can't read the CPU times", "err", err)
+		return func() *CPUUsage { return nil }
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	// saturated counts the samples at the threshold, out of samples
+	var samples, saturated int
+	last := start
+	sample := func() {
+		times, err := readCPUTimes()
+		if err != nil {
+			return
+		}
+		if system, _, ok := utilization(last, times); ok {
+			samples++
+			if system >= client.CPUThreshold {
+				saturated++
+			}
+		}
+		last = times
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cpuSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sample()
+			case <-stop:
+				sample()
+				return
+			}
+		}
+	}()
+	return func() *CPUUsage {
+		close(stop)
+		<-done
+		system, process, ok := utilization(start, last)
+		if !ok {
+			return nil
+		}
+		return &CPUUsage{System: system, Process: process, Limited: saturated*2 > samples}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import "os"
+
+// readCPUTimes returns the CPU times of the host from /proc/stat and those
+// of the process from /proc/self/stat
+func readCPUTimes() (cpuTimes, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	defer f.Close()
+	busy, total, err := parseProcStat(f)
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	stat, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	process, err := parseProcessStat(string(stat))
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	return cpuTimes{busy: busy, total: total, process: process}, nil
+}
@@ -0,0 +1,44 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSampleCPU(t *testing.T) {
+	if _, err := readCPUTimes(); err != nil {
+		t.Skipf("Can't read the CPU times: %s", err)
+	}
+	client := &Client{}
+	if usage := client.sampleCPU(context.Background())(); usage != nil {
+		t.Errorf("Expected no sampling without threshold, got %+v", usage)
+	}
+
+	// A busy loop keeps a CPU busy
+	client.CPUThreshold = 0.01
+	sampled := client.sampleCPU(context.Background())
+	for deadline := time.Now().Add(4 * cpuSampleInterval); time.Now().Before(deadline); {
+	}
+	usage := sampled()
+	if usage == nil {
+		t.Fatal("Expected the CPU usage")
+	}
+	if usage.Process <= 0 || usage.System > 1 || !usage.Limited {
+		t.Errorf("Unexpected CPU usage %+v", usage)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProcStat(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		stat        string
+		busy, total uint64
+	}{
+		{"current", "cpu  277799 0 39398 1183365 3415 0 570 6934 0 0\ncpu0 277799 0 39398 1183365 3415 0 570 6934 0 0\nintr 3613453 0 0\n", 324701, 1511481},
+		{"without steal", "cpu  100 0 50 800 50 0 0\n", 150, 1000},
+		{"old kernel", "cpu  100 20 80 800\n", 200, 1000},
+	} {
+		busy, total, err := parseProcStat(strings.NewReader(tc.stat))
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if busy != tc.busy || total != tc.total {
+			t.Errorf("%s: expected %d busy out of %d, got %d out of %d", tc.name, tc.busy, tc.total, busy, total)
+		}
+	}
+	for _, stat := range []string{"", "cpu0 1 2 3 4\n", "cpu  1 2\n", "cpu  1 2 x 4\n"} {
+		if _, _, err := parseProcStat(strings.NewReader(stat)); err == nil {
+			t.Errorf("%q: expected an error", stat)
+		}
+	}
+}
+
+func TestParseProcessStat(t *testing.T) {
+	for stat, expected := range map[string]uint64{
+		"22844 (speedtest_expor) S 1 22844 22838 0 -1 4194304 79 0 0 0 1520 310 0 0 20 0 9 0 1509362 2703360 310": 1830,
+		"22844 (a (b) c) R 1 22844 22838 0 -1 4194304 79 0 0 0 7 3 0 0 20 0 1 0 1509362 2703360 310":              10,
+	} {
+		ticks, err := parseProcessStat(stat)
+		if err != nil {
+			t.Errorf("%q: %s", stat, err)
+		}
+		if ticks != expected {
+			t.Errorf("%q: expected %d ticks, got %d", stat, expected, ticks)
+		}
+	}
+	for _, stat := range []string{"", "22844 (cat R 1", "22844 (cat) R 1 2 3"} {
+		if _, err := parseProcessStat(stat); err == nil {
+			t.Errorf("%q: expected an error", stat)
+		}
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	system, process, ok := utilization(cpuTimes{busy: 100, total: 1000, process: 10}, cpuTimes{busy: 550, total: 1500, process: 110})
+	if !ok || system != 0.9 || process != 0.2 {
+		t.Errorf("Unexpected utilization %f and %f", system, process)
+	}
+	if _, _, ok := utilization(cpuTimes{total: 1000}, cpuTimes{total: 1000}); ok {
+		t.Error("Expected no utilization without elapsed time")
+	}
+	if _, _, ok := utilization(cpuTimes{busy: 100, total: 1000}, cpuTimes{busy: 50, total: 2000}); ok {
+		t.Error("Expected no utilization when the counters went back")
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package speedtest measures the latency and bandwidth of a network link
+// against the Speedtest.net servers, or a self-hosted Speedtest Mini server.
+// It depends neither on Prometheus nor on the exporter flags, so it can be
+// embedded in other programs:
+//
+//	result, err := speedtest.Run(ctx, speedtest.Options{
+//		Filter: speedtest.ServerFilter{CountryCodes: []string{"DE"}},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	fmt.Printf("%.1f ms, %.1f Mbps down, %.1f Mbps up\n", result.Ping, result.Download, result.Upload)
+//
+// Run selects the test server and runs the test in one go. NewFilteredClient
+// and NewMiniClient return a Client instead, whose settings tune the phases
+// and which runs any number of tests against the same server.
+//
+// The exported API follows semantic versioning: deprecated identifiers are
+// kept until the next major version.
+package speedtest
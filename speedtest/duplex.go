@@ -0,0 +1,73 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"sync"
+)
+
+// duplexKey carries the duration shared by the phases of a duplex test in
+// their context
+type duplexKey struct{}
+
+// runsDuplex returns whether the download and upload phases among phases
+// run at once
+func (client *Client) runsDuplex(phases []string) bool {
+	return client.Duplex && runsPhase(phases, PhaseDownload) && runsPhase(phases, PhaseUpload)
+}
+
+// duplex runs the download and upload phases at once, adding their
+// measurements to result. Each phase samples its own throughput, over its
+// own connections. The first failure interrupts the other phase, and is
+// returned as a *PhaseError.
+func (client *Client) duplex(ctx context.Context, result map[string]Measurement) error {
+	client.startPhase(ctx, PhaseDownload)
+	ctx = context.WithValue(ctx, duplexKey{}, max(client.DownloadDuration, client.UploadDuration))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var failed *PhaseError
+	var wg sync.WaitGroup
+	for phase, measure := range map[string]func(context.Context, Server) (Measurement, error){
+		PhaseDownload: client.download,
+		PhaseUpload:   client.upload,
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, err := client.traced(ctx, phase, func(ctx context.Context) (Measurement, error) {
+				return measure(ctx, client.Server)
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if failed == nil {
+					failed = &PhaseError{Phase: phase, Err: err}
+					cancel()
+				}
+				return
+			}
+			loggerFrom(ctx).Debug("Speedtest duplex "+phase, "mbps", m.Value, "duration", m.Duration, "bytes", m.Bytes)
+			result[phase] = m
+		}()
+	}
+	wg.Wait()
+	if failed != nil {
+		return failed
+	}
+	return nil
+}
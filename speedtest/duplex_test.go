@@ -0,0 +1,62 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDuplex(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Duplex = true
+	client.DownloadDuration = 300 * time.Millisecond
+	client.DownloadSizes = []int{350}
+	client.UploadChunkSize = 64 * 1024
+
+	start := time.Now()
+	result, err := client.Run(context.Background(), PhaseDownload, PhaseUpload)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Duplex {
+		t.Error("Expected a duplex result")
+	}
+	// Both phases last the shared duration, at the same time
+	for _, phase := range []string{PhaseDownload, PhaseUpload} {
+		if m := result.Phases[phase]; m.Bytes == 0 || m.Duration < 200*time.Millisecond {
+			t.Errorf("Expected the %s phase to last the shared duration, got %+v", phase, m)
+		}
+	}
+	if elapsed > 550*time.Millisecond {
+		t.Errorf("Expected the phases to run at once, took %s", elapsed)
+	}
+
+	// A single transfer phase runs alone
+	result, err = client.Run(context.Background(), PhaseDownload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Duplex {
+		t.Error("Expected a download alone not to be duplex")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// The errors matched by the *HTTPError of some statuses, with errors.Is
+var (
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrForbidden        = errors.New("forbidden")
+	ErrNotFound         = errors.New("not found")
+	ErrTooManyRequests  = errors.New("too many requests")
+	ErrBadGateway       = errors.New("bad gateway")
+	ErrServerOverloaded = errors.New("server overloaded")
+)
+
+// statusErrors are the errors matched by the *HTTPError of some statuses
+var statusErrors = map[int]error{
+	http.StatusUnauthorized:       ErrUnauthorized,
+	http.StatusForbidden:          ErrForbidden,
+	http.StatusNotFound:           ErrNotFound,
+	http.StatusTooManyRequests:    ErrTooManyRequests,
+	http.StatusBadGateway:         ErrBadGateway,
+	http.StatusServiceUnavailable: ErrServerOverloaded,
+}
+
+// HTTPError is returned when a Speedtest server answers with an unexpected
+// HTTP status
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("Unexpected HTTP status from %s: %s", e.URL, e.Status)
+}
+
+// Unwrap returns the error of the status, e.g. ErrServerOverloaded for 503,
+// if any
+func (e *HTTPError) Unwrap() error {
+	return statusErrors[e.StatusCode]
+}
+
+// IsRateLimited tells whether err is a 403 or 429 response, which
+// speedtest.net answers to the clients it rate-limits or bans
+func IsRateLimited(err error) bool {
+	return errors.Is(err, ErrForbidden) || errors.Is(err, ErrTooManyRequests)
+}
+
+// RedirectError is returned when a test server redirects a test request,
+// or a configuration or server list request is redirected too many times
+type RedirectError struct {
+	URL      string
+	Location string
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("Unexpected redirect from %s to %s", e.URL, e.Location)
+}
+
+// PhaseError is returned when one of the test phases (ping, download or
+// upload) failed
+type PhaseError struct {
+	Phase string
+	Err   error
+}
+
+func (e *PhaseError) Error() string {
+	return fmt.Sprintf("Speedtest %s failed: %s", e.Phase, e.Err)
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorType classifies an error returned by the client, for use as a
+// metric label value
+func ErrorType(err error) string {
+	if e, ok := err.(*PhaseError); ok {
+		err = e.Err
+	}
+	var proxyErr *ProxyAuthError
+	if errors.As(err, &proxyErr) {
+		return "proxy_auth"
+	}
+	var versionErr *HTTPVersionError
+	if errors.As(err, &versionErr) {
+		return "http_version"
+	}
+	var connectErr *ConnectTimeoutError
+	if errors.As(err, &connectErr) {
+		return "connect_timeout"
+	}
+	var stalledErr *StalledTransferError
+	if errors.As(err, &stalledErr) {
+		return "stalled_transfer"
+	}
+	var rejectedErr *UploadRejectedError
+	if errors.As(err, &rejectedErr) {
+		return "upload_rejected"
+	}
+	var redirectErr *RedirectError
+	if errors.As(err, &redirectErr) {
+		return "redirect"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+	var certErr *tls.CertificateVerificationError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) || errors.As(err, &hostnameErr) || errors.As(err, &authorityErr) || errors.As(err, &invalidErr) {
+		return "tls_verify"
+	}
+	switch e := err.(type) {
+	case *HTTPError:
+		switch {
+		case errors.Is(e, ErrUnauthorized):
+			return "auth"
+		case IsRateLimited(e):
+			return "rate_limited"
+		case errors.Is(e, ErrServerOverloaded):
+			return "overloaded"
+		}
+		return "http"
+	case net.Error:
+		if e.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+	return "other"
+}
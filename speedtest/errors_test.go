@@ -0,0 +1,60 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package speedtest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorType(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected string
+	}{
+		{&HTTPError{StatusCode: http.StatusUnauthorized}, "auth"},
+		{&HTTPError{StatusCode: http.StatusForbidden}, "rate_limited"},
+		{&PhaseError{Phase: PhaseDownload, Err: &HTTPError{StatusCode: http.StatusUnauthorized}}, "auth"},
+		{&HTTPError{StatusCode: http.StatusNotFound}, "http"},
+		{&HTTPError{StatusCode: http.StatusServiceUnavailable}, "overloaded"},
+		{&HTTPError{StatusCode: http.StatusTooManyRequests}, "rate_limited"},
+		{&PhaseError{Phase: PhaseDownload, Err: &HTTPError{StatusCode: http.StatusTooManyRequests}}, "rate_limited"},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: &RedirectError{}}, "redirect"},
+		{&PhaseError{Phase: PhaseUpload, Err: timeoutError{}}, "timeout"},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "network"},
+		{&url.Error{Op: "Get", Err: &ProxyAuthError{Err: errors.New("username/password authentication failed")}}, "proxy_auth"},
+		{&url.Error{Op: "Get", Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}}, "tls_verify"},
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}}, "dns"},
+		{&PhaseError{Phase: PhasePing, Err: &HTTPVersionError{Err: errors.New("http2: frame too large")}}, "http_version"},
+		{&url.Error{Op: "Get", Err: &ConnectTimeoutError{Err: timeoutError{}}}, "connect_timeout"},
+		{&PhaseError{Phase: PhaseDownload, Err: &StalledTransferError{}}, "stalled_transfer"},
+		{&PhaseError{Phase: PhaseUpload, Err: &UploadRejectedError{Err: &HTTPError{StatusCode: http.StatusUnsupportedMediaType}}}, "upload_rejected"},
+		{errors.New("boom"), "other"},
+	} {
+		if got := ErrorType(tc.err); got != tc.expected {
+			t.Errorf("%v: expected %q, got %q", tc.err, tc.expected, got)
+		}
+	}
+}
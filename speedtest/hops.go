@@ -0,0 +1,144 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxHops is the largest hop count measured
+	maxHops = 30
+	// hopsTimeout bounds the hop count measurement
+	hopsTimeout = 2 * time.Second
+	// minHopsGrace is the least time waited, once the server answered,
+	// for the probes of lower TTLs to answer as well
+	minHopsGrace = 100 * time.Millisecond
+)
+
+// ErrHopsUnsupported is returned by CountHops when the TTL of the
+// connections can't be set on this platform
+var ErrHopsUnsupported = errors.New("Setting the TTL of the connections is not supported")
+
+// CountHops returns the number of hops to the server, the lowest TTL of
+// the TCP connections to its port that it answers, connected or refused.
+// The connections of every TTL up to 30 are dialed at once, the count
+// taking at most 2 seconds.
+func (client *Client) CountHops(ctx context.Context) (int, error) {
+	u, err := url.Parse(client.Server.URL)
+	if err != nil {
+		return 0, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hopsTimeout)
+	defer cancel()
+	// The host is resolved once, so every probe takes the same path
+	resolver := client.HopsTransport.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return 0, err
+	}
+	if len(ips) == 0 {
+		return 0, fmt.Errorf("No address found for %s", u.Hostname())
+	}
+	address := net.JoinHostPort(ips[0].IP.String(), port)
+
+	type answer struct {
+		ttl int
+		err error
+	}
+	answers := make(chan answer, maxHops)
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		go func() {
+			answers <- answer{ttl, client.dialHop(ctx, address, ttl)}
+		}()
+	}
+
+	start := time.Now()
+	hops := 0
+	var grace <-chan time.Time
+	for range maxHops {
+		var a answer
+		select {
+		case a = <-answers:
+		case <-grace:
+			return hops, nil
+		}
+		switch {
+		case a.err == nil:
+			if hops == 0 || a.ttl < hops {
+				hops = a.ttl
+			}
+			if grace == nil {
+				grace = time.After(max(time.Since(start), minHopsGrace))
+			}
+		case errors.Is(a.err, ErrHopsUnsupported):
+			return 0, a.err
+		}
+	}
+	if hops == 0 {
+		return 0, fmt.Errorf("Server %s didn't answer within %d hops", address, maxHops)
+	}
+	return hops, nil
+}
+
+// dialHop dials a TCP connection of the given TTL to address, returning
+// nil if the server answered it
+func (client *Client) dialHop(ctx context.Context, address string, ttl int) error {
+	dialer := client.HopsTransport.dialer()
+	bind := dialer.Control
+	dialer.Control = func(network string, address string, c syscall.RawConn) error {
+		if bind != nil {
+			if err := bind(network, address, c); err != nil {
+				return err
+			}
+		}
+		var err error
+		if controlErr := c.Control(func(fd uintptr) {
+			err = setTTL(fd, network, ttl)
+		}); controlErr != nil {
+			return controlErr
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrHopsUnsupported, err)
+		}
+		return nil
+	}
+	conn, err := client.HopsTransport.dial(ctx, dialer, "tcp", address)
+	if err != nil {
+		// A reset comes from the server as well
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return nil
+		}
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,61 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestCountHops(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	// Both an accepted and a refused connection answer at the first hop
+	for _, addr := range []net.Addr{listener.Addr(), closed.Addr()} {
+		client := &Client{Server: Server{URL: "http://" + addr.String() + "/speedtest/upload.php"}}
+		hops, err := client.CountHops(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %s", addr, err)
+		}
+		if hops != 1 {
+			t.Errorf("%s: expected 1 hop, got %d", addr, hops)
+		}
+	}
+
+	mini := newMiniServer()
+	defer mini.Close()
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Hops = true
+	result, err := client.Run(context.Background(), PhasePing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Hops != 1 {
+		t.Errorf("Expected the result to count 1 hop, got %d", result.Hops)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build http3
+
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Supported tells whether the HTTP/3 transport is built in
+const http3Supported = true
+
+// http3RoundTripper carries the test requests over HTTP/3, leaving the
+// others to the transport it is registered on
+type http3RoundTripper struct {
+	transport *http3.Transport
+}
+
+// registerHTTP3 registers on transport the HTTP/3 transport of the test
+// requests, its QUIC connections being opened from the source address,
+// interface and network namespace of config
+func registerHTTP3(transport *http.Transport, config TransportConfig) {
+	rt := &http3RoundTripper{transport: &http3.Transport{
+		TLSClientConfig: config.TLSConfig,
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: config.dialTimeout(),
+			MaxIdleTimeout:       idleConnTimeout,
+			KeepAlivePeriod:      keepAlive,
+		},
+		Dial:               config.dialQUIC,
+		DisableCompression: true,
+	}}
+	transport.RegisterProtocol("https", rt)
+	transport.RegisterProtocol("http", rt)
+	http3Transports.Store(transport, rt.transport)
+}
+
+func (rt *http3RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(testRequestKey{}) == nil {
+		return nil, http.ErrSkipAltProtocol
+	}
+	if req.URL.Scheme != "https" {
+		return nil, &HTTPVersionError{URL: req.URL.String(), Version: "HTTP/3", Err: errors.New("HTTP/3 requires an https server")}
+	}
+	resp, err := rt.transport.RoundTrip(req)
+	var handshakeErr *quicHandshakeError
+	if errors.As(err, &handshakeErr) && req.Context().Err() == nil {
+		return nil, &HTTPVersionError{URL: req.URL.String(), Version: "HTTP/3", Err: handshakeErr.Err}
+	}
+	return resp, err
+}
+
+// quicHandshakeError is the failure of the QUIC handshake with a server,
+// most likely not speaking HTTP/3
+type quicHandshakeError struct {
+	Err error
+}
+
+func (e *quicHandshakeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *quicHandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// dialQUIC opens a QUIC connection to address, from a UDP socket of its
+// own bound to the source address and interface, and created in the
+// network namespace of the configuration if any. The socket is closed
+// along with the connection.
+func (config TransportConfig) dialQUIC(ctx context.Context, address string, tlsConfig *tls.Config, quicConfig *quic.Config) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	resolver := config.dialer().Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// The server must be reachable from the family of the source address
+	remote := addrs[0]
+	for _, addr := range addrs {
+		if config.SourceAddress == nil || (addr.IP.To4() == nil) == (config.SourceAddress.To4() == nil) {
+			remote = addr
+			break
+		}
+	}
+	network, local := "udp4", &net.UDPAddr{IP: config.SourceAddress}
+	if remote.IP.To4() == nil {
+		network = "udp6"
+	}
+	listenConfig := net.ListenConfig{}
+	if config.Interface != "" {
+		listenConfig.Control = bindToDevice(config.Interface)
+	}
+	var conn net.PacketConn
+	listen := func() error {
+		conn, err = listenConfig.ListenPacket(ctx, network, local.String())
+		return err
+	}
+	if config.Netns == "" {
+		err = listen()
+	} else {
+		err = inNetns(config.Netns, listen)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, config.dialTimeout())
+	defer cancel()
+	transport := &quic.Transport{Conn: conn}
+	quicConn, err := transport.DialEarly(ctx, &net.UDPAddr{IP: remote.IP, Port: portNumber, Zone: remote.Zone}, tlsConfig, quicConfig)
+	if err != nil {
+		transport.Close()
+		conn.Close()
+		if parent.Err() != nil {
+			return nil, err
+		}
+		return nil, &quicHandshakeError{Err: err}
+	}
+	go func() {
+		<-quicConn.Context().Done()
+		transport.Close()
+		conn.Close()
+	}()
+	return quicConn, nil
+}
@@ -0,0 +1,26 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !http3
+
+package speedtest
+
+import "net/http"
+
+// http3Supported tells whether the HTTP/3 transport is built in
+const http3Supported = false
+
+// registerHTTP3 does nothing in the builds without the quic-go
+// dependency, HTTPVersionH3 being rejected
+func registerHTTP3(transport *http.Transport, config TransportConfig) {}
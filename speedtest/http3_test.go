@@ -0,0 +1,130 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build http3
+
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3MiniServer serves the Speedtest Mini files over HTTPS, and over
+// HTTP/3 on the same port, recording the protocols of the requests by path
+func newHTTP3MiniServer(t *testing.T) (*httptest.Server, map[string]string, *sync.Mutex) {
+	mini := newMiniServer()
+	t.Cleanup(mini.Close)
+	var mu sync.Mutex
+	protos := map[string]string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		protos[r.URL.Path] = r.Proto
+		mu.Unlock()
+		mini.Config.Handler.ServeHTTP(w, r)
+	})
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	conn, err := net.ListenPacket("udp", server.Listener.Addr().String())
+	if err != nil {
+		t.Skipf("Can't listen on the UDP port of the server: %s", err)
+	}
+	h3 := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: server.TLS.Certificates})}
+	go h3.Serve(conn)
+	t.Cleanup(func() {
+		h3.Close()
+		conn.Close()
+	})
+	return server, protos, &mu
+}
+
+func TestHTTP3(t *testing.T) {
+	server, protos, mu := newHTTP3MiniServer(t)
+	// The QUIC handshakes take the SNI override as well
+	transport, err := NewTransport(TransportConfig{
+		HTTPVersion: HTTPVersionH3,
+		TLSConfig:   server.Client().Transport.(*http.Transport).TLSClientConfig,
+		ServerName:  "example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewMiniClient(server.URL+"/mini/", Options{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Streams = 2
+	client.FreshConnections = true
+	result, err := client.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Download <= 0 || result.Upload <= 0 || result.Ping <= 0 {
+		t.Errorf("Expected positive results, got %+v", result)
+	}
+	expected := ConnectionInfo{HTTPVersion: "3", TLSVersion: "1.3", Family: "ipv4"}
+	if conn := result.Phases[PhaseDownload].Connection; conn == nil || *conn != expected {
+		t.Errorf("Expected the download connection to be %+v, got %+v", expected, conn)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range []string{"/mini/latency.txt", "/mini/random350x350.jpg", "/mini/upload.php"} {
+		if protos[path] != "HTTP/3.0" {
+			t.Errorf("Expected %s over HTTP/3, got %q", path, protos[path])
+		}
+	}
+}
+
+func TestHTTP3Unsupported(t *testing.T) {
+	// An HTTPS server without HTTP/3
+	mini := newMiniServer()
+	defer mini.Close()
+	server := httptest.NewTLSServer(mini.Config.Handler)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name string
+		url  string
+	}{
+		{"no handshake", server.URL + "/mini/"},
+		{"cleartext", mini.URL + "/mini/"},
+	} {
+		transport, err := NewTransport(TransportConfig{
+			HTTPVersion: HTTPVersionH3,
+			TLSConfig:   server.Client().Transport.(*http.Transport).TLSClientConfig,
+			DialTimeout: 500 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := NewMiniClient(tc.url, Options{Transport: transport})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Measure(context.Background(), PhaseDownload)
+		var versionErr *HTTPVersionError
+		if !errors.As(err, &versionErr) || versionErr.Version != "HTTP/3" || ErrorType(err) != "http_version" {
+			t.Errorf("%s: expected an HTTP/3 version error, got %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// InterfaceBytes are the bytes received and transmitted by a network
+// interface, as counted by the kernel
+type InterfaceBytes struct {
+	Rx int64
+	Tx int64
+}
+
+// parseNetDev returns the counters of iface in r, in the format of
+// /proc/net/dev: two header lines, then one line per interface with its
+// name, the 8 receive counters and the 8 transmit counters, bytes first
+func parseNetDev(r io.Reader, iface string) (InterfaceBytes, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) != iface {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 16 {
+			return InterfaceBytes{}, fmt.Errorf("Unexpected counters of interface %s: %q", iface, counters)
+		}
+		rx, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return InterfaceBytes{}, fmt.Errorf("Invalid received bytes of interface %s: %s", iface, err)
+		}
+		tx, err := strconv.ParseInt(fields[8], 10, 64)
+		if err != nil {
+			return InterfaceBytes{}, fmt.Errorf("Invalid transmitted bytes of interface %s: %s", iface, err)
+		}
+		return InterfaceBytes{Rx: rx, Tx: tx}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return InterfaceBytes{}, err
+	}
+	return InterfaceBytes{}, fmt.Errorf("No interface %s", iface)
+}
+
+// countInterface snapshots the counters of VerifyInterface, and returns
+// the function returning their change since. It returns nil when the
+// interface isn't verified, or its counters can't be read or went back,
+// as when the interface was reset.
+func (client *Client) countInterface(ctx context.Context) func() *InterfaceBytes {
+	if client.VerifyInterface == "" {
+		return func() *InterfaceBytes { return nil }
+	}
+	before, err := ReadInterfaceBytes(client.VerifyInterface)
+	if err != nil {
+		loggerFrom(ctx).Debug("Can't read the interface counters", "interface", client.VerifyInterface, "err", err)
+		return func() *InterfaceBytes { return nil }
+	}
+	return func() *InterfaceBytes {
+		after, err := ReadInterfaceBytes(client.VerifyInterface)
+		if err != nil {
+			loggerFrom(ctx).Debug("Can't read the interface counters", "interface", client.VerifyInterface, "err", err)
+			return nil
+		}
+		if after.Rx < before.Rx || after.Tx < before.Tx {
+			loggerFrom(ctx).Debug("Interface counters reset during the phase", "interface", client.VerifyInterface)
+			return nil
+		}
+		return &InterfaceBytes{Rx: after.Rx - before.Rx, Tx: after.Tx - before.Tx}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"testing"
+)
+
+func TestVerifyInterface(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadInterfaceBytes("lo"); err != nil {
+		t.Skipf("Can't read the loopback counters: %s", err)
+	}
+
+	// The loopback carries the test to the local server
+	client.VerifyInterface = "lo"
+	measurements, err := client.Measure(context.Background(), PhaseDownload, PhaseUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{PhaseDownload, PhaseUpload} {
+		m := measurements[phase]
+		if m.Interface == nil || m.Interface.Rx < m.Bytes || m.Interface.Tx < m.Bytes {
+			t.Errorf("%s: expected at least %d bytes over the loopback, got %+v", phase, m.Bytes, m.Interface)
+		}
+	}
+
+	// A missing interface leaves the counters out
+	client.VerifyInterface = "missing0"
+	measurements, err = client.Measure(context.Background(), PhaseDownload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := measurements[PhaseDownload]; m.Interface != nil {
+		t.Errorf("Expected no counters, got %+v", m.Interface)
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package speedtest
+
+import "errors"
+
+// ReadInterfaceBytes fails, the interface counters being read from the
+// Linux /proc/net/dev
+func ReadInterfaceBytes(iface string) (InterfaceBytes, error) {
+	return InterfaceBytes{}, errors.New("Interface counters are only supported on Linux")
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"strings"
+	"testing"
+)
+
+const netDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:  785321    6120    0    0    0     0          0         0   785321    6120    0    0    0     0       0          0
+  eth0: 9876543210 7012345    0   12    0     0          0      4021 123456789 2012345    0    0    0     0       0          0
+wlan0:12 1 0 0 0 0 0 0 34 1 0 0 0 0 0 0
+  bad0: 12 1 0 0
+`
+
+func TestParseNetDev(t *testing.T) {
+	for iface, expected := range map[string]InterfaceBytes{
+		"lo":    {Rx: 785321, Tx: 785321},
+		"eth0":  {Rx: 9876543210, Tx: 123456789},
+		"wlan0": {Rx: 12, Tx: 34},
+	} {
+		counters, err := parseNetDev(strings.NewReader(netDev), iface)
+		if err != nil {
+			t.Errorf("%s: %s", iface, err)
+		}
+		if counters != expected {
+			t.Errorf("%s: expected %+v, got %+v", iface, expected, counters)
+		}
+	}
+	for iface, expected := range map[string]string{
+		"eth1": "No interface eth1",
+		"bad0": "Unexpected counters",
+		"face": "No interface face",
+	} {
+		if _, err := parseNetDev(strings.NewReader(netDev), iface); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", iface, expected, err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const netnsSupported = true
+
+// netnsDir holds the named network namespaces, as created by ip netns add
+var netnsDir = "/run/netns"
+
+// inNetns runs fn on an OS thread of the named network namespace, so the
+// sockets it creates belong to that namespace. The other goroutines, such
+// as the HTTP listener, stay in the namespace of the process.
+func inNetns(name string, fn func() error) error {
+	target, err := unix.Open(filepath.Join(netnsDir, name), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Unknown network namespace %q: %w", name, err)
+	}
+	defer unix.Close(target)
+
+	errc := make(chan error, 1)
+	go func() {
+		// The thread only goes back to the scheduler once it is back in
+		// the namespace of the process, it terminates with the goroutine
+		// otherwise
+		runtime.LockOSThread()
+		origin, err := unix.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("Can't open the network namespace of the process: %w", err)
+			return
+		}
+		defer unix.Close(origin)
+		if err := unix.Setns(target, unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("Can't enter network namespace %q: %w", name, err)
+			return
+		}
+		err = fn()
+		if unix.Setns(origin, unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+		errc <- err
+	}()
+	return <-errc
+}
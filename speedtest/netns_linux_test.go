@@ -0,0 +1,87 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNetns(t *testing.T) {
+	defer func(dir string) { netnsDir = dir }(netnsDir)
+	netnsDir = t.TempDir()
+	if _, err := NewTransport(TransportConfig{Netns: "missing"}); err == nil {
+		t.Error("Expected an error with an unknown network namespace")
+	}
+
+	mini := newMiniServer()
+	defer mini.Close()
+
+	// The namespace of the process, where the server listens
+	if err := os.Symlink("/proc/self/ns/net", filepath.Join(netnsDir, "default")); err != nil {
+		t.Fatal(err)
+	}
+	transport, err := NewTransport(TransportConfig{Netns: "default"})
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("Entering a network namespace is not permitted")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Measure(context.Background(), PhasePing); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new namespace, whose loopback interface is down, held by a thread
+	// discarded at the end of the test
+	isolated := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			close(isolated)
+			return
+		}
+		isolated <- fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+		<-done
+	}()
+	path, ok := <-isolated
+	if !ok {
+		t.Skip("Creating a network namespace is not permitted")
+	}
+	if err := os.Symlink(path, filepath.Join(netnsDir, "isolated")); err != nil {
+		t.Fatal(err)
+	}
+	if client, err = NewMiniClient(mini.URL+"/mini/", Options{Transport: newTransport(t, TransportConfig{Netns: "isolated"})}); err == nil {
+		_, err = client.Measure(context.Background(), PhasePing)
+	}
+	if err == nil {
+		t.Error("Expected the server to be unreachable from the new namespace")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// officialUploadSizes are the upload payload sizes of the official clients,
+// the smallest ones being skipped by the upload ratio
+var officialUploadSizes = []int{32768, 65536, 131072, 262144, 524288, 1048576, 7340032}
+
+// ServerParameters are the test parameters recommended by the Speedtest
+// configuration, which the official clients obey. The fields missing from
+// the configuration are zero.
+type ServerParameters struct {
+	// DownloadThreads is the threadcount of the server-config element,
+	// UploadThreads the threads of the upload element
+	DownloadThreads int
+	UploadThreads   int
+	// DownloadDuration and UploadDuration are the testlength of the
+	// download and upload elements
+	DownloadDuration time.Duration
+	UploadDuration   time.Duration
+	// UploadRatio, UploadMaxChunkSize and UploadMaxChunkCount are the
+	// ratio, maxchunksize and maxchunkcount of the upload element, which
+	// shape the distribution of the upload payloads
+	UploadRatio         int
+	UploadMaxChunkSize  int
+	UploadMaxChunkCount int
+}
+
+// UploadSizes returns the upload payload sizes of the parameters: the
+// sizes of the official clients from the UploadRatio-th one, capped at
+// UploadMaxChunkSize, repeated for UploadMaxChunkCount payloads in all. It
+// returns nil when the configuration has none of these parameters.
+func (p *ServerParameters) UploadSizes() []int {
+	if p.UploadRatio == 0 && p.UploadMaxChunkSize == 0 && p.UploadMaxChunkCount == 0 {
+		return nil
+	}
+	sizes := officialUploadSizes
+	if p.UploadRatio > 1 {
+		sizes = sizes[min(p.UploadRatio, len(sizes))-1:]
+	}
+	if p.UploadMaxChunkSize > 0 {
+		capped := []int{}
+		for _, size := range sizes {
+			if size <= p.UploadMaxChunkSize {
+				capped = append(capped, size)
+			}
+		}
+		if len(capped) == 0 {
+			capped = []int{p.UploadMaxChunkSize}
+		}
+		sizes = capped
+	}
+	repeat := 1
+	if p.UploadMaxChunkCount > len(sizes) {
+		repeat = p.UploadMaxChunkCount / len(sizes)
+	}
+	distribution := make([]int, 0, repeat*len(sizes))
+	for _, size := range sizes {
+		for i := 0; i < repeat; i++ {
+			distribution = append(distribution, size)
+		}
+	}
+	return distribution
+}
+
+// optionalInt returns the number of the attribute name, 0 when missing and
+// with a warning when invalid, such as the dyn: values of the socket
+// elements
+func (attrs xmlAttrs) optionalInt(name string, element string, warn func(string)) int {
+	value, ok := attrs.text(name)
+	if !ok || value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		warn(fmt.Sprintf("%s with invalid %s %q, ignored", element, name, value))
+		return 0
+	}
+	return n
+}
+
+// optionalSize returns the size of the attribute name, such as 512K, 0
+// when missing and with a warning when invalid
+func (attrs xmlAttrs) optionalSize(name string, element string, warn func(string)) int {
+	value, ok := attrs.text(name)
+	if !ok || value == "" {
+		return 0
+	}
+	unit := 1
+	switch {
+	case strings.HasSuffix(strings.ToUpper(value), "K"):
+		unit = 1024
+	case strings.HasSuffix(strings.ToUpper(value), "M"):
+		unit = 1024 * 1024
+	}
+	digits := value
+	if unit > 1 {
+		digits = value[:len(value)-1]
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 0 {
+		warn(fmt.Sprintf("%s with invalid %s %q, ignored", element, name, value))
+		return 0
+	}
+	return n * unit
+}
+
+// parseParameters returns the test parameters of a Speedtest
+// configuration, nil when it has none. They are all optional, the invalid
+// ones being reported to warn and ignored.
+func parseParameters(body []byte, warn func(string)) *ServerParameters {
+	var p ServerParameters
+	found := false
+	xmlElements(body, "server-config", func(attrs xmlAttrs) {
+		found = true
+		p.DownloadThreads = attrs.optionalInt("threadcount", "server-config", warn)
+	})
+	xmlElements(body, "download", func(attrs xmlAttrs) {
+		found = true
+		p.DownloadDuration = time.Duration(attrs.optionalInt("testlength", "download", warn)) * time.Second
+	})
+	xmlElements(body, "upload", func(attrs xmlAttrs) {
+		found = true
+		p.UploadDuration = time.Duration(attrs.optionalInt("testlength", "upload", warn)) * time.Second
+		p.UploadThreads = attrs.optionalInt("threads", "upload", warn)
+		p.UploadRatio = attrs.optionalInt("ratio", "upload", warn)
+		p.UploadMaxChunkSize = attrs.optionalSize("maxchunksize", "upload", warn)
+		p.UploadMaxChunkCount = attrs.optionalInt("maxchunkcount", "upload", warn)
+	})
+	if !found {
+		return nil
+	}
+	return &p
+}
+
+// TransferParameters are the settings of the transfer phases in force for
+// a test, whether set on the client or recommended by the Speedtest
+// configuration
+type TransferParameters struct {
+	DownloadStreams  int
+	UploadStreams    int
+	DownloadDuration time.Duration
+	UploadDuration   time.Duration
+	// UploadSizes are the sizes of the upload payloads, requested in turn
+	UploadSizes []int
+	// UploadPayload is the content of the upload payloads, random or zero
+	UploadPayload string
+}
+
+// transferParameters returns the transfer settings in force
+func (client *Client) transferParameters() TransferParameters {
+	return TransferParameters{
+		DownloadStreams:  client.streams(PhaseDownload),
+		UploadStreams:    client.streams(PhaseUpload),
+		DownloadDuration: client.DownloadDuration,
+		UploadDuration:   client.UploadDuration,
+		UploadSizes:      client.uploadSizes(),
+		UploadPayload:    client.uploadPayload(),
+	}
+}
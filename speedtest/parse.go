@@ -0,0 +1,158 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The documents whose parse warnings are reported to OnParseWarning
+const (
+	DocumentConfig  = "config"
+	DocumentServers = "servers"
+)
+
+// xmlAttrs are the attributes of an element of the Speedtest documents
+type xmlAttrs []xml.Attr
+
+// text returns the value of the attribute name, matched regardless of case,
+// and whether it is set
+func (attrs xmlAttrs) text(name string) (string, bool) {
+	for _, attr := range attrs {
+		if strings.EqualFold(attr.Name.Local, name) {
+			return strings.TrimSpace(attr.Value), true
+		}
+	}
+	return "", false
+}
+
+// float returns the number of the attribute name, 0 with a warning when
+// missing or invalid
+func (attrs xmlAttrs) float(name string, element string, warn func(string)) float64 {
+	value, ok := attrs.text(name)
+	if !ok {
+		warn(fmt.Sprintf("%s without %s, assuming 0", element, name))
+		return 0
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		warn(fmt.Sprintf("%s with invalid %s %q, assuming 0", element, name, value))
+		return 0
+	}
+	return f
+}
+
+// xmlElements calls fn with the attributes of each element named name, at
+// any depth of body, the other elements being ignored. The walk stops at
+// the first syntax error, returned.
+func xmlElements(body []byte, name string, fn func(attrs xmlAttrs)) error {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if start, ok := token.(xml.StartElement); ok && strings.EqualFold(start.Name.Local, name) {
+			fn(xmlAttrs(start.Attr))
+		}
+	}
+}
+
+// parseConfig returns the client block of a Speedtest configuration. The
+// parse is tolerant: only a missing client element is an error, the
+// unexpected parts of the document being reported to warn.
+func parseConfig(body []byte, warn func(string)) (*ClientInfo, error) {
+	var info *ClientInfo
+	err := xmlElements(body, "client", func(attrs xmlAttrs) {
+		if info != nil {
+			warn("duplicate client element ignored")
+			return
+		}
+		info = &ClientInfo{
+			Lat: attrs.float("lat", "client", warn),
+			Lon: attrs.float("lon", "client", warn),
+		}
+		info.IP, _ = attrs.text("ip")
+		info.ISP, _ = attrs.text("isp")
+	})
+	if info == nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("No client element in the Speedtest configuration")
+	}
+	if err != nil {
+		warn(fmt.Sprintf("rest of the document ignored: %s", err))
+	}
+	return info, nil
+}
+
+// parseServers returns the servers of a Speedtest server list. The parse is
+// tolerant: the servers without URL are skipped, those with invalid
+// coordinates located at 0, and a syntax error keeps the servers read
+// before it, the unexpected parts of the document being reported to warn.
+func parseServers(body []byte, warn func(string)) ([]Server, error) {
+	var servers []Server
+	err := xmlElements(body, "server", func(attrs xmlAttrs) {
+		url, _ := attrs.text("url")
+		id, _ := attrs.text("id")
+		if url == "" {
+			warn(fmt.Sprintf("server %q without url skipped", id))
+			return
+		}
+		element := fmt.Sprintf("server %q", id)
+		server := Server{
+			URL: url,
+			Lat: attrs.float("lat", element, warn),
+			Lon: attrs.float("lon", element, warn),
+			ID:  id,
+		}
+		server.Name, _ = attrs.text("name")
+		server.Country, _ = attrs.text("country")
+		server.CC, _ = attrs.text("cc")
+		server.Sponsor, _ = attrs.text("sponsor")
+		servers = append(servers, server)
+	})
+	if err != nil {
+		if len(servers) == 0 {
+			return nil, err
+		}
+		warn(fmt.Sprintf("rest of the document ignored after %d servers: %s", len(servers), err))
+	}
+	return servers, nil
+}
+
+// parseWarning returns the function reporting the parse warnings of
+// document, logged and passed to OnParseWarning
+func (client *Client) parseWarning(ctx context.Context, document string) func(string) {
+	return func(warning string) {
+		loggerFrom(ctx).Debug("Ignoring a part of the Speedtest document", "document", document, "warning", warning)
+		if client.OnParseWarning != nil {
+			client.OnParseWarning(document, warning)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestParseConfig(t *testing.T) {
+	for _, tc := range []struct {
+		fixture  string
+		expected ClientInfo
+		warnings []string
+	}{
+		{"config-classic.xml", ClientInfo{IP: "203.0.113.7", Lat: 52.5196, Lon: 13.4069, ISP: "Example ISP"}, nil},
+		{"config-current.xml", ClientInfo{IP: "203.0.113.7", Lat: 52.5196, Lon: 13.4069, ISP: "Example ISP"}, nil},
+		{"config-damaged.xml", ClientInfo{IP: "203.0.113.7", ISP: "Example ISP"}, []string{
+			`client with invalid lat "52,5196", assuming 0`,
+			"client without lon, assuming 0",
+			"duplicate client element ignored",
+			"rest of the document ignored",
+		}},
+	} {
+		var warnings []string
+		info, err := parseConfig(readFixture(t, tc.fixture), func(warning string) {
+			warnings = append(warnings, warning)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", tc.fixture, err)
+			continue
+		}
+		if *info != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.fixture, tc.expected, *info)
+		}
+		if len(warnings) != len(tc.warnings) {
+			t.Errorf("%s: expected the warnings %q, got %q", tc.fixture, tc.warnings, warnings)
+			continue
+		}
+		for i := range warnings {
+			if !strings.HasPrefix(warnings[i], tc.warnings[i]) {
+				t.Errorf("%s: expected the warnings %q, got %q", tc.fixture, tc.warnings, warnings)
+				break
+			}
+		}
+	}
+
+	for _, body := range []string{"", "<html><body>Service unavailable</body></html>", "<settings><client"} {
+		if _, err := parseConfig([]byte(body), func(string) {}); err == nil {
+			t.Errorf("%q: expected an error", body)
+		}
+	}
+}
+
+func TestParseServers(t *testing.T) {
+	for _, tc := range []struct {
+		fixture  string
+		expected []string
+		warnings []string
+	}{
+		{"servers-static.xml", []string{"1234 Berlin DE", "5678 Paris FR"}, nil},
+		{"servers-current.xml", []string{"1234 Berlin DE", "5678 Paris FR"}, nil},
+		{"servers-damaged.xml", []string{"1234 Berlin DE", "5678 Paris FR"}, []string{
+			`server "1234" with invalid lon "", assuming 0`,
+			`server "4321" without url skipped`,
+			"rest of the document ignored after 2 servers",
+		}},
+	} {
+		var warnings []string
+		servers, err := parseServers(readFixture(t, tc.fixture), func(warning string) {
+			warnings = append(warnings, warning)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", tc.fixture, err)
+			continue
+		}
+		var got []string
+		for _, server := range servers {
+			if !strings.HasSuffix(server.URL, "/upload.php") || server.Lat == 0 {
+				t.Errorf("%s: unexpected server %+v", tc.fixture, server)
+			}
+			got = append(got, server.ID+" "+server.Name+" "+server.CC)
+		}
+		if strings.Join(got, ", ") != strings.Join(tc.expected, ", ") {
+			t.Errorf("%s: expected the servers %q, got %q", tc.fixture, tc.expected, got)
+		}
+		if len(warnings) != len(tc.warnings) {
+			t.Errorf("%s: expected the warnings %q, got %q", tc.fixture, tc.warnings, warnings)
+			continue
+		}
+		for i := range warnings {
+			if !strings.HasPrefix(warnings[i], tc.warnings[i]) {
+				t.Errorf("%s: expected the warnings %q, got %q", tc.fixture, tc.warnings, warnings)
+				break
+			}
+		}
+	}
+
+	if _, err := parseServers([]byte("<settings><servers><server url="), func(string) {}); err == nil {
+		t.Error("Expected an error without any server")
+	}
+}
+
+func TestParseParameters(t *testing.T) {
+	classic := &ServerParameters{
+		DownloadThreads:     4,
+		UploadThreads:       2,
+		DownloadDuration:    10 * time.Second,
+		UploadDuration:      10 * time.Second,
+		UploadRatio:         5,
+		UploadMaxChunkSize:  512 * 1024,
+		UploadMaxChunkCount: 50,
+	}
+	for _, tc := range []struct {
+		fixture  string
+		expected *ServerParameters
+		sizes    []int
+		warnings []string
+	}{
+		{"config-classic.xml", classic, repeatSize(524288, 50), nil},
+		{"config-current.xml", classic, repeatSize(524288, 50), nil},
+		{"config-minimal.xml", nil, nil, nil},
+		{"config-partial.xml", &ServerParameters{DownloadThreads: 8, UploadDuration: 15 * time.Second, UploadRatio: 3},
+			[]int{131072, 262144, 524288, 1048576, 7340032},
+			[]string{`upload with invalid threads "dyn:tcpulthreads", ignored`}},
+	} {
+		var warnings []string
+		parameters := parseParameters(readFixture(t, tc.fixture), func(warning string) {
+			warnings = append(warnings, warning)
+		})
+		if !reflect.DeepEqual(parameters, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.fixture, tc.expected, parameters)
+		}
+		if !reflect.DeepEqual(warnings, tc.warnings) {
+			t.Errorf("%s: expected the warnings %q, got %q", tc.fixture, tc.warnings, warnings)
+		}
+		if parameters != nil && !reflect.DeepEqual(parameters.UploadSizes(), tc.sizes) {
+			t.Errorf("%s: expected the upload sizes %v, got %v", tc.fixture, tc.sizes, parameters.UploadSizes())
+		}
+	}
+
+	if sizes := (&ServerParameters{UploadDuration: time.Second}).UploadSizes(); sizes != nil {
+		t.Errorf("Expected no upload sizes without their parameters, got %v", sizes)
+	}
+	if sizes := (&ServerParameters{UploadMaxChunkSize: 1000}).UploadSizes(); !reflect.DeepEqual(sizes, []int{1000}) {
+		t.Errorf("Expected the payloads capped at the maximum chunk size, got %v", sizes)
+	}
+}
+
+func repeatSize(size int, count int) []int {
+	sizes := make([]int, count)
+	for i := range sizes {
+		sizes[i] = size
+	}
+	return sizes
+}
@@ -0,0 +1,223 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// rateLimitBurst is the duration of the bursts allowed by the rate
+	// limiter
+	rateLimitBurst = 50 * time.Millisecond
+	// minRateLimitBurst is the minimum burst (bytes) of the rate limiter,
+	// a read of the copy buffers
+	minRateLimitBurst = 32 * 1024
+)
+
+// meter counts the bytes of a transfer phase as they flow, and throttles
+// them to its rate limiter, if not nil. It records the HTTP protocol, the
+// first connection and the encoded responses of the phase, and checks its
+// responses with its cache detector, if not nil. A nil meter does nothing.
+type meter struct {
+	n       int64
+	limiter *rateLimiter
+	cache   *cacheDetector
+	// phase is the meter of the phase of a stream meter, which counts the
+	// bytes of the stream too and records the rest
+	phase *meter
+
+	mu      sync.Mutex
+	proto   string
+	conn    *ConnectionInfo
+	encoded bool
+}
+
+// stream returns a meter counting the bytes of one of the streams of the
+// phase of m
+func (m *meter) stream() *meter {
+	return &meter{limiter: m.limiter, cache: m.cache, phase: m}
+}
+
+// shared returns the meter of the phase, m itself unless a stream meter
+func (m *meter) shared() *meter {
+	if m != nil && m.phase != nil {
+		return m.phase
+	}
+	return m
+}
+
+func (m *meter) setProtocol(proto string) {
+	m = m.shared()
+	if m != nil {
+		m.mu.Lock()
+		m.proto = proto
+		m.mu.Unlock()
+	}
+}
+
+// setEncoded records an encoded response, returning whether it is the first
+func (m *meter) setEncoded() bool {
+	m = m.shared()
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	first := !m.encoded
+	m.encoded = true
+	return first
+}
+
+// setConnection records info, unless a connection is already recorded
+func (m *meter) setConnection(info ConnectionInfo) {
+	m = m.shared()
+	if m != nil {
+		m.mu.Lock()
+		if m.conn == nil {
+			m.conn = &info
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *meter) connection() *ConnectionInfo {
+	m = m.shared()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conn
+}
+
+func (m *meter) protocol() string {
+	m = m.shared()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.proto
+}
+
+// cacheDetector returns the cache detector of the meter, if any
+func (m *meter) cacheDetector() *cacheDetector {
+	if m == nil {
+		return nil
+	}
+	return m.cache
+}
+
+func (m *meter) add(n int) {
+	if m != nil {
+		atomic.AddInt64(&m.n, int64(n))
+		if m.phase != nil {
+			atomic.AddInt64(&m.phase.n, int64(n))
+		}
+	}
+}
+
+func (m *meter) count() int64 {
+	return atomic.LoadInt64(&m.n)
+}
+
+// reader returns r throttled by the rate limiter of the meter, if any
+func (m *meter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if m == nil || m.limiter == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: m.limiter}
+}
+
+// rateLimiter is a token bucket shared by the connections of a transfer
+// phase, a token being a byte
+type rateLimiter struct {
+	rate  float64 // bytes per second
+	burst float64
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	limited bool
+}
+
+// newRateLimiter returns a rate limiter of bitsPerSecond, nil when not set
+func newRateLimiter(bitsPerSecond int64) *rateLimiter {
+	if bitsPerSecond <= 0 {
+		return nil
+	}
+	rate := float64(bitsPerSecond) / 8
+	burst := rate * rateLimitBurst.Seconds()
+	if burst < minRateLimitBurst {
+		burst = minRateLimitBurst
+	}
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes n tokens, waiting for the bucket to refill when they are
+// overdrawn. It returns early with the error of ctx if it is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		l.limited = true
+	}
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttled tells whether the rate limiter held back the transfer
+func (l *rateLimiter) throttled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limited
+}
+
+// limitedReader throttles the reads of r to its rate limiter
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if max := int(r.limiter.burst); len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.wait(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// 10MB/s
+	limiter := newRateLimiter(80 * 1000 * 1000)
+	r := &limitedReader{ctx: context.Background(), r: bytes.NewReader(make([]byte, 2*1000*1000)), limiter: limiter}
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	if err != nil || n != 2*1000*1000 {
+		t.Fatalf("Expected 2MB, got %d (%v)", n, err)
+	}
+	// The first burst isn't throttled
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected 2MB to be read in about 200ms, took %s", elapsed)
+	}
+	if !limiter.throttled() {
+		t.Error("Expected the reads to be throttled")
+	}
+
+	if newRateLimiter(0) != nil {
+		t.Error("Expected no rate limiter without a rate limit")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := newRateLimiter(8*1000*1000).wait(ctx, 10*1000*1000); err != context.Canceled {
+		t.Errorf("Expected the wait to be canceled, got %v", err)
+	}
+}
+
+func TestTransferRateLimit(t *testing.T) {
+	server := bodyServer(64 * 1024 * 1024)
+	defer server.Close()
+	client, err := NewMiniClient(server.URL+"/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.RateLimit = 40 * 1000 * 1000
+	client.DownloadDuration = 500 * time.Millisecond
+	client.DownloadSizes = []int{4000}
+	measurements, err := client.Measure(context.Background(), PhaseDownload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := measurements[PhaseDownload]
+	if m.Value > 40 || m.Value < 20 {
+		t.Errorf("Expected a download bandwidth of about 40 Mbps, got %.2f", m.Value)
+	}
+	if m.RateLimit != 40 || !m.RateLimited {
+		t.Errorf("Expected the download to be rate limited to 40 Mbps, got %+v", m)
+	}
+
+	mini := newMiniServer()
+	defer mini.Close()
+	client, err = NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.RateLimit = 40 * 1000 * 1000
+	client.UploadDuration = 500 * time.Millisecond
+	measurements, err = client.Measure(context.Background(), PhaseUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := measurements[PhaseUpload]; m.Value > 40 || !m.RateLimited {
+		t.Errorf("Expected the upload to be rate limited to 40 Mbps, got %+v", m)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// retryDelay is the time before a failed request is retried
+const retryDelay = 200 * time.Millisecond
+
+// transient tells whether err is the failure of a request worth retrying:
+// a connection reset or closed early, or an overloaded server
+func transient(err error) bool {
+	if errors.Is(err, ErrBadGateway) || errors.Is(err, ErrServerOverloaded) {
+		return true
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retry runs the request of a phase, retrying it up to client.Retries times
+// while it fails with transient errors. The bytes of the failed attempts
+// are taken off m, and not returned. The requests interrupted by ctx are
+// not retried.
+func (client *Client) retry(ctx context.Context, phase string, m *meter, request func() (int64, error)) (int64, error) {
+	for attempt := 1; ; attempt++ {
+		n, err := request()
+		if err == nil || attempt > client.Retries || ctx.Err() != nil || !transient(err) {
+			return n, err
+		}
+		m.add(-int(n))
+		loggerFrom(ctx).Debug("Retrying request", "phase", phase, "attempt", attempt, "err", err)
+		if client.OnRetry != nil {
+			client.OnRetry(phase, err)
+		}
+		timer := time.NewTimer(retryDelay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		}
+	}
+}
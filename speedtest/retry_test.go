@@ -0,0 +1,132 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected bool
+	}{
+		{&HTTPError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&HTTPError{StatusCode: http.StatusBadGateway}, true},
+		{&HTTPError{StatusCode: http.StatusNotFound}, false},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{fmt.Errorf("Post: %w", io.ErrUnexpectedEOF), true},
+		{context.DeadlineExceeded, false},
+		{errors.New("boom"), false},
+	} {
+		if got := transient(tc.err); got != tc.expected {
+			t.Errorf("%v: expected %t, got %t", tc.err, tc.expected, got)
+		}
+	}
+}
+
+// flakyServer serves the mini server files, failing the first requests of
+// each path: with a 503 for the GET requests, by closing the connection
+// for the uploads. The transport itself retries the GET requests when their
+// connection is closed.
+func flakyServer(mini *miniServer, failures int) *httptest.Server {
+	var mu sync.Mutex
+	failed := map[string]int{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := failed[r.URL.Path] < failures
+		if fail {
+			failed[r.URL.Path]++
+		}
+		mu.Unlock()
+		switch {
+		case !fail:
+			mini.Config.Handler.ServeHTTP(w, r)
+		case r.Method == "GET":
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		default:
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+}
+
+func TestRetries(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	server := flakyServer(mini, 1)
+	defer server.Close()
+	client, err := NewMiniClient(server.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Retries = 1
+	client.DownloadSizes = []int{350}
+	client.UploadChunkSize = 1000
+	retries := map[string]int{}
+	client.OnRetry = func(phase string, err error) {
+		retries[phase]++
+	}
+	var mu sync.Mutex
+	statuses := map[string][]int{}
+	client.OnRequest = func(phase string, status int) {
+		mu.Lock()
+		statuses[phase] = append(statuses[phase], status)
+		mu.Unlock()
+	}
+	measurements, err := client.Measure(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The bytes of the failed attempts are not counted
+	if m := measurements[PhaseDownload]; m.Bytes != 1024 {
+		t.Errorf("Expected a single 1024 bytes image, got %d bytes", m.Bytes)
+	}
+	if m := measurements[PhaseUpload]; m.Bytes != 1000 {
+		t.Errorf("Expected a single 1000 bytes upload, got %d bytes", m.Bytes)
+	}
+	if retries[PhaseDownload] != 1 || retries[PhaseUpload] != 1 || retries[PhasePing] != 1 {
+		t.Errorf("Expected a retry by phase, got %v", retries)
+	}
+	// The upload connection is closed without response
+	if !reflect.DeepEqual(statuses[PhaseDownload], []int{503, 200}) || !reflect.DeepEqual(statuses[PhaseUpload], []int{0, 200}) ||
+		len(statuses[PhasePing]) != numLatencyTests+1 || statuses[PhasePing][0] != 503 {
+		t.Errorf("Unexpected request statuses %v", statuses)
+	}
+
+	// Failures beyond the retries abort the phase
+	server = flakyServer(mini, 2)
+	defer server.Close()
+	client, err = NewMiniClient(server.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Retries = 1
+	client.DownloadSizes = []int{350}
+	_, err = client.Measure(context.Background(), PhaseDownload)
+	if pe, ok := err.(*PhaseError); !ok || pe.Phase != PhaseDownload || !errors.Is(err, ErrServerOverloaded) || ErrorType(err) != "overloaded" {
+		t.Errorf("Expected the download to fail with an overloaded server, got %v (%s)", err, ErrorType(err))
+	}
+}
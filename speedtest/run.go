@@ -0,0 +1,53 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import "context"
+
+// The Speedtest.net configuration and server list. They get a cache busting
+// parameter on each fetch.
+const (
+	DefaultConfigURL  = "http://c.speedtest.net/speedtest-config.php"
+	DefaultServersURL = "http://c.speedtest.net/speedtest-servers-static.php"
+)
+
+// Run selects a test server and runs a test against it. The server is
+// selected among those of the Speedtest configuration and server list of
+// opts, or the defaults, or is the Speedtest Mini server of opts.MiniURL.
+// If a phase fails, the result of the previous ones is returned with a
+// *PhaseError; no result is returned when no server could be selected.
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	var client *Client
+	var err error
+	if opts.MiniURL != "" {
+		client, err = NewMiniClient(opts.MiniURL, opts)
+	} else {
+		configURL, serversURL := opts.ConfigURL, opts.ServersURL
+		if configURL == "" {
+			configURL = DefaultConfigURL
+		}
+		if serversURL == "" {
+			serversURL = DefaultServersURL
+		}
+		client, err = NewFilteredClient(ctx, configURL, serversURL, opts.Filter, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.Configure != nil {
+		opts.Configure(client)
+	}
+	return client.Run(ctx, opts.Phases...)
+}
@@ -0,0 +1,337 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+const (
+	earthRadius = 6372.8
+)
+
+// ClientInfo is the client block of the Speedtest configuration: the
+// public IP address, position and ISP of the host as seen by speedtest.net
+type ClientInfo struct {
+	IP  string
+	Lat float64
+	Lon float64
+	ISP string
+}
+
+// Coordinates are a position, in degrees
+type Coordinates struct {
+	Lat float64
+	Lon float64
+}
+
+// Server is a Speedtest server
+type Server struct {
+	URL      string
+	Lat      float64
+	Lon      float64
+	Name     string
+	Country  string
+	CC       string
+	Sponsor  string
+	ID       string
+	Distance float64
+	Latency  float64
+}
+
+// BaseURL returns the URL of the directory holding the server test files.
+// Speedtest servers are advertised by their upload.php URL and serve
+// latency.txt and the random images alongside it.
+func (server Server) BaseURL() string {
+	i := strings.LastIndex(server.URL, "/")
+	if i < 0 {
+		return server.URL + "/"
+	}
+	return server.URL[:i+1]
+}
+
+// fetch retrieves the Speedtest configuration or server list at url, with
+// a fresh x parameter so no intermediary serves it from its cache
+func (client *Client) fetch(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	query := req.URL.Query()
+	query.Set("x", uniuri.New())
+	req.URL.RawQuery = query.Encode()
+	client.setHeaders(req)
+
+	resp, err := client.http.Do(req)
+	if err != nil {
+		return nil, client.httpVersionError(req, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// fetchFirst retrieves the document at the first of the comma separated
+// urls answering one that parses, the others being mirrors tried in turn.
+// Each attempt is bounded by the fetch timeout, and by its share of the
+// time left before the deadline of ctx so the mirrors get to be tried
+// within it. The error of the last attempt is returned when all fail.
+func (client *Client) fetchFirst(ctx context.Context, document string, urls string, parse func(body []byte) error) error {
+	list := splitURLs(urls)
+	if len(list) == 0 {
+		return fmt.Errorf("No URL for the Speedtest %s", document)
+	}
+	var err error
+	for i, url := range list {
+		attempt, cancel := client.attemptContext(ctx, len(list)-i)
+		var body []byte
+		if body, err = client.fetch(attempt, url); err == nil {
+			err = parse(body)
+		}
+		cancel()
+		if err == nil {
+			loggerFrom(ctx).Debug("Retrieved the Speedtest "+document, "url", url)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if i < len(list)-1 {
+			loggerFrom(ctx).Warn("Error retrieving the Speedtest "+document+", trying the next URL", "url", url, "err", err)
+		}
+	}
+	return err
+}
+
+// attemptContext returns the context of an attempt of fetchFirst, left
+// attempts remaining including this one
+func (client *Client) attemptContext(ctx context.Context, left int) (context.Context, context.CancelFunc) {
+	timeout := client.fetchTimeout
+	if timeout <= 0 {
+		timeout = httpTimeout
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if share := time.Until(deadline) / time.Duration(left); share < timeout {
+			timeout = share
+		}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// splitURLs splits a comma separated list of URLs
+func splitURLs(urls string) []string {
+	var list []string
+	for _, url := range strings.Split(urls, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			list = append(list, url)
+		}
+	}
+	return list
+}
+
+// getConfig retrieves the Speedtest configuration from the first of urls
+// answering and returns its client block and its test parameters, if any
+func (client *Client) getConfig(ctx context.Context, urls string) (*ClientInfo, *ServerParameters, error) {
+	ctx, end := client.trace(ctx, StepConfig)
+	var info *ClientInfo
+	var parameters *ServerParameters
+	err := client.fetchFirst(ctx, DocumentConfig, urls, func(body []byte) error {
+		warn := client.parseWarning(ctx, DocumentConfig)
+		var err error
+		if info, err = parseConfig(body, warn); err == nil {
+			parameters = parseParameters(body, warn)
+		}
+		return err
+	})
+	end(Step{Err: err})
+	if err == nil && client.clientLocation != nil {
+		info.Lat, info.Lon = client.clientLocation.Lat, client.clientLocation.Lon
+	}
+	return info, parameters, err
+}
+
+// locationSource tells where the coordinates of the client come from: the
+// configuration, or the override of the options
+func (client *Client) locationSource() string {
+	if client.clientLocation != nil {
+		return "override"
+	}
+	return "configuration"
+}
+
+// FetchClientInfo retrieves the client block of the Speedtest configuration
+// again, as the client IP address may have changed since the client was
+// created. Speedtest Mini clients have no configuration.
+func (client *Client) FetchClientInfo(ctx context.Context) (*ClientInfo, error) {
+	if client.configURL == "" {
+		return nil, fmt.Errorf("No Speedtest configuration for Speedtest Mini servers")
+	}
+	info, _, err := client.getConfig(ctx, client.configURL)
+	return info, err
+}
+
+// getServers retrieves the list of all Speedtest servers from the first of
+// urls answering
+func (client *Client) getServers(ctx context.Context, urls string) ([]Server, error) {
+	ctx, end := client.trace(ctx, StepServers)
+	var servers []Server
+	err := client.fetchFirst(ctx, DocumentServers, urls, func(body []byte) error {
+		var err error
+		servers, err = parseServers(body, client.parseWarning(ctx, DocumentServers))
+		return err
+	})
+	end(Step{Err: err})
+	return servers, err
+}
+
+// closestServers sorts the servers by their distance from the client
+func closestServers(info *ClientInfo, servers []Server) []Server {
+	for i := range servers {
+		servers[i].Distance = distance(info.Lat, info.Lon, servers[i].Lat, servers[i].Lon)
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return servers[i].Distance < servers[j].Distance
+	})
+	return servers
+}
+
+// fastestServer measures the latency of the given servers, in order, until
+// numClosest of them answered, and returns the one with the lowest latency,
+// aggregated as in the ping phase.
+func (client *Client) fastestServer(ctx context.Context, servers []Server) (Server, error) {
+	var candidates []Server
+	client.probes = map[string]latencyProbe{}
+	for _, server := range servers {
+		if ctx.Err() != nil {
+			return Server{}, ctx.Err()
+		}
+		latency, _, err := client.latency(ctx, server)
+		client.probes[server.URL] = latencyProbe{latency: latency, err: err}
+		if err != nil {
+			loggerFrom(ctx).Debug("Skipping server", "server_id", server.ID, "name", server.Name, "err", err)
+			continue
+		}
+		loggerFrom(ctx).Debug("Server latency", "server_id", server.ID, "name", server.Name,
+			"distance", server.Distance, "ms", latency)
+		server.Latency = latency
+		candidates = append(candidates, server)
+		if len(candidates) == numClosest {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return Server{}, fmt.Errorf("No Speedtest server available")
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Latency < candidates[j].Latency
+	})
+	return candidates[0], nil
+}
+
+// latencyProbe is the outcome of the latency measurement of a server
+type latencyProbe struct {
+	latency float64
+	err     error
+}
+
+// ServerStatus describes a server the test server was selected from
+type ServerStatus struct {
+	Server
+	// Probed tells whether the latency of the server was measured, and Err
+	// is the error which made it unavailable, if any
+	Probed   bool
+	Err      error
+	Selected bool
+}
+
+// Servers returns the servers the test server was selected from, closest
+// first, with the latency measured during the selection, if it got to
+// them. With probe set, their latency is measured again, the servers left
+// when ctx is done keeping the latency of the selection. A Speedtest Mini
+// client only has its server.
+func (client *Client) Servers(ctx context.Context, probe bool) []ServerStatus {
+	servers := client.ClosestServers
+	if len(servers) == 0 {
+		servers = []Server{client.Server}
+	}
+	statuses := make([]ServerStatus, len(servers))
+	for i, server := range servers {
+		status := ServerStatus{Server: server, Selected: server.URL == client.Server.URL}
+		if p, ok := client.probes[server.URL]; ok {
+			status.Latency, status.Err, status.Probed = p.latency, p.err, true
+		}
+		if probe && ctx.Err() == nil {
+			latency, _, err := client.latency(ctx, server)
+			if ctx.Err() == nil {
+				status.Latency, status.Err, status.Probed = latency, err, true
+			}
+		}
+		statuses[i] = status
+	}
+	return statuses
+}
+
+// ServerFilter restricts the servers considered during server selection.
+// Empty fields don't filter anything.
+type ServerFilter struct {
+	IDs          []string
+	CountryCodes []string
+}
+
+func (filter ServerFilter) String() string {
+	return fmt.Sprintf("IDs %v country codes %v", filter.IDs, filter.CountryCodes)
+}
+
+func (filter ServerFilter) apply(servers []Server) []Server {
+	contains := func(values []string, value string) bool {
+		if len(values) == 0 {
+			return true
+		}
+		for _, v := range values {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	}
+	var result []Server
+	for _, server := range servers {
+		if contains(filter.IDs, server.ID) && contains(filter.CountryCodes, server.CC) {
+			result = append(result, server)
+		}
+	}
+	return result
+}
+
+// distance computes the great circle distance (km) between two positions
+// using the haversine formula.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	hav := func(theta float64) float64 { return .5 * (1 - math.Cos(theta)) }
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	phi1, phi2 := rad(lat1), rad(lat2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(hav(phi2-phi1)+
+		math.Cos(phi1)*math.Cos(phi2)*hav(rad(lon2)-rad(lon1))))
+}
@@ -0,0 +1,393 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlamirault/speedtest_exporter/internal/speedtestfake"
+)
+
+func TestServerBaseURL(t *testing.T) {
+	for url, expected := range map[string]string{
+		"http://example.com/speedtest/upload.php": "http://example.com/speedtest/",
+		"http://example.com/upload.php":           "http://example.com/",
+		"upload.php":                              "upload.php/",
+	} {
+		if got := (Server{URL: url}).BaseURL(); got != expected {
+			t.Errorf("BaseURL of %q: expected %q, got %q", url, expected, got)
+		}
+	}
+}
+
+func TestServerFilter(t *testing.T) {
+	servers := []Server{
+		{ID: "1", CC: "DE"},
+		{ID: "2", CC: "FR"},
+		{ID: "3", CC: "DE"},
+	}
+	for _, tc := range []struct {
+		filter   ServerFilter
+		expected []string
+	}{
+		{ServerFilter{}, []string{"1", "2", "3"}},
+		{ServerFilter{IDs: []string{"2", "3"}}, []string{"2", "3"}},
+		{ServerFilter{CountryCodes: []string{"de"}}, []string{"1", "3"}},
+		{ServerFilter{IDs: []string{"2"}, CountryCodes: []string{"DE"}}, nil},
+	} {
+		var got []string
+		for _, server := range tc.filter.apply(servers) {
+			got = append(got, server.ID)
+		}
+		if len(got) != len(tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.filter, tc.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.expected[i] {
+				t.Errorf("%s: expected %v, got %v", tc.filter, tc.expected, got)
+				break
+			}
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	// Berlin to Paris is about 878 km
+	if d := distance(52.52, 13.405, 48.8566, 2.3522); math.Abs(d-878) > 5 {
+		t.Errorf("Expected about 878 km, got %v", d)
+	}
+	if d := distance(10, 20, 10, 20); d != 0 {
+		t.Errorf("Expected 0 km, got %v", d)
+	}
+}
+
+func TestClosestServers(t *testing.T) {
+	info := &ClientInfo{Lat: 52.52, Lon: 13.405}
+	servers := closestServers(info, []Server{
+		{ID: "new-york", Lat: 40.71, Lon: -74.01},
+		{ID: "paris", Lat: 48.86, Lon: 2.35},
+		{ID: "berlin", Lat: 52.52, Lon: 13.40},
+	})
+	for i, expected := range []string{"berlin", "paris", "new-york"} {
+		if servers[i].ID != expected {
+			t.Errorf("Expected %s at position %d, got %s", expected, i, servers[i].ID)
+		}
+	}
+	if servers[0].Distance > 1 || servers[2].Distance < 6000 {
+		t.Errorf("Unexpected distances %v, %v", servers[0].Distance, servers[2].Distance)
+	}
+}
+
+func TestMbps(t *testing.T) {
+	if got := mbps(1000*1000, time.Second); got != 8 {
+		t.Errorf("Expected 8 Mbps, got %v", got)
+	}
+	if got := mbps(250*1000, 500*time.Millisecond); got != 4 {
+		t.Errorf("Expected 4 Mbps, got %v", got)
+	}
+}
+
+func TestFetchCacheBusting(t *testing.T) {
+	var mu sync.Mutex
+	var nonces []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		nonces = append(nonces, r.URL.Query().Get("x"))
+		mu.Unlock()
+		if r.URL.Query().Get("lang") != "en" || r.Header.Get("Cache-Control") != "no-cache" {
+			t.Errorf("Unexpected request %s with headers %v", r.URL, r.Header)
+		}
+	}))
+	defer server.Close()
+	client := &Client{http: newHTTPClient(nil)}
+	for i := 0; i < 2; i++ {
+		if _, err := client.fetch(context.Background(), server.URL+"/speedtest-config.php?lang=en"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(nonces) != 2 || nonces[0] == "" || nonces[0] == nonces[1] {
+		t.Errorf("Expected a different nonce on each fetch, got %q", nonces)
+	}
+}
+
+// scriptedServer serves a Speedtest configuration locating the client in
+// Berlin and a list of four test servers: 2 in Hamburg answers quickly, 1 in
+// Berlin slowly, 4 in Paris even more slowly, and 3 in Munich is down. It
+// records the paths of the requests it gets.
+type scriptedServer struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	paths []string
+}
+
+func newScriptedServer() *scriptedServer {
+	scripted := &scriptedServer{}
+	scripted.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scripted.mu.Lock()
+		scripted.paths = append(scripted.paths, r.URL.Path)
+		scripted.mu.Unlock()
+		switch {
+		case r.URL.Path == "/config.php":
+			fmt.Fprint(w, `<settings><client ip="203.0.113.7" lat="52.52" lon="13.40" isp="Example ISP"/></settings>`)
+		case r.URL.Path == "/servers.php":
+			fmt.Fprintf(w, `<settings><servers>`+
+				`<server url="%[1]s/berlin/upload.php" lat="52.52" lon="13.40" name="Berlin" country="Germany" cc="DE" sponsor="Slow" id="1"/>`+
+				`<server url="%[1]s/hamburg/upload.php" lat="53.55" lon="10.00" name="Hamburg" country="Germany" cc="DE" sponsor="Fast" id="2"/>`+
+				`<server url="%[1]s/munich/upload.php" lat="48.14" lon="11.58" name="Munich" country="Germany" cc="DE" sponsor="Down" id="3"/>`+
+				`<server url="%[1]s/paris/upload.php" lat="48.86" lon="2.35" name="Paris" country="France" cc="FR" sponsor="Slow" id="4"/>`+
+				`</servers></settings>`, scripted.URL)
+		case strings.HasPrefix(r.URL.Path, "/munich/"):
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+		case strings.HasSuffix(r.URL.Path, "/latency.txt"):
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/berlin/"):
+				time.Sleep(20 * time.Millisecond)
+			case strings.HasPrefix(r.URL.Path, "/paris/"):
+				time.Sleep(40 * time.Millisecond)
+			}
+			fmt.Fprint(w, "test=test\n")
+		case strings.HasSuffix(r.URL.Path, ".jpg"):
+			w.Write(make([]byte, 1024))
+		case strings.HasSuffix(r.URL.Path, "/upload.php") && r.Method == "POST":
+			n, _ := io.Copy(io.Discard, r.Body)
+			fmt.Fprintf(w, "size=%d", n)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return scripted
+}
+
+// requested returns the paths requested so far, and forgets them
+func (scripted *scriptedServer) requested() []string {
+	scripted.mu.Lock()
+	defer scripted.mu.Unlock()
+	paths := scripted.paths
+	scripted.paths = nil
+	return paths
+}
+
+func TestNewClient(t *testing.T) {
+	scripted := newScriptedServer()
+	defer scripted.Close()
+	client, err := NewClient(scripted.URL+"/config.php", scripted.URL+"/servers.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ClientInfo{IP: "203.0.113.7", Lat: 52.52, Lon: 13.40, ISP: "Example ISP"}
+	if *client.Config != expected {
+		t.Errorf("Expected the client info %+v, got %+v", expected, *client.Config)
+	}
+	if len(client.AllServers) != 4 {
+		t.Fatalf("Expected 4 servers, got %+v", client.AllServers)
+	}
+	if s := client.AllServers[3]; s.ID != "4" || s.Name != "Paris" || s.Country != "France" || s.CC != "FR" ||
+		s.Sponsor != "Slow" || s.Lat != 48.86 || s.Lon != 2.35 || s.URL != scripted.URL+"/paris/upload.php" {
+		t.Errorf("Unexpected server %+v", s)
+	}
+	var ids []string
+	for _, server := range client.ClosestServers {
+		ids = append(ids, server.ID)
+	}
+	if strings.Join(ids, ",") != "1,2,3,4" {
+		t.Errorf("Expected the servers sorted by distance, got %v", ids)
+	}
+	if client.Server.ID != "2" || client.Server.Latency <= 0 {
+		t.Errorf("Expected the fastest server to be selected, got %+v", client.Server)
+	}
+
+	client.DownloadSizes = []int{350}
+	client.UploadMaxBytes = 1 << 20
+	scripted.requested()
+	measurements, err := client.Measure(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{PhasePing, PhaseDownload, PhaseUpload} {
+		if m, ok := measurements[phase]; !ok || m.Value <= 0 {
+			t.Errorf("Expected a %s measurement, got %+v", phase, m)
+		}
+	}
+	if m := measurements[PhaseDownload]; m.Bytes == 0 || m.Bytes%1024 != 0 {
+		t.Errorf("Expected whole images to be downloaded, got %d bytes", m.Bytes)
+	}
+	if m := measurements[PhaseUpload]; m.Bytes == 0 || m.Bytes > 1<<20 {
+		t.Errorf("Expected the upload to be capped, got %d bytes", m.Bytes)
+	}
+	for _, path := range scripted.requested() {
+		if !strings.HasPrefix(path, "/hamburg/") {
+			t.Errorf("Expected the tests to run against the selected server, got a request for %s", path)
+		}
+	}
+}
+
+func TestClientMirrors(t *testing.T) {
+	scripted := newScriptedServer()
+	defer scripted.Close()
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+
+	// The hanging configuration URL times out, the server list URL is
+	// missing, and the mirrors answer
+	start := time.Now()
+	ctx := context.Background()
+	client, err := NewFilteredClient(ctx, hanging.URL+"/config.php, "+scripted.URL+"/config.php", scripted.URL+"/missing.php,"+scripted.URL+"/servers.php", ServerFilter{}, Options{FetchTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Config.IP != "203.0.113.7" || len(client.AllServers) != 4 {
+		t.Errorf("Expected the configuration and server list of the mirrors, got %+v and %d servers", client.Config, len(client.AllServers))
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the hanging URL to time out after 200ms, took %s", elapsed)
+	}
+	if info, err := client.FetchClientInfo(ctx); err != nil || info.IP != "203.0.113.7" {
+		t.Errorf("Expected the configuration to be fetched again from the mirror, got %+v and %v", info, err)
+	}
+
+	// Without a fetch timeout, the hanging URL gets its share of the
+	// deadline, leaving time for the mirror
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := NewFilteredClient(ctx, hanging.URL+"/config.php,"+scripted.URL+"/config.php", scripted.URL+"/servers.php", ServerFilter{}, Options{}); err != nil {
+		t.Errorf("Expected the mirror to be tried within the deadline, got %v", err)
+	}
+
+	// The error of the last URL is returned when all fail
+	_, err = NewFilteredClient(context.Background(), scripted.URL+"/missing.php,"+scripted.URL+"/munich/config.php", scripted.URL+"/servers.php", ServerFilter{}, Options{})
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the error of the last mirror, got %v", err)
+	}
+}
+
+func TestClientLocationOverride(t *testing.T) {
+	fake := speedtestfake.New(speedtestfake.Options{})
+	defer fake.Close()
+
+	client, err := NewFilteredClient(context.Background(), fake.ConfigURL(), fake.ServersURL(), ServerFilter{}, Options{ClientLocation: &Coordinates{Lat: 40.7, Lon: -74}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Config.Lat != 40.7 || client.Config.Lon != -74 {
+		t.Errorf("Expected the coordinates of the options, got %+v", client.Config)
+	}
+	if client.ClosestServers[0].ID != "99" {
+		t.Errorf("Expected server 99 to be the closest one, got %+v", client.ClosestServers)
+	}
+	info, err := client.FetchClientInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Lat != 40.7 || info.Lon != -74 || info.IP != "203.0.113.7" {
+		t.Errorf("Expected the refreshed configuration to be overridden too, got %+v", info)
+	}
+
+	client, err = NewFilteredClient(context.Background(), fake.ConfigURL(), fake.ServersURL(), ServerFilter{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Config.Lat != 52.5 || client.ClosestServers[0].ID != "1234" {
+		t.Errorf("Expected the coordinates of the configuration, got %+v", client.Config)
+	}
+
+	client, err = NewFilteredClient(context.Background(), fake.ConfigURL(), fake.ServersURL(), ServerFilter{}, Options{ClientLocation: &Coordinates{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Config.Lat != 0 || client.Config.Lon != 0 || client.locationSource() != "override" {
+		t.Errorf("Expected 0,0 to override the coordinates of the configuration, got %+v", client.Config)
+	}
+}
+
+func TestNewFilteredClient(t *testing.T) {
+	scripted := newScriptedServer()
+	defer scripted.Close()
+	for _, tc := range []struct {
+		filter   ServerFilter
+		expected string
+	}{
+		{ServerFilter{CountryCodes: []string{"fr"}}, "4"},
+		{ServerFilter{IDs: []string{"1", "4"}}, "1"},
+		{ServerFilter{IDs: []string{"3"}}, ""},
+		{ServerFilter{CountryCodes: []string{"US"}}, ""},
+	} {
+		client, err := NewFilteredClient(context.Background(), scripted.URL+"/config.php", scripted.URL+"/servers.php", tc.filter, Options{})
+		switch {
+		case tc.expected == "" && err == nil:
+			t.Errorf("%s: expected no server, got %+v", tc.filter, client.Server)
+		case tc.expected != "" && err != nil:
+			t.Errorf("%s: %v", tc.filter, err)
+		case tc.expected != "" && client.Server.ID != tc.expected:
+			t.Errorf("%s: expected server %s, got %+v", tc.filter, tc.expected, client.Server)
+		}
+	}
+}
+
+func TestServers(t *testing.T) {
+	scripted := newScriptedServer()
+	defer scripted.Close()
+	client, err := NewClient(scripted.URL+"/config.php", scripted.URL+"/servers.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(statuses []ServerStatus) {
+		if len(statuses) != 4 {
+			t.Fatalf("Expected 4 servers, got %+v", statuses)
+		}
+		for _, status := range statuses {
+			if !status.Probed {
+				t.Errorf("Expected server %s to be probed", status.ID)
+			}
+			if status.Selected != (status.ID == "2") {
+				t.Errorf("Expected server 2 only to be selected, got %+v", status)
+			}
+			if (status.Err != nil) != (status.ID == "3") || (status.Err == nil && status.Latency <= 0) {
+				t.Errorf("Expected server 3 only to be unavailable, got %+v", status)
+			}
+		}
+		if statuses[0].ID != "1" || statuses[0].Distance != 0 || statuses[3].Distance <= statuses[2].Distance {
+			t.Errorf("Expected the servers sorted by distance, got %+v", statuses)
+		}
+	}
+	check(client.Servers(context.Background(), false))
+
+	scripted.requested()
+	check(client.Servers(context.Background(), true))
+	if requested := scripted.requested(); len(requested) == 0 {
+		t.Error("Expected the latencies to be measured again")
+	}
+
+	// The servers left when the time budget is over keep their latency
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	check(client.Servers(ctx, true))
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultShareURL is the speedtest.net API the results are submitted to
+	DefaultShareURL = "https://www.speedtest.net/api/api.php"
+	// shareHashKey is the key of the hash of the submitted results
+	shareHashKey = "297aae72"
+	// shareReferer is the referer expected by the API, that of the Flash
+	// client
+	shareReferer = "http://c.speedtest.net/flash/speedtest.swf"
+	// maxShareResponseSize caps the response of the API
+	maxShareResponseSize = 64 * 1024
+)
+
+// ShareResult submits result to the speedtest.net API at Client.ShareURL,
+// or DefaultShareURL, as the classic clients do, so it shows in the result
+// history of speedtest.net. It returns the URL of the image of the
+// result. Only the complete results of speedtest.net servers can be
+// submitted.
+func (client *Client) ShareResult(ctx context.Context, result *Result) (string, error) {
+	if err := shareable(result); err != nil {
+		return "", err
+	}
+	shareURL := client.ShareURL
+	if shareURL == "" {
+		shareURL = DefaultShareURL
+	}
+
+	// The bandwidths are submitted in kbps and the latency in ms, rounded
+	ping := int64(math.Round(result.Ping))
+	download := int64(math.Round(result.Download * 1000))
+	upload := int64(math.Round(result.Upload * 1000))
+	hash := md5.Sum([]byte(fmt.Sprintf("%d-%d-%d-%s", ping, upload, download, shareHashKey)))
+	form := url.Values{
+		"recommendedserverid": {result.Server.ID},
+		"serverid":            {result.Server.ID},
+		"ping":                {strconv.FormatInt(ping, 10)},
+		"download":            {strconv.FormatInt(download, 10)},
+		"upload":              {strconv.FormatInt(upload, 10)},
+		"bytesreceived":       {strconv.FormatInt(result.BytesDown, 10)},
+		"bytessent":           {strconv.FormatInt(result.BytesUp, 10)},
+		"hash":                {fmt.Sprintf("%x", hash)},
+		"testmethod":          {"http"},
+		"touchscreen":         {"none"},
+		"startmode":           {"pingselect"},
+		"accuracy":            {"1"},
+		"screenresolution":    {""},
+		"screendpi":           {""},
+		"promo":               {""},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", shareURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	client.setHeaders(req)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", shareReferer)
+
+	resp, err := client.http.Do(req)
+	if err != nil {
+		return "", client.httpVersionError(req, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &HTTPError{URL: shareURL, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxShareResponseSize))
+	if err != nil {
+		return "", err
+	}
+	answer, err := url.ParseQuery(strings.TrimSpace(string(body)))
+	if err != nil {
+		return "", fmt.Errorf("Invalid answer of %s: %s", shareURL, err)
+	}
+	id := answer.Get("resultid")
+	if id == "" {
+		return "", fmt.Errorf("No result ID in the answer of %s", shareURL)
+	}
+	// The result image is served by the host of the API
+	u, err := url.Parse(shareURL)
+	if err != nil {
+		return "", err
+	}
+	return u.Scheme + "://" + u.Host + "/result/" + url.PathEscape(id) + ".png", nil
+}
+
+// shareable tells why result can't be shared, if so
+func shareable(result *Result) error {
+	if result.Server.ID == "" {
+		return fmt.Errorf("Only the results of speedtest.net servers can be shared")
+	}
+	for _, phase := range []string{PhasePing, PhaseDownload, PhaseUpload} {
+		if !result.Succeeded[phase] {
+			return fmt.Errorf("The %s phase of the result didn't succeed", phase)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestShareResult(t *testing.T) {
+	var form url.Values
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/api.php" || r.Header.Get("Referer") != shareReferer {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		r.ParseForm()
+		form = r.PostForm
+		fmt.Fprint(w, "resultid=1234567890&date=1%2F1%2F2026&time=12%3A00+PM&rating=0")
+	}))
+	defer api.Close()
+	mini := newMiniServer()
+	defer mini.Close()
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ShareURL = api.URL + "/api/api.php"
+
+	result := &Result{
+		Server:    Server{ID: "4242"},
+		Ping:      12.4,
+		Download:  93.5,
+		Upload:    8.25,
+		BytesDown: 117000000,
+		BytesUp:   10300000,
+		Succeeded: map[string]bool{PhasePing: true, PhaseDownload: true, PhaseUpload: true},
+	}
+	shared, err := client.ShareResult(context.Background(), result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := api.URL + "/result/1234567890.png"; shared != expected {
+		t.Errorf("Expected the result image %s, got %s", expected, shared)
+	}
+	for field, expected := range map[string]string{
+		"serverid":      "4242",
+		"ping":          "12",
+		"download":      "93500",
+		"upload":        "8250",
+		"bytesreceived": "117000000",
+		"bytessent":     "10300000",
+		"hash":          "7d03efc6a190eea5dabbe2514c95b3c6",
+	} {
+		if value := form.Get(field); value != expected {
+			t.Errorf("Expected %s=%s, got %q", field, expected, value)
+		}
+	}
+
+	// The incomplete results are not submitted
+	result.Succeeded[PhaseUpload] = false
+	form = nil
+	if _, err := client.ShareResult(context.Background(), result); err == nil || form != nil {
+		t.Error("Expected an error sharing an incomplete result")
+	}
+
+	// A rejected submission fails
+	client.ShareURL = api.URL + "/other"
+	result.Succeeded[PhaseUpload] = true
+	if _, err := client.ShareResult(context.Background(), result); err == nil {
+		t.Error("Expected an error without result ID")
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSoakInterval is the period of the soak reports when not set
+	defaultSoakInterval = 5 * time.Second
+	// soakCheckInterval is the period the soak transfers are checked for
+	// stalls at
+	soakCheckInterval = 100 * time.Millisecond
+	// soakStallThreshold is the minimum time without data a soak transfer
+	// is stalled after, longer at the rates whose bursts are further apart
+	soakStallThreshold = time.Second
+	// soakStallTimeout is the time without data after which a soak
+	// transfer is dropped and reconnected
+	soakStallTimeout = 10 * time.Second
+	// soakMinBackoff and soakMaxBackoff bound the delay before a failed
+	// soak transfer is reconnected, doubled on each consecutive failure
+	soakMinBackoff = time.Second
+	soakMaxBackoff = time.Minute
+)
+
+// SoakOptions defines a soak test: transfers throttled to a low rate, kept
+// running continuously, instead of discrete tests transferring as much as
+// possible
+type SoakOptions struct {
+	// DownloadRate and UploadRate are the target rates (bits per second)
+	// of the download and upload, a direction being left out when zero
+	DownloadRate int64
+	UploadRate   int64
+	// URL, if set, is fetched by the downloads and posted to by the
+	// uploads instead of the test server
+	URL string
+	// Interval is the period of the reports, 5 seconds when not set
+	Interval time.Duration
+}
+
+// SoakReport is the activity of a soak test over a report interval
+type SoakReport struct {
+	// Elapsed is the time the report covers
+	Elapsed time.Duration
+	// DownloadBytes and UploadBytes are the bytes transferred over the
+	// interval, Download and Upload their rates (Mbps)
+	DownloadBytes int64
+	UploadBytes   int64
+	Download      float64
+	Upload        float64
+	// Ping is the round trip time (ms) to the test server last measured
+	// over the interval, the transfers running. It is zero when the
+	// measurement failed, with PingErr.
+	Ping    float64
+	PingErr error
+	// Stalls is the number of times the transfers stopped receiving or
+	// sending data for a while over the interval, and Reconnects the
+	// number of times they failed and were reconnected, by phase:
+	// download or upload
+	Stalls     map[string]int
+	Reconnects map[string]int
+	// Err is the last error of the transfers reconnected over the
+	// interval
+	Err error
+}
+
+// soakFlow is a soak transfer in one direction, requested again when it
+// completes, and reconnected with a backoff when it fails
+type soakFlow struct {
+	phase   string
+	url     string
+	meter   *meter
+	request func(ctx context.Context, m *meter) (int64, error)
+	// threshold is the time without data the flow is stalled after
+	threshold time.Duration
+
+	mu sync.Mutex
+	// cancel aborts the request in flight, aborted telling whether it
+	// was for stalling
+	cancel     context.CancelFunc
+	aborted    bool
+	reconnects int
+	err        error
+
+	// The progress of the flow, only tracked by the monitor of the test
+	reported     int64
+	last         int64
+	lastProgress time.Time
+	stalled      bool
+	stalls       int
+}
+
+// run requests the flow until ctx is done
+func (f *soakFlow) run(ctx context.Context) {
+	backoff := soakMinBackoff
+	for ctx.Err() == nil {
+		requestCtx, cancel := context.WithCancel(ctx)
+		f.mu.Lock()
+		f.cancel, f.aborted = cancel, false
+		f.mu.Unlock()
+		n, err := f.request(requestCtx, f.meter)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if n > 0 {
+			backoff = soakMinBackoff
+		}
+		if err == nil {
+			continue
+		}
+		f.mu.Lock()
+		if f.aborted {
+			err = &StalledTransferError{URL: f.url, Timeout: soakStallTimeout}
+		}
+		f.reconnects++
+		f.err = err
+		f.mu.Unlock()
+		loggerFrom(ctx).Debug("Soak transfer failed, reconnecting", "phase", f.phase, "backoff", backoff, "err", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		backoff = min(2*backoff, soakMaxBackoff)
+	}
+}
+
+// abort interrupts the request in flight, if any, as stalled
+func (f *soakFlow) abort() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cancel != nil {
+		f.aborted = true
+		f.cancel()
+	}
+}
+
+// check counts a stall when the flow transferred no data for its
+// threshold, and aborts the request when it didn't for soakStallTimeout
+func (f *soakFlow) check(now time.Time) {
+	if n := f.meter.count(); n != f.last {
+		f.last, f.lastProgress, f.stalled = n, now, false
+		return
+	}
+	idle := now.Sub(f.lastProgress)
+	if idle >= f.threshold && !f.stalled {
+		f.stalled = true
+		f.stalls++
+	}
+	if idle >= soakStallTimeout {
+		f.abort()
+		f.lastProgress = now
+	}
+}
+
+// Soak runs a soak test until ctx is done: the download and upload are
+// throttled to their target rates and requested again as they complete,
+// and the round trip time to the server is measured along, each interval.
+// The activity of each interval is passed to report. The transfers failing
+// or stalled for soakStallTimeout are reconnected after a backoff.
+func (client *Client) Soak(ctx context.Context, opts SoakOptions, report func(SoakReport)) error {
+	if opts.DownloadRate <= 0 && opts.UploadRate <= 0 {
+		return errors.New("No soak rate set")
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = defaultSoakInterval
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var flows []*soakFlow
+	if opts.DownloadRate > 0 {
+		url := opts.URL
+		if url == "" {
+			sizes := client.DownloadSizes
+			if len(sizes) == 0 {
+				sizes = DownloadSizes
+			}
+			size := sizes[len(sizes)-1]
+			url = fmt.Sprintf("%srandom%dx%d.jpg", client.Server.BaseURL(), size, size)
+		}
+		flows = append(flows, client.soakFlow(PhaseDownload, url, opts.DownloadRate, func(ctx context.Context, m *meter) (int64, error) {
+			req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+			if err != nil {
+				return 0, err
+			}
+			return client.do(PhaseDownload, req, m)
+		}))
+	}
+	if opts.UploadRate > 0 {
+		url := opts.URL
+		if url == "" {
+			url = client.Server.URL
+		}
+		sizes := client.uploadSizes()
+		size := int64(sizes[len(sizes)-1])
+		flows = append(flows, client.soakFlow(PhaseUpload, url, opts.UploadRate, func(ctx context.Context, m *meter) (int64, error) {
+			return client.postPayload(ctx, url, size, m)
+		}))
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	start := time.Now()
+	for _, f := range flows {
+		f.lastProgress = start
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.run(ctx)
+		}()
+	}
+	var pingMu sync.Mutex
+	var ping float64
+	var pingErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			rtt, err := client.soakPing(ctx, interval)
+			if ctx.Err() != nil {
+				return
+			}
+			pingMu.Lock()
+			ping, pingErr = rtt, err
+			pingMu.Unlock()
+			timer := time.NewTimer(interval)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+	}()
+
+	checks := time.NewTicker(soakCheckInterval)
+	defer checks.Stop()
+	reports := time.NewTicker(interval)
+	defer reports.Stop()
+	last := start
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-checks.C:
+			for _, f := range flows {
+				f.check(now)
+			}
+		case now := <-reports.C:
+			r := SoakReport{Elapsed: now.Sub(last), Stalls: map[string]int{}, Reconnects: map[string]int{}}
+			last = now
+			for _, f := range flows {
+				n := f.meter.count()
+				bytes := n - f.reported
+				f.reported = n
+				f.mu.Lock()
+				r.Reconnects[f.phase], f.reconnects = f.reconnects, 0
+				if f.err != nil {
+					r.Err, f.err = f.err, nil
+				}
+				f.mu.Unlock()
+				r.Stalls[f.phase], f.stalls = f.stalls, 0
+				if f.phase == PhaseDownload {
+					r.DownloadBytes, r.Download = bytes, mbps(bytes, r.Elapsed)
+				} else {
+					r.UploadBytes, r.Upload = bytes, mbps(bytes, r.Elapsed)
+				}
+			}
+			pingMu.Lock()
+			r.Ping, r.PingErr = ping, pingErr
+			ping, pingErr = 0, nil
+			pingMu.Unlock()
+			report(r)
+		}
+	}
+}
+
+// soakFlow returns the flow of a phase throttled to bitsPerSecond
+func (client *Client) soakFlow(phase string, url string, bitsPerSecond int64, request func(ctx context.Context, m *meter) (int64, error)) *soakFlow {
+	limiter := newRateLimiter(bitsPerSecond)
+	// The limiter lets bursts through, several of which make a stall
+	threshold := max(soakStallThreshold, time.Duration(4*limiter.burst/limiter.rate*float64(time.Second)))
+	return &soakFlow{phase: phase, url: url, meter: &meter{limiter: limiter}, request: request, threshold: threshold}
+}
+
+// soakPing returns the round trip time (ms) of a request to the server
+// latency.txt file, bounded by timeout
+func (client *Client) soakPing(ctx context.Context, timeout time.Duration) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", client.Server.BaseURL()+"latency.txt", nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err := client.do(PhasePing, req, nil); err != nil {
+		return 0, err
+	}
+	return float64(time.Since(start)) / float64(time.Millisecond), nil
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSoak(t *testing.T) {
+	var mu sync.Mutex
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/mini/latency.txt":
+			fmt.Fprint(w, "test=test\n")
+		case strings.HasPrefix(r.URL.Path, "/mini/random"):
+			mu.Lock()
+			downloads++
+			n := downloads
+			mu.Unlock()
+			if n == 1 {
+				// The first connection is dropped
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			chunk := make([]byte, 16*1024)
+			for i := 0; r.Context().Err() == nil; i++ {
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+				// The second one stalls for a while
+				if n == 2 && i == 4 {
+					time.Sleep(1500 * time.Millisecond)
+				}
+			}
+		case r.URL.Path == "/mini/upload.php":
+			io.Copy(io.Discard, r.Body)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewMiniClient(server.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Soak(context.Background(), SoakOptions{}, func(SoakReport) {}); err == nil {
+		t.Error("Expected an error without rate")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var reports []SoakReport
+	if err := client.Soak(ctx, SoakOptions{DownloadRate: 8 * 1000 * 1000, UploadRate: 4 * 1000 * 1000, Interval: 500 * time.Millisecond}, func(r SoakReport) {
+		reports = append(reports, r)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) < 8 {
+		t.Fatalf("Expected a report every 500ms, got %d", len(reports))
+	}
+	var stalls, reconnects int
+	var uploaded int64
+	var elapsed time.Duration
+	pinged := false
+	for _, r := range reports {
+		stalls += r.Stalls[PhaseDownload]
+		reconnects += r.Reconnects[PhaseDownload]
+		uploaded += r.UploadBytes
+		elapsed += r.Elapsed
+		pinged = pinged || r.Ping > 0
+		if r.Stalls[PhaseUpload] > 0 || r.Reconnects[PhaseUpload] > 0 {
+			t.Errorf("Expected the upload to run smoothly, got %+v", r)
+		}
+	}
+	// The backoff of the reconnection is a stall too
+	if stalls != 2 || reconnects != 1 {
+		t.Errorf("Expected 2 download stalls and a reconnect, got %d and %d", stalls, reconnects)
+	}
+	if rate := mbps(uploaded, elapsed); rate < 3 || rate > 5 {
+		t.Errorf("Expected an upload at about 4 Mbps, got %.2f", rate)
+	}
+	if last := reports[len(reports)-1]; last.Download < 6 || last.Download > 10 {
+		t.Errorf("Expected a download at about 8 Mbps eventually, got %.2f", last.Download)
+	}
+	if !pinged {
+		t.Error("Expected the latency to be measured")
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ConnectTimeoutError is returned when a connection to a server can't be
+// established within the dial timeout
+type ConnectTimeoutError struct {
+	Address string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *ConnectTimeoutError) Error() string {
+	return fmt.Sprintf("Connection to %s timed out after %s: %s", e.Address, e.Timeout, e.Err)
+}
+
+func (e *ConnectTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// StalledTransferError is returned when a request transfers no data for
+// the read timeout
+type StalledTransferError struct {
+	URL     string
+	Timeout time.Duration
+}
+
+func (e *StalledTransferError) Error() string {
+	return fmt.Sprintf("No data transferred with %s for %s", e.URL, e.Timeout)
+}
+
+// errStalled is the cause of the cancellation of the stalled requests
+var errStalled = errors.New("stalled transfer")
+
+// connectTimeoutError returns err, as a *ConnectTimeoutError if it is the
+// expiry of the dial timeout rather than of ctx
+func connectTimeoutError(ctx context.Context, address string, timeout time.Duration, err error) error {
+	var netErr net.Error
+	if err != nil && ctx.Err() == nil && errors.As(err, &netErr) && netErr.Timeout() {
+		return &ConnectTimeoutError{Address: address, Timeout: timeout, Err: err}
+	}
+	return err
+}
+
+// progressBody calls progress on each read returning data
+type progressBody struct {
+	io.ReadCloser
+	progress func()
+}
+
+func (b *progressBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.progress()
+	}
+	return n, err
+}
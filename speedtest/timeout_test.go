@@ -0,0 +1,106 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stallingServer serves 1024 bytes images, the first stalling ones
+// sending half of them then nothing until the client gives up
+func stallingServer(stalling int64) *httptest.Server {
+	var requests int64
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		if atomic.AddInt64(&requests, 1) <= stalling {
+			w.Write(make([]byte, 512))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.Write(make([]byte, 1024))
+	}))
+}
+
+func TestStalledTransfer(t *testing.T) {
+	measure := func(stalling int64, streams int) (Measurement, error) {
+		server := stallingServer(stalling)
+		defer server.Close()
+		client, err := NewMiniClient(server.URL+"/", Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.ReadTimeout = 200 * time.Millisecond
+		client.Streams = streams
+		client.DownloadSizes = []int{350, 350, 350, 350}
+		measurements, err := client.Measure(context.Background(), PhaseDownload)
+		return measurements[PhaseDownload], err
+	}
+
+	// The stalled stream is abandoned, the other one running the requests
+	m, err := measure(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Bytes < 3*1024 || m.Streams != 2 {
+		t.Errorf("Expected the other requests to complete, got %+v", m)
+	}
+	failed := 0
+	for _, stream := range m.PerStream {
+		if stream.Failed {
+			failed++
+			if stream.Value != 0 || stream.Errors == 0 {
+				t.Errorf("Expected the stalled stream to fail with no bandwidth, got %+v", stream)
+			}
+		} else if stream.Value <= 0 || stream.Errors != 0 {
+			t.Errorf("Expected the other stream to succeed, got %+v", stream)
+		}
+	}
+	if len(m.PerStream) != 2 || failed != 1 {
+		t.Errorf("Expected one of 2 streams to fail, got %+v", m.PerStream)
+	}
+
+	_, err = measure(2, 2)
+	if ErrorType(err) != "stalled_transfer" {
+		t.Errorf("Expected a stalled transfer with all the streams stalled, got %v (%s)", err, ErrorType(err))
+	}
+}
+
+func TestConnectTimeoutError(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+	err := connectTimeoutError(context.Background(), "192.0.2.1:80", 5*time.Second, dialErr)
+	var connectErr *ConnectTimeoutError
+	if !errors.As(err, &connectErr) || connectErr.Address != "192.0.2.1:80" || ErrorType(err) != "connect_timeout" {
+		t.Errorf("Expected a connection timeout, got %v (%s)", err, ErrorType(err))
+	}
+
+	// The expiry of the context of the request is not the dial timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := connectTimeoutError(ctx, "192.0.2.1:80", 5*time.Second, dialErr); err != dialErr {
+		t.Errorf("Expected the dial error, got %v", err)
+	}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	if err := connectTimeoutError(context.Background(), "192.0.2.1:80", 5*time.Second, refused); err != refused {
+		t.Errorf("Expected the dial error, got %v", err)
+	}
+}
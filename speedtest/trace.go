@@ -0,0 +1,64 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import "context"
+
+// The steps traced by Trace, in addition to the phases
+const (
+	// StepSetup is the creation of a client, made of the next three steps
+	StepSetup = "setup"
+	// StepConfig is the retrieval of the Speedtest configuration, on
+	// creation and by FetchClientInfo
+	StepConfig = "config"
+	// StepServers is the retrieval of the server list
+	StepServers = "servers"
+	// StepSelection is the selection of the test server
+	StepSelection = "selection"
+)
+
+// Step is the outcome of a traced step
+type Step struct {
+	// Server is the selected server of StepSelection and StepSetup, the
+	// tested one of the phases
+	Server *Server
+	// Measurement is the measurement of the successful phases
+	Measurement *Measurement
+	Err         error
+}
+
+// noStep ends the steps of the clients without Trace
+func noStep(Step) {}
+
+// trace starts a step under the client Trace, returning the context the
+// step runs with and the function ending it
+func (client *Client) trace(ctx context.Context, step string) (context.Context, func(Step)) {
+	if client.Trace == nil {
+		return ctx, noStep
+	}
+	return client.Trace(ctx, step)
+}
+
+// traced runs a phase as a step of the client Trace
+func (client *Client) traced(ctx context.Context, phase string, measure func(ctx context.Context) (Measurement, error)) (Measurement, error) {
+	ctx, end := client.trace(ctx, phase)
+	m, err := measure(ctx)
+	step := Step{Server: &client.Server, Err: err}
+	if err == nil {
+		step.Measurement = &m
+	}
+	end(step)
+	return m, err
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stepKey carries the path of the traced step in its context
+type stepKey struct{}
+
+// stepRecorder records the traced steps by their path, e.g. setup/config
+type stepRecorder struct {
+	mu    sync.Mutex
+	steps []string
+	ended map[string]Step
+}
+
+func (r *stepRecorder) trace(ctx context.Context, step string) (context.Context, func(Step)) {
+	if parent, ok := ctx.Value(stepKey{}).(string); ok {
+		step = parent + "/" + step
+	}
+	r.mu.Lock()
+	r.steps = append(r.steps, step)
+	r.mu.Unlock()
+	return context.WithValue(ctx, stepKey{}, step), func(s Step) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.ended[step] = s
+	}
+}
+
+func TestTrace(t *testing.T) {
+	scripted := newScriptedServer()
+	defer scripted.Close()
+	recorder := &stepRecorder{ended: map[string]Step{}}
+	client, err := NewFilteredClient(context.Background(), scripted.URL+"/config.php", scripted.URL+"/servers.php", ServerFilter{}, Options{Trace: recorder.trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DownloadSizes = []int{350}
+	client.UploadMaxBytes = 1 << 20
+	if _, err := client.FetchClientInfo(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Measure(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "setup,setup/config,setup/servers,setup/selection,config,download,upload,ping"
+	if steps := strings.Join(recorder.steps, ","); steps != expected {
+		t.Errorf("Expected the steps %s, got %s", expected, steps)
+	}
+	if len(recorder.ended) != len(recorder.steps) {
+		t.Errorf("Expected every step to end, got %v", recorder.ended)
+	}
+	for _, step := range []string{"setup", "setup/selection"} {
+		if s := recorder.ended[step]; s.Server == nil || s.Server.ID != "2" {
+			t.Errorf("Expected the %s step to end with the selected server, got %+v", step, s)
+		}
+	}
+	if s := recorder.ended[PhaseDownload]; s.Err != nil || s.Measurement == nil || s.Measurement.Bytes == 0 || s.Server.ID != "2" {
+		t.Errorf("Unexpected download step %+v", s)
+	}
+
+	// The failed steps end with their error
+	scripted.Close()
+	recorder = &stepRecorder{ended: map[string]Step{}}
+	client.Trace = recorder.trace
+	if _, err := client.Measure(context.Background(), PhasePing); err == nil {
+		t.Fatal("Expected the ping phase to fail")
+	}
+	if s := recorder.ended[PhasePing]; s.Err == nil || s.Measurement != nil {
+		t.Errorf("Expected the ping step to fail, got %+v", s)
+	}
+}
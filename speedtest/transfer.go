@@ -0,0 +1,645 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+var (
+	// DownloadSizes are the sizes of the random images of the Speedtest
+	// servers, all fetched by the download test by default
+	DownloadSizes = []int{350, 500, 750, 1000, 1500, 2000, 2500, 3000, 3500, 4000}
+
+	// uploadSizes are the sizes of the payloads posted during the upload test
+	uploadSizes = []int{
+		int(0.25 * 1024 * 1024),
+		int(0.5 * 1024 * 1024),
+		int(1.0 * 1024 * 1024),
+		int(1.5 * 1024 * 1024),
+		int(2.0 * 1024 * 1024),
+	}
+
+	// progressInterval is the interval of the progress logs of the transfer
+	// phases, at debug level
+	progressInterval = 5 * time.Second
+)
+
+// defaultBufferSize is the size of the buffers the response bodies are
+// read through when the client BufferSize is not set
+const defaultBufferSize = 32 * 1024
+
+// copyBuffers are the pools of the buffers the response bodies are read
+// through, by size
+var copyBuffers sync.Map
+
+// copyBuffer returns a buffer of the client BufferSize from its pool, to be
+// put back once the body is read
+func (client *Client) copyBuffer() (*[]byte, *sync.Pool) {
+	size := client.BufferSize
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	pool, ok := copyBuffers.Load(size)
+	if !ok {
+		pool, _ = copyBuffers.LoadOrStore(size, &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		})
+	}
+	return pool.(*sync.Pool).Get().(*[]byte), pool.(*sync.Pool)
+}
+
+// countingDiscard discards what is written to it, counting the bytes, on
+// its meter too if not nil. The first keep bytes are kept in head.
+type countingDiscard struct {
+	n     int64
+	meter *meter
+	keep  int
+	head  []byte
+}
+
+func (w *countingDiscard) Write(p []byte) (int, error) {
+	if len(w.head) < w.keep {
+		w.head = append(w.head, p[:min(len(p), w.keep-len(w.head))]...)
+	}
+	atomic.AddInt64(&w.n, int64(len(p)))
+	w.meter.add(len(p))
+	return len(p), nil
+}
+
+// do sends a request of a phase to a test server, reported to OnRequest,
+// and discards the response body, read
+// through a pooled buffer so it is never held in memory. The body is
+// metered by m, if not nil. The request context interrupts the read, the
+// bytes received so far being returned. With a read timeout, the request
+// is aborted with a *StalledTransferError when it transfers no data for
+// that long, in either direction.
+func (client *Client) do(phase string, req *http.Request, m *meter) (int64, error) {
+	return client.send(phase, req, m, &countingDiscard{meter: m})
+}
+
+// send is do, the response body being written to discard, which meters it
+// or not
+func (client *Client) send(phase string, req *http.Request, m *meter, discard *countingDiscard) (int64, error) {
+	client.setHeaders(req)
+	client.auth.apply(req)
+
+	stalled := func(err error) error { return err }
+	progress := func() {}
+	if client.ReadTimeout > 0 {
+		ctx, cancel := context.WithCancelCause(req.Context())
+		defer cancel(nil)
+		timer := time.AfterFunc(client.ReadTimeout, func() { cancel(errStalled) })
+		defer timer.Stop()
+		progress = func() { timer.Reset(client.ReadTimeout) }
+		stalled = func(err error) error {
+			if errors.Is(context.Cause(ctx), errStalled) {
+				return &StalledTransferError{URL: req.URL.String(), Timeout: client.ReadTimeout}
+			}
+			return err
+		}
+		req = req.WithContext(ctx)
+		if req.Body != nil {
+			req.Body = &progressBody{ReadCloser: req.Body, progress: progress}
+		}
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), testRequestKey{}, true))
+	// The first connection of the phase is described by its meter
+	var remote net.Addr
+	traced := m != nil && m.connection() == nil
+	if traced {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { remote = info.Conn.RemoteAddr() },
+		}))
+	}
+	resp, err := client.http.Do(req)
+	if err != nil {
+		err = stalled(client.httpVersionError(req, err))
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			client.onRequest(phase, 0)
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	client.onRequest(phase, resp.StatusCode)
+	m.setProtocol(resp.Proto)
+	if traced {
+		m.setConnection(newConnectionInfo(resp, remote))
+	}
+	// The error pages are not part of the measurement, and only drained
+	// so far for the connection to be reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.CopyN(io.Discard, resp.Body, maxErrorBody)
+		return 0, &HTTPError{URL: req.URL.String(), StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	m.cacheDetector().checkHeaders(req.Context(), req.URL.String(), resp.Header)
+	if encoding := responseEncoding(resp); encoding != "" {
+		if client.OnEncodedResponse != nil {
+			client.OnEncodedResponse(phase, encoding)
+		}
+		if m.setEncoded() {
+			msg := "Encoded responses, measured as received rather than decoded"
+			if resp.Uncompressed {
+				msg = "Encoded responses decoded by the transport, their bandwidth is overstated"
+			}
+			loggerFrom(req.Context()).Warn(msg, "phase", phase, "encoding", encoding, "url", req.URL.String())
+		}
+	}
+	buf, pool := client.copyBuffer()
+	defer pool.Put(buf)
+	body := &progressBody{ReadCloser: resp.Body, progress: progress}
+	_, err = io.CopyBuffer(discard, m.reader(req.Context(), body), *buf)
+	n := atomic.LoadInt64(&discard.n)
+	if err != nil {
+		return n, stalled(err)
+	}
+	return n, nil
+}
+
+// onRequest reports a response status, or 0 for a failed request, to
+// OnRequest
+func (client *Client) onRequest(phase string, status int) {
+	if client.OnRequest != nil {
+		client.OnRequest(phase, status)
+	}
+}
+
+// responseEncoding returns the content encoding of resp, with a name among
+// encodings or other, and empty for the identity. The responses decoded by
+// a transport with compression enabled are gzip encoded.
+func responseEncoding(resp *http.Response) string {
+	if resp.Uncompressed {
+		return "gzip"
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if i := strings.IndexByte(encoding, ','); i >= 0 {
+		encoding = strings.TrimSpace(encoding[:i])
+	}
+	switch encoding {
+	case "", "identity":
+		return ""
+	case "gzip", "x-gzip":
+		return "gzip"
+	case "deflate", "br", "zstd", "compress":
+		return encoding
+	}
+	return "other"
+}
+
+// latency returns the aggregated round trip time (ms) of PingSamples
+// requests to the server latency.txt file, and the round trip times of the
+// requests.
+func (client *Client) latency(ctx context.Context, server Server) (float64, []float64, error) {
+	url := server.BaseURL() + "latency.txt"
+	count := client.PingSamples
+	if count <= 0 {
+		count = numLatencyTests
+	}
+	samples := make([]float64, 0, count)
+	for i := 0; i < count; i++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Only the successful attempt is timed
+		var elapsed time.Duration
+		_, err = client.retry(ctx, PhasePing, nil, func() (int64, error) {
+			start := time.Now()
+			n, err := client.do(PhasePing, req, nil)
+			elapsed = time.Since(start)
+			return n, err
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+		samples = append(samples, float64(elapsed)/float64(time.Millisecond))
+	}
+	return AggregateLatency(samples, client.pingAggregation()), samples, nil
+}
+
+// download returns the bandwidth (Mbps) of fetching the server random
+// images, planned from a probe transfer when the download is adaptive.
+// Each request has its own x parameter, so no intermediary serves it from
+// its cache.
+func (client *Client) download(ctx context.Context, server Server) (Measurement, error) {
+	sizes := client.DownloadSizes
+	if len(sizes) == 0 {
+		sizes = DownloadSizes
+	}
+	request := func(ctx context.Context, size int, m *meter) (int64, error) {
+		url := fmt.Sprintf("%srandom%dx%d.jpg", server.BaseURL(), size, size)
+		req, err := http.NewRequestWithContext(ctx, "GET", url+"?x="+uniuri.New(), nil)
+		if err != nil {
+			return 0, err
+		}
+		cache := m.cacheDetector()
+		discard := &countingDiscard{meter: m, keep: cache.sampleSize()}
+		n, err := client.send(PhaseDownload, req, m, discard)
+		if err == nil {
+			cache.checkContent(ctx, url, discard.head)
+		}
+		return n, err
+	}
+	if client.AdaptiveDownload {
+		plan, err := client.planDownload(ctx, sizes, request)
+		if err != nil {
+			return Measurement{}, err
+		}
+		sizes = make([]int, plan.Requests)
+		for i := range sizes {
+			sizes[i] = plan.Size
+		}
+	}
+	return client.transfer(ctx, PhaseDownload, sizes, request)
+}
+
+// uploadSizes returns the sizes of the upload payloads: UploadChunkSize
+// when set, UploadSizes otherwise, or uploadSizes
+func (client *Client) uploadSizes() []int {
+	if client.UploadChunkSize > 0 {
+		return []int{client.UploadChunkSize}
+	}
+	if len(client.UploadSizes) > 0 {
+		return client.UploadSizes
+	}
+	return uploadSizes
+}
+
+// upload returns the bandwidth (Mbps) of posting random payloads to the
+// server upload.php script, of the sizes of uploadSizes.
+func (client *Client) upload(ctx context.Context, server Server) (Measurement, error) {
+	return client.transfer(ctx, PhaseUpload, client.uploadSizes(), func(ctx context.Context, size int, m *meter) (int64, error) {
+		return client.postPayload(ctx, server.URL, int64(size), m)
+	})
+}
+
+// randomReader generates size pseudo-random bytes on the fly, straight into
+// the buffer of the reader, so uploads don't hold their payload in memory.
+// The payload starts with prefix, if any, and is made of zeros when zero is
+// set, of bytes left as is by the form decoding when text is set.
+// It counts the bytes it produced, i.e. sent
+// by an upload, on its meter too if not nil, and fails once its context,
+// if not nil, is done.
+type randomReader struct {
+	size   int64
+	n      int64
+	ctx    context.Context
+	meter  *meter
+	state  uint64
+	prefix []byte
+	text   bool
+	zero   bool
+}
+
+// textBytes maps the bytes of the text payloads to the ones left as is by
+// the form decoding, all but the separators and escapes. They stay nearly
+// as incompressible as random bytes.
+var textBytes = func() (table [256]byte) {
+	for i := range table {
+		table[i] = byte(i)
+	}
+	for _, c := range []byte("&;=%+") {
+		table[c] = c ^ 0x40
+	}
+	return table
+}()
+
+func newRandomReader(size int64) *randomReader {
+	return &randomReader{size: size, state: rand.Uint64() | 1}
+}
+
+func (r *randomReader) Read(p []byte) (int, error) {
+	if r.ctx != nil && r.ctx.Err() != nil {
+		return 0, r.ctx.Err()
+	}
+	n := atomic.LoadInt64(&r.n)
+	left := r.size - n
+	if left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
+	start := 0
+	if n < int64(len(r.prefix)) {
+		start = copy(p, r.prefix[n:])
+	}
+	if r.zero {
+		clear(p[start:])
+		start = len(p)
+	}
+	// xorshift64, far cheaper than a cryptographic or locked source, and
+	// written 8 bytes at a time
+	for i := start; i < len(p); i += 8 {
+		r.state ^= r.state << 13
+		r.state ^= r.state >> 7
+		r.state ^= r.state << 17
+		if i+8 <= len(p) {
+			if !r.text {
+				binary.LittleEndian.PutUint64(p[i:], r.state)
+				continue
+			}
+			q := p[i : i+8]
+			v := r.state
+			q[0], q[1], q[2], q[3] = textBytes[byte(v)], textBytes[byte(v>>8)], textBytes[byte(v>>16)], textBytes[byte(v>>24)]
+			q[4], q[5], q[6], q[7] = textBytes[byte(v>>32)], textBytes[byte(v>>40)], textBytes[byte(v>>48)], textBytes[byte(v>>56)]
+			continue
+		}
+		v := r.state
+		for j := i; j < i+8 && j < len(p); j++ {
+			p[j] = byte(v)
+			if r.text {
+				p[j] = textBytes[p[j]]
+			}
+			v >>= 8
+		}
+	}
+	atomic.AddInt64(&r.n, int64(len(p)))
+	r.meter.add(len(p))
+	return len(p), nil
+}
+
+func (r *randomReader) count() int64 {
+	return atomic.LoadInt64(&r.n)
+}
+
+// streams returns the number of parallel connections of a transfer phase:
+// its own when set, Streams otherwise, or a single one
+func (client *Client) streams(phase string) int {
+	streams := client.Streams
+	if phase == PhaseDownload && client.DownloadStreams > 0 {
+		streams = client.DownloadStreams
+	}
+	if phase == PhaseUpload && client.UploadStreams > 0 {
+		streams = client.UploadStreams
+	}
+	if streams < 1 {
+		streams = 1
+	}
+	return streams
+}
+
+// transfer runs the requests of a phase over a pool of parallel
+// connections, and returns the bandwidth (Mbps) of all the bytes they
+// transferred, summed across the connections. One request is run per size,
+// unless the phase is bounded by duration or volume: the sizes are then
+// requested in turn until the end of the phase or the volume is reached,
+// whichever comes first. No request is started when it wouldn't complete in
+// time, the ones in flight at the end are interrupted, and the bandwidth is
+// computed over the elapsed time, or over its stable portion depending on
+// the client aggregation. The first failed request aborts the others.
+func (client *Client) transfer(ctx context.Context, phase string, sizes []int, request func(ctx context.Context, size int, m *meter) (int64, error)) (Measurement, error) {
+	streams := client.streams(phase)
+	duration, maxBytes := client.DownloadDuration, int64(0)
+	if phase == PhaseUpload {
+		duration, maxBytes = client.UploadDuration, client.UploadMaxBytes
+	}
+	if shared, ok := ctx.Value(duplexKey{}).(time.Duration); ok {
+		duration = shared
+	}
+	repeat := duration > 0 || maxBytes > 0
+	if streams > len(sizes) && !repeat {
+		streams = len(sizes)
+	}
+	parent := ctx
+	start := time.Now()
+	var cancel context.CancelFunc
+	if duration > 0 {
+		ctx, cancel = context.WithDeadline(ctx, start.Add(duration))
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	// mu guards the scheduling of the requests, the limit that ended the
+	// phase, and the count of the stalled streams
+	var mu sync.Mutex
+	next, reserved, limit, stalledStreams := 0, int64(0), "sizes", 0
+	job := func(last time.Duration) (int, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if duration > 0 && time.Until(start.Add(duration)) < last {
+			limit = "duration"
+			return 0, false
+		}
+		if !repeat && next >= len(sizes) {
+			return 0, false
+		}
+		size := sizes[next%len(sizes)]
+		if maxBytes > 0 {
+			if reserved >= maxBytes {
+				limit = "max_bytes"
+				return 0, false
+			}
+			if left := maxBytes - reserved; int64(size) > left {
+				size = int(left)
+			}
+		}
+		next++
+		reserved += int64(size)
+		return size, true
+	}
+
+	var total, achieved int64
+	m := &meter{limiter: newRateLimiter(client.RateLimit)}
+	if phase == PhaseDownload {
+		m.cache = client.newCacheDetector()
+	}
+	errc := make(chan error, streams)
+	var wg sync.WaitGroup
+	// The bytes of the completed requests of each stream, and the number of
+	// streams still running, for the progress logs. The errors and failure
+	// of each stream are only written by its goroutine.
+	streamBytes := make([]int64, streams)
+	streamErrors := make([]int, streams)
+	streamFailed := make([]bool, streams)
+	active := int64(streams)
+	logger := loggerFrom(ctx)
+	progress := logger.Enabled(ctx, slog.LevelDebug)
+	// Each stream has its own meter, sampled by the Ookla aggregation
+	meters := make([]*meter, streams)
+	for i := range meters {
+		meters[i] = m.stream()
+	}
+	// The throughput samples are only retained for the stable window and
+	// Ookla aggregations, the simple one only needing the totals
+	retain := client.Aggregation == AggregationStableWindow
+	perStream := client.Aggregation == AggregationOokla
+	samples := []Sample{}
+	streamSamples := make([][]Sample, streams)
+	sampleStreams := func(elapsed time.Duration) {
+		for i, sm := range meters {
+			streamSamples[i] = append(streamSamples[i], Sample{Elapsed: elapsed, Bytes: sm.count()})
+		}
+	}
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+		var logged Sample
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				sample := Sample{Elapsed: now.Sub(start), Bytes: m.count()}
+				if retain {
+					samples = append(samples, sample)
+				}
+				if perStream {
+					sampleStreams(sample.Elapsed)
+				}
+				if progress && sample.Elapsed-logged.Elapsed >= progressInterval {
+					bytes := make([]int64, streams)
+					for i := range streamBytes {
+						bytes[i] = atomic.LoadInt64(&streamBytes[i])
+					}
+					logger.Debug("Transfer phase progress", "phase", phase, "elapsed", sample.Elapsed, "bytes", sample.Bytes,
+						"mbps", mbps(sample.Bytes-logged.Bytes, sample.Elapsed-logged.Elapsed),
+						"active_streams", atomic.LoadInt64(&active), "stream_bytes", bytes)
+					logged = sample
+				}
+			}
+		}
+	}()
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer atomic.AddInt64(&active, -1)
+			transferred := false
+			var last time.Duration
+			for {
+				size, ok := job(last)
+				if !ok {
+					return
+				}
+				requestStart := time.Now()
+				n, err := client.retry(ctx, phase, meters[i], func() (int64, error) {
+					n, err := request(ctx, size, meters[i])
+					// The requests interrupted by the end or abort of the
+					// phase didn't fail on their own
+					if err != nil && ctx.Err() == nil {
+						streamErrors[i]++
+					}
+					return n, err
+				})
+				last = time.Since(requestStart)
+				atomic.AddInt64(&total, n)
+				atomic.AddInt64(&streamBytes[i], n)
+				if n > 0 && !transferred {
+					transferred = true
+					atomic.AddInt64(&achieved, 1)
+				}
+				if err != nil {
+					// The end of the phase interrupts the requests
+					if duration > 0 && parent.Err() == nil && ctx.Err() != nil {
+						mu.Lock()
+						limit = "duration"
+						mu.Unlock()
+						return
+					}
+					// A stalled stream is abandoned, unless all of them
+					// stalled
+					var stalledErr *StalledTransferError
+					if errors.As(err, &stalledErr) {
+						mu.Lock()
+						stalledStreams++
+						abandoned := stalledStreams < streams
+						mu.Unlock()
+						if abandoned {
+							logger.Warn("Abandoning a stalled stream", "phase", phase, "err", err)
+							streamFailed[i] = true
+							return
+						}
+					}
+					errc <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(stop)
+	<-sampled
+	samples = append(samples, Sample{Elapsed: elapsed, Bytes: m.count()})
+	if perStream {
+		sampleStreams(elapsed)
+	}
+
+	select {
+	case err := <-errc:
+		return Measurement{}, err
+	default:
+	}
+	measurement := Measurement{Value: mbps(total, elapsed), Duration: elapsed, Bytes: total, Streams: int(achieved)}
+	for i := range streams {
+		stream := StreamMeasurement{Bytes: streamBytes[i], Errors: streamErrors[i], Failed: streamFailed[i]}
+		if !stream.Failed {
+			stream.Value = mbps(stream.Bytes, elapsed)
+		}
+		measurement.PerStream = append(measurement.PerStream, stream)
+	}
+	switch client.Aggregation {
+	case AggregationStableWindow:
+		measurement.Value = StableThroughput(samples)
+	case AggregationOokla:
+		measurement.Value = OoklaThroughput(streamSamples)
+	}
+	if m.limiter != nil {
+		// The bursts of the token bucket let the bandwidth slightly exceed
+		// the rate limit
+		measurement.RateLimit = float64(client.RateLimit) / 1000 / 1000
+		measurement.RateLimited = m.limiter.throttled()
+		measurement.Value = math.Min(measurement.Value, measurement.RateLimit)
+	}
+	measurement.Connection = m.connection()
+	if m.cache != nil {
+		measurement.CacheChecked = true
+		measurement.CacheReason = m.cache.suspected()
+		measurement.CacheSuspected = measurement.CacheReason != ""
+	}
+	logger.Debug("Transfer phase ended", "phase", phase, "limit", limit, "bytes", total, "duration", elapsed,
+		"samples", len(samples), "aggregation", client.aggregation(), "rate_limited", measurement.RateLimited, "protocol", m.protocol())
+	return measurement, nil
+}
+
+func mbps(n int64, elapsed time.Duration) float64 {
+	return float64(n*8) / 1000 / 1000 / elapsed.Seconds()
+}
@@ -0,0 +1,467 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUploadBytes(t *testing.T) {
+	var received int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		atomic.AddInt64(&received, n)
+		if r.ContentLength != n {
+			t.Errorf("Expected %d bytes, received %d", r.ContentLength, n)
+		}
+		fmt.Fprintf(w, "size=%d", n)
+	}))
+	defer server.Close()
+
+	client, err := NewMiniClient(server.URL+"/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Streams = 2
+	measurements, err := client.Measure(context.Background(), PhaseUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := measurements[PhaseUpload]; m.Bytes != atomic.LoadInt64(&received) || m.Bytes == 0 {
+		t.Errorf("Expected the %d bytes received, got %d", received, m.Bytes)
+	}
+}
+
+func TestRandomReader(t *testing.T) {
+	r := newRandomReader(100003)
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 100003 || r.count() != 100003 {
+		t.Errorf("Expected 100003 bytes, got %d and counted %d", len(data), r.count())
+	}
+	zeros := 0
+	for _, b := range data {
+		if b == 0 {
+			zeros++
+		}
+	}
+	if zeros > len(data)/100 {
+		t.Errorf("Expected random bytes, got %d zeros", zeros)
+	}
+	// Transparent compression would inflate the upload rate
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	w.Write(data)
+	w.Close()
+	if compressed.Len() < len(data)*99/100 {
+		t.Errorf("Expected an incompressible payload, compressed to %d bytes", compressed.Len())
+	}
+
+	r = newRandomReader(100003)
+	r.zero = true
+	data, err = io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 100003 || !bytes.Equal(data, make([]byte, 100003)) {
+		t.Errorf("Expected 100003 zeros, got %d bytes", len(data))
+	}
+}
+
+// bodyServer serves size bytes on every request, written from a single
+// buffer
+func bodyServer(size int) *httptest.Server {
+	chunk := make([]byte, 32*1024)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		for left := size; left > 0; left -= len(chunk) {
+			if left < len(chunk) {
+				chunk = chunk[:left]
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestDownloadMemory(t *testing.T) {
+	const size = 64 * 1024 * 1024
+	server := bodyServer(size)
+	defer server.Close()
+	client, err := NewMiniClient(server.URL+"/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/random4000x4000.jpg", nil)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	n, err := client.do(PhaseDownload, req, nil)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size {
+		t.Errorf("Expected %d bytes, got %d", size, n)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4*1024*1024 {
+		t.Errorf("Expected the body not to be buffered, %d bytes allocated", allocated)
+	}
+}
+
+func TestDownloadInterrupted(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1024))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	client, err := NewMiniClient(server.URL+"/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/random350x350.jpg", nil)
+	go func() {
+		<-started
+		// Leave the client time to read the first bytes
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	n, err := client.do(PhaseDownload, req, nil)
+	if err == nil || n != 1024 {
+		t.Errorf("Expected the download to be interrupted after 1024 bytes, got %d bytes and %v", n, err)
+	}
+}
+
+func BenchmarkDownload(b *testing.B) {
+	server := bodyServer(4 * 1024 * 1024)
+	defer server.Close()
+	client, err := NewMiniClient(server.URL+"/", Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest("GET", server.URL+"/random4000x4000.jpg", nil)
+		if _, err := client.do(PhaseDownload, req, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkUploadPayload compares payloads built in memory, as uploads
+// used to, with the streamed ones, random, form-encoded or zeros. The
+// random ones are to be generated well above the gigabit rate.
+func BenchmarkUploadPayload(b *testing.B) {
+	const size = 2 * 1024 * 1024
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			data := make([]byte, size)
+			rand.Read(data)
+			io.Copy(io.Discard, &sliceReader{data: data})
+		}
+	})
+	for _, tc := range []struct {
+		name       string
+		text, zero bool
+	}{
+		{"streamed", false, false},
+		{"text", true, false},
+		{"zero", false, true},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				r := newRandomReader(size)
+				r.text = tc.text
+				r.zero = tc.zero
+				io.Copy(io.Discard, r)
+			}
+		})
+	}
+}
+
+// sliceReader reads a byte slice without the WriterTo of bytes.Reader, so
+// io.Copy goes through a buffer as the HTTP transport does
+type sliceReader struct {
+	data []byte
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestTransferProgress(t *testing.T) {
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = 200 * time.Millisecond
+	mini := newMiniServer()
+	defer mini.Close()
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Streams = 2
+	client.DownloadDuration = 500 * time.Millisecond
+	client.DownloadSizes = []int{350}
+
+	// The logs are written by the handler, under its lock
+	var buf bytes.Buffer
+	for level, expected := range map[slog.Level]bool{slog.LevelDebug: true, slog.LevelInfo: false} {
+		buf.Reset()
+		logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: level}))
+		if _, err := client.Measure(WithLogger(context.Background(), logger), PhaseDownload); err != nil {
+			t.Fatal(err)
+		}
+		logs := buf.String()
+		if logged := strings.Contains(logs, "Transfer phase progress"); logged != expected {
+			t.Errorf("Expected progress logs %t at level %s, got:\n%s", expected, level, logs)
+		}
+		if expected && (!strings.Contains(logs, "phase=download") || !strings.Contains(logs, "active_streams=2") || !strings.Contains(logs, "stream_bytes=")) {
+			t.Errorf("Expected the progress of the download streams, got:\n%s", logs)
+		}
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	for _, tc := range []struct {
+		status   int
+		expected error
+		errType  string
+	}{
+		{http.StatusForbidden, ErrForbidden, "rate_limited"},
+		{http.StatusServiceUnavailable, ErrServerOverloaded, "overloaded"},
+		{http.StatusNotFound, ErrNotFound, "http"},
+	} {
+		page := strings.Repeat("<p>Go away</p>", 1000)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "latency.txt") {
+				fmt.Fprint(w, "test=test\n")
+				return
+			}
+			w.WriteHeader(tc.status)
+			fmt.Fprint(w, page)
+		}))
+		client, err := NewMiniClient(server.URL+"/mini/", Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.DownloadSizes = []int{350}
+		measurements, err := client.Measure(context.Background(), PhaseDownload)
+		if !errors.Is(err, tc.expected) || ErrorType(err) != tc.errType {
+			t.Errorf("%d: expected %v (%s), got %v (%s)", tc.status, tc.expected, tc.errType, err, ErrorType(err))
+		}
+		if m := measurements[PhaseDownload]; m.Bytes != 0 {
+			t.Errorf("%d: expected the error page not to be measured, got %d bytes", tc.status, m.Bytes)
+		}
+		server.Close()
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	var target *httptest.Server
+	target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops, _ := strconv.Atoi(r.URL.Query().Get("hops"))
+		if hops > 0 {
+			http.Redirect(w, r, fmt.Sprintf("%s%s?hops=%d", target.URL, r.URL.Path, hops-1), http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "test=test\n")
+	}))
+	defer target.Close()
+
+	// The configuration and server list requests follow a few redirects
+	client := &Client{http: newHTTPClient(nil)}
+	resp, err := client.http.Get(target.URL + "/config?hops=2")
+	if err != nil {
+		t.Fatalf("Expected the redirects to be followed, got %v", err)
+	}
+	resp.Body.Close()
+	_, err = client.http.Get(fmt.Sprintf("%s/config?hops=%d", target.URL, maxRedirects+1))
+	if ErrorType(err) != "redirect" {
+		t.Errorf("Expected too many redirects to fail, got %v (%s)", err, ErrorType(err))
+	}
+
+	// The test requests are never redirected
+	req, err := http.NewRequest("GET", target.URL+"/latency.txt?hops=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.do(PhasePing, req, nil)
+	var redirectErr *RedirectError
+	if !errors.As(err, &redirectErr) || ErrorType(err) != "redirect" {
+		t.Errorf("Expected the redirect of a test request to fail, got %v (%s)", err, ErrorType(err))
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	// The server never responds, until the client hangs up. The bodies are
+	// drained first, so the server notices when it does.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	run := func(name string, f func(ctx context.Context) error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := f(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected the deadline to be exceeded, got %v", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: expected the cancellation to be honoured, took %s", name, elapsed)
+		}
+	}
+	run("setup", func(ctx context.Context) error {
+		_, err := NewFilteredClient(ctx, server.URL+"/config.php", server.URL+"/servers.php", ServerFilter{}, Options{})
+		return err
+	})
+	client, err := NewMiniClient(server.URL+"/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DownloadSizes = []int{350}
+	for _, phase := range []string{PhasePing, PhaseDownload, PhaseUpload} {
+		run(phase, func(ctx context.Context) error {
+			_, err := client.Run(ctx, phase)
+			return err
+		})
+	}
+}
+
+func TestRandomReaderCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newRandomReader(1 << 20)
+	r.ctx = ctx
+	buf := make([]byte, 1024)
+	if _, err := r.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if n, err := r.Read(buf); n != 0 || err != context.Canceled {
+		t.Errorf("Expected the reader to stop once canceled, got %d bytes and %v", n, err)
+	}
+}
+
+func TestEncodedDownload(t *testing.T) {
+	// 1MB of zeros compress to about 1KB
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write(make([]byte, 1024*1024))
+	w.Close()
+	var mu sync.Mutex
+	var accepted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		accepted = append(accepted, r.Header.Get("Accept-Encoding"))
+		mu.Unlock()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name      string
+		transport http.RoundTripper
+		// bytes is the size counted for each response, the one on the wire
+		// unless decoded by the transport
+		bytes int64
+	}{
+		{"default", nil, int64(compressed.Len())},
+		{"decoding", &http.Transport{}, 1024 * 1024},
+	} {
+		accepted = nil
+		encodings := map[string]int{}
+		client, err := NewMiniClient(server.URL+"/", Options{Transport: tc.transport, OnEncodedResponse: func(phase string, encoding string) {
+			mu.Lock()
+			defer mu.Unlock()
+			encodings[phase+" "+encoding]++
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.DownloadSizes = []int{350, 500}
+		measurements, err := client.Measure(context.Background(), PhaseDownload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := measurements[PhaseDownload].Bytes; n != 2*tc.bytes {
+			t.Errorf("Expected %d bytes to be counted with the %s transport, got %d", 2*tc.bytes, tc.name, n)
+		}
+		mu.Lock()
+		if encodings["download gzip"] != 2 {
+			t.Errorf("Expected 2 gzip encoded downloads with the %s transport, got %v", tc.name, encodings)
+		}
+		if tc.transport == nil && (len(accepted) != 2 || accepted[0] != "" || accepted[1] != "") {
+			t.Errorf("Expected no Accept-Encoding with the default transport, got %q", accepted)
+		}
+		mu.Unlock()
+	}
+
+	for _, tc := range []struct {
+		encoding string
+		expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"GZIP", "gzip"},
+		{"x-gzip", "gzip"},
+		{"br", "br"},
+		{"zstd, gzip", "zstd"},
+		{"snappy", "other"},
+	} {
+		resp := &http.Response{Header: http.Header{"Content-Encoding": {tc.encoding}}}
+		if encoding := responseEncoding(resp); encoding != tc.expected {
+			t.Errorf("Expected %q for %q, got %q", tc.expected, tc.encoding, encoding)
+		}
+	}
+	if encoding := responseEncoding(&http.Response{Uncompressed: true}); encoding != "gzip" {
+		t.Errorf("Expected the decoded responses to be gzip encoded, got %q", encoding)
+	}
+}
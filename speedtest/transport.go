@@ -0,0 +1,412 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	dialTimeout         = 30 * time.Second
+	keepAlive           = 30 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+	idleConnTimeout     = 90 * time.Second
+	dnsTimeout          = 5 * time.Second
+)
+
+const (
+	// HTTPVersionAuto negotiates HTTP/2 with the servers supporting it over
+	// TLS, HTTP/1.1 being used otherwise
+	HTTPVersionAuto = "auto"
+	// HTTPVersionH1 only uses HTTP/1.1, each stream of the transfer phases
+	// having its own TCP connection
+	HTTPVersionH1 = "h1"
+	// HTTPVersionH2 only uses HTTP/2, with prior knowledge over cleartext
+	// connections. The streams of the transfer phases are multiplexed over
+	// a connection.
+	HTTPVersionH2 = "h2"
+	// HTTPVersionH3 runs the test requests over HTTP/3, the streams of the
+	// transfer phases being multiplexed over a QUIC connection. The other
+	// requests negotiate HTTP/2 over TLS. It requires https test servers,
+	// no proxy, and the exporter to be built with the http3 tag.
+	HTTPVersionH3 = "h3"
+)
+
+// TransportConfig defines how the Speedtest clients connect to the servers
+type TransportConfig struct {
+	// ProxyURL is the proxy of every request. When nil, the proxy is
+	// taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+	// variables. Besides HTTP proxies, SOCKS5 proxies are supported: with
+	// the socks5h scheme, host names are resolved by the proxy.
+	ProxyURL *url.URL
+	// SourceAddress, if set, is the local address of the connections. It
+	// must be assigned to an interface of the host.
+	SourceAddress net.IP
+	// Interface, if set, is the network interface the connections are
+	// bound to. It is only supported on Linux.
+	Interface string
+	// Netns, if set, is the named network namespace the connections are
+	// opened in, as created by ip netns add, while the rest of the process
+	// stays in its own. The interface and source address belong to that
+	// namespace, and host names are resolved from within it. It is only
+	// supported on Linux.
+	Netns string
+	// Resolver, if set, resolves the host names of the servers instead of
+	// the system resolver
+	Resolver *net.Resolver
+	// TLSConfig, if set, replaces the default TLS settings of the
+	// connections to the servers, e.g. to trust a private CA
+	TLSConfig *tls.Config
+	// HTTPVersion is the HTTP version of the requests, HTTPVersionAuto
+	// when not set
+	HTTPVersion string
+	// DialTimeout bounds the establishment of the connections, 30 seconds
+	// when not set. Its expiry is a *ConnectTimeoutError.
+	DialTimeout time.Duration
+	// ServerName, if set, replaces the host of the URLs in the TLS
+	// handshakes: it is sent as SNI, and the server certificates are
+	// verified against it. Along with Options.Host, it reaches a server
+	// fronted by a load balancer or CDN by address.
+	ServerName string
+}
+
+func (config TransportConfig) dialTimeout() time.Duration {
+	if config.DialTimeout > 0 {
+		return config.DialTimeout
+	}
+	return dialTimeout
+}
+
+// check returns an error when the source address, interface or network
+// namespace can't be used on this host
+func (config TransportConfig) check() error {
+	switch config.HTTPVersion {
+	case "", HTTPVersionAuto, HTTPVersionH1, HTTPVersionH2:
+	case HTTPVersionH3:
+		if !http3Supported {
+			return fmt.Errorf("HTTP/3 is not supported by this build, without the http3 build tag")
+		}
+		if config.ProxyURL != nil {
+			return fmt.Errorf("HTTP/3 can't go through a proxy")
+		}
+	default:
+		return fmt.Errorf("Unknown HTTP version %q", config.HTTPVersion)
+	}
+	if config.Netns == "" {
+		return config.checkBindings()
+	}
+	if !netnsSupported {
+		return fmt.Errorf("Network namespaces are only supported on Linux")
+	}
+	// The namespace is entered once, so it is known to exist and be
+	// accessible
+	return inNetns(config.Netns, config.checkBindings)
+}
+
+// checkBindings returns an error when the source address or interface
+// can't be used in the network namespace of the caller
+func (config TransportConfig) checkBindings() error {
+	if config.Interface != "" {
+		if !bindSupported {
+			return fmt.Errorf("Binding to a network interface is only supported on Linux")
+		}
+		if _, err := net.InterfaceByName(config.Interface); err != nil {
+			return fmt.Errorf("Unknown network interface %q: %s", config.Interface, err)
+		}
+	}
+	if config.SourceAddress == nil {
+		return nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("Can't list the addresses of the host: %s", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(config.SourceAddress) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Source address %s is not assigned to any interface of the host", config.SourceAddress)
+}
+
+// dialer returns the dialer of the direct connections, bound to the source
+// address and interface
+func (config TransportConfig) dialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: config.dialTimeout(), KeepAlive: keepAlive, Resolver: config.Resolver}
+	if config.SourceAddress != nil {
+		// Only the addresses of the same family are dialed
+		dialer.LocalAddr = &net.TCPAddr{IP: config.SourceAddress}
+	}
+	if config.Interface != "" {
+		dialer.Control = bindToDevice(config.Interface)
+	}
+	if config.Netns != "" {
+		// The dial must not spread over other goroutines, whose threads
+		// are out of the namespace: the addresses are tried in turn, and
+		// the resolver dials its servers from within the namespace too
+		dialer.FallbackDelay = -1
+		if dialer.Resolver == nil {
+			dialer.Resolver = &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+					return config.dial(ctx, &net.Dialer{Timeout: dnsTimeout}, network, address)
+				},
+			}
+		}
+	}
+	return dialer
+}
+
+// dial connects to address with dialer, from within the network namespace
+// of the configuration if any
+func (config TransportConfig) dial(ctx context.Context, dialer *net.Dialer, network string, address string) (net.Conn, error) {
+	if config.Netns == "" {
+		return dialer.DialContext(ctx, network, address)
+	}
+	var conn net.Conn
+	err := inNetns(config.Netns, func() error {
+		var err error
+		conn, err = dialer.DialContext(ctx, network, address)
+		return err
+	})
+	return conn, err
+}
+
+// netnsDialer is the dialer of the connections to the SOCKS5 proxy, from
+// within the network namespace
+type netnsDialer struct {
+	config TransportConfig
+	dialer *net.Dialer
+}
+
+func (d netnsDialer) Dial(network string, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d netnsDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return d.config.dial(ctx, d.dialer, network, address)
+}
+
+// ProxyAuthError is returned when a SOCKS5 proxy rejects the credentials
+type ProxyAuthError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyAuthError) Error() string {
+	return fmt.Sprintf("Authentication failed with proxy %s: %s", e.Proxy, e.Err)
+}
+
+func (e *ProxyAuthError) Unwrap() error {
+	return e.Err
+}
+
+func isSOCKS(u *url.URL) bool {
+	return u != nil && (u.Scheme == "socks5" || u.Scheme == "socks5h")
+}
+
+// DialContext connects to the given address, through the SOCKS5 proxy of
+// the configuration if any, from the source address and interface. It is
+// used by the transport, and by anything opening raw connections to the
+// test servers.
+func (config TransportConfig) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	direct := config.dialer()
+	if !isSOCKS(config.ProxyURL) {
+		conn, err := config.dial(ctx, direct, network, address)
+		return conn, connectTimeoutError(ctx, address, config.dialTimeout(), err)
+	}
+	var forward proxy.Dialer = direct
+	if config.Netns != "" {
+		forward = netnsDialer{config: config, dialer: direct}
+	}
+	dialer, err := proxy.FromURL(config.ProxyURL, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, config.dialTimeout())
+	defer cancel()
+	if config.ProxyURL.Scheme == "socks5" {
+		// Resolve locally, the proxy only gets addresses
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		resolver := config.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(addrs[0].IP.String(), port)
+	}
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, network, address)
+	// The SOCKS client doesn't type its authentication errors
+	if err != nil && strings.Contains(err.Error(), "authentication") {
+		return nil, &ProxyAuthError{Proxy: config.ProxyURL.Redacted(), Err: err}
+	}
+	if err != nil && parent.Err() == nil && ctx.Err() != nil {
+		return nil, &ConnectTimeoutError{Address: address, Timeout: config.dialTimeout(), Err: err}
+	}
+	return conn, connectTimeoutError(parent, address, config.dialTimeout(), err)
+}
+
+// NewResolver returns a resolver querying the DNS server at address
+// (host:port) with the Go resolver, bypassing the system one. Its queries
+// are sent from the source address, interface and network namespace of
+// config, if set.
+func NewResolver(address string, config TransportConfig) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: dnsTimeout}
+			if config.SourceAddress != nil {
+				if strings.HasPrefix(network, "udp") {
+					dialer.LocalAddr = &net.UDPAddr{IP: config.SourceAddress}
+				} else {
+					dialer.LocalAddr = &net.TCPAddr{IP: config.SourceAddress}
+				}
+			}
+			if config.Interface != "" {
+				dialer.Control = bindToDevice(config.Interface)
+			}
+			return config.dial(ctx, dialer, network, address)
+		},
+	}
+}
+
+// NewTransport returns the transport carrying the requests of the Speedtest
+// clients: configuration and server list retrieval, server selection and
+// the test phases. It is meant to be shared between clients. An error is
+// returned when the source address, interface or network namespace is not
+// available, or the HTTP version is unknown.
+func NewTransport(config TransportConfig) (*http.Transport, error) {
+	if err := config.check(); err != nil {
+		return nil, err
+	}
+	transportProxy := http.ProxyFromEnvironment
+	if isSOCKS(config.ProxyURL) {
+		// The dialer already goes through the proxy
+		transportProxy = nil
+	} else if config.ProxyURL != nil {
+		transportProxy = http.ProxyURL(config.ProxyURL)
+	}
+	if config.ServerName != "" {
+		if config.TLSConfig == nil {
+			config.TLSConfig = &tls.Config{}
+		} else {
+			config.TLSConfig = config.TLSConfig.Clone()
+		}
+		config.TLSConfig.ServerName = config.ServerName
+	}
+	transport := &http.Transport{
+		Proxy:                 transportProxy,
+		DialContext:           config.DialContext,
+		TLSClientConfig:       config.TLSConfig,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		IdleConnTimeout:       idleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          100,
+		Protocols:             new(http.Protocols),
+		// The bodies are measured as received, not as transparently
+		// decoded
+		DisableCompression: true,
+	}
+	switch config.HTTPVersion {
+	case HTTPVersionH1:
+		transport.Protocols.SetHTTP1(true)
+		// Don't offer h2 in the TLS handshake
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		} else {
+			transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+		}
+		transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	case HTTPVersionH2:
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	case HTTPVersionH3:
+		transport.Protocols.SetHTTP1(true)
+		transport.Protocols.SetHTTP2(true)
+		registerHTTP3(transport, config)
+	default:
+		transport.Protocols.SetHTTP1(true)
+		transport.Protocols.SetHTTP2(true)
+	}
+	return transport, nil
+}
+
+// requiresHTTP2 tells whether rt only speaks HTTP/2
+func requiresHTTP2(rt http.RoundTripper) bool {
+	transport, ok := rt.(*http.Transport)
+	return ok && transport.Protocols != nil && transport.Protocols.HTTP2() && !transport.Protocols.HTTP1()
+}
+
+// HTTPVersionError is returned when HTTP/2 or HTTP/3, the Version, is
+// required but the server can't speak it
+type HTTPVersionError struct {
+	URL     string
+	Version string
+	Err     error
+}
+
+func (e *HTTPVersionError) Error() string {
+	return fmt.Sprintf("Server %s doesn't support %s: %s", e.URL, e.Version, e.Err)
+}
+
+func (e *HTTPVersionError) Unwrap() error {
+	return e.Err
+}
+
+// httpVersionError returns the error of req, as an *HTTPVersionError when
+// it's the failure of the client to speak HTTP/2 to the server it requires
+func (client *Client) httpVersionError(req *http.Request, err error) error {
+	// Neither the protocol errors nor the missing ALPN protocol are typed
+	if requiresHTTP2(client.http.Transport) && (strings.Contains(err.Error(), "http2:") || strings.Contains(err.Error(), "no application protocol")) {
+		return &HTTPVersionError{URL: req.URL.String(), Version: "HTTP/2", Err: err}
+	}
+	return err
+}
+
+// http3Transports are the HTTP/3 transports of the test requests, by the
+// transport of NewTransport they are registered on
+var http3Transports sync.Map
+
+// closeIdleConnections closes the idle connections of c, including the
+// HTTP/3 ones
+func closeIdleConnections(c *http.Client) {
+	c.CloseIdleConnections()
+	if transport, ok := c.Transport.(*http.Transport); ok {
+		if h3, ok := http3Transports.Load(transport); ok {
+			h3.(interface{ CloseIdleConnections() }).CloseIdleConnections()
+		}
+	}
+}
+
+// defaultTransport is used by the clients created without transport
+var defaultTransport, _ = NewTransport(TransportConfig{})
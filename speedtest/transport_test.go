@@ -0,0 +1,411 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// socksServer is a SOCKS5 proxy requiring username/password
+// authentication. It records the addresses it is asked to connect to.
+type socksServer struct {
+	net.Listener
+	username string
+	password string
+
+	mu        sync.Mutex
+	addresses []string
+}
+
+func newSOCKSServer(t *testing.T, username string, password string) *socksServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{Listener: listener, username: username, password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) serve(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 256)
+	// Greeting: version, methods
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 2})
+	// Username/password authentication
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	username := make([]byte, buf[1])
+	io.ReadFull(conn, username)
+	io.ReadFull(conn, buf[:1])
+	password := make([]byte, buf[0])
+	io.ReadFull(conn, password)
+	if string(username) != s.username || string(password) != s.password {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+	// Connect request: version, command, reserved, address type
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(conn, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	io.ReadFull(conn, buf[:2])
+	address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+	s.mu.Lock()
+	s.addresses = append(s.addresses, address)
+	s.mu.Unlock()
+
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func newTransport(t *testing.T, config TransportConfig) http.RoundTripper {
+	transport, err := NewTransport(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+func TestSOCKSProxy(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	socks := newSOCKSServer(t, "user", "secret")
+	defer socks.Close()
+	_, port, _ := net.SplitHostPort(mini.Listener.Addr().String())
+
+	cases := []struct {
+		scheme  string
+		address string
+	}{
+		// Resolved by the client
+		{"socks5", "127.0.0.1:" + port},
+		// Resolved by the proxy
+		{"socks5h", "localhost:" + port},
+	}
+	for _, c := range cases {
+		socks.mu.Lock()
+		socks.addresses = nil
+		socks.mu.Unlock()
+		proxyURL := &url.URL{Scheme: c.scheme, User: url.UserPassword("user", "secret"), Host: socks.Addr().String()}
+		client, err := NewMiniClient("http://localhost:"+port+"/mini/", Options{Transport: newTransport(t, TransportConfig{ProxyURL: proxyURL})})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Measure(context.Background(), PhasePing); err != nil {
+			t.Fatalf("%s: %s", c.scheme, err)
+		}
+		socks.mu.Lock()
+		if len(socks.addresses) == 0 || socks.addresses[0] != c.address {
+			t.Errorf("%s: expected connections to %s, got %v", c.scheme, c.address, socks.addresses)
+		}
+		socks.mu.Unlock()
+	}
+
+	proxyURL := &url.URL{Scheme: "socks5h", User: url.UserPassword("user", "wrong"), Host: socks.Addr().String()}
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{Transport: newTransport(t, TransportConfig{ProxyURL: proxyURL})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Measure(context.Background(), PhasePing)
+	if ErrorType(err) != "proxy_auth" {
+		t.Errorf("Expected a proxy authentication error, got %v (%s)", err, ErrorType(err))
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	mini := newUnstartedMiniServer()
+	var mu sync.Mutex
+	var remotes []string
+	mini.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			remotes = append(remotes, conn.RemoteAddr().(*net.TCPAddr).IP.String())
+			mu.Unlock()
+		}
+	}
+	mini.Start()
+	defer mini.Close()
+
+	source := net.ParseIP("127.0.0.1")
+	client, err := NewMiniClient(mini.URL+"/mini/", Options{Transport: newTransport(t, TransportConfig{SourceAddress: source})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Measure(context.Background(), PhasePing); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(remotes) == 0 || remotes[0] != source.String() {
+		t.Errorf("Expected connections from %s, got %v", source, remotes)
+	}
+	mu.Unlock()
+
+	if _, err := NewTransport(TransportConfig{SourceAddress: net.ParseIP("192.0.2.1")}); err == nil {
+		t.Error("Expected an error with an address missing from the host")
+	}
+	if _, err := NewTransport(TransportConfig{Interface: "nonexistent0"}); err == nil {
+		t.Error("Expected an error with an unknown interface")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	server := httptest.NewTLSServer(mini.Config.Handler)
+	defer server.Close()
+
+	measure := func(config *tls.Config) error {
+		client, err := NewMiniClient(server.URL+"/mini/", Options{Transport: newTransport(t, TransportConfig{TLSConfig: config})})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Measure(context.Background(), PhasePing)
+		return err
+	}
+	if err := measure(nil); ErrorType(err) != "tls_verify" {
+		t.Errorf("Expected a certificate verification error, got %v (%s)", err, ErrorType(err))
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	if err := measure(&tls.Config{RootCAs: pool}); err != nil {
+		t.Errorf("Expected the CA to be trusted: %s", err)
+	}
+	if err := measure(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Errorf("Expected the verification to be skipped: %s", err)
+	}
+}
+
+func TestHostOverride(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	var mu sync.Mutex
+	hosts := map[string]bool{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts[r.Host+" "+r.TLS.ServerName] = true
+		mu.Unlock()
+		mini.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	measure := func(host string) error {
+		transport := newTransport(t, TransportConfig{TLSConfig: &tls.Config{RootCAs: pool}, ServerName: host})
+		client, err := NewMiniClient(server.URL+"/mini/", Options{Transport: transport, Host: host})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Measure(context.Background(), PhasePing, PhaseDownload, PhaseUpload)
+		return err
+	}
+	// The test certificate is valid for example.com
+	if err := measure("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || !hosts["example.com example.com"] {
+		t.Errorf("Expected every request for example.com, got %v", hosts)
+	}
+	if err := measure("speedtest.internal.example.com"); ErrorType(err) != "tls_verify" {
+		t.Errorf("Expected the certificate to be verified against the override, got %v (%s)", err, ErrorType(err))
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	var mu sync.Mutex
+	var protos []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		protos = append(protos, r.Proto)
+		mu.Unlock()
+		mini.Config.Handler.ServeHTTP(w, r)
+	})
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h1 := httptest.NewTLSServer(handler)
+	defer h1.Close()
+
+	for _, tc := range []struct {
+		version string
+		server  *httptest.Server
+		proto   string
+	}{
+		{"", h2, "HTTP/2.0"},
+		{HTTPVersionAuto, h1, "HTTP/1.1"},
+		{HTTPVersionH1, h2, "HTTP/1.1"},
+		{HTTPVersionH2, h2, "HTTP/2.0"},
+		{HTTPVersionH2, h1, ""},
+		{HTTPVersionH2, mini.Server, ""},
+	} {
+		protos = nil
+		pool := x509.NewCertPool()
+		if cert := tc.server.Certificate(); cert != nil {
+			pool.AddCert(cert)
+		}
+		transport := newTransport(t, TransportConfig{HTTPVersion: tc.version, TLSConfig: &tls.Config{RootCAs: pool}})
+		client, err := NewMiniClient(tc.server.URL+"/mini/", Options{Transport: transport})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Measure(context.Background(), PhasePing)
+		if tc.proto == "" {
+			if ErrorType(err) != "http_version" {
+				t.Errorf("Expected an HTTP version error with %s against %s, got %v (%s)", tc.version, tc.server.URL, err, ErrorType(err))
+			}
+			continue
+		}
+		mu.Lock()
+		if err != nil || len(protos) == 0 || protos[0] != tc.proto {
+			t.Errorf("Expected %s requests with %q, got %v (%v)", tc.proto, tc.version, protos, err)
+		}
+		mu.Unlock()
+	}
+
+	if _, err := NewTransport(TransportConfig{HTTPVersion: "h4"}); err == nil {
+		t.Error("Expected an error with an unknown HTTP version")
+	}
+	proxyURL, _ := url.Parse("http://proxy.lan:3128")
+	if _, err := NewTransport(TransportConfig{HTTPVersion: HTTPVersionH3, ProxyURL: proxyURL}); err == nil {
+		t.Error("Expected an error with HTTP/3 through a proxy")
+	}
+	if _, err := NewTransport(TransportConfig{HTTPVersion: HTTPVersionH3}); (err == nil) != http3Supported {
+		t.Errorf("Expected HTTP/3 to be supported with the http3 build tag only, got %v", err)
+	}
+}
+
+// serveDNS answers the A queries for names with 127.0.0.1, NXDOMAIN for
+// the other names, until the connection is closed
+func serveDNS(conn net.PacketConn, names map[string]bool) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var parser dnsmessage.Parser
+		header, err := parser.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+		question, err := parser.Question()
+		if err != nil {
+			continue
+		}
+		header.Response = true
+		header.Authoritative = true
+		builder := dnsmessage.NewBuilder(nil, header)
+		builder.StartQuestions()
+		builder.Question(question)
+		builder.StartAnswers()
+		if !names[question.Name.String()] {
+			header.RCode = dnsmessage.RCodeNameError
+			builder = dnsmessage.NewBuilder(nil, header)
+			builder.StartQuestions()
+			builder.Question(question)
+		} else if question.Type == dnsmessage.TypeA {
+			builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60},
+				dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+		}
+		answer, err := builder.Finish()
+		if err == nil {
+			conn.WriteTo(answer, addr)
+		}
+	}
+}
+
+func TestResolver(t *testing.T) {
+	mini := newMiniServer()
+	defer mini.Close()
+	_, port, _ := net.SplitHostPort(mini.Listener.Addr().String())
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveDNS(conn, map[string]bool{"mini.test.": true})
+
+	config := TransportConfig{}
+	config.Resolver = NewResolver(conn.LocalAddr().String(), config)
+	transport := newTransport(t, config)
+
+	client, err := NewMiniClient("http://mini.test:"+port+"/mini/", Options{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Measure(context.Background(), PhasePing); err != nil {
+		t.Errorf("Expected the name to be resolved by the DNS server: %s", err)
+	}
+
+	client, err = NewMiniClient("http://missing.test:"+port+"/mini/", Options{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Measure(context.Background(), PhasePing); ErrorType(err) != "dns" {
+		t.Errorf("Expected a DNS error, got %v (%s)", err, ErrorType(err))
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// UploadFormatAuto posts form-encoded payloads, falling back to raw
+	// ones for good when a server rejects them, the format of the first
+	// successful upload being kept
+	UploadFormatAuto = "auto"
+	// UploadFormatForm posts the payloads as an URL-encoded content1 form
+	// field, as expected by the upload.php scripts, which report the size
+	// they received
+	UploadFormatForm = "form"
+	// UploadFormatRaw posts the payloads as an octet-stream body
+	UploadFormatRaw = "raw"
+)
+
+const (
+	// UploadPayloadRandom posts pseudo-random payloads, left as is by the
+	// transparent compression of some paths
+	UploadPayloadRandom = "random"
+	// UploadPayloadZero posts payloads of zeros, to measure the compressed
+	// path on purpose
+	UploadPayloadZero = "zero"
+)
+
+// formPrefix starts the form-encoded payloads
+var formPrefix = []byte("content1=")
+
+// maxUploadReply bounds the head of the upload responses read for the size
+// they report
+const maxUploadReply = 512
+
+// rejectedStatuses are the HTTP statuses of the servers rejecting the
+// format of an upload
+var rejectedStatuses = map[int]bool{
+	http.StatusBadRequest:            true,
+	http.StatusLengthRequired:        true,
+	http.StatusRequestEntityTooLarge: true,
+	http.StatusUnsupportedMediaType:  true,
+	http.StatusUnprocessableEntity:   true,
+}
+
+// UploadRejectedError is returned when a server rejects an upload payload:
+// it answers with a rejection status, before reading the whole payload, or
+// reports having received less than half of it. Sent is the number of
+// bytes sent of the Size of the payload, and Reported the size reported by
+// the server, -1 if none.
+type UploadRejectedError struct {
+	URL      string
+	Format   string
+	Sent     int64
+	Size     int64
+	Reported int64
+	Err      error
+}
+
+func (e *UploadRejectedError) Error() string {
+	msg := fmt.Sprintf("Upload rejected by %s (%s format, %d of %d bytes sent", e.URL, e.Format, e.Sent, e.Size)
+	if e.Reported >= 0 {
+		msg += fmt.Sprintf(", %d reported", e.Reported)
+	}
+	msg += ")"
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *UploadRejectedError) Unwrap() error {
+	return e.Err
+}
+
+// uploadPayload returns the content of the upload payloads, UploadPayload
+// or UploadPayloadRandom
+func (client *Client) uploadPayload() string {
+	if client.UploadPayload == "" {
+		return UploadPayloadRandom
+	}
+	return client.UploadPayload
+}
+
+// currentUploadFormat returns the format of the next upload: UploadFormat
+// when set, otherwise the detected one, or UploadFormatForm until detected
+func (client *Client) currentUploadFormat() string {
+	if client.UploadFormat != "" && client.UploadFormat != UploadFormatAuto {
+		return client.UploadFormat
+	}
+	if format := client.uploadFormat.Load(); format != nil {
+		return *format
+	}
+	return UploadFormatForm
+}
+
+// postPayload posts a random payload of size bytes to url, metered by m,
+// and returns the number of bytes sent. Until the format is detected in
+// UploadFormatAuto mode, a rejected form-encoded payload is taken off m and
+// posted again raw.
+func (client *Client) postPayload(ctx context.Context, url string, size int64, m *meter) (int64, error) {
+	format := client.currentUploadFormat()
+	n, err := client.post(ctx, url, size, format, m)
+	var rejected *UploadRejectedError
+	if errors.As(err, &rejected) && format == UploadFormatForm && client.uploadFormat.Load() == nil &&
+		(client.UploadFormat == "" || client.UploadFormat == UploadFormatAuto) {
+		loggerFrom(ctx).Debug("Form-encoded upload rejected, falling back to raw", "url", url, "err", err)
+		m.add(-int(n))
+		format = UploadFormatRaw
+		n, err = client.post(ctx, url, size, format, m)
+	}
+	if err == nil && client.uploadFormat.CompareAndSwap(nil, &format) {
+		loggerFrom(ctx).Debug("Detected the upload format", "url", url, "format", format)
+	}
+	return n, err
+}
+
+// post posts a random payload of size bytes in format to url, metered by
+// m, and returns the number of bytes sent
+func (client *Client) post(ctx context.Context, url string, size int64, format string, m *meter) (int64, error) {
+	body := newRandomReader(size)
+	body.ctx = ctx
+	body.meter = m
+	body.zero = client.UploadPayload == UploadPayloadZero
+	contentType := "application/octet-stream"
+	if format == UploadFormatForm {
+		body.prefix = formPrefix
+		body.text = true
+		contentType = "application/x-www-form-urlencoded"
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, m.reader(ctx, body))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	reply := &countingDiscard{keep: maxUploadReply}
+	_, err = client.send(PhaseUpload, req, m, reply)
+	sent := body.count()
+	if err != nil {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && rejectedStatuses[httpErr.StatusCode] {
+			err = &UploadRejectedError{URL: url, Format: format, Sent: sent, Size: size, Reported: -1, Err: err}
+		}
+		return sent, err
+	}
+	// The servers rejecting a payload instantly would otherwise make for
+	// absurd bandwidths
+	reported := reportedSize(reply.head)
+	if sent < size || (reported >= 0 && reported < size/2) {
+		return sent, &UploadRejectedError{URL: url, Format: format, Sent: sent, Size: size, Reported: reported}
+	}
+	return size, nil
+}
+
+// reportedSize returns the size reported by an upload.php response, e.g.
+// size=262144, or -1 if none
+func reportedSize(reply []byte) int64 {
+	value, ok := bytes.CutPrefix(bytes.TrimSpace(reply), []byte("size="))
+	if !ok {
+		return -1
+	}
+	size, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
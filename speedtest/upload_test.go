@@ -0,0 +1,151 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speedtest
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFormPayload(t *testing.T) {
+	r := newRandomReader(100003)
+	r.prefix = formPrefix
+	r.text = true
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 100003 || !bytes.HasPrefix(data, formPrefix) {
+		t.Fatalf("Expected 100003 bytes starting with %s, got %d: %.20s", formPrefix, len(data), data)
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := values.Get("content1")
+	if len(content) != 100003-len(formPrefix) {
+		t.Fatalf("Expected the content1 field to hold the payload, got %d bytes", len(content))
+	}
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	io.WriteString(w, content)
+	w.Close()
+	if compressed.Len() < len(content)*99/100 {
+		t.Errorf("Expected an incompressible payload, compressed to %d bytes", compressed.Len())
+	}
+}
+
+// formServer is an upload.php script, reporting the size of the content1
+// form field
+func formServer(posts *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(posts, 1)
+		r.ParseForm()
+		fmt.Fprintf(w, "size=%d", len(r.PostForm.Get("content1")))
+	}))
+}
+
+// rawServer accepts the raw payloads only
+func rawServer(posts *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(posts, 1)
+		if r.Header.Get("Content-Type") != "application/octet-stream" {
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprintf(w, "size=%d", n)
+	}))
+}
+
+func TestUploadFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		server   func(*int32) *httptest.Server
+		format   string
+		expected string
+		posts    int32
+		rejected bool
+	}{
+		{"auto form", formServer, UploadFormatAuto, UploadFormatForm, 2, false},
+		{"auto raw", rawServer, UploadFormatAuto, UploadFormatRaw, 3, false},
+		{"form", formServer, UploadFormatForm, UploadFormatForm, 2, false},
+		{"raw", rawServer, UploadFormatRaw, UploadFormatRaw, 2, false},
+		{"form rejected", rawServer, UploadFormatForm, UploadFormatForm, 1, true},
+		{"raw rejected", formServer, UploadFormatRaw, UploadFormatRaw, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var posts int32
+			server := tc.server(&posts)
+			defer server.Close()
+
+			client, err := NewMiniClient(server.URL+"/", Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.UploadSizes = []int{64 * 1024, 64 * 1024}
+			client.UploadFormat = tc.format
+			measurements, err := client.Measure(context.Background(), PhaseUpload)
+			var rejected *UploadRejectedError
+			if tc.rejected {
+				if !errors.As(err, &rejected) || rejected.Format != tc.expected || ErrorType(err) != "upload_rejected" {
+					t.Fatalf("Expected the %s upload to be rejected, got %v", tc.expected, err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if m := measurements[PhaseUpload]; m.Bytes != 128*1024 {
+					t.Errorf("Expected the 2 payloads to be counted, got %d bytes", m.Bytes)
+				}
+				if format := client.currentUploadFormat(); format != tc.expected {
+					t.Errorf("Expected the %s format, got %s", tc.expected, format)
+				}
+			}
+			if n := atomic.LoadInt32(&posts); n != tc.posts {
+				t.Errorf("Expected %d uploads, got %d", tc.posts, n)
+			}
+		})
+	}
+}
+
+func TestUploadRejectedInstantly(t *testing.T) {
+	// Answering without reading the payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	defer server.Close()
+
+	client, err := NewMiniClient(server.URL+"/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.UploadSizes = []int{64 * 1024 * 1024}
+	client.UploadFormat = UploadFormatRaw
+	_, err = client.Measure(context.Background(), PhaseUpload)
+	var rejected *UploadRejectedError
+	if !errors.As(err, &rejected) || rejected.Sent >= rejected.Size || rejected.Reported != -1 {
+		t.Fatalf("Expected the upload to be rejected, got %v", err)
+	}
+}
@@ -15,154 +15,1496 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/dchest/uniuri"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
+	"github.com/prometheus/common/promslog"
 	prom_version "github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
 
 	"github.com/nlamirault/speedtest_exporter/speedtest"
 	"github.com/nlamirault/speedtest_exporter/version"
 )
 
 const (
-	namespace = "speedtest"
+	// defaultNamespace prefixes the exported metric names by default
+	defaultNamespace = "speedtest"
+
+	// shutdownTimeout bounds the time given to in-flight requests on shutdown
+	shutdownTimeout = 10 * time.Second
+
+	// maxTestDuration is the time after which a running test is considered
+	// stuck
+	maxTestDuration = 10 * time.Minute
 )
 
-var (
-	ping = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "ping"),
-		"Latency (ms)",
-		[]string{"ip"}, nil,
-	)
-	download = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "download"),
-		"Download bandwidth (Mbps).",
-		[]string{"ip"}, nil,
-	)
-	upload = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "upload"),
-		"Upload bandwidth (Mbps).",
-		[]string{"ip"}, nil,
-	)
+// The triggers of the tests: a scrape without schedule, the first
+// scheduled test, the next ones, the confirmation of an anomalous
+// scheduled test, the latency tests of a split schedule, and the test of
+// -once
+const (
+	triggerScrape   = "scrape"
+	triggerStartup  = "startup"
+	triggerSchedule = "schedule"
+	triggerRetest   = "retest"
+	triggerPing     = "ping"
+	triggerOnce     = "once"
 )
 
+// resultDescs describes the metrics of a test result
+type resultDescs struct {
+	ping *prometheus.Desc
+	// pingStdDev is the standard deviation of the latency samples
+	pingStdDev *prometheus.Desc
+	// hops is the number of hops to the test server
+	hops *prometheus.Desc
+	// info identifies the test the other metrics come from, along with the
+	// speedtest.net result image of the shared tests
+	info *prometheus.Desc
+	// testParameters are the settings of the transfer phases in force
+	testParameters *prometheus.Desc
+	// connectionInfo describes the test connections
+	connectionInfo *prometheus.Desc
+	// serverLatitude, serverLongitude, clientLatitude and clientLongitude
+	// are the positions of the test server and client, when known
+	serverLatitude  *prometheus.Desc
+	serverLongitude *prometheus.Desc
+	clientLatitude  *prometheus.Desc
+	clientLongitude *prometheus.Desc
+	download        *prometheus.Desc
+	upload          *prometheus.Desc
+	// duplexDownload and duplexUpload replace download and upload for the
+	// duplex tests
+	duplexDownload *prometheus.Desc
+	duplexUpload   *prometheus.Desc
+	streams        *prometheus.Desc
+	// streamThroughput and streamErrors are the bandwidth and failed
+	// requests of each stream of the transfer phases
+	streamThroughput *prometheus.Desc
+	streamErrors     *prometheus.Desc
+	// rateLimited tells whether the rate limit, when set, constrained the
+	// transfer phases
+	rateLimited *prometheus.Desc
+	// cacheSuspected tells whether the download phase, when checked,
+	// seemed served by a transparent cache
+	cacheSuspected *prometheus.Desc
+	// phaseSuccess tells whether each phase run succeeded
+	phaseSuccess *prometheus.Desc
+	// transferBytes are the bytes of the transfer phases, and interfaceRx
+	// and interfaceTx the traffic of the verified interface meanwhile
+	transferBytes *prometheus.Desc
+	interfaceRx   *prometheus.Desc
+	interfaceTx   *prometheus.Desc
+	// cpuUtilization and processCPUUtilization are the CPU usage of the
+	// host and of the exporter during the transfer phases, and cpuLimited
+	// whether the CPU bounded them
+	cpuUtilization        *prometheus.Desc
+	processCPUUtilization *prometheus.Desc
+	cpuLimited            *prometheus.Desc
+	// provisionedDownload and provisionedUpload are the subscribed rates
+	// of the line, and the ratios the measured bandwidths relative to them
+	provisionedDownload *prometheus.Desc
+	provisionedUpload   *prometheus.Desc
+	downloadRatio       *prometheus.Desc
+	uploadRatio         *prometheus.Desc
+	// ip and server tell whether the metrics have the ip label, and the
+	// server_id and server_name ones
+	ip     bool
+	server bool
+}
+
+// newResultDescs returns the descriptions of the result metrics. Their
+// names are prefixed by the namespace of config and, unless disabled, they
+// are labeled by external IP address. When enabled, they are labeled by
+// test server too.
+func newResultDescs(config MetricsConfig) *resultDescs {
+	var labels []string
+	if !config.NoIPLabel {
+		labels = []string{"ip"}
+	}
+	if config.ServerLabels {
+		labels = append(labels, "server_id", "server_name")
+	}
+	return &resultDescs{
+		ping: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "ping"),
+			"Latency (ms)",
+			labels, nil,
+		),
+		pingStdDev: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "ping_stddev"),
+			"Standard deviation of the latency samples (ms).",
+			labels, nil,
+		),
+		hops: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "server_hops"),
+			"Number of hops to the test server, counted with TCP connections of increasing TTL.",
+			labels, nil,
+		),
+		info: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "result_info"),
+			"The identifier of the test the result metrics of the scrape all come from, and the URL of its result image on speedtest.net, when shared.",
+			append(labels[:len(labels):len(labels)], "run_id", "share_url"), nil,
+		),
+		serverLatitude: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "server_latitude"),
+			"Latitude of the test server, from the server list (degrees).",
+			labels, nil,
+		),
+		serverLongitude: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "server_longitude"),
+			"Longitude of the test server, from the server list (degrees).",
+			labels, nil,
+		),
+		clientLatitude: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "client_latitude"),
+			"Latitude of the client, from the Speedtest configuration unless overridden (degrees).",
+			labels, nil,
+		),
+		clientLongitude: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "client_longitude"),
+			"Longitude of the client, from the Speedtest configuration unless overridden (degrees).",
+			labels, nil,
+		),
+		download: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "download"),
+			"Download bandwidth (Mbps).",
+			labels, nil,
+		),
+		upload: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "upload"),
+			"Upload bandwidth (Mbps).",
+			labels, nil,
+		),
+		duplexDownload: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "duplex_download"),
+			"Download bandwidth (Mbps), measured while uploading.",
+			labels, nil,
+		),
+		duplexUpload: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "duplex_upload"),
+			"Upload bandwidth (Mbps), measured while downloading.",
+			labels, nil,
+		),
+		streams: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "transfer_streams"),
+			"Number of parallel connections that transferred data, by phase.",
+			append(labels[:len(labels):len(labels)], "phase"), nil,
+		),
+		streamThroughput: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "stream_throughput_bits_per_second"),
+			"Bandwidth of each stream of the transfer phases with parallel streams (bps), 0 for the streams which failed, by direction and stream number.",
+			append(labels[:len(labels):len(labels)], "direction", "stream"), nil,
+		),
+		streamErrors: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "stream_errors"),
+			"Number of failed requests of each stream of the transfer phases with parallel streams, retried or not, by direction and stream number.",
+			append(labels[:len(labels):len(labels)], "direction", "stream"), nil,
+		),
+		rateLimited: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "rate_limited"),
+			"Whether the bandwidth was constrained by the rate limit of the exporter rather than the network, by phase.",
+			append(labels[:len(labels):len(labels)], "phase"), nil,
+		),
+		cacheSuspected: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "cached_result_suspected"),
+			"Whether the responses of the download phase seemed served by a transparent cache, from their headers or content.",
+			labels, nil,
+		),
+		phaseSuccess: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "phase_success"),
+			"Whether each phase of the last test succeeded, by phase. The phases following a failed one are not run.",
+			append(labels[:len(labels):len(labels)], "phase"), nil,
+		),
+		transferBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "transfer_bytes"),
+			"Bytes transferred by the phase, excluding protocol overhead, exported along with the interface counters.",
+			append(labels[:len(labels):len(labels)], "phase"), nil,
+		),
+		interfaceRx: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "interface_rx_bytes"),
+			"Bytes received by the verified interface during the phase.",
+			append(labels[:len(labels):len(labels)], "phase"), nil,
+		),
+		interfaceTx: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "interface_tx_bytes"),
+			"Bytes transmitted by the verified interface during the phase.",
+			append(labels[:len(labels):len(labels)], "phase"), nil,
+		),
+		cpuUtilization: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "cpu_utilization_ratio"),
+			"Busy share of the CPUs of the host during the phase.",
+			append(labels[:len(labels):len(labels)], "phase"), nil,
+		),
+		processCPUUtilization: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "exporter_cpu_utilization_ratio"),
+			"Share of the CPUs of the host used by the exporter during the phase.",
+			append(labels[:len(labels):len(labels)], "phase"), nil,
+		),
+		testParameters: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "test_parameters_info"),
+			"Settings of the transfer phases in force for the test: streams, durations in seconds (0 when each payload is requested once), number, largest size in bytes and content (random or zero) of the upload payloads.",
+			append(labels[:len(labels):len(labels)], "download_streams", "upload_streams", "download_duration", "upload_duration", "upload_payloads", "upload_max_payload", "upload_payload"), nil,
+		),
+		connectionInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "connection_info"),
+			"Connections of the test, from the first one of the download phase, or else of the upload phase: HTTP version (1.1, 2 or 3), TLS version (none over cleartext) and address family of the server.",
+			append(labels[:len(labels):len(labels)], "http_version", "tls_version", "remote_addr_family"), nil,
+		),
+		cpuLimited: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "cpu_limited"),
+			"Whether the CPU utilization stayed above the threshold for most of the phase, its bandwidth being likely bounded by the CPU.",
+			append(labels[:len(labels):len(labels)], "phase"), nil,
+		),
+		provisionedDownload: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "provisioned_download_bits_per_second"),
+			"Subscribed download rate of the line (bps).",
+			nil, nil,
+		),
+		provisionedUpload: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "provisioned_upload_bits_per_second"),
+			"Subscribed upload rate of the line (bps).",
+			nil, nil,
+		),
+		downloadRatio: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "download_ratio"),
+			"Ratio of the download bandwidth to the subscribed download rate.",
+			labels, nil,
+		),
+		uploadRatio: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "upload_ratio"),
+			"Ratio of the upload bandwidth to the subscribed upload rate.",
+			labels, nil,
+		),
+		ip:     !config.NoIPLabel,
+		server: config.ServerLabels,
+	}
+}
+
+// labelValues returns the label values of the metrics of result
+func (d *resultDescs) labelValues(result *Result) []string {
+	var values []string
+	if d.ip {
+		values = append(values, result.IP)
+	}
+	if d.server {
+		var id, name string
+		if result.Server != nil {
+			id, name = result.Server.ID, result.Server.Name
+		}
+		values = append(values, id, name)
+	}
+	return values
+}
+
+func (d *resultDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.ping
+	ch <- d.pingStdDev
+	ch <- d.hops
+	ch <- d.info
+	ch <- d.serverLatitude
+	ch <- d.serverLongitude
+	ch <- d.clientLatitude
+	ch <- d.clientLongitude
+	ch <- d.download
+	ch <- d.upload
+	ch <- d.duplexDownload
+	ch <- d.duplexUpload
+	ch <- d.streams
+	ch <- d.streamThroughput
+	ch <- d.streamErrors
+	ch <- d.rateLimited
+	ch <- d.cacheSuspected
+	ch <- d.phaseSuccess
+	ch <- d.transferBytes
+	ch <- d.interfaceRx
+	ch <- d.interfaceTx
+	ch <- d.cpuUtilization
+	ch <- d.processCPUUtilization
+	ch <- d.cpuLimited
+	ch <- d.testParameters
+	ch <- d.connectionInfo
+	ch <- d.provisionedDownload
+	ch <- d.provisionedUpload
+	ch <- d.downloadRatio
+	ch <- d.uploadRatio
+}
+
 // Exporter collects Speedtest stats from the given server and exports them using
 // the prometheus metrics package.
 type Exporter struct {
-	Client *speedtest.Client
+	// ctx is the parent context of the tests, canceled on shutdown
+	ctx context.Context
+	// link is the name of the link the tests run over, empty for the
+	// default route
+	link string
+	// labels are the labels of the link, attached to its metrics and
+	// results
+	labels map[string]string
+	state  *stateStore
+	// outputs are handed the results, if any
+	outputs *outputs
+	descs   *resultDescs
+	ip      *ipChecker
+	// expectations report the tests missing the expected results
+	expectations *expectationChecker
+	// window aggregates the recent results, if enabled
+	window *resultWindow
+	// dns times the lookups of the configured names along with the tests
+	dns *dnsBenchmark
+	// limiter bounds the tests run at once, shared with the links, the
+	// probes and the targets
+	limiter *testLimiter
+	// tracer, if not nil, traces the tests and the setup of their clients,
+	// shared with the links
+	tracer *tracer
+	// backend is the backend the tests run on when several are compared,
+	// its name being the backend label of the metrics and results, and
+	// followers the Exporters of the other ones, tested in turn after each
+	// test of this one
+	backend   string
+	followers []*Exporter
+
+	// newClient creates the Speedtest clients of the configurations
+	newClient clientFactory
+	// dedup suppresses the repeated errors of the tests
+	dedup *logDedup
+	// mock, if set, is the mock backend the clients are created by, the
+	// probes included
+	mock *mockBackend
+	// newRunID returns the identifier of each test
+	newRunID func() string
+	// rebuild creates a new Speedtest client of the active configuration,
+	// to re-initialize the client after consecutive failures, nil when
+	// not set by the configuration manager
+	rebuild func() (speedtestClient, error)
+	reinit  *clientReinit
+	// rateLimit suspends the tests while the Speedtest servers rate-limit
+	// the client
+	rateLimit *rateLimitBackoff
+	// busy defers or skips the tests while the link is busy
+	busy *busyCheck
+
+	mu     sync.RWMutex
+	Client speedtestClient
+	tested bool
+	// interval is the time between scheduled tests. When zero, a test is
+	// run on each scrape instead.
+	interval time.Duration
+	// pingInterval, when set, splits the schedule: the latency is tested
+	// alone at this interval between the full tests, lastPing being the
+	// result of the last latency test
+	pingInterval time.Duration
+	last         *Result
+	lastPing     *Result
+	// next is the time of the next scheduled test, zero when none is
+	// scheduled
+	next time.Time
+	// testStarted is the start time of the running test, zero when idle
+	testStarted time.Time
+	wake        chan struct{}
+	output      OutputConfig
+	line        LineConfig
+	// retest runs a confirmation test after an anomalous scheduled test
+	retest bool
+	// dataCap, when set, skips the tests once dataUsage, the volumes they
+	// transferred over the last 24 hours, reaches it
+	dataCap   int64
+	dataUsage []dataUsage
+	// mode is modeSoak when the soak test runs instead of the discrete
+	// tests, with the settings of soak unless soakPaused
+	mode       string
+	soak       SoakConfig
+	soakPaused bool
+
+	tests   *prometheus.CounterVec
+	errors  *prometheus.CounterVec
+	retries *prometheus.CounterVec
+	// requests counts the requests of the phases by status class
+	requests *prometheus.CounterVec
+	// encodedResponses counts the responses of the phases with a content
+	// encoding
+	encodedResponses *prometheus.CounterVec
+	// parseWarnings counts the parts of the Speedtest documents ignored or
+	// defaulted by the parse
+	parseWarnings *prometheus.CounterVec
+	// retests counts the confirmation tests by outcome
+	retests *prometheus.CounterVec
+	// shareFailures counts the results that couldn't be shared
+	shareFailures prometheus.Counter
+	// transferred counts the bytes of the successful transfer phases
+	transferred *prometheus.CounterVec
+	// sinkMetrics count the deliveries of the sinks of the outputs, nil
+	// for the links sharing those of the default route
+	sinkMetrics *sinkMetrics
+	dataCapDesc *prometheus.Desc
+	dataUsed    *prometheus.Desc
+	// lastTest is the completion time of the last latency and bandwidth
+	// tests of a split schedule
+	lastTest    *prometheus.Desc
+	soakMetrics *soakMetrics
 }
 
-// NewExporter returns an initialized Exporter.
-func NewExporter(config string, server string) (*Exporter, error) {
-	log.Info("Setup Speedtest client")
-	client, err := speedtest.NewClient(config, server)
+// newExporter returns an Exporter without Speedtest client, which doesn't
+// run any test until SetClient is called. Test results are saved to state.
+// The metrics are named and labeled according to metrics.
+func newExporter(ctx context.Context, state *stateStore, metrics MetricsConfig) *Exporter {
+	slog.Debug("Init exporter")
+	return &Exporter{
+		ctx:          ctx,
+		state:        state,
+		descs:        newResultDescs(metrics),
+		ip:           newIPChecker(metrics.Namespace, state),
+		expectations: newExpectationChecker(metrics.Namespace),
+		window:       newResultWindow(metrics, state),
+		dns:          newDNSBenchmark(metrics.Namespace),
+		limiter:      newTestLimiter(metrics.Namespace),
+		newClient:    newSpeedtestClient,
+		newRunID:     randomRunID,
+		dedup:        newLogDedup(),
+		reinit:       newClientReinit(metrics.Namespace),
+		rateLimit:    newRateLimitBackoff(metrics.Namespace),
+		busy:         newBusyCheck(metrics.Namespace),
+		wake:         make(chan struct{}, 1),
+		tests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "tests_total",
+			Help:      "Number of Speedtest tests run, by trigger.",
+		}, []string{"trigger"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "errors_total",
+			Help:      "Number of failed Speedtest tests, by phase and error type.",
+		}, []string{"phase", "type"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "request_retries_total",
+			Help:      "Number of retries of the Speedtest requests failing with transient errors, by phase.",
+		}, []string{"phase"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of Speedtest requests, by phase and status class: 2xx, 3xx, 4xx, 5xx, or error for the requests without response.",
+		}, []string{"phase", "code"}),
+		encodedResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "encoded_responses_total",
+			Help:      "Number of responses of the phases with a content encoding, which may overstate the bandwidth, by phase and encoding: gzip, deflate, br, zstd, compress or other.",
+		}, []string{"phase", "encoding"}),
+		parseWarnings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "config_parse_warnings_total",
+			Help:      "Number of parts of the Speedtest configuration and server list ignored or defaulted as unexpected, by document: config or servers.",
+		}, []string{"document"}),
+		retests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "anomaly_retests_total",
+			Help:      "Number of confirmation tests run after anomalous scheduled tests, by result: reproduced, not_reproduced or failed.",
+		}, []string{"result"}),
+		shareFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "share_failures_total",
+			Help:      "Number of successful test results whose submission to speedtest.net failed.",
+		}),
+		transferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "transferred_bytes_total",
+			Help:      "Bytes transferred by the successful download and upload phases, by phase.",
+		}, []string{"phase"}),
+		sinkMetrics: newSinkMetrics(metrics.Namespace),
+		dataCapDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metrics.Namespace, "", "daily_cap_bytes"),
+			"Volume the tests may transfer over 24 hours, when capped.",
+			nil, nil,
+		),
+		dataUsed: prometheus.NewDesc(
+			prometheus.BuildFQName(metrics.Namespace, "", "daily_cap_used_bytes"),
+			"Volume transferred by the tests over the last 24 hours, when capped.",
+			nil, nil,
+		),
+		lastTest: prometheus.NewDesc(
+			prometheus.BuildFQName(metrics.Namespace, "", "last_test_timestamp_seconds"),
+			"Completion time of the last test of the latency and of the bandwidth, whatever its outcome, by test, when the latency is tested at its own interval.",
+			[]string{"test"}, nil,
+		),
+		soakMetrics: newSoakMetrics(metrics.Namespace),
+	}
+}
+
+// speedtestClient is the part of the Speedtest client the exporter depends
+// on, faked by the tests of the collector
+type speedtestClient interface {
+	// TestServer returns the server the tests run against
+	TestServer() speedtest.Server
+	// ClientInfo returns the client block of the Speedtest configuration
+	// retrieved on creation, nil for the Speedtest Mini servers
+	ClientInfo() *speedtest.ClientInfo
+	FetchClientInfo(ctx context.Context) (*speedtest.ClientInfo, error)
+	// Servers returns the servers the test server was selected from,
+	// measuring their latency again with probe set
+	Servers(ctx context.Context, probe bool) []speedtest.ServerStatus
+	Run(ctx context.Context, phases ...string) (*speedtest.Result, error)
+	// Soak runs a soak test until ctx is done, passing its reports to
+	// report
+	Soak(ctx context.Context, opts speedtest.SoakOptions, report func(speedtest.SoakReport)) error
+}
+
+// liveClient is the speedtestClient of a *speedtest.Client
+type liveClient struct {
+	*speedtest.Client
+}
+
+func (c liveClient) TestServer() speedtest.Server {
+	return c.Server
+}
+
+func (c liveClient) ClientInfo() *speedtest.ClientInfo {
+	return c.Config
+}
+
+// clientFactory creates the Speedtest client of a configuration, the
+// retrieval of the Speedtest documents and the server selection being
+// aborted when ctx is done
+type clientFactory func(ctx context.Context, config *SpeedtestConfig, opts speedtest.Options) (speedtestClient, error)
+
+// newSpeedtestClient is the clientFactory of the real Speedtest servers
+func newSpeedtestClient(ctx context.Context, config *SpeedtestConfig, opts speedtest.Options) (speedtestClient, error) {
+	slog.Debug("Setup Speedtest client")
+	var client *speedtest.Client
+	var err error
+	if config.MiniURL != "" {
+		client, err = speedtest.NewMiniClient(config.MiniURL, opts)
+	} else {
+		client, err = speedtest.NewFilteredClient(ctx, config.ConfigURL, config.ServerURL, config.serverFilter(), opts)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Can't create the Speedtest client: %s", err)
 	}
+	config.configure(client, 0)
+	slog.Info("Test server selected", "server_id", client.Server.ID, "name", client.Server.Name,
+		"sponsor", client.Server.Sponsor, "url", client.Server.URL)
+	return liveClient{client}, nil
+}
 
-	log.Debugln("Init exporter")
-	return &Exporter{
-		Client: client,
-	}, nil
+// newSpeedtestTransport returns the transport shared by the Speedtest
+// clients, logging the proxy it uses.
+func newSpeedtestTransport(config *SpeedtestConfig) (*http.Transport, error) {
+	transport := config.dialConfig()
+	transport.HTTPVersion = config.HTTPVersion
+	if config.HostOverride != "" {
+		u, _ := url.Parse("//" + config.HostOverride)
+		transport.ServerName = u.Hostname()
+		slog.Debug("Overriding the host of the Speedtest requests", "host", config.HostOverride)
+	}
+	if config.HTTPVersion != speedtest.HTTPVersionAuto {
+		slog.Debug("Forcing the HTTP version of the Speedtest requests", "http_version", config.HTTPVersion)
+	}
+	if config.SourceAddress != "" {
+		slog.Debug("Binding the Speedtest connections", "source_address", transport.SourceAddress)
+	}
+	if config.Interface != "" {
+		slog.Debug("Binding the Speedtest connections", "interface", config.Interface)
+	}
+	if config.Netns != "" {
+		slog.Debug("Opening the Speedtest connections in a network namespace", "netns", config.Netns)
+	}
+	if config.DNSServer != "" {
+		slog.Debug("Resolving the Speedtest host names", "dns_server", dnsServerAddress(config.DNSServer))
+	}
+	var err error
+	if transport.TLSConfig, err = newTLSConfig(&config.TLS); err != nil {
+		return nil, err
+	}
+	if config.TLS.InsecureSkipVerify {
+		slog.Warn("The certificates of the Speedtest servers are NOT verified, the test traffic may be intercepted")
+	}
+	if config.ProxyURL == "" {
+		var attrs []any
+		for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+			value := os.Getenv(name)
+			if value == "" {
+				value = os.Getenv(strings.ToLower(name))
+			}
+			if value != "" {
+				attrs = append(attrs, strings.ToLower(name), redactURL(value))
+			}
+		}
+		if len(attrs) > 0 {
+			slog.Debug("Using the proxy of the environment", attrs...)
+		}
+		return speedtest.NewTransport(transport)
+	}
+	proxyURL, err := url.Parse(config.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy URL: %s", err)
+	}
+	slog.Debug("Using proxy", "proxy_url", proxyURL.Redacted())
+	transport.ProxyURL = proxyURL
+	return speedtest.NewTransport(transport)
+}
+
+// newTLSConfig returns the TLS settings of config, nil for the defaults
+func newTLSConfig(config *TLSConfig) (*tls.Config, error) {
+	if config.CAFile == "" && !config.InsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read the CA file: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in the CA file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// createClient creates the Speedtest client of config with the factory of
+// the exporter, counting its requests, their retries and the parse warnings
+// of the Speedtest documents, and tracing its steps. It is aborted on
+// shutdown, and after the init timeout of config, which the attempts at
+// the mirrors of the Speedtest documents share.
+func (e *Exporter) createClient(config *SpeedtestConfig, opts speedtest.Options) (speedtestClient, error) {
+	opts.Trace = e.tracer.trace()
+	opts.OnRetry = func(phase string, err error) {
+		e.retries.WithLabelValues(phase).Inc()
+	}
+	opts.OnRequest = func(phase string, status int) {
+		e.requests.WithLabelValues(phase, statusClass(status)).Inc()
+	}
+	opts.OnEncodedResponse = func(phase string, encoding string) {
+		e.encodedResponses.WithLabelValues(phase, encoding).Inc()
+	}
+	opts.OnParseWarning = func(document string, warning string) {
+		e.parseWarnings.WithLabelValues(document).Inc()
+	}
+	ctx := e.ctx
+	if config.InitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.InitTimeout)
+		defer cancel()
+	}
+	return e.newClient(ctx, config, opts)
+}
+
+// statusClass returns the class of an HTTP status code, such as 5xx, or
+// error for 0 and any invalid code
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "error"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// SetClient replaces the Speedtest client used by the next tests
+func (e *Exporter) SetClient(client speedtestClient) {
+	e.mu.Lock()
+	e.Client = client
+	e.mu.Unlock()
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SetInterval defines the time between scheduled tests, zero meaning a test
+// is run on each scrape
+func (e *Exporter) SetInterval(interval time.Duration) {
+	e.mu.Lock()
+	changed := e.interval != interval
+	e.interval = interval
+	e.mu.Unlock()
+	if changed {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SetPingInterval defines the time between the latency tests run alone
+// between the scheduled tests, zero disabling them
+func (e *Exporter) SetPingInterval(interval time.Duration) {
+	e.mu.Lock()
+	changed := e.pingInterval != interval
+	e.pingInterval = interval
+	e.mu.Unlock()
+	if changed {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SetRetest defines whether an anomalous scheduled test is confirmed by
+// running another one right away
+func (e *Exporter) SetRetest(retest bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.retest = retest
+}
+
+// SetLogDedup sets the period of the summaries of the repeated errors of
+// the tests, 0 logging them all
+func (e *Exporter) SetLogDedup(window time.Duration) {
+	e.dedup.setWindow(window)
+}
+
+// SetOutput defines how the results are exported
+func (e *Exporter) SetOutput(output OutputConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.output = output
+}
+
+// SetLine defines the subscribed rates of the line the results are
+// compared to
+func (e *Exporter) SetLine(line LineConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.line = line
+}
+
+// run runs the scheduled tests, or the soak test, until the exporter
+// context is done. The first test is run as soon as an interval is set.
+// With a ping interval, the latency is tested alone until the next full
+// test is due. A full test finding the link busy is deferred or skipped.
+func (e *Exporter) run() {
+	trigger := triggerStartup
+	// due is the time of the next full test of a split schedule, whose
+	// interval is scheduled
+	var due time.Time
+	var scheduled time.Duration
+	for {
+		e.mu.RLock()
+		client, interval, pingInterval, mode, soak := e.Client, e.interval, e.pingInterval, e.mode, e.soak
+		e.mu.RUnlock()
+		// The other backends are tested even when this one can't be
+		idle := client == nil && len(e.followers) == 0
+
+		if mode == modeSoak && client != nil {
+			e.runSoak(client, soak)
+			if e.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		var next <-chan time.Time
+		wait := interval
+		if interval > 0 {
+			if scheduled != interval {
+				due, scheduled = time.Time{}, interval
+			}
+			backingOff := len(e.followers) == 0 && !e.rateLimit.backingOff().IsZero()
+			switch {
+			case idle:
+			case backingOff:
+			case pingInterval > 0 && time.Now().Before(due):
+				e.testCycle(triggerPing, speedtest.PhasePing)
+			case e.capped():
+				e.logger().Warn("Daily data cap reached, skipping the test", "cap", byteSize(e.dataCapValue()))
+				due = time.Now().Add(interval)
+			default:
+				busy, delay := e.linkBusy(e.ctx, true)
+				switch {
+				case e.ctx.Err() != nil:
+					return
+				case delay > 0:
+					due, wait = time.Now().Add(delay), delay
+				case busy:
+					due = time.Now().Add(interval)
+				default:
+					e.testCycle(trigger)
+					trigger = triggerSchedule
+					due = time.Now().Add(interval)
+				}
+			}
+			if pingInterval > 0 {
+				wait = min(pingInterval, max(time.Until(due), 0))
+			}
+			if backingOff {
+				wait = max(wait, time.Until(e.rateLimit.backingOff()))
+			}
+			next = time.After(wait)
+		}
+		e.mu.Lock()
+		if interval > 0 && !idle {
+			e.next = time.Now().Add(wait)
+		} else {
+			e.next = time.Time{}
+		}
+		e.mu.Unlock()
+		select {
+		case <-next:
+		case <-e.wake:
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// testCycle runs a scheduled test of the given phases, or all of them,
+// then the same test of each of the other backends in turn, an anomalous
+// full test being confirmed when enabled. The backends without client or
+// backing off are skipped.
+func (e *Exporter) testCycle(trigger string, phases ...string) {
+	for _, x := range append([]*Exporter{e}, e.followers...) {
+		x.mu.RLock()
+		client, retest := x.Client, x.retest
+		x.mu.RUnlock()
+		if client == nil || !x.rateLimit.backingOff().IsZero() {
+			continue
+		}
+		if result := x.test(e.ctx, client, trigger, phases...); result.Anomalous && retest {
+			x.confirm(client)
+		}
+	}
+}
+
+// confirm runs the confirmation test of an anomalous test. Only one is
+// run, whatever its result.
+func (e *Exporter) confirm(client speedtestClient) {
+	logger := e.logger()
+	logger.Info("Anomalous test result, running a confirmation test")
+	retest := e.test(e.ctx, client, triggerRetest)
+	outcome := "not_reproduced"
+	switch {
+	case retest.Error != "":
+		outcome = "failed"
+	case retest.Anomalous:
+		outcome = "reproduced"
+	}
+	logger.Info("Confirmation test finished", "result", outcome)
+	e.retests.WithLabelValues(outcome).Inc()
+}
+
+// Status returns whether the exporter has a Speedtest client, and whether
+// a test completed successfully since startup.
+func (e *Exporter) Status() (initialized bool, tested bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.Client != nil, e.tested
+}
+
+// Healthy returns whether no test is stuck
+func (e *Exporter) Healthy() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.testStarted.IsZero() || time.Since(e.testStarted) < maxTestDuration
+}
+
+// Last returns the last test result, nil before the first test, and the time
+// of the next scheduled test, zero when none is scheduled.
+func (e *Exporter) Last() (*Result, time.Time) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.published(), e.next
+}
+
+// published returns the last test result. With a split schedule, its
+// latency is that of the last latency test when more recent. e.mu must be
+// held.
+func (e *Exporter) published() *Result {
+	switch {
+	case e.lastPing == nil:
+		return e.last
+	case e.last == nil:
+		return e.lastPing
+	}
+	return mergeLatency(e.last, e.lastPing)
 }
 
 // Describe describes all the metrics ever exported by the Speedtest exporter.
 // It implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- ping
-	ch <- download
-	ch <- upload
+	e.descs.describe(ch)
+	e.tests.Describe(ch)
+	e.errors.Describe(ch)
+	e.retries.Describe(ch)
+	e.requests.Describe(ch)
+	e.encodedResponses.Describe(ch)
+	e.parseWarnings.Describe(ch)
+	e.retests.Describe(ch)
+	e.shareFailures.Describe(ch)
+	e.transferred.Describe(ch)
+	e.sinkMetrics.Describe(ch)
+	ch <- e.dataCapDesc
+	ch <- e.dataUsed
+	ch <- e.lastTest
+	e.soakMetrics.Describe(ch)
+	e.reinit.Describe(ch)
+	e.rateLimit.Describe(ch)
+	e.busy.Describe(ch)
+	e.expectations.Describe(ch)
+	e.window.Describe(ch)
+	e.dns.Describe(ch)
+	if !e.child() {
+		e.limiter.Describe(ch)
+	}
+	e.ip.Describe(ch)
 }
 
 // Collect fetches the stats from configured Speedtest location and delivers them
-// as Prometheus metrics.
+// as Prometheus metrics. When tests are scheduled, the last result is
+// delivered instead.
 // It implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	log.Infof("Speedtest exporter starting")
-	if e.Client == nil {
-		log.Errorf("Speedtest client not configured.")
+	e.collect(e.ctx, ch)
+}
+
+// scrapeCollector is the Exporter collector of a scrape, whose test is
+// aborted when the scrape request is canceled
+type scrapeCollector struct {
+	*Exporter
+	ctx context.Context
+}
+
+func (c scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(c.ctx, ch)
+}
+
+// collect is Collect, a test run on scrape being aborted when ctx is done
+// or the exporter shuts down
+func (e *Exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	e.mu.RLock()
+	client, interval, last, output, line := e.Client, e.interval, e.published(), e.output, e.line
+	e.mu.RUnlock()
+	if client == nil {
+		slog.Debug("Speedtest client not configured")
+		collectLine(ch, e.descs, line, nil, false)
+		e.collectCounters(ch)
+		return
+	}
+
+	// A capped, soaking, rate-limited or busy exporter serves its last
+	// result, as if tests were scheduled
+	held := interval > 0 || e.capped() || e.soaking() || !e.rateLimit.backingOff().IsZero()
+	if !held {
+		held, _ = e.linkBusy(ctx, false)
+	}
+	if held {
+		if last != nil {
+			collectResult(ch, e.descs, last, output.Timestamps)
+		}
+		collectLine(ch, e.descs, line, last, output.Timestamps)
+		e.collectCounters(ch)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(e.ctx, cancel)
+	defer stop()
+	result := e.test(ctx, client, triggerScrape)
+	collectResult(ch, e.descs, result, output.Timestamps)
+	collectLine(ch, e.descs, line, result, output.Timestamps)
+	e.collectCounters(ch)
+}
+
+// collectCounters delivers the metrics accumulated across the tests
+func (e *Exporter) collectCounters(ch chan<- prometheus.Metric) {
+	e.tests.Collect(ch)
+	e.errors.Collect(ch)
+	e.retries.Collect(ch)
+	e.requests.Collect(ch)
+	e.encodedResponses.Collect(ch)
+	e.parseWarnings.Collect(ch)
+	e.retests.Collect(ch)
+	e.shareFailures.Collect(ch)
+	e.transferred.Collect(ch)
+	e.sinkMetrics.Collect(ch)
+	e.collectDataUsage(ch)
+	e.collectLastTests(ch)
+	if e.soaking() {
+		e.soakMetrics.Collect(ch)
+	}
+	e.reinit.Collect(ch)
+	e.rateLimit.Collect(ch)
+	e.busy.Collect(ch)
+	e.expectations.Collect(ch)
+	e.window.Collect(ch)
+	e.dns.Collect(ch)
+	if !e.child() {
+		e.limiter.Collect(ch)
+	}
+	e.ip.Collect(ch)
+}
+
+// collectLastTests delivers the completion time of the last latency and
+// bandwidth tests of a split schedule, a full test testing the latency too
+func (e *Exporter) collectLastTests(ch chan<- prometheus.Metric) {
+	e.mu.RLock()
+	split, last, lastPing := e.pingInterval > 0, e.last, e.lastPing
+	e.mu.RUnlock()
+	if !split {
 		return
 	}
+	var latency time.Time
+	if last != nil {
+		latency = last.FinishedAt
+		ch <- prometheus.MustNewConstMetric(e.lastTest, prometheus.GaugeValue, float64(last.FinishedAt.UnixNano())/1e9, "bandwidth")
+	}
+	if lastPing != nil && lastPing.FinishedAt.After(latency) {
+		latency = lastPing.FinishedAt
+	}
+	if !latency.IsZero() {
+		ch <- prometheus.MustNewConstMetric(e.lastTest, prometheus.GaugeValue, float64(latency.UnixNano())/1e9, "latency")
+	}
+}
+
+// The messages of the tests whose repeats are deduplicated
+const (
+	msgTestFailed       = "Speedtest failed"
+	msgClientInfoFailed = "Can't retrieve the Speedtest configuration, using the client address of the startup"
+)
+
+// test runs a Speedtest of the given phases, or all of them if none is
+// given, aborted when ctx is done, and records its result along with its
+// trigger. The results of the latency tests of a split schedule are kept
+// apart from those of the full tests.
+func (e *Exporter) test(ctx context.Context, client speedtestClient, trigger string, phases ...string) *Result {
+	logger := e.logger()
+	if e.child() {
+		ctx = speedtest.WithLogger(ctx, logger)
+	}
+	logger.Debug("Speedtest exporter starting", "trigger", trigger)
+	ctx, endTrace := e.tracer.startTest(ctx, trigger, e.link, client.TestServer())
+	// The lookups run in the background, not delaying the test
+	e.dns.start(e.ctx, logger)
+	// The test waits for its turn before being considered running
+	queueErr := e.limiter.acquire(ctx)
+	if queueErr == nil {
+		defer e.limiter.release()
+	}
+	start := time.Now()
+	e.mu.Lock()
+	e.testStarted = start
+	e.mu.Unlock()
+	// The client address is fetched again, as it may have changed since the
+	// client was created, though not by the frequent latency tests
+	info := client.ClientInfo()
+	var infoErr error
+	if e.ip.enabled() && info != nil && queueErr == nil && trigger != triggerPing {
+		fresh, err := client.FetchClientInfo(ctx)
+		if infoErr = err; err != nil {
+			e.dedup.log(logger, slog.LevelWarn, msgClientInfoFailed, "", "err", err)
+		} else {
+			e.dedup.reset(logger, msgClientInfoFailed)
+			info = fresh
+		}
+	}
+	ip := e.ip.externalIP(ctx, info)
 
-	ip, err := checkIP()
+	var res *speedtest.Result
+	var err error
+	if queueErr != nil {
+		err = &speedtest.PhaseError{Phase: phaseQueue, Err: queueErr}
+	} else {
+		res, err = client.Run(ctx, phases...)
+	}
+	server := client.TestServer()
+	// The result is complete before being published, by a single swap
+	result := newResult(start, ip, res)
+	result.RunID = e.newRunID()
+	result.Link = e.link
+	result.Labels = e.labels
+	result.Trigger = trigger
+	e.tests.WithLabelValues(trigger).Inc()
+	if res != nil {
+		e.addDataUsage(res.BytesDown + res.BytesUp)
+		if res.ShareErr != nil {
+			logger.Warn("Can't share the Speedtest result", "server_id", server.ID, "err", res.ShareErr)
+			e.shareFailures.Inc()
+		}
+	}
+	result.Backend = "mini"
+	if info != nil {
+		result.ISP = info.ISP
+		result.ClientLocation = newLocation(info.Lat, info.Lon)
+		result.Backend = backendSpeedtest
+	}
+	if e.mock != nil {
+		result.Backend = backendMock
+	}
+	if e.backend != "" {
+		result.Backend = e.backend
+	}
+	for _, phase := range []string{speedtest.PhaseDownload, speedtest.PhaseUpload} {
+		if res != nil && res.Succeeded[phase] {
+			e.transferred.WithLabelValues(phase).Add(float64(res.Phases[phase].Bytes))
+		}
+	}
+	// A rate-limited configuration request suspends the tests too
+	outcome := err
+	if outcome == nil && speedtest.IsRateLimited(infoErr) {
+		outcome = infoErr
+	}
 	if err != nil {
-		log.Errorf("Error getting IP address: %s", err)
-		ip = "unknown"
+		result.Error = err.Error()
+		phase := "unknown"
+		if pe, ok := err.(*speedtest.PhaseError); ok {
+			phase = pe.Phase
+			err = pe.Err
+		}
+		errorType := speedtest.ErrorType(err)
+		e.dedup.log(logger, slog.LevelError, msgTestFailed, phase+"/"+errorType+"/"+server.ID, "phase", phase, "server_id", server.ID,
+			"duration", time.Since(start), "type", errorType, "err", err)
+		e.errors.WithLabelValues(phase, errorType).Inc()
+	} else {
+		e.dedup.reset(logger, msgTestFailed)
+		e.expectations.check(result)
+	}
+	// The window aggregates the full tests only
+	if trigger != triggerPing {
+		result.Anomalous = e.window.add(result)
+	}
+	e.mu.Lock()
+	if e.testStarted.Equal(start) {
+		e.testStarted = time.Time{}
+	}
+	if trigger == triggerPing {
+		e.lastPing = result
+	} else {
+		e.last = result
+	}
+	if err == nil {
+		e.tested = true
+	}
+	e.mu.Unlock()
+	if trigger != triggerPing {
+		e.state.setLastResult(result)
+	}
+	e.outputs.add(result)
+	endTrace(result)
+	// The tests which didn't get their turn or were aborted say nothing
+	// of the client. A new client would only fetch the configuration
+	// again while rate-limited.
+	if queueErr == nil && ctx.Err() == nil {
+		e.mu.RLock()
+		interval := e.interval
+		e.mu.RUnlock()
+		if delay := e.rateLimit.record(outcome, interval); delay > 0 {
+			logger.Warn("Rate-limited by the Speedtest servers, suspending the tests", "backoff", delay, "until", time.Now().Add(delay).Round(time.Second))
+		} else if e.rebuild != nil {
+			if failures := e.reinit.record(client, err != nil); failures > 0 {
+				e.reinitialize(client, failures)
+			}
+		}
 	}
+	logger.Debug("Speedtest exporter finished", "duration", time.Since(start))
+	return result
+}
+
+// liftBackoff ends the backoff of the tests, a probe having succeeded
+// meanwhile, and resumes the schedule
+func (e *Exporter) liftBackoff() {
+	if e.rateLimit.backingOff().IsZero() {
+		return
+	}
+	e.rateLimit.record(nil, 0)
+	e.logger().Info("Probe succeeded while rate-limited, resuming the tests")
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
 
-	metrics := e.Client.NetworkMetrics()
-	ch <- prometheus.MustNewConstMetric(ping, prometheus.GaugeValue, metrics["ping"], ip)
-	ch <- prometheus.MustNewConstMetric(download, prometheus.GaugeValue, metrics["download"], ip)
-	ch <- prometheus.MustNewConstMetric(upload, prometheus.GaugeValue, metrics["upload"], ip)
-	log.Infof("Speedtest exporter finished")
+// randomRunID returns a random test identifier of 16 hexadecimal digits
+func randomRunID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
 }
 
-func init() {
-	prometheus.MustRegister(prom_version.NewCollector("speedtest_exporter"))
+// newRegistry returns the registry of the metrics exposed on the telemetry
+// path, along with those of the Exporter collected per scrape. Unless
+// disabled, it includes the Go runtime and process metrics of the exporter.
+// The constant labels of the configuration are attached to the other
+// metrics.
+func newRegistry(config *Config, cs ...prometheus.Collector) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	labeled := prometheus.WrapRegistererWith(prometheus.Labels(config.Metrics.Labels), registry)
+	labeled.MustRegister(versioncollector.NewCollector("speedtest_exporter"))
+	if !config.Web.DisableExporterMetrics {
+		registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+	labeled.MustRegister(cs...)
+	return registry
 }
 
 func main() {
-	var (
-		showVersion   = flag.Bool("version", false, "Print version information.")
-		listenAddress = flag.String("web.listen-address", ":9112", "Address to listen on for web interface and telemetry.")
-		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		configURL     = flag.String("speedtest.config-url", "http://c.speedtest.net/speedtest-config.php?x="+uniuri.New(), "Speedtest configuration URL")
-		serverURL     = flag.String("speedtest.server-url", "http://c.speedtest.net/speedtest-servers-static.php?x="+uniuri.New(), "Speedtest server URL")
-	)
-	flag.Parse()
-
-	if *showVersion {
+	if len(os.Args) > 1 && os.Args[1] == "benchmark-servers" {
+		os.Exit(runBenchmarkServers(os.Args[2:]))
+	}
+	config, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		slog.Error("Invalid configuration", "err", err)
+		os.Exit(1)
+	}
+
+	if config.ShowVersion {
 		fmt.Printf("Speedtest Prometheus exporter. v%s\n", version.Version)
 		os.Exit(0)
 	}
 
-	log.Infoln("Starting speedtest exporter", prom_version.Info())
-	log.Infoln("Build context", prom_version.BuildContext())
+	if config.ServiceInstall || config.ServiceUninstall {
+		if config.ServiceInstall {
+			err = installService(serviceArgs(os.Args[1:]))
+		} else {
+			err = uninstallService()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	service, err := isService()
+	if err != nil {
+		slog.Error("Can't determine whether running as a service", "err", err)
+		os.Exit(1)
+	}
+
+	logLevel := promslog.NewLevel()
+	logLevel.Set(config.Log.Level)
+	logFormat := promslog.NewFormat()
+	logFormat.Set(config.Log.Format)
+	logger := promslog.New(&promslog.Config{Level: logLevel, Format: logFormat})
+	if service {
+		handler, err := newServiceHandler(logLevel)
+		if err != nil {
+			logger.Error("Can't open the event log", "err", err)
+			os.Exit(1)
+		}
+		logger = slog.New(handler)
+	}
+	slog.SetDefault(logger)
 
-	exporter, err := NewExporter(*configURL, *serverURL)
+	if config.CheckConfig {
+		if err := checkConfig(os.Stdout, config, config.CheckConfigOffline); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if config.Once {
+		// An interrupted test fails as any other
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		code := runOnce(ctx, os.Stdout, os.Stderr, config)
+		stop()
+		os.Exit(code)
+	}
+
+	logger.Info("Starting speedtest exporter", "version", prom_version.Info())
+	logger.Info("Build context", "build_context", prom_version.BuildContext())
+
+	var state *stateStore
+	if config.State.File != "" {
+		if state, err = loadState(config.State.File); err != nil {
+			logger.Error("Can't load the state file", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// Service stop requests share the shutdown path of SIGTERM
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	if service {
+		serviceDone := runService(term)
+		defer serviceDone()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exporter := newExporter(ctx, state, config.Metrics)
+	if config.Backend == backendMock {
+		logger.Info("Using the mock backend, the results are not measured")
+		exporter.mock = newMockBackend(config.Mock)
+		exporter.newClient = exporter.mock.newClient
+	}
+	if exporter.outputs, err = openOutputs(config, exporter); err != nil {
+		logger.Error("Can't open the outputs", "err", err)
+		os.Exit(1)
+	}
+	if exporter.tracer, err = newTracer(config); err != nil {
+		logger.Error("Can't set up tracing", "err", err)
+		os.Exit(1)
+	}
+	manager, err := newConfigManager(os.Args[1:], config, exporter)
 	if err != nil {
-		log.Errorf("Can't create exporter : %s", err)
+		logger.Error("Can't create exporter", "err", err)
 		os.Exit(1)
 	}
-	log.Infoln("Register exporter")
-	prometheus.MustRegister(exporter)
+	manager.logLevel = logLevel
+	logger.Info("Register exporter")
+	targets := newTargetRunner(manager, config.Metrics)
+	manager.targets = targets
+	registry := newRegistry(config, manager, targets)
+	go exporter.run()
+	for _, link := range manager.links {
+		go link.run()
+	}
+	// The first backend tests the others in turn
+	if len(manager.backends) > 0 {
+		go manager.backends[0].run()
+	}
+	go targets.run(ctx)
 
-	http.Handle(*metricsPath, prometheus.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>Speedtest Exporter</title></head>
-             <body>
-             <h1>Speedtest Exporter</h1>
-             <p><a href='` + *metricsPath + `'>Metrics</a></p>
-             </body>
-             </html>`))
-	})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := manager.reload(); err != nil {
+				logger.Error("Error reloading configuration", "err", err)
+			}
+		}
+	}()
 
-	log.Infoln("Listening on", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
-}
+	if config.ConfigURL != "" && config.ConfigRefresh > 0 {
+		go func() {
+			ticker := time.NewTicker(config.ConfigRefresh)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := manager.reload(); err != nil {
+					logger.Error("Error refreshing configuration", "url", config.ConfigURL, "err", err)
+				}
+			}
+		}()
+	}
 
-// checkIP gets the current external IP address.
-// From: https://www.reddit.com/r/golang/comments/3l71g4/help_function_to_return_the_users_external_ip/cv3pj7r/
-func checkIP() (string, error) {
-	rsp, err := http.Get("http://checkip.amazonaws.com")
+	if config.Web.EnablePprof && config.Web.PprofListenAddress != "" {
+		go func() {
+			logger.Info("Serving pprof", "address", config.Web.PprofListenAddress)
+			mux := http.NewServeMux()
+			registerPprof(mux)
+			if err := http.ListenAndServe(config.Web.PprofListenAddress, mux); err != nil {
+				logger.Error("Error serving pprof", "err", err)
+			}
+		}()
+	}
+
+	listener, err := listen(config.Web.ListenAddress, config.Web.SocketMode)
 	if err != nil {
-		return "", err
+		logger.Error("Can't listen", "address", config.Web.ListenAddress, "err", err)
+		os.Exit(1)
 	}
-	defer rsp.Body.Close()
+	go manager.initClient()
+	go notifySystemd(ctx, manager)
+	server := &http.Server{
+		Handler:     newRouter(config, manager, registry),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	err = serve(server, listener, config.Web.ConfigFile, term, cancel, state, exporter.outputs)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := exporter.tracer.shutdown(shutdownCtx); err != nil {
+		logger.Warn("Can't export the pending traces", "err", err)
+	}
+	if err != nil {
+		logger.Error("Error serving HTTP", "err", err)
+		os.Exit(1)
+	}
+}
 
-	buf, err := ioutil.ReadAll(rsp.Body)
+// serve runs the HTTP server until a signal is received on stop. TLS and
+// authentication are set up from the exporter-toolkit web configuration
+// file, if any. The server is then shut down: in-flight tests are canceled,
+// the responses they produce are given shutdownTimeout to complete, and the
+// outputs and the state are flushed.
+func serve(server *http.Server, listener net.Listener, webConfigFile string, stop <-chan os.Signal, cancel context.CancelFunc, state *stateStore, outputs *outputs) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- web.Serve(listener, server, &web.FlagConfig{WebConfigFile: &webConfigFile}, slog.Default())
+	}()
+
+	select {
+	case err := <-errc:
+		cancel()
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	case sig := <-stop:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+	if err := sdNotify("STOPPING=1"); err != nil {
+		slog.Warn("Can't notify systemd", "err", err)
+	}
+
+	cancel()
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down the HTTP server", "err", err)
+	}
+	outputs.close(ctx)
+	if err := state.flush(); err != nil {
+		return fmt.Errorf("Can't write the state file: %s", err)
+	}
+	return nil
+}
+
+// loadAuth builds the test server credentials. Secrets are read from files
+// so they don't show up in the process list.
+func loadAuth(config AuthConfig) (*speedtest.Auth, error) {
+	if config.Username == "" && config.PasswordFile == "" && config.BearerTokenFile == "" {
+		return nil, nil
+	}
+	auth := &speedtest.Auth{
+		Username: config.Username,
+	}
+	if config.PasswordFile != "" {
+		password, err := readSecretFile(config.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.Password = password
+	}
+	if config.BearerTokenFile != "" {
+		token, err := readSecretFile(config.BearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.BearerToken = token
+	}
+	return auth, nil
+}
+
+func readSecretFile(filename string) (string, error) {
+	buf, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return "", err
 	}
-
-	return string(bytes.TrimSpace(buf)), nil
+	return strings.TrimRight(string(buf), "\r\n"), nil
 }
@@ -13,3 +13,1219 @@
 // limitations under the License.
 
 package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/nlamirault/speedtest_exporter/internal/speedtestfake"
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// gather returns the metrics of the collectors in the text format
+func gather(t *testing.T, collectors ...prometheus.Collector) string {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors...)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(&buf, family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+func TestScheduledTests(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	client, err := speedtest.NewClient(fake.URL+"/config.php", fake.URL+"/servers.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exporter := newExporter(ctx, nil, defaultConfig().Metrics)
+	exporter.SetClient(liveClient{client})
+	exporter.SetInterval(time.Hour)
+	go exporter.run()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, tested := exporter.Status(); tested {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The scheduled test didn't run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fake.reset()
+
+	metrics := gather(t, exporter)
+	if !strings.Contains(metrics, "speedtest_download{") {
+		t.Errorf("Expected the scheduled test result, got:\n%s", metrics)
+	}
+	if !strings.Contains(metrics, `speedtest_tests_total{trigger="startup"} 1`) {
+		t.Errorf("Expected the first scheduled test to count as startup test, got:\n%s", metrics)
+	}
+	if last, _ := exporter.Last(); last.Trigger != triggerStartup {
+		t.Errorf("Expected the startup trigger, got %q", last.Trigger)
+	}
+	if fake.requested("/near/") {
+		t.Error("Scrapes must not run a test when tests are scheduled")
+	}
+}
+
+func TestSplitSchedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exporter := newExporter(ctx, nil, defaultConfig().Metrics)
+	client := &fakeClient{
+		server: speedtest.Server{ID: "1234"},
+		measurements: map[string]speedtest.Measurement{
+			speedtest.PhasePing:     {Value: 12.5},
+			speedtest.PhaseDownload: {Value: 93.5},
+			speedtest.PhaseUpload:   {Value: 38.2},
+		},
+	}
+	exporter.SetClient(client)
+	exporter.SetPingInterval(10 * time.Millisecond)
+	exporter.SetInterval(time.Hour)
+	go exporter.run()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(client.requested()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("The latency tests didn't run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The full test comes first, against the same server as the latency
+	// tests following it
+	runs := client.requested()
+	if len(runs[0]) != 0 {
+		t.Errorf("Expected a full test first, got the phases %v", runs[0])
+	}
+	for _, phases := range runs[1:] {
+		if !slices.Equal(phases, []string{speedtest.PhasePing}) {
+			t.Errorf("Expected latency tests until the next full test, got the phases %v", phases)
+		}
+	}
+
+	last, next := exporter.Last()
+	if last.Trigger != triggerStartup || last.Download == nil || last.Ping == nil || last.LatencyRunID == "" || !last.LatencyFinishedAt.After(last.FinishedAt) {
+		t.Errorf("Expected the full test with the latency of the last latency test, got %+v", last)
+	}
+	if time.Until(next) > time.Second {
+		t.Errorf("Expected the next latency test to be due shortly, got %s", next)
+	}
+	metrics := gather(t, exporter)
+	for _, sample := range []string{
+		`speedtest_download{ip="unknown"} 93.5`,
+		`speedtest_ping{ip="unknown"} 12.5`,
+		`speedtest_last_test_timestamp_seconds{test="bandwidth"}`,
+		`speedtest_last_test_timestamp_seconds{test="latency"}`,
+		`speedtest_tests_total{trigger="startup"} 1`,
+		`speedtest_tests_total{trigger="ping"}`,
+	} {
+		if !strings.Contains(metrics, sample) {
+			t.Errorf("Expected %s, got:\n%s", sample, metrics)
+		}
+	}
+}
+
+func TestCreateClientShutdown(t *testing.T) {
+	fake := speedtestfake.New(speedtestfake.Options{})
+	defer fake.Close()
+	fake.Inject(speedtestfake.Config, speedtestfake.Fault{Hang: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exporter := newExporter(ctx, nil, defaultConfig().Metrics)
+	config := defaultConfig().Speedtest
+	config.ConfigURL, config.ServerURL = fake.ConfigURL(), fake.ServersURL()
+	// The shutdown aborts the retrieval of the configuration, rather than
+	// waiting for the fetch timeout
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := exporter.createClient(&config, speedtest.Options{}); err == nil {
+		t.Fatal("Expected an error creating the client on shutdown")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the shutdown to abort the client creation, took %s", elapsed)
+	}
+}
+
+func TestCreateClientDeadline(t *testing.T) {
+	fake := speedtestfake.New(speedtestfake.Options{})
+	defer fake.Close()
+	fake.Inject(speedtestfake.Config, speedtestfake.Fault{Hang: true})
+
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	config := defaultConfig().Speedtest
+	// Three hanging mirrors share the init timeout rather than getting
+	// the fetch timeout each
+	config.ConfigURL = strings.Join([]string{fake.ConfigURL(), fake.ConfigURL(), fake.ConfigURL()}, ",")
+	config.ServerURL = fake.ServersURL()
+	config.FetchTimeout, config.InitTimeout = 10*time.Second, 600*time.Millisecond
+	start := time.Now()
+	if _, err := exporter.createClient(&config, speedtest.Options{FetchTimeout: config.FetchTimeout}); err == nil {
+		t.Fatal("Expected an error creating the client from hanging mirrors")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the client creation to stay within the init timeout, took %s", elapsed)
+	}
+	if requests := fake.Requests(speedtestfake.Config); requests != 3 {
+		t.Errorf("Expected each mirror to be tried, got %d requests", requests)
+	}
+}
+
+func TestRequestRetries(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	var opts speedtest.Options
+	exporter.newClient = func(ctx context.Context, config *SpeedtestConfig, o speedtest.Options) (speedtestClient, error) {
+		opts = o
+		return &fakeClient{}, nil
+	}
+	client, err := exporter.createClient(&SpeedtestConfig{}, speedtest.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.SetClient(client)
+	exporter.SetInterval(time.Hour)
+	opts.OnRetry(speedtest.PhaseUpload, fmt.Errorf("connection reset by peer"))
+	if metrics := gather(t, exporter); !strings.Contains(metrics, `speedtest_request_retries_total{phase="upload"} 1`) {
+		t.Errorf("Expected the retried upload request, got:\n%s", metrics)
+	}
+
+	for _, status := range []int{200, 204, 503, 0} {
+		opts.OnRequest(speedtest.PhaseDownload, status)
+	}
+	metrics := gather(t, exporter)
+	for _, line := range []string{
+		`speedtest_http_requests_total{code="2xx",phase="download"} 2`,
+		`speedtest_http_requests_total{code="5xx",phase="download"} 1`,
+		`speedtest_http_requests_total{code="error",phase="download"} 1`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %s, got:\n%s", line, metrics)
+		}
+	}
+
+	opts.OnEncodedResponse(speedtest.PhaseDownload, "gzip")
+	if metrics := gather(t, exporter); !strings.Contains(metrics, `speedtest_encoded_responses_total{encoding="gzip",phase="download"} 1`) {
+		t.Errorf("Expected the encoded response, got:\n%s", metrics)
+	}
+
+	opts.OnParseWarning(speedtest.DocumentServers, `server "4321" without url skipped`)
+	if metrics := gather(t, exporter); !strings.Contains(metrics, `speedtest_config_parse_warnings_total{document="servers"} 1`) {
+		t.Errorf("Expected the parse warning, got:\n%s", metrics)
+	}
+}
+
+// fakeClient is a speedtestClient returning scripted results. A blocking
+// one never completes its tests, until they are canceled.
+type fakeClient struct {
+	server       speedtest.Server
+	info         *speedtest.ClientInfo
+	measurements map[string]speedtest.Measurement
+	err          error
+	block        bool
+	// servers are the servers returned by Servers, probed the probe
+	// argument of its last call
+	servers []speedtest.ServerStatus
+	probed  bool
+	// hops is the hop count of the results, duplex whether they are
+	// duplex
+	hops   int
+	duplex bool
+	// shareURL and shareErr are the outcome of the submission of the
+	// results
+	shareURL string
+	shareErr error
+	// parameters are the transfer settings reported in the results
+	parameters speedtest.TransferParameters
+	// soakReports are reported in turn by the soak tests, every interval,
+	// soaks counting the soak tests started
+	soakReports []speedtest.SoakReport
+	soaks       atomic.Int32
+	// runs are the phases requested by each test
+	mu   sync.Mutex
+	runs [][]string
+}
+
+func (c *fakeClient) TestServer() speedtest.Server {
+	return c.server
+}
+
+func (c *fakeClient) ClientInfo() *speedtest.ClientInfo {
+	return c.info
+}
+
+func (c *fakeClient) FetchClientInfo(ctx context.Context) (*speedtest.ClientInfo, error) {
+	return c.info, nil
+}
+
+func (c *fakeClient) Servers(ctx context.Context, probe bool) []speedtest.ServerStatus {
+	c.probed = probe
+	return c.servers
+}
+
+func (c *fakeClient) Soak(ctx context.Context, opts speedtest.SoakOptions, report func(speedtest.SoakReport)) error {
+	c.soaks.Add(1)
+	for _, r := range c.soakReports {
+		select {
+		case <-time.After(opts.Interval):
+			report(r)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (c *fakeClient) Run(ctx context.Context, phases ...string) (*speedtest.Result, error) {
+	if c.block {
+		<-ctx.Done()
+		return &speedtest.Result{Server: c.server}, &speedtest.PhaseError{Phase: speedtest.PhaseDownload, Err: ctx.Err()}
+	}
+	c.mu.Lock()
+	c.runs = append(c.runs, phases)
+	c.mu.Unlock()
+	now := time.Now()
+	measurements := c.measurements
+	if len(phases) > 0 {
+		measurements = map[string]speedtest.Measurement{}
+		for _, phase := range phases {
+			if m, ok := c.measurements[phase]; ok {
+				measurements[phase] = m
+			}
+		}
+	}
+	succeeded := map[string]bool{}
+	for phase := range measurements {
+		succeeded[phase] = true
+	}
+	if pe, ok := c.err.(*speedtest.PhaseError); ok {
+		succeeded[pe.Phase] = false
+	}
+	return &speedtest.Result{Server: c.server, StartedAt: now, FinishedAt: now, Hops: c.hops, Duplex: c.duplex, ShareURL: c.shareURL, ShareErr: c.shareErr, Phases: measurements, Succeeded: succeeded, Parameters: c.parameters,
+		BytesDown: measurements[speedtest.PhaseDownload].Bytes, BytesUp: measurements[speedtest.PhaseUpload].Bytes}, c.err
+}
+
+// requested returns the phases requested by each test so far
+func (c *fakeClient) requested() [][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.runs)
+}
+
+func TestCollect(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		client   speedtestClient
+		expected string
+	}{
+		{
+			name: "no client",
+			expected: `
+# HELP speedtest_external_ip_changes_total Number of changes of the external IP address.
+# TYPE speedtest_external_ip_changes_total counter
+speedtest_external_ip_changes_total 0
+# HELP speedtest_share_failures_total Number of successful test results whose submission to speedtest.net failed.
+# TYPE speedtest_share_failures_total counter
+speedtest_share_failures_total 0
+# HELP speedtest_queue_timeouts_total Number of tests not run as they waited too long for the running ones to finish.
+# TYPE speedtest_queue_timeouts_total counter
+speedtest_queue_timeouts_total 0
+# HELP speedtest_queued_tests Number of tests waiting for the running ones to finish.
+# TYPE speedtest_queued_tests gauge
+speedtest_queued_tests 0
+`,
+		},
+		{
+			name: "success",
+			client: &fakeClient{
+				server: speedtest.Server{ID: "1234", Name: "Berlin"},
+				measurements: map[string]speedtest.Measurement{
+					speedtest.PhasePing:     {Value: 12.5},
+					speedtest.PhaseDownload: {Value: 93.5, Streams: 4, Bytes: 125000000},
+					speedtest.PhaseUpload:   {Value: 38.2, Streams: 2, RateLimit: 40, Bytes: 50000000},
+				},
+			},
+			expected: `
+# HELP speedtest_download Download bandwidth (Mbps).
+# TYPE speedtest_download gauge
+speedtest_download{ip="unknown"} 93.5
+# HELP speedtest_external_ip_changes_total Number of changes of the external IP address.
+# TYPE speedtest_external_ip_changes_total counter
+speedtest_external_ip_changes_total 0
+# HELP speedtest_result_info The identifier of the test the result metrics of the scrape all come from, and the URL of its result image on speedtest.net, when shared.
+# TYPE speedtest_result_info gauge
+speedtest_result_info{ip="unknown",run_id="3f2a9c1e7b5d4086",share_url=""} 1
+# HELP speedtest_share_failures_total Number of successful test results whose submission to speedtest.net failed.
+# TYPE speedtest_share_failures_total counter
+speedtest_share_failures_total 0
+# HELP speedtest_queue_timeouts_total Number of tests not run as they waited too long for the running ones to finish.
+# TYPE speedtest_queue_timeouts_total counter
+speedtest_queue_timeouts_total 0
+# HELP speedtest_queued_tests Number of tests waiting for the running ones to finish.
+# TYPE speedtest_queued_tests gauge
+speedtest_queued_tests 0
+# HELP speedtest_phase_success Whether each phase of the last test succeeded, by phase. The phases following a failed one are not run.
+# TYPE speedtest_phase_success gauge
+speedtest_phase_success{ip="unknown",phase="download"} 1
+speedtest_phase_success{ip="unknown",phase="ping"} 1
+speedtest_phase_success{ip="unknown",phase="upload"} 1
+# HELP speedtest_ping Latency (ms)
+# TYPE speedtest_ping gauge
+speedtest_ping{ip="unknown"} 12.5
+# HELP speedtest_rate_limited Whether the bandwidth was constrained by the rate limit of the exporter rather than the network, by phase.
+# TYPE speedtest_rate_limited gauge
+speedtest_rate_limited{ip="unknown",phase="upload"} 0
+# HELP speedtest_tests_total Number of Speedtest tests run, by trigger.
+# TYPE speedtest_tests_total counter
+speedtest_tests_total{trigger="scrape"} 1
+# HELP speedtest_transfer_streams Number of parallel connections that transferred data, by phase.
+# TYPE speedtest_transfer_streams gauge
+speedtest_transfer_streams{ip="unknown",phase="download"} 4
+speedtest_transfer_streams{ip="unknown",phase="upload"} 2
+# HELP speedtest_transferred_bytes_total Bytes transferred by the successful download and upload phases, by phase.
+# TYPE speedtest_transferred_bytes_total counter
+speedtest_transferred_bytes_total{phase="download"} 1.25e+08
+speedtest_transferred_bytes_total{phase="upload"} 5e+07
+# HELP speedtest_upload Upload bandwidth (Mbps).
+# TYPE speedtest_upload gauge
+speedtest_upload{ip="unknown"} 38.2
+`,
+		},
+		{
+			name: "failed upload",
+			client: &fakeClient{
+				server: speedtest.Server{ID: "1234", Name: "Berlin"},
+				measurements: map[string]speedtest.Measurement{
+					speedtest.PhaseDownload: {Value: 93.5, Streams: 1, Bytes: 125000000},
+				},
+				err: &speedtest.PhaseError{Phase: speedtest.PhaseUpload, Err: &speedtest.HTTPError{URL: "http://example.com/upload.php", StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}},
+			},
+			expected: `
+# HELP speedtest_download Download bandwidth (Mbps).
+# TYPE speedtest_download gauge
+speedtest_download{ip="unknown"} 93.5
+# HELP speedtest_errors_total Number of failed Speedtest tests, by phase and error type.
+# TYPE speedtest_errors_total counter
+speedtest_errors_total{phase="upload",type="overloaded"} 1
+# HELP speedtest_external_ip_changes_total Number of changes of the external IP address.
+# TYPE speedtest_external_ip_changes_total counter
+speedtest_external_ip_changes_total 0
+# HELP speedtest_result_info The identifier of the test the result metrics of the scrape all come from, and the URL of its result image on speedtest.net, when shared.
+# TYPE speedtest_result_info gauge
+speedtest_result_info{ip="unknown",run_id="3f2a9c1e7b5d4086",share_url=""} 1
+# HELP speedtest_share_failures_total Number of successful test results whose submission to speedtest.net failed.
+# TYPE speedtest_share_failures_total counter
+speedtest_share_failures_total 0
+# HELP speedtest_queue_timeouts_total Number of tests not run as they waited too long for the running ones to finish.
+# TYPE speedtest_queue_timeouts_total counter
+speedtest_queue_timeouts_total 0
+# HELP speedtest_queued_tests Number of tests waiting for the running ones to finish.
+# TYPE speedtest_queued_tests gauge
+speedtest_queued_tests 0
+# HELP speedtest_phase_success Whether each phase of the last test succeeded, by phase. The phases following a failed one are not run.
+# TYPE speedtest_phase_success gauge
+speedtest_phase_success{ip="unknown",phase="download"} 1
+speedtest_phase_success{ip="unknown",phase="upload"} 0
+# HELP speedtest_tests_total Number of Speedtest tests run, by trigger.
+# TYPE speedtest_tests_total counter
+speedtest_tests_total{trigger="scrape"} 1
+# HELP speedtest_transfer_streams Number of parallel connections that transferred data, by phase.
+# TYPE speedtest_transfer_streams gauge
+speedtest_transfer_streams{ip="unknown",phase="download"} 1
+# HELP speedtest_transferred_bytes_total Bytes transferred by the successful download and upload phases, by phase.
+# TYPE speedtest_transferred_bytes_total counter
+speedtest_transferred_bytes_total{phase="download"} 1.25e+08
+`,
+		},
+		{
+			name: "failed setup",
+			client: &fakeClient{
+				err: errors.New("boom"),
+			},
+			expected: `
+# HELP speedtest_errors_total Number of failed Speedtest tests, by phase and error type.
+# TYPE speedtest_errors_total counter
+speedtest_errors_total{phase="unknown",type="other"} 1
+# HELP speedtest_external_ip_changes_total Number of changes of the external IP address.
+# TYPE speedtest_external_ip_changes_total counter
+speedtest_external_ip_changes_total 0
+# HELP speedtest_result_info The identifier of the test the result metrics of the scrape all come from, and the URL of its result image on speedtest.net, when shared.
+# TYPE speedtest_result_info gauge
+speedtest_result_info{ip="unknown",run_id="3f2a9c1e7b5d4086",share_url=""} 1
+# HELP speedtest_share_failures_total Number of successful test results whose submission to speedtest.net failed.
+# TYPE speedtest_share_failures_total counter
+speedtest_share_failures_total 0
+# HELP speedtest_queue_timeouts_total Number of tests not run as they waited too long for the running ones to finish.
+# TYPE speedtest_queue_timeouts_total counter
+speedtest_queue_timeouts_total 0
+# HELP speedtest_queued_tests Number of tests waiting for the running ones to finish.
+# TYPE speedtest_queued_tests gauge
+speedtest_queued_tests 0
+# HELP speedtest_tests_total Number of Speedtest tests run, by trigger.
+# TYPE speedtest_tests_total counter
+speedtest_tests_total{trigger="scrape"} 1
+`,
+		},
+	} {
+		exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+		exporter.newRunID = func() string { return "3f2a9c1e7b5d4086" }
+		exporter.SetClient(tc.client)
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(tc.expected)); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
+
+// sequenceClient runs tests whose values are their sequence number, every
+// third test failing its upload phase
+type sequenceClient struct {
+	fakeClient
+	runs atomic.Int64
+}
+
+func (c *sequenceClient) Run(ctx context.Context, phases ...string) (*speedtest.Result, error) {
+	n := c.runs.Add(1)
+	now := time.Now()
+	result := &speedtest.Result{
+		StartedAt:  now.Add(-time.Duration(n) * time.Millisecond),
+		FinishedAt: now,
+		Phases: map[string]speedtest.Measurement{
+			speedtest.PhasePing:     {Value: float64(n)},
+			speedtest.PhaseDownload: {Value: float64(n)},
+		},
+		Succeeded: map[string]bool{speedtest.PhasePing: true, speedtest.PhaseDownload: true, speedtest.PhaseUpload: true},
+	}
+	if n%3 == 0 {
+		result.Succeeded[speedtest.PhaseUpload] = false
+		return result, &speedtest.PhaseError{Phase: speedtest.PhaseUpload, Err: errors.New("connection reset")}
+	}
+	result.Phases[speedtest.PhaseUpload] = speedtest.Measurement{Value: float64(n)}
+	return result, nil
+}
+
+func TestCollectConsistency(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	var ids atomic.Int64
+	exporter.newRunID = func() string { return strconv.FormatInt(ids.Add(1), 10) }
+	client := &sequenceClient{}
+	exporter.SetClient(client)
+	exporter.SetInterval(time.Hour)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+
+	// scrape checks that the metrics of a scrape all come from the run of
+	// its result_info
+	scrape := func() error {
+		families, err := registry.Gather()
+		if err != nil {
+			return err
+		}
+		values := map[string]float64{}
+		var runID string
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				labels := map[string]string{}
+				for _, label := range m.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				switch name := family.GetName(); {
+				case name == "speedtest_ping" || name == "speedtest_download" || name == "speedtest_upload":
+					values[name] = m.GetGauge().GetValue()
+				case name == "speedtest_phase_success" && labels["phase"] == speedtest.PhaseUpload:
+					values["upload_success"] = m.GetGauge().GetValue()
+				case name == "speedtest_result_info":
+					runID = labels["run_id"]
+				}
+			}
+		}
+		if runID == "" {
+			return nil
+		}
+		n, _ := strconv.ParseFloat(runID, 64)
+		upload, uploaded := values["speedtest_upload"]
+		if values["speedtest_ping"] != n || values["speedtest_download"] != n || (uploaded && upload != n) ||
+			uploaded != (values["upload_success"] == 1) || uploaded == (int(n)%3 == 0) {
+			return fmt.Errorf("expected the metrics of run %s, got %v", runID, values)
+		}
+		return nil
+	}
+
+	done := make(chan struct{})
+	var scrapes atomic.Int64
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := scrape(); err != nil {
+					t.Error(err)
+					return
+				}
+				scrapes.Add(1)
+			}
+		}()
+	}
+	for range 2000 {
+		exporter.test(context.Background(), client, triggerSchedule)
+	}
+	close(done)
+	wg.Wait()
+	if last, _ := exporter.Last(); last.RunID != "2000" {
+		t.Errorf("Expected the last result to be run 2000, got %q", last.RunID)
+	}
+	t.Logf("%d consistent scrapes", scrapes.Load())
+}
+
+func TestCollectServerLabels(t *testing.T) {
+	metrics := defaultConfig().Metrics
+	metrics.ServerLabels = true
+	exporter := newExporter(context.Background(), nil, metrics)
+	exporter.SetClient(&fakeClient{
+		server: speedtest.Server{ID: "1234", Name: "Berlin"},
+		measurements: map[string]speedtest.Measurement{
+			speedtest.PhasePing:     {Value: 12.5},
+			speedtest.PhaseDownload: {Value: 93.5, Streams: 4},
+		},
+	})
+	expected := `
+# HELP speedtest_download Download bandwidth (Mbps).
+# TYPE speedtest_download gauge
+speedtest_download{ip="unknown",server_id="1234",server_name="Berlin"} 93.5
+# HELP speedtest_transfer_streams Number of parallel connections that transferred data, by phase.
+# TYPE speedtest_transfer_streams gauge
+speedtest_transfer_streams{ip="unknown",phase="download",server_id="1234",server_name="Berlin"} 4
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "speedtest_download", "speedtest_transfer_streams"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectHops(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetClient(&fakeClient{
+		server:       speedtest.Server{ID: "1234"},
+		measurements: map[string]speedtest.Measurement{speedtest.PhasePing: {Value: 12.5}},
+		hops:         9,
+	})
+	expected := `
+# HELP speedtest_server_hops Number of hops to the test server, counted with TCP connections of increasing TTL.
+# TYPE speedtest_server_hops gauge
+speedtest_server_hops{ip="unknown"} 9
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "speedtest_server_hops"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectShare(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.newRunID = func() string { return "3f2a9c1e7b5d4086" }
+	exporter.SetClient(&fakeClient{
+		server:       speedtest.Server{ID: "1234"},
+		measurements: map[string]speedtest.Measurement{speedtest.PhasePing: {Value: 12.5}},
+		shareURL:     "https://www.speedtest.net/result/1234567890.png",
+	})
+	expected := `
+# HELP speedtest_result_info The identifier of the test the result metrics of the scrape all come from, and the URL of its result image on speedtest.net, when shared.
+# TYPE speedtest_result_info gauge
+speedtest_result_info{ip="unknown",run_id="3f2a9c1e7b5d4086",share_url="https://www.speedtest.net/result/1234567890.png"} 1
+# HELP speedtest_share_failures_total Number of successful test results whose submission to speedtest.net failed.
+# TYPE speedtest_share_failures_total counter
+speedtest_share_failures_total 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "speedtest_result_info", "speedtest_share_failures_total"); err != nil {
+		t.Error(err)
+	}
+	if last, _ := exporter.Last(); last.ShareURL != "https://www.speedtest.net/result/1234567890.png" {
+		t.Errorf("Expected the share URL in the result, got %q", last.ShareURL)
+	}
+
+	// A failed submission doesn't fail the test
+	exporter.SetClient(&fakeClient{
+		server:       speedtest.Server{ID: "1234"},
+		measurements: map[string]speedtest.Measurement{speedtest.PhasePing: {Value: 12.5}},
+		shareErr:     fmt.Errorf("No result ID in the answer"),
+	})
+	expected = `
+# HELP speedtest_result_info The identifier of the test the result metrics of the scrape all come from, and the URL of its result image on speedtest.net, when shared.
+# TYPE speedtest_result_info gauge
+speedtest_result_info{ip="unknown",run_id="3f2a9c1e7b5d4086",share_url=""} 1
+# HELP speedtest_share_failures_total Number of successful test results whose submission to speedtest.net failed.
+# TYPE speedtest_share_failures_total counter
+speedtest_share_failures_total 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "speedtest_result_info", "speedtest_share_failures_total"); err != nil {
+		t.Error(err)
+	}
+	if last, _ := exporter.Last(); last.Error != "" {
+		t.Errorf("Expected a successful test, got %q", last.Error)
+	}
+}
+
+func TestCollectParameters(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetClient(&fakeClient{
+		server:       speedtest.Server{ID: "1234"},
+		measurements: map[string]speedtest.Measurement{speedtest.PhasePing: {Value: 12.5}},
+		parameters: speedtest.TransferParameters{
+			DownloadStreams:  8,
+			UploadStreams:    4,
+			DownloadDuration: 10 * time.Second,
+			UploadDuration:   15 * time.Second,
+			UploadSizes:      []int{524288, 1048576, 524288, 1048576},
+			UploadPayload:    speedtest.UploadPayloadRandom,
+		},
+	})
+	expected := `
+# HELP speedtest_test_parameters_info Settings of the transfer phases in force for the test: streams, durations in seconds (0 when each payload is requested once), number, largest size in bytes and content (random or zero) of the upload payloads.
+# TYPE speedtest_test_parameters_info gauge
+speedtest_test_parameters_info{download_duration="10",download_streams="8",ip="unknown",upload_duration="15",upload_max_payload="1048576",upload_payload="random",upload_payloads="4",upload_streams="4"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "speedtest_test_parameters_info"); err != nil {
+		t.Error(err)
+	}
+	if last, _ := exporter.Last(); last.Parameters == nil || last.Parameters.UploadMaxPayloadBytes != 1048576 {
+		t.Errorf("Expected the parameters in the result, got %+v", last.Parameters)
+	}
+
+	// Clients that don't report their parameters have no info metric
+	exporter.SetClient(&fakeClient{
+		server:       speedtest.Server{ID: "1234"},
+		measurements: map[string]speedtest.Measurement{speedtest.PhasePing: {Value: 12.5}},
+	})
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(""), "speedtest_test_parameters_info"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectLocations(t *testing.T) {
+	names := []string{"speedtest_server_latitude", "speedtest_server_longitude", "speedtest_client_latitude", "speedtest_client_longitude"}
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetClient(&fakeClient{
+		server:       speedtest.Server{ID: "1234", Lat: 48.8567, Lon: 2.3508},
+		info:         &speedtest.ClientInfo{IP: "203.0.113.7", Lat: 45.75, Lon: 4.85},
+		measurements: map[string]speedtest.Measurement{speedtest.PhasePing: {Value: 12.5}},
+	})
+	expected := `
+# HELP speedtest_client_latitude Latitude of the client, from the Speedtest configuration unless overridden (degrees).
+# TYPE speedtest_client_latitude gauge
+speedtest_client_latitude{ip="203.0.113.7"} 45.75
+# HELP speedtest_client_longitude Longitude of the client, from the Speedtest configuration unless overridden (degrees).
+# TYPE speedtest_client_longitude gauge
+speedtest_client_longitude{ip="203.0.113.7"} 4.85
+# HELP speedtest_server_latitude Latitude of the test server, from the server list (degrees).
+# TYPE speedtest_server_latitude gauge
+speedtest_server_latitude{ip="203.0.113.7"} 48.8567
+# HELP speedtest_server_longitude Longitude of the test server, from the server list (degrees).
+# TYPE speedtest_server_longitude gauge
+speedtest_server_longitude{ip="203.0.113.7"} 2.3508
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+
+	// The unknown coordinates, such as those of Speedtest Mini servers,
+	// are omitted
+	exporter.SetClient(&fakeClient{
+		server:       speedtest.Server{URL: "http://mini.example.com/mini/"},
+		measurements: map[string]speedtest.Measurement{speedtest.PhasePing: {Value: 12.5}},
+	})
+	if n := testutil.CollectAndCount(exporter, names...); n != 0 {
+		t.Errorf("Expected no coordinates, got %d metrics", n)
+	}
+}
+
+func TestCollectInterface(t *testing.T) {
+	names := []string{"speedtest_transfer_bytes", "speedtest_interface_rx_bytes", "speedtest_interface_tx_bytes"}
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetClient(&fakeClient{
+		measurements: map[string]speedtest.Measurement{
+			speedtest.PhaseDownload: {Value: 93.5, Bytes: 125000000, Interface: &speedtest.InterfaceBytes{Rx: 131250000, Tx: 2100000}},
+			speedtest.PhaseUpload:   {Value: 38.2, Bytes: 50000000},
+		},
+	})
+	expected := `
+# HELP speedtest_interface_rx_bytes Bytes received by the verified interface during the phase.
+# TYPE speedtest_interface_rx_bytes gauge
+speedtest_interface_rx_bytes{ip="unknown",phase="download"} 1.3125e+08
+# HELP speedtest_interface_tx_bytes Bytes transmitted by the verified interface during the phase.
+# TYPE speedtest_interface_tx_bytes gauge
+speedtest_interface_tx_bytes{ip="unknown",phase="download"} 2.1e+06
+# HELP speedtest_transfer_bytes Bytes transferred by the phase, excluding protocol overhead, exported along with the interface counters.
+# TYPE speedtest_transfer_bytes gauge
+speedtest_transfer_bytes{ip="unknown",phase="download"} 1.25e+08
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+	if last, _ := exporter.Last(); last.Download.Interface == nil || last.Download.Interface.RxBytes != 131250000 || last.Upload.Interface != nil {
+		t.Errorf("Unexpected interface traffic %+v and %+v", last.Download.Interface, last.Upload.Interface)
+	}
+}
+
+func TestCollectCPU(t *testing.T) {
+	names := []string{"speedtest_cpu_utilization_ratio", "speedtest_exporter_cpu_utilization_ratio", "speedtest_cpu_limited"}
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetClient(&fakeClient{
+		measurements: map[string]speedtest.Measurement{
+			speedtest.PhaseDownload: {Value: 93.5, CPU: &speedtest.CPUUsage{System: 0.97, Process: 0.85, Limited: true}},
+			speedtest.PhaseUpload:   {Value: 38.2, CPU: &speedtest.CPUUsage{System: 0.4, Process: 0.3}},
+			speedtest.PhasePing:     {Value: 12.5},
+		},
+	})
+	expected := `
+# HELP speedtest_cpu_limited Whether the CPU utilization stayed above the threshold for most of the phase, its bandwidth being likely bounded by the CPU.
+# TYPE speedtest_cpu_limited gauge
+speedtest_cpu_limited{ip="unknown",phase="download"} 1
+speedtest_cpu_limited{ip="unknown",phase="upload"} 0
+# HELP speedtest_cpu_utilization_ratio Busy share of the CPUs of the host during the phase.
+# TYPE speedtest_cpu_utilization_ratio gauge
+speedtest_cpu_utilization_ratio{ip="unknown",phase="download"} 0.97
+speedtest_cpu_utilization_ratio{ip="unknown",phase="upload"} 0.4
+# HELP speedtest_exporter_cpu_utilization_ratio Share of the CPUs of the host used by the exporter during the phase.
+# TYPE speedtest_exporter_cpu_utilization_ratio gauge
+speedtest_exporter_cpu_utilization_ratio{ip="unknown",phase="download"} 0.85
+speedtest_exporter_cpu_utilization_ratio{ip="unknown",phase="upload"} 0.3
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+
+	// The usage is absent when not sampled
+	exporter.SetClient(&fakeClient{
+		measurements: map[string]speedtest.Measurement{speedtest.PhaseDownload: {Value: 93.5}},
+	})
+	if n := testutil.CollectAndCount(exporter, names...); n != 0 {
+		t.Errorf("Expected no CPU usage, got %d metrics", n)
+	}
+}
+
+func TestCollectCache(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetClient(&fakeClient{
+		measurements: map[string]speedtest.Measurement{
+			speedtest.PhaseDownload: {Value: 2500, CacheChecked: true, CacheSuspected: true, CacheReason: "Age: 3600"},
+			speedtest.PhasePing:     {Value: 12.5},
+		},
+	})
+	expected := `
+# HELP speedtest_cached_result_suspected Whether the responses of the download phase seemed served by a transparent cache, from their headers or content.
+# TYPE speedtest_cached_result_suspected gauge
+speedtest_cached_result_suspected{ip="unknown"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "speedtest_cached_result_suspected"); err != nil {
+		t.Error(err)
+	}
+	if last, _ := exporter.Last(); last.Download == nil || last.Download.Cache == nil || last.Download.Cache.Reason != "Age: 3600" {
+		t.Errorf("Expected the cache reason in the result, got %+v", last.Download)
+	}
+
+	// The metric is absent when not checked
+	exporter.SetClient(&fakeClient{
+		measurements: map[string]speedtest.Measurement{speedtest.PhaseDownload: {Value: 93.5}},
+	})
+	if n := testutil.CollectAndCount(exporter, "speedtest_cached_result_suspected"); n != 0 {
+		t.Errorf("Expected no cache metric, got %d metrics", n)
+	}
+}
+
+func TestCollectStreams(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetClient(&fakeClient{
+		measurements: map[string]speedtest.Measurement{
+			speedtest.PhaseDownload: {Value: 100, Streams: 2, PerStream: []speedtest.StreamMeasurement{
+				{Value: 87.5, Bytes: 109375000},
+				{Value: 12.5, Bytes: 15625000, Errors: 1},
+			}},
+			speedtest.PhaseUpload: {Value: 8.25, Streams: 1, PerStream: []speedtest.StreamMeasurement{
+				{Value: 8.25, Bytes: 10312500},
+				{Bytes: 1024, Errors: 2, Failed: true},
+			}},
+		},
+	})
+	expected := `
+# HELP speedtest_stream_errors Number of failed requests of each stream of the transfer phases with parallel streams, retried or not, by direction and stream number.
+# TYPE speedtest_stream_errors gauge
+speedtest_stream_errors{direction="download",ip="unknown",stream="0"} 0
+speedtest_stream_errors{direction="download",ip="unknown",stream="1"} 1
+speedtest_stream_errors{direction="upload",ip="unknown",stream="0"} 0
+speedtest_stream_errors{direction="upload",ip="unknown",stream="1"} 2
+# HELP speedtest_stream_throughput_bits_per_second Bandwidth of each stream of the transfer phases with parallel streams (bps), 0 for the streams which failed, by direction and stream number.
+# TYPE speedtest_stream_throughput_bits_per_second gauge
+speedtest_stream_throughput_bits_per_second{direction="download",ip="unknown",stream="0"} 8.75e+07
+speedtest_stream_throughput_bits_per_second{direction="download",ip="unknown",stream="1"} 1.25e+07
+speedtest_stream_throughput_bits_per_second{direction="upload",ip="unknown",stream="0"} 8.25e+06
+speedtest_stream_throughput_bits_per_second{direction="upload",ip="unknown",stream="1"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "speedtest_stream_throughput_bits_per_second", "speedtest_stream_errors"); err != nil {
+		t.Error(err)
+	}
+	if last, _ := exporter.Last(); last.Upload == nil || len(last.Upload.PerStream) != 2 || !last.Upload.PerStream[1].Failed {
+		t.Errorf("Expected the streams in the result, got %+v", last.Upload)
+	}
+
+	// A single stream is the phase itself
+	exporter.SetClient(&fakeClient{
+		measurements: map[string]speedtest.Measurement{
+			speedtest.PhaseDownload: {Value: 93.5, Streams: 1, PerStream: []speedtest.StreamMeasurement{{Value: 93.5}}},
+		},
+	})
+	if n := testutil.CollectAndCount(exporter, "speedtest_stream_throughput_bits_per_second", "speedtest_stream_errors"); n != 0 {
+		t.Errorf("Expected no stream metrics, got %d metrics", n)
+	}
+}
+
+func TestCollectConnection(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetClient(&fakeClient{
+		measurements: map[string]speedtest.Measurement{
+			speedtest.PhaseDownload: {Value: 93.5, Connection: &speedtest.ConnectionInfo{HTTPVersion: "2", TLSVersion: "1.3", Family: "ipv6"}},
+			speedtest.PhaseUpload:   {Value: 8.25, Connection: &speedtest.ConnectionInfo{HTTPVersion: "1.1", TLSVersion: "1.2", Family: "ipv4"}},
+		},
+	})
+	expected := `
+# HELP speedtest_connection_info Connections of the test, from the first one of the download phase, or else of the upload phase: HTTP version (1.1, 2 or 3), TLS version (none over cleartext) and address family of the server.
+# TYPE speedtest_connection_info gauge
+speedtest_connection_info{http_version="2",ip="unknown",remote_addr_family="ipv6",tls_version="1.3"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "speedtest_connection_info"); err != nil {
+		t.Error(err)
+	}
+
+	// The upload connection describes the tests without download, and the
+	// previous series is gone
+	exporter.SetClient(&fakeClient{
+		measurements: map[string]speedtest.Measurement{
+			speedtest.PhaseUpload: {Value: 8.25, Connection: &speedtest.ConnectionInfo{HTTPVersion: "1.1", TLSVersion: "none", Family: "ipv4"}},
+		},
+	})
+	expected = `
+# HELP speedtest_connection_info Connections of the test, from the first one of the download phase, or else of the upload phase: HTTP version (1.1, 2 or 3), TLS version (none over cleartext) and address family of the server.
+# TYPE speedtest_connection_info gauge
+speedtest_connection_info{http_version="1.1",ip="unknown",remote_addr_family="ipv4",tls_version="none"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "speedtest_connection_info"); err != nil {
+		t.Error(err)
+	}
+	if last, _ := exporter.Last(); last.Connection == nil || last.Connection.TLSVersion != "none" {
+		t.Errorf("Expected the connection in the result, got %+v", last.Connection)
+	}
+}
+
+func TestCollectDuplex(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetClient(&fakeClient{
+		measurements: map[string]speedtest.Measurement{
+			speedtest.PhaseDownload: {Value: 93.5},
+			speedtest.PhaseUpload:   {Value: 8.25},
+		},
+		duplex: true,
+	})
+	expected := `
+# HELP speedtest_duplex_download Download bandwidth (Mbps), measured while uploading.
+# TYPE speedtest_duplex_download gauge
+speedtest_duplex_download{ip="unknown"} 93.5
+# HELP speedtest_duplex_upload Upload bandwidth (Mbps), measured while downloading.
+# TYPE speedtest_duplex_upload gauge
+speedtest_duplex_upload{ip="unknown"} 8.25
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "speedtest_download", "speedtest_upload", "speedtest_duplex_download", "speedtest_duplex_upload"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectLine(t *testing.T) {
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	exporter.SetLine(LineConfig{Download: 1000 * 1000 * 1000, Upload: 50 * 1000 * 1000})
+	names := []string{"speedtest_provisioned_download_bits_per_second", "speedtest_provisioned_upload_bits_per_second", "speedtest_download_ratio", "speedtest_upload_ratio"}
+	expected := `
+# HELP speedtest_provisioned_download_bits_per_second Subscribed download rate of the line (bps).
+# TYPE speedtest_provisioned_download_bits_per_second gauge
+speedtest_provisioned_download_bits_per_second 1e+09
+# HELP speedtest_provisioned_upload_bits_per_second Subscribed upload rate of the line (bps).
+# TYPE speedtest_provisioned_upload_bits_per_second gauge
+speedtest_provisioned_upload_bits_per_second 5e+07
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), names...); err != nil {
+		t.Errorf("Expected the provisioned rates before the first test: %v", err)
+	}
+
+	// The upload failed, and has no ratio
+	exporter.SetClient(&fakeClient{
+		measurements: map[string]speedtest.Measurement{speedtest.PhaseDownload: {Value: 700}},
+		err:          &speedtest.PhaseError{Phase: speedtest.PhaseUpload, Err: errors.New("boom")},
+	})
+	expected += `
+# HELP speedtest_download_ratio Ratio of the download bandwidth to the subscribed download rate.
+# TYPE speedtest_download_ratio gauge
+speedtest_download_ratio{ip="unknown"} 0.7
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), names...); err != nil {
+		t.Errorf("Expected the download ratio only: %v", err)
+	}
+
+	exporter.SetLine(LineConfig{Upload: 50 * 1000 * 1000})
+	expected = `
+# HELP speedtest_provisioned_upload_bits_per_second Subscribed upload rate of the line (bps).
+# TYPE speedtest_provisioned_upload_bits_per_second gauge
+speedtest_provisioned_upload_bits_per_second 5e+07
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), names...); err != nil {
+		t.Errorf("Expected no download metric without provisioned rate: %v", err)
+	}
+}
+
+func TestScrapeCanceled(t *testing.T) {
+	config := defaultConfig()
+	exporter := newExporter(context.Background(), nil, config.Metrics)
+	exporter.SetClient(&fakeClient{server: speedtest.Server{ID: "1234"}, block: true})
+	handler := scrapeHandler(config, exporter, prometheus.NewRegistry())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil).WithContext(ctx))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the test to be aborted with the scrape")
+	}
+	if metrics := gather(t, exporter.errors); !strings.Contains(metrics, `speedtest_errors_total{phase="download",type="timeout"} 1`) {
+		t.Errorf("Expected the aborted test to be counted, got:\n%s", metrics)
+	}
+
+	// The tests run on scrape are aborted on shutdown too
+	shutdown, stop := context.WithCancel(context.Background())
+	exporter = newExporter(shutdown, nil, config.Metrics)
+	exporter.SetClient(&fakeClient{block: true})
+	handler = scrapeHandler(config, exporter, prometheus.NewRegistry())
+	done = make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+		close(done)
+	}()
+	stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the test to be aborted on shutdown")
+	}
+}
+
+// writeWebConfig writes a self-signed certificate for 127.0.0.1 and a web
+// configuration file enabling TLS and basic authentication of the user
+// "prometheus" with the password "secret".
+func writeWebConfig(t *testing.T, dir string) (string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "speedtest_exporter"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"cert.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"key.pem":  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		"web.yml": []byte(fmt.Sprintf(`
+tls_server_config:
+  cert_file: %s
+  key_file: %s
+basic_auth_users:
+  prometheus: %s
+`, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), hash)),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "web.yml"), pool
+}
+
+func TestServeTLSAndBasicAuth(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	webConfigFile, pool := writeWebConfig(t, dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "ok")
+		}),
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(server, listener, webConfigFile, stop, func() {}, nil, nil)
+	}()
+	defer func() {
+		stop <- os.Interrupt
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+	url := "https://" + listener.Addr().String() + "/metrics"
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	get := func(user, password string) int {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("prometheus", "secret"); code != http.StatusOK {
+		t.Errorf("Expected status 200 with valid credentials, got %d", code)
+	}
+	if code := get("", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without credentials, got %d", code)
+	}
+	if code := get("prometheus", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 with a wrong password, got %d", code)
+	}
+
+	untrusted := &http.Client{Transport: &http.Transport{}}
+	if _, err := untrusted.Get(url); err == nil {
+		t.Error("Expected the TLS handshake to fail without the server certificate")
+	}
+	resp, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Error("Expected plain HTTP requests to be rejected")
+		}
+	}
+}
+
+func TestInvalidWebConfig(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	webConfigFile := filepath.Join(dir, "web.yml")
+	if err := ioutil.WriteFile(webConfigFile, []byte("tls_server_config:\n  cert_file: missing.pem\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := parseTestConfig("--web.config.file", webConfigFile)
+	if err == nil || !strings.Contains(err.Error(), "web.config_file") {
+		t.Errorf("Expected an invalid web configuration error, got %v", err)
+	}
+}
+
+func TestAnomalyRetest(t *testing.T) {
+	metrics := defaultConfig().Metrics
+	metrics.Window = 5
+	metrics.AnomalyThreshold = 50
+	exporter := newExporter(context.Background(), nil, metrics)
+	client := &fakeClient{measurements: map[string]speedtest.Measurement{speedtest.PhaseDownload: {Value: 100}}}
+	for range minAnomalySamples {
+		exporter.test(context.Background(), client, triggerSchedule)
+	}
+	client.measurements[speedtest.PhaseDownload] = speedtest.Measurement{Value: 10}
+	if result := exporter.test(context.Background(), client, triggerSchedule); !result.Anomalous {
+		t.Fatal("Expected an anomalous result")
+	}
+	client.measurements[speedtest.PhaseDownload] = speedtest.Measurement{Value: 95}
+	exporter.confirm(client)
+	last, _ := exporter.Last()
+	if last.Trigger != triggerRetest || last.Anomalous {
+		t.Errorf("Expected a normal confirmation test, got %+v", last)
+	}
+	client.measurements[speedtest.PhaseDownload] = speedtest.Measurement{Value: 10}
+	exporter.confirm(client)
+	expected := `
+# HELP speedtest_anomaly_retests_total Number of confirmation tests run after anomalous scheduled tests, by result: reproduced, not_reproduced or failed.
+# TYPE speedtest_anomaly_retests_total counter
+speedtest_anomaly_retests_total{result="not_reproduced"} 1
+speedtest_anomaly_retests_total{result="reproduced"} 1
+`
+	if err := testutil.CollectAndCompare(scrapeCollector{exporter, context.Background()}, strings.NewReader(expected), "speedtest_anomaly_retests_total"); err != nil {
+		t.Error(err)
+	}
+}
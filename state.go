@@ -0,0 +1,153 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// State is the exporter state persisted across restarts
+type State struct {
+	LastResult *Result `json:"last_result,omitempty"`
+	// LastIP is the last external IP address observed
+	LastIP string `json:"last_ip,omitempty"`
+	// Window holds the recent tests of the window aggregates
+	Window []windowSample `json:"window,omitempty"`
+	// Targets are the targets added through the targets API
+	Targets []Target `json:"targets,omitempty"`
+}
+
+// stateStore holds the state in memory and writes it to the state file on
+// flush. A nil stateStore discards the state.
+type stateStore struct {
+	filename string
+
+	mu    sync.Mutex
+	state State
+}
+
+// loadState reads the state file, if it exists.
+func loadState(filename string) (*stateStore, error) {
+	store := &stateStore{filename: filename}
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &store.state); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *stateStore) setLastResult(result *Result) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.LastResult = result
+}
+
+func (s *stateStore) setLastIP(ip string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.LastIP = ip
+}
+
+// lastIP returns the last external IP address observed, empty if none
+func (s *stateStore) lastIP() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.LastIP
+}
+
+func (s *stateStore) setWindow(samples []windowSample) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Window = samples
+}
+
+// window returns the recent tests of the window aggregates, if any
+func (s *stateStore) window() []windowSample {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Window
+}
+
+func (s *stateStore) setTargets(targets []Target) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Targets = targets
+}
+
+// targets returns the targets added through the targets API, if any
+func (s *stateStore) targets() []Target {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Targets
+}
+
+// flush writes the state file. The file is replaced atomically, so it is
+// never left half written.
+func (s *stateStore) flush() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	buf, err := json.MarshalIndent(&s.state, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.filename)
+}
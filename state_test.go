@@ -0,0 +1,116 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+func TestShutdownDuringTest(t *testing.T) {
+	fake := newFakeSpeedtest()
+	fake.uploadStarted = make(chan struct{})
+	defer fake.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	filename := filepath.Join(dir, "state.json")
+
+	client, err := speedtest.NewClient(fake.URL+"/config.php", fake.URL+"/servers.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := openResultsLog(ResultsConfig{File: filepath.Join(dir, "results.jsonl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	exporter := newExporter(ctx, state, defaultConfig().Metrics)
+	exporter.outputs = &outputs{results: results}
+	exporter.SetClient(liveClient{client})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:     promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(server, listener, "", stop, cancel, state, exporter.outputs)
+	}()
+	go http.Get("http://" + listener.Addr().String() + "/metrics")
+
+	select {
+	case <-fake.uploadStarted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The test didn't reach the upload phase")
+	}
+	stop <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(shutdownTimeout + 5*time.Second):
+		t.Fatal("The exporter didn't shut down")
+	}
+
+	saved, err := loadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := saved.state.LastResult
+	if result == nil {
+		t.Fatal("Expected the last result in the state file")
+	}
+	if result.Download == nil {
+		t.Error("Expected the download result in the state file")
+	}
+	if result.Upload != nil {
+		t.Errorf("Expected no upload result in the state file, got %+v", result.Upload)
+	}
+	if result.Error == "" {
+		t.Error("Expected the interrupted test error in the state file")
+	}
+
+	logged, err := os.ReadFile(filepath.Join(dir, "results.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(logged), "\n"), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"error":`) {
+		t.Errorf("Expected the interrupted test in the results file, got %q", logged)
+	}
+}
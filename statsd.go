@@ -0,0 +1,293 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The formats of the tags of the StatsD and Graphite metrics
+const (
+	statsdTagsNone     = "none"
+	statsdTagsDatadog  = "datadog"
+	statsdTagsGraphite = "graphite"
+)
+
+var (
+	// statsdPlaceholderRE matches the placeholders of the metric path
+	// templates, such as {metric}
+	statsdPlaceholderRE = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+	// statsdInvalidRE matches the characters replaced in the values of
+	// the path placeholders and of the tags
+	statsdInvalidRE = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+// statsdPlaceholders are the placeholders of the metric path templates,
+// besides the constant labels
+var statsdPlaceholders = []string{"metric", "server_id", "backend", "ip", "link"}
+
+// statsdMetric is a value of a result, in base units
+type statsdMetric struct {
+	name  string
+	value float64
+}
+
+// statsdMetrics returns the values of result: the bandwidths in bits per
+// second, the latencies in seconds and the bytes transferred
+func statsdMetrics(result *Result) []statsdMetric {
+	var metrics []statsdMetric
+	if result.Download != nil {
+		metrics = append(metrics,
+			statsdMetric{"download_bps", result.Download.Value * 1e6},
+			statsdMetric{"download_bytes", float64(result.Download.Bytes)})
+	}
+	if result.Upload != nil {
+		metrics = append(metrics,
+			statsdMetric{"upload_bps", result.Upload.Value * 1e6},
+			statsdMetric{"upload_bytes", float64(result.Upload.Bytes)})
+	}
+	if result.Ping != nil {
+		metrics = append(metrics, statsdMetric{"ping_seconds", result.Ping.Value / 1000})
+		if len(result.Ping.Samples) > 1 {
+			metrics = append(metrics, statsdMetric{"jitter_seconds", result.Ping.Jitter / 1000})
+		}
+	}
+	success := 0.0
+	if result.Error == "" {
+		success = 1
+	}
+	return append(metrics, statsdMetric{"success", success})
+}
+
+// statsdEncoder names the metrics of the results after the path template,
+// and tags them in tagFormat
+type statsdEncoder struct {
+	template  string
+	tagFormat string
+	labels    labelMap
+}
+
+func newStatsDEncoder(config *Config) *statsdEncoder {
+	return &statsdEncoder{
+		template:  config.StatsD.Template,
+		tagFormat: config.StatsD.TagFormat,
+		labels:    config.Metrics.Labels,
+	}
+}
+
+// values returns the values of the placeholders and tags of result
+func (e *statsdEncoder) values(result *Result) map[string]string {
+	values := map[string]string{"ip": result.IP, "backend": result.Backend, "link": result.Link}
+	for name, value := range e.labels {
+		values[name] = value
+	}
+	for name, value := range result.Labels {
+		values[name] = value
+	}
+	if result.Server != nil {
+		values["server_id"] = result.Server.ID
+	}
+	return values
+}
+
+// path returns the path of metric
+func (e *statsdEncoder) path(metric string, values map[string]string) string {
+	return statsdPlaceholderRE.ReplaceAllStringFunc(e.template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		if name == "metric" {
+			return metric
+		}
+		if values[name] == "" {
+			return "unknown"
+		}
+		return statsdInvalidRE.ReplaceAllString(values[name], "_")
+	})
+}
+
+// tags returns the tags of the metrics of result in format: the constant
+// labels, those of the link, the server ID, the backend and the link
+func (e *statsdEncoder) tags(result *Result, values map[string]string, format string) string {
+	if format == statsdTagsNone {
+		return ""
+	}
+	names := make([]string, 0, len(e.labels)+len(result.Labels)+3)
+	for name := range e.labels {
+		names = append(names, name)
+	}
+	for name := range result.Labels {
+		names = append(names, name)
+	}
+	names = append(names, "server_id", "backend", "link")
+	sort.Strings(names)
+	var tags []string
+	for _, name := range names {
+		if value := values[name]; value != "" {
+			value = statsdInvalidRE.ReplaceAllString(value, "_")
+			if format == statsdTagsDatadog {
+				tags = append(tags, name+":"+value)
+			} else {
+				tags = append(tags, name+"="+value)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	if format == statsdTagsDatadog {
+		return "|#" + strings.Join(tags, ",")
+	}
+	return ";" + strings.Join(tags, ";")
+}
+
+// statsdLines returns the StatsD gauges of result
+func (e *statsdEncoder) statsdLines(result *Result) []string {
+	values := e.values(result)
+	tags := e.tags(result, values, e.tagFormat)
+	var lines []string
+	for _, m := range statsdMetrics(result) {
+		value := strconv.FormatFloat(m.value, 'f', -1, 64)
+		if e.tagFormat == statsdTagsDatadog {
+			lines = append(lines, e.path(m.name, values)+":"+value+"|g"+tags)
+		} else {
+			lines = append(lines, e.path(m.name, values)+tags+":"+value+"|g")
+		}
+	}
+	return lines
+}
+
+// graphiteLines returns the Graphite plaintext lines of result, whose tags
+// are always in the graphite format
+func (e *statsdEncoder) graphiteLines(result *Result) []string {
+	values := e.values(result)
+	format := statsdTagsNone
+	if e.tagFormat != statsdTagsNone {
+		format = statsdTagsGraphite
+	}
+	tags := e.tags(result, values, format)
+	timestamp := strconv.FormatInt(result.FinishedAt.Unix(), 10)
+	var lines []string
+	for _, m := range statsdMetrics(result) {
+		lines = append(lines, e.path(m.name, values)+tags+" "+strconv.FormatFloat(m.value, 'f', -1, 64)+" "+timestamp)
+	}
+	return lines
+}
+
+// statsdWriter sends the results to a StatsD server over UDP, in a single
+// datagram
+type statsdWriter struct {
+	encoder *statsdEncoder
+	address string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (w *statsdWriter) write(ctx context.Context, result *Result) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "udp", w.address)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+	if _, err := w.conn.Write([]byte(strings.Join(w.encoder.statsdLines(result), "\n"))); err != nil {
+		// The address is resolved again on the next write
+		w.conn.Close()
+		w.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (w *statsdWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.Close()
+}
+
+// graphiteWriter sends the results to a Graphite plaintext listener, over
+// a TCP connection per result
+type graphiteWriter struct {
+	encoder *statsdEncoder
+	address string
+}
+
+func (w *graphiteWriter) write(ctx context.Context, result *Result) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", w.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(sinkTimeout))
+	}
+	_, err = conn.Write([]byte(strings.Join(w.encoder.graphiteLines(result), "\n") + "\n"))
+	return err
+}
+
+// newStatsDSinks returns the StatsD and Graphite sinks of the
+// configuration, by name
+func newStatsDSinks(config *Config) map[string]resultSink {
+	sinks := map[string]resultSink{}
+	encoder := newStatsDEncoder(config)
+	if config.StatsD.Address != "" {
+		sinks["statsd"] = &statsdWriter{encoder: encoder, address: config.StatsD.Address}
+	}
+	if config.StatsD.GraphiteAddress != "" {
+		sinks["graphite"] = &graphiteWriter{encoder: encoder, address: config.StatsD.GraphiteAddress}
+	}
+	return sinks
+}
+
+// validateTemplate checks the placeholders of a metric path template are
+// known
+func validateTemplate(template string, labels labelMap) error {
+	if template == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	if !strings.Contains(template, "{metric}") {
+		return fmt.Errorf("must contain the {metric} placeholder")
+	}
+	for _, match := range statsdPlaceholderRE.FindAllStringSubmatch(template, -1) {
+		name := match[1]
+		if _, ok := labels[name]; ok {
+			continue
+		}
+		known := false
+		for _, placeholder := range statsdPlaceholders {
+			known = known || placeholder == name
+		}
+		if !known {
+			return fmt.Errorf("unknown placeholder {%s}, expected {%s} or a constant label", name, strings.Join(statsdPlaceholders, "}, {"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var statsdTestResult = &Result{
+	FinishedAt: time.Unix(1700000000, 0),
+	IP:         "192.0.2.1",
+	Backend:    "speedtest",
+	Server:     &ResultServer{ID: "1234"},
+	Download:   &PhaseResult{Value: 93.5, Bytes: 120000000},
+	Ping:       &PhaseResult{Value: 12.5, Samples: []float64{12.5, 13}, Jitter: 0.5},
+}
+
+func TestStatsDLines(t *testing.T) {
+	config := defaultConfig()
+	config.Metrics.Labels = labelMap{"site": "home.office"}
+	config.StatsD.Template = "speedtest.{site}.{metric}"
+
+	for _, tc := range []struct {
+		format   string
+		expected []string
+	}{
+		{statsdTagsNone, []string{
+			"speedtest.home_office.download_bps:93500000|g",
+			"speedtest.home_office.download_bytes:120000000|g",
+			"speedtest.home_office.ping_seconds:0.0125|g",
+			"speedtest.home_office.jitter_seconds:0.0005|g",
+			"speedtest.home_office.success:1|g",
+		}},
+		{statsdTagsDatadog, []string{
+			"speedtest.home_office.download_bps:93500000|g|#backend:speedtest,server_id:1234,site:home_office",
+			"speedtest.home_office.download_bytes:120000000|g|#backend:speedtest,server_id:1234,site:home_office",
+			"speedtest.home_office.ping_seconds:0.0125|g|#backend:speedtest,server_id:1234,site:home_office",
+			"speedtest.home_office.jitter_seconds:0.0005|g|#backend:speedtest,server_id:1234,site:home_office",
+			"speedtest.home_office.success:1|g|#backend:speedtest,server_id:1234,site:home_office",
+		}},
+		{statsdTagsGraphite, []string{
+			"speedtest.home_office.download_bps;backend=speedtest;server_id=1234;site=home_office:93500000|g",
+			"speedtest.home_office.download_bytes;backend=speedtest;server_id=1234;site=home_office:120000000|g",
+			"speedtest.home_office.ping_seconds;backend=speedtest;server_id=1234;site=home_office:0.0125|g",
+			"speedtest.home_office.jitter_seconds;backend=speedtest;server_id=1234;site=home_office:0.0005|g",
+			"speedtest.home_office.success;backend=speedtest;server_id=1234;site=home_office:1|g",
+		}},
+	} {
+		config.StatsD.TagFormat = tc.format
+		lines := newStatsDEncoder(config).statsdLines(statsdTestResult)
+		if strings.Join(lines, "\n") != strings.Join(tc.expected, "\n") {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tc.format, strings.Join(tc.expected, "\n"), strings.Join(lines, "\n"))
+		}
+	}
+
+	config.StatsD.Template = "net.{server_id}.{ip}.{metric}"
+	config.StatsD.TagFormat = statsdTagsNone
+	lines := newStatsDEncoder(config).graphiteLines(&Result{FinishedAt: time.Unix(1700000000, 0), IP: "192.0.2.1", Error: "timeout"})
+	if expected := "net.unknown.192_0_2_1.success 0 1700000000"; strings.Join(lines, "\n") != expected {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}
+
+func TestStatsDWriter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	config := defaultConfig()
+	config.StatsD.Address = conn.LocalAddr().String()
+	sink := newStatsDSinks(config)["statsd"]
+	if err := sink.write(context.Background(), statsdTestResult); err != nil {
+		t.Fatal(err)
+	}
+	defer sink.(*statsdWriter).Close()
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join(newStatsDEncoder(config).statsdLines(statsdTestResult), "\n")
+	if string(buf[:n]) != expected {
+		t.Errorf("Expected the datagram\n%s\ngot\n%s", expected, buf[:n])
+	}
+}
+
+func TestGraphiteWriter(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	config := defaultConfig()
+	config.StatsD.GraphiteAddress = listener.Addr().String()
+	config.StatsD.TagFormat = statsdTagsDatadog
+	sink := newStatsDSinks(config)["graphite"]
+	if err := sink.write(context.Background(), statsdTestResult); err != nil {
+		t.Fatal(err)
+	}
+	lines := <-received
+	if len(lines) != 5 || lines[0] != "speedtest.download_bps;backend=speedtest;server_id=1234 93500000 1700000000" {
+		t.Errorf("Unexpected lines %q", lines)
+	}
+
+	// An unavailable listener fails the write, to be retried
+	listener.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sink.write(ctx, statsdTestResult); err == nil {
+		t.Error("Expected an error with the listener closed")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// readyPollInterval is the interval readiness is checked at before
+// notifying systemd
+const readyPollInterval = time.Second
+
+// sdNotify sends a state notification, such as READY=1, to systemd. It does
+// nothing unless the exporter is run by a Type=notify systemd service.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract socket names start with a NUL byte
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the timeout of the systemd watchdog of the
+// exporter, zero when disabled
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifySystemd notifies systemd once the exporter is ready, then pings the
+// systemd watchdog, if enabled, as long as no test is stuck. It returns
+// when ctx is done, and immediately when not run by systemd.
+func notifySystemd(ctx context.Context, manager *configManager) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	ticker := time.NewTicker(readyPollInterval)
+	for manager.ready() != nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			ticker.Stop()
+			return
+		}
+	}
+	ticker.Stop()
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("Can't notify systemd", "err", err)
+	}
+
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker = time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if !manager.healthy() {
+			slog.Warn("A test is stuck, not pinging the systemd watchdog")
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			slog.Warn("Can't ping the systemd watchdog", "err", err)
+		}
+	}
+}
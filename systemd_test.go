@@ -0,0 +1,92 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotifySystemd(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defer setEnv(t, map[string]string{"NOTIFY_SOCKET": socket, "WATCHDOG_USEC": "20000"})()
+
+	config := defaultConfig()
+	config.Probe.Only = true
+	exporter := newExporter(context.Background(), nil, defaultConfig().Metrics)
+	manager, err := newConfigManager(nil, config, exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifySystemd(ctx, manager)
+
+	read := func() string {
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	if state := read(); state != "READY=1" {
+		t.Errorf("Expected READY=1, got %q", state)
+	}
+	if state := read(); state != "WATCHDOG=1" {
+		t.Errorf("Expected WATCHDOG=1, got %q", state)
+	}
+
+	// A stuck test stops the watchdog pings
+	exporter.mu.Lock()
+	exporter.testStarted = time.Now().Add(-maxTestDuration)
+	exporter.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	for {
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Errorf("Expected no watchdog ping while a test is stuck, got %d bytes", n)
+	}
+
+	if err := sdNotify("STOPPING=1"); err != nil {
+		t.Fatal(err)
+	}
+	if state := read(); state != "STOPPING=1" {
+		t.Errorf("Expected STOPPING=1, got %q", state)
+	}
+}
+
+func TestNotifySystemdUnset(t *testing.T) {
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("Expected no error without NOTIFY_SOCKET, got %v", err)
+	}
+}
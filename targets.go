@@ -0,0 +1,725 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// targetsCheckInterval is the interval the targets file is checked for
+// changes at
+const targetsCheckInterval = 10 * time.Second
+
+// Target is a test server listed in the targets file
+type Target struct {
+	// Name, if set, identifies the target in the targets API. It is
+	// required by the targets added through the API.
+	Name     string `yaml:"name"`
+	ServerID string `yaml:"server_id"`
+	// Backend is either "speedtest" or "mini", defaulting to the backend of
+	// the module
+	Backend string `yaml:"backend"`
+	// Module, if set, is the probe module the tests are run with
+	Module string `yaml:"module"`
+	// Labels are attached to the metrics of the target
+	Labels map[string]string `yaml:"labels"`
+	// Interval, if set, is the interval between the tests of the target,
+	// instead of the schedule interval
+	Interval time.Duration `yaml:"interval"`
+}
+
+// targetJSON is the JSON form of a Target, used by the targets API and the
+// state file, whose interval is a duration string as in the targets file
+type targetJSON struct {
+	Name     string            `json:"name,omitempty"`
+	ServerID string            `json:"server_id,omitempty"`
+	Backend  string            `json:"backend,omitempty"`
+	Module   string            `json:"module,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Interval string            `json:"interval,omitempty"`
+	// Source is where the target comes from, file or api, in the
+	// responses of the targets API. It is ignored on input.
+	Source string `json:"source,omitempty"`
+}
+
+func (t Target) toJSON() targetJSON {
+	j := targetJSON{Name: t.Name, ServerID: t.ServerID, Backend: t.Backend, Module: t.Module, Labels: t.Labels}
+	if t.Interval != 0 {
+		j.Interval = t.Interval.String()
+	}
+	return j
+}
+
+func (j targetJSON) target() (Target, error) {
+	t := Target{Name: j.Name, ServerID: j.ServerID, Backend: j.Backend, Module: j.Module, Labels: j.Labels}
+	if j.Interval != "" {
+		interval, err := time.ParseDuration(j.Interval)
+		if err != nil {
+			return Target{}, fmt.Errorf("invalid interval: %s", err)
+		}
+		t.Interval = interval
+	}
+	return t, nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (t Target) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.toJSON())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *Target) UnmarshalJSON(buf []byte) error {
+	var j targetJSON
+	if err := json.Unmarshal(buf, &j); err != nil {
+		return err
+	}
+	target, err := j.target()
+	if err != nil {
+		return err
+	}
+	*t = target
+	return nil
+}
+
+// TargetsConfig is the content of the targets file
+type TargetsConfig struct {
+	Targets []Target `yaml:"targets"`
+}
+
+// key identifies the target in the results, and in its series: the
+// targets of distinct keys have distinct target, backend or module labels
+func (t Target) key() string {
+	backend := t.Backend
+	if backend == "" {
+		backend = "speedtest"
+	}
+	return backend + "/" + t.ServerID + "/" + t.Module
+}
+
+// loadTargets reads and validates the targets file, whose labels must not
+// collide with the constant labels
+func loadTargets(filename string, constant labelMap) ([]Target, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &TargetsConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("Can't parse %s: %s", filename, err)
+	}
+	for i, target := range config.Targets {
+		if err := target.validate(constant); err != nil {
+			return nil, fmt.Errorf("Invalid target %d of %s: %s", i+1, filename, err)
+		}
+		if duplicate(config.Targets[:i], target) {
+			return nil, fmt.Errorf("Duplicate target %d of %s", i+1, filename)
+		}
+	}
+	return config.Targets, nil
+}
+
+// duplicate returns whether target has the key or the name of one of
+// targets
+func duplicate(targets []Target, target Target) bool {
+	return slices.ContainsFunc(targets, func(t Target) bool {
+		return t.key() == target.key() || (target.Name != "" && t.Name == target.Name)
+	})
+}
+
+func (t Target) validate(constant labelMap) error {
+	switch t.Backend {
+	case "", "speedtest":
+		if t.ServerID == "" {
+			return fmt.Errorf("missing server_id")
+		}
+	case "mini":
+		if t.ServerID != "" {
+			return fmt.Errorf("server selection is not supported by the mini backend")
+		}
+	default:
+		return fmt.Errorf("unknown backend %q", t.Backend)
+	}
+	if t.Interval < 0 {
+		return fmt.Errorf("negative interval")
+	}
+	if err := validateLabels(t.Labels); err != nil {
+		return err
+	}
+	for _, name := range targetLabels {
+		if _, ok := t.Labels[name]; ok {
+			return fmt.Errorf("label %q is already set by the exporter", name)
+		}
+	}
+	return validateLabelCollisions(t.Labels, constant)
+}
+
+// interval returns the interval between the tests of the target, that of
+// the schedule unless set
+func (t Target) interval(schedule time.Duration) time.Duration {
+	if t.Interval > 0 {
+		return t.Interval
+	}
+	return schedule
+}
+
+// targetLabels are the labels of the target metrics, before the labels of
+// the targets. The ip label, which can be disabled, comes last.
+var targetLabels = []string{"target", "backend", "module", "ip"}
+
+// targetRunner runs scheduled tests against the targets of the targets
+// file, which is checked for changes every targetsCheckInterval. Each
+// target is tested at its own interval, the tests being staggered: with N
+// targets sharing an interval, the i-th one is tested i/N of the way
+// through it, so they don't interfere with each other. The tests of the
+// targets due at once run in parallel, up to the limit of the exporter's
+// limiter. It exposes the last result and the next test time of each
+// target.
+type targetRunner struct {
+	manager *configManager
+	metrics MetricsConfig
+
+	// filename, modified and size identify the loaded targets file
+	filename string
+	modified time.Time
+	size     int64
+
+	mu sync.RWMutex
+	// targets are the targets of the file followed by those of the API,
+	// less those the file now lists too
+	targets []Target
+	file    []Target
+	api     []Target
+	results map[string]*Result
+	// succeeded is the completion time of the last successful test of
+	// each target
+	succeeded map[string]time.Time
+	// anchor is the start of the first interval, the slots of the targets
+	// being offset from it
+	anchor time.Time
+	// next is the time of the next test of each target, computed for the
+	// targets of order at the intervals staggered
+	next      map[string]time.Time
+	order     []string
+	staggered []time.Duration
+	// running is set for the targets being tested, which skip their slots
+	// meanwhile
+	running map[string]bool
+	wg      sync.WaitGroup
+}
+
+// newTargetRunner returns a targetRunner testing the targets file of the
+// active configuration and the targets of the API saved to the state file.
+// The metrics are named and labeled according to metrics.
+func newTargetRunner(manager *configManager, metrics MetricsConfig) *targetRunner {
+	r := &targetRunner{
+		manager:   manager,
+		metrics:   metrics,
+		results:   map[string]*Result{},
+		succeeded: map[string]time.Time{},
+		running:   map[string]bool{},
+	}
+	for _, target := range manager.exporter.state.targets() {
+		// The labels of the exporter may have changed since
+		if err := target.validate(metrics.Labels); err != nil || target.Name == "" || duplicate(r.api, target) {
+			slog.Error("Dropping an invalid target of the state file", "target", target.Name, "err", err)
+			continue
+		}
+		r.api = append(r.api, target)
+	}
+	r.combine()
+	return r
+}
+
+// run runs the tests until ctx is done, then waits for the running ones
+func (r *targetRunner) run(ctx context.Context) {
+	defer r.wg.Wait()
+	for {
+		r.update()
+		r.testDue(ctx)
+		timer := time.NewTimer(r.untilNext(time.Now()))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// untilNext returns the time until the next test is due, at most
+// targetsCheckInterval so the targets file changes are noticed
+func (r *targetRunner) untilNext(now time.Time) time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	wait := targetsCheckInterval
+	for _, next := range r.next {
+		wait = min(wait, max(next.Sub(now), 0))
+	}
+	return wait
+}
+
+// update reloads the targets file if it changed. On error, the previous
+// targets are kept.
+func (r *targetRunner) update() {
+	filename := r.manager.current().Probe.TargetsFile
+	if filename == "" {
+		r.setTargets("", time.Time{}, 0, nil)
+		return
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		slog.Error("Can't read the targets file, keeping the previous targets", "file", filename, "err", err)
+		return
+	}
+	if filename == r.filename && info.ModTime().Equal(r.modified) && info.Size() == r.size {
+		return
+	}
+	targets, err := loadTargets(filename, r.metrics.Labels)
+	if err != nil {
+		slog.Error("Can't load the targets file, keeping the previous targets", "file", filename, "err", err)
+		return
+	}
+	slog.Info("Targets loaded", "file", filename, "targets", len(targets))
+	r.setTargets(filename, info.ModTime(), info.Size(), targets)
+}
+
+// setTargets replaces the targets, dropping the results of the removed ones
+func (r *targetRunner) setTargets(filename string, modified time.Time, size int64, targets []Target) {
+	r.filename, r.modified, r.size = filename, modified, size
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.file = targets
+	r.combine()
+}
+
+// combine sets the targets from those of the file and of the API, whose
+// results are dropped along with them. The targets of the API the file
+// lists too are left out. r.mu must be held.
+func (r *targetRunner) combine() {
+	r.targets = slices.Clone(r.file)
+	for _, target := range r.api {
+		if duplicate(r.file, target) {
+			slog.Warn("Ignoring a target of the API listed in the targets file", "target", target.Name)
+			continue
+		}
+		r.targets = append(r.targets, target)
+	}
+	r.prune()
+}
+
+// prune drops the results of the targets no longer listed. r.mu must be
+// held.
+func (r *targetRunner) prune() {
+	keep := map[string]bool{}
+	for _, target := range r.targets {
+		keep[target.key()] = true
+	}
+	for key := range r.results {
+		if !keep[key] {
+			delete(r.results, key)
+			delete(r.succeeded, key)
+		}
+	}
+}
+
+// testDue starts the tests of the targets whose slot came, in the
+// background, and schedules their next test an interval later
+func (r *targetRunner) testDue(ctx context.Context) {
+	schedule := r.manager.current().Schedule.Interval
+	if schedule <= 0 {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stagger(now, schedule)
+	for _, target := range r.targets {
+		key := target.key()
+		next, ok := r.next[key]
+		if !ok || next.After(now) {
+			continue
+		}
+		// A test outlasting the interval skips the missed slots
+		interval := target.interval(schedule)
+		for !next.After(now) {
+			next = next.Add(interval)
+		}
+		r.next[key] = next
+		if r.running[key] {
+			slog.Warn("Skipping the test of a target still running the previous one", "target", target.ServerID, "module", target.Module)
+			continue
+		}
+		r.running[key] = true
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			result := r.test(ctx, target)
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			delete(r.running, key)
+			// The target may have been removed meanwhile
+			if slices.ContainsFunc(r.targets, func(t Target) bool { return t.key() == key }) {
+				r.results[key] = result
+				if result.Error == "" {
+					r.succeeded[key] = result.FinishedAt
+				}
+			}
+		}()
+	}
+}
+
+// stagger computes the slots of the targets, grouped by interval, again
+// only when they or their intervals changed. r.mu must be held.
+func (r *targetRunner) stagger(now time.Time, schedule time.Duration) {
+	order := make([]string, len(r.targets))
+	intervals := make([]time.Duration, len(r.targets))
+	for i, target := range r.targets {
+		order[i] = target.key()
+		intervals[i] = target.interval(schedule)
+	}
+	if slices.Equal(order, r.order) && slices.Equal(intervals, r.staggered) {
+		return
+	}
+	if r.anchor.IsZero() {
+		r.anchor = now
+	}
+	groups := map[time.Duration][]string{}
+	for i, key := range order {
+		groups[intervals[i]] = append(groups[intervals[i]], key)
+	}
+	r.next = map[string]time.Time{}
+	for interval, keys := range groups {
+		for i, slot := range staggerSlots(r.anchor, now, interval, len(keys)) {
+			r.next[keys[i]] = slot
+		}
+	}
+	r.order, r.staggered = order, intervals
+}
+
+// staggerSlots returns the next slots of n targets sharing interval, from
+// now on: the i-th one is i/n of the way through the intervals starting at
+// anchor
+func staggerSlots(anchor, now time.Time, interval time.Duration, n int) []time.Time {
+	slots := make([]time.Time, n)
+	for i := range slots {
+		slot := anchor.Add(time.Duration(int64(interval) * int64(i) / int64(n)))
+		if slot.Before(now) {
+			slot = slot.Add((now.Sub(slot) + interval - 1) / interval * interval)
+		}
+		slots[i] = slot
+	}
+	return slots
+}
+
+// test runs the tests of a target
+func (r *targetRunner) test(ctx context.Context, target Target) *Result {
+	active := r.manager.current()
+	module := active.modules[target.Module]
+	backend := target.backend(module)
+	filter := module.serverFilter()
+	if target.ServerID != "" {
+		filter.IDs = []string{target.ServerID}
+	}
+	if module.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, module.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	result, err := probe(ctx, r.manager.exporter, active, backend, filter, module)
+	if result.Result == nil {
+		result.Result = newResult(start, "", nil)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		slog.Error("Target test failed", "target", target.ServerID, "backend", backend, "module", target.Module, "err", err)
+	}
+	return result.Result
+}
+
+func (t Target) backend(module Module) string {
+	switch {
+	case t.Backend != "":
+		return t.Backend
+	case module.Backend != "":
+		return module.Backend
+	}
+	return "speedtest"
+}
+
+// Describe sends no descriptor, the labels of the target metrics depending
+// on the targets file.
+// It implements prometheus.Collector.
+func (r *targetRunner) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect delivers the last result of each target, and whether it is up,
+// even before its first test. The metrics have the labels of all the
+// targets, those a target doesn't define being empty.
+// It implements prometheus.Collector.
+func (r *targetRunner) Collect(ch chan<- prometheus.Metric) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := map[string]bool{}
+	for _, target := range r.targets {
+		for name := range target.Labels {
+			names[name] = true
+		}
+	}
+	extra := make([]string, 0, len(names))
+	for name := range names {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	base := targetLabels
+	if r.metrics.NoIPLabel {
+		base = base[:len(base)-1]
+	}
+	labels := append(append([]string{}, base...), extra...)
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(r.metrics.Namespace, "target", name), help, labels, nil)
+	}
+	ping := desc("ping", "Latency of the target (ms).")
+	download := desc("download", "Download bandwidth of the target (Mbps).")
+	upload := desc("upload", "Upload bandwidth of the target (Mbps).")
+	success := desc("success", "Whether the last test of the target succeeded.")
+	// The state metrics don't have the ip label, known after a test only
+	stateLabels := append(append([]string{}, targetLabels[:3]...), extra...)
+	stateDesc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(r.metrics.Namespace, "target", name), help, append(labels, stateLabels...), nil)
+	}
+	nextRun := stateDesc("next_run_timestamp_seconds", "Time of the next test of the target, staggered across its interval.")
+	up := stateDesc("up", "Whether the last test of the target succeeded, 0 until its first test.")
+	status := stateDesc("status_info", "The status of the target: not_tested, succeeded or failed.", "status")
+	lastSuccess := stateDesc("last_success_timestamp_seconds", "Completion time of the last successful test of the target.")
+
+	for _, target := range r.targets {
+		backend := target.backend(r.manager.current().modules[target.Module])
+		state := []string{target.ServerID, backend, target.Module}
+		for _, name := range extra {
+			state = append(state, target.Labels[name])
+		}
+		if next, ok := r.next[target.key()]; ok {
+			ch <- prometheus.MustNewConstMetric(nextRun, prometheus.GaugeValue, float64(next.UnixNano())/1e9, state...)
+		}
+		if at, ok := r.succeeded[target.key()]; ok {
+			ch <- prometheus.MustNewConstMetric(lastSuccess, prometheus.GaugeValue, float64(at.UnixNano())/1e9, state...)
+		}
+		result, ok := r.results[target.key()]
+		upValue, statusValue := 0.0, "not_tested"
+		switch {
+		case ok && result.Error == "":
+			upValue, statusValue = 1, "succeeded"
+		case ok:
+			statusValue = "failed"
+		}
+		ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, upValue, state...)
+		ch <- prometheus.MustNewConstMetric(status, prometheus.GaugeValue, 1, append([]string{statusValue}, state...)...)
+		if !ok {
+			continue
+		}
+		values := []string{target.ServerID, backend, target.Module}
+		if !r.metrics.NoIPLabel {
+			values = append(values, result.IP)
+		}
+		for _, name := range extra {
+			values = append(values, target.Labels[name])
+		}
+		collect := func(desc *prometheus.Desc, phase *PhaseResult) {
+			if phase != nil {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, phase.Value, values...)
+			}
+		}
+		collect(ping, result.Ping)
+		collect(download, result.Download)
+		collect(upload, result.Upload)
+		value := 0.0
+		if result.Error == "" {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(success, prometheus.GaugeValue, value, values...)
+	}
+}
+
+var (
+	errTargetExists  = errors.New("a target with the same name, or server, backend and module, already exists")
+	errUnknownTarget = errors.New("unknown target")
+	errFileTarget    = errors.New("the target is listed in the targets file")
+)
+
+// add adds a target of the API, validated as those of the targets file
+func (r *targetRunner) add(target Target) error {
+	if err := target.validate(r.metrics.Labels); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if duplicate(r.targets, target) || duplicate(r.api, target) {
+		return errTargetExists
+	}
+	r.api = append(r.api, target)
+	r.combine()
+	r.manager.exporter.state.setTargets(slices.Clone(r.api))
+	return nil
+}
+
+// remove removes the target of the API named name, whose series disappear
+// with it
+func (r *targetRunner) remove(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.api, func(t Target) bool { return t.Name == name })
+	if i < 0 {
+		if slices.ContainsFunc(r.file, func(t Target) bool { return t.Name == name }) {
+			return errFileTarget
+		}
+		return errUnknownTarget
+	}
+	r.api = slices.Delete(r.api, i, i+1)
+	r.combine()
+	r.manager.exporter.state.setTargets(slices.Clone(r.api))
+	return nil
+}
+
+// list returns the targets of the file and of the API, with their source
+func (r *targetRunner) list() []targetJSON {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	targets := []targetJSON{}
+	for _, target := range r.file {
+		j := target.toJSON()
+		j.Source = "file"
+		targets = append(targets, j)
+	}
+	for _, target := range r.api {
+		j := target.toJSON()
+		j.Source = "api"
+		targets = append(targets, j)
+	}
+	return targets
+}
+
+// targetsHandler serves the targets API: GET /api/v1/targets lists the
+// targets, POST adds one, and DELETE /api/v1/targets/{name} removes one
+// added by POST. The changes require the API token and are saved to the
+// state file, if any.
+type targetsHandler struct {
+	manager *configManager
+	runner  *targetRunner
+}
+
+func (h *targetsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if name := r.PathValue("name"); name != "" {
+		if r.Method != "DELETE" {
+			w.Header().Set("Allow", "DELETE")
+			http.Error(w, "This endpoint requires a DELETE request.", http.StatusMethodNotAllowed)
+			return
+		}
+		requireToken(h.manager, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.remove(w, name)
+		})).ServeHTTP(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]targetJSON{"targets": h.runner.list()})
+	case "POST":
+		requireToken(h.manager, http.HandlerFunc(h.add)).ServeHTTP(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "This endpoint requires a GET or POST request.", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *targetsHandler) add(w http.ResponseWriter, r *http.Request) {
+	var j targetJSON
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&j); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid target: %s", err), http.StatusBadRequest)
+		return
+	}
+	target, err := j.target()
+	if err == nil && target.Name == "" {
+		err = fmt.Errorf("missing name")
+	}
+	active := h.manager.current()
+	if _, ok := active.modules[target.Module]; err == nil && target.Module != "" && !ok {
+		err = fmt.Errorf("unknown module %q", target.Module)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid target: %s", err), http.StatusBadRequest)
+		return
+	}
+	if active.Schedule.Interval <= 0 {
+		http.Error(w, "The targets require schedule.interval.", http.StatusConflict)
+		return
+	}
+	switch err := h.runner.add(target); {
+	case err == errTargetExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Invalid target: %s", err), http.StatusBadRequest)
+		return
+	}
+	slog.Info("Target added", "target", target.Name, "server_id", target.ServerID, "module", target.Module)
+	h.flush()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(target)
+}
+
+func (h *targetsHandler) remove(w http.ResponseWriter, name string) {
+	switch err := h.runner.remove(name); err {
+	case nil:
+	case errUnknownTarget:
+		http.Error(w, fmt.Sprintf("Unknown target %q", name), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	slog.Info("Target removed", "target", name)
+	h.flush()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// flush saves the targets of the API right away, so they survive a crash
+func (h *targetsHandler) flush() {
+	if err := h.manager.exporter.state.flush(); err != nil {
+		slog.Error("Can't write the state file", "err", err)
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadTargets(t *testing.T) {
+	targets, err := loadTargets("targets.yml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[1].Module != "full_hourly" || targets[0].Labels["site"] != "berlin-office" {
+		t.Errorf("Unexpected targets %+v", targets)
+	}
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	filename := filepath.Join(dir, "targets.yml")
+	for content, expected := range map[string]string{
+		"targets:\n  - labels: {site: a}\n":                                          "missing server_id",
+		"targets:\n  - server_id: '1'\n    backend: ftp\n":                           `unknown backend "ftp"`,
+		"targets:\n  - backend: mini\n    server_id: '1'\n":                          "not supported by the mini backend",
+		"targets:\n  - server_id: '1'\n    labels: {target: a}\n":                    `label "target" is already set`,
+		"targets:\n  - server_id: '1'\n    labels: {1site: a}\n":                     "invalid label name",
+		"targets:\n  - server_id: '1'\n  - server_id: '1'\n":                         "Duplicate target 2",
+		"targets:\n  - server_id: '1'\n  - server_id: '1'\n    backend: speedtest\n": "Duplicate target 2",
+		"targets:\n  - server_id: '1'\n    unknown_field: true\n":                    "field unknown_field not found",
+		"targets:\n  - server_id: '1'\n    interval: -1m\n":                          "negative interval",
+	} {
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadTargets(filename, nil); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected error containing %q, got %v", content, expected, err)
+		}
+	}
+
+	// The labels can't override the constant ones
+	if err := ioutil.WriteFile(filename, []byte("targets:\n  - server_id: '1'\n    labels: {site: a}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTargets(filename, labelMap{"site": "b"}); err == nil || !strings.Contains(err.Error(), "already set by metrics.labels") {
+		t.Errorf("Expected a collision with the constant labels, got %v", err)
+	}
+}
+
+func TestTargetRunner(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	filename := filepath.Join(dir, "targets.yml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+targets:
+  - server_id: "1234"
+    labels: {site: berlin}
+  - server_id: "99"
+    labels: {rack: r1}
+`)
+
+	config := defaultConfig()
+	config.Speedtest.ConfigURL = fake.URL + "/config.php"
+	config.Speedtest.ServerURL = fake.URL + "/servers.php"
+	config.Schedule.Interval = time.Hour
+	config.Probe.Only = true
+	config.Probe.TargetsFile = filename
+	manager, err := newConfigManager(nil, config, newExporter(context.Background(), nil, defaultConfig().Metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := newTargetRunner(manager, defaultConfig().Metrics)
+	runner.update()
+	start := time.Now()
+	runner.testDue(context.Background())
+	runner.wg.Wait()
+	// The second target is tested half way through the interval
+	second := runner.targets[1].key()
+	if next := runner.next[second]; next.Sub(start) < 29*time.Minute || next.Sub(start) > 31*time.Minute {
+		t.Errorf("Expected the second target to be tested in 30 minutes, got %s", next.Sub(start))
+	}
+	if metrics := gather(t, runner); !hasSample(metrics, "speedtest_target_next_run_timestamp_seconds", `target="99"}`) || hasSample(metrics, "speedtest_target_success", `target="99"}`) {
+		t.Errorf("Expected the second target to wait for its slot, got:\n%s", metrics)
+	}
+	// The untested target is down
+	if metrics := gather(t, runner); !hasSample(metrics, "speedtest_target_up", `target="99"} 0`) ||
+		!hasSample(metrics, "speedtest_target_status_info", `status="not_tested",target="99"} 1`) ||
+		hasSample(metrics, "speedtest_target_last_success_timestamp_seconds", `target="99"}`) {
+		t.Errorf("Expected the second target to be down until tested, got:\n%s", metrics)
+	}
+	runner.next[second] = time.Now()
+	runner.testDue(context.Background())
+	runner.wg.Wait()
+
+	metrics := gather(t, runner)
+	for name, labels := range map[string]string{
+		"speedtest_target_download":                       `rack="",site="berlin",target="1234"}`,
+		"speedtest_target_upload":                         `rack="r1",site="",target="99"}`,
+		"speedtest_target_success":                        `rack="",site="berlin",target="1234"} 1`,
+		"speedtest_target_up":                             `rack="r1",site="",target="99"} 1`,
+		"speedtest_target_status_info":                    `site="",status="succeeded",target="99"} 1`,
+		"speedtest_target_last_success_timestamp_seconds": `rack="r1",site="",target="99"}`,
+	} {
+		if !hasSample(metrics, name, labels) {
+			t.Errorf("Expected %s with %s, got:\n%s", name, labels, metrics)
+		}
+	}
+
+	// A removed target stops being exported, and the label sets of the
+	// previous file disappear
+	write("targets:\n  - server_id: \"1234\"\n")
+	runner.update()
+	runner.testDue(context.Background())
+	runner.wg.Wait()
+	metrics = gather(t, runner)
+	if strings.Contains(metrics, `target="99"`) || !hasSample(metrics, "speedtest_target_download", `target="1234"}`) {
+		t.Errorf("Expected the results of target 1234 only, got:\n%s", metrics)
+	}
+	if strings.Contains(metrics, "site=") || strings.Contains(metrics, "rack=") {
+		t.Errorf("Expected the labels of the previous file to disappear, got:\n%s", metrics)
+	}
+
+	// The slots are recomputed for the new targets, from the same start
+	write("targets:\n  - server_id: \"1234\"\n  - server_id: \"99\"\n")
+	runner.update()
+	runner.testDue(context.Background())
+	runner.wg.Wait()
+	if next := runner.next[second]; !next.Equal(runner.anchor.Add(30 * time.Minute)) {
+		t.Errorf("Expected the new target to be tested half way through the interval, got %s", next)
+	}
+
+	// A target with its own interval is staggered apart from the others,
+	// from the same start
+	write("targets:\n  - server_id: \"1234\"\n  - server_id: \"99\"\n    interval: 15m\n  - server_id: \"42\"\n    interval: 15m\n")
+	runner.update()
+	runner.testDue(context.Background())
+	runner.wg.Wait()
+	for key, expected := range map[string]time.Duration{
+		runner.targets[0].key(): time.Hour,
+		runner.targets[1].key(): 15 * time.Minute,
+		runner.targets[2].key(): 7*time.Minute + 30*time.Second,
+	} {
+		if next := runner.next[key]; !next.Equal(runner.anchor.Add(expected)) {
+			t.Errorf("Expected %s to be tested %s after the start, got %s", key, expected, next.Sub(runner.anchor))
+		}
+	}
+
+	// An invalid file keeps the previous targets
+	write("targets: [")
+	runner.update()
+	if metrics := gather(t, runner); !strings.Contains(metrics, `target="1234"`) {
+		t.Errorf("Expected the previous targets to be kept, got:\n%s", metrics)
+	}
+}
+
+func TestTargetModules(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	filename := filepath.Join(dir, "targets.yml")
+	if err := ioutil.WriteFile(filename, []byte("targets:\n  - server_id: \"1234\"\n  - server_id: \"1234\"\n    module: ping_only\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := defaultConfig()
+	config.Speedtest.ConfigURL = fake.URL + "/config.php"
+	config.Speedtest.ServerURL = fake.URL + "/servers.php"
+	config.Schedule.Interval = time.Hour
+	config.Probe.Only = true
+	config.Probe.TargetsFile = filename
+	config.Probe.ModulesFile = "probe.yml"
+	manager, err := newConfigManager(nil, config, newExporter(context.Background(), nil, defaultConfig().Metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := newTargetRunner(manager, defaultConfig().Metrics)
+	runner.update()
+	// The targets of a server tested with distinct modules have distinct
+	// series, before and after their tests
+	gather(t, runner)
+	runner.testDue(context.Background())
+	for key := range runner.next {
+		runner.next[key] = time.Now()
+	}
+	runner.testDue(context.Background())
+	runner.wg.Wait()
+	metrics := gather(t, runner)
+	for _, module := range []string{"", "ping_only"} {
+		if labels := `module="` + module + `",target="1234"} 1`; !hasSample(metrics, "speedtest_target_success", labels) {
+			t.Errorf("Expected speedtest_target_success with %s, got:\n%s", labels, metrics)
+		}
+	}
+}
+
+func TestTargetsAPI(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	targetsFile := filepath.Join(dir, "targets.yml")
+	if err := ioutil.WriteFile(targetsFile, []byte("targets:\n  - name: office\n    server_id: \"1234\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stateFile := filepath.Join(dir, "state.json")
+
+	args := []string{"--probe.only", "--speedtest.interval", "1h", "--web.api-token-file", tokenFile, "--probe.targets-file", targetsFile,
+		"--speedtest.config-url", fake.URL + "/config.php", "--speedtest.server-url", fake.URL + "/servers.php"}
+	config, err := parseTestConfig(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := func() (*targetRunner, http.Handler) {
+		state, err := loadState(stateFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager, err := newConfigManager(args, config, newExporter(context.Background(), state, defaultConfig().Metrics))
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager.targets = newTargetRunner(manager, defaultConfig().Metrics)
+		manager.targets.update()
+		return manager.targets, newRouter(config, manager, newRegistry(config, manager))
+	}
+	runner, h := start()
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer s3cret")
+		h.ServeHTTP(w, r)
+		return w
+	}
+	list := func() string {
+		w := get(h, "/api/v1/targets")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 listing the targets, got %d", w.Code)
+		}
+		return strings.TrimSpace(w.Body.String())
+	}
+
+	suspect := `{"name":"suspect","server_id":"99","interval":"15m","labels":{"circuit":"c42"}}`
+	for body, expected := range map[string]int{
+		`{"server_id":"99"}`: http.StatusBadRequest,
+		`{"name":"a","server_id":"99","labels":{"target":"x"}}`: http.StatusBadRequest,
+		`{"name":"a","server_id":"99","module":"missing"}`:      http.StatusBadRequest,
+		`{"name":"a","server_id":"99","interval":"soon"}`:       http.StatusBadRequest,
+		`{"name":"a","server_id":"99","unknown_field":true}`:    http.StatusBadRequest,
+		`{"name":"a","backend":"mini","server_id":"99"}`:        http.StatusBadRequest,
+		`{"name":"office","server_id":"99"}`:                    http.StatusConflict,
+		`{"name":"a","server_id":"1234"}`:                       http.StatusConflict,
+	} {
+		if w := request("POST", "/api/v1/targets", body); w.Code != expected {
+			t.Errorf("%s: expected status %d, got %d: %s", body, expected, w.Code, w.Body.String())
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/targets", strings.NewReader(suspect)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 adding a target without token, got %d", w.Code)
+	}
+	if w := request("POST", "/api/v1/targets", suspect); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201 adding a target, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request("POST", "/api/v1/targets", suspect); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 adding the target again, got %d", w.Code)
+	}
+	expected := `{"targets":[{"name":"office","server_id":"1234","source":"file"},{"name":"suspect","server_id":"99","labels":{"circuit":"c42"},"interval":"15m0s","source":"api"}]}`
+	if targets := list(); targets != expected {
+		t.Errorf("Expected the targets %s, got %s", expected, targets)
+	}
+
+	// The added target is tested and exported like those of the file
+	runner.testDue(context.Background())
+	for key := range runner.next {
+		runner.next[key] = time.Now()
+	}
+	runner.testDue(context.Background())
+	runner.wg.Wait()
+	if metrics := gather(t, runner); !hasSample(metrics, "speedtest_target_success", `circuit="c42",ip="203.0.113.7",module="",target="99"} 1`) {
+		t.Errorf("Expected the added target to be tested, got:\n%s", metrics)
+	}
+
+	// The added target survives a restart
+	if err := runner.manager.exporter.state.flush(); err != nil {
+		t.Fatal(err)
+	}
+	runner, h = start()
+	if targets := list(); targets != expected {
+		t.Errorf("Expected the targets %s after a restart, got %s", expected, targets)
+	}
+
+	if w := request("DELETE", "/api/v1/targets/office", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 removing a target of the file, got %d", w.Code)
+	}
+	if w := request("DELETE", "/api/v1/targets/unknown", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 removing an unknown target, got %d", w.Code)
+	}
+	if w := request("GET", "/api/v1/targets/suspect", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 getting a target, got %d", w.Code)
+	}
+	if w := request("DELETE", "/api/v1/targets/suspect", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204 removing the target, got %d: %s", w.Code, w.Body.String())
+	}
+	if metrics := gather(t, runner); strings.Contains(metrics, `target="99"`) || strings.Contains(metrics, "circuit=") {
+		t.Errorf("Expected the series of the removed target to disappear, got:\n%s", metrics)
+	}
+	runner, h = start()
+	if targets := list(); targets != `{"targets":[{"name":"office","server_id":"1234","source":"file"}]}` {
+		t.Errorf("Expected the removal to be saved, got %s", targets)
+	}
+}
+
+func TestTargetsAPISeries(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	targetsFile := filepath.Join(dir, "targets.yml")
+	if err := ioutil.WriteFile(targetsFile, []byte("targets:\n  - name: office\n    server_id: \"1234\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"--probe.only", "--speedtest.interval", "1h", "--web.api-token-file", tokenFile, "--probe.targets-file", targetsFile,
+		"--probe.modules-file", "probe.yml", "--speedtest.config-url", fake.URL + "/config.php", "--speedtest.server-url", fake.URL + "/servers.php"}
+	config, err := parseTestConfig(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := newConfigManager(args, config, newExporter(context.Background(), nil, defaultConfig().Metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := newTargetRunner(manager, defaultConfig().Metrics)
+	manager.targets = runner
+	runner.update()
+	h := newRouter(config, manager, newRegistry(config, manager, runner))
+	request := func(body string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/targets", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer s3cret")
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// The explicit speedtest backend is that of the target of the file, so
+	// their series would be the same
+	if code := request(`{"name":"explicit","server_id":"1234","backend":"speedtest"}`); code != http.StatusConflict {
+		t.Errorf("Expected status 409 adding the target of the file with its backend, got %d", code)
+	}
+	// Another module tells the series apart
+	if code := request(`{"name":"latency","server_id":"1234","module":"ping_only"}`); code != http.StatusCreated {
+		t.Fatalf("Expected status 201 adding the server with another module, got %d", code)
+	}
+	runner.testDue(context.Background())
+	for key := range runner.next {
+		runner.next[key] = time.Now()
+	}
+	runner.testDue(context.Background())
+	runner.wg.Wait()
+	w := get(h, "/metrics")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 scraping the targets, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, module := range []string{"", "ping_only"} {
+		if labels := `module="` + module + `",target="1234"} 1`; !hasSample(w.Body.String(), "speedtest_target_up", labels) {
+			t.Errorf("Expected speedtest_target_up with %s, got:\n%s", labels, w.Body.String())
+		}
+	}
+}
+
+func TestStaggerSlots(t *testing.T) {
+	anchor := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name     string
+		now      time.Time
+		n        int
+		expected []string
+	}{
+		{"start", anchor, 4, []string{"00:00", "00:15", "00:30", "00:45"}},
+		{"later", anchor.Add(20 * time.Minute), 4, []string{"01:00", "01:15", "00:30", "00:45"}},
+		{"several intervals later", anchor.Add(150 * time.Minute), 3, []string{"03:00", "03:20", "02:40"}},
+		{"single target", anchor.Add(time.Minute), 1, []string{"01:00"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var slots []string
+			for _, slot := range staggerSlots(anchor, test.now, time.Hour, test.n) {
+				slots = append(slots, slot.Format("15:04"))
+			}
+			if strings.Join(slots, " ") != strings.Join(test.expected, " ") {
+				t.Errorf("Expected the slots %v, got %v", test.expected, slots)
+			}
+		})
+	}
+}
+
+// hasSample returns whether the metrics in the text format have a sample of
+// the metric name whose labels end with suffix
+func hasSample(metrics string, name string, suffix string) bool {
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, name+"{") && strings.Contains(line, suffix) {
+			return true
+		}
+	}
+	return false
+}
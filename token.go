@@ -0,0 +1,52 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireToken guards a state-changing endpoint: requests must come from
+// the admin networks, if any, and, when an API token is configured,
+// present it as a bearer token. Requests without token are answered 401,
+// those with a wrong token or from other networks 403.
+func requireToken(manager *configManager, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active := manager.current()
+		if !active.allowlist.allows(active.allowlist.admin, r) {
+			http.Error(w, "Client address not allowed.", http.StatusForbidden)
+			return
+		}
+		token := active.apiToken
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="speedtest_exporter"`)
+			http.Error(w, "This endpoint requires an API token.", http.StatusUnauthorized)
+			return
+		}
+		presented := strings.TrimPrefix(header, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			http.Error(w, "Invalid API token.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
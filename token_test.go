@@ -0,0 +1,96 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	tokenFile := filepath.Join(dir, "token")
+	writeToken := func(token string) {
+		if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeToken("s3cret")
+
+	args := []string{"--probe.only", "--web.api-token-file", tokenFile}
+	config, err := parseTestConfig(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := newConfigManager(args, config, newExporter(context.Background(), nil, defaultConfig().Metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newRouter(config, manager, newRegistry(config, manager))
+	reload := func(header string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/-/reload", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := reload("")
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected status 401 with a challenge without token, got %d", w.Code)
+	}
+	if w := reload("Basic czNjcmV0"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 with basic authentication, got %d", w.Code)
+	}
+	for _, token := range []string{"wrong", "s3cret2", "s3cre"} {
+		if w := reload("Bearer " + token); w.Code != http.StatusForbidden {
+			t.Errorf("%q: expected status 403 with a wrong token, got %d", token, w.Code)
+		}
+	}
+	if w := reload("Bearer s3cret"); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 with the token, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Read-only endpoints don't require the token
+	for _, path := range []string{"/metrics", "/-/healthy", "/-/ready"} {
+		if w := get(h, path); w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", path, w.Code)
+		}
+	}
+
+	// The token is read again on reload
+	writeToken("rotated")
+	if err := manager.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if w := reload("Bearer s3cret"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the previous token to be rejected after reload, got %d", w.Code)
+	}
+	if w := reload("Bearer rotated"); w.Code != http.StatusOK {
+		t.Errorf("Expected the new token to be accepted after reload, got %d", w.Code)
+	}
+
+	writeToken("")
+	if err := manager.reload(); err == nil {
+		t.Error("Expected an error with an empty token file")
+	}
+}
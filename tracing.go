@@ -0,0 +1,164 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nootlp
+
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// tracer exports a trace per test, its root span having a child span per
+// step of the Speedtest client. The setup of the clients, which retrieves
+// the server list and selects the test server, is traced on its own. A nil
+// tracer traces nothing.
+type tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// newTracer returns the tracer of config, nil when tracing is disabled
+func newTracer(config *Config) (*tracer, error) {
+	if config.Tracing.OTLPEndpoint == "" {
+		return nil, nil
+	}
+	exporter, err := newTraceExporter(config.Tracing)
+	if err != nil {
+		return nil, err
+	}
+	return newTracerWith(config, sdktrace.WithBatcher(exporter)), nil
+}
+
+// newTraceExporter returns the gRPC or HTTP exporter of config
+func newTraceExporter(config TracingConfig) (sdktrace.SpanExporter, error) {
+	tlsConfig, err := newTLSConfig(&config.OTLPTLS)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if config.OTLPProtocol == otlpProtocolHTTP {
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(config.OTLPEndpoint),
+			otlptracehttp.WithHeaders(config.OTLPHeaders),
+		}
+		if config.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		} else if tlsConfig != nil {
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsConfig))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	opts := []otlptracegrpc.Option{
+		otlptracegrpc.WithEndpoint(config.OTLPEndpoint),
+		otlptracegrpc.WithHeaders(config.OTLPHeaders),
+	}
+	if config.OTLPInsecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	} else if tlsConfig != nil {
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+// newTracerWith returns a tracer sampling the tests at the ratio of config,
+// its spans going to processor
+func newTracerWith(config *Config, processor sdktrace.TracerProviderOption) *tracer {
+	provider := sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithResource(otlpResource(config)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Tracing.SampleRatio))),
+	)
+	return &tracer{provider: provider, tracer: provider.Tracer("github.com/nlamirault/speedtest_exporter")}
+}
+
+// noTest ends the tests of a nil tracer
+func noTest(*Result) {}
+
+// startTest starts the root span of a test against server, returning the
+// context of the test and the function ending the span with its result
+func (t *tracer) startTest(ctx context.Context, trigger string, link string, server speedtest.Server) (context.Context, func(*Result)) {
+	if t == nil {
+		return ctx, noTest
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("trigger", trigger),
+		attribute.String("server.id", server.ID),
+		attribute.String("server.name", server.Name),
+	}
+	if link != "" {
+		attrs = append(attrs, attribute.String("link", link))
+	}
+	ctx, span := t.tracer.Start(ctx, "speedtest.test", trace.WithAttributes(attrs...))
+	return ctx, func(result *Result) {
+		for phase, r := range map[string]*PhaseResult{speedtest.PhaseDownload: result.Download, speedtest.PhaseUpload: result.Upload} {
+			if r != nil {
+				span.SetAttributes(attribute.Int64(phase+".bytes", r.Bytes))
+			}
+		}
+		if result.Error != "" {
+			span.SetStatus(codes.Error, result.Error)
+		}
+		span.End()
+	}
+}
+
+// step is the Trace of the Speedtest clients, starting a child span per
+// step annotated with its server, measurement and error
+func (t *tracer) step(ctx context.Context, step string) (context.Context, func(speedtest.Step)) {
+	ctx, span := t.tracer.Start(ctx, "speedtest."+step)
+	return ctx, func(s speedtest.Step) {
+		if s.Server != nil {
+			span.SetAttributes(attribute.String("server.id", s.Server.ID))
+		}
+		if m := s.Measurement; m != nil {
+			span.SetAttributes(attribute.Float64("value", m.Value))
+			if step != speedtest.PhasePing {
+				span.SetAttributes(attribute.Int64("bytes", m.Bytes), attribute.Int("streams", m.Streams))
+			}
+		}
+		if s.Err != nil {
+			span.RecordError(s.Err)
+			span.SetStatus(codes.Error, s.Err.Error())
+		}
+		span.End()
+	}
+}
+
+// trace returns the Trace of the Speedtest clients, nil when tracing is
+// disabled so the clients skip it
+func (t *tracer) trace() func(ctx context.Context, step string) (context.Context, func(speedtest.Step)) {
+	if t == nil {
+		return nil
+	}
+	return t.step
+}
+
+// shutdown exports the pending spans
+func (t *tracer) shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build nootlp
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+// tracer traces nothing in the builds without the OpenTelemetry
+// dependencies
+type tracer struct{}
+
+// newTracer fails in the builds without the OpenTelemetry dependencies
+// when tracing is enabled
+func newTracer(config *Config) (*tracer, error) {
+	if config.Tracing.OTLPEndpoint != "" {
+		return nil, fmt.Errorf("this exporter is built without OTLP support, the nootlp build tag being set")
+	}
+	return nil, nil
+}
+
+func (t *tracer) startTest(ctx context.Context, trigger string, link string, server speedtest.Server) (context.Context, func(*Result)) {
+	return ctx, func(*Result) {}
+}
+
+func (t *tracer) trace() func(ctx context.Context, step string) (context.Context, func(speedtest.Step)) {
+	return nil
+}
+
+func (t *tracer) shutdown(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nootlp
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/nlamirault/speedtest_exporter/speedtest"
+)
+
+func TestTracing(t *testing.T) {
+	fake := newFakeSpeedtest()
+	defer fake.Close()
+	config := defaultConfig()
+	config.Speedtest.ConfigURL = fake.URL + "/config.php"
+	config.Speedtest.ServerURL = fake.URL + "/servers.php"
+	recorder := tracetest.NewSpanRecorder()
+	exporter := newExporter(context.Background(), nil, config.Metrics)
+	exporter.tracer = newTracerWith(config, sdktrace.WithSpanProcessor(recorder))
+	client, err := exporter.createClient(&config.Speedtest, speedtest.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := exporter.test(context.Background(), client, triggerSchedule); result.Error != "" {
+		t.Fatal(result.Error)
+	}
+
+	// The configuration is retrieved on setup, and again by the test for
+	// the client address
+	children := map[string]bool{}
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		for _, parent := range recorder.Ended() {
+			if span.Parent().SpanID() == parent.SpanContext().SpanID() {
+				children[parent.Name()+" > "+span.Name()] = true
+			}
+		}
+	}
+	for _, child := range []string{
+		"speedtest.setup > speedtest.config",
+		"speedtest.setup > speedtest.servers",
+		"speedtest.setup > speedtest.selection",
+		"speedtest.test > speedtest.config",
+		"speedtest.test > speedtest.download",
+		"speedtest.test > speedtest.upload",
+		"speedtest.test > speedtest.ping",
+	} {
+		if !children[child] {
+			t.Errorf("Expected the span %s, got %v", child, children)
+		}
+	}
+	if span := spans["speedtest.setup"]; span == nil || span.Parent().IsValid() {
+		t.Errorf("Expected the setup to be traced on its own, got %v", span)
+	}
+	if span := spans["speedtest.test"]; span == nil || span.Parent().IsValid() || span.Status().Code == codes.Error {
+		t.Fatalf("Expected a successful root span, got %v", span)
+	}
+	attrs := map[string]string{}
+	for _, attr := range spans["speedtest.download"].Attributes() {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attrs["server.id"] == "" || attrs["bytes"] == "" || attrs["bytes"] == "0" {
+		t.Errorf("Expected the download span to carry its server and bytes, got %v", attrs)
+	}
+
+	// The failed phases set the status of their span and of the test
+	fake.Close()
+	recorder = tracetest.NewSpanRecorder()
+	exporter.tracer = newTracerWith(config, sdktrace.WithSpanProcessor(recorder))
+	liveClient := client.(liveClient)
+	liveClient.Trace = exporter.tracer.trace()
+	exporter.test(context.Background(), liveClient, triggerSchedule)
+	var failed []string
+	for _, span := range recorder.Ended() {
+		if span.Status().Code == codes.Error {
+			failed = append(failed, span.Name())
+		}
+	}
+	if strings.Join(failed, ",") != "speedtest.config,speedtest.download,speedtest.test" {
+		t.Errorf("Expected the failed steps and the test to be in error, got %v", failed)
+	}
+}
+
+func TestTracingSampleRatio(t *testing.T) {
+	config := defaultConfig()
+	config.Tracing.SampleRatio = 0
+	recorder := tracetest.NewSpanRecorder()
+	sampled := newTracerWith(config, sdktrace.WithSpanProcessor(recorder))
+	ctx, end := sampled.startTest(context.Background(), triggerSchedule, "", speedtest.Server{ID: "1"})
+	_, endStep := sampled.step(ctx, speedtest.PhaseDownload)
+	endStep(speedtest.Step{})
+	end(&Result{})
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Errorf("Expected no span sampled, got %d", len(spans))
+	}
+
+	var disabled *tracer
+	if disabled.trace() != nil {
+		t.Error("Expected no Trace with tracing disabled")
+	}
+	if ctx, _ := disabled.startTest(context.Background(), triggerSchedule, "", speedtest.Server{}); ctx != context.Background() {
+		t.Error("Expected the context of the test to be left as is with tracing disabled")
+	}
+}
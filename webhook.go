@@ -0,0 +1,94 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/nlamirault/speedtest_exporter/version"
+)
+
+// webhookSignatureHeader holds the HMAC-SHA256 of the webhook body, as
+// sha256=<hex digest>
+const webhookSignatureHeader = "X-Speedtest-Signature-256"
+
+// webhookSink posts the JSON result of each test to a webhook, signed with
+// the shared secret when configured
+type webhookSink struct {
+	client *http.Client
+	url    string
+	secret []byte
+}
+
+func newWebhookSink(config *Config) (*webhookSink, error) {
+	s := &webhookSink{
+		client: &http.Client{},
+		url:    config.Webhook.URL,
+	}
+	if config.Webhook.SecretFile != "" {
+		secret, err := readSecretFile(config.Webhook.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		s.secret = []byte(secret)
+	}
+	return s, nil
+}
+
+// signature returns the value of the signature header of body
+func (s *webhookSink) signature(body []byte) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *webhookSink) write(ctx context.Context, result *Result) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return permanentError{err}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "speedtest_exporter/"+version.Version)
+	if s.secret != nil {
+		req.Header.Set(webhookSignatureHeader, s.signature(body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("The webhook answered %s: %s", resp.Status, strings.TrimSpace(string(answer)))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+		return permanentError{err}
+	}
+	return err
+}
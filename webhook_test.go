@@ -0,0 +1,86 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWebhookSink(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	os.WriteFile(secretFile, []byte("shared\n"), 0600)
+
+	var body []byte
+	var signature string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get(webhookSignatureHeader)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	config := defaultConfig()
+	config.Webhook.URL = server.URL
+	config.Webhook.SecretFile = secretFile
+	sink, err := newWebhookSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := &Result{IP: "192.0.2.1", Error: "download failed"}
+	if err := sink.write(context.Background(), failed); err != nil {
+		t.Fatal(err)
+	}
+	var posted Result
+	if err := json.Unmarshal(body, &posted); err != nil || posted.Error != "download failed" {
+		t.Errorf("Unexpected body %s", body)
+	}
+	mac := hmac.New(sha256.New, []byte("shared"))
+	mac.Write(body)
+	if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != expected {
+		t.Errorf("Expected the signature %s, got %s", expected, signature)
+	}
+
+	var permanent permanentError
+	status = http.StatusBadGateway
+	if err := sink.write(context.Background(), failed); err == nil || errors.As(err, &permanent) {
+		t.Errorf("Expected a temporary error, got %v", err)
+	}
+	status = http.StatusNotFound
+	if err := sink.write(context.Background(), failed); !errors.As(err, &permanent) {
+		t.Errorf("Expected a permanent error, got %v", err)
+	}
+
+	config.Webhook.SecretFile = ""
+	if sink, err = newWebhookSink(config); err != nil {
+		t.Fatal(err)
+	}
+	status = http.StatusOK
+	if err := sink.write(context.Background(), failed); err != nil || signature != "" {
+		t.Errorf("Expected an unsigned request, got %q and %v", signature, err)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// windowSample is a test of the window, the values of its missing phases
+// being nil
+type windowSample struct {
+	FinishedAt time.Time `json:"finished_at"`
+	Success    bool      `json:"success"`
+	Download   *float64  `json:"download,omitempty"`
+	Upload     *float64  `json:"upload,omitempty"`
+	Ping       *float64  `json:"ping,omitempty"`
+}
+
+func newWindowSample(result *Result) windowSample {
+	value := func(phase *PhaseResult) *float64 {
+		if phase == nil {
+			return nil
+		}
+		return &phase.Value
+	}
+	return windowSample{
+		FinishedAt: result.FinishedAt,
+		Success:    result.Error == "",
+		Download:   value(result.Download),
+		Upload:     value(result.Upload),
+		Ping:       value(result.Ping),
+	}
+}
+
+// minAnomalySamples is the number of successful tests of the window a
+// result is compared to, the results being never anomalous before
+const minAnomalySamples = 3
+
+// windowDescs describe the aggregates of a measured value
+type windowDescs struct {
+	metric        string
+	avg, min, max *prometheus.Desc
+	value         func(windowSample) *float64
+}
+
+// resultWindow keeps the last tests, saved to the state, and exports the
+// average, minimum and maximum of the measured values over the successful
+// ones. A nil resultWindow exports nothing.
+type resultWindow struct {
+	size  int
+	state *stateStore
+	descs []windowDescs
+	// sizeDesc describes the size of the window
+	sizeDesc *prometheus.Desc
+	// threshold is the deviation from the median of the window, in
+	// percent, beyond which a value is anomalous, zero disabling the
+	// detection
+	threshold     float64
+	anomalousDesc *prometheus.Desc
+
+	mu      sync.Mutex
+	samples []windowSample
+	// anomalous tells whether the values of the last successful test
+	// deviated from the window, by metric
+	anomalous map[string]bool
+}
+
+// newResultWindow returns the window of config, nil when disabled,
+// starting with the tests saved to state
+func newResultWindow(config MetricsConfig, state *stateStore) *resultWindow {
+	if config.Window <= 0 {
+		return nil
+	}
+	w := &resultWindow{
+		size:  config.Window,
+		state: state,
+		sizeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "window_size"),
+			"Number of recent tests the window aggregates are computed over.",
+			nil, nil,
+		),
+		threshold: config.AnomalyThreshold,
+		anomalousDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "result_anomalous"),
+			"Whether the value of the last successful test deviates from the median of the window by more than the anomaly threshold.",
+			[]string{"metric"}, nil,
+		),
+		anomalous: map[string]bool{},
+	}
+	for _, m := range []struct {
+		name, unit string
+		value      func(windowSample) *float64
+	}{
+		{"download", "Mbps", func(s windowSample) *float64 { return s.Download }},
+		{"upload", "Mbps", func(s windowSample) *float64 { return s.Upload }},
+		{"ping", "ms", func(s windowSample) *float64 { return s.Ping }},
+	} {
+		desc := func(aggregate, help string) *prometheus.Desc {
+			return prometheus.NewDesc(
+				prometheus.BuildFQName(config.Namespace, "", m.name+"_window_"+aggregate),
+				help+" of the "+m.name+" of the successful recent tests ("+m.unit+").",
+				nil, nil,
+			)
+		}
+		w.descs = append(w.descs, windowDescs{
+			metric: m.name,
+			avg:    desc("avg", "Average"),
+			min:    desc("min", "Minimum"),
+			max:    desc("max", "Maximum"),
+			value:  m.value,
+		})
+	}
+	w.samples = state.window()
+	if len(w.samples) > w.size {
+		w.samples = w.samples[len(w.samples)-w.size:]
+	}
+	return w
+}
+
+// add adds the test of result to the window, evicting the oldest one when
+// full. It returns whether a value of the successful test is anomalous
+// compared to the previous ones of the window.
+func (w *resultWindow) add(result *Result) bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sample := newWindowSample(result)
+	anomalous := false
+	if sample.Success && w.threshold > 0 {
+		for _, d := range w.descs {
+			value := d.value(sample)
+			if value == nil {
+				delete(w.anomalous, d.metric)
+				continue
+			}
+			w.anomalous[d.metric] = isAnomalous(w.values(d), *value, w.threshold)
+			anomalous = anomalous || w.anomalous[d.metric]
+		}
+	}
+	w.samples = append(w.samples, sample)
+	if len(w.samples) > w.size {
+		w.samples = w.samples[len(w.samples)-w.size:]
+	}
+	w.state.setWindow(append([]windowSample{}, w.samples...))
+	return anomalous
+}
+
+// values returns the values of d of the successful tests of the window.
+// w.mu must be held.
+func (w *resultWindow) values(d windowDescs) []float64 {
+	var values []float64
+	for _, s := range w.samples {
+		if value := d.value(s); s.Success && value != nil {
+			values = append(values, *value)
+		}
+	}
+	return values
+}
+
+// isAnomalous tells whether value deviates from the median of the trailing
+// values by more than threshold percent. A value is never anomalous
+// compared to less than minAnomalySamples values, or to a zero median.
+func isAnomalous(trailing []float64, value, threshold float64) bool {
+	if len(trailing) < minAnomalySamples {
+		return false
+	}
+	m := median(trailing)
+	if m == 0 {
+		return false
+	}
+	return math.Abs(value-m)/math.Abs(m)*100 > threshold
+}
+
+// median returns the median of values, which must not be empty
+func median(values []float64) float64 {
+	sorted := slices.Sorted(slices.Values(values))
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+func (w *resultWindow) Describe(ch chan<- *prometheus.Desc) {
+	if w == nil {
+		return
+	}
+	ch <- w.sizeDesc
+	if w.threshold > 0 {
+		ch <- w.anomalousDesc
+	}
+	for _, d := range w.descs {
+		ch <- d.avg
+		ch <- d.min
+		ch <- d.max
+	}
+}
+
+func (w *resultWindow) Collect(ch chan<- prometheus.Metric) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(w.sizeDesc, prometheus.GaugeValue, float64(w.size))
+	for _, d := range w.descs {
+		anomalous, ok := w.anomalous[d.metric]
+		if !ok {
+			continue
+		}
+		value := 0.0
+		if anomalous {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(w.anomalousDesc, prometheus.GaugeValue, value, d.metric)
+	}
+	for _, d := range w.descs {
+		var sum float64
+		var n int
+		min, max := math.Inf(1), math.Inf(-1)
+		for _, s := range w.samples {
+			value := d.value(s)
+			if !s.Success || value == nil {
+				continue
+			}
+			sum += *value
+			n++
+			min = math.Min(min, *value)
+			max = math.Max(max, *value)
+		}
+		if n == 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(d.avg, prometheus.GaugeValue, sum/float64(n))
+		ch <- prometheus.MustNewConstMetric(d.min, prometheus.GaugeValue, min)
+		ch <- prometheus.MustNewConstMetric(d.max, prometheus.GaugeValue, max)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2016, 2017 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResultWindow(t *testing.T) {
+	config := defaultConfig().Metrics
+	if newResultWindow(config, nil) != nil {
+		t.Fatal("Expected no window by default")
+	}
+	config.Window = 3
+	state, err := loadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newResultWindow(config, state)
+	for _, result := range []*Result{
+		{Download: &PhaseResult{Value: 10}, Upload: &PhaseResult{Value: 1}, Ping: &PhaseResult{Value: 50}},
+		{Download: &PhaseResult{Value: 90}, Upload: &PhaseResult{Value: 9}, Ping: &PhaseResult{Value: 10}},
+		// The failed tests count in the window, without their values
+		{Download: &PhaseResult{Value: 5}, Ping: &PhaseResult{Value: 100}, Error: "upload failed"},
+		{Download: &PhaseResult{Value: 60}, Upload: &PhaseResult{Value: 3}, Ping: &PhaseResult{Value: 20}},
+	} {
+		w.add(result)
+	}
+	expected := `
+# HELP speedtest_download_window_avg Average of the download of the successful recent tests (Mbps).
+# TYPE speedtest_download_window_avg gauge
+speedtest_download_window_avg 75
+# HELP speedtest_download_window_max Maximum of the download of the successful recent tests (Mbps).
+# TYPE speedtest_download_window_max gauge
+speedtest_download_window_max 90
+# HELP speedtest_download_window_min Minimum of the download of the successful recent tests (Mbps).
+# TYPE speedtest_download_window_min gauge
+speedtest_download_window_min 60
+# HELP speedtest_ping_window_avg Average of the ping of the successful recent tests (ms).
+# TYPE speedtest_ping_window_avg gauge
+speedtest_ping_window_avg 15
+# HELP speedtest_window_size Number of recent tests the window aggregates are computed over.
+# TYPE speedtest_window_size gauge
+speedtest_window_size 3
+`
+	if err := testutil.CollectAndCompare(w, strings.NewReader(expected), "speedtest_download_window_avg", "speedtest_download_window_min", "speedtest_download_window_max", "speedtest_ping_window_avg", "speedtest_window_size"); err != nil {
+		t.Error(err)
+	}
+
+	// The window is restored from the state, within the new size
+	if err := state.flush(); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := loadState(state.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Window = 1
+	w = newResultWindow(config, restored)
+	if len(w.samples) != 1 || *w.samples[0].Download != 60 {
+		t.Errorf("Expected the last test of the state, got %+v", w.samples)
+	}
+}
+
+func TestIsAnomalous(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		trailing  []float64
+		value     float64
+		anomalous bool
+	}{
+		{"too few samples", []float64{100, 100}, 1, false},
+		{"steady", []float64{100, 95, 105, 98}, 101, false},
+		{"drop", []float64{100, 95, 105, 98}, 40, true},
+		{"spike", []float64{20, 22, 19}, 35, true},
+		{"within threshold", []float64{100, 100, 100}, 150, false},
+		{"median ignores an outlier", []float64{100, 5, 102, 98, 101}, 99, false},
+		{"even count", []float64{10, 20, 30, 40}, 37.4, false},
+		{"zero median", []float64{0, 0, 0}, 10, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if anomalous := isAnomalous(test.trailing, test.value, 50); anomalous != test.anomalous {
+				t.Errorf("Expected anomalous %t for %v against %v, got %t", test.anomalous, test.value, test.trailing, anomalous)
+			}
+		})
+	}
+}
+
+func TestResultWindowAnomalies(t *testing.T) {
+	config := defaultConfig().Metrics
+	config.Window = 5
+	config.AnomalyThreshold = 50
+	w := newResultWindow(config, nil)
+	for _, download := range []float64{100, 90, 110} {
+		if w.add(&Result{Download: &PhaseResult{Value: download}, Ping: &PhaseResult{Value: 10}}) {
+			t.Errorf("Unexpected anomaly of %v before %d tests", download, minAnomalySamples)
+		}
+	}
+	// The failed tests are not compared
+	if w.add(&Result{Download: &PhaseResult{Value: 1}, Error: "upload failed"}) {
+		t.Error("Unexpected anomaly of a failed test")
+	}
+	if !w.add(&Result{Download: &PhaseResult{Value: 20}, Ping: &PhaseResult{Value: 11}}) {
+		t.Error("Expected an anomalous download")
+	}
+	expected := `
+# HELP speedtest_result_anomalous Whether the value of the last successful test deviates from the median of the window by more than the anomaly threshold.
+# TYPE speedtest_result_anomalous gauge
+speedtest_result_anomalous{metric="download"} 1
+speedtest_result_anomalous{metric="ping"} 0
+`
+	if err := testutil.CollectAndCompare(w, strings.NewReader(expected), "speedtest_result_anomalous"); err != nil {
+		t.Error(err)
+	}
+}